@@ -0,0 +1,86 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/rancher/elemental-toolkit/v2/cmd/config"
+	"github.com/rancher/elemental-toolkit/v2/pkg/action"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+// NewActivateCmd returns a new instance of the activate subcommand and appends it to
+// the root command. requireRoot is to initiate it with or without the CheckRoot
+// pre-run check. This method is mostly used for testing purposes.
+func NewActivateCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "activate SNAPSHOT",
+		Short: "Makes the given passive snapshot the active one from the next boot on",
+		Long: "Makes the given passive snapshot the active one from the next boot on\n\n" +
+			"The snapshot must be bootable: its image matches the checksum recorded in the\n" +
+			"installation state, if any, and it includes a kernel and an initrd. Only the\n" +
+			"loopdevice snapshotter supports it.",
+		Args: cobra.ExactArgs(1),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			if addCheckRoot {
+				return CheckRoot()
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := strconv.Atoi(args[0])
+			if err != nil || id <= 0 {
+				return elementalError.New(fmt.Sprintf("invalid snapshot ID '%s'", args[0]), elementalError.ActivateSnapshot)
+			}
+
+			path, err := exec.LookPath("mount")
+			if err != nil {
+				return err
+			}
+			mounter := types.NewMounter(path)
+
+			cfg, err := config.ReadConfigRun(viper.GetString("config-dir"), cmd.Flags(), mounter)
+			if err != nil {
+				cfg.Logger.Errorf("Error reading config: %s\n", err)
+				return elementalError.NewFromError(err, elementalError.ReadingRunConfig)
+			}
+
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true // Do not propagate errors down the line, we control them
+
+			err = action.Activate(cfg, id)
+			if err != nil {
+				cfg.Logger.Errorf("activate command failed: %v", err)
+			}
+			return err
+		},
+	}
+	root.AddCommand(c)
+	c.Flags().Bool("reboot", false, "Reboot after activating the snapshot")
+	c.Flags().Bool("poweroff", false, "Shutdown after activating the snapshot")
+	return c
+}
+
+// register the subcommand into rootCmd
+var _ = NewActivateCmd(rootCmd, true)
@@ -96,9 +96,7 @@ func NewBuildDisk(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 	}
 	root.AddCommand(c)
 	imgType := newEnumFlag([]string{constants.RawType, constants.AzureType, constants.GCEType}, constants.RawType)
-	c.Flags().StringP("name", "n", "", "Basename of the generated disk file")
-	c.Flags().StringP("output", "o", "", "Output directory (defaults to current directory)")
-	c.Flags().Bool("date", false, "Adds a date suffix into the generated disk file")
+	addOutputFlags(c, "disk")
 	c.Flags().Bool("expandable", false, "Creates an expandable image including only the recovery image")
 	c.Flags().VarP(imgType, "type", "t", "Type of image to create")
 	c.Flags().StringSliceP("cloud-init", "c", []string{}, "Cloud-init config files to include in disk")
@@ -138,9 +138,7 @@ func NewBuildISO(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 	firmType := newEnumFlag([]string{types.EFI}, types.EFI)
 
 	root.AddCommand(c)
-	c.Flags().StringP("name", "n", "", "Basename of the generated ISO file")
-	c.Flags().StringP("output", "o", "", "Output directory (defaults to current directory)")
-	c.Flags().Bool("date", false, "Adds a date suffix into the generated ISO file")
+	addOutputFlags(c, "ISO")
 	c.Flags().String("overlay-rootfs", "", "Path of the overlayed rootfs data")
 	c.Flags().String("overlay-uefi", "", "Path of the overlayed uefi data")
 	c.Flags().String("overlay-iso", "", "Path of the overlayed iso data")
@@ -0,0 +1,83 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"os/exec"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/rancher/elemental-toolkit/v2/cmd/config"
+	"github.com/rancher/elemental-toolkit/v2/pkg/action"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+// NewCaptureCmd returns a new instance of the capture subcommand and appends it to
+// the root command. requireRoot is to initiate it with or without the CheckRoot
+// pre-run check. This method is mostly used for testing purposes.
+func NewCaptureCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "capture OUTPUT",
+		Short: "Captures the running system into an image usable as an install or upgrade source",
+		Long: "Captures the running active system into the OUTPUT filesystem image, which can be\n" +
+			"used as a 'file:' system source of install and upgrade, or into the OUTPUT tarball,\n" +
+			"which can be used as an upgrade '--from-file' artifact. Volatile and host specific\n" +
+			"paths are left out, as well as the paths matching the configured capture excludes.",
+		Args: cobra.ExactArgs(1),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			if addCheckRoot {
+				return CheckRoot()
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path, err := exec.LookPath("mount")
+			if err != nil {
+				return err
+			}
+			mounter := types.NewMounter(path)
+
+			cfg, err := config.ReadConfigRun(viper.GetString("config-dir"), cmd.Flags(), mounter)
+			if err != nil {
+				cfg.Logger.Errorf("Error reading config: %s\n", err)
+				return elementalError.NewFromError(err, elementalError.ReadingRunConfig)
+			}
+
+			cmd.SilenceUsage = true
+			spec, err := config.ReadCaptureSpec(cfg, cmd.Flags())
+			if err != nil {
+				cfg.Logger.Errorf("Error reading spec: %s\n", err)
+				return elementalError.NewFromError(err, elementalError.ReadingSpecConfig)
+			}
+
+			cmd.SilenceErrors = true // Do not propagate errors down the line, we control them
+			err = action.Capture(cfg, spec, args[0])
+			if err != nil {
+				cfg.Logger.Errorf("capture command failed: %v", err)
+			}
+			return err
+		},
+	}
+	root.AddCommand(c)
+	c.Flags().String("fs", "squashfs", "Filesystem of the captured image (squashfs, ext2, ext3 or ext4) or tar for a tarball")
+	return c
+}
+
+// register the subcommand into rootCmd
+var _ = NewCaptureCmd(rootCmd, true)
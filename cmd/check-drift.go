@@ -0,0 +1,91 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"os/exec"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+
+	"github.com/rancher/elemental-toolkit/v2/cmd/config"
+	"github.com/rancher/elemental-toolkit/v2/pkg/action"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+// NewCheckDriftCmd returns a new instance of the check-drift subcommand and appends it to
+// the root command. requireRoot is to initiate it with or without the CheckRoot
+// pre-run check. This method is mostly used for testing purposes.
+func NewCheckDriftCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "check-drift",
+		Short: "Compares the active image with its source and prints a report of the changed files",
+		Args:  cobra.ExactArgs(0),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			if addCheckRoot {
+				return CheckRoot()
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			viper.SetDefault("quiet", true) // Prevents any other writes to stdout
+			path, err := exec.LookPath("mount")
+			if err != nil {
+				return err
+			}
+			mounter := types.NewMounter(path)
+
+			cfg, err := config.ReadConfigRun(viper.GetString("config-dir"), cmd.Flags(), mounter)
+			if err != nil {
+				cfg.Logger.Errorf("Error reading config: %s\n", err)
+				return elementalError.NewFromError(err, elementalError.ReadingRunConfig)
+			}
+
+			err = validateCosignFlags(cfg.Logger, cmd.Flags())
+			if err != nil {
+				return elementalError.NewFromError(err, elementalError.CosignWrongFlags)
+			}
+
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true // Do not propagate errors down the line, we control them
+
+			report, err := action.CompareInstalledToSource(cfg)
+			if report != nil {
+				reportBytes, mErr := yaml.Marshal(report)
+				if mErr == nil {
+					_, mErr = cmd.OutOrStdout().Write(reportBytes)
+				}
+				if mErr != nil {
+					cfg.Logger.Errorf("Error writing drift report on stdout: %s\n", mErr)
+				}
+			}
+			if err != nil {
+				cfg.Logger.Errorf("check-drift command failed: %v", err)
+			}
+			return err
+		},
+	}
+	root.AddCommand(c)
+	addCosignFlags(c)
+	addLocalImageFlag(c)
+	return c
+}
+
+// register the subcommand into rootCmd
+var _ = NewCheckDriftCmd(rootCmd, true)
@@ -17,6 +17,8 @@ limitations under the License.
 package config
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -25,11 +27,13 @@ import (
 	"reflect"
 	"strings"
 
+	"github.com/hashicorp/go-multierror"
 	"github.com/mitchellh/mapstructure"
 	"github.com/sanity-io/litter"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
 
 	"github.com/rancher/elemental-toolkit/v2/internal/version"
 	"github.com/rancher/elemental-toolkit/v2/pkg/config"
@@ -42,6 +46,7 @@ var decodeHook = viper.DecodeHook(
 	mapstructure.ComposeDecodeHookFunc(
 		UnmarshalerHook(),
 		KeyValuePairHook(),
+		types.SizeHookFromData,
 		mapstructure.StringToTimeDurationHookFunc(),
 		mapstructure.StringToSliceHookFunc(","),
 	),
@@ -129,7 +134,9 @@ func ReadConfigBuild(configDir string, flags *pflag.FlagSet, mounter types.Mount
 	}
 
 	// merge yaml config files on top of default runconfig
+	cfgFiles := []string{}
 	if exists, _ := utils.Exists(cfg.Fs, filepath.Join(configDir, "manifest.yaml")); exists {
+		cfgFiles = append(cfgFiles, filepath.Join(configDir, "manifest.yaml"))
 		viper.AddConfigPath(configDir)
 		viper.SetConfigType("yaml")
 		viper.SetConfigName("manifest")
@@ -152,6 +159,14 @@ func ReadConfigBuild(configDir string, flags *pflag.FlagSet, mounter types.Mount
 		cfg.Logger.Warnf("error unmarshalling config: %s", err)
 	}
 
+	if cfg.FailOnUnknownKeys {
+		err = checkUnknownKeys(cfg.Fs, cfgFiles, reflect.TypeOf(*cfg), buildConfigSections)
+		if err != nil {
+			cfg.Logger.Errorf("invalid config files: %s", err)
+			return cfg, err
+		}
+	}
+
 	err = cfg.Sanitize()
 	cfg.Logger.Debugf("Full config loaded: %s", litter.Sdump(cfg))
 	return cfg, err
@@ -161,6 +176,7 @@ func ReadConfigRun(configDir string, flags *pflag.FlagSet, mounter types.Mounter
 	cfg := config.NewRunConfig(
 		config.WithLogger(types.NewLogger()),
 		config.WithMounter(mounter),
+		config.WithRunner(&types.RealRunner{TraceFile: constants.CommandTraceFile}),
 		config.WithOCIImageExtractor(),
 	)
 	configLogger(cfg.Logger, cfg.Fs)
@@ -182,7 +198,9 @@ func ReadConfigRun(configDir string, flags *pflag.FlagSet, mounter types.Mounter
 	}
 
 	// merge yaml config files on top of default runconfig
+	cfgFiles := []string{}
 	if exists, _ := utils.Exists(cfg.Fs, filepath.Join(configDir, "config.yaml")); exists {
+		cfgFiles = append(cfgFiles, filepath.Join(configDir, "config.yaml"))
 		viper.AddConfigPath(configDir)
 		viper.SetConfigType("yaml")
 		viper.SetConfigName("config")
@@ -198,8 +216,9 @@ func ReadConfigRun(configDir string, flags *pflag.FlagSet, mounter types.Mounter
 	cfgExtra := filepath.Join(configDir, "config.d")
 	if exists, _ := utils.Exists(cfg.Fs, cfgExtra); exists {
 		viper.AddConfigPath(cfgExtra)
-		err := filepath.WalkDir(cfgExtra, func(_ string, d fs.DirEntry, _ error) error {
+		err := filepath.WalkDir(cfgExtra, func(path string, d fs.DirEntry, _ error) error {
 			if !d.IsDir() && filepath.Ext(d.Name()) == ".yaml" {
+				cfgFiles = append(cfgFiles, path)
 				viper.SetConfigType("yaml")
 				viper.SetConfigName(strings.TrimSuffix(d.Name(), ".yaml"))
 				return viper.MergeInConfig()
@@ -224,6 +243,14 @@ func ReadConfigRun(configDir string, flags *pflag.FlagSet, mounter types.Mounter
 		cfg.Logger.Warnf("error unmarshalling RunConfig: %s", err)
 	}
 
+	if cfg.FailOnUnknownKeys {
+		err = checkUnknownKeys(cfg.Fs, cfgFiles, reflect.TypeOf(*cfg), runConfigSections)
+		if err != nil {
+			cfg.Logger.Errorf("invalid config files: %s", err)
+			return cfg, err
+		}
+	}
+
 	err = cfg.Sanitize()
 	cfg.Logger.Debugf("Full config loaded: %s", litter.Sdump(cfg))
 	return cfg, err
@@ -244,11 +271,88 @@ func ReadInstallSpec(r *types.RunConfig, flags *pflag.FlagSet) (*types.InstallSp
 	if err != nil {
 		r.Logger.Warnf("error unmarshalling InstallSpec: %s", err)
 	}
+
+	if install.System.IsDir() {
+		merged, err := mergeImageDefaults(r, vp, install.System.Value())
+		if err != nil {
+			return install, err
+		}
+		if merged != nil {
+			install = config.NewInstallSpec(r.Config)
+			err = merged.Unmarshal(install, setDecoder, decodeHook)
+			if err != nil {
+				r.Logger.Warnf("error unmarshalling InstallSpec: %s", err)
+			}
+		}
+	}
+
 	err = install.Sanitize()
 	r.Logger.Debugf("Loaded install spec: %s", litter.Sdump(install))
 	return install, err
 }
 
+// mergeImageDefaults returns the install settings of the given viper instance merged on top
+// of the install section of the defaults file shipped by the directory source, if any. Any
+// setting of the user, from config files, environment variables or flags, takes precedence
+// over the image defaults. Returns nil if the source does not ship a defaults file.
+func mergeImageDefaults(r *types.RunConfig, vp *viper.Viper, source string) (*viper.Viper, error) {
+	file := filepath.Join(source, constants.ImageDefaultsFile)
+	data, err := r.Fs.ReadFile(file)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			r.Logger.Warnf("failed reading image defaults %s: %s", file, err)
+		}
+		return nil, nil
+	}
+
+	defaults := viper.New()
+	defaults.SetConfigType("yaml")
+	err = defaults.ReadConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing image defaults %s: %w", file, err)
+	}
+	section := defaults.Sub("install")
+	if section == nil {
+		return nil, nil
+	}
+	r.Logger.Infof("Applying install defaults of the image from %s", file)
+
+	// Sources are chosen by the user, the image can't redirect them
+	settings := section.AllSettings()
+	delete(settings, "system")
+	delete(settings, "recovery-system")
+
+	merged := viper.New()
+	err = merged.MergeConfigMap(settings)
+	if err == nil {
+		err = merged.MergeConfigMap(vp.AllSettings())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed merging image defaults %s: %w", file, err)
+	}
+	return merged, nil
+}
+
+func ReadCaptureSpec(r *types.RunConfig, flags *pflag.FlagSet) (*types.CaptureSpec, error) {
+	capture := config.NewCaptureSpec()
+	vp := viper.Sub("capture")
+	if vp == nil {
+		vp = viper.New()
+	}
+	// Bind capture cmd flags
+	bindGivenFlags(vp, flags)
+	// Bind capture env vars
+	viperReadEnv(vp, "CAPTURE", constants.GetCaptureKeyEnvMap())
+
+	err := vp.Unmarshal(capture, setDecoder, decodeHook)
+	if err != nil {
+		r.Logger.Warnf("error unmarshalling CaptureSpec: %s", err)
+	}
+	err = capture.Sanitize()
+	r.Logger.Debugf("Loaded capture spec: %s", litter.Sdump(capture))
+	return capture, err
+}
+
 func ReadInitSpec(r *types.RunConfig, flags *pflag.FlagSet) (*types.InitSpec, error) {
 	init := config.NewInitSpec()
 	vp := viper.Sub("init")
@@ -575,3 +679,146 @@ func viperReadEnv(vp *viper.Viper, prefix string, keyMap map[string]string) {
 		_ = vp.BindEnv(k, fmt.Sprintf("%s_%s", prefix, v))
 	}
 }
+
+// rootKeys are the keys bound to root command flags, valid in any config file
+var rootKeys = []string{"debug", "config-dir", "logfile", "quiet"}
+
+// runConfigSections maps the config.yaml sections to the spec each one is unmarshalled to
+var runConfigSections = map[string]reflect.Type{
+	"install": reflect.TypeOf(types.InstallSpec{}),
+	"capture": reflect.TypeOf(types.CaptureSpec{}),
+	"init":    reflect.TypeOf(types.InitSpec{}),
+	"mount":   reflect.TypeOf(types.MountSpec{}),
+	"reset":   reflect.TypeOf(types.ResetSpec{}),
+	"upgrade": reflect.TypeOf(types.UpgradeSpec{}),
+}
+
+// buildConfigSections maps the manifest.yaml sections to the spec each one is unmarshalled to
+var buildConfigSections = map[string]reflect.Type{
+	"iso":  reflect.TypeOf(types.LiveISO{}),
+	"disk": reflect.TypeOf(types.DiskSpec{}),
+}
+
+// checkUnknownKeys parses the given yaml files and returns an error listing, with their
+// line numbers, all the keys not matching any field of the given config type or sections
+func checkUnknownKeys(vfs types.FS, files []string, cfgType reflect.Type, sections map[string]reflect.Type) error {
+	var errs error
+
+	keys := structKeys(cfgType)
+	for name, t := range sections {
+		keys[name] = t
+	}
+	for _, key := range rootKeys {
+		keys[key] = reflect.TypeOf("")
+	}
+
+	for _, file := range files {
+		data, err := vfs.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var doc yaml.Node
+		err = yaml.Unmarshal(data, &doc)
+		if err != nil {
+			return fmt.Errorf("failed parsing %s: %w", file, err)
+		}
+		if len(doc.Content) == 0 {
+			continue
+		}
+		errs = multierror.Append(errs, checkNodeKeys(file, "", doc.Content[0], keys)).ErrorOrNil()
+	}
+	return errs
+}
+
+// checkNodeKeys checks the keys of the given mapping node against the given keys
+func checkNodeKeys(file, prefix string, node *yaml.Node, keys map[string]reflect.Type) error {
+	var errs error
+
+	if node.Kind != yaml.MappingNode {
+		// Type mismatches are reported by the decoder
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		if key.Value == "<<" {
+			// yaml merge keys are resolved by the parser
+			continue
+		}
+		name := strings.ToLower(key.Value)
+		t, ok := keys[name]
+		if !ok {
+			errs = multierror.Append(errs, fmt.Errorf("unknown key '%s%s' in %s line %d", prefix, key.Value, file, key.Line))
+			continue
+		}
+		err := checkValueKeys(file, prefix+key.Value, node.Content[i+1], t)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+// checkValueKeys checks the keys of the given node value of the given type
+func checkValueKeys(file, path string, node *yaml.Node, t reflect.Type) error {
+	var errs error
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	// Types with custom unmarshalers do not map yaml keys to fields
+	if reflect.PointerTo(t).Implements(reflect.TypeOf((*Unmarshaler)(nil)).Elem()) {
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		return checkNodeKeys(file, path+".", node, structKeys(t))
+	case reflect.Slice, reflect.Array:
+		if node.Kind != yaml.SequenceNode {
+			return nil
+		}
+		for i, item := range node.Content {
+			err := checkValueKeys(file, fmt.Sprintf("%s[%d]", path, i), item, t.Elem())
+			if err != nil {
+				errs = multierror.Append(errs, err)
+			}
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return nil
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			err := checkValueKeys(file, fmt.Sprintf("%s.%s", path, node.Content[i].Value), node.Content[i+1], t.Elem())
+			if err != nil {
+				errs = multierror.Append(errs, err)
+			}
+		}
+	}
+	return errs
+}
+
+// structKeys returns the keys mapstructure decodes into the given struct type
+func structKeys(t reflect.Type) map[string]reflect.Type {
+	keys := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+		if name == "-" {
+			continue
+		}
+		if strings.Contains(opts, "squash") {
+			for k, v := range structKeys(field.Type) {
+				keys[k] = v
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		keys[strings.ToLower(name)] = field.Type
+	}
+	return keys
+}
@@ -78,6 +78,28 @@ var _ = Describe("Config", Label("config"), func() {
 		})
 	})
 
+	Describe("read image sources with credentials", Label("install", "auth"), func() {
+		It("reads the credentials of each source", func() {
+			cfg, err := ReadConfigRun("fixtures/auth/", nil, mounter)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			inst, err := ReadInstallSpec(cfg, nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(inst.System.Value()).To(Equal("registry.org/elemental/os:v1"))
+			Expect(inst.System.GetAuth()).To(Equal(&types.RegistryAuth{Token: "token"}))
+			Expect(inst.RecoverySystem.Source.Value()).To(Equal("registry.org/elemental/recovery:v1"))
+			Expect(inst.RecoverySystem.Source.GetAuth()).To(Equal(&types.RegistryAuth{Username: "user", Password: "secret"}))
+		})
+		It("reads the HTTP headers", Label("http-headers"), func() {
+			cfg, err := ReadConfigRun("fixtures/auth/", nil, mounter)
+			Expect(err).ShouldNot(HaveOccurred())
+			// Header names are case insensitive, keys are lowercased when read
+			Expect(cfg.HTTPHeaders).To(Equal(types.HTTPHeaderScopes{{
+				URL: "https://artifacts.example.com", Headers: types.HTTPHeaders{"authorization": "Bearer token"},
+			}}))
+		})
+	})
+
 	Describe("Build config with arch", Label("build"), func() {
 		var flags *pflag.FlagSet
 		BeforeEach(func() {
@@ -292,6 +314,32 @@ var _ = Describe("Config", Label("config"), func() {
 			Expect(cfg.Snapshotter.Type).To(Equal(constants.LoopDeviceSnapshotterType))
 			Expect(cfg.Snapshotter.MaxSnaps).To(Equal(42))
 		})
+		It("reads the registry mirror from environment variables", func() {
+			Expect(os.Setenv("ELEMENTAL_REGISTRY_MIRROR", "mirror.local:5000")).To(Succeed())
+			defer os.Unsetenv("ELEMENTAL_REGISTRY_MIRROR")
+
+			cfg, err := ReadConfigRun("fixtures/config/", nil, mounter)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(cfg.RegistryMirror).To(Equal("mirror.local:5000"))
+		})
+		It("ignores unknown keys by default", Label("unknown-keys"), func() {
+			cfg, err := ReadConfigRun("fixtures/unknownkeys/", nil, mounter)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(cfg.Cosign).To(BeTrue())
+		})
+		It("fails on unknown keys if fail-on-unknown-keys is set", Label("unknown-keys"), func() {
+			Expect(os.Setenv("ELEMENTAL_FAIL_ON_UNKNOWN_KEYS", "true")).To(Succeed())
+			defer os.Unsetenv("ELEMENTAL_FAIL_ON_UNKNOWN_KEYS")
+
+			_, err := ReadConfigRun("fixtures/unknownkeys/", nil, mounter)
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("unknown key 'install.dockerimg' in fixtures/unknownkeys/config.yaml line 5"))
+			Expect(err.Error()).To(ContainSubstring("unknown key 'upgrade.recovery-system.lable' in fixtures/unknownkeys/config.d/01_config.yaml line 3"))
+			Expect(err.Error()).NotTo(ContainSubstring("recovery-system.fs"))
+
+			_, err = ReadConfigRun("fixtures/config/", nil, mounter)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
 	})
 	Describe("Read runtime specs", Label("spec"), func() {
 		var cfg *types.RunConfig
@@ -382,6 +430,46 @@ var _ = Describe("Config", Label("config"), func() {
 				Expect(spec.CloudInit[0]).To(Equal("path/to/file1.yaml"))
 				Expect(spec.CloudInit[1]).To(Equal("/absolute/path/to/file2.yaml"))
 			})
+			Describe("image defaults", Label("image-defaults"), func() {
+				BeforeEach(func() {
+					Expect(utils.MkdirAll(fs, "/some/dir/etc/elemental", constants.DirPerm)).To(Succeed())
+					Expect(fs.WriteFile("/some/dir"+constants.ImageDefaultsFile, []byte(
+						"install:\n"+
+							"  system: docker:some/other/image\n"+
+							"  partitions:\n"+
+							"    bootloader:\n"+
+							"      size: 1024\n"+
+							"    state:\n"+
+							"      size: 9000\n"+
+							"    persistent:\n"+
+							"      label: IMG_PERSISTENT\n",
+					), constants.FilePerm)).To(Succeed())
+					Expect(flags.Set("system", "dir:/some/dir")).To(Succeed())
+				})
+				It("merges the defaults of a directory source under the user settings", func() {
+					spec, err := ReadInstallSpec(cfg, flags)
+					Expect(err).ShouldNot(HaveOccurred())
+					// Image defaults apply to settings not set by the user
+					Expect(spec.Partitions.State.Size).To(Equal(uint(9000)))
+					Expect(spec.Partitions.Persistent.FilesystemLabel).To(Equal("IMG_PERSISTENT"))
+					// User settings take precedence over the image defaults
+					Expect(spec.Partitions.Boot.Size).To(Equal(uint(512)))
+					Expect(spec.NoFormat).To(BeTrue())
+					// Sources can't be changed by the image
+					Expect(spec.System.Value()).To(Equal("/some/dir"))
+				})
+				It("fails on invalid defaults files", func() {
+					Expect(fs.WriteFile("/some/dir"+constants.ImageDefaultsFile, []byte("install: [\n"), constants.FilePerm)).To(Succeed())
+					_, err := ReadInstallSpec(cfg, flags)
+					Expect(err).To(MatchError(ContainSubstring("failed parsing image defaults")))
+				})
+				It("ignores defaults of non directory sources", func() {
+					Expect(flags.Set("system", "docker:image/from:flag")).To(Succeed())
+					spec, err := ReadInstallSpec(cfg, flags)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(spec.Partitions.State.Size).NotTo(Equal(uint(9000)))
+				})
+			})
 		})
 		Describe("Read ResetSpec", Label("install"), func() {
 			var flags *pflag.FlagSet
@@ -509,6 +597,35 @@ var _ = Describe("Config", Label("config"), func() {
 				Expect(spec.System.Value() == "system/cos")
 			})
 		})
+		Describe("Read CaptureSpec", Label("capture"), func() {
+			It("inits a default capture spec", func() {
+				spec, err := ReadCaptureSpec(cfg, nil)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(spec.FS).To(Equal(constants.SquashFs))
+				Expect(spec.Excludes).To(BeEmpty())
+			})
+			It("overrides the filesystem with environment variables and flags", func() {
+				Expect(os.Setenv("ELEMENTAL_CAPTURE_FS", "ext2")).To(Succeed())
+				defer os.Unsetenv("ELEMENTAL_CAPTURE_FS")
+				spec, err := ReadCaptureSpec(cfg, nil)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(spec.FS).To(Equal("ext2"))
+
+				flags := pflag.NewFlagSet("testflags", 1)
+				flags.String("fs", "", "testing flag")
+				Expect(flags.Set("fs", "ext4")).To(Succeed())
+				spec, err = ReadCaptureSpec(cfg, flags)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(spec.FS).To(Equal("ext4"))
+			})
+			It("fails on an unsupported filesystem", func() {
+				flags := pflag.NewFlagSet("testflags", 1)
+				flags.String("fs", "", "testing flag")
+				Expect(flags.Set("fs", "vfat")).To(Succeed())
+				_, err := ReadCaptureSpec(cfg, flags)
+				Expect(err).To(MatchError(ContainSubstring("unsupported capture filesystem")))
+			})
+		})
 		Describe("Read MountSpec", Label("mount"), func() {
 			var ghwTest mocks.GhwMock
 			BeforeEach(func() {
@@ -25,6 +25,7 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 )
 
@@ -34,6 +35,24 @@ func addCosignFlags(cmd *cobra.Command) {
 	cmd.Flags().String("cosign-key", "", "Sets the URL of the public key to be used by cosign validation")
 }
 
+// addOutputFlags adds flags related to the naming and location of build artifacts
+func addOutputFlags(cmd *cobra.Command, artifact string) {
+	overwrite := newEnumFlag(
+		[]string{constants.OverwriteArtifacts, constants.FailOnArtifacts, constants.RenameArtifacts},
+		constants.OverwriteArtifacts,
+	)
+	cmd.Flags().StringP("name", "n", "", fmt.Sprintf("Basename of the generated %s file, '%s' is replaced by the target architecture", artifact, constants.ArchPlaceholder))
+	cmd.Flags().StringP("output", "o", "", "Output directory of all generated artifacts, created if missing (alias --output-dir, defaults to current directory)")
+	cmd.Flags().Bool("date", false, fmt.Sprintf("Adds a date suffix into the generated %s file", artifact))
+	cmd.Flags().Var(overwrite, "overwrite-policy", "Policy for artifacts already present in the output directory: 'overwrite', 'fail' or 'rename'")
+	cmd.Flags().SetNormalizeFunc(func(_ *pflag.FlagSet, name string) pflag.NormalizedName {
+		if name == "output-dir" {
+			name = "output"
+		}
+		return pflag.NormalizedName(name)
+	})
+}
+
 // addPowerFlags adds flags related to power
 func addPowerFlags(cmd *cobra.Command) {
 	cmd.Flags().Bool("reboot", false, "Reboot the system after install")
@@ -65,6 +84,11 @@ func addResetFlags(cmd *cobra.Command) {
 	addPowerFlags(cmd)
 }
 
+// addBootAttemptsFlag adds the boot attempts counter flag shared by install and upgrade
+func addBootAttemptsFlag(cmd *cobra.Command) {
+	cmd.Flags().Int("boot-assessment-attempts", 0, "Boots of the new active system before the boot assessment falls back to a passive snapshot unless confirmed with 'confirm-boot', up to 9")
+}
+
 // addSystemFlag adds system flag to define source OS
 func addSystemFlag(cmd *cobra.Command) {
 	cmd.Flags().String("system", "", "Sets the system image source and its type (e.g. 'docker:registry.org/image:tag')")
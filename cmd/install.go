@@ -17,7 +17,9 @@ limitations under the License.
 package cmd
 
 import (
+	"fmt"
 	"os/exec"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -73,17 +75,50 @@ func NewInstallCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 				return elementalError.NewFromError(err, elementalError.ReadingSpecConfig)
 			}
 
+			targets, _ := cmd.Flags().GetStringSlice("targets")
+			if len(targets) > 0 {
+				if len(args) == 1 {
+					return elementalError.New("a target device can't be combined with the targets flag", elementalError.InvalidTarget)
+				}
+				for i := range targets {
+					// If the device path is a symlink, resolve it (e.g., /dev/disk/by-id/...)
+					targets[i], err = utils.ResolveLink(cfg.Fs, targets[i], "/", constants.MaxLinkDepth)
+					if err != nil {
+						cfg.Logger.Errorf("invalid target device: %v", err)
+						return elementalError.NewFromError(err, elementalError.InvalidTarget)
+					}
+				}
+				parallel, _ := cmd.Flags().GetInt("parallel")
+
+				cfg.Logger.Infof("Install called for %d targets", len(targets))
+				err = action.InstallMany(cfg, spec, targets, parallel)
+				if err != nil {
+					cfg.Logger.Errorf("install command failed: %v", err)
+				}
+				return err
+			}
+
 			if len(args) == 1 {
 				spec.Target = args[0]
 			}
 
-			if spec.Target == "" {
+			// Disks partitioned and mounted by external tools require no target device
+			if spec.Target == "" && !spec.SkipPartitioning {
 				return elementalError.New("at least a target device must be supplied", elementalError.InvalidTarget)
 			}
 
 			// If the device path is a symlink, resolve it (e.g., /dev/disk/by-path/platform-fe340000.mmc-part1)
 			spec.Target, _ = utils.ResolveLink(cfg.Fs, spec.Target, "/", constants.MaxLinkDepth)
 
+			if factory, _ := cmd.Flags().GetBool("factory"); factory {
+				cfg.Logger.Infof("Factory install called")
+				err = action.FactoryInstall(cfg, spec)
+				if err != nil {
+					cfg.Logger.Errorf("install command failed: %v", err)
+				}
+				return err
+			}
+
 			cfg.Logger.Infof("Install called")
 			install, err := action.NewInstallAction(cfg, spec)
 			if err != nil {
@@ -107,7 +142,15 @@ func NewInstallCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 	root.AddCommand(c)
 	c.Flags().StringSliceP("cloud-init", "c", []string{}, "Cloud-init config files")
 	c.Flags().StringP("iso", "i", "", "Performs an installation from the ISO url")
+	c.Flags().String("iso-checksum", "", "Verifies the ISO against this sha256 or sha512 checksum, or the checksum file at this url, before using it")
 	c.Flags().Bool("no-format", false, "Don’t format disks. It is implied that COS_STATE, COS_RECOVERY, COS_PERSISTENT, COS_OEM are already existing")
+	c.Flags().Bool("auto-target-allow-removable", false, "Removable disks can be picked as 'auto' target if there is no other disk")
+	c.Flags().StringSlice("exclude-device-labels", []string{}, "Disks including a filesystem with any of these labels are never picked as 'auto' target")
+	c.Flags().StringSlice("exclude-device-paths", []string{}, "Disks never picked as 'auto' target")
+	c.Flags().StringSlice("exclude-device-types", []string{}, fmt.Sprintf("Device types never picked as 'auto' target (%s)", strings.Join(constants.GetDiskTypes(), ", ")))
+	c.Flags().String("prefer-device-type", "", "Device type picked as 'auto' target over any other if available")
+	c.Flags().Bool("skip-partitioning", false, "Don't partition nor mount disks, partitions are expected to be mounted under the root-mountpoint by the caller")
+	c.Flags().String("root-mountpoint", "", "Folder where partitions are mounted when skipping partitioning, e.g. '<root>/state' or '<root>/efi'")
 
 	c.Flags().Var(firmType, "firmware", "Firmware to install, only 'efi' is currently supported")
 	_ = c.Flags().MarkDeprecated("firmware", "'firmware' is deprecated. only efi firmware is supported.")
@@ -120,6 +163,17 @@ func NewInstallCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 	c.Flags().Bool("disable-boot-entry", false, "Dont create an EFI entry for the system install.")
 	c.Flags().Var(snapshotterType, "snapshotter.type", "Sets the snapshotter type to install")
 	c.Flags().StringSlice("cloud-init-paths", []string{}, "Cloud-init config files to run during install")
+	c.Flags().Bool("skip-first-boot-setup", false, "Keep the installed system pristine to be redistributed as a golden image, it runs its first boot setup when booted on the final host")
+	c.Flags().Bool("factory", false, "Unattended install for imaging lines, keeps first boot setup for the final host, writes a provisioning marker and powers off")
+	c.Flags().StringSlice("raid-disks", []string{}, "Member disks of a software RAID array to create and install to")
+	c.Flags().String("raid-level", constants.RaidLevel, "RAID level of the array created from the raid-disks")
+	c.Flags().Bool("record-checksums", false, "Record the checksums of the installed images in state.yaml, so 'verify-install' can verify them")
+	c.Flags().String("trim-after-install", constants.TrimAuto, "Trim the installed filesystems to discard unused blocks: 'auto' only on non-rotational disks, 'always' or 'never'")
+	c.Flags().String("dbx-update", "", "Apply this authenticated forbidden signatures database (dbx) update to the firmware")
+	c.Flags().String("sbom", "", "Write an SBOM of the installed system to the OEM partition, either 'spdx' or 'cyclonedx'")
+	c.Flags().StringSlice("targets", []string{}, "Install the same system into several target devices at once, the system source is only dumped once")
+	addBootAttemptsFlag(c)
+	c.Flags().Int("parallel", 4, "Maximum number of concurrent installations when several targets are set")
 	addSharedInstallUpgradeFlags(c)
 	addLocalImageFlag(c)
 	addPlatformFlags(c)
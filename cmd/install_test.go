@@ -76,6 +76,11 @@ var _ = Describe("Install", Label("install", "cmd"), func() {
 		Expect(err.(*elementalError.ElementalError)).ToNot(BeNil())
 		Expect(err.(*elementalError.ElementalError).ExitCode()).To(Equal(elementalError.InvalidTarget))
 	})
+	It("Errors out setting a target device and the targets flag", Label("args"), func() {
+		_, _, err := executeCommandC(rootCmd, "install", "--system", "dir:/image", "--targets", "/dev/sda,/dev/sdb", "/dev/sdc")
+		Expect(err).ToNot(BeNil())
+		Expect(err.(*elementalError.ElementalError).ExitCode()).To(Equal(elementalError.InvalidTarget))
+	})
 	It("Errors out setting reboot and poweroff at the same time", Label("flags"), func() {
 		_, _, err := executeCommandC(rootCmd, "install", "--reboot", "--poweroff", "/dev/whatever")
 		Expect(err).ToNot(BeNil())
@@ -0,0 +1,79 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"os/exec"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+
+	"github.com/rancher/elemental-toolkit/v2/cmd/config"
+	"github.com/rancher/elemental-toolkit/v2/pkg/action"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+// NewProbeCmd returns a new instance of the probe subcommand and appends it to
+// the root command.
+func NewProbeCmd(root *cobra.Command) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "probe",
+		Short: "Reports the capabilities and environment of the current host",
+		Args:  cobra.ExactArgs(0),
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			viper.SetDefault("quiet", true) // Prevents any other writes to stdout
+			path, err := exec.LookPath("mount")
+			if err != nil {
+				return err
+			}
+			mounter := types.NewMounter(path)
+
+			cfg, err := config.ReadConfigRun(viper.GetString("config-dir"), cmd.Flags(), mounter)
+			if err != nil {
+				cfg.Logger.Errorf("Error reading config: %s\n", err)
+				return elementalError.NewFromError(err, elementalError.ReadingRunConfig)
+			}
+
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true // Do not propagate errors down the line, we control them
+
+			benchmark, _ := cmd.Flags().GetBool("benchmark")
+			report, err := action.Probe(&cfg.Config, action.WithProbeBenchmark(benchmark))
+			if report != nil {
+				reportBytes, mErr := yaml.Marshal(report)
+				if mErr == nil {
+					_, mErr = cmd.OutOrStdout().Write(reportBytes)
+				}
+				if mErr != nil {
+					cfg.Logger.Errorf("Error writing probe report on stdout: %s\n", mErr)
+				}
+			}
+			if err != nil {
+				cfg.Logger.Errorf("probe command failed: %v", err)
+			}
+			return err
+		},
+	}
+	c.Flags().Bool("benchmark", false, "Measure the read throughput of each disk, and the write throughput of blank disks")
+	root.AddCommand(c)
+	return c
+}
+
+// register the subcommand into rootCmd
+var _ = NewProbeCmd(rootCmd)
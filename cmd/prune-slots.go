@@ -0,0 +1,81 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"os/exec"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/rancher/elemental-toolkit/v2/cmd/config"
+	"github.com/rancher/elemental-toolkit/v2/pkg/action"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+// NewPruneSlotsCmd returns a new instance of the prune-slots subcommand and appends it to
+// the root command. requireRoot is to initiate it with or without the CheckRoot
+// pre-run check. This method is mostly used for testing purposes.
+func NewPruneSlotsCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "prune-slots",
+		Short: "Removes the snapshots and images not used by the current boot layout",
+		Long: "Removes the snapshots and images not used by the current boot layout\n\n" +
+			"Passive snapshots missing from the bootloader passive snapshots list or without an\n" +
+			"image, leftovers of failed recovery upgrades and installation state records of\n" +
+			"snapshots which no longer exist are removed and the reclaimed space is reported.\n" +
+			"The active snapshot and any image in use are never removed. Only the loopdevice\n" +
+			"snapshotter supports pruning snapshots.",
+		Args: cobra.NoArgs,
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			if addCheckRoot {
+				return CheckRoot()
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			path, err := exec.LookPath("mount")
+			if err != nil {
+				return err
+			}
+			mounter := types.NewMounter(path)
+
+			cfg, err := config.ReadConfigRun(viper.GetString("config-dir"), cmd.Flags(), mounter)
+			if err != nil {
+				cfg.Logger.Errorf("Error reading config: %s\n", err)
+				return elementalError.NewFromError(err, elementalError.ReadingRunConfig)
+			}
+
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true // Do not propagate errors down the line, we control them
+
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			err = action.PruneSlots(cfg, dryRun)
+			if err != nil {
+				cfg.Logger.Errorf("prune-slots command failed: %v", err)
+			}
+			return err
+		},
+	}
+	root.AddCommand(c)
+	c.Flags().Bool("dry-run", false, "Only report the artifacts to remove and the space to reclaim")
+	return c
+}
+
+// register the subcommand into rootCmd
+var _ = NewPruneSlotsCmd(rootCmd, true)
@@ -72,7 +72,7 @@ func NewPullImageCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 
 			var digest string
 			e := types.OCIImageExtractor{}
-			if digest, err = e.ExtractImage(image, destination, cfg.Platform.String(), local, verify); err != nil {
+			if digest, err = e.ExtractImage(image, destination, cfg.Platform.String(), local, verify, nil); err != nil {
 				cfg.Logger.Error(err.Error())
 				return elementalError.NewFromError(err, elementalError.UnpackImage)
 			}
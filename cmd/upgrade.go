@@ -17,6 +17,8 @@ limitations under the License.
 package cmd
 
 import (
+	"errors"
+	"fmt"
 	"os/exec"
 
 	"github.com/spf13/cobra"
@@ -64,6 +66,17 @@ func NewUpgradeCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 			// Adapt 'docker-image' and 'directory'  deprecated flags to 'system' syntax
 			adaptDockerImageAndDirectoryFlagsToSystem(cmd.Flags())
 
+			fromFile, _ := cmd.Flags().GetString("from-file")
+			if fromFile != "" {
+				if system, _ := cmd.Flags().GetString("system"); system != "" {
+					err = errors.New("flags from-file and system are mutually exclusive, please only set one of them")
+					cfg.Logger.Errorf("Error reading install/upgrade flags: %s\n", err)
+					return elementalError.NewFromError(err, elementalError.ReadingInstallUpgradeFlags)
+				}
+				// The actual source type is detected by the action
+				_ = cmd.Flags().Set("system", fmt.Sprintf("file:%s", fromFile))
+			}
+
 			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
 			cmd.SilenceUsage = true
 			cmd.SilenceErrors = true // Do not propagate errors down the line, we control them
@@ -74,6 +87,15 @@ func NewUpgradeCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 				return elementalError.NewFromError(err, elementalError.ReadingSpecConfig)
 			}
 
+			if fromFile != "" {
+				cfg.Logger.Infof("Upgrade from file called")
+				err = action.UpgradeFromFile(cfg, spec, fromFile)
+				if err != nil {
+					cfg.Logger.Errorf("upgrade command failed: %v", err)
+				}
+				return err
+			}
+
 			cfg.Logger.Infof("Upgrade called")
 			upgrade, err := action.NewUpgradeAction(cfg, spec)
 			if err != nil {
@@ -91,8 +113,17 @@ func NewUpgradeCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 	}
 	root.AddCommand(c)
 	c.Flags().Bool("recovery", false, "Upgrade recovery image too")
+	c.Flags().Bool("create-recovery-if-missing", false, "If the recovery partition is missing create it in the free disk space and upgrade the recovery image into it, instead of skipping the recovery upgrade")
 	c.Flags().Bool("bootloader", false, "Reinstall bootloader during the upgrade")
+	c.Flags().Bool("verify-only", false, "Deploy and verify the upgrade source into a new snapshot without activating it, the upgrade is staged for a later 'resume'")
+	c.Flags().Bool("resume", false, "Apply a previously verified and staged upgrade, the staged snapshot is activated without deploying the source again")
+	c.Flags().Bool("verify-kernel-modules", false, "Check the kernel modules of the upgrade image match its kernel version before applying it")
+	c.Flags().Bool("only-upgrade-if-newer", false, "Refuse to upgrade if the version of the upgrade image is not newer than the active one")
+	c.Flags().Bool("allow-downgrade", false, "Upgrade regardless of the 'only-upgrade-if-newer' version check")
+	c.Flags().String("from-file", "", "Upgrade from a local image artifact (squashfs, filesystem image or tarball), a '<file>.sha256' or '<file>.sha512' checksum next to it is required")
+	c.Flags().Bool("skip-checksum", false, "Upgrade from a local image artifact without a '<file>.sha256' or '<file>.sha512' checksum, the artifact is not verified")
 	c.Flags().StringSlice("cloud-init-paths", []string{}, "Cloud-init config files to run during upgrade")
+	addBootAttemptsFlag(c)
 	addSharedInstallUpgradeFlags(c)
 	addLocalImageFlag(c)
 	return c
@@ -39,12 +39,18 @@ func main() {
 		rootCmd,
 		cmd.NewBuildISO(rootCmd, false),
 		cmd.NewCloudInitCmd(rootCmd),
+		cmd.NewExpandCmd(rootCmd, false),
 		cmd.NewInstallCmd(rootCmd, false),
+		cmd.NewNextBootCmd(rootCmd, false),
+		cmd.NewConfirmBootCmd(rootCmd, false),
+		cmd.NewHistoryCmd(rootCmd, false),
 		cmd.NewPullImageCmd(rootCmd, false),
 		cmd.NewResetCmd(rootCmd, false),
 		cmd.NewRunStage(rootCmd),
+		cmd.NewSupportBundleCmd(rootCmd, false),
 		cmd.NewUpgradeCmd(rootCmd, false),
 		cmd.NewUpgradeRecoveryCmd(rootCmd, false),
+		cmd.NewVerifyInstallCmd(rootCmd, false),
 		cmd.NewVersionCmd(rootCmd),
 		cmd.NewStateCmd(rootCmd),
 	} {
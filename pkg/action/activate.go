@@ -0,0 +1,213 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/bootloader"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/snapshotter"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+// pickSnapshot returns the snapshot to activate out of the available ones and the active one
+type pickSnapshot func(ids []int, active int) (int, error)
+
+// Activate makes the given passive snapshot the active one, so it is booted by default from the
+// next boot on. The snapshot must be bootable: its image matches the checksum recorded in the
+// installation state, if any, and it includes a kernel and an initrd. Power actions set in the
+// RunConfig are honored once the snapshot is activated.
+func Activate(cfg *types.RunConfig, id int) error {
+	return activateSnapshot(cfg, func(_ []int, _ int) (int, error) {
+		return id, nil
+	})
+}
+
+// Deactivate demotes the active snapshot by activating the most recent passive snapshot, with
+// the same checks as Activate.
+func Deactivate(cfg *types.RunConfig) error {
+	return activateSnapshot(cfg, func(ids []int, active int) (int, error) {
+		passives := slices.DeleteFunc(slices.Clone(ids), func(id int) bool { return id == active })
+		if len(passives) == 0 {
+			return 0, fmt.Errorf("no passive snapshot to activate")
+		}
+		return slices.Max(passives), nil
+	})
+}
+
+func activateSnapshot(cfg *types.RunConfig, pick pickSnapshot) (err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() { err = cleanup.Cleanup(err) }()
+
+	state, err := cfg.LoadInstallState()
+	if err != nil {
+		cfg.Logger.Errorf("failed reading installation state: %v", err)
+		return elementalError.NewFromError(err, elementalError.ReadFile)
+	}
+	active, _ := activeSystemState(state)
+
+	parts, err := utils.GetAllPartitions()
+	if err != nil {
+		cfg.Logger.Errorf("could not read host partitions: %v", err)
+		return elementalError.NewFromError(err, elementalError.MountPartitions)
+	}
+	ep, err := cfg.PartitionSelection.ElementalPartitions(parts, state)
+	if err != nil {
+		cfg.Logger.Errorf("could not pick the host partitions: %v", err)
+		return elementalError.NewFromError(err, elementalError.MountPartitions)
+	}
+	if ep.State == nil || ep.Boot == nil {
+		cfg.Logger.Errorf("state or bootloader partition not found")
+		return elementalError.New("state or bootloader partition not found", elementalError.MountPartitions)
+	}
+	if ep.State.MountPoint == "" {
+		ep.State.MountPoint = constants.RunningStateDir
+	}
+	if ep.Boot.MountPoint == "" {
+		ep.Boot.MountPoint = constants.BootDir
+	}
+	if ep.Recovery != nil && ep.Recovery.MountPoint == "" {
+		ep.Recovery.MountPoint = constants.RecoveryDir
+	}
+	for _, part := range []*types.Partition{ep.State, ep.Boot, ep.Recovery} {
+		if part == nil {
+			continue
+		}
+		umount, err := elemental.MountRWPartition(cfg.Config, part)
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.MountPartitions)
+		}
+		cleanup.Push(umount)
+	}
+
+	var bl types.Bootloader = bootloader.NewGrub(&cfg.Config)
+	if cfg.Bootloader == constants.BootloaderNone {
+		bl = bootloader.NewNone(&cfg.Config, bootloader.NewGrubTemplateData(
+			types.UpgradeSpec{Partitions: ep}.GetGrubLabels(), "", state.Snapshotter.Type,
+		))
+	}
+	snap, err := snapshotter.NewSnapshotter(cfg.Config, state.Snapshotter, bl)
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.SnapshotterInit)
+	}
+	err = snap.InitSnapshotter(ep.State, ep.Boot.MountPoint)
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.SnapshotterInit)
+	}
+	ids, err := snap.GetSnapshots()
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.ActivateSnapshot)
+	}
+
+	// Without a bootloader the kernel and initrd of the snapshot are copied over the
+	// current ones, they are only swapped in once the snapshot is activated
+	staged, stage := bl.(stagedBootloader)
+	stageKernel := func(root string) error {
+		if !stage {
+			return nil
+		}
+		return staged.Stage(root, ep.Boot.MountPoint)
+	}
+
+	id, err := pick(ids, active)
+	if err == nil {
+		err = checkBootable(cfg, state, ep.State.MountPoint, ids, active, id, stageKernel)
+	}
+	if err == nil {
+		err = snap.ActivateSnapshot(id)
+	}
+	if err == nil && stage {
+		err = staged.Commit()
+	}
+	if err != nil {
+		if stage {
+			staged.Discard()
+		}
+		cfg.Logger.Errorf("failed activating snapshot: %v", err)
+		return elementalError.NewFromError(err, elementalError.ActivateSnapshot)
+	}
+
+	statePart := state.Partitions[constants.StatePartName]
+	if statePart != nil {
+		for snapID, system := range statePart.Snapshots {
+			system.Active = snapID == id
+		}
+	}
+	var recoveryStateFile string
+	if ep.Recovery != nil {
+		recoveryStateFile = filepath.Join(ep.Recovery.MountPoint, constants.InstallStateFile)
+	}
+	err = cfg.WriteInstallState(state, filepath.Join(ep.State.MountPoint, constants.InstallStateFile), recoveryStateFile)
+	if err != nil {
+		cfg.Logger.Errorf("failed writing installation state: %v", err)
+		return elementalError.NewFromError(err, elementalError.CreateFile)
+	}
+	cfg.Logger.Infof("Snapshot %d is active from the next boot on", id)
+
+	return PowerAction(cfg)
+}
+
+// checkBootable checks the given snapshot exists, is not the active one, matches the checksum
+// recorded in the installation state and includes a kernel and an initrd. The onRoot function
+// is called with the root tree of the snapshot once checked, while it is still mounted.
+func checkBootable(cfg *types.RunConfig, state *types.InstallState, rootDir string, ids []int, active, id int, onRoot func(string) error) (err error) {
+	if !slices.Contains(ids, id) {
+		return fmt.Errorf("snapshot %d not found", id)
+	}
+	if id == active {
+		return fmt.Errorf("snapshot %d is already active", id)
+	}
+
+	path, err := snapshotter.SnapshotPath(state.Snapshotter, rootDir, id)
+	if err != nil {
+		return err
+	}
+	if statePart := state.Partitions[constants.StatePartName]; statePart != nil &&
+		statePart.Snapshots[id] != nil && statePart.Snapshots[id].Checksum != "" {
+		err = utils.VerifyFileDigest(cfg.Fs, path, statePart.Snapshots[id].Checksum)
+		if err != nil {
+			return fmt.Errorf("snapshot %d is corrupted: %w", id, err)
+		}
+	}
+
+	root := path
+	if dir, _ := utils.IsDir(cfg.Fs, path); !dir {
+		img := &types.Image{File: path, MountPoint: constants.ActivateImageDir}
+		err = elemental.MountFileSystemImage(cfg.Config, img, "ro")
+		if err != nil {
+			return fmt.Errorf("failed mounting snapshot %d: %w", id, err)
+		}
+		defer func() {
+			uErr := elemental.UnmountFileSystemImage(cfg.Config, img)
+			if err == nil {
+				err = uErr
+			}
+		}()
+		root = img.MountPoint
+	}
+	_, _, err = elemental.FindKernelInitrd(cfg.Config, root)
+	if err != nil {
+		return fmt.Errorf("snapshot %d is not bootable: %w", id, err)
+	}
+	return onRoot(root)
+}
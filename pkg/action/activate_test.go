@@ -0,0 +1,220 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+
+	"github.com/jaypipes/ghw/pkg/block"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v4"
+	"github.com/twpayne/go-vfs/v4/vfst"
+	"gopkg.in/yaml.v3"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/action"
+	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+var _ = Describe("Activate and Deactivate actions", Label("activate"), func() {
+	var config *types.RunConfig
+	var runner *mocks.FakeRunner
+	var fs vfs.FS
+	var mounter *mocks.FakeMounter
+	var cleanup func()
+	var ghwTest mocks.GhwMock
+	var state *types.InstallState
+	var snapsDir, stateFile string
+
+	readState := func() *types.InstallState {
+		data, err := fs.ReadFile(stateFile)
+		Expect(err).NotTo(HaveOccurred())
+		s := &types.InstallState{}
+		Expect(yaml.Unmarshal(data, s)).To(Succeed())
+		return s
+	}
+	activeLink := func() string {
+		link, err := fs.Readlink(filepath.Join(snapsDir, constants.ActiveSnapshot))
+		Expect(err).NotTo(HaveOccurred())
+		return link
+	}
+
+	BeforeEach(func() {
+		runner = mocks.NewFakeRunner()
+		mounter = mocks.NewFakeMounter()
+		logger := types.NewBufferLogger(&bytes.Buffer{})
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).Should(BeNil())
+
+		config = conf.NewRunConfig(
+			conf.WithFs(fs),
+			conf.WithRunner(runner),
+			conf.WithLogger(logger),
+			conf.WithMounter(mounter),
+		)
+
+		mainDisk := block.Disk{
+			Name: "device",
+			Partitions: []*block.Partition{
+				{
+					Name:            "device1",
+					FilesystemLabel: constants.BootLabel,
+					Type:            "vfat",
+				},
+				{
+					Name:            "device2",
+					FilesystemLabel: constants.StateLabel,
+					Type:            "ext4",
+				},
+			},
+		}
+		ghwTest = mocks.GhwMock{}
+		ghwTest.AddDisk(mainDisk)
+		ghwTest.CreateDevices()
+
+		// Snapshot 2 is active and snapshots 1 and 3 are passive
+		snapsDir = filepath.Join(constants.RunningStateDir, ".snapshots")
+		for _, id := range []int{1, 2, 3} {
+			img := filepath.Join(snapsDir, fmt.Sprintf("%d/snapshot.img", id))
+			Expect(utils.MkdirAll(fs, filepath.Dir(img), constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile(img, []byte(fmt.Sprintf("snapshot%d", id)), constants.FilePerm)).To(Succeed())
+		}
+		Expect(fs.Symlink("2/snapshot.img", filepath.Join(snapsDir, constants.ActiveSnapshot))).To(Succeed())
+
+		state = &types.InstallState{
+			Snapshotter: types.NewLoopDevice(),
+			Partitions: map[string]*types.PartitionState{
+				constants.StatePartName: {
+					FSLabel: constants.StateLabel,
+					Snapshots: map[int]*types.SystemState{
+						1: {Checksum: fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("snapshot1")))},
+						2: {Active: true},
+						3: {},
+					},
+				},
+			},
+		}
+		stateFile = filepath.Join(constants.RunningStateDir, constants.InstallStateFile)
+		Expect(config.WriteInstallState(state, stateFile, "")).To(Succeed())
+
+		// Kernel and initrd of the mounted snapshot image
+		bootDir := filepath.Join(constants.ActivateImageDir, "boot")
+		Expect(utils.MkdirAll(fs, bootDir, constants.DirPerm)).To(Succeed())
+		Expect(utils.MkdirAll(fs, filepath.Join(constants.ActivateImageDir, "lib/modules/6.4.0-1"), constants.DirPerm)).To(Succeed())
+		Expect(fs.WriteFile(filepath.Join(bootDir, "vmlinuz-6.4.0-1"), []byte("kernel"), constants.FilePerm)).To(Succeed())
+		Expect(fs.WriteFile(filepath.Join(bootDir, "initrd-6.4.0-1"), []byte("initrd"), constants.FilePerm)).To(Succeed())
+
+		runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+			if cmd == "losetup" {
+				return []byte("/dev/loop0"), nil
+			}
+			return []byte{}, nil
+		}
+	})
+	AfterEach(func() {
+		ghwTest.Clean()
+		cleanup()
+	})
+	It("activates a passive snapshot", func() {
+		Expect(action.Activate(config, 1)).To(Succeed())
+		Expect(activeLink()).To(HaveSuffix("1/snapshot.img"))
+
+		snaps := readState().Partitions[constants.StatePartName].Snapshots
+		Expect(snaps[1].Active).To(BeTrue())
+		Expect(snaps[2].Active).To(BeFalse())
+		Expect(runner.IncludesCmds([][]string{
+			{"grub2-editenv", filepath.Join(constants.BootDir, constants.GrubOEMEnv), "set", "passive_snaps=3 2"},
+		})).To(Succeed())
+		// Partitions and snapshot image were released
+		Expect(mounter.List()).To(BeEmpty())
+	})
+	It("copies the kernel of the activated snapshot if there is no bootloader", Label("bootloader-none"), func() {
+		config.Bootloader = constants.BootloaderNone
+		config.KernelInstallPath = "/EFI/Linux/elemental"
+		kernelDir := filepath.Join(constants.BootDir, config.KernelInstallPath)
+		Expect(utils.MkdirAll(fs, kernelDir, constants.DirPerm)).To(Succeed())
+		Expect(fs.WriteFile(filepath.Join(kernelDir, "vmlinuz"), []byte("old kernel"), constants.FilePerm)).To(Succeed())
+
+		Expect(action.Activate(config, 1)).To(Succeed())
+		Expect(activeLink()).To(HaveSuffix("1/snapshot.img"))
+		data, err := fs.ReadFile(filepath.Join(kernelDir, "vmlinuz"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal("kernel"))
+		data, err = fs.ReadFile(filepath.Join(kernelDir, "elemental.conf"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring("linux /EFI/Linux/elemental/vmlinuz"))
+		Expect(runner.IncludesCmds([][]string{{"grub2-editenv"}})).NotTo(Succeed())
+		Expect(mounter.List()).To(BeEmpty())
+	})
+	It("keeps the kernel if the snapshot can't be activated and there is no bootloader", Label("bootloader-none"), func() {
+		config.Bootloader = constants.BootloaderNone
+		config.KernelInstallPath = "/EFI/Linux/elemental"
+		kernelDir := filepath.Join(constants.BootDir, config.KernelInstallPath)
+		Expect(utils.MkdirAll(fs, kernelDir, constants.DirPerm)).To(Succeed())
+		Expect(fs.WriteFile(filepath.Join(kernelDir, "vmlinuz"), []byte("old kernel"), constants.FilePerm)).To(Succeed())
+		Expect(fs.Remove(filepath.Join(snapsDir, constants.ActiveSnapshot))).To(Succeed())
+		Expect(fs.Mkdir(filepath.Join(snapsDir, constants.ActiveSnapshot), constants.DirPerm)).To(Succeed())
+
+		Expect(action.Activate(config, 1)).To(MatchError(ContainSubstring("active: file exists")))
+		files, err := fs.ReadDir(kernelDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(HaveLen(1))
+		data, err := fs.ReadFile(filepath.Join(kernelDir, "vmlinuz"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal("old kernel"))
+	})
+	It("deactivates the active snapshot in favor of the most recent passive one", func() {
+		Expect(action.Deactivate(config)).To(Succeed())
+		Expect(activeLink()).To(HaveSuffix("3/snapshot.img"))
+		snaps := readState().Partitions[constants.StatePartName].Snapshots
+		Expect(snaps[3].Active).To(BeTrue())
+		Expect(snaps[2].Active).To(BeFalse())
+	})
+	It("fails to activate the active snapshot", func() {
+		Expect(action.Activate(config, 2)).To(MatchError(ContainSubstring("snapshot 2 is already active")))
+	})
+	It("fails to activate a missing snapshot", func() {
+		Expect(action.Activate(config, 9)).To(MatchError(ContainSubstring("snapshot 9 not found")))
+		Expect(activeLink()).To(HaveSuffix("2/snapshot.img"))
+	})
+	It("fails to activate a snapshot not matching its checksum", func() {
+		Expect(fs.WriteFile(filepath.Join(snapsDir, "1/snapshot.img"), []byte("corrupted"), constants.FilePerm)).To(Succeed())
+		Expect(action.Activate(config, 1)).To(MatchError(ContainSubstring("snapshot 1 is corrupted")))
+		Expect(activeLink()).To(HaveSuffix("2/snapshot.img"))
+		Expect(readState().Partitions[constants.StatePartName].Snapshots[2].Active).To(BeTrue())
+	})
+	It("fails to activate a snapshot without kernel", func() {
+		Expect(fs.Remove(filepath.Join(constants.ActivateImageDir, "boot/vmlinuz-6.4.0-1"))).To(Succeed())
+		Expect(action.Activate(config, 3)).To(MatchError(ContainSubstring("snapshot 3 is not bootable")))
+		Expect(activeLink()).To(HaveSuffix("2/snapshot.img"))
+		Expect(mounter.List()).To(BeEmpty())
+	})
+	It("fails to deactivate if there is no passive snapshot", func() {
+		for _, id := range []string{"1", "3"} {
+			Expect(fs.RemoveAll(filepath.Join(snapsDir, id))).To(Succeed())
+		}
+		Expect(action.Deactivate(config)).To(MatchError(ContainSubstring("no passive snapshot to activate")))
+	})
+})
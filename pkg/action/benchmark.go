@@ -0,0 +1,93 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+// BenchmarkResult is the throughput of a disk in MB/s. The write throughput is only
+// measured on blank disks.
+type BenchmarkResult struct {
+	ReadMBps  float64 `yaml:"read-mbps"`
+	WriteMBps float64 `yaml:"write-mbps,omitempty"`
+}
+
+// Benchmark measures the sequential read throughput of the given disk with direct I/O. The
+// write throughput is also measured if the disk is blank, neither partitioned nor holding any
+// known filesystem signature, by writing zeros right after its first MiB. Existing data is
+// never overwritten.
+func Benchmark(cfg *types.Config, disk string) (*BenchmarkResult, error) {
+	count := fmt.Sprintf("count=%d", constants.BenchmarkSizeMB)
+	result := &BenchmarkResult{}
+
+	elapsed, err := timedRun(cfg.Runner, "dd", "if="+disk, "of=/dev/null", "bs=1M", count, "iflag=direct")
+	if err != nil {
+		return nil, fmt.Errorf("failed reading from %s: %w", disk, err)
+	}
+	result.ReadMBps = throughput(elapsed)
+
+	blank, err := blankDisk(cfg.Runner, disk)
+	if err != nil {
+		return nil, err
+	}
+	if !blank {
+		cfg.Logger.Debugf("%s is not blank, skipping the write benchmark", disk)
+		return result, nil
+	}
+
+	elapsed, err = timedRun(cfg.Runner, "dd", "if=/dev/zero", "of="+disk, "bs=1M", count, "seek=1", "oflag=direct", "conv=fsync")
+	if err != nil {
+		return nil, fmt.Errorf("failed writing to %s: %w", disk, err)
+	}
+	result.WriteMBps = throughput(elapsed)
+	return result, nil
+}
+
+// blankDisk returns true if the given disk has no partitions nor filesystem signatures
+func blankDisk(runner types.Runner, disk string) (bool, error) {
+	out, err := runner.Run("lsblk", "-nrpo", "NAME,FSTYPE", disk)
+	if err != nil {
+		return false, fmt.Errorf("failed listing %s: %s", disk, string(out))
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	return len(lines) == 1 && len(strings.Fields(lines[0])) < 2, nil
+}
+
+// timedRun runs the given command and returns how long it took
+func timedRun(runner types.Runner, command string, args ...string) (time.Duration, error) {
+	start := time.Now()
+	out, err := runner.Run(command, args...)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return time.Since(start), nil
+}
+
+// throughput returns the MB/s of transferring the benchmark size in the given time
+func throughput(elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		elapsed = time.Microsecond
+	}
+	mbps := float64(constants.BenchmarkSizeMB) / elapsed.Seconds()
+	return float64(int64(mbps*10)) / 10
+}
@@ -0,0 +1,89 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action_test
+
+import (
+	"bytes"
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/action"
+	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
+	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+var _ = Describe("Benchmark action", Label("benchmark"), func() {
+	var config *types.Config
+	var runner *mocks.FakeRunner
+	var lsblkOut string
+	var ddErr bool
+
+	BeforeEach(func() {
+		runner = mocks.NewFakeRunner()
+		config = conf.NewConfig(
+			conf.WithRunner(runner),
+			conf.WithLogger(types.NewBufferLogger(&bytes.Buffer{})),
+		)
+		lsblkOut = "/dev/sda \n"
+		ddErr = false
+		runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+			switch cmd {
+			case "lsblk":
+				return []byte(lsblkOut), nil
+			case "dd":
+				if ddErr {
+					return []byte("Input/output error"), fmt.Errorf("exit status 1")
+				}
+			}
+			return []byte{}, nil
+		}
+	})
+	It("measures read and write throughput of a blank disk", func() {
+		result, err := action.Benchmark(config, "/dev/sda")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.ReadMBps).To(BeNumerically(">", 0))
+		Expect(result.WriteMBps).To(BeNumerically(">", 0))
+		Expect(runner.CmdsMatch([][]string{
+			{"dd", "if=/dev/sda", "of=/dev/null", "bs=1M", "count=64", "iflag=direct"},
+			{"lsblk", "-nrpo", "NAME,FSTYPE", "/dev/sda"},
+			{"dd", "if=/dev/zero", "of=/dev/sda", "bs=1M", "count=64", "seek=1", "oflag=direct", "conv=fsync"},
+		})).To(Succeed())
+	})
+	It("does not write to partitioned disks", func() {
+		lsblkOut = "/dev/sda \n/dev/sda1 ext4\n"
+		result, err := action.Benchmark(config, "/dev/sda")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.ReadMBps).To(BeNumerically(">", 0))
+		Expect(result.WriteMBps).To(BeZero())
+		Expect(runner.IncludesCmds([][]string{{"dd", "if=/dev/zero"}})).NotTo(Succeed())
+	})
+	It("does not write to disks holding a filesystem", func() {
+		lsblkOut = "/dev/sda xfs\n"
+		result, err := action.Benchmark(config, "/dev/sda")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.WriteMBps).To(BeZero())
+		Expect(runner.IncludesCmds([][]string{{"dd", "if=/dev/zero"}})).NotTo(Succeed())
+	})
+	It("fails if the disk can't be read", func() {
+		ddErr = true
+		_, err := action.Benchmark(config, "/dev/sda")
+		Expect(err).To(MatchError(ContainSubstring("Input/output error")))
+	})
+})
@@ -77,7 +77,9 @@ func NewBuildDiskAction(cfg *types.BuildConfig, spec *types.DiskSpec, opts ...Bu
 	}
 
 	if b.bootloader == nil {
-		b.bootloader = bootloader.NewGrub(&cfg.Config)
+		b.bootloader = bootloader.NewGrub(&cfg.Config, bootloader.WithGrubTemplateData(
+			bootloader.NewGrubTemplateData(b.spec.GetGrubLabels(), b.spec.GrubDefEntry, cfg.Snapshotter.Type),
+		))
 	}
 
 	if b.snapshotter == nil {
@@ -164,16 +166,13 @@ func (b *BuildDiskAction) BuildDiskRun() (err error) { //nolint:gocyclo
 	cleanup := utils.NewCleanStack()
 	defer func() { err = cleanup.Cleanup(err) }()
 	workdir := filepath.Join(b.cfg.OutDir, constants.DiskWorkDir)
-	cleanup.Push(func() error { return b.cfg.Fs.RemoveAll(workdir) })
+	cleanup.Push(func() error { return utils.SafeRemoveAll(b.cfg.Logger, b.cfg.Mounter, b.cfg.Fs, workdir) })
 
 	// Set output image file
-	if b.cfg.Date {
-		currTime := time.Now()
-		rawImg = fmt.Sprintf("%s.%s.raw", b.cfg.Name, currTime.Format("20060102"))
-	} else {
-		rawImg = fmt.Sprintf("%s.raw", b.cfg.Name)
+	rawImg, err = artifactPath(b.cfg, "raw")
+	if err != nil {
+		return err
 	}
-	rawImg = filepath.Join(b.cfg.OutDir, rawImg)
 
 	err = utils.MkdirAll(b.cfg.Fs, workdir, constants.DirPerm)
 	if err != nil {
@@ -265,7 +264,7 @@ func (b *BuildDiskAction) BuildDiskRun() (err error) { //nolint:gocyclo
 
 	tmpSrc := b.spec.RecoverySystem.Source
 	b.spec.RecoverySystem.Source = types.NewDirSrc(recRoot)
-	err = elemental.DeployRecoverySystem(b.cfg.Config, &b.spec.RecoverySystem)
+	err = elemental.DeployRecoverySystem(b.cfg.ForArtifact(constants.RecoveryArtifact), &b.spec.RecoverySystem)
 	if err != nil {
 		b.cfg.Logger.Errorf("failed deploying recovery system: %v", err)
 		return err
@@ -295,27 +294,33 @@ func (b *BuildDiskAction) BuildDiskRun() (err error) { //nolint:gocyclo
 	}
 
 	// Convert image to desired format
+	artifact := rawImg
 	switch b.spec.Type {
 	case constants.RawType:
 		// Nothing to do here
-		b.cfg.Logger.Infof("Done! Image created at %s", rawImg)
 	case constants.AzureType:
 		err = Raw2Azure(rawImg, b.cfg.Fs, b.cfg.Logger, false)
 		if err != nil {
 			b.cfg.Logger.Errorf("failed creating Azure image: %s", err.Error())
 			return err
 		}
-		b.cfg.Logger.Infof("Done! Image created at %s", fmt.Sprintf("%s.vhd", rawImg))
+		artifact = fmt.Sprintf("%s.vhd", rawImg)
 	case constants.GCEType:
 		err = Raw2Gce(rawImg, b.cfg.Fs, b.cfg.Logger, false)
 		if err != nil {
 			b.cfg.Logger.Errorf("failed creating GCE image: %s", err.Error())
 			return err
 		}
-		b.cfg.Logger.Infof("Done! Image created at %s", fmt.Sprintf("%s.tar.gz", rawImg))
+		artifact = fmt.Sprintf("%s.tar.gz", rawImg)
+	}
+
+	err = writeArtifactChecksum(b.cfg, artifact)
+	if err != nil {
+		return err
 	}
+	b.cfg.Logger.Infof("Done! Image created at %s", artifact)
 
-	return elementalError.NewFromError(err, elementalError.Unknown)
+	return nil
 }
 
 // CreateRAWDisk creates the RAW disk image file including all required partitions
@@ -391,12 +396,16 @@ func (b *BuildDiskAction) CreatePartitionImages() ([]*types.Image, error) {
 		}
 		err = elemental.CreateImageFromTree(
 			b.cfg.Config, img, b.roots[part.Name], b.spec.Expandable,
-			func() error { return b.cfg.Fs.RemoveAll(b.roots[part.Name]) },
+			func() error { return utils.SafeRemoveAll(b.cfg.Logger, b.cfg.Mounter, b.cfg.Fs, b.roots[part.Name]) },
 		)
 		if err != nil {
 			b.cfg.Logger.Errorf("failed creating %s partition image: %s", part.Name, err.Error())
 			return nil, err
 		}
+		if part.Size == 0 {
+			// Partitions without a fixed size are sized from their tree by the image size policy
+			part.Size = img.Size
+		}
 		images = append(images, img)
 	}
 
@@ -408,7 +417,7 @@ func (b *BuildDiskAction) CreatePartitionImages() ([]*types.Image, error) {
 		img = part.ToImage()
 		err = elemental.CreateImageFromTree(
 			b.cfg.Config, img, b.roots[part.Name], b.spec.Expandable,
-			func() error { return b.cfg.Fs.RemoveAll(b.roots[part.Name]) },
+			func() error { return utils.SafeRemoveAll(b.cfg.Logger, b.cfg.Mounter, b.cfg.Fs, b.roots[part.Name]) },
 		)
 		if err != nil {
 			b.cfg.Logger.Errorf("failed creating %s partition image: %s", part.Name, err.Error())
@@ -569,6 +578,13 @@ func (b *BuildDiskAction) CreateDiskImage(rawDiskFile string, partImgs ...*types
 	if err != nil {
 		return elementalError.NewFromError(err, elementalError.CopyData)
 	}
+	if !b.cfg.SparseImages {
+		err = elemental.AllocateFile(b.cfg.Config, rawDiskFile)
+		if err != nil {
+			b.cfg.Logger.Errorf("failed allocating RAW disk: %s", err.Error())
+			return elementalError.NewFromError(err, elementalError.CreateFile)
+		}
+	}
 
 	return nil
 }
@@ -721,6 +737,7 @@ func (b *BuildDiskAction) CreateDiskPartitionTable(disk string) error {
 			SizeS:      sizeS,
 			PLabel:     part.Name,
 			FileSystem: part.FS,
+			TypeGUID:   part.TypeGUID,
 		}
 		gd.CreatePartition(&gdPart)
 	}
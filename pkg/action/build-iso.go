@@ -19,7 +19,6 @@ package action
 import (
 	"fmt"
 	"path/filepath"
-	"time"
 
 	"github.com/rancher/elemental-toolkit/v2/pkg/bootloader"
 	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
@@ -92,7 +91,7 @@ func (b *BuildISOAction) Run() error {
 	if err != nil {
 		return elementalError.NewFromError(err, elementalError.CreateTempDir)
 	}
-	cleanup.Push(func() error { return b.cfg.Fs.RemoveAll(isoTmpDir) })
+	cleanup.Push(func() error { return utils.SafeRemoveAll(b.cfg.Logger, b.cfg.Mounter, b.cfg.Fs, isoTmpDir) })
 
 	rootDir := filepath.Join(isoTmpDir, "rootfs")
 	err = utils.MkdirAll(b.cfg.Fs, rootDir, constants.DirPerm)
@@ -178,7 +177,7 @@ func (b *BuildISOAction) Run() error {
 		FS:     constants.SquashFs,
 	}
 
-	err = elemental.DeployRecoverySystem(b.cfg.Config, image)
+	err = elemental.DeployRecoverySystem(b.cfg.ForArtifact(constants.ISOArtifact), image)
 	if err != nil {
 		b.cfg.Logger.Errorf("Failed preparing ISO's root tree: %v", err)
 		return err
@@ -266,27 +265,10 @@ func (b BuildISOAction) createEFI(root string, img string) error {
 
 func (b BuildISOAction) burnISO(root, efiImg string) error {
 	cmd := "xorriso"
-	var outputFile string
-	var isoFileName string
 
-	if b.cfg.Date {
-		currTime := time.Now()
-		isoFileName = fmt.Sprintf("%s.%s.iso", b.cfg.Name, currTime.Format("20060102"))
-	} else {
-		isoFileName = fmt.Sprintf("%s.iso", b.cfg.Name)
-	}
-
-	outputFile = isoFileName
-	if b.cfg.OutDir != "" {
-		outputFile = filepath.Join(b.cfg.OutDir, outputFile)
-	}
-
-	if exists, _ := utils.Exists(b.cfg.Fs, outputFile); exists {
-		b.cfg.Logger.Warnf("Overwriting already existing %s", outputFile)
-		err := b.cfg.Fs.Remove(outputFile)
-		if err != nil {
-			return elementalError.NewFromError(err, elementalError.RemoveFile)
-		}
+	outputFile, err := artifactPath(b.cfg, "iso")
+	if err != nil {
+		return err
 	}
 
 	args := []string{
@@ -301,15 +283,9 @@ func (b BuildISOAction) burnISO(root, efiImg string) error {
 		return elementalError.NewFromError(err, elementalError.CommandRun)
 	}
 
-	checksum, err := utils.CalcFileChecksum(b.cfg.Fs, outputFile)
+	err = writeArtifactChecksum(b.cfg, outputFile)
 	if err != nil {
-		b.cfg.Logger.Errorf("checksum computation failed: %v", err)
-		return elementalError.NewFromError(err, elementalError.CalculateChecksum)
-	}
-	err = b.cfg.Fs.WriteFile(fmt.Sprintf("%s.sha256", outputFile), []byte(fmt.Sprintf("%s %s\n", checksum, isoFileName)), 0644)
-	if err != nil {
-		b.cfg.Logger.Errorf("cannot write checksum file: %v", err)
-		return elementalError.NewFromError(err, elementalError.CreateFile)
+		return err
 	}
 
 	return nil
@@ -21,6 +21,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -133,6 +134,63 @@ var _ = Describe("Build Actions", func() {
 
 			Expect(err).ShouldNot(HaveOccurred())
 		})
+		It("Names artifacts after the architecture and applies the overwrite policy", Label("output"), func() {
+			rootSrc, _ := types.NewSrcFromURI("oci:elementalos:latest")
+			iso.RootFS = []*types.ImageSource{rootSrc}
+
+			extractor.SideEffect = func(_, destination, _ string, _, _ bool) (string, error) {
+				err := utils.MkdirAll(fs, filepath.Join(destination, "lib/modules/6.4"), constants.DirPerm)
+				if err != nil {
+					return mocks.FakeDigest, err
+				}
+				err = utils.MkdirAll(fs, filepath.Join(destination, "boot"), constants.DirPerm)
+				if err != nil {
+					return mocks.FakeDigest, err
+				}
+				_, err = fs.Create(filepath.Join(destination, "boot/vmlinuz-6.4"))
+				if err != nil {
+					return mocks.FakeDigest, err
+				}
+				_, err = fs.Create(filepath.Join(destination, "boot/initrd"))
+				return mocks.FakeDigest, err
+			}
+
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "xorriso" {
+					for i, arg := range args {
+						if arg == "-outdev" {
+							return []byte{}, fs.WriteFile(args[i+1], []byte("profound thoughts"), constants.FilePerm)
+						}
+					}
+				}
+				return []byte{}, nil
+			}
+
+			cfg.Name = "elemental-{arch}"
+			cfg.OutDir = "/artifacts"
+			isoFile := fmt.Sprintf("/artifacts/elemental-%s.iso", cfg.Platform.Arch)
+			renamed := fmt.Sprintf("/artifacts/elemental-%s-1.iso", cfg.Platform.Arch)
+
+			By("creating the output directory")
+			buildISO := action.NewBuildISOAction(cfg, iso, action.WithLiveBootloader(bootloader))
+			Expect(buildISO.Run()).To(Succeed())
+			Expect(utils.Exists(fs, isoFile)).To(BeTrue())
+			Expect(utils.Exists(fs, isoFile+".sha256")).To(BeTrue())
+
+			By("renaming on collisions")
+			cfg.Overwrite = constants.RenameArtifacts
+			buildISO = action.NewBuildISOAction(cfg, iso, action.WithLiveBootloader(bootloader))
+			Expect(buildISO.Run()).To(Succeed())
+			Expect(utils.Exists(fs, isoFile)).To(BeTrue())
+			checksum, err := fs.ReadFile(renamed + ".sha256")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(checksum)).To(HaveSuffix(" " + filepath.Base(renamed) + "\n"))
+
+			By("failing on collisions")
+			cfg.Overwrite = constants.FailOnArtifacts
+			buildISO = action.NewBuildISOAction(cfg, iso, action.WithLiveBootloader(bootloader))
+			Expect(buildISO.Run()).NotTo(Succeed())
+		})
 		It("Fails on prepare EFI", func() {
 			iso.BootloaderInRootFs = true
 
@@ -244,6 +302,28 @@ var _ = Describe("Build Actions", func() {
 				{"partx", "-u", "/tmp/test/elemental.raw"},
 			})).To(Succeed())
 		})
+		It("Sizes partitions without a fixed size by the image size policy", func() {
+			disk.Partitions.OEM.Size = 0
+			cfg.ImageSizePolicy = types.SizePolicy{RoundTo: 1, MinSize: 100}
+			buildDisk, err := action.NewBuildDiskAction(cfg, disk, action.WithDiskBootloader(bootloader))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(buildDisk.BuildDiskRun()).To(Succeed())
+			Expect(disk.Partitions.OEM.Size).To(Equal(uint(100)))
+			Expect(disk.MinDiskSize()).To(BeNumerically(">", uint(100)))
+		})
+		It("Compresses the recovery image with the configured level", Label("compression-level"), func() {
+			cfg.CompressionLevel = map[string]int{constants.RecoveryArtifact: 3}
+			buildDisk, err := action.NewBuildDiskAction(cfg, disk, action.WithDiskBootloader(bootloader))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(buildDisk.BuildDiskRun()).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{
+				"mksquashfs", "/tmp/test/build/recovery.img.root", "/tmp/test/build/recovery/boot/recovery.img",
+				"-b", "1024k", "-Xcompression-level", "3",
+			}})).To(Succeed())
+			Expect(cfg.SquashFsCompressionConfig).To(Equal(constants.GetDefaultSquashfsCompressionOptions()))
+		})
 		It("Successfully builds an expandable disk", func() {
 			disk.Expandable = true
 
@@ -0,0 +1,153 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+// Capture creates a filesystem image or a tarball of the running active system into the given
+// output file. The image can be used as a file source of later installations and upgrades and
+// the tarball as a local artifact of upgrades, so a system configured by hand can be deployed
+// to other hosts. Volatile and host specific paths are left
+// out, as well as the paths matching any of the configured exclude expressions and none of the
+// include expressions.
+func Capture(cfg *types.RunConfig, spec *types.CaptureSpec, output string) (err error) {
+	if !elemental.IsActiveMode(cfg.Config) {
+		cfg.Logger.Errorf("not booted from the active system")
+		return elementalError.New("capture requires booting from the active system", elementalError.CaptureSystem)
+	}
+
+	output, err = filepath.Abs(output)
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.CaptureSystem)
+	}
+	if exists, _ := utils.Exists(cfg.Fs, output); exists {
+		cfg.Logger.Errorf("output file %s already exists", output)
+		return elementalError.New(fmt.Sprintf("output file %s already exists", output), elementalError.CaptureSystem)
+	}
+
+	paths, err := captureExcludes(cfg, spec)
+	if err != nil {
+		cfg.Logger.Errorf("failed filtering paths of the running system: %v", err)
+		return elementalError.NewFromError(err, elementalError.CaptureSystem)
+	}
+	paths = append(paths, output)
+
+	if spec.FS == constants.Tarball {
+		cfg.Logger.Infof("Capturing the running system into %s", output)
+		err = captureTarball(cfg, output, paths)
+		if err != nil {
+			cfg.Logger.Errorf("failed capturing the running system: %v", err)
+			_ = utils.SafeRemoveAll(cfg.Logger, cfg.Mounter, cfg.Fs, output)
+			return elementalError.NewFromError(err, elementalError.CaptureSystem)
+		}
+		cfg.Logger.Infof("Running system captured into %s, use it as the upgrade --from-file artifact", output)
+		return nil
+	}
+
+	img := &types.Image{File: output, FS: spec.FS}
+	var cleaner func() error
+	if img.FS != constants.SquashFs {
+		img.Label = constants.SystemLabel
+		img.MountPoint, err = utils.TempDir(cfg.Fs, "", "elemental-capture")
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.CreateTempDir)
+		}
+		cleaner = func() error { return utils.SafeRemoveAll(cfg.Logger, cfg.Mounter, cfg.Fs, img.MountPoint) }
+	}
+
+	cfg.Logger.Infof("Capturing the running system into %s", output)
+	err = elemental.CreateImageFromTreeExcluding(cfg.Config, img, "/", paths, cleaner)
+	if err != nil {
+		cfg.Logger.Errorf("failed capturing the running system: %v", err)
+		_ = utils.SafeRemoveAll(cfg.Logger, cfg.Mounter, cfg.Fs, output)
+		return elementalError.NewFromError(err, elementalError.CreateImgFromTree)
+	}
+
+	cfg.Logger.Infof("Running system captured into %s, use file:%s as a system source", output, output)
+	return nil
+}
+
+// captureTarball archives the running system tree into the given output file, except the
+// default system excludes and the given paths. The compression is picked from the output
+// file suffix, e.g. '.tar.gz' or '.tar.zst'.
+func captureTarball(cfg *types.RunConfig, output string, paths []string) error {
+	args := []string{
+		"--numeric-owner", "--xattrs", "--xattrs-include=*", "--acls", "--auto-compress",
+		"--anchored", "--wildcards",
+	}
+	for _, pattern := range constants.GetDefaultSystemExcludes() {
+		args = append(args, "--exclude=./"+pattern)
+	}
+	// Excluded paths are matched literally
+	args = append(args, "--no-wildcards")
+	for _, path := range paths {
+		args = append(args, "--exclude=."+path)
+	}
+	args = append(args, "-cpf", output, "-C", "/", ".")
+
+	out, err := cfg.Runner.Run("tar", args...)
+	if err != nil {
+		cfg.Logger.Debugf("tar output: %s", string(out))
+	}
+	return err
+}
+
+// captureExcludes returns the paths of the running system tree which are left out of the
+// captured image. Paths already left out as default system excludes are not listed.
+func captureExcludes(cfg *types.RunConfig, spec *types.CaptureSpec) ([]string, error) {
+	filters := types.CaptureSpec{
+		Includes: spec.Includes,
+		Excludes: append(constants.GetDefaultCaptureExcludes(), spec.Excludes...),
+	}
+	includes, excludes, err := filters.Filters()
+	if err != nil {
+		return nil, err
+	}
+	filtered, err := utils.FilterTreePaths(cfg.Fs, "/", includes, excludes)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, path := range filtered {
+		if !matchesSystemExcludes(path) {
+			paths = append(paths, path)
+		}
+	}
+	cfg.Logger.Debugf("Paths excluded from the captured image: %v", paths)
+	return paths, nil
+}
+
+// matchesSystemExcludes checks if the given path, relative to the root tree with a leading '/',
+// matches any of the default system excludes
+func matchesSystemExcludes(path string) bool {
+	for _, pattern := range constants.GetDefaultSystemExcludes() {
+		if ok, _ := filepath.Match("/"+pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action_test
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v4"
+	"github.com/twpayne/go-vfs/v4/vfst"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/action"
+	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+var _ = Describe("Capture action", Label("capture"), func() {
+	var config *types.RunConfig
+	var runner *mocks.FakeRunner
+	var fs vfs.FS
+	var cleanup func()
+	var spec *types.CaptureSpec
+	var output string
+
+	// excludes returns the paths excluded from the mksquashfs call
+	excludes := func() []string {
+		for _, cmd := range runner.GetCmds() {
+			if cmd[0] != "mksquashfs" {
+				continue
+			}
+			for i, arg := range cmd {
+				if arg == "-e" {
+					return cmd[i+1:]
+				}
+			}
+		}
+		return nil
+	}
+
+	BeforeEach(func() {
+		runner = mocks.NewFakeRunner()
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+			"/etc/hostname":                 "golden",
+			"/etc/machine-id":               "1234",
+			"/etc/ssh/sshd_config":          "config",
+			"/etc/ssh/ssh_host_rsa_key":     "key",
+			"/proc/1/cmdline":               "init",
+			"/oem/90_custom.yaml":           "config",
+			"/opt/app/bin/app":              "app",
+			"/opt/app/cache/data":           "data",
+			"/var/log/messages":             "log",
+			"/var/log/audit/audit.log":      "log",
+			"/usr/lib/os-release":           "ID=golden",
+			"/run/elemental/active_mode":    "1",
+			"/run/elemental/efi/grubenv":    "env",
+			"/tmp/elemental-capture/marker": "tmp",
+		})
+		Expect(err).Should(BeNil())
+
+		config = conf.NewRunConfig(
+			conf.WithFs(fs),
+			conf.WithRunner(runner),
+			conf.WithLogger(types.NewBufferLogger(&bytes.Buffer{})),
+			conf.WithSyscall(&mocks.FakeSyscall{}),
+			conf.WithMounter(mocks.NewFakeMounter()),
+		)
+		spec = conf.NewCaptureSpec()
+		output = "/root/golden.squashfs"
+	})
+	AfterEach(func() {
+		cleanup()
+	})
+	It("captures the running system except volatile and host specific paths", func() {
+		Expect(action.Capture(config, spec, output)).To(Succeed())
+		Expect(runner.IncludesCmds([][]string{{"mksquashfs", "/", output}})).To(Succeed())
+		Expect(excludes()).To(ContainElements(
+			"etc/machine-id", "etc/ssh/ssh_host_rsa_key", "oem/90_custom.yaml",
+			"var/log/messages", "var/log/audit", "root/golden.squashfs",
+		))
+		Expect(excludes()).NotTo(ContainElements("etc/hostname", "etc/ssh/sshd_config", "opt/app"))
+		// Runtime paths are only excluded by the default system excludes
+		Expect(excludes()).NotTo(ContainElement("proc/1"))
+		Expect(excludes()).To(ContainElements("proc/*", "run/*"))
+	})
+	It("honors the configured include and exclude expressions", func() {
+		spec.Excludes = []string{"^/opt/app/cache$"}
+		spec.Includes = []string{"^/var/log/audit$"}
+		Expect(action.Capture(config, spec, output)).To(Succeed())
+		Expect(excludes()).To(ContainElements("opt/app/cache", "var/log/messages"))
+		Expect(excludes()).NotTo(ContainElements("var/log/audit", "opt/app/bin"))
+	})
+	It("captures into a filesystem image", func() {
+		spec.FS = constants.LinuxImgFs
+		output = "/root/golden.img"
+		Expect(action.Capture(config, spec, output)).To(Succeed())
+		Expect(runner.IncludesCmds([][]string{{"mkfs.ext2"}, {"rsync"}})).To(Succeed())
+		Expect(runner.IncludesCmds([][]string{{"mksquashfs"}})).NotTo(Succeed())
+	})
+	It("captures into a tarball", func() {
+		spec.FS = constants.Tarball
+		output = "/root/golden.tar.gz"
+		Expect(action.Capture(config, spec, output)).To(Succeed())
+		Expect(runner.IncludesCmds([][]string{{"tar"}})).To(Succeed())
+		Expect(runner.IncludesCmds([][]string{{"mksquashfs"}})).NotTo(Succeed())
+		var args []string
+		for _, cmd := range runner.GetCmds() {
+			if cmd[0] == "tar" {
+				args = cmd[1:]
+			}
+		}
+		Expect(args).To(ContainElements(
+			"--exclude=./proc/*", "--exclude=./etc/machine-id", "--exclude=./oem/90_custom.yaml",
+			"--exclude=./root/golden.tar.gz",
+		))
+		Expect(args).NotTo(ContainElement("--exclude=./etc/hostname"))
+		Expect(args[len(args)-5:]).To(Equal([]string{"-cpf", output, "-C", "/", "."}))
+	})
+	It("fails if the output file already exists", func() {
+		Expect(utils.MkdirAll(fs, filepath.Dir(output), constants.DirPerm)).To(Succeed())
+		Expect(fs.WriteFile(output, []byte("image"), constants.FilePerm)).To(Succeed())
+		Expect(action.Capture(config, spec, output)).To(MatchError(ContainSubstring("already exists")))
+		Expect(runner.GetCmds()).To(BeEmpty())
+	})
+	It("fails if not booted from the active system", func() {
+		Expect(fs.Remove(constants.ActiveMode)).To(Succeed())
+		Expect(action.Capture(config, spec, output)).To(MatchError(ContainSubstring("requires booting from the active system")))
+		Expect(runner.GetCmds()).To(BeEmpty())
+	})
+	It("removes the partial output on failure", func() {
+		runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+			if cmd == "mksquashfs" {
+				Expect(fs.WriteFile(args[1], []byte("partial"), constants.FilePerm)).To(Succeed())
+				return []byte{}, errors.New("mksquashfs failed")
+			}
+			return []byte{}, nil
+		}
+		Expect(action.Capture(config, spec, output)).NotTo(Succeed())
+		Expect(utils.Exists(fs, output)).To(BeFalse())
+	})
+})
@@ -17,8 +17,17 @@ limitations under the License.
 package action
 
 import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
 	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
 
+	"github.com/rancher/elemental-toolkit/v2/internal/version"
+	"github.com/rancher/elemental-toolkit/v2/pkg/atomicfile"
+	cnst "github.com/rancher/elemental-toolkit/v2/pkg/constants"
 	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
@@ -55,17 +64,195 @@ func PowerAction(cfg *types.RunConfig) error {
 		code int
 	)
 
+	if (cfg.Reboot || cfg.PowerOff) && cfg.RebootMessage != "" {
+		// The message is a courtesy, failing to broadcast it does not prevent the power action
+		if _, wErr := cfg.Runner.Run("wall", cfg.RebootMessage); wErr != nil {
+			cfg.Logger.Warnf("failed broadcasting the reboot message: %v", wErr)
+		}
+	}
+
+	if cfg.Reboot || cfg.PowerOff {
+		// Power actions are forced, make sure all writes are on disk first
+		if sErr := utils.SyncAndDropCaches(cfg.Fs, cfg.Runner); sErr != nil {
+			cfg.Logger.Warnf("failed flushing writes before the power action: %v", sErr)
+		}
+	}
+
+	delay := time.Duration(cfg.RebootDelay)
 	if cfg.Reboot {
-		cfg.Logger.Infof("Rebooting in 5 seconds")
-		if err = utils.Reboot(cfg.Runner, 5); err != nil {
+		cfg.Logger.Infof("Rebooting in %d seconds", cfg.RebootDelay)
+		if err = utils.Reboot(cfg.Runner, delay); err != nil {
 			code = elementalError.Reboot
 		}
 	} else if cfg.PowerOff {
-		cfg.Logger.Infof("Shutting down in 5 seconds")
-		if err = utils.Shutdown(cfg.Runner, 5); err != nil {
+		cfg.Logger.Infof("Shutting down in %d seconds", cfg.RebootDelay)
+		if err = utils.Shutdown(cfg.Runner, delay); err != nil {
 			code = elementalError.PowerOff
 		}
 	}
 
 	return elementalError.NewFromError(err, code)
 }
+
+// artifactPath returns the path of the build artifact with the given extension. The name
+// is derived from the configured name, architecture and date and the output directory
+// is created if missing. An existing artifact is handled as set in the overwrite policy.
+func artifactPath(cfg *types.BuildConfig, ext string) (string, error) {
+	name := strings.ReplaceAll(cfg.Name, cnst.ArchPlaceholder, cfg.Platform.Arch)
+	if cfg.Date {
+		name = fmt.Sprintf("%s.%s", name, time.Now().Format("20060102"))
+	}
+
+	if cfg.OutDir != "" {
+		err := utils.MkdirAll(cfg.Fs, cfg.OutDir, cnst.DirPerm)
+		if err != nil {
+			return "", elementalError.NewFromError(err, elementalError.CreateDir)
+		}
+	}
+
+	path := filepath.Join(cfg.OutDir, fmt.Sprintf("%s.%s", name, ext))
+	for n := 1; ; n++ {
+		if exists, _ := utils.Exists(cfg.Fs, path); !exists {
+			return path, nil
+		}
+		switch cfg.Overwrite {
+		case cnst.FailOnArtifacts:
+			return "", elementalError.New(fmt.Sprintf("artifact %s already exists", path), elementalError.CreateFile)
+		case cnst.RenameArtifacts:
+			path = filepath.Join(cfg.OutDir, fmt.Sprintf("%s-%d.%s", name, n, ext))
+		default:
+			cfg.Logger.Warnf("Overwriting already existing %s", path)
+			err := cfg.Fs.Remove(path)
+			if err != nil {
+				return "", elementalError.NewFromError(err, elementalError.RemoveFile)
+			}
+		}
+	}
+}
+
+// writeArtifactChecksum writes the checksum file next to the given build artifact, the
+// file extension is the configured checksum algorithm, as in 'elemental.iso.sha512'
+func writeArtifactChecksum(cfg *types.BuildConfig, artifact string) error {
+	algo := cfg.ChecksumAlgo
+	if algo == "" {
+		algo = cnst.SHA256
+	}
+	checksum, err := utils.CalcFileChecksumWithAlgo(cfg.Fs, artifact, algo)
+	if err != nil {
+		cfg.Logger.Errorf("checksum computation failed: %v", err)
+		return elementalError.NewFromError(err, elementalError.CalculateChecksum)
+	}
+	data := []byte(fmt.Sprintf("%s %s\n", checksum, filepath.Base(artifact)))
+	err = cfg.Fs.WriteFile(fmt.Sprintf("%s.%s", artifact, algo), data, 0644)
+	if err != nil {
+		cfg.Logger.Errorf("cannot write checksum file: %v", err)
+		return elementalError.NewFromError(err, elementalError.CreateFile)
+	}
+	return nil
+}
+
+// deployedFiles returns the files of a system image written by all deployments, as the kernel
+// and initrd links, followed by the given files written by the action
+func deployedFiles(cfg *types.RunConfig, files ...string) []string {
+	deployed := []string{cnst.ImageVersionFile, cnst.KernelPath, cnst.InitrdPath}
+	if cfg.DefaultBootTarget != "" {
+		deployed = append(deployed, cnst.DefaultTargetLink)
+	}
+	return append(deployed, files...)
+}
+
+// writeImageVersion writes the toolkit build information together with the given deployment
+// state into the image version file of the given root tree
+func writeImageVersion(cfg *types.RunConfig, root string, state types.SystemState) error {
+	build := version.Get()
+	data, err := yaml.Marshal(types.ImageVersion{
+		Toolkit:     build.Version,
+		GitCommit:   build.GitCommit,
+		Snapshotter: cfg.Snapshotter.Type,
+		SystemState: state,
+	})
+	if err != nil {
+		return err
+	}
+	data = append([]byte("# Autogenerated file by elemental client, do not edit\n\n"), data...)
+
+	path := filepath.Join(root, cnst.ImageVersionFile)
+	err = utils.MkdirAll(cfg.Fs, filepath.Dir(path), cnst.DirPerm)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(cfg.Fs, path, data, cnst.FilePerm)
+}
+
+// WebhookEvent is the payload posted to the configured webhook on completion of an action
+type WebhookEvent struct {
+	MachineID string  `json:"machine-id"`
+	Action    string  `json:"action"`
+	Result    string  `json:"result"`
+	Error     string  `json:"error,omitempty"`
+	Version   string  `json:"version"`
+	Duration  float64 `json:"duration"`
+}
+
+// notifier is told the outcome of an action once it is done
+type notifier interface {
+	notify(err error)
+}
+
+// notifiers tells the outcome of an action to each of its notifiers, only the first
+// outcome is notified
+type notifiers struct {
+	list []notifier
+	sent bool
+}
+
+func newNotifiers(list ...notifier) *notifiers {
+	return &notifiers{list: list}
+}
+
+func (n *notifiers) notify(err error) {
+	if n.sent {
+		return
+	}
+	n.sent = true
+	for _, l := range n.list {
+		l.notify(err)
+	}
+}
+
+// webhook notifies the completion of an action to the configured webhook
+type webhook struct {
+	cfg    *types.RunConfig
+	action string
+	start  time.Time
+}
+
+func newWebhook(cfg *types.RunConfig, action string) *webhook {
+	return &webhook{cfg: cfg, action: action, start: time.Now()}
+}
+
+// notify posts the result of the action given its error. Notification errors are only logged
+func (w *webhook) notify(err error) {
+	if w.cfg.WebhookURL == "" {
+		return
+	}
+
+	event := WebhookEvent{
+		Action:   w.action,
+		Result:   "success",
+		Version:  version.GetVersion(),
+		Duration: time.Since(w.start).Seconds(),
+	}
+	if err != nil {
+		event.Result = "failure"
+		event.Error = err.Error()
+	}
+	if id, rErr := w.cfg.Fs.ReadFile(cnst.MachineID); rErr == nil {
+		event.MachineID = strings.TrimSpace(string(id))
+	}
+
+	w.cfg.Logger.Infof("Notifying %s result to %s", w.action, w.cfg.WebhookURL)
+	if pErr := w.cfg.Client.PostJSON(w.cfg.Logger, w.cfg.WebhookURL, event); pErr != nil {
+		w.cfg.Logger.Warnf("failed notifying webhook: %v", pErr)
+	}
+}
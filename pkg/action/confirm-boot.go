@@ -0,0 +1,89 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"path/filepath"
+	"strconv"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/bootloader"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+// setBootAttempts sets the attempts count of the boot assessment in the grubenv of the OEM
+// partition. GRUB decrements it on each boot of the active system pending assessment and
+// falls back to the passive snapshots once it is exhausted. An empty count keeps the single
+// attempt of the default boot assessment.
+func setBootAttempts(b types.Bootloader, oemDir string, attempts int) error {
+	value := ""
+	if attempts > 0 {
+		value = strconv.Itoa(attempts)
+	}
+	return b.SetPersistentVariables(
+		filepath.Join(oemDir, constants.GrubEnv),
+		map[string]string{constants.GrubBootAttempts: value},
+	)
+}
+
+// ConfirmBoot confirms the current boot of the active system is healthy by clearing the GRUB
+// boot attempts counter set on install or upgrade, so GRUB no longer falls back to a passive
+// snapshot. The counter is kept if not booted from the active system.
+func ConfirmBoot(cfg *types.RunConfig) (err error) {
+	if !elemental.IsActiveMode(cfg.Config) {
+		cfg.Logger.Warnf("Not booted from the active system, keeping the boot attempts counter")
+		return nil
+	}
+
+	cleanup := utils.NewCleanStack()
+	defer func() { err = cleanup.Cleanup(err) }()
+
+	parts, err := utils.GetAllPartitions()
+	if err != nil {
+		cfg.Logger.Errorf("could not read host partitions: %v", err)
+		return elementalError.NewFromError(err, elementalError.MountPartitions)
+	}
+	ep, err := cfg.PartitionSelection.ElementalPartitions(parts, nil)
+	if err != nil {
+		cfg.Logger.Errorf("could not pick the host partitions: %v", err)
+		return elementalError.NewFromError(err, elementalError.MountPartitions)
+	}
+	if ep.OEM == nil {
+		cfg.Logger.Errorf("OEM partition not found")
+		return elementalError.New("OEM partition not found", elementalError.MountPartitions)
+	}
+	if ep.OEM.MountPoint == "" {
+		ep.OEM.MountPoint = constants.OEMPath
+	}
+
+	umount, err := elemental.MountRWPartition(cfg.Config, ep.OEM)
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.MountPartitions)
+	}
+	cleanup.Push(umount)
+
+	cfg.Logger.Infof("Confirming boot, clearing the boot attempts counter")
+	err = setBootAttempts(bootloader.NewGrub(&cfg.Config), ep.OEM.MountPoint, 0)
+	if err != nil {
+		cfg.Logger.Errorf("failed clearing boot attempts counter: %v", err)
+		return elementalError.NewFromError(err, elementalError.SetGrubVariables)
+	}
+	return nil
+}
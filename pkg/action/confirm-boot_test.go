@@ -0,0 +1,93 @@
+/*
+   Copyright © 2022 - 2025 SUSE LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package action_test
+
+import (
+	"bytes"
+	"path/filepath"
+
+	"github.com/jaypipes/ghw/pkg/block"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v4"
+	"github.com/twpayne/go-vfs/v4/vfst"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/action"
+	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+var _ = Describe("ConfirmBoot action", Label("confirm-boot"), func() {
+	var config *types.RunConfig
+	var runner *mocks.FakeRunner
+	var fs vfs.FS
+	var mounter *mocks.FakeMounter
+	var cleanup func()
+	var ghwTest mocks.GhwMock
+
+	BeforeEach(func() {
+		runner = mocks.NewFakeRunner()
+		mounter = mocks.NewFakeMounter()
+		logger := types.NewBufferLogger(&bytes.Buffer{})
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).Should(BeNil())
+
+		config = conf.NewRunConfig(
+			conf.WithFs(fs),
+			conf.WithRunner(runner),
+			conf.WithLogger(logger),
+			conf.WithMounter(mounter),
+		)
+
+		mainDisk := block.Disk{
+			Name: "device",
+			Partitions: []*block.Partition{
+				{
+					Name:            "device2",
+					FilesystemLabel: "COS_OEM",
+					Type:            "ext4",
+				},
+			},
+		}
+		ghwTest = mocks.GhwMock{}
+		ghwTest.AddDisk(mainDisk)
+		ghwTest.CreateDevices()
+		Expect(utils.MkdirAll(fs, filepath.Dir(constants.ActiveMode), constants.DirPerm)).To(Succeed())
+	})
+	AfterEach(func() {
+		ghwTest.Clean()
+		cleanup()
+	})
+	It("clears the boot attempts counter when booted from the active system", func() {
+		Expect(fs.WriteFile(constants.ActiveMode, []byte("1"), constants.FilePerm)).To(Succeed())
+		Expect(action.ConfirmBoot(config)).To(Succeed())
+		Expect(runner.IncludesCmds([][]string{
+			{"grub2-editenv", filepath.Join(constants.OEMPath, constants.GrubEnv), "set", constants.GrubBootAttempts + "="},
+		})).To(Succeed())
+		// OEM partition was mounted and released
+		Expect(mounter.List()).To(BeEmpty())
+	})
+	It("keeps the boot attempts counter when booted from a passive snapshot", func() {
+		Expect(fs.WriteFile(constants.PassiveMode, []byte("1"), constants.FilePerm)).To(Succeed())
+		Expect(action.ConfirmBoot(config)).To(Succeed())
+		Expect(runner.GetCmds()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,167 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/snapshotter"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+// DriftReport lists the files of the active image differing from its source
+type DriftReport struct {
+	Source   string   `yaml:"source"`
+	Modified []string `yaml:"modified,omitempty"`
+	Added    []string `yaml:"added,omitempty"`
+	Removed  []string `yaml:"removed,omitempty"`
+}
+
+// Drifted returns true if any file of the active image differs from its source
+func (r DriftReport) Drifted() bool {
+	return len(r.Modified)+len(r.Added)+len(r.Removed) > 0
+}
+
+// CompareInstalledToSource compares the files of the active image, by checksum, with the
+// source it was deployed from. The source is resolved again pinned to the digest recorded
+// in the installation state. Transient paths and the files written at deployment time, as
+// recorded in the installation state, are not compared. The report is returned together with an error if
+// the active image drifted from its source.
+func CompareInstalledToSource(cfg *types.RunConfig) (report *DriftReport, err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() { err = cleanup.Cleanup(err) }()
+
+	state, err := cfg.LoadInstallState()
+	if err != nil {
+		cfg.Logger.Errorf("failed reading installation state: %v", err)
+		return nil, elementalError.NewFromError(err, elementalError.ReadFile)
+	}
+
+	id, active := activeSystemState(state)
+	if active == nil || active.Source == nil || active.Source.IsEmpty() {
+		return nil, elementalError.New("no source recorded for the active image", elementalError.DetectDrift)
+	}
+	src := pinSource(active.Source, active.Digest)
+	report = &DriftReport{Source: src.String()}
+
+	imgPath, err := snapshotter.SnapshotPath(state.Snapshotter, constants.RunningStateDir, id)
+	if err != nil {
+		return nil, elementalError.NewFromError(err, elementalError.DetectDrift)
+	}
+	imgRoot := imgPath
+	if dir, _ := utils.IsDir(cfg.Fs, imgPath); !dir {
+		img := &types.Image{File: imgPath, MountPoint: constants.DriftImageDir}
+		err = elemental.MountFileSystemImage(cfg.Config, img, "ro")
+		if err != nil {
+			cfg.Logger.Errorf("failed mounting active image %s: %v", imgPath, err)
+			return nil, elementalError.NewFromError(err, elementalError.DetectDrift)
+		}
+		cleanup.Push(func() error { return elemental.UnmountFileSystemImage(cfg.Config, img) })
+		imgRoot = img.MountPoint
+	}
+
+	srcRoot, err := utils.TempDir(cfg.Fs, "", "elemental-drift")
+	if err != nil {
+		return nil, elementalError.NewFromError(err, elementalError.CreateTempDir)
+	}
+	cleanup.Push(func() error { return utils.SafeRemoveAll(cfg.Logger, cfg.Mounter, cfg.Fs, srcRoot) })
+
+	cfg.Logger.Infof("Resolving source %s of the active image", report.Source)
+	err = elemental.DumpSource(cfg.Config, srcRoot, src, nil)
+	if err != nil {
+		cfg.Logger.Errorf("failed dumping source %s: %v", report.Source, err)
+		return nil, elementalError.NewFromError(err, elementalError.DumpSource)
+	}
+
+	// Files written at deployment time never match the source
+	deployed := active.Deployed
+	if len(deployed) == 0 {
+		deployed = constants.GetDeployedFiles()
+	}
+	excludes := constants.GetDefaultSystemExcludes()
+	for _, file := range deployed {
+		excludes = append(excludes, strings.TrimPrefix(file, "/"))
+	}
+	missing, err := utils.DiffData(cfg.Logger, cfg.Runner, cfg.Fs, srcRoot, imgRoot, excludes...)
+	if err != nil {
+		return nil, elementalError.NewFromError(err, elementalError.DetectDrift)
+	}
+	extra, err := utils.DiffData(cfg.Logger, cfg.Runner, cfg.Fs, imgRoot, srcRoot, excludes...)
+	if err != nil {
+		return nil, elementalError.NewFromError(err, elementalError.DetectDrift)
+	}
+
+	// Files differing in content are reported in both directions
+	inExtra := map[string]bool{}
+	for _, path := range extra {
+		inExtra[path] = true
+	}
+	for _, path := range missing {
+		if inExtra[path] {
+			report.Modified = append(report.Modified, path)
+			delete(inExtra, path)
+		} else {
+			report.Removed = append(report.Removed, path)
+		}
+	}
+	for _, path := range extra {
+		if inExtra[path] {
+			report.Added = append(report.Added, path)
+		}
+	}
+
+	if report.Drifted() {
+		return report, elementalError.New(
+			fmt.Sprintf(
+				"active image drifted from %s: %d modified, %d added and %d removed files",
+				report.Source, len(report.Modified), len(report.Added), len(report.Removed),
+			),
+			elementalError.DetectDrift,
+		)
+	}
+	cfg.Logger.Infof("Active image matches its source %s", report.Source)
+	return report, nil
+}
+
+// activeSystemState returns the snapshot id and deployment state of the active image
+func activeSystemState(state *types.InstallState) (int, *types.SystemState) {
+	statePart := state.Partitions[constants.StatePartName]
+	if statePart == nil {
+		return 0, nil
+	}
+	for id, snap := range statePart.Snapshots {
+		if snap.Active {
+			return id, snap
+		}
+	}
+	return 0, nil
+}
+
+// pinSource returns the given image source pinned to the given digest, other sources
+// or sources without a digest are returned as is
+func pinSource(src *types.ImageSource, digest string) *types.ImageSource {
+	if src == nil || !src.IsImage() || !strings.HasPrefix(digest, "sha256:") {
+		return src
+	}
+	ref := strings.SplitN(src.Value(), "@", 2)[0]
+	return types.NewDockerSrc(fmt.Sprintf("%s@%s", ref, digest))
+}
@@ -0,0 +1,164 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v4"
+	"github.com/twpayne/go-vfs/v4/vfst"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/action"
+	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+var _ = Describe("CompareInstalledToSource action", Label("drift"), func() {
+	var config *types.RunConfig
+	var runner *mocks.FakeRunner
+	var fs vfs.FS
+	var mounter *mocks.FakeMounter
+	var extractor *mocks.FakeImageExtractor
+	var cleanup func()
+	var state *types.InstallState
+	var srcDiff, imgDiff string
+
+	BeforeEach(func() {
+		runner = mocks.NewFakeRunner()
+		mounter = mocks.NewFakeMounter()
+		logger := types.NewBufferLogger(&bytes.Buffer{})
+		extractor = mocks.NewFakeImageExtractor(logger)
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).Should(BeNil())
+
+		config = conf.NewRunConfig(
+			conf.WithFs(fs),
+			conf.WithRunner(runner),
+			conf.WithLogger(logger),
+			conf.WithMounter(mounter),
+			conf.WithImageExtractor(extractor),
+		)
+
+		activeImg := filepath.Join(constants.RunningStateDir, ".snapshots/1/snapshot.img")
+		Expect(utils.MkdirAll(fs, filepath.Dir(activeImg), constants.DirPerm)).To(Succeed())
+		Expect(fs.WriteFile(activeImg, []byte("active"), constants.FilePerm)).To(Succeed())
+
+		state = &types.InstallState{
+			Snapshotter: types.NewLoopDevice(),
+			Partitions: map[string]*types.PartitionState{
+				constants.StatePartName: {
+					FSLabel: constants.StateLabel,
+					Snapshots: map[int]*types.SystemState{
+						1: {
+							Source: types.NewDockerSrc("registry.org/os:v1.0"),
+							Digest: "sha256:0a1b2c",
+							Active: true,
+						},
+					},
+				},
+			},
+		}
+		Expect(config.WriteInstallState(state, filepath.Join(constants.RunningStateDir, constants.InstallStateFile), "")).To(Succeed())
+
+		srcDiff, imgDiff = "", ""
+		runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+			switch cmd {
+			case "losetup":
+				return []byte("/dev/loop0"), nil
+			case constants.Rsync:
+				if strings.Contains(args[len(args)-2], "elemental-drift") {
+					return []byte(srcDiff), nil
+				}
+				return []byte(imgDiff), nil
+			default:
+				return []byte{}, nil
+			}
+		}
+	})
+	AfterEach(func() {
+		cleanup()
+	})
+	It("reports no drift if the active image matches its source", func() {
+		report, err := action.CompareInstalledToSource(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Drifted()).To(BeFalse())
+		Expect(report.Source).To(Equal("oci://registry.org/os:v1.0@sha256:0a1b2c"))
+		Expect(extractor.Auths).To(HaveKey("registry.org/os:v1.0@sha256:0a1b2c"))
+		Expect(mounter.IsLikelyNotMountPoint(constants.DriftImageDir)).To(BeTrue())
+	})
+	It("reports modified, added and removed files", func() {
+		srcDiff = ">fcs...... usr/bin/ls\n>f+++++++++ usr/lib/removed.so\n.d..t...... usr/\n"
+		imgDiff = ">fcs...... usr/bin/ls\n>f+++++++++ usr/bin/backdoor\n"
+
+		report, err := action.CompareInstalledToSource(config)
+		Expect(err).To(HaveOccurred())
+		Expect(report.Modified).To(Equal([]string{"usr/bin/ls"}))
+		Expect(report.Added).To(Equal([]string{"usr/bin/backdoor"}))
+		Expect(report.Removed).To(Equal([]string{"usr/lib/removed.so"}))
+	})
+	It("excludes transient paths and the image version file", func() {
+		_, err := action.CompareInstalledToSource(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(runner.IncludesCmds([][]string{
+			{constants.Rsync, "--dry-run", "--checksum", "--itemize-changes", "--archive", "--exclude=.snapshots"},
+		})).To(Succeed())
+		for _, cmd := range runner.GetCmds() {
+			if cmd[0] == constants.Rsync {
+				Expect(cmd).To(ContainElement("--exclude=etc/elemental/version"))
+			}
+		}
+	})
+	It("excludes the files written at deployment time as recorded in the state", func() {
+		state.Partitions[constants.StatePartName].Snapshots[1].Deployed = []string{
+			constants.ImageVersionFile, constants.KernelPath, constants.LocalTimeFile,
+		}
+		Expect(config.WriteInstallState(state, filepath.Join(constants.RunningStateDir, constants.InstallStateFile), "")).To(Succeed())
+
+		_, err := action.CompareInstalledToSource(config)
+		Expect(err).NotTo(HaveOccurred())
+		for _, cmd := range runner.GetCmds() {
+			if cmd[0] == constants.Rsync {
+				Expect(cmd).To(ContainElements("--exclude=boot/vmlinuz", "--exclude=etc/localtime"))
+				Expect(cmd).NotTo(ContainElement("--exclude=etc/machine-id"))
+			}
+		}
+	})
+	It("excludes all files possibly written at deployment time if none is recorded", func() {
+		_, err := action.CompareInstalledToSource(config)
+		Expect(err).NotTo(HaveOccurred())
+		for _, cmd := range runner.GetCmds() {
+			if cmd[0] == constants.Rsync {
+				Expect(cmd).To(ContainElements("--exclude=etc/machine-id", "--exclude=etc/systemd/system/default.target"))
+			}
+		}
+	})
+	It("fails if there is no source recorded for the active image", func() {
+		state.Partitions[constants.StatePartName].Snapshots[1].Source = nil
+		Expect(config.WriteInstallState(state, filepath.Join(constants.RunningStateDir, constants.InstallStateFile), "")).To(Succeed())
+
+		_, err := action.CompareInstalledToSource(config)
+		Expect(err).To(MatchError(ContainSubstring("no source recorded")))
+	})
+})
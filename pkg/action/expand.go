@@ -0,0 +1,94 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+var partNumRegexp = regexp.MustCompile(`(\d+)$`)
+
+// Expand grows the given elemental partition (e.g. 'persistent') and its filesystem to fill
+// all the free space available at the end of its disk. Only the last partition of a disk
+// can be expanded. It is safe to run it multiple times.
+func Expand(cfg *types.RunConfig, partName string) error {
+	parts, err := utils.GetAllPartitions()
+	if err != nil {
+		cfg.Logger.Errorf("could not read host partitions: %v", err)
+		return elementalError.NewFromError(err, elementalError.ExpandPartition)
+	}
+
+	state, err := cfg.LoadInstallState()
+	if err != nil {
+		cfg.Logger.Warnf("failed reading installation state: %s", err.Error())
+	}
+	ep, err := cfg.PartitionSelection.ElementalPartitions(parts, state)
+	if err != nil {
+		cfg.Logger.Errorf("could not pick the host partitions: %v", err)
+		return elementalError.NewFromError(err, elementalError.ExpandPartition)
+	}
+
+	var part *types.Partition
+	switch partName {
+	case constants.OEMPartName:
+		part = ep.OEM
+	case constants.RecoveryPartName:
+		part = ep.Recovery
+	case constants.StatePartName:
+		part = ep.State
+	case constants.PersistentPartName:
+		part = ep.Persistent
+	default:
+		return elementalError.New(fmt.Sprintf("partition '%s' can't be expanded", partName), elementalError.ExpandPartition)
+	}
+	if part == nil {
+		return elementalError.New(fmt.Sprintf("%s partition not found", partName), elementalError.ExpandPartition)
+	}
+
+	partNum := partitionNumber(part)
+	for _, p := range parts {
+		if p.Disk == part.Disk && partitionNumber(p) > partNum {
+			cfg.Logger.Errorf("%s is not the last partition of %s", part.Path, part.Disk)
+			return elementalError.New(
+				fmt.Sprintf("only the last partition of a disk can be expanded, found %s after %s", p.Path, part.Path),
+				elementalError.ExpandPartition,
+			)
+		}
+	}
+
+	cfg.Logger.Infof("Expanding %s partition (%s)", partName, part.Path)
+	err = utils.GrowPartition(cfg.Runner, part.Disk, partNum)
+	if err != nil {
+		cfg.Logger.Errorf("failed expanding %s partition: %v", partName, err)
+		return elementalError.NewFromError(err, elementalError.ExpandPartition)
+	}
+	return nil
+}
+
+// partitionNumber returns the partition number parsed from the partition device path
+func partitionNumber(part *types.Partition) int {
+	match := partNumRegexp.FindString(part.Path)
+	num, _ := strconv.Atoi(match)
+	return num
+}
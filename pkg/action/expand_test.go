@@ -0,0 +1,108 @@
+/*
+   Copyright © 2022 - 2025 SUSE LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package action_test
+
+import (
+	"bytes"
+
+	"github.com/jaypipes/ghw/pkg/block"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v4/vfst"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/action"
+	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+var _ = Describe("Expand action", Label("expand"), func() {
+	var config *types.RunConfig
+	var runner *mocks.FakeRunner
+	var cleanup func()
+	var ghwTest mocks.GhwMock
+
+	BeforeEach(func() {
+		runner = mocks.NewFakeRunner()
+		runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+			if cmd == "lsblk" {
+				return []byte(`FSTYPE="ext4" MOUNTPOINT="/run/elemental/persistent"`), nil
+			}
+			return []byte{}, nil
+		}
+		fs, fsCleanup, err := vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).Should(BeNil())
+		cleanup = fsCleanup
+
+		config = conf.NewRunConfig(
+			conf.WithFs(fs),
+			conf.WithRunner(runner),
+			conf.WithLogger(types.NewBufferLogger(&bytes.Buffer{})),
+			conf.WithMounter(mocks.NewFakeMounter()),
+		)
+
+		mainDisk := block.Disk{
+			Name: "device",
+			Partitions: []*block.Partition{
+				{
+					Name:            "device1",
+					FilesystemLabel: "COS_GRUB",
+					Type:            "vfat",
+				},
+				{
+					Name:            "device2",
+					FilesystemLabel: "COS_STATE",
+					Type:            "ext4",
+				},
+				{
+					Name:            "device3",
+					FilesystemLabel: "COS_PERSISTENT",
+					Type:            "ext4",
+				},
+			},
+		}
+		ghwTest = mocks.GhwMock{}
+		ghwTest.AddDisk(mainDisk)
+		ghwTest.CreateDevices()
+	})
+	AfterEach(func() {
+		ghwTest.Clean()
+		cleanup()
+	})
+	It("expands the persistent partition", func() {
+		Expect(action.Expand(config, constants.PersistentPartName)).To(Succeed())
+		Expect(runner.IncludesCmds([][]string{
+			{"growpart", "/dev/device", "3"},
+			{"resize2fs", "/dev/device3"},
+		})).To(Succeed())
+	})
+	It("fails to expand a partition which is not the last one", func() {
+		err := action.Expand(config, constants.StatePartName)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("only the last partition"))
+		Expect(runner.IncludesCmds([][]string{{"growpart"}})).NotTo(Succeed())
+	})
+	It("fails to expand a missing partition", func() {
+		err := action.Expand(config, constants.RecoveryPartName)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("not found"))
+	})
+	It("fails to expand an unknown partition", func() {
+		Expect(action.Expand(config, "bootloader")).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,85 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+// History prints the upgrade history stored in the OEM partition to the given writer,
+// the oldest upgrade first. The OEM partition is temporarily mounted if required.
+func History(cfg *types.RunConfig, out io.Writer) (err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() { err = cleanup.Cleanup(err) }()
+
+	parts, err := utils.GetAllPartitions()
+	if err != nil {
+		cfg.Logger.Errorf("could not read host partitions: %v", err)
+		return elementalError.NewFromError(err, elementalError.MountPartitions)
+	}
+	ep, err := cfg.PartitionSelection.ElementalPartitions(parts, nil)
+	if err != nil {
+		cfg.Logger.Errorf("could not pick the host partitions: %v", err)
+		return elementalError.NewFromError(err, elementalError.MountPartitions)
+	}
+	if ep.OEM == nil {
+		cfg.Logger.Errorf("OEM partition not found")
+		return elementalError.New("OEM partition not found", elementalError.MountPartitions)
+	}
+	if ep.OEM.MountPoint == "" {
+		ep.OEM.MountPoint = constants.OEMPath
+		err = elemental.MountPartition(cfg.Config, ep.OEM, "ro")
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.MountPartitions)
+		}
+		cleanup.Push(func() error { return elemental.UnmountPartition(cfg.Config, ep.OEM) })
+	}
+
+	history, err := cfg.LoadUpgradeHistory(filepath.Join(ep.OEM.MountPoint, constants.UpgradeHistoryFile))
+	if err != nil {
+		cfg.Logger.Errorf("failed reading upgrade history: %v", err)
+		return err
+	}
+	if len(history) == 0 {
+		cfg.Logger.Infof("No upgrades recorded")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DATE\tFROM\tTO\tDIGEST\tRESULT")
+	for _, r := range history {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.Date, withVersion(r.From, r.FromVersion), withVersion(r.To, r.ToVersion), r.Digest, r.Result)
+	}
+	return w.Flush()
+}
+
+// withVersion appends the OS version, if known, to the given source
+func withVersion(source, version string) string {
+	if version == "" {
+		return source
+	}
+	return fmt.Sprintf("%s (%s)", source, version)
+}
@@ -0,0 +1,111 @@
+/*
+   Copyright © 2022 - 2025 SUSE LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package action_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+
+	"github.com/jaypipes/ghw/pkg/block"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v4"
+	"github.com/twpayne/go-vfs/v4/vfst"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/action"
+	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+var _ = Describe("History action", Label("history"), func() {
+	var config *types.RunConfig
+	var runner *mocks.FakeRunner
+	var fs vfs.FS
+	var mounter *mocks.FakeMounter
+	var cleanup func()
+	var ghwTest mocks.GhwMock
+	var historyFile string
+
+	BeforeEach(func() {
+		runner = mocks.NewFakeRunner()
+		mounter = mocks.NewFakeMounter()
+		logger := types.NewBufferLogger(&bytes.Buffer{})
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).Should(BeNil())
+
+		config = conf.NewRunConfig(
+			conf.WithFs(fs),
+			conf.WithRunner(runner),
+			conf.WithLogger(logger),
+			conf.WithMounter(mounter),
+		)
+
+		mainDisk := block.Disk{
+			Name: "device",
+			Partitions: []*block.Partition{
+				{
+					Name:            "device2",
+					FilesystemLabel: "COS_OEM",
+					Type:            "ext4",
+				},
+			},
+		}
+		ghwTest = mocks.GhwMock{}
+		ghwTest.AddDisk(mainDisk)
+		ghwTest.CreateDevices()
+		historyFile = filepath.Join(constants.OEMPath, constants.UpgradeHistoryFile)
+		Expect(utils.MkdirAll(fs, constants.OEMPath, constants.DirPerm)).To(Succeed())
+	})
+	AfterEach(func() {
+		ghwTest.Clean()
+		cleanup()
+	})
+	It("prints the recorded upgrades", func() {
+		Expect(config.AppendUpgradeHistory(historyFile, types.UpgradeRecord{
+			Date: "2024-01-01T00:00:00Z", From: "oci://os:v1", To: "oci://os:v2", Result: constants.UpgradeFailed,
+		})).To(Succeed())
+		Expect(config.AppendUpgradeHistory(historyFile, types.UpgradeRecord{
+			Date: "2024-01-02T00:00:00Z", From: "oci://os:v1", FromVersion: "1.0", To: "oci://os:v2", ToVersion: "2.0",
+			Digest: "sha256:abcd", Result: constants.UpgradeSucceeded,
+		})).To(Succeed())
+
+		out := &bytes.Buffer{}
+		Expect(action.History(config, out)).To(Succeed())
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		Expect(lines).To(HaveLen(3))
+		Expect(lines[1]).To(ContainSubstring(constants.UpgradeFailed))
+		Expect(lines[2]).To(ContainSubstring("sha256:abcd"))
+		Expect(lines[2]).To(ContainSubstring("oci://os:v1 (1.0)"))
+		Expect(lines[2]).To(ContainSubstring("oci://os:v2 (2.0)"))
+		// OEM partition was mounted and released
+		Expect(mounter.List()).To(BeEmpty())
+	})
+	It("prints nothing if there is no history", func() {
+		out := &bytes.Buffer{}
+		Expect(action.History(config, out)).To(Succeed())
+		Expect(out.String()).To(BeEmpty())
+	})
+	It("fails on a corrupted history file", func() {
+		Expect(fs.WriteFile(historyFile, []byte("{"), constants.FilePerm)).To(Succeed())
+		Expect(action.History(config, &bytes.Buffer{})).NotTo(Succeed())
+	})
+})
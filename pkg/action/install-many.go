@@ -0,0 +1,267 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/twpayne/go-vfs/v4"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/cloudinit"
+	cnst "github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+// InstallMany installs the same system into several target devices at once. The system
+// source is dumped only once into a shared tree, then each target is installed from it with
+// at most 'parallel' installations at the same time. Install mount points are fixed paths,
+// so each installation runs in its own mount namespace. Partitioning and formatting are
+// serialized, as all targets get the same filesystem labels, and installations relying on
+// label lookups of existing partitions (no-format, skip-partitioning) are not supported.
+// A failure on one target does not abort the others, all failures are returned together.
+func InstallMany(cfg *types.RunConfig, spec *types.InstallSpec, targets []string, parallel int, opts ...InstallActionOption) (err error) {
+	notifier := newNotifiers(newWebhook(cfg, "install-many"), newMetricsNotifier(cfg, "install-many"))
+	defer func() { notifier.notify(err) }()
+
+	cleanup := utils.NewCleanStack()
+	defer func() { err = cleanup.Cleanup(err) }()
+
+	err = checkInstallManySpec(spec, targets)
+	if err != nil {
+		cfg.Logger.Errorf("invalid setup to install several targets: %v", err)
+		return elementalError.NewFromError(err, elementalError.InvalidTarget)
+	}
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	// Set the clock only once, before any download
+	err = elemental.SyncTime(cfg.Config, spec.TimeSync)
+	if err != nil {
+		cfg.Logger.Errorf("failed setting system time: %v", err)
+		return elementalError.NewFromError(err, elementalError.SyncTime)
+	}
+
+	src := spec.System
+	if spec.Iso != "" {
+		isoSrc, isoCleaner, err := elemental.SourceFormISO(cfg.Config, spec.Iso, spec.IsoChecksum)
+		cleanup.Push(isoCleaner)
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.Unknown)
+		}
+		src = isoSrc
+	}
+
+	tree, err := elemental.StagingDir(cfg.Config, "", "elemental-install-", 0)
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.CreateTempDir)
+	}
+	cleanup.Push(func() error { return utils.SafeRemoveAll(cfg.Logger, cfg.Mounter, cfg.Fs, tree) })
+
+	cfg.Logger.Infof("Dumping %s once for %d targets", src.String(), len(targets))
+	err = elemental.MirrorRoot(cfg.Config, tree, src)
+	if err != nil {
+		cfg.Logger.Errorf("failed dumping source '%s': %v", src.String(), err)
+		return elementalError.NewFromError(err, elementalError.DumpSource)
+	}
+
+	// Power actions and notifications are only applied once all installations are done
+	targetCfg := *cfg
+	targetCfg.Reboot, targetCfg.PowerOff = false, false
+	targetCfg.WebhookURL, targetCfg.MetricsFile = "", ""
+
+	var (
+		errs       error
+		lock       sync.Mutex
+		deviceLock sync.Mutex
+		wg         sync.WaitGroup
+	)
+	slots := make(chan struct{}, parallel)
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			cfg.Logger.Infof("Installing %s", target)
+			err := installTarget(&targetCfg, newTargetSpec(spec, src, target, tree), &deviceLock, opts...)
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				cfg.Logger.Errorf("failed installing %s: %v", target, err)
+				errs = multierror.Append(errs, fmt.Errorf("target %s: %w", target, err))
+				return
+			}
+			cfg.Logger.Infof("Installed %s", target)
+		}(target)
+	}
+	wg.Wait()
+
+	if errs != nil {
+		failed := len(errs.(*multierror.Error).Errors)
+		cfg.Logger.Errorf("%d of %d installations failed", failed, len(targets))
+		return elementalError.NewFromError(errs, elementalError.InstallMany)
+	}
+	cfg.Logger.Infof("All %d installations completed", len(targets))
+
+	// Do not reboot/poweroff on cleanup errors
+	err = cleanup.Cleanup(nil)
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.Cleanup)
+	}
+	notifier.notify(nil)
+	return PowerAction(cfg)
+}
+
+// checkInstallManySpec checks the given targets can be installed at once with the given spec.
+// All targets share the filesystem labels, thus partitions can't be looked up by label.
+func checkInstallManySpec(spec *types.InstallSpec, targets []string) error {
+	if len(targets) == 0 {
+		return fmt.Errorf("no target devices supplied")
+	}
+	for i, target := range targets {
+		if target == cnst.AutoTarget {
+			return fmt.Errorf("the '%s' target can't be used to install several targets", cnst.AutoTarget)
+		}
+		if slices.Contains(targets[i+1:], target) {
+			return fmt.Errorf("target %s is set more than once", target)
+		}
+	}
+	switch {
+	case spec.NoFormat:
+		return fmt.Errorf("no-format requires looking up partitions by label, which is ambiguous for several targets")
+	case spec.SkipPartitioning:
+		return fmt.Errorf("skip-partitioning can't be used to install several targets")
+	case len(spec.RaidDisks) > 0:
+		return fmt.Errorf("raid-disks can't be used to install several targets")
+	}
+	for _, part := range spec.Partitions.PartitionsByInstallOrder(spec.ExtraPartitions) {
+		if part.FSUUID != "" {
+			return fmt.Errorf("filesystem UUID of partition %s would be set on all targets", part.Name)
+		}
+	}
+	return nil
+}
+
+// newTargetSpec returns a copy of the given spec to install the given target from the
+// dumped tree of the system source src
+func newTargetSpec(spec *types.InstallSpec, src *types.ImageSource, target, tree string) *types.InstallSpec {
+	targetSpec := *spec
+	targetSpec.Target = target
+	targetSpec.Iso = ""
+	targetSpec.System = types.NewDirSrc(tree)
+	targetSpec.System.SetDigest(src.GetDigest())
+	if spec.RecoverySystem.Source.String() == spec.System.String() {
+		targetSpec.RecoverySystem.Source = targetSpec.System
+	}
+	// The clock is already set, only the timezone is applied to each target
+	targetSpec.TimeSync = types.TimeSyncSpec{Timezone: spec.TimeSync.Timezone}
+
+	// Partitions are updated by the installation, e.g. their device path
+	parts := spec.Partitions
+	for _, part := range []**types.Partition{&parts.BIOS, &parts.Boot, &parts.OEM, &parts.Recovery, &parts.State, &parts.Persistent, &parts.Var, &parts.Root} {
+		if *part != nil {
+			copied := **part
+			*part = &copied
+		}
+	}
+	targetSpec.Partitions = parts
+	targetSpec.ExtraPartitions = types.PartitionList{}
+	for _, part := range spec.ExtraPartitions {
+		copied := *part
+		targetSpec.ExtraPartitions = append(targetSpec.ExtraPartitions, &copied)
+	}
+	return &targetSpec
+}
+
+// installTarget runs an installation within a private mount namespace. The namespace is
+// bound to the OS thread, thus the thread is locked for the whole installation and never
+// unlocked, so it is discarded once done. Cloud-init stages are run sequentially by a
+// cloud-init runner of the target, as they run on other threads they enter the namespace
+// and root of the locked thread.
+func installTarget(cfg *types.RunConfig, spec *types.InstallSpec, deviceLock sync.Locker, opts ...InstallActionOption) error {
+	errCh := make(chan error)
+	go func() {
+		runtime.LockOSThread()
+		err := cfg.Syscall.UnshareMountNS()
+		if err != nil {
+			errCh <- fmt.Errorf("failed creating mount namespace: %w", err)
+			return
+		}
+		install, err := NewInstallAction(targetConfig(cfg, syscall.Gettid()), spec, opts...)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		install.deviceLock = deviceLock
+		errCh <- install.Run()
+	}()
+	return <-errCh
+}
+
+// targetConfig returns a copy of the given config to install a target from the given
+// locked thread. Parallel cloud-init stages are run sequentially and the yip runner is
+// replaced by one running within the mount namespace and root of the thread.
+func targetConfig(cfg *types.RunConfig, tid int) *types.RunConfig {
+	targetCfg := *cfg
+	targetCfg.StageConcurrency = map[string]string{}
+	for stage, mode := range cfg.StageConcurrency {
+		if mode == cnst.StageParallel {
+			mode = cnst.StageSequential
+		}
+		targetCfg.StageConcurrency[stage] = mode
+	}
+
+	if _, ok := cfg.CloudInitRunner.(*cloudinit.YipCloudInitRunner); ok {
+		task := threadRunner{Runner: cfg.Runner, tid: tid}
+		targetCfg.CloudInitRunner = cloudinit.NewYipCloudInitRunner(
+			cfg.Logger, task, vfs.NewPathFS(vfs.OSFS, fmt.Sprintf("/proc/%d/root", tid)),
+		)
+	}
+	return &targetCfg
+}
+
+// threadRunner runs commands within the mount namespace, root and working directory of
+// the given thread
+type threadRunner struct {
+	types.Runner
+	tid int
+}
+
+func (t threadRunner) args(command string, args []string) []string {
+	return append([]string{"-t", strconv.Itoa(t.tid), "-m", "-r", "-w", "--", command}, args...)
+}
+
+func (t threadRunner) InitCmd(command string, args ...string) *exec.Cmd {
+	return t.Runner.InitCmd("nsenter", t.args(command, args)...)
+}
+
+func (t threadRunner) Run(command string, args ...string) ([]byte, error) {
+	return t.Runner.Run("nsenter", t.args(command, args)...)
+}
@@ -18,11 +18,21 @@ package action
 
 import (
 	"fmt"
+	iofs "io/fs"
+	"maps"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
+	"gopkg.in/yaml.v3"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/atomicfile"
 	"github.com/rancher/elemental-toolkit/v2/pkg/bootloader"
+	"github.com/rancher/elemental-toolkit/v2/pkg/cloudinit"
 	cnst "github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	eleefi "github.com/rancher/elemental-toolkit/v2/pkg/efi"
 	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
 	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
 	"github.com/rancher/elemental-toolkit/v2/pkg/snapshotter"
@@ -36,6 +46,21 @@ type InstallAction struct {
 	bootloader  types.Bootloader
 	snapshotter types.Snapshotter
 	snapshot    *types.Snapshot
+	timer       *utils.PhaseTimer
+	sbom        string
+	version     string
+	deployed    []string
+	checksums   map[string]string
+	// Cloud-config files installed if no cloud-init source is set
+	defaultCloudConfig iofs.FS
+	// Serializes device preparation of concurrent installations, see InstallMany
+	deviceLock sync.Locker
+	// Writes a provisioning marker to the state partition, see FactoryInstall
+	provisioningMarker bool
+	// Firmware variables the dbx update is applied to, see checkDbxUpdate
+	efivars   eleefi.Variables
+	dbxUpdate *eleefi.DbxUpdate
+	dbxState  *types.DbxUpdateState
 }
 
 type InstallActionOption func(i *InstallAction) error
@@ -47,10 +72,36 @@ func WithInstallBootloader(bootloader types.Bootloader) func(i *InstallAction) e
 	}
 }
 
+// WithInstallDefaultCloudConfig sets the default cloud-config files, by default the ones
+// embedded in the binary are used
+func WithInstallDefaultCloudConfig(configs iofs.FS) func(i *InstallAction) error {
+	return func(i *InstallAction) error {
+		i.defaultCloudConfig = configs
+		return nil
+	}
+}
+
+// WithInstallProvisioningMarker writes a marker file to the state partition recording
+// when and from which source the system was provisioned
+func WithInstallProvisioningMarker() func(i *InstallAction) error {
+	return func(i *InstallAction) error {
+		i.provisioningMarker = true
+		return nil
+	}
+}
+
+// WithInstallEFIVariables sets the EFI variables the dbx update is applied to
+func WithInstallEFIVariables(efivars eleefi.Variables) func(i *InstallAction) error {
+	return func(i *InstallAction) error {
+		i.efivars = efivars
+		return nil
+	}
+}
+
 func NewInstallAction(cfg *types.RunConfig, spec *types.InstallSpec, opts ...InstallActionOption) (*InstallAction, error) {
 	var err error
 
-	i := &InstallAction{cfg: cfg, spec: spec}
+	i := &InstallAction{cfg: cfg, spec: spec, timer: utils.NewPhaseTimer(cfg.Logger), efivars: eleefi.RealEFIVariables{}}
 
 	for _, o := range opts {
 		err = o(i)
@@ -60,10 +111,23 @@ func NewInstallAction(cfg *types.RunConfig, spec *types.InstallSpec, opts ...Ins
 		}
 	}
 
+	if i.bootloader == nil && cfg.Bootloader == cnst.BootloaderNone {
+		i.bootloader = bootloader.NewNone(&cfg.Config, bootloader.NewGrubTemplateData(
+			i.spec.GetGrubLabels(), i.spec.GrubDefEntry, cfg.Snapshotter.Type,
+		))
+	}
+
 	if i.bootloader == nil {
+		// EFI boot entries can't point to RAID arrays, firmware boots from the
+		// fallback path of any of the member disks instead. Disks partitioned
+		// by external tools do not register boot entries on the installing host either.
+		disableBootEntry := i.spec.DisableBootEntry || i.spec.IsRaid() || i.spec.SkipPartitioning
 		i.bootloader = bootloader.NewGrub(&cfg.Config,
-			bootloader.WithGrubDisableBootEntry(i.spec.DisableBootEntry),
+			bootloader.WithGrubDisableBootEntry(disableBootEntry),
 			bootloader.WithGrubAutoDisableBootEntry(),
+			bootloader.WithGrubTemplateData(bootloader.NewGrubTemplateData(
+				i.spec.GetGrubLabels(), i.spec.GrubDefEntry, cfg.Snapshotter.Type,
+			)),
 		)
 	}
 
@@ -71,7 +135,15 @@ func NewInstallAction(cfg *types.RunConfig, spec *types.InstallSpec, opts ...Ins
 		i.snapshotter, err = snapshotter.NewSnapshotter(cfg.Config, cfg.Snapshotter, i.bootloader)
 	}
 
+	if i.defaultCloudConfig == nil {
+		i.defaultCloudConfig = cloudinit.DefaultConfigs()
+	}
+
 	if i.cfg.Snapshotter.Type == cnst.BtrfsSnapshotterType {
+		if spec.SkipPartitioning {
+			cfg.Logger.Errorf("btrfs snapshotter requires formatting the state partition, it can't be used with skip-partitioning")
+			return nil, fmt.Errorf("btrfs snapshotter is not supported with skip-partitioning")
+		}
 		if spec.Partitions.State.FS != cnst.Btrfs {
 			cfg.Logger.Warning("Btrfs snapshotter type, forcing btrfs filesystem on state partition")
 			spec.Partitions.State.FS = cnst.Btrfs
@@ -85,6 +157,7 @@ func NewInstallAction(cfg *types.RunConfig, spec *types.InstallSpec, opts ...Ins
 // it appends defiled cloud init paths rooted to the deployed root. This way any
 // 'after-install' hook provided by the deployed system image is also taken into account.
 func (i *InstallAction) installHook(hook string) error {
+	defer i.timer.Track("hook " + hook)()
 	cIPaths := i.cfg.CloudInitPaths
 	if hook == cnst.AfterInstallHook {
 		cIPaths = append(cIPaths, utils.PreAppendRoot(cnst.WorkingImgDir, i.cfg.CloudInitPaths...)...)
@@ -93,6 +166,7 @@ func (i *InstallAction) installHook(hook string) error {
 }
 
 func (i *InstallAction) installChrootHook(hook string, root string) error {
+	defer i.timer.Track("hook " + hook)()
 	extraMounts := map[string]string{}
 	persistent := i.spec.Partitions.Persistent
 	if persistent != nil && persistent.MountPoint != "" {
@@ -123,6 +197,8 @@ func (i *InstallAction) createInstallStateYaml() error {
 	installState := &types.InstallState{
 		Date:        date,
 		Snapshotter: i.cfg.Snapshotter,
+		Timings:     i.timer.Timings(),
+		DbxUpdate:   i.dbxState,
 		Partitions: map[string]*types.PartitionState{
 			cnst.StatePartName: {
 				FSLabel: i.spec.Partitions.State.FilesystemLabel,
@@ -130,10 +206,14 @@ func (i *InstallAction) createInstallStateYaml() error {
 					i.snapshot.ID: {
 						Source:     i.spec.System,
 						Digest:     i.spec.System.GetDigest(),
+						Version:    i.version,
 						Active:     true,
 						Labels:     i.spec.SnapshotLabels,
 						Date:       date,
 						FromAction: cnst.ActionInstall,
+						SBOM:       i.sbom,
+						Checksum:   i.checksums[cnst.ActiveImgName],
+						Deployed:   i.deployed,
 					},
 				},
 			},
@@ -147,6 +227,7 @@ func (i *InstallAction) createInstallStateYaml() error {
 					Labels:     i.spec.SnapshotLabels,
 					Date:       date,
 					FromAction: cnst.ActionInstall,
+					Checksum:   i.checksums[cnst.RecoveryImgName],
 				},
 			},
 		},
@@ -162,6 +243,16 @@ func (i *InstallAction) createInstallStateYaml() error {
 			FSLabel: i.spec.Partitions.Persistent.FilesystemLabel,
 		}
 	}
+	if i.spec.Partitions.Var != nil {
+		installState.Partitions[cnst.VarPartName] = &types.PartitionState{
+			FSLabel: i.spec.Partitions.Var.FilesystemLabel,
+		}
+	}
+	if i.spec.Partitions.Root != nil {
+		installState.Partitions[cnst.RootPartName] = &types.PartitionState{
+			FSLabel: i.spec.Partitions.Root.FilesystemLabel,
+		}
+	}
 	if i.spec.Partitions.Boot != nil {
 		installState.Partitions[cnst.BootPartName] = &types.PartitionState{
 			FSLabel: i.spec.Partitions.Boot.FilesystemLabel,
@@ -175,14 +266,199 @@ func (i *InstallAction) createInstallStateYaml() error {
 	)
 }
 
+// writeAnswerFile writes a configuration file to the state partition including all the
+// effective settings of this installation, so running an install with it reproduces it.
+// Image sources are pinned to the deployed digest and host specific data is left out.
+func (i *InstallAction) writeAnswerFile() error {
+	pinned := func(src *types.ImageSource) *types.ImageSource {
+		if src == nil {
+			return nil
+		}
+		return pinSource(src, src.GetDigest())
+	}
+	unbound := func(part *types.Partition) *types.Partition {
+		if part == nil {
+			return nil
+		}
+		p := *part
+		p.Path, p.Disk = "", ""
+		return &p
+	}
+
+	spec := *i.spec
+	spec.System = pinned(i.spec.System)
+	if spec.Iso != "" {
+		// The system source is set from the ISO at install time
+		spec.System = types.NewEmptySrc()
+	}
+	spec.RecoverySystem.Source = pinned(i.spec.RecoverySystem.Source)
+	if i.spec.RecoverySystem.Source.String() == i.spec.System.String() {
+		// Recovery defaults to the system source
+		spec.RecoverySystem.Source = types.NewEmptySrc()
+	}
+	spec.RecoverySystem.File, spec.RecoverySystem.MountPoint, spec.RecoverySystem.LoopDevice = "", "", ""
+	spec.Partitions = types.ElementalPartitions{
+		BIOS:       unbound(i.spec.Partitions.BIOS),
+		Boot:       unbound(i.spec.Partitions.Boot),
+		OEM:        unbound(i.spec.Partitions.OEM),
+		Recovery:   unbound(i.spec.Partitions.Recovery),
+		State:      unbound(i.spec.Partitions.State),
+		Persistent: unbound(i.spec.Partitions.Persistent),
+		Var:        unbound(i.spec.Partitions.Var),
+		Root:       unbound(i.spec.Partitions.Root),
+	}
+	spec.ExtraPartitions = types.PartitionList{}
+	for _, part := range i.spec.ExtraPartitions {
+		spec.ExtraPartitions = append(spec.ExtraPartitions, unbound(part))
+	}
+
+	// Default cloud-init paths are always included, do not duplicate them
+	cfg := *i.cfg
+	cfg.CloudInitPaths = []string{}
+	for _, path := range i.cfg.CloudInitPaths {
+		if !slices.Contains(cnst.GetCloudInitPaths(), path) {
+			cfg.CloudInitPaths = append(cfg.CloudInitPaths, path)
+		}
+	}
+
+	// Secrets are redacted when written, leave them out so they are not replayed
+	cfg.HTTPHeaders = nil
+	header := "# Autogenerated file by elemental client, effective installation settings\n"
+	for _, scope := range i.cfg.HTTPHeaders {
+		header += fmt.Sprintf("# HTTP headers not included, set them again: %s %s\n",
+			scope.URL, strings.Join(slices.Sorted(maps.Keys(scope.Headers)), ", "))
+	}
+	for _, src := range []*types.ImageSource{i.spec.System, i.spec.RecoverySystem.Source} {
+		if src == nil || src.GetAuth() == nil {
+			continue
+		}
+		line := fmt.Sprintf("# Registry credentials not included, set them again: %s\n", pinned(src).String())
+		if !strings.Contains(header, line) {
+			header += line
+		}
+	}
+
+	answers := struct {
+		types.RunConfig `yaml:",inline"`
+		Install         *types.InstallSpec `yaml:"install"`
+	}{cfg, &spec}
+	data, err := yaml.Marshal(answers)
+	if err != nil {
+		return err
+	}
+
+	// Drop empty values, so defaults apply for them
+	var tree map[string]interface{}
+	if err = yaml.Unmarshal(data, &tree); err != nil {
+		return err
+	}
+	data, err = yaml.Marshal(pruneEmptyValues(tree))
+	if err != nil {
+		return err
+	}
+	data = append([]byte(header+"\n"), data...)
+
+	path := filepath.Join(i.spec.Partitions.State.MountPoint, cnst.InstallConfigFile)
+	i.cfg.Logger.Infof("Writing installation answer file to %s", path)
+	return atomicfile.WriteFile(i.cfg.Fs, path, data, i.cfg.ConfigFilePerm())
+}
+
+// writeProvisioningMarker writes a file to the state partition recording when and from
+// which source this system was provisioned
+func (i *InstallAction) writeProvisioningMarker() error {
+	marker := struct {
+		Date   string `yaml:"date"`
+		Source string `yaml:"source"`
+		Digest string `yaml:"digest,omitempty"`
+	}{
+		Date:   time.Now().Format(time.RFC3339),
+		Source: i.spec.System.String(),
+		Digest: i.spec.System.GetDigest(),
+	}
+	data, err := yaml.Marshal(marker)
+	if err != nil {
+		return err
+	}
+	data = append([]byte("# Autogenerated file by elemental client, do not edit\n\n"), data...)
+
+	path := filepath.Join(i.spec.Partitions.State.MountPoint, cnst.ProvisionedFile)
+	i.cfg.Logger.Infof("Writing provisioning marker to %s", path)
+	return atomicfile.WriteFile(i.cfg.Fs, path, data, cnst.FilePerm)
+}
+
+// pruneEmptyValues removes nil values and empty strings from the given decoded yaml map
+func pruneEmptyValues(tree map[string]interface{}) map[string]interface{} {
+	for key, value := range tree {
+		switch v := value.(type) {
+		case nil:
+			delete(tree, key)
+		case string:
+			if v == "" {
+				delete(tree, key)
+			}
+		case map[string]interface{}:
+			tree[key] = pruneEmptyValues(v)
+		}
+	}
+	return tree
+}
+
+// FactoryInstall runs an unattended installation meant for imaging lines. The system
+// is installed from a fixed source, its first boot setup is deferred to the first boot on
+// the final host, so the machine-id is unique there, a provisioning marker is written to
+// the state partition and the host powers off once done.
+func FactoryInstall(cfg *types.RunConfig, spec *types.InstallSpec, opts ...InstallActionOption) error {
+	if spec.Iso == "" {
+		if spec.System == nil || spec.System.IsEmpty() {
+			return elementalError.New("undefined source for the factory installation", elementalError.ReadingSpecConfig)
+		}
+		if spec.System.IsImage() && !utils.ValidTaggedContainerReference(spec.System.Value()) {
+			return elementalError.New(
+				fmt.Sprintf("image '%s' to install is not pinned to a tag or digest", spec.System.Value()),
+				elementalError.ReadingSpecConfig,
+			)
+		}
+	}
+
+	spec.SkipFirstBootSetup = true
+	if !spec.DisableBootEntry {
+		// The disk boots on the final host, boot entries of the imaging host are useless there
+		cfg.Logger.Infof("EFI boot entries are not created on factory installations")
+		spec.DisableBootEntry = true
+	}
+	cfg.Reboot = false
+	cfg.PowerOff = true
+
+	install, err := NewInstallAction(cfg, spec, append(opts, WithInstallProvisioningMarker())...)
+	if err != nil {
+		cfg.Logger.Errorf("failed to initialize install action: %v", err)
+		return err
+	}
+
+	cfg.Logger.Infof("Running factory installation of %s", spec.System.String())
+	return install.Run()
+}
+
 // InstallRun will install the system from a given configuration
 func (i InstallAction) Run() (err error) {
+	metrics := newMetricsNotifier(i.cfg, "install")
+	metrics.timer = i.timer
+	notifier := newNotifiers(newWebhook(i.cfg, "install"), metrics)
+	defer func() { notifier.notify(err) }()
+
 	cleanup := utils.NewCleanStack()
 	defer func() { err = cleanup.Cleanup(err) }()
 
+	// Set the clock before any download, certificates might be considered not valid yet
+	err = elemental.SyncTime(i.cfg.Config, i.spec.TimeSync)
+	if err != nil {
+		i.cfg.Logger.Errorf("failed setting system time: %v", err)
+		return elementalError.NewFromError(err, elementalError.SyncTime)
+	}
+
 	// Set installation sources from a downloaded ISO
 	if i.spec.Iso != "" {
-		isoSrc, isoCleaner, err := elemental.SourceFormISO(i.cfg.Config, i.spec.Iso)
+		isoSrc, isoCleaner, err := elemental.SourceFormISO(i.cfg.Config, i.spec.Iso, i.spec.IsoChecksum)
 		cleanup.Push(isoCleaner)
 		if err != nil {
 			return elementalError.NewFromError(err, elementalError.Unknown)
@@ -190,20 +466,53 @@ func (i InstallAction) Run() (err error) {
 		i.spec.System = isoSrc
 	}
 
-	// Partition and format device if needed
-	err = i.prepareDevice()
-	if err != nil {
-		return err
+	// Directory sources can be checked before any disk write, other sources once unpacked
+	checkTreeBoot := !i.spec.System.IsDir() || len(i.spec.TransformCmd) > 0
+	if !checkTreeBoot {
+		err = i.checkBootCompatibility(i.spec.System.Value())
+		if err != nil {
+			return err
+		}
 	}
 
-	err = elemental.MountPartitions(i.cfg.Config, i.spec.Partitions.PartitionsByMountPoint(false), "rw")
-	if err != nil {
-		i.cfg.Logger.Errorf("failed mounting partitions")
-		return elementalError.NewFromError(err, elementalError.MountPartitions)
+	// Firmware variables are only written once installed, but the update is checked before any disk write
+	if i.spec.DbxUpdate != "" {
+		err = i.checkDbxUpdate()
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.DbxUpdate)
+		}
+	}
+
+	if i.spec.SkipPartitioning {
+		// Partitions are already created and mounted by the caller
+		err = i.checkMountedPartitions()
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.MountPartitions)
+		}
+	} else {
+		// Partition and format device if needed
+		done := i.timer.Track("partition")
+		if i.deviceLock != nil {
+			i.deviceLock.Lock()
+		}
+		err = i.prepareDevice()
+		if i.deviceLock != nil {
+			i.deviceLock.Unlock()
+		}
+		done()
+		if err != nil {
+			return err
+		}
+
+		err = elemental.MountPartitions(i.cfg.Config, i.spec.Partitions.PartitionsByMountPoint(false), "rw")
+		if err != nil {
+			i.cfg.Logger.Errorf("failed mounting partitions")
+			return elementalError.NewFromError(err, elementalError.MountPartitions)
+		}
+		cleanup.Push(func() error {
+			return elemental.UnmountPartitions(i.cfg.Config, i.spec.Partitions.PartitionsByMountPoint(true))
+		})
 	}
-	cleanup.Push(func() error {
-		return elemental.UnmountPartitions(i.cfg.Config, i.spec.Partitions.PartitionsByMountPoint(true))
-	})
 
 	err = i.snapshotter.InitSnapshotter(i.spec.Partitions.State, i.spec.Partitions.Boot.MountPoint)
 	if err != nil {
@@ -226,12 +535,32 @@ func (i InstallAction) Run() (err error) {
 	}
 	cleanup.PushErrorOnly(func() error { return i.snapshotter.CloseTransactionOnError(i.snapshot) })
 
+	err = i.checkInodes(i.snapshot.WorkDir)
+	if err != nil {
+		return err
+	}
+
 	// Deploy system image
+	done := i.timer.Track("deploy system")
 	err = elemental.MirrorRoot(i.cfg.Config, i.snapshot.WorkDir, i.spec.System)
+	done()
 	if err != nil {
 		i.cfg.Logger.Errorf("failed deploying source: %s", i.spec.System.String())
 		return elementalError.NewFromError(err, elementalError.DumpSource)
 	}
+	i.version = osVersion(i.cfg.Fs, i.snapshot.WorkDir)
+	metrics.osVersion = i.version
+
+	err = i.transformSource(i.snapshot.WorkDir)
+	if err != nil {
+		return err
+	}
+	if checkTreeBoot {
+		err = i.checkBootCompatibility(i.snapshot.WorkDir)
+		if err != nil {
+			return err
+		}
+	}
 
 	// Fine tune the dumped tree
 	i.cfg.Logger.Info("Fine tune the dumped root tree")
@@ -241,6 +570,34 @@ func (i InstallAction) Run() (err error) {
 		return err
 	}
 
+	// Seed the var partition with the initial /var of the system
+	if i.spec.Partitions.Var != nil {
+		err = i.seedVarPartition()
+		if err != nil {
+			i.cfg.Logger.Errorf("failed seeding the var partition: %v", err)
+			return elementalError.NewFromError(err, elementalError.CopyData)
+		}
+	}
+
+	// Seed the root partition with everything but /usr of the system
+	if i.spec.Partitions.Root != nil {
+		err = elemental.SeedRootPartition(i.cfg.Config, i.snapshot.WorkDir, i.spec.Partitions)
+		if err != nil {
+			i.cfg.Logger.Errorf("failed seeding the root partition: %v", err)
+			return elementalError.NewFromError(err, elementalError.CopyData)
+		}
+	}
+
+	// Filter the active root tree to derive the recovery image from it
+	var recoveryExcludes []string
+	if i.spec.RecoveryFromActive {
+		recoveryExcludes, err = i.recoveryExcludes()
+		if err != nil {
+			i.cfg.Logger.Errorf("failed filtering recovery paths from the active root tree: %v", err)
+			return err
+		}
+	}
+
 	// Closing snapshotter transaction
 	i.cfg.Logger.Info("Closing snapshotter transaction")
 	err = i.snapshotter.CloseTransaction(i.snapshot)
@@ -249,6 +606,15 @@ func (i InstallAction) Run() (err error) {
 		return err
 	}
 
+	// Record image checksums so the installation can be verified later on
+	i.checksums = map[string]string{}
+	if i.spec.RecordChecksums {
+		i.checksums[cnst.ActiveImgName], err = imageChecksum(i.cfg.Fs, i.snapshot.Path, i.cfg.ChecksumAlgo)
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.CreateFile)
+		}
+	}
+
 	// Install recovery
 	recoveryBootDir := filepath.Join(i.spec.Partitions.Recovery.MountPoint, "boot")
 	err = utils.MkdirAll(i.cfg.Fs, recoveryBootDir, cnst.DirPerm)
@@ -259,7 +625,7 @@ func (i InstallAction) Run() (err error) {
 
 	recoverySystem := i.spec.RecoverySystem
 	i.cfg.Logger.Info("Deploying recovery system")
-	if recoverySystem.Source.String() == i.spec.System.String() {
+	if i.spec.RecoveryFromActive || recoverySystem.Source.String() == i.spec.System.String() {
 		// Reuse already deployed root-tree from active snapshot
 		recoverySystem.Source, err = i.snapshotter.SnapshotToImageSource(i.snapshot)
 		if err != nil {
@@ -267,11 +633,19 @@ func (i InstallAction) Run() (err error) {
 		}
 		recoverySystem.Source.SetDigest(i.spec.System.GetDigest())
 	}
-	err = elemental.DeployRecoverySystem(i.cfg.Config, &recoverySystem)
+	done = i.timer.Track("deploy recovery")
+	err = elemental.DeployRecoverySystem(i.cfg.ForArtifact(cnst.RecoveryArtifact), &recoverySystem, recoveryExcludes...)
+	done()
 	if err != nil {
 		i.cfg.Logger.Errorf("Failed deploying recovery image: %v", err)
 		return elementalError.NewFromError(err, elementalError.DeployImage)
 	}
+	if i.spec.RecordChecksums {
+		i.checksums[cnst.RecoveryImgName], err = imageChecksum(i.cfg.Fs, recoverySystem.File, i.cfg.ChecksumAlgo)
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.CreateFile)
+		}
+	}
 
 	err = i.installHook(cnst.PostInstallHook)
 	if err != nil {
@@ -284,6 +658,22 @@ func (i InstallAction) Run() (err error) {
 	if err != nil {
 		return elementalError.NewFromError(err, elementalError.CreateFile)
 	}
+	if i.spec.AnswerFile {
+		err = i.writeAnswerFile()
+		if err != nil {
+			i.cfg.Logger.Errorf("failed writing the installation answer file: %v", err)
+			return elementalError.NewFromError(err, elementalError.CreateFile)
+		}
+	}
+	if i.provisioningMarker {
+		err = i.writeProvisioningMarker()
+		if err != nil {
+			i.cfg.Logger.Errorf("failed writing the provisioning marker: %v", err)
+			return elementalError.NewFromError(err, elementalError.CreateFile)
+		}
+	}
+
+	i.trimFilesystems()
 
 	// Do not reboot/poweroff on cleanup errors
 	err = cleanup.Cleanup(err)
@@ -292,7 +682,7 @@ func (i InstallAction) Run() (err error) {
 	}
 
 	// If we want to eject the cd, create the required executable so the cd is ejected at shutdown
-	if i.cfg.EjectCD && utils.BootedFrom(i.cfg.Runner, "cdroot") {
+	if i.cfg.EjectCD && !i.spec.SkipFirstBootSetup && utils.BootedFrom(i.cfg.Runner, "cdroot") {
 		i.cfg.Logger.Infof("Writing eject script")
 		err = i.cfg.Fs.WriteFile("/usr/lib/systemd/system-shutdown/eject", []byte(cnst.EjectScript), 0744)
 		if err != nil {
@@ -300,20 +690,231 @@ func (i InstallAction) Run() (err error) {
 		}
 	}
 
+	i.timer.Summary()
+	notifier.notify(nil)
 	return PowerAction(i.cfg)
 }
 
+// trimFilesystems discards the unused blocks of the mounted partitions according to the
+// trim policy. Trimming is only an optimization, failures are logged and ignored.
+func (i *InstallAction) trimFilesystems() {
+	if i.spec.TrimAfterInstall == cnst.TrimNever || !i.cfg.Runner.CommandExists(cnst.Fstrim) {
+		return
+	}
+	for _, part := range i.spec.Partitions.PartitionsByMountPoint(false) {
+		if part.MountPoint == "" || part.Path == "" {
+			continue
+		}
+		if i.spec.TrimAfterInstall != cnst.TrimAlways {
+			out, err := i.cfg.Runner.Run("lsblk", "-dno", "ROTA", part.Path)
+			if err != nil || strings.TrimSpace(string(out)) != "0" {
+				i.cfg.Logger.Debugf("Not trimming %s, not a non-rotational disk", part.MountPoint)
+				continue
+			}
+		}
+		out, err := i.cfg.Runner.Run(cnst.Fstrim, "-v", part.MountPoint)
+		if err != nil {
+			i.cfg.Logger.Warnf("Could not trim %s: %s", part.MountPoint, strings.TrimSpace(string(out)))
+			continue
+		}
+		i.cfg.Logger.Debugf("Trimmed %s: %s", part.MountPoint, strings.TrimSpace(string(out)))
+	}
+}
+
+// checkMountedPartitions verifies all partitions are mounted at their mountpoints and carry
+// the expected filesystem label, as they are expected to be mounted in advance when
+// partitioning is skipped
+func (i *InstallAction) checkMountedPartitions() error {
+	hostParts, err := utils.GetAllPartitions()
+	if err != nil {
+		i.cfg.Logger.Errorf("could not read host partitions: %v", err)
+		return err
+	}
+	pinned, err := i.pinnedPartitions(hostParts)
+	if err != nil {
+		return err
+	}
+
+	for _, part := range i.spec.Partitions.PartitionsByMountPoint(false) {
+		if !utils.IsMounted(i.cfg.Mounter, part.MountPoint) {
+			i.cfg.Logger.Errorf("partition %s is not mounted at %s", part.Name, part.MountPoint)
+			return fmt.Errorf("mountpoint %s of partition %s not found", part.MountPoint, part.Name)
+		}
+
+		var mounted *types.Partition
+		for _, hostPart := range hostParts {
+			if hostPart.MountPoint != "" && filepath.Clean(hostPart.MountPoint) == filepath.Clean(part.MountPoint) {
+				mounted = hostPart
+				break
+			}
+		}
+		if mounted == nil {
+			return fmt.Errorf("no partition found mounted at %s for partition %s", part.MountPoint, part.Name)
+		}
+		if pin, ok := pinned[part.Name]; ok && pin.Path != mounted.Path {
+			return fmt.Errorf(
+				"partition %s mounted at %s is not the %s partition %s selected in partition-selection",
+				mounted.Path, part.MountPoint, part.Name, pin.Path,
+			)
+		}
+		if part.FilesystemLabel != "" && mounted.FilesystemLabel != part.FilesystemLabel {
+			return fmt.Errorf(
+				"partition %s mounted at %s is labeled '%s', expected '%s'",
+				mounted.Path, part.MountPoint, mounted.FilesystemLabel, part.FilesystemLabel,
+			)
+		}
+		i.cfg.Logger.Debugf("Using partition %s mounted at %s", mounted.Path, part.MountPoint)
+	}
+	return nil
+}
+
+// pinnedPartitions returns the given host partitions pinned by path or by GPT partition GUID
+// in the partition selection, indexed by the name of the partition to install
+func (i *InstallAction) pinnedPartitions(hostParts types.PartitionList) (map[string]*types.Partition, error) {
+	pinned := map[string]*types.Partition{}
+	for _, part := range i.spec.Partitions.PartitionsByInstallOrder(types.PartitionList{}) {
+		host, ok, err := i.cfg.PartitionSelection.Pinned(part.Name, hostParts)
+		if err != nil {
+			i.cfg.Logger.Errorf("failed selecting the %s partition: %v", part.Name, err)
+			return nil, err
+		}
+		if ok {
+			pinned[part.Name] = host
+		}
+	}
+	return pinned, nil
+}
+
+// usePinnedPartitions sets the device of the partitions pinned in the partition selection, so
+// installing without formatting uses them instead of looking them up by filesystem label
+func (i *InstallAction) usePinnedPartitions() error {
+	if len(i.cfg.PartitionSelection.Paths) == 0 && len(i.cfg.PartitionSelection.GUIDs) == 0 {
+		return nil
+	}
+	hostParts, err := utils.GetAllPartitions()
+	if err != nil {
+		i.cfg.Logger.Errorf("could not read host partitions: %v", err)
+		return err
+	}
+	pinned, err := i.pinnedPartitions(hostParts)
+	if err != nil {
+		return err
+	}
+	for _, part := range i.spec.Partitions.PartitionsByInstallOrder(types.PartitionList{}) {
+		if host, ok := pinned[part.Name]; ok {
+			i.cfg.Logger.Infof("Using partition %s as the %s partition", host.Path, part.Name)
+			part.Path = host.Path
+		}
+	}
+	return nil
+}
+
+// seedVarPartition copies the /var contents of the deployed root tree to the var partition
+func (i *InstallAction) seedVarPartition() error {
+	varTree := filepath.Join(i.snapshot.WorkDir, cnst.VarPath)
+	if ok, _ := utils.Exists(i.cfg.Fs, varTree); !ok {
+		i.cfg.Logger.Warnf("no %s found in the system tree, the var partition is left empty", cnst.VarPath)
+		return nil
+	}
+	i.cfg.Logger.Infof("Seeding the var partition from %s", varTree)
+	return utils.SyncData(i.cfg.Logger, i.cfg.Runner, i.cfg.Fs, varTree, i.spec.Partitions.Var.MountPoint)
+}
+
+// recoveryExcludes returns the paths of the active root tree which are left out of the
+// recovery image according to the recovery include and exclude expressions
+func (i *InstallAction) recoveryExcludes() ([]string, error) {
+	includes, excludes, err := i.spec.RecoveryFilters()
+	if err != nil {
+		return nil, elementalError.NewFromError(err, elementalError.Unknown)
+	}
+	paths, err := utils.FilterTreePaths(i.cfg.Fs, i.snapshot.WorkDir, includes, excludes)
+	if err != nil {
+		return nil, elementalError.NewFromError(err, elementalError.ReadFile)
+	}
+	i.cfg.Logger.Debugf("Paths excluded from the recovery image: %v", paths)
+	return paths, nil
+}
+
+// findAutoTarget picks the target disk among the disks of the host not excluded by
+// path, label or device type. Disks of the preferred device type, if any, are picked
+// over the others.
+func (i *InstallAction) findAutoTarget() (string, error) {
+	var excludePaths []string
+	for _, path := range i.spec.ExcludeDevicePaths {
+		// Device paths are usually symlinks such as /dev/disk/by-id/*
+		resolved, err := utils.ResolveLink(i.cfg.Fs, path, "/", cnst.MaxLinkDepth)
+		if err != nil {
+			resolved = path
+		}
+		excludePaths = append(excludePaths, resolved)
+	}
+
+	if len(i.spec.ExcludeDeviceTypes) > 0 || i.spec.PreferDeviceType != "" {
+		diskTypes, err := utils.DiskTypes(i.cfg.Fs, i.cfg.Runner)
+		if err != nil {
+			return "", err
+		}
+		var others []string
+		for disk, diskType := range diskTypes {
+			switch {
+			case slices.Contains(i.spec.ExcludeDeviceTypes, diskType):
+				i.cfg.Logger.Debugf("Excluding %s disk %s", diskType, disk)
+				excludePaths = append(excludePaths, disk)
+			case i.spec.PreferDeviceType != "" && diskType != i.spec.PreferDeviceType:
+				others = append(others, disk)
+			}
+		}
+
+		if i.spec.PreferDeviceType != "" && len(others) < len(diskTypes) {
+			target, err := utils.FindAutoTarget(
+				i.cfg.Runner, i.spec.AllowRemovable, i.spec.Force, i.spec.ExcludeDeviceLabels, append(excludePaths, others...),
+			)
+			if err == nil {
+				return target, nil
+			}
+			i.cfg.Logger.Warnf("No %s disk picked as target, trying other disks: %v", i.spec.PreferDeviceType, err)
+		}
+	}
+
+	return utils.FindAutoTarget(
+		i.cfg.Runner, i.spec.AllowRemovable, i.spec.Force, i.spec.ExcludeDeviceLabels, excludePaths,
+	)
+}
+
 func (i *InstallAction) prepareDevice() error {
 	if i.spec.NoFormat {
 		if elemental.CheckActiveDeployment(i.cfg.Config) && !i.spec.Force {
 			return elementalError.New("use `force` flag to run an installation over the current running deployment", elementalError.AlreadyInstalled)
 		}
+		err := i.usePinnedPartitions()
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.InvalidTarget)
+		}
 	} else {
+		if i.spec.Target == cnst.AutoTarget {
+			target, err := i.findAutoTarget()
+			if err != nil {
+				i.cfg.Logger.Errorf("failed finding a target disk: %v", err)
+				return elementalError.NewFromError(err, elementalError.InvalidTarget)
+			}
+			i.cfg.Logger.Infof("Automatically selected target disk %s", target)
+			i.spec.Target = target
+		}
+
 		// Deactivate any active volume on target
 		err := elemental.DeactivateDevices(i.cfg.Config)
 		if err != nil {
 			return elementalError.NewFromError(err, elementalError.DeactivatingDevices)
 		}
+		if len(i.spec.RaidDisks) > 0 {
+			if !strings.HasPrefix(i.spec.Target, "/dev/md") {
+				return elementalError.New(fmt.Sprintf("invalid RAID array device '%s'", i.spec.Target), elementalError.InvalidTarget)
+			}
+			err = elemental.CreateRaidArray(i.cfg.Config, i.spec.Target, i.spec.RaidLevel, i.spec.RaidDisks)
+			if err != nil {
+				return elementalError.NewFromError(err, elementalError.SetupRaid)
+			}
+		}
 		// Partition device
 		err = elemental.PartitionAndFormatDevice(i.cfg.Config, i.spec)
 		if err != nil {
@@ -323,21 +924,231 @@ func (i *InstallAction) prepareDevice() error {
 	return nil
 }
 
+// transformSource runs the configured transform command, if any, with the given unpacked
+// source tree set in its environment. A failure aborts the installation.
+func (i *InstallAction) transformSource(root string) error {
+	if len(i.spec.TransformCmd) == 0 {
+		return nil
+	}
+	defer i.timer.Track("transform")()
+
+	i.cfg.Logger.Infof("Running transform command '%s'", strings.Join(i.spec.TransformCmd, " "))
+	args := append([]string{fmt.Sprintf("%s=%s", cnst.SourceTreeEnv, root)}, i.spec.TransformCmd...)
+	out, err := i.cfg.Runner.Run("env", args...)
+	if err != nil {
+		i.cfg.Logger.Errorf("transform command failed: %s", strings.TrimSpace(string(out)))
+		return elementalError.NewFromError(fmt.Errorf("transform command failed: %w", err), elementalError.TransformSource)
+	}
+	i.cfg.Logger.Debugf("transform command output: %s", string(out))
+	return nil
+}
+
+// checkInodes checks the given target has enough free inodes to deploy a directory source,
+// file heavy trees could exhaust them while free space remains. Other sources are not
+// unpacked yet, thus they are not checked.
+func (i *InstallAction) checkInodes(target string) error {
+	if !i.spec.System.IsDir() {
+		return nil
+	}
+	src := i.spec.System.Value()
+	count, err := utils.CountInodes(i.cfg.Fs, src, cnst.GetDefaultSystemRootedExcludes(src)...)
+	if err != nil {
+		i.cfg.Logger.Errorf("failed counting the files of %s: %v", src, err)
+		return elementalError.NewFromError(err, elementalError.NotEnoughInodes)
+	}
+	free, err := utils.FreeInodes(i.cfg.Runner, target)
+	if err != nil {
+		i.cfg.Logger.Warnf("skipping the free inodes check: %v", err)
+		return nil
+	}
+	if count > free {
+		err = fmt.Errorf("the system requires %d inodes but only %d are free in %s", count, free, target)
+		i.cfg.Logger.Errorf("not enough free inodes: %v", err)
+		return elementalError.NewFromError(err, elementalError.NotEnoughInodes)
+	}
+	return nil
+}
+
+// checkDbxUpdate parses the configured dbx update and checks it is applicable to the firmware
+func (i *InstallAction) checkDbxUpdate() error {
+	data, err := i.cfg.Fs.ReadFile(i.spec.DbxUpdate)
+	if err != nil {
+		i.cfg.Logger.Errorf("failed reading dbx update %s: %v", i.spec.DbxUpdate, err)
+		return err
+	}
+	update, err := eleefi.ReadDbxUpdate(data)
+	if err != nil {
+		i.cfg.Logger.Errorf("invalid dbx update %s: %v", i.spec.DbxUpdate, err)
+		return err
+	}
+	missing, err := eleefi.ComputeDbxUpdate(i.efivars, update)
+	if err != nil {
+		i.cfg.Logger.Errorf("dbx update %s is not applicable: %v", i.spec.DbxUpdate, err)
+		return err
+	}
+	digest, err := utils.CalcFileChecksum(i.cfg.Fs, i.spec.DbxUpdate)
+	if err != nil {
+		i.cfg.Logger.Errorf("failed computing checksum of dbx update %s: %v", i.spec.DbxUpdate, err)
+		return err
+	}
+	i.cfg.Logger.Infof("dbx update %s adds %d of its %d signatures", i.spec.DbxUpdate, missing, update.Len())
+	i.dbxUpdate = update
+	i.dbxState = &types.DbxUpdateState{
+		Source:     i.spec.DbxUpdate,
+		Digest:     digest,
+		Timestamp:  update.Timestamp.Format(time.RFC3339),
+		Signatures: update.Len(),
+	}
+	return nil
+}
+
+// applyDbxUpdate applies the checked dbx update to the firmware
+func (i *InstallAction) applyDbxUpdate() error {
+	applied, err := eleefi.ApplyDbxUpdate(i.efivars, i.dbxUpdate)
+	if err != nil {
+		i.cfg.Logger.Errorf("failed applying dbx update %s: %v", i.spec.DbxUpdate, err)
+		return err
+	}
+	if applied == 0 {
+		i.cfg.Logger.Infof("dbx update %s is already applied", i.spec.DbxUpdate)
+	} else {
+		i.cfg.Logger.Infof("Applied %d signatures of dbx update %s", applied, i.spec.DbxUpdate)
+	}
+	i.dbxState.Applied = applied
+	return nil
+}
+
+// checkBootCompatibility checks the system tree at root can be booted on the target firmware
+func (i *InstallAction) checkBootCompatibility(root string) error {
+	err := elemental.CheckBootCompatibility(i.cfg.Config, root, i.spec.Firmware)
+	if err != nil {
+		i.cfg.Logger.Errorf("incompatible system source: %v", err)
+		return elementalError.NewFromError(err, elementalError.BootCompatibility)
+	}
+	return nil
+}
+
 func (i *InstallAction) refineDeployment() error { //nolint:dupl
-	// Copy cloud-init if any
-	err := elemental.CopyCloudConfig(i.cfg.Config, i.spec.Partitions.GetConfigStorage(), i.spec.CloudInit)
+	// Populate the OEM partition from the configured sources in order, so later sources
+	// and the cloud-init files written below win on conflicting paths
+	var err error
+	for _, src := range i.spec.OEMSources {
+		err = elemental.DumpSource(i.cfg.Config, i.spec.Partitions.GetConfigStorage(), src, nil)
+		if err != nil {
+			i.cfg.Logger.Errorf("failed populating OEM partition from %s: %v", src.String(), err)
+			return elementalError.NewFromError(err, elementalError.DumpSource)
+		}
+	}
+
+	// Copy cloud-init if any, otherwise fall back to the embedded defaults
+	if len(i.spec.CloudInit) > 0 {
+		err = elemental.CopyCloudConfig(i.cfg.Config, i.spec.Partitions.GetConfigStorage(), i.spec.CloudInit)
+	} else {
+		err = elemental.WriteDefaultCloudConfig(i.cfg.Config, i.spec.Partitions.GetConfigStorage(), i.defaultCloudConfig)
+	}
 	if err != nil {
 		return elementalError.NewFromError(err, elementalError.CopyFile)
 	}
+	err = elemental.WriteOverlayConfig(i.cfg.Config, i.spec.Partitions.GetConfigStorage(), i.spec.Overlay, i.spec.Partitions.Var, i.spec.Partitions.Root)
+	if err != nil {
+		i.cfg.Logger.Errorf("failed writing overlay config: %v", err)
+		return elementalError.NewFromError(err, elementalError.CreateFile)
+	}
+	err = elemental.WriteRecoveryPassConfig(i.cfg.Config, i.spec.Partitions.GetConfigStorage(), i.spec.RecoveryPassHash)
+	if err != nil {
+		i.cfg.Logger.Errorf("failed writing recovery password config: %v", err)
+		return elementalError.NewFromError(err, elementalError.CreateFile)
+	}
+	err = elemental.WriteUsersConfig(i.cfg.Config, i.spec.Partitions.GetConfigStorage(), i.spec.Users)
+	if err != nil {
+		i.cfg.Logger.Errorf("failed writing users config: %v", err)
+		return elementalError.NewFromError(err, elementalError.CreateUsers)
+	}
+	err = elemental.ValidateCloudConfig(i.cfg.Config, i.spec.Partitions.GetConfigStorage())
+	if err != nil {
+		i.cfg.Logger.Errorf("failed validating cloud-init config: %v", err)
+		return elementalError.NewFromError(err, elementalError.InvalidCloudConfig)
+	}
+	var files []string
+	if i.spec.SkipFirstBootSetup {
+		files = append(files, cnst.MachineID)
+	}
+	if i.spec.TimeSync.Timezone != "" {
+		files = append(files, cnst.LocalTimeFile)
+	}
+	if i.spec.IsRaid() {
+		files = append(files, cnst.MdadmConf)
+	}
+	i.deployed = deployedFiles(i.cfg, files...)
+
+	if i.spec.SkipFirstBootSetup {
+		err = elemental.ResetMachineID(i.cfg.Config, i.snapshot.WorkDir)
+		if err != nil {
+			i.cfg.Logger.Errorf("failed resetting machine ID: %v", err)
+			return elementalError.NewFromError(err, elementalError.CreateFile)
+		}
+	}
+	err = elemental.LinkKernelInitrd(i.cfg.Config, i.snapshot.WorkDir)
+	if err != nil {
+		i.cfg.Logger.Errorf("failed linking kernel and initrd: %v", err)
+		return elementalError.NewFromError(err, elementalError.FindKernelInitrd)
+	}
+	err = elemental.SetDefaultBootTarget(i.cfg.Config, i.snapshot.WorkDir, i.cfg.DefaultBootTarget)
+	if err != nil {
+		i.cfg.Logger.Errorf("failed setting default boot target: %v", err)
+		return elementalError.NewFromError(err, elementalError.BootTarget)
+	}
+	err = elemental.SetTimezone(i.cfg.Config, i.snapshot.WorkDir, i.spec.TimeSync.Timezone)
+	if err != nil {
+		i.cfg.Logger.Errorf("failed setting timezone: %v", err)
+		return elementalError.NewFromError(err, elementalError.SyncTime)
+	}
+	if i.spec.SBOM != "" {
+		i.sbom, err = elemental.WriteSBOM(
+			i.cfg.Config, i.snapshot.WorkDir, i.spec.Partitions.GetConfigStorage(), i.spec.SBOM, i.spec.System,
+		)
+		if err != nil {
+			i.cfg.Logger.Errorf("failed writing SBOM: %v", err)
+			return elementalError.NewFromError(err, elementalError.CreateFile)
+		}
+	}
+
+	err = writeImageVersion(i.cfg, i.snapshot.WorkDir, types.SystemState{
+		Source:     i.spec.System,
+		Digest:     i.spec.System.GetDigest(),
+		Version:    i.version,
+		Labels:     i.spec.SnapshotLabels,
+		Date:       time.Now().Format(time.RFC3339),
+		FromAction: cnst.ActionInstall,
+		Deployed:   i.deployed,
+	})
+	if err != nil {
+		i.cfg.Logger.Errorf("failed writing image version file: %v", err)
+		return elementalError.NewFromError(err, elementalError.CreateFile)
+	}
+
 	// Install grub
+	done := i.timer.Track("bootloader")
 	err = i.bootloader.Install(
 		i.snapshot.WorkDir,
 		i.spec.Partitions.Boot.MountPoint,
 	)
+	done()
 	if err != nil {
 		i.cfg.Logger.Errorf("failed installing grub: %v", err)
 		return elementalError.NewFromError(err, elementalError.InstallGrub)
 	}
+	if i.dbxUpdate != nil {
+		err = i.applyDbxUpdate()
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.DbxUpdate)
+		}
+	}
+	err = elemental.WriteGrubPassword(i.cfg.Config, i.spec.Partitions.Boot.MountPoint, i.spec.GrubPasswordHash)
+	if err != nil {
+		i.cfg.Logger.Errorf("failed writing grub password: %v", err)
+		return elementalError.NewFromError(err, elementalError.CreateFile)
+	}
 
 	err = i.installChrootHook(cnst.AfterInstallChrootHook, cnst.WorkingImgDir)
 	if err != nil {
@@ -351,6 +1162,15 @@ func (i *InstallAction) refineDeployment() error { //nolint:dupl
 	}
 
 	grubVars := i.spec.GetGrubLabels()
+	if i.spec.IsRaid() {
+		// Make the initrd assemble the array on boot
+		uuid, err := elemental.ConfigureRaid(i.cfg.Config, i.spec.Target, i.snapshot.WorkDir)
+		if err != nil {
+			i.cfg.Logger.Errorf("failed configuring RAID array: %v", err)
+			return elementalError.NewFromError(err, elementalError.SetupRaid)
+		}
+		grubVars["raid_uuid"] = uuid
+	}
 	err = i.bootloader.SetPersistentVariables(
 		filepath.Join(i.spec.Partitions.Boot.MountPoint, cnst.GrubOEMEnv),
 		grubVars,
@@ -370,5 +1190,13 @@ func (i *InstallAction) refineDeployment() error { //nolint:dupl
 		i.cfg.Logger.Errorf("failed setting defaut GRUB entry: %v", err)
 		return elementalError.NewFromError(err, elementalError.SetDefaultGrubEntry)
 	}
+
+	if i.spec.BootAttempts > 0 && i.spec.Partitions.OEM != nil {
+		err = setBootAttempts(i.bootloader, i.spec.Partitions.OEM.MountPoint, i.spec.BootAttempts)
+		if err != nil {
+			i.cfg.Logger.Errorf("failed setting boot attempts counter: %v", err)
+			return elementalError.NewFromError(err, elementalError.SetGrubVariables)
+		}
+	}
 	return nil
 }
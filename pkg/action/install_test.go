@@ -18,19 +18,26 @@ package action_test
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"path/filepath"
+	"strings"
+	"testing/fstest"
+	"time"
 
+	efilib "github.com/canonical/go-efilib"
 	"github.com/jaypipes/ghw/pkg/block"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/twpayne/go-vfs/v4"
 	"github.com/twpayne/go-vfs/v4/vfst"
+	"gopkg.in/yaml.v3"
 
 	"github.com/rancher/elemental-toolkit/v2/pkg/action"
 	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
 	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
 	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
@@ -68,6 +75,7 @@ var _ = Describe("Install action tests", func() {
 		var err error
 		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
 		Expect(err).Should(BeNil())
+		client.Fs = fs
 
 		cloudInit = &mocks.FakeCloudInitRunner{}
 		config = conf.NewRunConfig(
@@ -94,6 +102,14 @@ var _ = Describe("Install action tests", func() {
 		var spec *types.InstallSpec
 		var installer *action.InstallAction
 
+		// bootTree creates the kernel and initrd of a system tree
+		bootTree := func(root string) {
+			Expect(utils.MkdirAll(fs, filepath.Join(root, "boot"), constants.DirPerm)).To(Succeed())
+			Expect(utils.MkdirAll(fs, filepath.Join(root, "lib/modules/6.7"), constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile(filepath.Join(root, "boot/vmlinuz-6.7"), []byte{}, constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile(filepath.Join(root, "boot/elemental.initrd-6.7"), []byte{}, constants.FilePerm)).To(Succeed())
+		}
+
 		BeforeEach(func() {
 			device = "/some/device"
 			err = utils.MkdirAll(fs, filepath.Dir(device), constants.DirPerm)
@@ -141,13 +157,26 @@ var _ = Describe("Install action tests", func() {
 						return cmdline()
 					}
 					return []byte{}, nil
+				case "rsync":
+					// Only the boot files of system trees are copied
+					root, _ := fs.RawPath("/")
+					src := strings.TrimPrefix(args[len(args)-2], strings.TrimSuffix(root, "/"))
+					dst := strings.TrimPrefix(args[len(args)-1], strings.TrimSuffix(root, "/"))
+					if ok, _ := utils.Exists(fs, filepath.Join(src, "boot/vmlinuz-6.7")); ok {
+						bootTree(dst)
+					}
+					return []byte{}, nil
 				default:
 					return []byte{}, nil
 				}
 			}
 
 			// Need to create the IsoBaseTree, like if we are booting from iso
-			Expect(utils.MkdirAll(fs, constants.ISOBaseTree, constants.DirPerm)).To(Succeed())
+			bootTree(constants.ISOBaseTree)
+			extractor.SideEffect = func(_, destination, _ string, _, _ bool) (string, error) {
+				bootTree(destination)
+				return mocks.FakeDigest, nil
+			}
 
 			spec = conf.NewInstallSpec(config.Config)
 			loopCfg, ok := config.Snapshotter.Config.(*types.LoopDeviceConfig)
@@ -187,6 +216,7 @@ var _ = Describe("Install action tests", func() {
 						Name:            "device2",
 						FilesystemLabel: "COS_STATE",
 						Type:            "ext4",
+						UUID:            "3f2504e0-4f89-41d3-9a0c-0305e82c3301",
 					},
 					{
 						Name:            "device3",
@@ -223,6 +253,373 @@ var _ = Describe("Install action tests", func() {
 			Expect(runner.IncludesCmds([][]string{{"reboot", "-f"}}))
 		})
 
+		It("Broadcasts a message and reboots without delay", Label("reboot"), func() {
+			spec.Target = device
+			config.Reboot = true
+			config.RebootDelay = 0
+			config.RebootMessage = "Installation completed"
+			start := time.Now()
+			Expect(installer.Run()).To(BeNil())
+			Expect(time.Since(start)).To(BeNumerically("<", constants.RebootDelay*time.Second))
+			Expect(runner.MatchMilestones([][]string{
+				{"wall", "Installation completed"},
+				{"sync"},
+				{"reboot", "-f"},
+			})).To(Succeed())
+		})
+
+		It("Fails if the default boot target is not in the image", Label("boot-target"), func() {
+			spec.Target = device
+			config.DefaultBootTarget = "maintenance.target"
+			Expect(installer.Run()).To(MatchError(ContainSubstring("boot target maintenance.target not found")))
+		})
+
+		It("Trims the installed filesystems on non-rotational disks", Label("trim"), func() {
+			spec.Target = device
+			sideEffect := runner.SideEffect
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "lsblk" && args[len(args)-2] == "ROTA" {
+					if args[len(args)-1] == "/some/device3" {
+						return []byte("1\n"), nil
+					}
+					return []byte("0\n"), nil
+				}
+				return sideEffect(cmd, args...)
+			}
+			Expect(installer.Run()).To(BeNil())
+			Expect(runner.IncludesCmds([][]string{
+				{"fstrim", "-v", constants.OEMDir},
+				{"fstrim", "-v", constants.PersistentDir},
+			})).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"fstrim", "-v", constants.RecoveryDir}})).NotTo(Succeed())
+		})
+
+		It("Does not trim the installed filesystems if disabled", Label("trim"), func() {
+			spec.Target = device
+			spec.TrimAfterInstall = constants.TrimNever
+			Expect(installer.Run()).To(BeNil())
+			Expect(runner.IncludesCmds([][]string{{"fstrim"}})).NotTo(Succeed())
+		})
+
+		It("Notifies the result to the webhook", Label("webhook"), func() {
+			spec.Target = device
+			config.WebhookURL = "https://dashboard.example.org/events"
+			Expect(utils.MkdirAll(fs, "/etc", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile(constants.MachineID, []byte("abcd\n"), constants.FilePerm)).To(Succeed())
+			Expect(installer.Run()).To(BeNil())
+			Expect(client.PostData[config.WebhookURL]).To(HaveLen(1))
+			event, ok := client.PostData[config.WebhookURL][0].(action.WebhookEvent)
+			Expect(ok).To(BeTrue())
+			Expect(event.MachineID).To(Equal("abcd"))
+			Expect(event.Action).To(Equal("install"))
+			Expect(event.Result).To(Equal("success"))
+		})
+
+		It("Notifies failures to the webhook", Label("webhook"), func() {
+			spec.Target = device
+			config.WebhookURL = "https://dashboard.example.org/events"
+			cmdFail = "parted"
+			Expect(installer.Run()).NotTo(BeNil())
+			event, ok := client.PostData[config.WebhookURL][0].(action.WebhookEvent)
+			Expect(ok).To(BeTrue())
+			Expect(event.Result).To(Equal("failure"))
+			Expect(event.Error).NotTo(BeEmpty())
+		})
+
+		It("Does not fail if the webhook can't be notified", Label("webhook"), func() {
+			spec.Target = device
+			config.WebhookURL = "https://dashboard.example.org/events"
+			client.Error = true
+			Expect(installer.Run()).To(BeNil())
+			Expect(memLog.String()).To(ContainSubstring("failed notifying webhook"))
+		})
+
+		It("Updates the metrics file with the installation outcome", Label("metrics"), func() {
+			spec.Target = device
+			config.MetricsFile = "/var/lib/node_exporter/elemental.prom"
+			Expect(utils.MkdirAll(fs, filepath.Dir(config.MetricsFile), constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile(config.MetricsFile, []byte(
+				"elemental_action_runs_total{action=\"install\",result=\"success\"} 2\n"+
+					"elemental_action_runs_total{action=\"install\",result=\"failure\"} 1\n"+
+					"elemental_action_success{action=\"install\"} 0\n"+
+					"elemental_action_success{action=\"upgrade\"} 1\n"+
+					"node_custom_metric 7\n",
+			), constants.FilePerm)).To(Succeed())
+
+			Expect(installer.Run()).To(BeNil())
+			data, err := fs.ReadFile(config.MetricsFile)
+			Expect(err).ToNot(HaveOccurred())
+			metrics := string(data)
+			Expect(metrics).To(ContainSubstring("# TYPE elemental_action_runs_total counter\n"))
+			Expect(metrics).To(ContainSubstring("elemental_action_runs_total{action=\"install\",result=\"success\"} 3\n"))
+			Expect(metrics).To(ContainSubstring("elemental_action_runs_total{action=\"install\",result=\"failure\"} 1\n"))
+			Expect(metrics).To(ContainSubstring("elemental_action_success{action=\"install\"} 1\n"))
+			Expect(metrics).To(ContainSubstring("elemental_action_success{action=\"upgrade\"} 1\n"))
+			Expect(metrics).To(ContainSubstring("elemental_action_phase_duration_seconds{action=\"install\",phase=\"deploy system\"} "))
+			Expect(metrics).To(ContainSubstring("node_custom_metric 7\n"))
+			Expect(metrics).NotTo(ContainSubstring("elemental_action_success{action=\"install\"} 0"))
+		})
+
+		It("Runs the transform command against the unpacked source tree", Label("transform"), func() {
+			spec.Target = device
+			spec.TransformCmd = []string{"/usr/local/bin/site-tweaks", "--site", "berlin"}
+			Expect(installer.Run()).To(BeNil())
+			var transform []string
+			for _, cmd := range runner.GetCmds() {
+				if cmd[0] == "env" {
+					transform = cmd
+				}
+			}
+			Expect(transform).To(HaveLen(5))
+			Expect(transform[1]).To(HavePrefix(constants.SourceTreeEnv + "=/"))
+			Expect(transform[2:]).To(Equal(spec.TransformCmd))
+		})
+
+		It("Aborts the installation if the transform command fails", Label("transform"), func() {
+			spec.Target = device
+			spec.TransformCmd = []string{"/usr/local/bin/site-tweaks"}
+			cmdFail = "env"
+			Expect(installer.Run()).To(MatchError(ContainSubstring("transform command failed")))
+		})
+
+		It("Writes an answer file reproducing the installation", Label("answer-file"), func() {
+			spec.Target = device
+			spec.AnswerFile = true
+			spec.System = types.NewDockerSrc("my/image:v1.0")
+			spec.System.SetAuth(&types.RegistryAuth{Username: "user", Password: "s3cr3t"})
+			config.HTTPHeaders = types.HTTPHeaderScopes{{
+				URL:     "https://artifacts.example.com",
+				Headers: types.HTTPHeaders{"X-Api-Key": "k3y", "Authorization": "Bearer t0k3n"},
+			}}
+			extractor.SideEffect = func(_, destination, _ string, _, _ bool) (string, error) {
+				bootTree(destination)
+				Expect(utils.MkdirAll(fs, filepath.Join(destination, "etc"), constants.DirPerm)).To(Succeed())
+				return "sha256:f00d", fs.WriteFile(filepath.Join(destination, "etc/os-release"), []byte{}, constants.FilePerm)
+			}
+			Expect(installer.Run()).To(BeNil())
+			data, err := fs.ReadFile(filepath.Join(spec.Partitions.State.MountPoint, constants.InstallConfigFile))
+			Expect(err).ToNot(HaveOccurred())
+
+			answers := struct {
+				Install map[string]interface{} `yaml:"install"`
+			}{}
+			Expect(yaml.Unmarshal(data, &answers)).To(Succeed())
+			Expect(answers.Install).To(HaveKeyWithValue("target", device))
+			Expect(answers.Install).To(HaveKeyWithValue("system", "oci://my/image:v1.0@sha256:f00d"))
+			Expect(string(data)).NotTo(ContainSubstring("/some/device1"))
+			Expect(answers.Install["recovery-system"]).NotTo(HaveKey("file"))
+			Expect(string(data)).NotTo(ContainSubstring("http-headers"))
+			Expect(string(data)).NotTo(ContainSubstring("redacted"))
+			Expect(string(data)).To(ContainSubstring("# HTTP headers not included, set them again: https://artifacts.example.com Authorization, X-Api-Key\n"))
+			Expect(string(data)).To(ContainSubstring("# Registry credentials not included, set them again: oci://my/image:v1.0@sha256:f00d\n"))
+		})
+
+		It("Runs a factory installation powering off when done", Label("factory"), func() {
+			spec.Target = device
+			spec.System = types.NewDockerSrc("my/image:v1.0")
+			config.Reboot = true
+			extractor.SideEffect = func(_, destination, _ string, _, _ bool) (string, error) {
+				bootTree(destination)
+				Expect(utils.MkdirAll(fs, filepath.Join(destination, "etc"), constants.DirPerm)).To(Succeed())
+				return "sha256:f00d", fs.WriteFile(filepath.Join(destination, "etc/machine-id"), []byte("d2f0b5c1a3e4"), constants.FilePerm)
+			}
+			Expect(action.FactoryInstall(config, spec, action.WithInstallBootloader(bootloader))).To(Succeed())
+			Expect(spec.SkipFirstBootSetup).To(BeTrue())
+			Expect(spec.DisableBootEntry).To(BeTrue())
+			Expect(runner.IncludesCmds([][]string{{"poweroff", "-f"}})).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"reboot", "-f"}})).NotTo(Succeed())
+
+			data, err := fs.ReadFile(filepath.Join(spec.Partitions.State.MountPoint, constants.ProvisionedFile))
+			Expect(err).ToNot(HaveOccurred())
+			marker := map[string]string{}
+			Expect(yaml.Unmarshal(data, &marker)).To(Succeed())
+			Expect(marker).To(HaveKeyWithValue("source", "oci://my/image:v1.0"))
+			Expect(marker).To(HaveKeyWithValue("digest", "sha256:f00d"))
+			Expect(marker).To(HaveKey("date"))
+		})
+
+		It("Fails a factory installation from an unpinned image", Label("factory"), func() {
+			spec.Target = device
+			spec.System = types.NewDockerSrc("my/image")
+			Expect(action.FactoryInstall(config, spec)).NotTo(Succeed())
+			Expect(runner.GetCmds()).To(BeEmpty())
+		})
+
+		It("Records the duration of each phase", Label("timings"), func() {
+			spec.Target = device
+			Expect(installer.Run()).To(BeNil())
+			Expect(memLog.String()).To(ContainSubstring("Phase timings"))
+			data, err := fs.ReadFile(filepath.Join(spec.Partitions.State.MountPoint, constants.InstallStateFile))
+			Expect(err).ToNot(HaveOccurred())
+			state := &types.InstallState{}
+			Expect(yaml.Unmarshal(data, state)).To(Succeed())
+			phases := []string{}
+			for _, timing := range state.Timings {
+				phases = append(phases, timing.Phase)
+			}
+			Expect(phases).To(ContainElements(
+				"partition", "deploy system", "bootloader", "deploy recovery",
+				"hook before-install", "hook after-install", "hook post-install",
+			))
+		})
+
+		It("Installs with a separate var partition seeded from the system", Label("var"), func() {
+			spec.Target = device
+			spec.Partitions.Var = &types.Partition{
+				Name:            constants.VarPartName,
+				FilesystemLabel: constants.VarLabel,
+				Size:            2048,
+				FS:              constants.LinuxFs,
+				MountPoint:      constants.VarDir,
+			}
+			spec.System = types.NewDockerSrc("my/image:v1.0")
+			extractor.SideEffect = func(_, destination, _ string, _, _ bool) (string, error) {
+				bootTree(destination)
+				Expect(utils.MkdirAll(fs, filepath.Join(destination, "var/lib"), constants.DirPerm)).To(Succeed())
+				Expect(utils.MkdirAll(fs, filepath.Join(destination, "etc"), constants.DirPerm)).To(Succeed())
+				return "sha256:f00d", fs.WriteFile(filepath.Join(destination, "etc/os-release"), []byte{}, constants.FilePerm)
+			}
+			Expect(installer.Run()).To(BeNil())
+
+			seeded := false
+			for _, cmd := range runner.GetCmds() {
+				if cmd[0] == "rsync" && strings.HasSuffix(cmd[len(cmd)-1], constants.VarDir+"/") {
+					seeded = strings.HasSuffix(cmd[len(cmd)-2], "/var/")
+				}
+			}
+			Expect(seeded).To(BeTrue())
+
+			data, err := fs.ReadFile(filepath.Join(spec.Partitions.State.MountPoint, constants.InstallStateFile))
+			Expect(err).ToNot(HaveOccurred())
+			state := &types.InstallState{}
+			Expect(yaml.Unmarshal(data, state)).To(Succeed())
+			Expect(state.Partitions[constants.VarPartName].FSLabel).To(Equal(constants.VarLabel))
+
+			data, err = fs.ReadFile(filepath.Join(constants.OEMDir, constants.OverlayConfigFile))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring("device: LABEL=COS_VAR"))
+		})
+
+		It("Installs with a separate root partition seeded from the system", Label("root"), func() {
+			spec.Target = device
+			spec.Partitions.Root = &types.Partition{
+				Name:            constants.RootPartName,
+				FilesystemLabel: constants.RootLabel,
+				Size:            4096,
+				FS:              constants.LinuxFs,
+				MountPoint:      constants.RootDir,
+			}
+			Expect(installer.Run()).To(BeNil())
+
+			var seed []string
+			for _, cmd := range runner.GetCmds() {
+				if cmd[0] == "rsync" && strings.HasSuffix(cmd[len(cmd)-1], constants.RootDir+"/") {
+					seed = cmd
+				}
+			}
+			Expect(seed).To(ContainElement("--exclude=/usr"))
+			Expect(seed).NotTo(ContainElement("--exclude=/var/*"))
+
+			data, err := fs.ReadFile(filepath.Join(spec.Partitions.State.MountPoint, constants.InstallStateFile))
+			Expect(err).ToNot(HaveOccurred())
+			state := &types.InstallState{}
+			Expect(yaml.Unmarshal(data, state)).To(Succeed())
+			Expect(state.Partitions[constants.RootPartName].FSLabel).To(Equal(constants.RootLabel))
+
+			data, err = fs.ReadFile(filepath.Join(constants.OEMDir, constants.OverlayConfigFile))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring("device: LABEL=COS_ROOT"))
+		})
+
+		It("Records the checksums of the installed images", Label("verify-install"), func() {
+			spec.Target = device
+			spec.RecordChecksums = true
+			sideEffect := runner.SideEffect
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "mksquashfs" {
+					return []byte{}, fs.WriteFile(args[1], []byte("recovery"), constants.FilePerm)
+				}
+				return sideEffect(cmd, args...)
+			}
+			Expect(installer.Run()).To(BeNil())
+			data, err := fs.ReadFile(filepath.Join(spec.Partitions.State.MountPoint, constants.InstallStateFile))
+			Expect(err).ToNot(HaveOccurred())
+			state := &types.InstallState{}
+			Expect(yaml.Unmarshal(data, state)).To(Succeed())
+			Expect(state.Partitions[constants.RecoveryPartName].RecoveryImage.Checksum).To(MatchRegexp("^sha256:[0-9a-f]{64}$"))
+			for _, snap := range state.Partitions[constants.StatePartName].Snapshots {
+				Expect(snap.Checksum).To(MatchRegexp("^sha256:[0-9a-f]{64}$"))
+			}
+		})
+
+		It("Records the image checksums with the configured algorithm", Label("verify-install", "checksum"), func() {
+			spec.Target = device
+			spec.RecordChecksums = true
+			config.ChecksumAlgo = constants.SHA512
+			Expect(installer.Run()).To(BeNil())
+			data, err := fs.ReadFile(filepath.Join(spec.Partitions.State.MountPoint, constants.InstallStateFile))
+			Expect(err).ToNot(HaveOccurred())
+			state := &types.InstallState{}
+			Expect(yaml.Unmarshal(data, state)).To(Succeed())
+			for _, snap := range state.Partitions[constants.StatePartName].Snapshots {
+				Expect(snap.Checksum).To(MatchRegexp("^sha512:[0-9a-f]{128}$"))
+			}
+		})
+
+		It("Records the files written at deployment time", Label("drift"), func() {
+			spec.Target = device
+			spec.SkipFirstBootSetup = true
+			Expect(installer.Run()).To(BeNil())
+			data, err := fs.ReadFile(filepath.Join(spec.Partitions.State.MountPoint, constants.InstallStateFile))
+			Expect(err).ToNot(HaveOccurred())
+			state := &types.InstallState{}
+			Expect(yaml.Unmarshal(data, state)).To(Succeed())
+			for _, snap := range state.Partitions[constants.StatePartName].Snapshots {
+				Expect(snap.Deployed).To(ContainElements(constants.ImageVersionFile, constants.KernelPath, constants.MachineID))
+				Expect(snap.Deployed).NotTo(ContainElement(constants.LocalTimeFile))
+			}
+		})
+
+		It("Does not compute image checksums unless requested", Label("verify-install"), func() {
+			spec.Target = device
+			Expect(installer.Run()).To(BeNil())
+			data, err := fs.ReadFile(filepath.Join(spec.Partitions.State.MountPoint, constants.InstallStateFile))
+			Expect(err).ToNot(HaveOccurred())
+			state := &types.InstallState{}
+			Expect(yaml.Unmarshal(data, state)).To(Succeed())
+			Expect(state.Partitions[constants.RecoveryPartName].RecoveryImage.Checksum).To(BeEmpty())
+			for _, snap := range state.Partitions[constants.StatePartName].Snapshots {
+				Expect(snap.Checksum).To(BeEmpty())
+			}
+		})
+
+		It("Writes the grub and recovery passwords", Label("password"), func() {
+			spec.Target = device
+			spec.GrubPasswordHash = "grub.pbkdf2.sha512.10000.AB12.CD34"
+			spec.RecoveryPassHash = "$6$salt$hash"
+			Expect(installer.Run()).To(BeNil())
+			ok, _ := utils.Exists(fs, filepath.Join(spec.Partitions.Boot.MountPoint, constants.GrubPasswordCfg))
+			Expect(ok).To(BeTrue())
+			ok, _ = utils.Exists(fs, filepath.Join(spec.Partitions.OEM.MountPoint, constants.RecoveryPassConfig))
+			Expect(ok).To(BeTrue())
+		})
+
+		It("Sets the boot attempts counter", Label("boot-attempts"), func() {
+			spec.Target = device
+			spec.BootAttempts = 3
+			Expect(installer.Run()).To(BeNil())
+			grubEnv := filepath.Join(spec.Partitions.OEM.MountPoint, constants.GrubEnv)
+			Expect(bootloader.PersistentVariables[grubEnv]).To(HaveKeyWithValue(constants.GrubBootAttempts, "3"))
+		})
+
+		It("Does not set the boot attempts counter if disabled", Label("boot-attempts"), func() {
+			spec.Target = device
+			spec.BootAttempts = 0
+			Expect(installer.Run()).To(BeNil())
+			grubEnv := filepath.Join(spec.Partitions.OEM.MountPoint, constants.GrubEnv)
+			Expect(bootloader.PersistentVariables).NotTo(HaveKey(grubEnv))
+		})
+
 		It("Sets the executable /run/cos/ejectcd so systemd can eject the cd on restart", func() {
 			_ = utils.MkdirAll(fs, "/usr/lib/systemd/system-shutdown", constants.DirPerm)
 			_, err := fs.Stat("/usr/lib/systemd/system-shutdown/eject")
@@ -252,6 +649,19 @@ var _ = Describe("Install action tests", func() {
 			Expect(err).To(HaveOccurred())
 		})
 
+		It("Does not write the eject script for golden images", Label("pristine"), func() {
+			_ = utils.MkdirAll(fs, "/usr/lib/systemd/system-shutdown", constants.DirPerm)
+			cmdline = func() ([]byte, error) {
+				return []byte("cdroot"), nil
+			}
+			spec.Target = device
+			spec.SkipFirstBootSetup = true
+			config.EjectCD = true
+			Expect(installer.Run()).To(BeNil())
+			_, err := fs.Stat("/usr/lib/systemd/system-shutdown/eject")
+			Expect(err).To(HaveOccurred())
+		})
+
 		It("Successfully installs despite hooks failure", Label("hooks"), func() {
 			cloudInit.Error = true
 			spec.Target = device
@@ -267,6 +677,29 @@ var _ = Describe("Install action tests", func() {
 			Expect(installer.Run()).To(BeNil())
 		})
 
+		It("Installs without formatting into the partitions selected by GUID", Label("no-format", "guid"), func() {
+			spec.NoFormat = true
+			spec.Force = true
+			config.PartitionSelection.GUIDs = map[string]string{
+				constants.StatePartName: "3F2504E0-4F89-41D3-9A0C-0305E82C3301",
+			}
+			Expect(installer.Run()).To(Succeed())
+			Expect(memLog.String()).To(ContainSubstring("Using partition /dev/device2 as the state partition"))
+		})
+
+		It("Fails to install without formatting if a selected GUID is not found", Label("no-format", "guid"), func() {
+			spec.NoFormat = true
+			spec.Force = true
+			config.PartitionSelection.GUIDs = map[string]string{
+				constants.OEMPartName: "8c5b2f0e-7e2a-4a5b-9d1e-2f4a6b8c0d1e",
+			}
+			err := installer.Run()
+			Expect(err).To(MatchError(ContainSubstring("oem partition with GUID 8c5b2f0e-7e2a-4a5b-9d1e-2f4a6b8c0d1e not found")))
+			var elErr *elementalError.ElementalError
+			Expect(errors.As(err, &elErr)).To(BeTrue())
+			Expect(elErr.ExitCode()).To(Equal(elementalError.InvalidTarget))
+		})
+
 		It("Successfully installs a docker image", Label("docker"), func() {
 			spec.Target = device
 			spec.System = types.NewDockerSrc("my/image:latest")
@@ -281,6 +714,254 @@ var _ = Describe("Install action tests", func() {
 			Expect(err).ShouldNot(HaveOccurred())
 			Expect(installer.Run()).To(BeNil())
 			Expect(client.WasGetCalledWith("http://my.config.org")).To(BeTrue())
+			Expect(cloudInit.Validated).To(ContainElement(filepath.Join(constants.OEMDir, "90_custom.yaml")))
+		})
+
+		It("Fails if the written cloud-config is invalid", Label("cloud-config", "validate"), func() {
+			spec.Target = device
+			spec.CloudInit = []string{"http://my.config.org"}
+			cloudInit.ValidateErr = true
+			err := installer.Run()
+			Expect(err).To(MatchError(ContainSubstring("invalid cloud-init file")))
+			Expect(err).To(MatchError(ContainSubstring("line 1")))
+			Expect(runner.IncludesCmds([][]string{{"grub2-editenv"}})).NotTo(Succeed())
+		})
+
+		It("Applies a dbx update and records it", Label("dbx"), func() {
+			spec.Target = device
+			spec.DbxUpdate = "/dbxupdate.bin"
+			Expect(fs.WriteFile(spec.DbxUpdate, mocks.NewDbxUpdate(bytes.Repeat([]byte{1}, 32)), constants.FilePerm)).To(Succeed())
+			efivars := mocks.NewMockEFIVariables()
+			installer, err := action.NewInstallAction(
+				config, spec, action.WithInstallBootloader(bootloader), action.WithInstallEFIVariables(efivars),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(installer.Run()).To(Succeed())
+
+			_, _, err = efivars.GetVariable(efilib.DbxVariable.GUID, efilib.DbxVariable.Name)
+			Expect(err).NotTo(HaveOccurred())
+			data, err := fs.ReadFile(filepath.Join(spec.Partitions.State.MountPoint, constants.InstallStateFile))
+			Expect(err).ToNot(HaveOccurred())
+			state := &types.InstallState{}
+			Expect(yaml.Unmarshal(data, state)).To(Succeed())
+			Expect(state.DbxUpdate).NotTo(BeNil())
+			Expect(state.DbxUpdate.Source).To(Equal("/dbxupdate.bin"))
+			Expect(state.DbxUpdate.Digest).NotTo(BeEmpty())
+			Expect(state.DbxUpdate.Signatures).To(Equal(1))
+			Expect(state.DbxUpdate.Applied).To(Equal(1))
+		})
+
+		It("Fails before partitioning if the dbx update is invalid", Label("dbx"), func() {
+			spec.Target = device
+			spec.DbxUpdate = "/dbxupdate.bin"
+			Expect(fs.WriteFile(spec.DbxUpdate, []byte("invalid"), constants.FilePerm)).To(Succeed())
+			installer, err := action.NewInstallAction(
+				config, spec, action.WithInstallBootloader(bootloader), action.WithInstallEFIVariables(mocks.NewMockEFIVariables()),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(installer.Run()).To(MatchError(ContainSubstring("invalid dbx update")))
+			Expect(runner.IncludesCmds([][]string{{"parted"}})).NotTo(Succeed())
+		})
+
+		It("Fails before partitioning if the source has no kernel", Label("boot-compat"), func() {
+			spec.Target = device
+			Expect(fs.Remove(filepath.Join(constants.ISOBaseTree, "boot/vmlinuz-6.7"))).To(Succeed())
+			Expect(installer.Run()).To(MatchError(ContainSubstring("no Kernel file found")))
+			Expect(runner.IncludesCmds([][]string{{"parted"}})).NotTo(Succeed())
+		})
+
+		It("Fails if the unpacked image has no kernel", Label("boot-compat"), func() {
+			spec.Target = device
+			spec.System = types.NewDockerSrc("my/image:latest")
+			extractor.SideEffect = nil
+			Expect(installer.Run()).To(MatchError(ContainSubstring("no Kernel file found")))
+			Expect(runner.IncludesCmds([][]string{{"parted"}})).To(Succeed())
+		})
+
+		It("Fails if the target has not enough free inodes for the system", Label("inodes"), func() {
+			spec.Target = device
+			sideEffect := runner.SideEffect
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "df" && args[0] == "--output=itotal,iavail" {
+					return []byte("Inodes IFree\n65536 3\n"), nil
+				}
+				return sideEffect(cmd, args...)
+			}
+			err := installer.Run()
+			Expect(err).To(MatchError(ContainSubstring("the system requires 7 inodes but only 3 are free")))
+			Expect(runner.IncludesCmds([][]string{{"rsync"}})).NotTo(Succeed())
+		})
+
+		It("Populates the OEM partition from the OEM sources in order", Label("oem-sources"), func() {
+			spec.Target = device
+			spec.OEMSources = []*types.ImageSource{types.NewDockerSrc("my/oem:base"), types.NewDockerSrc("my/oem:site")}
+			extractor.SideEffect = func(imageRef, destination, _ string, _, _ bool) (string, error) {
+				if !strings.HasPrefix(imageRef, "my/oem:") {
+					bootTree(destination)
+					return "sha256:f00d", nil
+				}
+				Expect(destination).To(Equal(constants.OEMDir))
+				Expect(fs.WriteFile(filepath.Join(destination, "90_layer.yaml"), []byte(imageRef), constants.FilePerm)).To(Succeed())
+				return "sha256:f00d", fs.WriteFile(filepath.Join(destination, imageRef[len("my/oem:"):]+".yaml"), []byte{}, constants.FilePerm)
+			}
+			Expect(installer.Run()).To(BeNil())
+
+			for _, f := range []string{"base.yaml", "site.yaml"} {
+				ok, _ := utils.Exists(fs, filepath.Join(constants.OEMDir, f))
+				Expect(ok).To(BeTrue())
+			}
+			data, err := fs.ReadFile(filepath.Join(constants.OEMDir, "90_layer.yaml"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal("my/oem:site"))
+		})
+
+		It("Fails if an OEM source can't be copied", Label("oem-sources"), func() {
+			spec.Target = device
+			spec.OEMSources = []*types.ImageSource{types.NewDockerSrc("my/oem:base")}
+			extractor.SideEffect = func(imageRef, _, _ string, _, _ bool) (string, error) {
+				if imageRef == "my/oem:base" {
+					return "", fmt.Errorf("pull failed")
+				}
+				return "sha256:f00d", nil
+			}
+			Expect(installer.Run()).NotTo(Succeed())
+		})
+
+		Describe("Skipping partitioning", Label("skip-partitioning"), func() {
+			var mountTarget func(labels map[string]string)
+
+			BeforeEach(func() {
+				spec.SkipPartitioning = true
+				spec.RootMountPoint = "/mnt/target"
+				Expect(spec.Sanitize()).To(Succeed())
+
+				// Mounts the given partitions, by mountpoint dir and label, under the root mountpoint
+				mountTarget = func(labels map[string]string) {
+					disk := block.Disk{Name: "target"}
+					num := 0
+					for dir, label := range labels {
+						num++
+						mountPoint := filepath.Join("/mnt/target", dir)
+						Expect(utils.MkdirAll(fs, mountPoint, constants.DirPerm)).To(Succeed())
+						name := fmt.Sprintf("target%d", num)
+						Expect(mounter.Mount(filepath.Join("/dev", name), mountPoint, "auto", []string{"rw"})).To(Succeed())
+						disk.Partitions = append(disk.Partitions, &block.Partition{
+							Name:            name,
+							FilesystemLabel: label,
+							Type:            "ext4",
+							MountPoint:      mountPoint,
+						})
+					}
+					ghwTest.Clean()
+					ghwTest = mocks.GhwMock{}
+					ghwTest.AddDisk(disk)
+					ghwTest.CreateDevices()
+				}
+			})
+			It("installs into the partitions mounted under the root mountpoint", func() {
+				mountTarget(map[string]string{
+					"efi":        constants.BootLabel,
+					"oem":        constants.OEMLabel,
+					"recovery":   constants.RecoveryLabel,
+					"state":      constants.StateLabel,
+					"persistent": constants.PersistentLabel,
+				})
+				Expect(installer.Run()).To(Succeed())
+
+				for _, cmd := range runner.GetCmds() {
+					Expect(cmd[0]).NotTo(BeElementOf("parted", "mkfs.ext4", "mkfs.vfat", "wipefs"))
+				}
+				ok, _ := utils.Exists(fs, filepath.Join("/mnt/target/state", constants.InstallStateFile))
+				Expect(ok).To(BeTrue())
+				Expect(spec.RecoverySystem.File).To(Equal(filepath.Join("/mnt/target/recovery", constants.BootPath, constants.RecoveryImgFile)))
+			})
+			It("fails if some partition is not mounted", func() {
+				mountTarget(map[string]string{"state": constants.StateLabel})
+				err := installer.Run()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("not found"))
+			})
+			It("fails if the mountpoint exists but nothing is mounted on it", func() {
+				mountTarget(map[string]string{
+					"efi":      constants.BootLabel,
+					"oem":      constants.OEMLabel,
+					"recovery": constants.RecoveryLabel,
+					"state":    constants.StateLabel,
+				})
+				Expect(utils.MkdirAll(fs, "/mnt/target/persistent", constants.DirPerm)).To(Succeed())
+				err := installer.Run()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("/mnt/target/persistent"))
+			})
+			It("fails if the partition mounted is not the one selected", Label("guid"), func() {
+				mountTarget(map[string]string{
+					"efi":        constants.BootLabel,
+					"oem":        constants.OEMLabel,
+					"recovery":   constants.RecoveryLabel,
+					"state":      constants.StateLabel,
+					"persistent": constants.PersistentLabel,
+				})
+				ghwTest.Clean()
+				ghwTest.AddDisk(block.Disk{Name: "other", Partitions: []*block.Partition{{
+					Name:            "other1",
+					FilesystemLabel: constants.StateLabel,
+					Type:            "ext4",
+					UUID:            "3f2504e0-4f89-41d3-9a0c-0305e82c3301",
+				}}})
+				ghwTest.CreateDevices()
+				config.PartitionSelection.GUIDs = map[string]string{
+					constants.StatePartName: "3f2504e0-4f89-41d3-9a0c-0305e82c3301",
+				}
+				err := installer.Run()
+				Expect(err).To(MatchError(ContainSubstring("is not the state partition /dev/other1 selected")))
+
+				config.PartitionSelection.GUIDs = map[string]string{
+					constants.OEMPartName: "8c5b2f0e-7e2a-4a5b-9d1e-2f4a6b8c0d1e",
+				}
+				err = installer.Run()
+				Expect(err).To(MatchError(ContainSubstring("oem partition with GUID 8c5b2f0e-7e2a-4a5b-9d1e-2f4a6b8c0d1e not found")))
+			})
+			It("fails if a mounted partition has an unexpected label", func() {
+				mountTarget(map[string]string{
+					"efi":        constants.BootLabel,
+					"oem":        constants.OEMLabel,
+					"recovery":   constants.RecoveryLabel,
+					"state":      "DATA",
+					"persistent": constants.PersistentLabel,
+				})
+				err := installer.Run()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("labeled 'DATA', expected '%s'", constants.StateLabel))
+			})
+		})
+
+		Describe("Default cloud-config", Label("cloud-config", "default"), func() {
+			var defaults fstest.MapFS
+			BeforeEach(func() {
+				spec.Target = device
+				defaults = fstest.MapFS{
+					"80_appliance.yaml": {Data: []byte("name: appliance\n")},
+					"README.md":         {Data: []byte("# not a cloud-config\n")},
+				}
+				installer, err = action.NewInstallAction(
+					config, spec, action.WithInstallBootloader(bootloader), action.WithInstallDefaultCloudConfig(defaults),
+				)
+				Expect(err).ToNot(HaveOccurred())
+			})
+			It("installs the default cloud-config if no other source is set", func() {
+				Expect(installer.Run()).To(BeNil())
+				data, err := fs.ReadFile(filepath.Join(spec.Partitions.OEM.MountPoint, "80_appliance.yaml"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(data)).To(Equal("name: appliance\n"))
+				ok, _ := utils.Exists(fs, filepath.Join(spec.Partitions.OEM.MountPoint, "README.md"))
+				Expect(ok).To(BeFalse())
+			})
+			It("does not install the default cloud-config if some source is set", func() {
+				spec.CloudInit = []string{"http://my.config.org"}
+				Expect(installer.Run()).To(BeNil())
+				ok, _ := utils.Exists(fs, filepath.Join(spec.Partitions.OEM.MountPoint, "80_appliance.yaml"))
+				Expect(ok).To(BeFalse())
+			})
 		})
 
 		It("Fails setting the persistent grub variables", func() {
@@ -304,6 +985,78 @@ var _ = Describe("Install action tests", func() {
 			Expect(installer.Run()).NotTo(BeNil())
 		})
 
+		It("Fails to create a RAID array on a non md device", Label("disk", "raid"), func() {
+			spec.Target = device
+			spec.RaidDisks = []string{"/dev/sda", "/dev/sdb"}
+			err := installer.Run()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("invalid RAID array device"))
+			Expect(runner.IncludesCmds([][]string{{"mdadm"}})).NotTo(Succeed())
+		})
+
+		It("Fails if no target disk can be automatically selected", Label("disk", "auto"), func() {
+			spec.Target = constants.AutoTarget
+			err := installer.Run()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("no suitable target disk"))
+			Expect(runner.IncludesCmds([][]string{{"lsblk", "-dbnpro", "NAME,SIZE,TYPE,RM,RO"}})).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"parted"}})).NotTo(Succeed())
+		})
+
+		Describe("Selecting the target by device type", Label("disk", "auto", "device-type"), func() {
+			BeforeEach(func() {
+				sideEffect := runner.SideEffect
+				runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+					if cmd == "lsblk" && args[0] == "-dbnpro" {
+						return []byte("/dev/sda 1000 disk 0 0\n/dev/nvme0n1 500 disk 0 0\n/dev/nvme1n1 200 disk 0 0\n"), nil
+					}
+					return sideEffect(cmd, args...)
+				}
+				Expect(utils.MkdirAll(fs, "/sys/block/nvme1n1/device", constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile("/sys/block/nvme1n1/device/model", []byte("INTEL SSDPED1D280GA\n"), constants.FilePerm)).To(Succeed())
+				spec.Target = constants.AutoTarget
+			})
+			It("picks a disk of the preferred device type", func() {
+				spec.PreferDeviceType = constants.DiskTypeOptane
+				_ = installer.Run()
+				Expect(spec.Target).To(Equal("/dev/nvme1n1"))
+			})
+			It("never picks a disk of an excluded device type", func() {
+				spec.PreferDeviceType = constants.DiskTypeNVMe
+				spec.ExcludeDeviceTypes = []string{constants.DiskTypeOptane}
+				_ = installer.Run()
+				Expect(spec.Target).To(Equal("/dev/nvme0n1"))
+			})
+			It("picks other disks if there is none of the preferred device type", func() {
+				spec.PreferDeviceType = constants.DiskTypeNVDIMM
+				_ = installer.Run()
+				Expect(spec.Target).To(Equal("/dev/sda"))
+			})
+		})
+
+		Describe("Selecting a removable target", Label("disk", "auto", "removable"), func() {
+			BeforeEach(func() {
+				sideEffect := runner.SideEffect
+				runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+					if cmd == "lsblk" && args[0] == "-dbnpro" {
+						return []byte("/dev/sdb 1000 disk 1 0\n"), nil
+					}
+					return sideEffect(cmd, args...)
+				}
+				spec.Target = constants.AutoTarget
+			})
+			It("never picks a removable disk when forced", func() {
+				spec.Force = true
+				Expect(installer.Run()).To(MatchError(ContainSubstring("only removable disks found")))
+				Expect(spec.Target).To(Equal(constants.AutoTarget))
+			})
+			It("picks a removable disk if allowed", func() {
+				spec.AllowRemovable = true
+				_ = installer.Run()
+				Expect(spec.Target).To(Equal("/dev/sdb"))
+			})
+		})
+
 		It("Fails if some hook fails and strict is set", Label("strict"), func() {
 			spec.Target = device
 			config.Strict = true
@@ -402,5 +1155,137 @@ var _ = Describe("Install action tests", func() {
 
 		// Start transaction
 		// Close transaction
+
+		Describe("Install Many", Label("many"), func() {
+			var targets []string
+
+			BeforeEach(func() {
+				targets = []string{device, "/some/disk", "/some/other"}
+				for _, target := range targets[1:] {
+					_, err = fs.Create(target)
+					Expect(err).ToNot(HaveOccurred())
+				}
+
+				// Track the partition table of each target disk
+				partedOuts := map[string]string{}
+				sideEffect := runner.SideEffect
+				runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+					if cmd != "parted" || cmdFail == cmd {
+						return sideEffect(cmd, args...)
+					}
+					disk := args[3]
+					if _, ok := partedOuts[disk]; !ok {
+						partedOuts[disk] = printOutput
+					}
+					for i, arg := range args {
+						if arg == "mkpart" {
+							partNum := strings.Count(partedOuts[disk], "\n")
+							partedOuts[disk] += fmt.Sprintf(partTmpl, partNum, args[i+3], args[i+4])
+							_, _ = fs.Create(fmt.Sprintf("%s%d", disk, partNum))
+							break
+						}
+					}
+					return []byte(partedOuts[disk]), nil
+				}
+			})
+
+			It("installs all targets from a single dump of the source", func() {
+				config.Reboot = true
+				opts := []action.InstallActionOption{action.WithInstallBootloader(bootloader)}
+				Expect(action.InstallMany(config, spec, targets, 1, opts...)).To(Succeed())
+
+				rsyncs := 0
+				for _, cmd := range runner.GetCmds() {
+					if cmd[0] == "rsync" && strings.HasSuffix(cmd[len(cmd)-2], constants.ISOBaseTree+"/") {
+						rsyncs++
+					}
+				}
+				Expect(rsyncs).To(Equal(1))
+				Expect(syscall.UnshareCalls()).To(Equal(len(targets)))
+				for _, target := range targets {
+					Expect(runner.IncludesCmds([][]string{
+						{"parted", "--script", "--machine", "--", target, "unit", "s", "mklabel", "gpt"},
+					})).To(Succeed())
+				}
+				Expect(memLog.String()).To(ContainSubstring("All 3 installations completed"))
+
+				// Reboot only happens once at the end
+				rebootCmd := 0
+				for _, cmd := range runner.GetCmds() {
+					if cmd[0] == "reboot" {
+						rebootCmd++
+					}
+				}
+				Expect(rebootCmd).To(Equal(1))
+			})
+
+			It("installs several targets at the same time", func() {
+				config.StageConcurrency = map[string]string{"after-install": constants.StageParallel}
+				opts := []action.InstallActionOption{action.WithInstallBootloader(bootloader)}
+				Expect(action.InstallMany(config, spec, targets, len(targets), opts...)).To(Succeed())
+
+				Expect(syscall.UnshareCalls()).To(Equal(len(targets)))
+				for _, target := range targets {
+					Expect(runner.IncludesCmds([][]string{
+						{"parted", "--script", "--machine", "--", target, "unit", "s", "mklabel", "gpt"},
+					})).To(Succeed())
+				}
+				Expect(memLog.String()).To(ContainSubstring("All 3 installations completed"))
+				Expect(config.StageConcurrency).To(HaveKeyWithValue("after-install", constants.StageParallel))
+			})
+
+			It("only writes the metrics of the whole run", Label("metrics"), func() {
+				config.MetricsFile = "/var/lib/node_exporter/elemental.prom"
+				opts := []action.InstallActionOption{action.WithInstallBootloader(bootloader)}
+				Expect(action.InstallMany(config, spec, targets, len(targets), opts...)).To(Succeed())
+
+				data, err := fs.ReadFile(config.MetricsFile)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(data)).To(ContainSubstring("elemental_action_runs_total{action=\"install-many\",result=\"success\"} 1\n"))
+				Expect(string(data)).NotTo(ContainSubstring("action=\"install\""))
+			})
+
+			It("installs the remaining targets if one fails", func() {
+				sideEffect := runner.SideEffect
+				runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+					if cmd == "parted" && args[3] == "/some/disk" {
+						return []byte("no space left"), fmt.Errorf("exit status 1")
+					}
+					return sideEffect(cmd, args...)
+				}
+				config.Reboot = true
+				err = action.InstallMany(config, spec, targets, 1, action.WithInstallBootloader(bootloader))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("target /some/disk"))
+				Expect(err.Error()).NotTo(ContainSubstring("target /some/device"))
+				Expect(memLog.String()).To(ContainSubstring("1 of 3 installations failed"))
+				Expect(syscall.UnshareCalls()).To(Equal(len(targets)))
+				Expect(runner.IncludesCmds([][]string{{"reboot", "-f"}})).NotTo(Succeed())
+			})
+
+			It("fails if the mount namespace can't be created", func() {
+				syscall.ErrorOnUnshare = true
+				err = action.InstallMany(config, spec, targets, 2, action.WithInstallBootloader(bootloader))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("mount namespace"))
+				Expect(runner.IncludesCmds([][]string{{"parted"}})).NotTo(Succeed())
+			})
+
+			It("fails on duplicated targets", func() {
+				Expect(action.InstallMany(config, spec, []string{device, device}, 2)).NotTo(Succeed())
+				Expect(runner.GetCmds()).To(BeEmpty())
+			})
+
+			It("fails on the auto target", func() {
+				Expect(action.InstallMany(config, spec, []string{device, constants.AutoTarget}, 2)).NotTo(Succeed())
+				Expect(runner.GetCmds()).To(BeEmpty())
+			})
+
+			It("fails if partitions are looked up by label", func() {
+				spec.NoFormat = true
+				Expect(action.InstallMany(config, spec, targets, 2)).NotTo(Succeed())
+				Expect(runner.GetCmds()).To(BeEmpty())
+			})
+		})
 	})
 })
@@ -0,0 +1,213 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/atomicfile"
+	cnst "github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+const (
+	metricRuns          = "elemental_action_runs_total"
+	metricLastRun       = "elemental_action_last_run_timestamp_seconds"
+	metricSuccess       = "elemental_action_success"
+	metricDuration      = "elemental_action_duration_seconds"
+	metricPhaseDuration = "elemental_action_phase_duration_seconds"
+	metricOSVersion     = "elemental_os_version_info"
+)
+
+// metricsHelp holds the help text and type of each exported metric, in the order they are written
+var metricsHelp = [][3]string{
+	{metricRuns, "counter", "Runs of each action by result"},
+	{metricLastRun, "gauge", "Unix time of the last run of each action"},
+	{metricSuccess, "gauge", "Whether the last run of each action succeeded"},
+	{metricDuration, "gauge", "Duration of the last run of each action"},
+	{metricPhaseDuration, "gauge", "Duration of each phase of the last run of each action"},
+	{metricOSVersion, "gauge", "OS version of the system as of the last action"},
+}
+
+// actionMetrics is the outcome of an action to export as metrics
+type actionMetrics struct {
+	action    string
+	err       error
+	start     time.Time
+	timings   []types.PhaseTiming
+	osVersion string
+}
+
+// metricsNotifier writes the outcome of an action to the configured metrics file
+type metricsNotifier struct {
+	cfg       *types.RunConfig
+	action    string
+	start     time.Time
+	timer     *utils.PhaseTimer
+	osVersion string
+}
+
+func newMetricsNotifier(cfg *types.RunConfig, action string) *metricsNotifier {
+	return &metricsNotifier{cfg: cfg, action: action, start: time.Now()}
+}
+
+// notify writes the metrics of the action given its error. Write errors are only logged
+func (n *metricsNotifier) notify(err error) {
+	if n.cfg.MetricsFile == "" {
+		return
+	}
+	m := actionMetrics{action: n.action, err: err, start: n.start, osVersion: n.osVersion}
+	if n.timer != nil {
+		m.timings = n.timer.Timings()
+	}
+	if mErr := writeMetrics(n.cfg, m); mErr != nil {
+		n.cfg.Logger.Warnf("failed writing metrics file: %v", mErr)
+	}
+}
+
+// writeMetrics updates the metrics file with the given action outcome in Prometheus textfile
+// format. Metrics of other actions already in the file are kept and run counters are increased.
+func writeMetrics(cfg *types.RunConfig, m actionMetrics) error {
+	samples := map[string][]string{}
+	if data, err := cfg.Fs.ReadFile(cfg.MetricsFile); err == nil {
+		samples = parseMetrics(data)
+	}
+
+	result := "success"
+	success := 1
+	if m.err != nil {
+		result = "failure"
+		success = 0
+	}
+	actionLabel := fmt.Sprintf("action=%q", m.action)
+	runsLabels := fmt.Sprintf("{%s,result=%q}", actionLabel, result)
+
+	runs := 1.0
+	for _, sample := range samples[metricRuns] {
+		if labels, value, ok := strings.Cut(sample, " "); ok && labels == runsLabels {
+			prev, _ := strconv.ParseFloat(value, 64)
+			runs += prev
+		}
+	}
+
+	// Drop the samples of the previous run of this action, run counters are kept
+	for name, list := range samples {
+		if name == metricRuns {
+			continue
+		}
+		var kept []string
+		for _, sample := range list {
+			if labels, _, _ := strings.Cut(sample, " "); !strings.Contains(labels, actionLabel) {
+				kept = append(kept, sample)
+			}
+		}
+		samples[name] = kept
+	}
+	samples[metricRuns] = append(removeSample(samples[metricRuns], runsLabels), fmt.Sprintf("%s %s", runsLabels, formatValue(runs)))
+	samples[metricLastRun] = append(samples[metricLastRun], fmt.Sprintf("{%s} %d", actionLabel, time.Now().Unix()))
+	samples[metricSuccess] = append(samples[metricSuccess], fmt.Sprintf("{%s} %d", actionLabel, success))
+	samples[metricDuration] = append(samples[metricDuration], fmt.Sprintf("{%s} %s", actionLabel, formatValue(time.Since(m.start).Seconds())))
+	for _, timing := range m.timings {
+		duration, err := time.ParseDuration(timing.Duration)
+		if err != nil {
+			continue
+		}
+		samples[metricPhaseDuration] = append(
+			samples[metricPhaseDuration], fmt.Sprintf("{%s,phase=%q} %s", actionLabel, timing.Phase, formatValue(duration.Seconds())),
+		)
+	}
+	if m.osVersion != "" {
+		samples[metricOSVersion] = []string{fmt.Sprintf("{version=%q} 1", m.osVersion)}
+	}
+
+	var buf bytes.Buffer
+	written := map[string]bool{}
+	for _, metric := range metricsHelp {
+		name := metric[0]
+		written[name] = true
+		if len(samples[name]) == 0 {
+			continue
+		}
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", name, metric[2], name, metric[1])
+		list := samples[name]
+		sort.Strings(list)
+		for _, sample := range list {
+			fmt.Fprintf(&buf, "%s%s\n", name, sample)
+		}
+	}
+	// Keep any other metric found in the file
+	var others []string
+	for name := range samples {
+		if !written[name] {
+			others = append(others, name)
+		}
+	}
+	sort.Strings(others)
+	for _, name := range others {
+		for _, sample := range samples[name] {
+			fmt.Fprintf(&buf, "%s%s\n", name, sample)
+		}
+	}
+
+	err := utils.MkdirAll(cfg.Fs, filepath.Dir(cfg.MetricsFile), cnst.DirPerm)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(cfg.Fs, cfg.MetricsFile, buf.Bytes(), cnst.FilePerm)
+}
+
+// parseMetrics returns the samples of a Prometheus textfile indexed by metric name, each
+// sample is kept as the labels and value that follow the metric name
+func parseMetrics(data []byte) map[string][]string {
+	samples := map[string][]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		idx := strings.IndexAny(line, "{ ")
+		if idx <= 0 {
+			continue
+		}
+		samples[line[:idx]] = append(samples[line[:idx]], line[idx:])
+	}
+	return samples
+}
+
+// removeSample returns the samples without the one with the given labels
+func removeSample(samples []string, labels string) []string {
+	var kept []string
+	for _, sample := range samples {
+		if l, _, _ := strings.Cut(sample, " "); l != labels {
+			kept = append(kept, sample)
+		}
+	}
+	return kept
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -23,6 +23,7 @@ import (
 	"regexp"
 	"slices"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/hashicorp/go-multierror"
@@ -61,6 +62,12 @@ func RunMount(cfg *types.RunConfig, spec *types.MountSpec) error {
 
 	}
 
+	cfg.Logger.Debug("Mounting split root volume")
+	if err = MountSplitRoot(cfg, spec); err != nil {
+		cfg.Logger.Errorf("Error mounting split root volume: %s", err.Error())
+		return err
+	}
+
 	cfg.Logger.Debug("Mounting volumes")
 	if err = MountVolumes(cfg, spec); err != nil {
 		cfg.Logger.Errorf("Error mounting volumes: %s", err.Error())
@@ -113,46 +120,147 @@ func MountVolumes(cfg *types.RunConfig, spec *types.MountSpec) error {
 	sort.Strings(keys)
 
 	for _, k := range keys {
-		var dev string
-		switch {
-		case strings.HasPrefix(volumes[k].Device, labelPref):
-			dev = filepath.Join(diskByLabel, strings.TrimPrefix(volumes[k].Device, labelPref))
-		case strings.HasPrefix(volumes[k].Device, partLabelPref):
-			dev = filepath.Join(diskByPartLabel, strings.TrimPrefix(volumes[k].Device, partLabelPref))
-		case strings.HasPrefix(volumes[k].Device, uuidPref):
-			dev = filepath.Join(diskByUUID, strings.TrimPrefix(volumes[k].Device, uuidPref))
-		case strings.HasPrefix(volumes[k].Device, devPref):
-			dev = volumes[k].Device
-		default:
-			cfg.Logger.Errorf("Unknown device reference, it should be LABEL, PARTLABEL, UUID or a /dev/* path")
-			errs = multierror.Append(errs, fmt.Errorf("unkown device reference: %s", volumes[k].Device))
-			continue
+		if err := mountVolume(cfg, spec.Sysroot, volumes[k]); err != nil {
+			errs = multierror.Append(errs, err)
 		}
-		mountpoint := volumes[k].Mountpoint
-		if !strings.HasPrefix(mountpoint, runPath) {
-			mountpoint = filepath.Join(spec.Sysroot, mountpoint)
+	}
+	return errs
+}
+
+// mountVolume mounts the given volume, mountpoints out of /run are relative to the sysroot
+func mountVolume(cfg *types.RunConfig, sysroot string, volume *types.VolumeMount) error {
+	var dev string
+	switch {
+	case strings.HasPrefix(volume.Device, labelPref):
+		dev = filepath.Join(diskByLabel, strings.TrimPrefix(volume.Device, labelPref))
+	case strings.HasPrefix(volume.Device, partLabelPref):
+		dev = filepath.Join(diskByPartLabel, strings.TrimPrefix(volume.Device, partLabelPref))
+	case strings.HasPrefix(volume.Device, uuidPref):
+		dev = filepath.Join(diskByUUID, strings.TrimPrefix(volume.Device, uuidPref))
+	case strings.HasPrefix(volume.Device, devPref):
+		dev = volume.Device
+	default:
+		cfg.Logger.Errorf("Unknown device reference, it should be LABEL, PARTLABEL, UUID or a /dev/* path")
+		return fmt.Errorf("unkown device reference: %s", volume.Device)
+	}
+	mountpoint := volume.Mountpoint
+	if !strings.HasPrefix(mountpoint, runPath) {
+		mountpoint = filepath.Join(sysroot, mountpoint)
+	}
+	if utils.IsMounted(cfg.Mounter, mountpoint) {
+		cfg.Logger.Debugf("Not mounting %s, it is already mounted", mountpoint)
+		return nil
+	}
+
+	err := utils.MkdirAll(cfg.Fs, mountpoint, constants.DirPerm)
+	if err != nil {
+		cfg.Logger.Errorf("failed creating mountpoint %s", mountpoint)
+		return err
+	}
+
+	fstype := volume.FSType
+	if fstype == "" {
+		fstype = "auto"
+	}
+
+	cfg.Logger.Debugf("Mounting %s to %s", dev, mountpoint)
+	err = cfg.Mounter.Mount(dev, mountpoint, fstype, volume.Options)
+	if err != nil {
+		cfg.Logger.Errorf("failed mounting device %s to %s", dev, mountpoint)
+	}
+	return err
+}
+
+// MountSplitRoot mounts the separate writable root volume, if any, and bind mounts each
+// of its top level directories over the sysroot. /usr is always kept from the system image.
+// It runs before any other volume is mounted, so volumes under these paths are not hidden.
+func MountSplitRoot(cfg *types.RunConfig, spec *types.MountSpec) error {
+	if !spec.HasSplitRoot() {
+		cfg.Logger.Debug("No split root volume defined, omitting split root mounts")
+		return nil
+	}
+
+	if err := mountVolume(cfg, spec.Sysroot, &spec.SplitRoot.Volume); err != nil {
+		return err
+	}
+
+	paths, err := splitRootPaths(cfg, spec)
+	if err != nil {
+		cfg.Logger.Errorf("failed listing split root volume paths: %s", err.Error())
+		return err
+	}
+
+	for _, path := range paths {
+		target := filepath.Join(spec.Sysroot, path)
+		if err := utils.MkdirAll(cfg.Fs, target, constants.DirPerm); err != nil {
+			cfg.Logger.Errorf("Error creating directory %s: %s", target, err.Error())
+			return err
+		}
+		source := filepath.Join(splitRootMountpoint(spec), path)
+		cfg.Logger.Debugf("Mounting bind path %s", path)
+		if err := cfg.Mounter.Mount(source, target, "none", []string{"defaults", "bind"}); err != nil {
+			cfg.Logger.Errorf("Error mounting bind path %s: %s", path, err.Error())
+			return err
 		}
+	}
+	return nil
+}
 
-		err := utils.MkdirAll(cfg.Fs, mountpoint, constants.DirPerm)
-		if err != nil {
-			cfg.Logger.Errorf("failed creating mountpoint %s", mountpoint)
-			errs = multierror.Append(errs, err)
+// splitRootMountpoint returns the mountpoint of the split root volume
+func splitRootMountpoint(spec *types.MountSpec) string {
+	mountpoint := spec.SplitRoot.Volume.Mountpoint
+	if !strings.HasPrefix(mountpoint, runPath) {
+		mountpoint = filepath.Join(spec.Sysroot, mountpoint)
+	}
+	return mountpoint
+}
+
+// splitRootPaths returns the top level directories of the split root volume to
+// bind mount over the sysroot
+func splitRootPaths(cfg *types.RunConfig, spec *types.MountSpec) ([]string, error) {
+	entries, err := cfg.Fs.ReadDir(splitRootMountpoint(spec))
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for _, entry := range entries {
+		path := filepath.Join("/", entry.Name())
+		if !entry.IsDir() || path == constants.UsrPath || entry.Name() == "lost+found" {
 			continue
 		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
 
-		fstype := volumes[k].FSType
-		if fstype == "" {
-			fstype = "auto"
+// checkTmpfsSize verifies the given tmpfs size does not exceed the RAM of the booting system
+func checkTmpfsSize(cfg *types.RunConfig, size string) error {
+	bytes, percent, err := types.ParseTmpfsSize(size)
+	if err != nil || percent {
+		return err
+	}
+	meminfo, err := cfg.Fs.ReadFile("/proc/meminfo")
+	if err != nil {
+		cfg.Logger.Warnf("could not read memory information, not checking tmpfs size: %v", err)
+		return nil
+	}
+	for _, line := range strings.Split(string(meminfo), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
 		}
-
-		cfg.Logger.Debugf("Mounting %s to %s", dev, mountpoint)
-		err = cfg.Mounter.Mount(dev, mountpoint, fstype, volumes[k].Options)
+		memKB, err := strconv.ParseUint(fields[1], 10, 64)
 		if err != nil {
-			cfg.Logger.Errorf("failed mounting device %s to %s", dev, mountpoint)
-			errs = multierror.Append(errs, err)
+			break
+		}
+		if bytes > memKB<<10 {
+			return fmt.Errorf("tmpfs size %s exceeds the available RAM of %dkB", size, memKB)
 		}
+		return nil
 	}
-	return errs
+	cfg.Logger.Warnf("could not find total memory, not checking tmpfs size")
+	return nil
 }
 
 func MountEphemeral(cfg *types.RunConfig, sysroot string, overlay types.EphemeralMounts) error {
@@ -169,6 +277,10 @@ func MountEphemeral(cfg *types.RunConfig, sysroot string, overlay types.Ephemera
 
 	switch overlay.Type {
 	case constants.Tmpfs:
+		if err := checkTmpfsSize(cfg, overlay.Size); err != nil {
+			// Not fatal, the overlay is only filled up to the available RAM
+			cfg.Logger.Warnf("%s, the ephemeral overlay may run out of memory", err.Error())
+		}
 		overlaySource = constants.Tmpfs
 		overlayFS = constants.Tmpfs
 		overlayOpts = []string{"defaults", fmt.Sprintf("size=%s", overlay.Size)}
@@ -301,6 +413,19 @@ func WriteFstab(cfg *types.RunConfig, spec *types.MountSpec, data string) error
 		return nil
 	}
 
+	if spec.HasSplitRoot() {
+		rVol := spec.SplitRoot.Volume
+		data += fstab(rVol.Device, rVol.Mountpoint, rVol.FSType, rVol.Options)
+
+		paths, err := splitRootPaths(cfg, spec)
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			data += fstab(filepath.Join(rVol.Mountpoint, path), path, "none", []string{"defaults", "bind"})
+		}
+	}
+
 	for _, vol := range spec.Volumes {
 		data += fstab(vol.Device, vol.Mountpoint, vol.FSType, vol.Options)
 	}
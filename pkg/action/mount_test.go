@@ -148,6 +148,25 @@ var _ = Describe("Mount Action", func() {
 			Expect(string(fstab)).To(Equal(expectedFstab))
 		})
 
+		It("Writes the split root volume and its bind mounts", Label("root"), func() {
+			spec.SplitRoot.Volume = types.VolumeMount{
+				Mountpoint: constants.RootDir,
+				Device:     "LABEL=COS_ROOT",
+				FSType:     "ext4",
+			}
+			for _, dir := range []string{"etc", "usr", "var"} {
+				Expect(utils.MkdirAll(fs, filepath.Join(constants.RootDir, dir), constants.DirPerm)).To(Succeed())
+			}
+			Expect(action.WriteFstab(cfg, spec, "")).To(Succeed())
+
+			fstab, err := cfg.Config.Fs.ReadFile(filepath.Join(spec.Sysroot, "/etc/fstab"))
+			Expect(err).To(BeNil())
+			expectedFstab := "LABEL=COS_ROOT\t/run/elemental/root\text4\tdefaults\t0\t0\n"
+			expectedFstab += "/run/elemental/root/etc\t/etc\tnone\tdefaults,bind\t0\t0\n"
+			expectedFstab += "/run/elemental/root/var\t/var\tnone\tdefaults,bind\t0\t0\n"
+			Expect(string(fstab)).To(HavePrefix(expectedFstab))
+		})
+
 		It("Does not write fstab if not requested", func() {
 			spec := &types.MountSpec{
 				WriteFstab: false,
@@ -179,13 +198,20 @@ var _ = Describe("Mount Action", func() {
 			)
 			Expect(action.MountVolumes(cfg, spec)).To(Succeed())
 			list, _ := mounter.List()
-			Expect(len(list)).To(Equal(5))
+			// Note the already mounted '/a/path' mountpoint is not mounted twice
+			Expect(len(list)).To(Equal(4))
 			// Note they were sorted according to the mountpoint
 			Expect(list[0].Device).To(Equal("/dev/disk/by-partlabel/partitionlabel"))
 			Expect(list[1].Path).To(Equal("/sysroot/a/path"))
-			Expect(list[2].Device).To(Equal("/dev/disk/by-uuid/someuuidgoeshere"))
-			Expect(list[3].Device).To(Equal("/dev/somedevice"))
-			Expect(list[4].Device).To(Equal("/dev/persistentdev"))
+			Expect(list[1].Device).To(Equal("/dev/disk/by-uuid/someuuidgoeshere"))
+			Expect(list[2].Device).To(Equal("/dev/somedevice"))
+			Expect(list[3].Device).To(Equal("/dev/persistentdev"))
+		})
+		It("does not mount already mounted volumes", func() {
+			Expect(mounter.Mount("/dev/somedevice", "/run/elemental", "vfat", []string{})).To(Succeed())
+			Expect(action.MountVolumes(cfg, spec)).To(Succeed())
+			list, _ := mounter.List()
+			Expect(len(list)).To(Equal(2))
 		})
 		It("fails to mount a volume", func() {
 			mounter.ErrorOnMount = true
@@ -201,6 +227,38 @@ var _ = Describe("Mount Action", func() {
 			Expect(action.MountVolumes(cfg, spec)).NotTo(Succeed())
 		})
 	})
+	Describe("Mounts split root volume", Label("root"), func() {
+		BeforeEach(func() {
+			spec.SplitRoot.Volume = types.VolumeMount{
+				Mountpoint: constants.RootDir,
+				Device:     "LABEL=COS_ROOT",
+			}
+			for _, dir := range []string{"etc", "home", "usr", "lost+found"} {
+				Expect(utils.MkdirAll(fs, filepath.Join(constants.RootDir, dir), constants.DirPerm)).To(Succeed())
+			}
+		})
+		It("bind mounts all top level directories but /usr", func() {
+			Expect(action.MountSplitRoot(cfg, spec)).To(Succeed())
+			list, _ := mounter.List()
+			Expect(len(list)).To(Equal(3))
+			Expect(list[0].Device).To(Equal("/dev/disk/by-label/COS_ROOT"))
+			Expect(list[0].Path).To(Equal(constants.RootDir))
+			Expect(list[1].Device).To(Equal(filepath.Join(constants.RootDir, "etc")))
+			Expect(list[1].Path).To(Equal("/sysroot/etc"))
+			Expect(list[2].Device).To(Equal(filepath.Join(constants.RootDir, "home")))
+			Expect(list[2].Path).To(Equal("/sysroot/home"))
+		})
+		It("does nothing in recovery mode", func() {
+			spec.Mode = constants.RecoveryImgName
+			Expect(action.MountSplitRoot(cfg, spec)).To(Succeed())
+			list, _ := mounter.List()
+			Expect(len(list)).To(Equal(0))
+		})
+		It("fails to mount the volume", func() {
+			mounter.ErrorOnMount = true
+			Expect(action.MountSplitRoot(cfg, spec)).NotTo(Succeed())
+		})
+	})
 	Describe("Mounts ephemeral paths", func() {
 		It("mounts tmpfs overlays paths without errors", func() {
 			spec.Ephemeral.Paths = []string{"/etc"}
@@ -210,6 +268,18 @@ var _ = Describe("Mount Action", func() {
 			Expect(list[1].Path).To(Equal("/sysroot/etc"))
 			Expect(list[1].Device).To(Equal("overlay"))
 		})
+		It("warns if the tmpfs overlay size exceeds the available RAM", func() {
+			Expect(utils.MkdirAll(fs, "/proc", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/proc/meminfo", []byte("MemTotal:        2097152 kB\n"), constants.FilePerm)).To(Succeed())
+			spec.Ephemeral.Paths = []string{"/etc"}
+			spec.Ephemeral.Size = "512M"
+			Expect(action.MountEphemeral(cfg, spec.Sysroot, spec.Ephemeral)).To(Succeed())
+			Expect(memLog.String()).NotTo(ContainSubstring("exceeds the available RAM"))
+
+			spec.Ephemeral.Size = "4G"
+			Expect(action.MountEphemeral(cfg, spec.Sysroot, spec.Ephemeral)).To(Succeed())
+			Expect(memLog.String()).To(ContainSubstring("tmpfs size 4G exceeds the available RAM of 2097152kB"))
+		})
 		It("mounts overlays paths on a block device without errors", func() {
 			spec.Ephemeral.Paths = []string{"/etc"}
 			spec.Ephemeral.Type = "block"
@@ -0,0 +1,90 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/bootloader"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+const nextEntryVar = "next_entry"
+
+var passiveEntryRegexp = regexp.MustCompile(fmt.Sprintf("^%s[0-9]+$", constants.PassiveImgName))
+
+// SetNextBoot sets the GRUB one-shot next_entry variable in the OEM grubenv so the
+// next reboot boots into the given entry. GRUB clears the variable once consumed,
+// thus any later reboot falls back to the default entry. Power actions set in
+// the RunConfig are honored once the variable is set.
+func SetNextBoot(cfg *types.RunConfig, entry string) (err error) {
+	if entry != constants.ActiveImgName && entry != constants.RecoveryImgName && !passiveEntryRegexp.MatchString(entry) {
+		cfg.Logger.Errorf("invalid boot entry '%s'", entry)
+		return elementalError.New(fmt.Sprintf("invalid boot entry '%s'", entry), elementalError.InvalidBootEntry)
+	}
+
+	cleanup := utils.NewCleanStack()
+	defer func() { err = cleanup.Cleanup(err) }()
+
+	parts, err := utils.GetAllPartitions()
+	if err != nil {
+		cfg.Logger.Errorf("could not read host partitions: %v", err)
+		return elementalError.NewFromError(err, elementalError.MountPartitions)
+	}
+	ep, err := cfg.PartitionSelection.ElementalPartitions(parts, nil)
+	if err != nil {
+		cfg.Logger.Errorf("could not pick the host partitions: %v", err)
+		return elementalError.NewFromError(err, elementalError.MountPartitions)
+	}
+	if ep.OEM == nil {
+		cfg.Logger.Errorf("OEM partition not found")
+		return elementalError.New("OEM partition not found", elementalError.MountPartitions)
+	}
+	if ep.OEM.MountPoint == "" {
+		ep.OEM.MountPoint = constants.OEMPath
+	}
+
+	umount, err := elemental.MountRWPartition(cfg.Config, ep.OEM)
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.MountPartitions)
+	}
+	cleanup.Push(umount)
+
+	cfg.Logger.Infof("Setting next boot entry to '%s'", entry)
+	grub := bootloader.NewGrub(&cfg.Config)
+	err = grub.SetPersistentVariables(
+		filepath.Join(ep.OEM.MountPoint, constants.GrubEnv),
+		map[string]string{nextEntryVar: entry},
+	)
+	if err != nil {
+		cfg.Logger.Errorf("failed setting next boot entry: %v", err)
+		return elementalError.NewFromError(err, elementalError.SetGrubVariables)
+	}
+
+	// Do not reboot/poweroff on cleanup errors
+	err = cleanup.Cleanup(nil)
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.Cleanup)
+	}
+	return PowerAction(cfg)
+}
@@ -0,0 +1,126 @@
+/*
+   Copyright © 2022 - 2025 SUSE LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package action_test
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+
+	"github.com/jaypipes/ghw/pkg/block"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v4"
+	"github.com/twpayne/go-vfs/v4/vfst"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/action"
+	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+var _ = Describe("SetNextBoot action", Label("next-boot"), func() {
+	var config *types.RunConfig
+	var runner *mocks.FakeRunner
+	var fs vfs.FS
+	var mounter *mocks.FakeMounter
+	var cleanup func()
+	var ghwTest mocks.GhwMock
+	var grubEnv string
+
+	BeforeEach(func() {
+		runner = mocks.NewFakeRunner()
+		mounter = mocks.NewFakeMounter()
+		logger := types.NewBufferLogger(&bytes.Buffer{})
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).Should(BeNil())
+
+		config = conf.NewRunConfig(
+			conf.WithFs(fs),
+			conf.WithRunner(runner),
+			conf.WithLogger(logger),
+			conf.WithMounter(mounter),
+		)
+
+		mainDisk := block.Disk{
+			Name: "device",
+			Partitions: []*block.Partition{
+				{
+					Name:            "device1",
+					FilesystemLabel: "COS_GRUB",
+					Type:            "vfat",
+				},
+				{
+					Name:            "device2",
+					FilesystemLabel: "COS_OEM",
+					Type:            "ext4",
+				},
+			},
+		}
+		ghwTest = mocks.GhwMock{}
+		ghwTest.AddDisk(mainDisk)
+		ghwTest.CreateDevices()
+		grubEnv = filepath.Join(constants.OEMPath, constants.GrubEnv)
+	})
+	AfterEach(func() {
+		ghwTest.Clean()
+		cleanup()
+	})
+	It("sets the recovery entry for the next boot", func() {
+		Expect(action.SetNextBoot(config, constants.RecoveryImgName)).To(Succeed())
+		Expect(runner.IncludesCmds([][]string{
+			{"grub2-editenv", grubEnv, "set", "next_entry=recovery"},
+		})).To(Succeed())
+		// OEM partition was mounted and released
+		Expect(mounter.List()).To(BeEmpty())
+	})
+	It("sets a passive snapshot entry for the next boot and reboots", func() {
+		config.Reboot = true
+		mountedOnReboot := -1
+		runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+			if cmd == "reboot" {
+				mounts, _ := mounter.List()
+				mountedOnReboot = len(mounts)
+			}
+			return []byte{}, nil
+		}
+		Expect(action.SetNextBoot(config, fmt.Sprintf("%s3", constants.PassiveImgName))).To(Succeed())
+		Expect(runner.MatchMilestones([][]string{
+			{"grub2-editenv", grubEnv, "set", "next_entry=passive3"},
+			{"reboot", "-f"},
+		})).To(Succeed())
+		// OEM partition was released before rebooting
+		Expect(mountedOnReboot).To(Equal(0))
+	})
+	It("fails on an unknown entry", func() {
+		err := action.SetNextBoot(config, "passive")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("invalid boot entry"))
+		Expect(runner.GetCmds()).To(BeEmpty())
+	})
+	It("fails if the grub environment can't be set", func() {
+		runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+			if cmd == "grub2-editenv" || cmd == "grub-editenv" {
+				return []byte{}, fmt.Errorf("editenv failed")
+			}
+			return []byte{}, nil
+		}
+		Expect(action.SetNextBoot(config, constants.RecoveryImgName)).NotTo(Succeed())
+	})
+})
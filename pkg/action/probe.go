@@ -0,0 +1,155 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	eleefi "github.com/rancher/elemental-toolkit/v2/pkg/efi"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+// ProbeDisk is a disk found on the host, its size is in bytes
+type ProbeDisk struct {
+	Path      string           `yaml:"path"`
+	Size      uint64           `yaml:"size"`
+	Removable bool             `yaml:"removable"`
+	ReadOnly  bool             `yaml:"read-only"`
+	Type      string           `yaml:"type,omitempty"`
+	Benchmark *BenchmarkResult `yaml:"benchmark,omitempty"`
+}
+
+// ProbeReport describes the capabilities and environment of the host
+type ProbeReport struct {
+	Arch       string          `yaml:"arch"`
+	Firmware   string          `yaml:"firmware"`
+	SecureBoot bool            `yaml:"secure-boot"`
+	TPM        bool            `yaml:"tpm"`
+	Disks      []ProbeDisk     `yaml:"disks"`
+	Tools      map[string]bool `yaml:"tools"`
+}
+
+type ProbeOption func(p *probe)
+
+// WithProbeEFIVariables sets the EFI variables store used to check the secure boot state
+func WithProbeEFIVariables(efivars eleefi.Variables) ProbeOption {
+	return func(p *probe) {
+		p.efivars = efivars
+	}
+}
+
+// WithProbeBenchmark measures the throughput of each writable disk, see Benchmark
+func WithProbeBenchmark(benchmark bool) ProbeOption {
+	return func(p *probe) {
+		p.benchmark = benchmark
+	}
+}
+
+type probe struct {
+	cfg       *types.Config
+	efivars   eleefi.Variables
+	benchmark bool
+}
+
+// Probe reports the capabilities and environment of the current host: architecture, firmware
+// type, secure boot state, TPM presence, disks and the availability of the tools used by the
+// toolkit. It only reads the host state, nothing is modified. Disks are optionally
+// benchmarked, which only writes to blank disks.
+func Probe(cfg *types.Config, opts ...ProbeOption) (*ProbeReport, error) {
+	p := &probe{cfg: cfg, efivars: eleefi.RealEFIVariables{}}
+	for _, o := range opts {
+		o(p)
+	}
+
+	report := &ProbeReport{
+		Arch:     runtime.GOARCH,
+		Firmware: types.BIOS,
+		Tools:    map[string]bool{},
+	}
+
+	if ok, _ := utils.Exists(cfg.Fs, constants.EfiDevice); ok {
+		report.Firmware = types.EFI
+		if eleefi.VariablesSupported(p.efivars) {
+			enabled, err := eleefi.SecureBootEnabled(p.efivars)
+			if err != nil {
+				cfg.Logger.Warnf("could not read the secure boot state: %v", err)
+			}
+			report.SecureBoot = enabled
+		}
+	}
+	report.TPM, _ = utils.Exists(cfg.Fs, constants.TPMDevice)
+
+	for _, tool := range constants.GetProbeTools() {
+		report.Tools[tool] = cfg.Runner.CommandExists(tool)
+	}
+
+	disks, err := p.disks()
+	if err != nil {
+		cfg.Logger.Errorf("failed probing disks: %v", err)
+		return report, elementalError.NewFromError(err, elementalError.CommandRun)
+	}
+	report.Disks = disks
+
+	if p.benchmark {
+		for i := range report.Disks {
+			if report.Disks[i].ReadOnly {
+				continue
+			}
+			result, err := Benchmark(cfg, report.Disks[i].Path)
+			if err != nil {
+				cfg.Logger.Warnf("could not benchmark %s: %v", report.Disks[i].Path, err)
+				continue
+			}
+			report.Disks[i].Benchmark = result
+		}
+	}
+	return report, nil
+}
+
+// disks lists the disks of the host from lsblk
+func (p *probe) disks() ([]ProbeDisk, error) {
+	out, err := p.cfg.Runner.Run("lsblk", "-dbnpro", "NAME,SIZE,TYPE,RM,RO")
+	if err != nil {
+		return nil, fmt.Errorf("failed listing disks: %s", string(out))
+	}
+
+	disks := []ProbeDisk{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 5 || fields[2] != "disk" {
+			continue
+		}
+		size, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		disks = append(disks, ProbeDisk{
+			Path:      fields[0],
+			Size:      size,
+			Removable: fields[3] == "1",
+			ReadOnly:  fields[4] == "1",
+			Type:      utils.DiskType(p.cfg.Fs, fields[0]),
+		})
+	}
+	return disks, nil
+}
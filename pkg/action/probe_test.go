@@ -0,0 +1,118 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action_test
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+
+	efi "github.com/canonical/go-efilib"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v4"
+	"github.com/twpayne/go-vfs/v4/vfst"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/action"
+	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+var _ = Describe("Probe action", Label("probe"), func() {
+	var config *types.Config
+	var runner *mocks.FakeRunner
+	var fs vfs.FS
+	var cleanup func()
+	var efivars *mocks.MockEFIVariables
+	var lsblkErr bool
+
+	BeforeEach(func() {
+		runner = mocks.NewFakeRunner()
+		logger := types.NewBufferLogger(&bytes.Buffer{})
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).Should(BeNil())
+
+		config = conf.NewConfig(
+			conf.WithFs(fs),
+			conf.WithRunner(runner),
+			conf.WithLogger(logger),
+		)
+
+		efivars = mocks.NewMockEFIVariables()
+		lsblkErr = false
+		runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+			if cmd == "lsblk" {
+				if lsblkErr {
+					return []byte("lsblk failure"), fmt.Errorf("lsblk error")
+				}
+				return []byte("/dev/sda 21474836480 disk 0 0\n/dev/sr0 1073741824 rom 1 1\n/dev/sdb 8589934592 disk 1 0\n"), nil
+			}
+			return []byte{}, nil
+		}
+	})
+	AfterEach(func() {
+		cleanup()
+	})
+	It("reports an EFI host with secure boot and TPM", func() {
+		Expect(utils.MkdirAll(fs, constants.EfiDevice, constants.DirPerm)).To(Succeed())
+		Expect(utils.MkdirAll(fs, constants.TPMDevice, constants.DirPerm)).To(Succeed())
+		Expect(efivars.SetVariable(efi.GlobalVariable, "SecureBoot", []byte{1}, efi.AttributeBootserviceAccess)).To(Succeed())
+
+		report, err := action.Probe(config, action.WithProbeEFIVariables(efivars))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Arch).To(Equal(runtime.GOARCH))
+		Expect(report.Firmware).To(Equal(types.EFI))
+		Expect(report.SecureBoot).To(BeTrue())
+		Expect(report.TPM).To(BeTrue())
+		Expect(report.Disks).To(Equal([]action.ProbeDisk{
+			{Path: "/dev/sda", Size: 21474836480},
+			{Path: "/dev/sdb", Size: 8589934592, Removable: true},
+		}))
+		Expect(report.Tools).To(HaveKeyWithValue("rsync", true))
+		Expect(report.Tools).To(HaveLen(len(constants.GetProbeTools())))
+	})
+	It("reports a BIOS host without TPM", func() {
+		runner.CmdNotFound = "xorriso"
+		report, err := action.Probe(config, action.WithProbeEFIVariables(efivars))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Firmware).To(Equal(types.BIOS))
+		Expect(report.SecureBoot).To(BeFalse())
+		Expect(report.TPM).To(BeFalse())
+		Expect(report.Tools).To(HaveKeyWithValue("xorriso", false))
+	})
+	It("benchmarks writable disks if requested", Label("benchmark"), func() {
+		report, err := action.Probe(config, action.WithProbeEFIVariables(efivars), action.WithProbeBenchmark(true))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Disks).To(HaveLen(2))
+		for _, disk := range report.Disks {
+			Expect(disk.Benchmark).NotTo(BeNil())
+			Expect(disk.Benchmark.ReadMBps).To(BeNumerically(">", 0))
+		}
+		Expect(runner.IncludesCmds([][]string{{"dd", "if=/dev/sdb"}})).To(Succeed())
+	})
+	It("fails if disks can't be listed", func() {
+		lsblkErr = true
+		report, err := action.Probe(config, action.WithProbeEFIVariables(efivars))
+		Expect(err).To(HaveOccurred())
+		Expect(report).NotTo(BeNil())
+		Expect(report.Disks).To(BeEmpty())
+	})
+})
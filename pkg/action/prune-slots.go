@@ -0,0 +1,296 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/bootloader"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/snapshotter"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+// pruner removes, or only reports on dry runs, unused artifacts and adds up the space they take
+type pruner struct {
+	cfg       *types.RunConfig
+	dryRun    bool
+	reclaimed uint
+	backing   []string
+}
+
+// PruneSlots removes the artifacts of the state and recovery partitions which are not part of
+// the current boot layout: passive snapshots missing from the bootloader passive snapshots list
+// or without an image, the leftovers of failed recovery upgrades and the installation state
+// records of snapshots which no longer exist. The active snapshot and any image in use are never
+// removed. With dryRun the artifacts and the space they take are only reported.
+func PruneSlots(cfg *types.RunConfig, dryRun bool) (err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() { err = cleanup.Cleanup(err) }()
+
+	state, err := cfg.LoadInstallState()
+	if err != nil {
+		cfg.Logger.Errorf("failed reading installation state: %v", err)
+		return elementalError.NewFromError(err, elementalError.ReadFile)
+	}
+	active, _ := activeSystemState(state)
+	if active == 0 {
+		cfg.Logger.Errorf("active snapshot not found in the installation state")
+		return elementalError.New("could not determine the active snapshot", elementalError.PruneSlots)
+	}
+
+	parts, err := utils.GetAllPartitions()
+	if err != nil {
+		cfg.Logger.Errorf("could not read host partitions: %v", err)
+		return elementalError.NewFromError(err, elementalError.MountPartitions)
+	}
+	ep, err := cfg.PartitionSelection.ElementalPartitions(parts, state)
+	if err != nil {
+		cfg.Logger.Errorf("could not pick the host partitions: %v", err)
+		return elementalError.NewFromError(err, elementalError.MountPartitions)
+	}
+	if ep.State == nil || ep.Boot == nil {
+		cfg.Logger.Errorf("state or bootloader partition not found")
+		return elementalError.New("state or bootloader partition not found", elementalError.MountPartitions)
+	}
+	if ep.State.MountPoint == "" {
+		ep.State.MountPoint = constants.RunningStateDir
+	}
+	if ep.Boot.MountPoint == "" {
+		ep.Boot.MountPoint = constants.BootDir
+	}
+	if ep.Recovery != nil && ep.Recovery.MountPoint == "" {
+		ep.Recovery.MountPoint = constants.RecoveryDir
+	}
+	for _, part := range []*types.Partition{ep.State, ep.Boot, ep.Recovery} {
+		if part == nil {
+			continue
+		}
+		umount, err := mountPrunePartition(cfg, part, dryRun)
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.MountPartitions)
+		}
+		cleanup.Push(umount)
+	}
+
+	out, err := cfg.Runner.Run("losetup", "-ln", "--output", "BACK-FILE")
+	if err != nil {
+		cfg.Logger.Errorf("failed listing loop devices: %v", err)
+		return elementalError.NewFromError(err, elementalError.PruneSlots)
+	}
+	p := &pruner{cfg: cfg, dryRun: dryRun, backing: strings.Fields(string(out))}
+
+	if state.Snapshotter.Type == constants.LoopDeviceSnapshotterType {
+		err = p.pruneSnapshots(state, ep, active)
+		if err != nil {
+			cfg.Logger.Errorf("failed pruning snapshots: %v", err)
+			return elementalError.NewFromError(err, elementalError.PruneSlots)
+		}
+	} else {
+		cfg.Logger.Warnf("Snapshots are only pruned with the %s snapshotter", constants.LoopDeviceSnapshotterType)
+	}
+
+	if ep.Recovery != nil {
+		for _, path := range []string{constants.BootTransitionPath, constants.OldBootPath} {
+			err = p.prune(ep.Recovery.MountPoint, path, "recovery upgrade leftover", nil)
+			if err != nil {
+				cfg.Logger.Errorf("failed pruning recovery upgrade leftovers: %v", err)
+				return elementalError.NewFromError(err, elementalError.PruneSlots)
+			}
+		}
+	}
+
+	if dryRun {
+		cfg.Logger.Infof("%dMiB can be reclaimed", p.reclaimed)
+	} else {
+		cfg.Logger.Infof("Reclaimed %dMiB", p.reclaimed)
+	}
+	return nil
+}
+
+// pruneSnapshots removes the snapshots which are neither active nor a bootable passive snapshot
+// listed in the bootloader, and the installation state records of missing snapshots
+func (p *pruner) pruneSnapshots(state *types.InstallState, ep types.ElementalPartitions, active int) error {
+	referenced, err := passiveSnapshots(p.cfg, ep.Boot.MountPoint)
+	if err != nil {
+		return err
+	}
+
+	snap, err := snapshotter.NewSnapshotter(p.cfg.Config, state.Snapshotter, bootloader.NewGrub(&p.cfg.Config))
+	if err != nil {
+		return err
+	}
+	err = snap.InitSnapshotter(ep.State, ep.Boot.MountPoint)
+	if err != nil {
+		return err
+	}
+	ids, err := snap.GetSnapshots()
+	if err != nil {
+		return err
+	}
+
+	var kept []int
+	refresh := false
+	for _, id := range ids {
+		path, err := snapshotter.SnapshotPath(state.Snapshotter, ep.State.MountPoint, id)
+		if err != nil {
+			return err
+		}
+		exists, _ := utils.Exists(p.cfg.Fs, path)
+		if id == active || (exists && slices.Contains(referenced, id)) {
+			kept = append(kept, id)
+			continue
+		}
+		rel, err := filepath.Rel(ep.State.MountPoint, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		if p.inUse(rel) {
+			p.cfg.Logger.Warnf("Snapshot %d is in use, it is kept", id)
+			kept = append(kept, id)
+			continue
+		}
+		err = p.prune(ep.State.MountPoint, rel, fmt.Sprintf("snapshot %d", id), func() error { return snap.DeleteSnapshot(id) })
+		if err != nil {
+			return err
+		}
+		refresh = refresh || slices.Contains(referenced, id)
+	}
+
+	// Activating the active snapshot again lists the remaining passive snapshots in the bootloader
+	if refresh && !p.dryRun {
+		err = snap.ActivateSnapshot(active)
+		if err != nil {
+			return err
+		}
+	}
+
+	statePart := state.Partitions[constants.StatePartName]
+	if statePart == nil {
+		return nil
+	}
+	changed := false
+	for id := range statePart.Snapshots {
+		if id == active || slices.Contains(kept, id) {
+			continue
+		}
+		if p.dryRun {
+			p.cfg.Logger.Infof("Would prune the installation state record of snapshot %d", id)
+		} else {
+			p.cfg.Logger.Infof("Pruning the installation state record of snapshot %d", id)
+		}
+		delete(statePart.Snapshots, id)
+		changed = true
+	}
+	if !changed || p.dryRun {
+		return nil
+	}
+	var recoveryStateFile string
+	if ep.Recovery != nil {
+		recoveryStateFile = filepath.Join(ep.Recovery.MountPoint, constants.InstallStateFile)
+	}
+	return p.cfg.WriteInstallState(state, filepath.Join(ep.State.MountPoint, constants.InstallStateFile), recoveryStateFile)
+}
+
+// prune removes the given path, relative to the given partition root, if it exists and is not
+// in use. It is removed with the given remove function or from the filesystem if nil.
+func (p *pruner) prune(root, rel, desc string, remove func() error) error {
+	path := filepath.Join(root, rel)
+	if ok, _ := utils.Exists(p.cfg.Fs, path); !ok {
+		return nil
+	}
+	if p.inUse(rel) {
+		p.cfg.Logger.Warnf("The %s at %s is in use, it is kept", desc, path)
+		return nil
+	}
+	size, err := utils.DirSizeMB(p.cfg.Fs, path)
+	if err != nil {
+		return err
+	}
+	if p.dryRun {
+		p.cfg.Logger.Infof("Would prune the %s at %s, %dMiB", desc, path, size)
+		p.reclaimed += size
+		return nil
+	}
+
+	p.cfg.Logger.Infof("Pruning the %s at %s, %dMiB", desc, path, size)
+	if remove == nil {
+		err = utils.SafeRemoveAll(p.cfg.Logger, p.cfg.Mounter, p.cfg.Fs, path)
+	} else {
+		err = remove()
+	}
+	if err != nil {
+		return err
+	}
+	p.reclaimed += size
+	return nil
+}
+
+// inUse checks if the given path, relative to its partition root, contains the backing file of
+// a loop device. Backing files are matched regardless of where the partition is mounted.
+func (p *pruner) inUse(rel string) bool {
+	for _, file := range p.backing {
+		if strings.Contains(file, "/"+rel+"/") || strings.HasSuffix(file, "/"+rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// passiveSnapshots returns the passive snapshots listed in the bootloader environment
+func passiveSnapshots(cfg *types.RunConfig, bootDir string) ([]int, error) {
+	envFile := filepath.Join(bootDir, constants.GrubOEMEnv)
+	env, err := utils.LoadEnvFile(cfg.Fs, envFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading bootloader environment %s: %w", envFile, err)
+	}
+	value, ok := env[constants.GrubPassiveSnapshots]
+	if !ok {
+		return nil, fmt.Errorf("passive snapshots not found in the bootloader environment %s", envFile)
+	}
+	var ids []int
+	for _, field := range strings.Fields(value) {
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid passive snapshot '%s' in the bootloader environment %s", field, envFile)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// mountPrunePartition mounts the given partition if not mounted yet, read only on dry runs
+func mountPrunePartition(cfg *types.RunConfig, part *types.Partition, dryRun bool) (func() error, error) {
+	if !dryRun {
+		return elemental.MountRWPartition(cfg.Config, part)
+	}
+	if mnt, _ := elemental.IsMounted(cfg.Config, part); mnt {
+		return func() error { return nil }, nil
+	}
+	err := elemental.MountPartition(cfg.Config, part, "ro")
+	if err != nil {
+		return nil, err
+	}
+	return func() error { return elemental.UnmountPartition(cfg.Config, part) }, nil
+}
@@ -0,0 +1,183 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action_test
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+
+	"github.com/jaypipes/ghw/pkg/block"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v4"
+	"github.com/twpayne/go-vfs/v4/vfst"
+	"gopkg.in/yaml.v3"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/action"
+	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+var _ = Describe("PruneSlots action", Label("prune-slots"), func() {
+	var config *types.RunConfig
+	var runner *mocks.FakeRunner
+	var fs vfs.FS
+	var cleanup func()
+	var ghwTest mocks.GhwMock
+	var state *types.InstallState
+	var snapsDir, stateFile, envFile string
+	var leftovers []string
+
+	readState := func() *types.InstallState {
+		data, err := fs.ReadFile(stateFile)
+		Expect(err).NotTo(HaveOccurred())
+		s := &types.InstallState{}
+		Expect(yaml.Unmarshal(data, s)).To(Succeed())
+		return s
+	}
+	exists := func(path string) bool {
+		ok, _ := utils.Exists(fs, path)
+		return ok
+	}
+	snapDir := func(id int) string {
+		return filepath.Join(snapsDir, fmt.Sprintf("%d", id))
+	}
+
+	BeforeEach(func() {
+		runner = mocks.NewFakeRunner()
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).Should(BeNil())
+
+		config = conf.NewRunConfig(
+			conf.WithFs(fs),
+			conf.WithRunner(runner),
+			conf.WithLogger(types.NewBufferLogger(&bytes.Buffer{})),
+			conf.WithMounter(mocks.NewFakeMounter()),
+		)
+
+		mainDisk := block.Disk{
+			Name: "device",
+			Partitions: []*block.Partition{
+				{Name: "device1", FilesystemLabel: constants.BootLabel, Type: "vfat"},
+				{Name: "device2", FilesystemLabel: constants.StateLabel, Type: "ext4"},
+				{Name: "device3", FilesystemLabel: constants.RecoveryLabel, Type: "ext4"},
+			},
+		}
+		ghwTest = mocks.GhwMock{}
+		ghwTest.AddDisk(mainDisk)
+		ghwTest.CreateDevices()
+
+		// Snapshot 3 is active, 2 is a listed passive, 1 is not listed, 4 is listed
+		// but has no image and 5 is not listed but in use
+		snapsDir = filepath.Join(constants.RunningStateDir, ".snapshots")
+		for _, id := range []int{1, 2, 3, 5} {
+			img := filepath.Join(snapDir(id), "snapshot.img")
+			Expect(utils.MkdirAll(fs, filepath.Dir(img), constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile(img, []byte(fmt.Sprintf("snapshot%d", id)), constants.FilePerm)).To(Succeed())
+		}
+		Expect(utils.MkdirAll(fs, filepath.Join(snapDir(4), "snapshot.workDir"), constants.DirPerm)).To(Succeed())
+		Expect(fs.Symlink("3/snapshot.img", filepath.Join(snapsDir, constants.ActiveSnapshot))).To(Succeed())
+
+		envFile = filepath.Join(constants.BootDir, constants.GrubOEMEnv)
+		Expect(utils.MkdirAll(fs, constants.BootDir, constants.DirPerm)).To(Succeed())
+		Expect(fs.WriteFile(envFile, []byte("# GRUB Environment Block\npassive_snaps=4 2\n####"), constants.FilePerm)).To(Succeed())
+
+		leftovers = []string{
+			filepath.Join(constants.RecoveryDir, constants.TransitionPath(constants.ActionUpgradeRecovery), constants.RecoveryImgFile),
+			filepath.Join(constants.RecoveryDir, constants.OldBootPath, constants.RecoveryImgFile),
+		}
+		for _, file := range leftovers {
+			Expect(utils.MkdirAll(fs, filepath.Dir(file), constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile(file, []byte("recovery"), constants.FilePerm)).To(Succeed())
+		}
+
+		state = &types.InstallState{
+			Snapshotter: types.NewLoopDevice(),
+			Partitions: map[string]*types.PartitionState{
+				constants.StatePartName: {
+					FSLabel: constants.StateLabel,
+					Snapshots: map[int]*types.SystemState{
+						1: {}, 2: {}, 3: {Active: true}, 5: {}, 6: {},
+					},
+				},
+			},
+		}
+		stateFile = filepath.Join(constants.RunningStateDir, constants.InstallStateFile)
+		Expect(config.WriteInstallState(state, stateFile, "")).To(Succeed())
+
+		runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+			if cmd == "losetup" {
+				return []byte("/run/initramfs/elemental-state/.snapshots/5/snapshot.img\n"), nil
+			}
+			return []byte{}, nil
+		}
+	})
+	AfterEach(func() {
+		ghwTest.Clean()
+		cleanup()
+	})
+	It("removes the artifacts not used by the boot layout", func() {
+		Expect(action.PruneSlots(config, false)).To(Succeed())
+
+		Expect(exists(snapDir(1))).To(BeFalse())
+		Expect(exists(snapDir(4))).To(BeFalse())
+		for _, id := range []int{2, 3, 5} {
+			Expect(exists(snapDir(id))).To(BeTrue())
+		}
+		for _, file := range leftovers {
+			Expect(exists(filepath.Dir(file))).To(BeFalse())
+		}
+		Expect(exists(filepath.Join(constants.RecoveryDir, constants.BootTransitionPath))).To(BeFalse())
+		Expect(readState().Partitions[constants.StatePartName].Snapshots).To(HaveLen(3))
+		Expect(readState().Partitions[constants.StatePartName].Snapshots).To(HaveKey(5))
+
+		// The bootloader no longer lists the removed snapshot 4
+		Expect(runner.IncludesCmds([][]string{
+			{"grub2-editenv", envFile, "set", "passive_snaps=5 2"},
+		})).To(Succeed())
+	})
+	It("only reports the artifacts on a dry run", func() {
+		Expect(action.PruneSlots(config, true)).To(Succeed())
+
+		for _, id := range []int{1, 2, 3, 4, 5} {
+			Expect(exists(snapDir(id))).To(BeTrue())
+		}
+		for _, file := range leftovers {
+			Expect(exists(file)).To(BeTrue())
+		}
+		Expect(readState().Partitions[constants.StatePartName].Snapshots).To(HaveLen(5))
+		Expect(runner.IncludesCmds([][]string{{"grub2-editenv"}})).NotTo(Succeed())
+	})
+	It("keeps all snapshots if the bootloader does not list the passive snapshots", func() {
+		Expect(fs.WriteFile(envFile, []byte("# GRUB Environment Block\n"), constants.FilePerm)).To(Succeed())
+		Expect(action.PruneSlots(config, false)).To(MatchError(ContainSubstring("passive snapshots not found")))
+		for _, id := range []int{1, 2, 3, 4, 5} {
+			Expect(exists(snapDir(id))).To(BeTrue())
+		}
+	})
+	It("fails if the active snapshot is unknown", func() {
+		state.Partitions[constants.StatePartName].Snapshots[3].Active = false
+		Expect(config.WriteInstallState(state, stateFile, "")).To(Succeed())
+		Expect(action.PruneSlots(config, false)).To(MatchError(ContainSubstring("could not determine the active snapshot")))
+		Expect(exists(snapDir(1))).To(BeTrue())
+	})
+})
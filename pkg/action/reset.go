@@ -74,6 +74,8 @@ type ResetAction struct {
 	bootloader  types.Bootloader
 	snapshotter types.Snapshotter
 	snapshot    *types.Snapshot
+	version     string
+	deployed    []string
 }
 
 func NewResetAction(cfg *types.RunConfig, spec *types.ResetSpec, opts ...ResetActionOption) (*ResetAction, error) {
@@ -89,12 +91,21 @@ func NewResetAction(cfg *types.RunConfig, spec *types.ResetSpec, opts ...ResetAc
 		}
 	}
 
+	if r.bootloader == nil && cfg.Bootloader == constants.BootloaderNone {
+		r.bootloader = bootloader.NewNone(&cfg.Config, bootloader.NewGrubTemplateData(
+			r.spec.GetGrubLabels(), r.spec.GrubDefEntry, cfg.Snapshotter.Type,
+		))
+	}
+
 	if r.bootloader == nil {
 		r.bootloader = bootloader.NewGrub(
 			&cfg.Config,
 			bootloader.WithGrubDisableBootEntry(r.spec.DisableBootEntry),
 			bootloader.WithGrubAutoDisableBootEntry(),
 			bootloader.WithGrubClearBootEntry(false),
+			bootloader.WithGrubTemplateData(bootloader.NewGrubTemplateData(
+				r.spec.GetGrubLabels(), r.spec.GrubDefEntry, cfg.Snapshotter.Type,
+			)),
 		)
 	}
 
@@ -147,10 +158,12 @@ func (r *ResetAction) updateInstallState(cleanup *utils.CleanStack) error {
 					r.snapshot.ID: {
 						Source:     src,
 						Digest:     src.GetDigest(),
+						Version:    r.version,
 						Active:     true,
 						Labels:     r.spec.SnapshotLabels,
 						Date:       date,
 						FromAction: constants.ActionReset,
+						Deployed:   r.deployed,
 					},
 				},
 			},
@@ -166,6 +179,16 @@ func (r *ResetAction) updateInstallState(cleanup *utils.CleanStack) error {
 			FSLabel: r.spec.Partitions.Persistent.FilesystemLabel,
 		}
 	}
+	if r.spec.Partitions.Var != nil {
+		installState.Partitions[constants.VarPartName] = &types.PartitionState{
+			FSLabel: r.spec.Partitions.Var.FilesystemLabel,
+		}
+	}
+	if r.spec.Partitions.Root != nil {
+		installState.Partitions[constants.RootPartName] = &types.PartitionState{
+			FSLabel: r.spec.Partitions.Root.FilesystemLabel,
+		}
+	}
 	if r.spec.State != nil && r.spec.State.Partitions != nil {
 		installState.Partitions[constants.RecoveryPartName] = r.spec.State.Partitions[constants.RecoveryPartName]
 	}
@@ -183,8 +206,41 @@ func (r *ResetAction) updateInstallState(cleanup *utils.CleanStack) error {
 	)
 }
 
+// ResetToVersion resets the system to the given source instead of the recovery image. Image
+// sources must be pinned to a tag or a digest, so the reset version is well known.
+func ResetToVersion(cfg *types.RunConfig, spec *types.ResetSpec, source *types.ImageSource, opts ...ResetActionOption) error {
+	if source == nil || source.IsEmpty() {
+		return elementalError.New("undefined source to reset to", elementalError.ReadingSpecConfig)
+	}
+	if source.IsImage() && !utils.ValidTaggedContainerReference(source.Value()) {
+		return elementalError.New(
+			fmt.Sprintf("image '%s' to reset to is not pinned to a tag or digest", source.Value()),
+			elementalError.ReadingSpecConfig,
+		)
+	}
+
+	spec.System = source
+	err := spec.Sanitize()
+	if err != nil {
+		cfg.Logger.Errorf("invalid reset setup: %v", err)
+		return elementalError.NewFromError(err, elementalError.ReadingSpecConfig)
+	}
+
+	reset, err := NewResetAction(cfg, spec, opts...)
+	if err != nil {
+		cfg.Logger.Errorf("failed to initialize reset action: %v", err)
+		return err
+	}
+
+	cfg.Logger.Infof("Resetting to %s", source.String())
+	return reset.Run()
+}
+
 // ResetRun will reset the cos system to by following several steps
 func (r ResetAction) Run() (err error) {
+	notifier := newNotifiers(newWebhook(r.cfg, "reset"), newMetricsNotifier(r.cfg, "reset"))
+	defer func() { notifier.notify(err) }()
+
 	cleanup := utils.NewCleanStack()
 	defer func() { err = cleanup.Cleanup(err) }()
 
@@ -221,6 +277,15 @@ func (r ResetAction) Run() (err error) {
 			}
 		}
 	}
+
+	// Reformat the separate root partition, it is seeded again from the reset system
+	if r.spec.Partitions.Root != nil {
+		err = elemental.FormatPartition(r.cfg.Config, r.spec.Partitions.Root)
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.FormatPartitions)
+		}
+	}
+
 	// Mount configured partitions
 	err = elemental.MountPartitions(r.cfg.Config, r.spec.Partitions.PartitionsByMountPoint(false, r.spec.Partitions.Recovery), "rw")
 	if err != nil {
@@ -266,6 +331,15 @@ func (r ResetAction) Run() (err error) {
 		return err
 	}
 
+	// Seed the root partition with everything but /usr of the system
+	if r.spec.Partitions.Root != nil {
+		err = elemental.SeedRootPartition(r.cfg.Config, r.snapshot.WorkDir, r.spec.Partitions)
+		if err != nil {
+			r.cfg.Logger.Errorf("failed seeding the root partition: %v", err)
+			return elementalError.NewFromError(err, elementalError.CopyData)
+		}
+	}
+
 	// Closing snapshotter transaction
 	r.cfg.Logger.Info("Closing snapshotter transaction")
 	err = r.snapshotter.CloseTransaction(r.snapshot)
@@ -290,6 +364,7 @@ func (r ResetAction) Run() (err error) {
 		return elementalError.NewFromError(err, elementalError.Cleanup)
 	}
 
+	notifier.notify(nil)
 	return PowerAction(r.cfg)
 }
 
@@ -299,6 +374,43 @@ func (r *ResetAction) refineDeployment() error { //nolint:dupl
 	if err != nil {
 		return elementalError.NewFromError(err, elementalError.CopyFile)
 	}
+	// A formatted OEM partition lost the mount settings of the var and root partitions
+	if r.spec.FormatOEM {
+		err = elemental.WriteOverlayConfig(
+			r.cfg.Config, r.spec.Partitions.GetConfigStorage(), types.OverlaySpec{}, r.spec.Partitions.Var, r.spec.Partitions.Root,
+		)
+		if err != nil {
+			r.cfg.Logger.Errorf("failed writing overlay config: %v", err)
+			return elementalError.NewFromError(err, elementalError.CreateFile)
+		}
+	}
+	err = elemental.LinkKernelInitrd(r.cfg.Config, r.snapshot.WorkDir)
+	if err != nil {
+		r.cfg.Logger.Errorf("failed linking kernel and initrd: %v", err)
+		return elementalError.NewFromError(err, elementalError.FindKernelInitrd)
+	}
+	err = elemental.SetDefaultBootTarget(r.cfg.Config, r.snapshot.WorkDir, r.cfg.DefaultBootTarget)
+	if err != nil {
+		r.cfg.Logger.Errorf("failed setting default boot target: %v", err)
+		return elementalError.NewFromError(err, elementalError.BootTarget)
+	}
+
+	r.version = osVersion(r.cfg.Fs, r.snapshot.WorkDir)
+	r.deployed = deployedFiles(r.cfg)
+	err = writeImageVersion(r.cfg, r.snapshot.WorkDir, types.SystemState{
+		Source:     r.spec.System,
+		Digest:     r.spec.System.GetDigest(),
+		Version:    r.version,
+		Labels:     r.spec.SnapshotLabels,
+		Date:       time.Now().Format(time.RFC3339),
+		FromAction: constants.ActionReset,
+		Deployed:   r.deployed,
+	})
+	if err != nil {
+		r.cfg.Logger.Errorf("failed writing image version file: %v", err)
+		return elementalError.NewFromError(err, elementalError.CreateFile)
+	}
+
 	// Install grub
 	err = r.bootloader.Install(
 		r.snapshot.WorkDir,
@@ -20,12 +20,14 @@ import (
 	"bytes"
 	"fmt"
 	"path/filepath"
+	"strings"
 
 	"github.com/jaypipes/ghw/pkg/block"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/twpayne/go-vfs/v4"
 	"github.com/twpayne/go-vfs/v4/vfst"
+	"gopkg.in/yaml.v3"
 
 	"github.com/rancher/elemental-toolkit/v2/pkg/action"
 	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
@@ -81,6 +83,7 @@ var _ = Describe("Reset action tests", func() {
 		var spec *types.ResetSpec
 		var reset *action.ResetAction
 		var cmdFail, bootedFrom string
+		var mainDisk block.Disk
 		var err error
 		BeforeEach(func() {
 			cmdFail = ""
@@ -92,7 +95,7 @@ var _ = Describe("Reset action tests", func() {
 
 			bootloader = &mocks.FakeBootloader{}
 
-			mainDisk := block.Disk{
+			mainDisk = block.Disk{
 				Name: "device",
 				Partitions: []*block.Partition{
 					{
@@ -174,6 +177,73 @@ var _ = Describe("Reset action tests", func() {
 			Expect(reset.Run()).To(BeNil())
 			Expect(runner.IncludesCmds([][]string{{"poweroff", "-f"}}))
 		})
+		Describe("With a separate root partition", Label("root"), func() {
+			BeforeEach(func() {
+				mainDisk.Partitions = append(mainDisk.Partitions,
+					&block.Partition{Name: "device6", FilesystemLabel: constants.RootLabel, Type: "ext4"},
+					&block.Partition{Name: "device7", FilesystemLabel: constants.VarLabel, Type: "xfs"},
+				)
+				ghwTest.Clean()
+				ghwTest = mocks.GhwMock{}
+				ghwTest.AddDisk(mainDisk)
+				ghwTest.CreateDevices()
+
+				state := &types.InstallState{Partitions: map[string]*types.PartitionState{
+					constants.StatePartName: {FSLabel: constants.StateLabel},
+					constants.RootPartName:  {FSLabel: constants.RootLabel},
+					constants.VarPartName:   {FSLabel: constants.VarLabel},
+				}}
+				statePath := filepath.Join(constants.RunningStateDir, constants.InstallStateFile)
+				Expect(config.WriteInstallState(state, statePath, statePath)).To(Succeed())
+
+				spec, err = conf.NewResetSpec(config.Config)
+				Expect(err).ShouldNot(HaveOccurred())
+				reset, err = action.NewResetAction(config, spec, action.WithResetBootloader(bootloader))
+				Expect(err).NotTo(HaveOccurred())
+			})
+			It("formats and seeds the root partition again", func() {
+				Expect(spec.Partitions.Root.Path).To(Equal("/dev/device6"))
+				Expect(spec.Partitions.Var.MountPoint).To(BeEmpty())
+				Expect(reset.Run()).To(Succeed())
+
+				Expect(runner.IncludesCmds([][]string{{"mkfs.ext4", "-L", constants.RootLabel, "/dev/device6"}})).To(Succeed())
+				var seed []string
+				for _, cmd := range runner.GetCmds() {
+					if cmd[0] == "rsync" && strings.HasSuffix(cmd[len(cmd)-1], constants.RootDir+"/") {
+						seed = cmd
+					}
+				}
+				Expect(seed).To(ContainElements("--exclude=/usr", "--exclude=/var/*"))
+				for _, cmd := range runner.GetCmds() {
+					Expect(cmd).NotTo(ContainElement("/dev/device7"))
+				}
+
+				data, err := fs.ReadFile(filepath.Join(spec.Partitions.State.MountPoint, constants.InstallStateFile))
+				Expect(err).ToNot(HaveOccurred())
+				state := &types.InstallState{}
+				Expect(yaml.Unmarshal(data, state)).To(Succeed())
+				Expect(state.Partitions[constants.RootPartName].FSLabel).To(Equal(constants.RootLabel))
+				Expect(state.Partitions[constants.VarPartName].FSLabel).To(Equal(constants.VarLabel))
+			})
+			It("writes the mount settings again if the OEM partition is formatted", func() {
+				spec.FormatOEM = true
+				Expect(reset.Run()).To(Succeed())
+
+				data, err := fs.ReadFile(filepath.Join(constants.OEMDir, constants.OverlayConfigFile))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(data)).To(ContainSubstring("device: LABEL=COS_ROOT"))
+				Expect(string(data)).To(ContainSubstring("device: LABEL=COS_VAR"))
+			})
+			It("fails if the root partition is not found", func() {
+				ghwTest.Clean()
+				ghwTest = mocks.GhwMock{}
+				mainDisk.Partitions = mainDisk.Partitions[:len(mainDisk.Partitions)-2]
+				ghwTest.AddDisk(mainDisk)
+				ghwTest.CreateDevices()
+				_, err = conf.NewResetSpec(config.Config)
+				Expect(err).To(MatchError(ContainSubstring("root partition labeled COS_ROOT not found")))
+			})
+		})
 		It("Successfully resets from a squashfs recovery image", Label("channel"), func() {
 			err := utils.MkdirAll(config.Fs, constants.ISOBaseTree, constants.DirPerm)
 			Expect(err).ShouldNot(HaveOccurred())
@@ -191,6 +261,25 @@ var _ = Describe("Reset action tests", func() {
 		It("Successfully resets from a channel package", Label("channel"), func() {
 			Expect(reset.Run()).To(BeNil())
 		})
+		Describe("Reset to version", Label("version"), func() {
+			It("resets to a pinned image", func() {
+				src := types.NewDockerSrc("my/image:v1.2.3")
+				err = action.ResetToVersion(config, spec, src, action.WithResetBootloader(bootloader))
+				Expect(err).To(BeNil())
+				Expect(extractor.Auths).To(HaveKey("my/image:v1.2.3"))
+
+				data, err := fs.ReadFile(filepath.Join(spec.Partitions.State.MountPoint, constants.InstallStateFile))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).To(ContainSubstring("oci://my/image:v1.2.3"))
+			})
+			It("fails to reset to an image without a tag or digest", func() {
+				src := types.NewDockerSrc("my/image")
+				Expect(action.ResetToVersion(config, spec, src)).NotTo(Succeed())
+			})
+			It("fails to reset to an empty source", func() {
+				Expect(action.ResetToVersion(config, spec, types.NewEmptySrc())).NotTo(Succeed())
+			})
+		})
 		It("Fails setting the persistent grub variables", func() {
 			bootloader.ErrorSetPersistentVariables = true
 			err = reset.Run()
@@ -0,0 +1,150 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+const supportBundleDir = "elemental-support"
+
+type bundleItem struct {
+	name    string
+	collect func() ([]byte, error)
+}
+
+// CollectSupportBundle gathers the resolved configuration, the installation state,
+// the executed commands trace, the block devices layout and the elemental services
+// and cloud-init stages logs into the given tar.gz
+// file. Collection is best effort, any item that can't be gathered is logged and
+// its error is included in the bundle instead.
+func CollectSupportBundle(cfg *types.RunConfig, output string) (err error) {
+	run := func(cmd string, args ...string) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			if !cfg.Runner.CommandExists(cmd) {
+				return nil, fmt.Errorf("command '%s' not found", cmd)
+			}
+			return cfg.Runner.Run(cmd, args...)
+		}
+	}
+	read := func(file string) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			return cfg.Fs.ReadFile(file)
+		}
+	}
+
+	items := []bundleItem{
+		{"config.yaml", func() ([]byte, error) {
+			redacted := *cfg
+			redacted.WebhookURL = redactURL(cfg.WebhookURL)
+			return yaml.Marshal(&redacted)
+		}},
+		{"commands.log", read(constants.CommandTraceFile)},
+		{constants.InstallStateFile, func() ([]byte, error) {
+			state, err := cfg.LoadInstallState()
+			if err != nil {
+				return nil, err
+			}
+			return yaml.Marshal(state)
+		}},
+		{"lsblk.json", run("lsblk", "-p", "-J", "-o", "NAME,PATH,SIZE,TYPE,FSTYPE,LABEL,PARTLABEL,UUID,MOUNTPOINT")},
+		{"blkid.txt", run("blkid")},
+		{"journal.log", run("journalctl", "-b", "--no-pager", "-u", "elemental*")},
+		{"cloud-init.log", run("journalctl", "-b", "--no-pager", "-u", "elemental-setup-*")},
+		{"cmdline", read("/proc/cmdline")},
+		{"mounts", read("/proc/mounts")},
+		{"os-release", read("/etc/os-release")},
+	}
+
+	file, err := cfg.Fs.Create(output)
+	if err != nil {
+		cfg.Logger.Errorf("failed creating support bundle %s: %v", output, err)
+		return elementalError.NewFromError(err, elementalError.CreateFile)
+	}
+	defer file.Close()
+	gzipWriter := gzip.NewWriter(file)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	now := time.Now()
+	for _, item := range items {
+		cfg.Logger.Debugf("Collecting %s", item.name)
+		data, err := item.collect()
+		if err != nil {
+			cfg.Logger.Warnf("failed collecting %s: %v", item.name, err)
+			data = append(data, []byte(fmt.Sprintf("\nerror collecting %s: %v\n", item.name, err))...)
+		}
+		header := &tar.Header{
+			Name:    filepath.Join(supportBundleDir, item.name),
+			Size:    int64(len(data)),
+			Mode:    0600,
+			ModTime: now,
+			Format:  tar.FormatGNU,
+		}
+		err = tarWriter.WriteHeader(header)
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.TarHeader)
+		}
+		_, err = tarWriter.Write(data)
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.CopyData)
+		}
+	}
+
+	// Closing the writers flushes the archive trailers
+	err = tarWriter.Close()
+	if err != nil {
+		cfg.Logger.Errorf("failed closing support bundle archive: %v", err)
+		return elementalError.NewFromError(err, elementalError.CopyData)
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		cfg.Logger.Errorf("failed compressing support bundle: %v", err)
+		return elementalError.NewFromError(err, elementalError.CopyData)
+	}
+	err = file.Close()
+	if err != nil {
+		cfg.Logger.Errorf("failed writing support bundle %s: %v", output, err)
+		return elementalError.NewFromError(err, elementalError.CopyData)
+	}
+
+	cfg.Logger.Infof("Support bundle written to %s", output)
+	return nil
+}
+
+// redactURL keeps only the scheme and host of the given URL, webhook endpoints
+// commonly carry access tokens in their credentials, path or query
+func redactURL(raw string) string {
+	if raw == "" {
+		return raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return "<redacted>"
+	}
+	return fmt.Sprintf("%s://%s/<redacted>", u.Scheme, u.Host)
+}
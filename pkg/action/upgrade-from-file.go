@@ -0,0 +1,216 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+const (
+	artifactUnknown = iota
+	artifactFsImage
+	artifactTarball
+)
+
+// artifactMagic maps the magic bytes found at a given offset to the artifact kind
+var artifactMagic = []struct {
+	offset int64
+	magic  []byte
+	kind   int
+}{
+	{0, []byte("hsqs"), artifactFsImage},                         // squashfs
+	{1080, []byte{0x53, 0xEF}, artifactFsImage},                  // ext2/3/4
+	{0, []byte("XFSB"), artifactFsImage},                         // xfs
+	{0x10040, []byte("_BHRfS_M"), artifactFsImage},               // btrfs
+	{257, []byte("ustar"), artifactTarball},                      // tar
+	{0, []byte{0x1F, 0x8B}, artifactTarball},                     // gzip
+	{0, []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}, artifactTarball}, // xz
+	{0, []byte{0x28, 0xB5, 0x2F, 0xFD}, artifactTarball},         // zstd
+	{0, []byte("BZh"), artifactTarball},                          // bzip2
+}
+
+// UpgradeFromFile upgrades the system using a local image artifact as the upgrade source,
+// no network access is required. Filesystem images (squashfs, ext, xfs, btrfs) are used
+// as they are and tarballs are unpacked into the persistent partition before the upgrade.
+// The artifact checksum is verified against the '<path>.<algorithm>' file next to it, e.g.
+// '<path>.sha256', which is required unless the spec explicitly skips the checksum. If cosign is enabled the artifact
+// signature is also verified against '<path>.sig'.
+func UpgradeFromFile(cfg *types.RunConfig, spec *types.UpgradeSpec, path string) (err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() {
+		err = cleanup.Cleanup(err)
+	}()
+
+	err = verifyArtifact(cfg, path, spec.SkipChecksum)
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.VerifyUpgrade)
+	}
+
+	kind, err := detectArtifact(cfg.Fs, path)
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.IdentifySource)
+	}
+
+	switch kind {
+	case artifactFsImage:
+		cfg.Logger.Infof("Upgrading from filesystem image %s", path)
+		spec.System = types.NewFileSrc(path)
+	case artifactTarball:
+		cfg.Logger.Infof("Upgrading from tarball %s", path)
+		dir, err := unpackArtifact(cfg, spec, path, cleanup)
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.DumpSource)
+		}
+		spec.System = types.NewDirSrc(dir)
+	default:
+		return elementalError.New(fmt.Sprintf("unknown artifact type for %s", path), elementalError.IdentifySource)
+	}
+
+	upgrade, err := NewUpgradeAction(cfg, spec)
+	if err != nil {
+		return err
+	}
+
+	// Power actions are postponed until the unpacked artifact is cleaned up
+	reboot, poweroff := cfg.Reboot, cfg.PowerOff
+	cfg.Reboot, cfg.PowerOff = false, false
+	err = upgrade.Run()
+	cfg.Reboot, cfg.PowerOff = reboot, poweroff
+	if err != nil {
+		return err
+	}
+
+	err = cleanup.Cleanup(nil)
+	if err != nil {
+		return err
+	}
+
+	return PowerAction(cfg)
+}
+
+// verifyArtifact checks the artifact checksum and, if cosign is enabled, its signature. It fails
+// if there is no checksum file unless skipChecksum is set.
+func verifyArtifact(cfg *types.RunConfig, path string, skipChecksum bool) error {
+	// The checksum file of the configured algorithm is preferred
+	var checksumFile, algo string
+	for _, a := range append([]string{cfg.ChecksumAlgo}, constants.GetChecksumAlgorithms()...) {
+		if ok, _ := utils.Exists(cfg.Fs, path+"."+a); a != "" && ok {
+			checksumFile, algo = path+"."+a, a
+			break
+		}
+	}
+	if checksumFile != "" {
+		data, err := cfg.Fs.ReadFile(checksumFile)
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(string(data))
+		if len(fields) == 0 {
+			return fmt.Errorf("empty checksum file %s", checksumFile)
+		}
+		err = utils.VerifyFileDigest(cfg.Fs, path, fmt.Sprintf("%s:%s", algo, fields[0]))
+		if err != nil {
+			return err
+		}
+		cfg.Logger.Infof("Checksum of %s verified", path)
+	} else if skipChecksum {
+		cfg.Logger.Warnf("No checksum file found for %s, skipping checksum verification", path)
+	} else {
+		return fmt.Errorf("no checksum file found for %s, the artifact can't be verified", path)
+	}
+
+	if cfg.Cosign {
+		args := []string{"verify-blob", "--signature", path + ".sig"}
+		if cfg.CosignPubKey != "" {
+			args = append(args, "--key", cfg.CosignPubKey)
+		}
+		args = append(args, path)
+		out, err := cfg.Runner.Run("cosign", args...)
+		if err != nil {
+			cfg.Logger.Errorf("cosign verification failed: %s", string(out))
+			return err
+		}
+	}
+	return nil
+}
+
+// detectArtifact returns the kind of the given artifact based on its magic bytes
+func detectArtifact(fs types.FS, path string) (int, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return artifactUnknown, err
+	}
+	defer f.Close()
+
+	// Read enough of the header to match all known magic bytes
+	header := make([]byte, 0x10040+8)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return artifactUnknown, err
+	}
+	header = header[:n]
+
+	for _, m := range artifactMagic {
+		end := m.offset + int64(len(m.magic))
+		if end <= int64(len(header)) && bytes.Equal(header[m.offset:end], m.magic) {
+			return m.kind, nil
+		}
+	}
+	return artifactUnknown, nil
+}
+
+// unpackArtifact extracts the given tarball into a temporary directory within the download directory,
+// if configured, or within the persistent partition, if any, and returns its path. Unmounts and
+// removals are pushed to the cleanup stack.
+func unpackArtifact(cfg *types.RunConfig, spec *types.UpgradeSpec, path string, cleanup *utils.CleanStack) (string, error) {
+	base := ""
+	if cfg.DownloadDir == "" && spec.Partitions.Persistent != nil {
+		umount, err := elemental.MountRWPartition(cfg.Config, spec.Partitions.Persistent)
+		if err != nil {
+			return "", err
+		}
+		cleanup.Push(umount)
+		base = spec.Partitions.Persistent.MountPoint
+	}
+
+	// The unpacked tree is at least as large as the tarball
+	var required uint64
+	if info, err := cfg.Fs.Stat(path); err == nil {
+		required = uint64(info.Size())
+	}
+	dir, err := elemental.StagingDir(cfg.Config, base, "upgrade-artifact-", required)
+	if err != nil {
+		return "", err
+	}
+	cleanup.Push(func() error { return utils.SafeRemoveAll(cfg.Logger, cfg.Mounter, cfg.Fs, dir) })
+
+	out, err := cfg.Runner.Run("tar", "--numeric-owner", "--xattrs", "--xattrs-include=*", "--acls", "-xpf", path, "-C", dir)
+	if err != nil {
+		cfg.Logger.Errorf("failed unpacking %s: %s", path, string(out))
+		return "", err
+	}
+	return dir, nil
+}
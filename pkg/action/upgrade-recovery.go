@@ -36,6 +36,7 @@ type UpgradeRecoveryAction struct {
 	cfg                *types.RunConfig
 	spec               *types.UpgradeSpec
 	updateInstallState bool
+	operation          string
 }
 
 type UpgradeRecoveryActionOption func(r *UpgradeRecoveryAction) error
@@ -47,10 +48,19 @@ func WithUpdateInstallState(updateInstallState bool) func(u *UpgradeRecoveryActi
 	}
 }
 
+// WithTransitionOperation sets the operation the recovery transition image is named after,
+// defaults to the upgrade-recovery action
+func WithTransitionOperation(operation string) func(u *UpgradeRecoveryAction) error {
+	return func(u *UpgradeRecoveryAction) error {
+		u.operation = operation
+		return nil
+	}
+}
+
 func NewUpgradeRecoveryAction(config *types.RunConfig, spec *types.UpgradeSpec, opts ...UpgradeRecoveryActionOption) (*UpgradeRecoveryAction, error) {
 	var err error
 
-	u := &UpgradeRecoveryAction{cfg: config, spec: spec}
+	u := &UpgradeRecoveryAction{cfg: config, spec: spec, operation: constants.ActionUpgradeRecovery}
 
 	for _, o := range opts {
 		err = o(u)
@@ -146,6 +156,9 @@ func (u *UpgradeRecoveryAction) upgradeInstallStateYaml() error {
 }
 
 func (u *UpgradeRecoveryAction) Run() (err error) {
+	notifier := newNotifiers(newWebhook(u.cfg, "upgrade-recovery"), newMetricsNotifier(u.cfg, "upgrade-recovery"))
+	defer func() { notifier.notify(err) }()
+
 	cleanup := utils.NewCleanStack()
 	defer func() {
 		err = cleanup.Cleanup(err)
@@ -157,17 +170,23 @@ func (u *UpgradeRecoveryAction) Run() (err error) {
 		return err
 	}
 
-	// Remove any traces of previously errored upgrades
-	transitionDir := filepath.Join(u.spec.Partitions.Recovery.MountPoint, constants.BootTransitionPath)
+	// Remove any traces of previously errored upgrades of the same operation
+	transitionDir := filepath.Join(u.spec.Partitions.Recovery.MountPoint, constants.TransitionPath(u.operation))
+	legacyImg := filepath.Join(u.spec.Partitions.Recovery.MountPoint, constants.BootTransitionPath, constants.RecoveryImgFile)
 	u.Debugf("removing any orphaned recovery system %s", transitionDir)
-	err = utils.RemoveAll(u.cfg.Fs, transitionDir)
-	if err != nil {
-		u.Errorf("failed removing orphaned recovery image: %s", err.Error())
-		return err
+	for _, orphan := range []string{transitionDir, legacyImg} {
+		err = utils.SafeRemoveAll(u.cfg.Logger, u.cfg.Mounter, u.cfg.Fs, orphan)
+		if err != nil {
+			u.Errorf("failed removing orphaned recovery image: %s", err.Error())
+			return err
+		}
 	}
 
-	// Deploy recovery system to transition dir
-	err = elemental.DeployRecoverySystem(u.cfg.Config, &u.spec.RecoverySystem)
+	// Deploy recovery system to the transition dir of this operation
+	recoverySystem := u.spec.RecoverySystem
+	recoverySystem.File = filepath.Join(transitionDir, constants.RecoveryImgFile)
+	recoverySystem.MountPoint = constants.TransitionMountPoint(u.operation)
+	err = elemental.DeployRecoverySystem(u.cfg.ForArtifact(constants.RecoveryArtifact), &recoverySystem)
 	if err != nil {
 		u.cfg.Logger.Errorf("failed deploying recovery image: %s", err.Error())
 		return elementalError.NewFromError(err, elementalError.DeployImage)
@@ -178,7 +197,7 @@ func (u *UpgradeRecoveryAction) Run() (err error) {
 	oldBootDir := filepath.Join(u.spec.Partitions.Recovery.MountPoint, constants.OldBootPath)
 
 	// If a previous upgrade failed, remove old boot-dir
-	err = utils.RemoveAll(u.cfg.Fs, oldBootDir)
+	err = utils.SafeRemoveAll(u.cfg.Logger, u.cfg.Mounter, u.cfg.Fs, oldBootDir)
 	if err != nil {
 		u.Errorf("failed removing orphaned recovery image: %s", err.Error())
 		return err
@@ -210,7 +229,7 @@ func (u *UpgradeRecoveryAction) Run() (err error) {
 	}
 
 	// Remove old boot-dir when new recovery system is in place
-	err = utils.RemoveAll(u.cfg.Fs, oldBootDir)
+	err = utils.SafeRemoveAll(u.cfg.Logger, u.cfg.Mounter, u.cfg.Fs, oldBootDir)
 	if err != nil {
 		u.Warnf("failed removing old recovery image: %s", err.Error())
 	}
@@ -233,5 +252,6 @@ func (u *UpgradeRecoveryAction) Run() (err error) {
 		return elementalError.NewFromError(err, elementalError.Cleanup)
 	}
 
+	notifier.notify(nil)
 	return PowerAction(u.cfg)
 }
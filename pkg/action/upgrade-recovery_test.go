@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"fmt"
 	"path/filepath"
+	"strings"
 
 	"github.com/jaypipes/ghw/pkg/block"
 	. "github.com/onsi/ginkgo/v2"
@@ -214,6 +215,24 @@ var _ = Describe("Upgrade Recovery Actions", func() {
 				Expect(spec.State.Partitions["recovery"].RecoveryImage.FromAction).To(Equal(constants.ActionUpgradeRecovery))
 				Expect(spec.State.Partitions["recovery"].RecoveryImage.Labels["foo"]).To(Equal("bar"))
 			})
+			It("Keeps the transitions of other operations", Label("transition"), func() {
+				spec := PrepareTestRecoveryImage(config, constants.LiveDir, fs, runner)
+				otherTransition := filepath.Join(constants.LiveDir, constants.TransitionPath(constants.ActionUpgrade), constants.RecoveryImgFile)
+				Expect(utils.MkdirAll(fs, filepath.Dir(otherTransition), constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(otherTransition, []byte("upgrade"), constants.FilePerm)).To(Succeed())
+
+				Expect(filepath.Dir(spec.RecoverySystem.File)).To(Equal(
+					filepath.Join(constants.LiveDir, constants.TransitionPath(constants.ActionUpgradeRecovery)),
+				))
+				upgradeRecovery, err = action.NewUpgradeRecoveryAction(config, spec, action.WithUpdateInstallState(true))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(upgradeRecovery.Run()).To(Succeed())
+
+				Expect(runner.IncludesCmds([][]string{{"mksquashfs", "/some/dir", spec.RecoverySystem.File}})).To(Succeed())
+				data, err := fs.ReadFile(otherTransition)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(data)).To(Equal("upgrade"))
+			})
 			It("Successfully skips updateInstallState", Label("docker"), func() {
 				recoveryImgPath := filepath.Join(constants.LiveDir, constants.BootPath, constants.RecoveryImgFile)
 				spec := PrepareTestRecoveryImage(config, constants.LiveDir, fs, runner)
@@ -293,9 +312,10 @@ func PrepareTestRecoveryImage(config *types.RunConfig, recoveryPath string, fs v
 	spec.SnapshotLabels = map[string]string{"foo": "bar"}
 
 	runner.SideEffect = func(command string, args ...string) ([]byte, error) {
-		if command == "mksquashfs" && args[1] == spec.RecoverySystem.File {
-			// create the transition img for squash to fake it
-			_, err = fs.Create(spec.RecoverySystem.File)
+		transitions := filepath.Join(recoveryPath, constants.BootTransitionPath)
+		if command == "mksquashfs" && strings.HasPrefix(args[1], transitions) {
+			// create the transition img for squash to fake it, each operation has its own
+			_, err = fs.Create(args[1])
 			Expect(err).To(Succeed())
 		}
 		return []byte{}, nil
@@ -17,11 +17,17 @@ limitations under the License.
 package action
 
 import (
+	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
 	"slices"
+	"strings"
 	"time"
 
+	"gopkg.in/yaml.v3"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/atomicfile"
 	"github.com/rancher/elemental-toolkit/v2/pkg/bootloader"
 	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
 	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
@@ -31,6 +37,22 @@ import (
 	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
 )
 
+const stagedRootDir = "root"
+
+// stagedUpgrade is the record of a verified upgrade deployed in a snapshot which is not active yet
+type stagedUpgrade struct {
+	Snapshot          int `yaml:"snapshot"`
+	types.SystemState `yaml:",inline"`
+}
+
+// verifyFailure is the record stored along with each quarantined upgrade tree
+type verifyFailure struct {
+	Date   string `yaml:"date"`
+	Source string `yaml:"source"`
+	Digest string `yaml:"digest,omitempty"`
+	Error  string `yaml:"error"`
+}
+
 // UpgradeAction represents the struct that will run the upgrade from start to finish
 type UpgradeAction struct {
 	cfg         *types.RunConfig
@@ -38,6 +60,24 @@ type UpgradeAction struct {
 	bootloader  types.Bootloader
 	snapshotter types.Snapshotter
 	snapshot    *types.Snapshot
+	timer       *utils.PhaseTimer
+	history     types.UpgradeRecord
+	// recovery partition to create before upgrading the recovery image
+	newRecovery *types.Partition
+}
+
+// stagedBootloader is implemented by bootloaders whose boot files are only swapped in
+// once the upgrade transaction is closed, as there is no fallback boot entry
+type stagedBootloader interface {
+	Stage(rootDir, bootDir string) error
+	Commit() error
+	Discard()
+}
+
+// stagingSnapshotter is implemented by snapshotters able to close a transaction without
+// activating the resulting snapshot, which is required to stage upgrades
+type stagingSnapshotter interface {
+	StageTransaction(snapshot *types.Snapshot) error
 }
 
 type UpgradeActionOption func(r *UpgradeAction) error
@@ -52,7 +92,7 @@ func WithUpgradeBootloader(bootloader types.Bootloader) func(u *UpgradeAction) e
 func NewUpgradeAction(config *types.RunConfig, spec *types.UpgradeSpec, opts ...UpgradeActionOption) (*UpgradeAction, error) {
 	var err error
 
-	u := &UpgradeAction{cfg: config, spec: spec}
+	u := &UpgradeAction{cfg: config, spec: spec, timer: utils.NewPhaseTimer(config.Logger)}
 
 	for _, o := range opts {
 		err = o(u)
@@ -62,16 +102,27 @@ func NewUpgradeAction(config *types.RunConfig, spec *types.UpgradeSpec, opts ...
 		}
 	}
 
-	if u.bootloader == nil {
-		u.bootloader = bootloader.NewGrub(&config.Config, bootloader.WithGrubDisableBootEntry(true))
-	}
-
 	// Reuse the snapshotter of the previous setup if there is an inconsistency
 	if spec.State != nil && spec.State.Snapshotter.Type != config.Snapshotter.Type {
 		config.Logger.Warning("can't change snaphsotter type on upgrades, not supported. Using the setup from previous install")
 		config.Snapshotter = spec.State.Snapshotter
 	}
 
+	if u.bootloader == nil && config.Bootloader == constants.BootloaderNone {
+		u.bootloader = bootloader.NewNone(&config.Config, bootloader.NewGrubTemplateData(
+			spec.GetGrubLabels(), spec.GrubDefEntry, config.Snapshotter.Type,
+		))
+	}
+
+	if u.bootloader == nil {
+		u.bootloader = bootloader.NewGrub(&config.Config,
+			bootloader.WithGrubDisableBootEntry(true),
+			bootloader.WithGrubTemplateData(bootloader.NewGrubTemplateData(
+				spec.GetGrubLabels(), spec.GrubDefEntry, config.Snapshotter.Type,
+			)),
+		)
+	}
+
 	if u.snapshotter == nil {
 		u.snapshotter, err = snapshotter.NewSnapshotter(config.Config, config.Snapshotter, u.bootloader)
 		if err != nil {
@@ -104,6 +155,7 @@ func (u UpgradeAction) Error(s string, args ...interface{}) {
 // it appends defined cloud init paths rooted to the deployed root. This way any
 // 'after-upgrade' hook provided by the deployed system image is also taken into account.
 func (u UpgradeAction) upgradeHook(hook string) error {
+	defer u.timer.Track("hook " + hook)()
 	cIPaths := u.cfg.CloudInitPaths
 	if hook == constants.AfterUpgradeHook {
 		cIPaths = append(cIPaths, utils.PreAppendRoot(constants.WorkingImgDir, u.cfg.CloudInitPaths...)...)
@@ -112,6 +164,7 @@ func (u UpgradeAction) upgradeHook(hook string) error {
 }
 
 func (u UpgradeAction) upgradeChrootHook(hook string, root string) error {
+	defer u.timer.Track("hook " + hook)()
 	mountPoints := map[string]string{}
 
 	oemDevice := u.spec.Partitions.OEM
@@ -136,8 +189,8 @@ func (u *UpgradeAction) upgradeInstallStateYaml() error {
 	var oldActiveID int
 	var deletedIDs []int
 
-	if u.spec.Partitions.Recovery == nil || u.spec.Partitions.State == nil {
-		return fmt.Errorf("undefined state or recovery partition")
+	if u.spec.Partitions.State == nil {
+		return fmt.Errorf("undefined state partition")
 	}
 
 	snapshots, err := u.snapshotter.GetSnapshots()
@@ -154,6 +207,7 @@ func (u *UpgradeAction) upgradeInstallStateYaml() error {
 
 	u.spec.State.Snapshotter = u.cfg.Snapshotter
 	u.spec.State.Date = time.Now().Format(time.RFC3339)
+	u.spec.State.Timings = u.timer.Timings()
 
 	statePart := u.spec.State.Partitions[constants.StatePartName]
 	if statePart == nil {
@@ -179,10 +233,12 @@ func (u *UpgradeAction) upgradeInstallStateYaml() error {
 	statePart.Snapshots[u.snapshot.ID] = &types.SystemState{
 		Source:     u.spec.System,
 		Digest:     u.spec.System.GetDigest(),
+		Version:    u.history.ToVersion,
 		Active:     true,
 		Labels:     u.spec.SnapshotLabels,
 		Date:       u.spec.State.Date,
 		FromAction: constants.ActionUpgrade,
+		Deployed:   deployedFiles(u.cfg),
 	}
 
 	if statePart.Snapshots[oldActiveID] != nil {
@@ -218,13 +274,30 @@ func (u *UpgradeAction) upgradeInstallStateYaml() error {
 		}
 	}
 
+	var recoveryStateFile string
+	if u.spec.Partitions.Recovery != nil {
+		recoveryStateFile = filepath.Join(u.spec.Partitions.Recovery.MountPoint, constants.InstallStateFile)
+	}
 	return u.cfg.WriteInstallState(
 		u.spec.State, filepath.Join(u.spec.Partitions.State.MountPoint, constants.InstallStateFile),
-		filepath.Join(u.spec.Partitions.Recovery.MountPoint, constants.InstallStateFile),
+		recoveryStateFile,
 	)
 }
 
 func (u *UpgradeAction) mountRWPartitions(cleanup *utils.CleanStack) error {
+	// The upgrade history and the boot attempts counter are stored in the OEM partition,
+	// it is mounted first so failures mounting other partitions are recorded too
+	if u.spec.Partitions.OEM != nil {
+		if u.spec.Partitions.OEM.MountPoint == "" {
+			u.spec.Partitions.OEM.MountPoint = constants.OEMPath
+		}
+		umount, err := elemental.MountRWPartition(u.cfg.Config, u.spec.Partitions.OEM)
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.MountPartitions)
+		}
+		cleanup.Push(umount)
+	}
+
 	umount, err := elemental.MountRWPartition(u.cfg.Config, u.spec.Partitions.Boot)
 	if err != nil {
 		return elementalError.NewFromError(err, elementalError.MountBootPartition)
@@ -232,11 +305,13 @@ func (u *UpgradeAction) mountRWPartitions(cleanup *utils.CleanStack) error {
 	cleanup.Push(umount)
 
 	if !elemental.IsRecoveryMode(u.cfg.Config) {
-		umount, err = elemental.MountRWPartition(u.cfg.Config, u.spec.Partitions.Recovery)
-		if err != nil {
-			return elementalError.NewFromError(err, elementalError.MountRecoveryPartition)
+		if u.spec.Partitions.Recovery != nil {
+			umount, err = elemental.MountRWPartition(u.cfg.Config, u.spec.Partitions.Recovery)
+			if err != nil {
+				return elementalError.NewFromError(err, elementalError.MountRecoveryPartition)
+			}
+			cleanup.Push(umount)
 		}
-		cleanup.Push(umount)
 	} else {
 		umount, err = elemental.MountRWPartition(u.cfg.Config, u.spec.Partitions.State)
 		if err != nil {
@@ -256,18 +331,218 @@ func (u *UpgradeAction) mountRWPartitions(cleanup *utils.CleanStack) error {
 	return nil
 }
 
+// checkRecoveryPartition handles a missing recovery partition, as found on some minimal
+// installations. If configured to, the free space for it is checked here and the partition
+// is created by createRecoveryPartition once the upgraded system is committed, otherwise the
+// recovery upgrade is skipped.
+func (u *UpgradeAction) checkRecoveryPartition() error {
+	if u.spec.Partitions.Recovery != nil || elemental.IsRecoveryMode(u.cfg.Config) {
+		return nil
+	}
+	if !u.spec.CreateRecoveryIfMissing {
+		if u.spec.RecoveryUpgrade {
+			u.cfg.Logger.Warnf("Recovery partition not found, skipping the recovery upgrade")
+			u.spec.RecoveryUpgrade = false
+		} else {
+			u.Info("Recovery partition not found, not creating it")
+		}
+		return nil
+	}
+	if u.spec.VerifyOnly {
+		u.Info("Recovery partition not found, it will be created once the staged upgrade is applied")
+		return nil
+	}
+
+	u.newRecovery = &types.Partition{
+		FilesystemLabel: constants.RecoveryLabel,
+		Size:            constants.RecoverySize,
+		Name:            constants.RecoveryPartName,
+		FS:              constants.LinuxFs,
+		MountPoint:      constants.RecoveryDir,
+		Disk:            u.spec.Partitions.State.Disk,
+	}
+	u.Info("Recovery partition not found, it will be created on %s", u.newRecovery.Disk)
+	err := elemental.CheckPartitionSpace(u.cfg.Config, u.newRecovery.Disk, u.newRecovery)
+	if err != nil {
+		u.Error("cannot create the recovery partition: %v", err)
+		return err
+	}
+
+	// The new recovery partition is empty, the recovery image is always deployed
+	u.spec.RecoveryUpgrade = true
+	return nil
+}
+
+// createRecoveryPartition creates the recovery partition found missing by checkRecoveryPartition
+// and mounts it RW. The partition is removed again if the upgrade fails afterwards, so an empty
+// recovery partition is never left behind.
+func (u *UpgradeAction) createRecoveryPartition(cleanup *utils.CleanStack) error {
+	part := u.newRecovery
+	u.Info("Creating the recovery partition on %s", part.Disk)
+	err := elemental.AddPartition(u.cfg.Config, part.Disk, part)
+	if err != nil {
+		u.Error("failed creating recovery partition: %v", err)
+		return err
+	}
+	cleanup.PushErrorOnly(func() error {
+		u.spec.Partitions.Recovery = nil
+		return elemental.RemovePartition(u.cfg.Config, part.Disk, part)
+	})
+	u.spec.Partitions.Recovery = part
+
+	umount, err := elemental.MountRWPartition(u.cfg.Config, part)
+	if err != nil {
+		return err
+	}
+	cleanup.Push(umount)
+	return nil
+}
+
+// checkPersistentSpace verifies the persistent partition has enough free space to run the
+// upgrade, that is the estimated size of the upgraded system plus some room for runtime writes.
+// If not enough free space is found the configured cache paths are pruned, if allowed.
+func (u *UpgradeAction) checkPersistentSpace() error {
+	persistent := u.spec.Partitions.Persistent
+	if persistent == nil || persistent.MountPoint == "" {
+		return nil
+	}
+
+	// Upgrades kept on verification failures and the backup of the active system take about the size of the system
+	required := constants.PersistentUpgradeMinFreeMiB + u.estimateSystemSize()
+
+	free, err := utils.FreeSpaceMB(u.cfg.Runner, persistent.MountPoint)
+	if err != nil {
+		return err
+	}
+	if free >= required {
+		return nil
+	}
+
+	if !u.cfg.PrunePersistentOnUpgrade {
+		return fmt.Errorf(
+			"persistent partition has %dMiB free, %dMiB are required to upgrade. Free some space or set prune-persistent-on-upgrade",
+			free, required,
+		)
+	}
+
+	for _, path := range u.cfg.PersistentCachePaths {
+		u.Info("Pruning persistent cache path %s", path)
+		err = u.pruneDir(filepath.Join(persistent.MountPoint, path))
+		if err != nil {
+			return fmt.Errorf("failed pruning persistent cache path '%s': %w", path, err)
+		}
+	}
+
+	free, err = utils.FreeSpaceMB(u.cfg.Runner, persistent.MountPoint)
+	if err != nil {
+		return err
+	}
+	if free < required {
+		return fmt.Errorf("persistent partition has %dMiB free after pruning cache paths, %dMiB are required to upgrade", free, required)
+	}
+	return nil
+}
+
+// pruneDir removes the contents of the given directory, the directory itself is kept
+func (u *UpgradeAction) pruneDir(dir string) error {
+	entries, err := u.cfg.Fs.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err = utils.SafeRemoveAll(u.cfg.Logger, u.cfg.Mounter, u.cfg.Fs, filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// estimateSystemSize returns the expected size in MiB of the upgraded system based on the
+// configured image size or on the size of the active system.
+func (u *UpgradeAction) estimateSystemSize() uint {
+	if loopCfg, ok := u.cfg.Snapshotter.Config.(*types.LoopDeviceConfig); ok && loopCfg.Size > 0 {
+		return loopCfg.Size
+	}
+	if u.spec.State == nil || u.spec.State.Partitions[constants.StatePartName] == nil {
+		return 0
+	}
+	for id, snap := range u.spec.State.Partitions[constants.StatePartName].Snapshots {
+		if !snap.Active {
+			continue
+		}
+		path, err := snapshotter.SnapshotPath(u.cfg.Snapshotter, u.spec.Partitions.State.MountPoint, id)
+		if err != nil {
+			break
+		}
+		size, err := utils.DirSizeMB(u.cfg.Fs, path)
+		if err != nil {
+			u.Debug("could not compute the size of the active system: %v", err)
+			break
+		}
+		return size
+	}
+	return 0
+}
+
 func (u *UpgradeAction) Run() (err error) {
+	metrics := newMetricsNotifier(u.cfg, "upgrade")
+	metrics.timer = u.timer
+	notifier := newNotifiers(newWebhook(u.cfg, "upgrade"), metrics)
+	defer func() { notifier.notify(err) }()
+
 	cleanup := utils.NewCleanStack()
+	recorded := false
 	defer func() {
+		// Staged upgrades are not applied, thus not recorded
+		if err != nil && !recorded && !u.spec.VerifyOnly {
+			u.recordHistory(constants.UpgradeFailed)
+		}
 		err = cleanup.Cleanup(err)
 	}()
 
+	u.history = types.UpgradeRecord{
+		From:        u.activeSource(),
+		FromVersion: u.activeVersion(),
+	}
+	metrics.osVersion = u.history.FromVersion
+
+	err = u.checkRecoveryPartition()
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.CreateRecoveryPartition)
+	}
+
 	// Mount required partitions as RW
 	err = u.mountRWPartitions(cleanup)
 	if err != nil {
 		return err
 	}
 
+	err = u.checkPersistentSpace()
+	if err != nil {
+		u.Error("persistent partition preflight failed: %v", err)
+		return elementalError.NewFromError(err, elementalError.PersistentSpace)
+	}
+
+	var staged *stagedUpgrade
+	if u.spec.ResumeUpgrade {
+		staged, err = u.loadStagedUpgrade()
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.ResumeUpgrade)
+		}
+		u.Info("Resuming staged upgrade of %s", staged.Source.String())
+	}
+	if _, ok := u.snapshotter.(stagingSnapshotter); (u.spec.VerifyOnly || staged != nil) && !ok {
+		err = fmt.Errorf("staged upgrades are not supported by the %s snapshotter", u.cfg.Snapshotter.Type)
+		u.Error(err.Error())
+		if staged != nil {
+			return elementalError.NewFromError(err, elementalError.ResumeUpgrade)
+		}
+		return elementalError.NewFromError(err, elementalError.VerifyUpgrade)
+	}
+
 	// Init snapshotter
 	err = u.snapshotter.InitSnapshotter(u.spec.Partitions.State, u.spec.Partitions.Boot.MountPoint)
 	if err != nil {
@@ -275,6 +550,95 @@ func (u *UpgradeAction) Run() (err error) {
 		return elementalError.NewFromError(err, elementalError.SnapshotterInit)
 	}
 
+	if staged != nil {
+		err = u.activateStagedUpgrade(staged)
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.ResumeUpgrade)
+		}
+		cleanup.PushSuccessOnly(func() error { return utils.SafeRemoveAll(u.cfg.Logger, u.cfg.Mounter, u.cfg.Fs, u.stagingDir()) })
+	} else {
+		err = u.deployUpgrade(cleanup)
+		if err != nil {
+			return err
+		}
+		if u.spec.VerifyOnly {
+			return nil
+		}
+	}
+	metrics.osVersion = u.history.ToVersion
+
+	// Upgrade recovery
+	if u.newRecovery != nil {
+		err = u.createRecoveryPartition(cleanup)
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.CreateRecoveryPartition)
+		}
+	}
+	if u.spec.RecoveryUpgrade {
+		recoverySystem := &u.spec.RecoverySystem
+		u.cfg.Logger.Info("Deploying recovery system")
+		if recoverySystem.Source.String() == u.spec.System.String() {
+			// Reuse already deployed root-tree from active snapshot
+			recoverySystem.Source, err = u.snapshotter.SnapshotToImageSource(u.snapshot)
+			if err != nil {
+				return err
+			}
+			recoverySystem.Source.SetDigest(u.spec.System.GetDigest())
+		}
+		upgradeRecoveryAction, err := NewUpgradeRecoveryAction(
+			u.cfg, u.spec, WithUpdateInstallState(false), WithTransitionOperation(constants.ActionUpgrade),
+		)
+		if err != nil {
+			u.Error("Could not initialize Recovery upgrade: %s", err)
+			return elementalError.NewFromError(err, elementalError.UpgradeRecovery)
+		}
+		done := u.timer.Track("deploy recovery")
+		err = upgradeRecoveryAction.Run()
+		done()
+		if err != nil {
+			u.Error("Could not upgrade Recovery: %s", err)
+			return elementalError.NewFromError(err, elementalError.UpgradeRecovery)
+		}
+	}
+
+	err = u.upgradeHook(constants.PostUpgradeHook)
+	if err != nil {
+		u.Error("Error running hook post-upgrade: %s", err)
+		return elementalError.NewFromError(err, elementalError.HookPostUpgrade)
+	}
+
+	// Update state.yaml file on recovery and state partitions
+	err = u.upgradeInstallStateYaml()
+	if err != nil {
+		u.Error("failed upgrading installation metadata")
+		return err
+	}
+	u.recordHistory(constants.UpgradeSucceeded)
+	recorded = true
+
+	u.Info("Upgrade completed")
+
+	// Do not reboot/poweroff on cleanup errors
+	err = cleanup.Cleanup(err)
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.Cleanup)
+	}
+
+	u.timer.Summary()
+	notifier.notify(nil)
+	return PowerAction(u.cfg)
+}
+
+// deployUpgrade deploys the upgrade source into a new snapshot and closes the transaction.
+// Verified upgrades are only staged, the snapshot is not activated nor the bootloader set up.
+func (u *UpgradeAction) deployUpgrade(cleanup *utils.CleanStack) (err error) {
+	if u.spec.VerifyOnly {
+		err = u.dropStagedUpgrade()
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.VerifyUpgrade)
+		}
+	}
+
 	// Before upgrade hook happens once partitions are RW mounted, just before image OS is deployed
 	err = u.upgradeHook(constants.BeforeUpgradeHook)
 	if err != nil {
@@ -290,22 +654,47 @@ func (u *UpgradeAction) Run() (err error) {
 		return elementalError.NewFromError(err, elementalError.SnapshotterStart)
 	}
 	cleanup.PushErrorOnly(func() error { return u.snapshotter.CloseTransactionOnError(u.snapshot) })
+	cleanup.PushErrorOnly(func() error {
+		u.onVerifyFailure(u.snapshot.WorkDir, err)
+		return nil
+	})
 
 	// Deploy system image
+	done := u.timer.Track("deploy system")
 	err = elemental.MirrorRoot(u.cfg.Config, u.snapshot.WorkDir, u.spec.System)
+	done()
 	if err != nil {
 		u.cfg.Logger.Errorf("failed deploying source '%s': %v", u.spec.System.String(), err)
+		if isVerifyFailure(err) {
+			return err
+		}
 		return elementalError.NewFromError(err, elementalError.DumpSource)
 	}
+	u.history.ToVersion = osVersion(u.cfg.Fs, u.snapshot.WorkDir)
+
+	err = u.checkNewerVersion(u.history.ToVersion)
+	if err != nil {
+		return err
+	}
 
 	// Fine tune the dumped tree
 	u.cfg.Logger.Info("Fine tune the dumped root tree")
+	if staged, ok := u.bootloader.(stagedBootloader); ok {
+		cleanup.PushErrorOnly(func() error {
+			staged.Discard()
+			return nil
+		})
+	}
 	err = u.refineDeployment()
 	if err != nil {
 		u.cfg.Logger.Error("failed refining system root tree")
 		return err
 	}
 
+	if u.spec.VerifyOnly {
+		return u.stageUpgrade()
+	}
+
 	// Closing snapshotter transaction
 	u.cfg.Logger.Info("Closing snapshotter transaction")
 	err = u.snapshotter.CloseTransaction(u.snapshot)
@@ -313,66 +702,119 @@ func (u *UpgradeAction) Run() (err error) {
 		u.cfg.Logger.Errorf("failed closing snapshot transaction: %v", err)
 		return err
 	}
-
-	// Upgrade recovery
-	if u.spec.RecoveryUpgrade {
-		recoverySystem := &u.spec.RecoverySystem
-		u.cfg.Logger.Info("Deploying recovery system")
-		if recoverySystem.Source.String() == u.spec.System.String() {
-			// Reuse already deployed root-tree from active snapshot
-			recoverySystem.Source, err = u.snapshotter.SnapshotToImageSource(u.snapshot)
-			if err != nil {
-				return err
-			}
-			recoverySystem.Source.SetDigest(u.spec.System.GetDigest())
-		}
-		upgradeRecoveryAction, err := NewUpgradeRecoveryAction(u.cfg, u.spec, WithUpdateInstallState(false))
+	if staged, ok := u.bootloader.(stagedBootloader); ok {
+		err = staged.Commit()
 		if err != nil {
-			u.Error("Could not initialize Recovery upgrade: %s", err)
-			return elementalError.NewFromError(err, elementalError.UpgradeRecovery)
+			u.cfg.Logger.Errorf("failed installing the kernel and initrd: %v", err)
+			return elementalError.NewFromError(err, elementalError.InstallGrub)
 		}
-		if err := upgradeRecoveryAction.Run(); err != nil {
-			u.Error("Could not upgrade Recovery: %s", err)
-			return elementalError.NewFromError(err, elementalError.UpgradeRecovery)
+	}
+	return nil
+}
+
+// activeSource returns the source of the active snapshot as tracked in the installation state
+func (u *UpgradeAction) activeSource() string {
+	if u.spec.State == nil || u.spec.State.Partitions[constants.StatePartName] == nil {
+		return ""
+	}
+	for _, snap := range u.spec.State.Partitions[constants.StatePartName].Snapshots {
+		if snap.Active && snap.Source != nil {
+			return snap.Source.String()
 		}
 	}
+	return ""
+}
 
-	err = u.upgradeHook(constants.PostUpgradeHook)
-	if err != nil {
-		u.Error("Error running hook post-upgrade: %s", err)
-		return elementalError.NewFromError(err, elementalError.HookPostUpgrade)
+// activeVersion returns the OS version of the active snapshot as recorded in the installation
+// state. For installations not recording it, it is read from the running system only if it is
+// the active snapshot, the recovery or a passive system could be of any other version.
+func (u *UpgradeAction) activeVersion() string {
+	if u.spec.State != nil && u.spec.State.Partitions[constants.StatePartName] != nil {
+		for _, snap := range u.spec.State.Partitions[constants.StatePartName].Snapshots {
+			if snap.Active && snap.Version != "" {
+				return snap.Version
+			}
+		}
+	}
+	if elemental.IsActiveMode(u.cfg.Config) {
+		return osVersion(u.cfg.Fs, "/")
 	}
+	return ""
+}
 
-	// Update state.yaml file on recovery and state partitions
-	err = u.upgradeInstallStateYaml()
+// recordHistory appends the upgrade result to the history file in the OEM partition. Failing to
+// record it is not considered an upgrade failure.
+func (u *UpgradeAction) recordHistory(result string) {
+	if u.spec.Partitions.OEM == nil || u.spec.Partitions.OEM.MountPoint == "" {
+		u.cfg.Logger.Warnf("OEM partition not available, not recording upgrade history")
+		return
+	}
+	record := u.history
+	record.Date = time.Now().Format(time.RFC3339)
+	record.To = u.spec.System.String()
+	record.Digest = u.spec.System.GetDigest()
+	record.Result = result
+	err := u.cfg.AppendUpgradeHistory(
+		filepath.Join(u.spec.Partitions.OEM.MountPoint, constants.UpgradeHistoryFile), record,
+	)
 	if err != nil {
-		u.Error("failed upgrading installation metadata")
-		return err
+		u.cfg.Logger.Warnf("failed recording upgrade history: %v", err)
 	}
+}
 
-	u.Info("Upgrade completed")
-
-	// Do not reboot/poweroff on cleanup errors
-	err = cleanup.Cleanup(err)
+// osVersion returns the OS version of the given root tree as set in its os-release file, if any
+func osVersion(fs types.FS, root string) string {
+	osRelease, err := utils.LoadEnvFile(fs, filepath.Join(root, "etc", "os-release"))
 	if err != nil {
-		return elementalError.NewFromError(err, elementalError.Cleanup)
+		return ""
 	}
-
-	return PowerAction(u.cfg)
+	if version := osRelease["VERSION_ID"]; version != "" {
+		return version
+	}
+	return osRelease["VERSION"]
 }
 
 func (u *UpgradeAction) refineDeployment() error { //nolint:dupl
 	var err error
 
-	// Install grub
-	if u.spec.BootloaderUpgrade {
-		err = u.bootloader.Install(
-			u.snapshot.WorkDir,
-			u.spec.Partitions.Boot.MountPoint,
-		)
+	err = elemental.LinkKernelInitrd(u.cfg.Config, u.snapshot.WorkDir)
+	if err != nil {
+		u.cfg.Logger.Errorf("failed linking kernel and initrd: %v", err)
+		return elementalError.NewFromError(err, elementalError.FindKernelInitrd)
+	}
+	err = elemental.SetDefaultBootTarget(u.cfg.Config, u.snapshot.WorkDir, u.cfg.DefaultBootTarget)
+	if err != nil {
+		u.cfg.Logger.Errorf("failed setting default boot target: %v", err)
+		return elementalError.NewFromError(err, elementalError.BootTarget)
+	}
+
+	if u.spec.VerifyModules {
+		err = elemental.VerifyKernelModules(u.cfg.Config, u.snapshot.WorkDir)
 		if err != nil {
-			u.cfg.Logger.Errorf("failed installing grub: %v", err)
-			return elementalError.NewFromError(err, elementalError.InstallGrub)
+			u.cfg.Logger.Errorf("kernel modules do not match the kernel: %v", err)
+			return elementalError.NewFromError(err, elementalError.VerifyUpgrade)
+		}
+	}
+
+	err = writeImageVersion(u.cfg, u.snapshot.WorkDir, types.SystemState{
+		Source:     u.spec.System,
+		Digest:     u.spec.System.GetDigest(),
+		Version:    u.history.ToVersion,
+		Labels:     u.spec.SnapshotLabels,
+		Date:       time.Now().Format(time.RFC3339),
+		FromAction: constants.ActionUpgrade,
+		Deployed:   deployedFiles(u.cfg),
+	})
+	if err != nil {
+		u.cfg.Logger.Errorf("failed writing image version file: %v", err)
+		return elementalError.NewFromError(err, elementalError.CreateFile)
+	}
+
+	// Install grub, staged upgrades set it up once they are resumed
+	if !u.spec.VerifyOnly {
+		err = u.installBootloader(u.snapshot.WorkDir)
+		if err != nil {
+			return err
 		}
 	}
 
@@ -387,6 +829,53 @@ func (u *UpgradeAction) refineDeployment() error { //nolint:dupl
 		return elementalError.NewFromError(err, elementalError.HookAfterUpgrade)
 	}
 
+	err = u.preSwapVerify(u.snapshot.WorkDir)
+	if err != nil {
+		return err
+	}
+
+	if u.spec.VerifyOnly {
+		return nil
+	}
+	return u.setBootloaderVars(constants.WorkingImgDir)
+}
+
+// installBootloader installs the bootloader, or just its configuration, from the given root tree
+func (u *UpgradeAction) installBootloader(root string) (err error) {
+	if staged, ok := u.bootloader.(stagedBootloader); ok {
+		// Without a bootloader the kernel and initrd of the new image are copied
+		// and only replace the current ones once the transaction is closed
+		err = staged.Stage(root, u.spec.Partitions.Boot.MountPoint)
+		if err != nil {
+			u.cfg.Logger.Errorf("failed staging the kernel and initrd: %v", err)
+			return elementalError.NewFromError(err, elementalError.InstallGrub)
+		}
+	} else if u.spec.BootloaderUpgrade {
+		done := u.timer.Track("bootloader")
+		err = u.bootloader.Install(
+			root,
+			u.spec.Partitions.Boot.MountPoint,
+		)
+		done()
+		if err != nil {
+			u.cfg.Logger.Errorf("failed installing grub: %v", err)
+			return elementalError.NewFromError(err, elementalError.InstallGrub)
+		}
+	} else if u.cfg.GrubTemplate != "" {
+		// A custom grub config is rendered on every upgrade, labels may have changed
+		err = u.bootloader.InstallConfig(root, u.spec.Partitions.Boot.MountPoint)
+		if err != nil {
+			u.cfg.Logger.Errorf("failed installing grub config: %v", err)
+			return elementalError.NewFromError(err, elementalError.InstallGrub)
+		}
+	}
+
+	return nil
+}
+
+// setBootloaderVars sets the grub labels, the default entry and the boot attempts counter,
+// the default entry is based on the given root tree
+func (u *UpgradeAction) setBootloaderVars(root string) (err error) {
 	grubVars := u.spec.GetGrubLabels()
 	err = u.bootloader.SetPersistentVariables(
 		filepath.Join(u.spec.Partitions.Boot.MountPoint, constants.GrubOEMEnv),
@@ -397,11 +886,329 @@ func (u *UpgradeAction) refineDeployment() error { //nolint:dupl
 		return elementalError.NewFromError(err, elementalError.SetGrubVariables)
 	}
 
-	err = u.bootloader.SetDefaultEntry(u.spec.Partitions.Boot.MountPoint, constants.WorkingImgDir, u.spec.GrubDefEntry)
+	err = u.bootloader.SetDefaultEntry(u.spec.Partitions.Boot.MountPoint, root, u.spec.GrubDefEntry)
 	if err != nil {
 		u.Error("failed setting default entry")
 		return elementalError.NewFromError(err, elementalError.SetDefaultGrubEntry)
 	}
 
+	if u.spec.BootAttempts > 0 && u.spec.Partitions.OEM != nil {
+		err = setBootAttempts(u.bootloader, u.spec.Partitions.OEM.MountPoint, u.spec.BootAttempts)
+		if err != nil {
+			u.Error("failed setting boot attempts counter: %v", err)
+			return elementalError.NewFromError(err, elementalError.SetGrubVariables)
+		}
+	}
+
+	return nil
+}
+
+// checkNewerVersion fails if the only-upgrade-if-newer gate is set and the given target
+// version is not strictly newer than the active one, unless downgrades are allowed
+func (u *UpgradeAction) checkNewerVersion(target string) error {
+	if !u.spec.OnlyIfNewer || u.spec.AllowDowngrade {
+		return nil
+	}
+	current := u.history.FromVersion
+	if current == "" {
+		err := fmt.Errorf("the version of the active system is unknown")
+		u.Error("%s, set 'allow-downgrade' to upgrade to %s anyway", err.Error(), target)
+		return elementalError.NewFromError(err, elementalError.Downgrade)
+	}
+	cmp, err := utils.CompareVersions(target, current)
+	if err != nil {
+		u.Error("could not compare the upgrade version '%s' with the active version '%s': %v", target, current, err)
+		return elementalError.NewFromError(err, elementalError.Downgrade)
+	}
+	if cmp <= 0 {
+		err = fmt.Errorf("upgrade version %s is not newer than the active version %s", target, current)
+		u.Error("%s, set 'allow-downgrade' to apply it anyway", err.Error())
+		return elementalError.NewFromError(err, elementalError.Downgrade)
+	}
+	u.Info("Upgrading from version %s to %s", current, target)
+	return nil
+}
+
+// preSwapVerify runs the configured pre-swap verification command, if any, with the given
+// transition tree set in its environment. A failure aborts the upgrade before the swap.
+func (u *UpgradeAction) preSwapVerify(root string) error {
+	if len(u.spec.PreSwapVerifyCmd) == 0 {
+		return nil
+	}
+	u.Info("Running pre-swap verification command '%s'", strings.Join(u.spec.PreSwapVerifyCmd, " "))
+	args := append([]string{fmt.Sprintf("%s=%s", constants.TransitionMountPointEnv, root)}, u.spec.PreSwapVerifyCmd...)
+	out, err := u.cfg.Runner.Run("env", args...)
+	if err != nil {
+		u.Error("pre-swap verification failed: %s", strings.TrimSpace(string(out)))
+		return elementalError.NewFromError(fmt.Errorf("pre-swap verification command failed: %w", err), elementalError.VerifyUpgrade)
+	}
+	u.Debug("pre-swap verification output: %s", string(out))
+	return nil
+}
+
+// isVerifyFailure returns true if the given error is a failed verification of the upgrade,
+// that is of the source signature, of the upgraded tree or of its transition image
+func isVerifyFailure(err error) bool {
+	var elErr *elementalError.ElementalError
+	if !errors.As(err, &elErr) {
+		return false
+	}
+	switch elErr.ExitCode() {
+	case elementalError.VerifyUpgrade, elementalError.CosignVerify, elementalError.VerifyImage:
+		return true
+	}
+	return false
+}
+
+// onVerifyFailure applies the configured verification failure policy to the given upgrade
+// tree, or to the transition image if that is what failed, before it is discarded. The
+// artifact is either kept in the persistent partition, replacing the one kept by a previous
+// failure, or quarantined along with the failure details. Failing to preserve the artifact
+// is only logged, the upgrade fails anyway.
+func (u *UpgradeAction) onVerifyFailure(tree string, failure error) {
+	if !isVerifyFailure(failure) {
+		return
+	}
+
+	var target string
+	switch u.cfg.OnVerifyFailure {
+	case constants.VerifyKeep:
+		target = constants.FailedUpgradeDir
+	case constants.VerifyQuarantine:
+		target = filepath.Join(constants.QuarantineDir, time.Now().UTC().Format("20060102T150405Z"))
+	default:
+		return
+	}
+	if u.spec.Partitions.Persistent == nil || u.spec.Partitions.Persistent.MountPoint == "" {
+		u.cfg.Logger.Warnf("persistent partition not available, the failed upgrade is not preserved")
+		return
+	}
+	target = filepath.Join(u.spec.Partitions.Persistent.MountPoint, target)
+
+	artifact, dst := tree, stagedRootDir
+	var elErr *elementalError.ElementalError
+	if errors.As(failure, &elErr) && elErr.ExitCode() == elementalError.VerifyImage && u.snapshot != nil {
+		artifact, dst = u.snapshot.Path, filepath.Base(u.snapshot.Path)
+	}
+
+	err := u.preserveArtifact(artifact, target, dst, failure)
+	if err != nil {
+		u.cfg.Logger.Warnf("failed preserving the failed upgrade at %s: %v", target, err)
+		return
+	}
+	u.Info("Upgrade failing verification preserved at %s", target)
+}
+
+// preserveArtifact moves the given upgrade tree or image to dst within the target path.
+// A record of the failure is stored next to quarantined artifacts, which is all that is
+// kept if there is no artifact, e.g. if the source signature verification failed.
+func (u *UpgradeAction) preserveArtifact(artifact, target, dst string, failure error) error {
+	err := utils.SafeRemoveAll(u.cfg.Logger, u.cfg.Mounter, u.cfg.Fs, target)
+	if err != nil {
+		return err
+	}
+	err = utils.MkdirAll(u.cfg.Fs, target, constants.DirPerm)
+	if err != nil {
+		return err
+	}
+	if ok, _ := utils.Exists(u.cfg.Fs, artifact); ok {
+		err = u.moveArtifact(artifact, filepath.Join(target, dst))
+		if err != nil {
+			return err
+		}
+	}
+	if u.cfg.OnVerifyFailure != constants.VerifyQuarantine {
+		return nil
+	}
+	data, err := yaml.Marshal(verifyFailure{
+		Date:   time.Now().Format(time.RFC3339),
+		Source: u.spec.System.String(),
+		Digest: u.spec.System.GetDigest(),
+		Error:  failure.Error(),
+	})
+	if err != nil {
+		return err
+	}
+	return u.cfg.Fs.WriteFile(filepath.Join(target, constants.QuarantineRecordFile), data, constants.FilePerm)
+}
+
+// moveArtifact moves the given file or directory to dst. Upgrades are usually deployed in the
+// state partition, which is another filesystem than the persistent partition, or in a mount
+// point, so they can't be renamed. In such a case the artifact is copied and the source is
+// discarded along with the failed transaction.
+func (u *UpgradeAction) moveArtifact(src, dst string) error {
+	err := u.cfg.Fs.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	u.cfg.Logger.Debugf("could not rename %s to %s, copying it: %v", src, dst, err)
+
+	if ok, _ := utils.IsDir(u.cfg.Fs, src); !ok {
+		return utils.CopyFile(u.cfg.Fs, src, dst)
+	}
+	err = utils.MkdirAll(u.cfg.Fs, dst, constants.DirPerm)
+	if err != nil {
+		return err
+	}
+	return utils.SyncData(u.cfg.Logger, u.cfg.Runner, u.cfg.Fs, src, dst)
+}
+
+// stagingDir returns the path where verified upgrades are staged
+func (u *UpgradeAction) stagingDir() string {
+	return filepath.Join(u.spec.Partitions.Persistent.MountPoint, constants.UpgradeStagingDir)
+}
+
+// stageUpgrade closes the transaction of the verified upgrade without activating the new
+// snapshot, which is recorded in the staging directory. Resuming the upgrade later on only
+// activates the snapshot, the source is not deployed again.
+func (u *UpgradeAction) stageUpgrade() error {
+	_, _, err := elemental.FindKernelInitrd(u.cfg.Config, u.snapshot.WorkDir)
+	if err != nil {
+		u.Error("staged system is not bootable: %v", err)
+		return elementalError.NewFromError(err, elementalError.VerifyUpgrade)
+	}
+
+	if loopCfg, ok := u.cfg.Snapshotter.Config.(*types.LoopDeviceConfig); ok && loopCfg.Size > 0 {
+		size, err := utils.DirSizeMB(u.cfg.Fs, u.snapshot.WorkDir)
+		if err != nil {
+			u.Error("failed computing staged system size: %v", err)
+			return elementalError.NewFromError(err, elementalError.VerifyUpgrade)
+		}
+		if size > loopCfg.Size {
+			err = fmt.Errorf("staged system requires %dMiB, it does not fit in a %dMiB image", size, loopCfg.Size)
+			u.Error(err.Error())
+			return elementalError.NewFromError(err, elementalError.VerifyUpgrade)
+		}
+	}
+
+	u.cfg.Logger.Info("Staging snapshotter transaction")
+	err = u.snapshotter.(stagingSnapshotter).StageTransaction(u.snapshot)
+	if err != nil {
+		u.cfg.Logger.Errorf("failed staging snapshot transaction: %v", err)
+		return err
+	}
+
+	staged := &stagedUpgrade{
+		Snapshot: u.snapshot.ID,
+		SystemState: types.SystemState{
+			Source:  u.spec.System,
+			Digest:  u.spec.System.GetDigest(),
+			Version: u.history.ToVersion,
+			Date:    time.Now().Format(time.RFC3339),
+		},
+	}
+	data, err := yaml.Marshal(staged)
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.VerifyUpgrade)
+	}
+	err = utils.MkdirAll(u.cfg.Fs, u.stagingDir(), constants.DirPerm)
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.CreateDir)
+	}
+	err = atomicfile.WriteFile(u.cfg.Fs, filepath.Join(u.stagingDir(), constants.UpgradeStagingFile), data, constants.FilePerm)
+	if err != nil {
+		u.Error("failed writing staged upgrade data: %v", err)
+		return elementalError.NewFromError(err, elementalError.CreateFile)
+	}
+
+	u.Info("Upgrade verified and staged in snapshot %d, it can be applied with the 'resume' option", u.snapshot.ID)
+	return nil
+}
+
+// dropStagedUpgrade deletes the snapshot of a previously staged upgrade, if any, so it is
+// replaced by the one being staged
+func (u *UpgradeAction) dropStagedUpgrade() error {
+	data, err := u.cfg.Fs.ReadFile(filepath.Join(u.stagingDir(), constants.UpgradeStagingFile))
+	if err != nil {
+		return nil
+	}
+	staged := &stagedUpgrade{}
+	if yaml.Unmarshal(data, staged) == nil && staged.Snapshot > 0 {
+		u.Info("Dropping the upgrade previously staged in snapshot %d", staged.Snapshot)
+		err = u.snapshotter.DeleteSnapshot(staged.Snapshot)
+		if err != nil {
+			u.cfg.Logger.Warnf("could not delete staged snapshot %d: %v", staged.Snapshot, err)
+		}
+	}
+	return utils.SafeRemoveAll(u.cfg.Logger, u.cfg.Mounter, u.cfg.Fs, u.stagingDir())
+}
+
+// loadStagedUpgrade returns the record of the currently staged upgrade
+func (u *UpgradeAction) loadStagedUpgrade() (*stagedUpgrade, error) {
+	data, err := u.cfg.Fs.ReadFile(filepath.Join(u.stagingDir(), constants.UpgradeStagingFile))
+	if err != nil {
+		u.Error("no staged upgrade found: %v", err)
+		return nil, err
+	}
+	staged := &stagedUpgrade{}
+	err = yaml.Unmarshal(data, staged)
+	if err != nil {
+		u.Error("failed parsing staged upgrade data: %v", err)
+		return nil, err
+	}
+	if staged.Source == nil || staged.Source.IsEmpty() {
+		return nil, fmt.Errorf("staged upgrade has no source defined")
+	}
+	if staged.Snapshot <= 0 {
+		return nil, fmt.Errorf("staged upgrade has no snapshot defined")
+	}
+	return staged, nil
+}
+
+// activateStagedUpgrade checks the snapshot of the staged upgrade is bootable, sets up the
+// bootloader from it and activates it
+func (u *UpgradeAction) activateStagedUpgrade(staged *stagedUpgrade) (err error) {
+	state := u.spec.State
+	if state == nil {
+		state = &types.InstallState{}
+	}
+	state.Snapshotter = u.cfg.Snapshotter
+	active, _ := activeSystemState(state)
+	stateDir := u.spec.Partitions.State.MountPoint
+
+	ids, err := u.snapshotter.GetSnapshots()
+	if err != nil {
+		return err
+	}
+	path, err := snapshotter.SnapshotPath(u.cfg.Snapshotter, stateDir, staged.Snapshot)
+	if err != nil {
+		return err
+	}
+
+	bootStaged, stage := u.bootloader.(stagedBootloader)
+	defer func() {
+		if err != nil && stage {
+			bootStaged.Discard()
+		}
+	}()
+	err = checkBootable(u.cfg, state, stateDir, ids, active, staged.Snapshot, func(root string) error {
+		err := u.installBootloader(root)
+		if err != nil {
+			return err
+		}
+		return u.setBootloaderVars(root)
+	})
+	if err != nil {
+		u.Error("staged upgrade can't be applied: %v", err)
+		return err
+	}
+
+	err = u.snapshotter.ActivateSnapshot(staged.Snapshot)
+	if err != nil {
+		return err
+	}
+	if stage {
+		err = bootStaged.Commit()
+		if err != nil {
+			u.cfg.Logger.Errorf("failed installing the kernel and initrd: %v", err)
+			return err
+		}
+	}
+
+	u.snapshot = &types.Snapshot{ID: staged.Snapshot, Path: path}
+	u.history.ToVersion = staged.Version
+	// Keep track of the original source in the installation state
+	*u.spec.System = *staged.Source
+	u.spec.System.SetDigest(staged.Digest)
 	return nil
 }
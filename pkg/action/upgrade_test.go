@@ -18,8 +18,11 @@ package action_test
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/jaypipes/ghw/pkg/block"
 	. "github.com/onsi/ginkgo/v2"
@@ -27,10 +30,12 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/twpayne/go-vfs/v4"
 	"github.com/twpayne/go-vfs/v4/vfst"
+	"gopkg.in/yaml.v3"
 
 	"github.com/rancher/elemental-toolkit/v2/pkg/action"
 	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
 	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
 	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
@@ -96,6 +101,13 @@ var _ = Describe("Runtime Actions", func() {
 			Expect(utils.MkdirAll(fs, constants.LiveDir, constants.DirPerm)).To(Succeed())
 			Expect(utils.MkdirAll(fs, filepath.Dir(constants.ActiveMode), constants.DirPerm)).To(Succeed())
 
+			runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+				if cmd == "df" {
+					return []byte("Avail\n4096\n"), nil
+				}
+				return []byte{}, nil
+			}
+
 			mainDisk := block.Disk{
 				Name: "device",
 				Partitions: []*block.Partition{
@@ -183,6 +195,378 @@ var _ = Describe("Runtime Actions", func() {
 				err := upgrade.Run()
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("setting default entry"))
+
+				// The failed upgrade is recorded in the history
+				history, err := config.LoadUpgradeHistory(
+					filepath.Join(spec.Partitions.OEM.MountPoint, constants.UpgradeHistoryFile),
+				)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(history).To(HaveLen(1))
+				Expect(history[0].Result).To(Equal(constants.UpgradeFailed))
+			})
+			Describe("Only upgrading to newer versions", Label("version"), func() {
+				BeforeEach(func() {
+					Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 1)).To(Succeed())
+					Expect(utils.MkdirAll(fs, "/etc", constants.DirPerm)).To(Succeed())
+					Expect(fs.WriteFile("/etc/os-release", []byte("VERSION_ID=2.1.0\n"), constants.FilePerm)).To(Succeed())
+					spec.OnlyIfNewer = true
+				})
+				setTargetVersion := func(version string) {
+					extractor.SideEffect = func(_, destination, _ string, _, _ bool) (string, error) {
+						Expect(utils.MkdirAll(fs, filepath.Join(destination, "etc"), constants.DirPerm)).To(Succeed())
+						Expect(fs.WriteFile(
+							filepath.Join(destination, "etc", "os-release"), []byte("VERSION_ID="+version+"\n"), constants.FilePerm,
+						)).To(Succeed())
+						return mocks.FakeDigest, nil
+					}
+				}
+				It("upgrades to a newer version", func() {
+					setTargetVersion("2.2.0-rc1")
+					upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(upgrade.Run()).To(Succeed())
+					ok, _ := utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/2/snapshot.img"))
+					Expect(ok).To(BeTrue())
+				})
+				It("refuses to upgrade to an older or the same version", func() {
+					for _, version := range []string{"2.0.9", "2.1.0", "2.1.0-rc2"} {
+						setTargetVersion(version)
+						upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+						Expect(err).NotTo(HaveOccurred())
+						err = upgrade.Run()
+						Expect(err).To(MatchError(ContainSubstring("not newer than the active version")))
+					}
+					ok, _ := utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/2/snapshot.img"))
+					Expect(ok).To(BeFalse())
+				})
+				It("refuses to upgrade if the versions can't be compared", func() {
+					setTargetVersion("")
+					upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(upgrade.Run()).To(MatchError(ContainSubstring("invalid semantic version")))
+				})
+				It("exports the upgraded version to the metrics file", Label("metrics"), func() {
+					setTargetVersion("2.2.0")
+					config.MetricsFile = "/var/lib/node_exporter/elemental.prom"
+					upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(upgrade.Run()).To(Succeed())
+					data, err := fs.ReadFile(config.MetricsFile)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(string(data)).To(ContainSubstring("elemental_os_version_info{version=\"2.2.0\"} 1\n"))
+					Expect(string(data)).To(ContainSubstring("elemental_action_runs_total{action=\"upgrade\",result=\"success\"} 1\n"))
+				})
+				It("compares with the version of the active snapshot when booting from recovery", func() {
+					Expect(fs.Remove(constants.ActiveMode)).To(Succeed())
+					Expect(fs.WriteFile(constants.RecoveryMode, []byte("1"), constants.FilePerm)).To(Succeed())
+					Expect(fs.WriteFile("/etc/os-release", []byte("VERSION_ID=1.0\n"), constants.FilePerm)).To(Succeed())
+					spec.State = &types.InstallState{
+						Snapshotter: config.Snapshotter,
+						Partitions: map[string]*types.PartitionState{
+							constants.StatePartName: {Snapshots: map[int]*types.SystemState{1: {Active: true, Version: "2.1.0"}}},
+						},
+					}
+					setTargetVersion("2.0.9")
+					upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(upgrade.Run()).To(MatchError(ContainSubstring("not newer than the active version 2.1.0")))
+
+					spec.State.Partitions[constants.StatePartName].Snapshots[1].Version = ""
+					upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(upgrade.Run()).To(MatchError(ContainSubstring("version of the active system is unknown")))
+				})
+				It("records the version of the active snapshot in the history when booting from recovery", Label("history"), func() {
+					Expect(fs.Remove(constants.ActiveMode)).To(Succeed())
+					Expect(fs.WriteFile(constants.RecoveryMode, []byte("1"), constants.FilePerm)).To(Succeed())
+					Expect(fs.WriteFile("/etc/os-release", []byte("VERSION_ID=1.0\n"), constants.FilePerm)).To(Succeed())
+					spec.State = &types.InstallState{
+						Snapshotter: config.Snapshotter,
+						Partitions: map[string]*types.PartitionState{
+							constants.StatePartName: {Snapshots: map[int]*types.SystemState{1: {Active: true, Version: "2.1.0"}}},
+						},
+					}
+					setTargetVersion("2.2.0")
+					upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(upgrade.Run()).To(Succeed())
+
+					history, err := config.LoadUpgradeHistory(
+						filepath.Join(spec.Partitions.OEM.MountPoint, constants.UpgradeHistoryFile),
+					)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(history).To(HaveLen(1))
+					Expect(history[0].FromVersion).To(Equal("2.1.0"))
+					Expect(history[0].ToVersion).To(Equal("2.2.0"))
+				})
+				It("downgrades if allowed", func() {
+					setTargetVersion("1.0")
+					spec.AllowDowngrade = true
+					upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(upgrade.Run()).To(Succeed())
+				})
+			})
+			It("Runs the pre-swap verification command with the transition tree", Label("pre-swap"), func() {
+				Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 1)).To(Succeed())
+				spec.PreSwapVerifyCmd = []string{"/usr/bin/attest", "--strict"}
+				upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(upgrade.Run()).To(Succeed())
+				var verify []string
+				for _, cmd := range runner.GetCmds() {
+					if cmd[0] == "env" {
+						verify = cmd
+					}
+				}
+				Expect(verify).To(HaveLen(4))
+				Expect(verify[1]).To(HavePrefix(constants.TransitionMountPointEnv + "=/"))
+				Expect(verify[2:]).To(Equal([]string{"/usr/bin/attest", "--strict"}))
+			})
+			It("Writes the image version file into the upgraded image", Label("image-version"), func() {
+				Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 1)).To(Succeed())
+				spec.System = types.NewDockerSrc("my/image:v2.0")
+				spec.SnapshotLabels = map[string]string{"channel": "stable"}
+				// Read the version file from the transition tree before it is packed into an image
+				spec.PreSwapVerifyCmd = []string{"true"}
+				var imgVersion types.ImageVersion
+				runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+					switch cmd {
+					case "df":
+						return []byte("Avail\n4096\n"), nil
+					case "env":
+						root := strings.TrimPrefix(args[0], constants.TransitionMountPointEnv+"=")
+						data, err := fs.ReadFile(filepath.Join(root, constants.ImageVersionFile))
+						Expect(err).NotTo(HaveOccurred())
+						Expect(yaml.Unmarshal(data, &imgVersion)).To(Succeed())
+					}
+					return []byte{}, nil
+				}
+				upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(upgrade.Run()).To(Succeed())
+
+				Expect(imgVersion.Toolkit).NotTo(BeEmpty())
+				Expect(imgVersion.Snapshotter).To(Equal(constants.LoopDeviceSnapshotterType))
+				Expect(imgVersion.Source.String()).To(Equal("oci://my/image:v2.0"))
+				Expect(imgVersion.Digest).To(Equal(mocks.FakeDigest))
+				Expect(imgVersion.FromAction).To(Equal(constants.ActionUpgrade))
+				Expect(imgVersion.Labels).To(HaveKeyWithValue("channel", "stable"))
+				Expect(imgVersion.Date).NotTo(BeEmpty())
+			})
+			It("Aborts the upgrade before the swap if the pre-swap verification fails", Label("pre-swap"), func() {
+				Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 1)).To(Succeed())
+				spec.PreSwapVerifyCmd = []string{"/usr/bin/attest"}
+				runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+					switch cmd {
+					case "df":
+						return []byte("Avail\n4096\n"), nil
+					case "env":
+						return []byte("attestation denied"), fmt.Errorf("exit status 1")
+					}
+					return []byte{}, nil
+				}
+				upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(upgrade.Run()).To(MatchError(ContainSubstring("pre-swap verification")))
+
+				// No new snapshot was swapped in
+				ok, _ := utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/2/snapshot.img"))
+				Expect(ok).To(BeFalse())
+				Expect(bootloader.PersistentVariables).To(BeEmpty())
+			})
+			Describe("Without a bootloader", Label("bootloader-none"), func() {
+				var kernelDir string
+				BeforeEach(func() {
+					Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 1)).To(Succeed())
+					config.Bootloader = constants.BootloaderNone
+					config.KernelInstallPath = "/EFI/elemental"
+					kernelDir = filepath.Join(constants.BootDir, config.KernelInstallPath)
+					Expect(utils.MkdirAll(fs, kernelDir, constants.DirPerm)).To(Succeed())
+					Expect(fs.WriteFile(filepath.Join(kernelDir, "vmlinuz"), []byte("old kernel"), constants.FilePerm)).To(Succeed())
+
+					Expect(utils.MkdirAll(fs, filepath.Join(constants.WorkingImgDir, "boot"), constants.DirPerm)).To(Succeed())
+					Expect(utils.MkdirAll(fs, filepath.Join(constants.WorkingImgDir, "lib/modules/6.4.0-1"), constants.DirPerm)).To(Succeed())
+					Expect(fs.WriteFile(filepath.Join(constants.WorkingImgDir, "boot/vmlinuz-6.4.0-1"), []byte("new kernel"), constants.FilePerm)).To(Succeed())
+					Expect(fs.WriteFile(filepath.Join(constants.WorkingImgDir, "boot/initrd-6.4.0-1"), []byte("initrd"), constants.FilePerm)).To(Succeed())
+				})
+				It("installs the kernel of the new image once the transaction is closed", func() {
+					upgrade, err = action.NewUpgradeAction(config, spec)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(upgrade.Run()).To(Succeed())
+
+					kernel, err := fs.ReadFile(filepath.Join(kernelDir, "vmlinuz"))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(kernel)).To(Equal("new kernel"))
+					entry, err := fs.ReadFile(filepath.Join(kernelDir, "elemental.conf"))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(entry)).To(ContainSubstring("root=LABEL=COS_STATE"))
+				})
+				It("keeps the current kernel if the upgrade fails before the swap", func() {
+					spec.PreSwapVerifyCmd = []string{"/usr/bin/attest"}
+					runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+						switch cmd {
+						case "df":
+							return []byte("Avail\n4096\n"), nil
+						case "env":
+							return []byte("attestation denied"), fmt.Errorf("exit status 1")
+						}
+						return []byte{}, nil
+					}
+					upgrade, err = action.NewUpgradeAction(config, spec)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(upgrade.Run()).NotTo(Succeed())
+
+					kernel, err := fs.ReadFile(filepath.Join(kernelDir, "vmlinuz"))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(kernel)).To(Equal("old kernel"))
+					files, err := fs.ReadDir(kernelDir)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(files).To(HaveLen(1))
+				})
+			})
+			Describe("Verification failure policies", Label("verify-failure"), func() {
+				BeforeEach(func() {
+					Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 1)).To(Succeed())
+					spec.Partitions.Persistent = &types.Partition{
+						FilesystemLabel: constants.PersistentLabel,
+						Path:            "/dev/device7",
+						MountPoint:      constants.PersistentDir,
+					}
+					spec.PreSwapVerifyCmd = []string{"/usr/bin/attest"}
+					runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+						switch cmd {
+						case "df":
+							return []byte("Avail\n4096\n"), nil
+						case "env":
+							return []byte("attestation denied"), fmt.Errorf("exit status 1")
+						}
+						return []byte{}, nil
+					}
+				})
+				quarantined := func() string {
+					quarantine := filepath.Join(spec.Partitions.Persistent.MountPoint, constants.QuarantineDir)
+					entries, err := fs.ReadDir(quarantine)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(entries).To(HaveLen(1))
+					return filepath.Join(quarantine, entries[0].Name())
+				}
+				It("discards the failed upgrade tree by default", func() {
+					upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(upgrade.Run()).NotTo(Succeed())
+					ok, _ := utils.Exists(fs, filepath.Join(spec.Partitions.Persistent.MountPoint, constants.FailedUpgradeDir))
+					Expect(ok).To(BeFalse())
+				})
+				It("keeps the failed upgrade tree in the persistent partition", func() {
+					config.OnVerifyFailure = constants.VerifyKeep
+					upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(upgrade.Run()).To(MatchError(ContainSubstring("pre-swap verification")))
+
+					target := filepath.Join(spec.Partitions.Persistent.MountPoint, constants.FailedUpgradeDir, "root")
+					ok, _ := utils.IsDir(fs, target)
+					Expect(ok).To(BeTrue())
+					ok, _ = utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/2/snapshot.img"))
+					Expect(ok).To(BeFalse())
+				})
+				It("quarantines the failed upgrade tree with the failure details", func() {
+					config.OnVerifyFailure = constants.VerifyQuarantine
+					upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(upgrade.Run()).NotTo(Succeed())
+
+					target := quarantined()
+					ok, _ := utils.IsDir(fs, filepath.Join(target, "root"))
+					Expect(ok).To(BeTrue())
+					data, err := fs.ReadFile(filepath.Join(target, constants.QuarantineRecordFile))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(data)).To(ContainSubstring("pre-swap verification command failed"))
+				})
+				It("quarantines upgrades failing the signature verification", func() {
+					config.OnVerifyFailure = constants.VerifyQuarantine
+					config.Cosign = true
+					spec.PreSwapVerifyCmd = nil
+					spec.System = types.NewDockerSrc("some/image:v2")
+					runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+						switch cmd {
+						case "df":
+							return []byte("Avail\n4096\n"), nil
+						case "cosign":
+							return []byte("invalid signature"), fmt.Errorf("exit status 1")
+						}
+						return []byte{}, nil
+					}
+					upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+					Expect(err).NotTo(HaveOccurred())
+					err = upgrade.Run()
+					var elErr *elementalError.ElementalError
+					Expect(errors.As(err, &elErr)).To(BeTrue())
+					Expect(elErr.ExitCode()).To(Equal(elementalError.CosignVerify))
+
+					data, err := fs.ReadFile(filepath.Join(quarantined(), constants.QuarantineRecordFile))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(data)).To(ContainSubstring("cosign verification of some/image:v2 failed"))
+				})
+				It("keeps the transition image failing its verification", func() {
+					config.OnVerifyFailure = constants.VerifyKeep
+					config.MaxImageCopyRetries = 1
+					config.Snapshotter.Config.(*types.LoopDeviceConfig).Size = 0
+					spec.PreSwapVerifyCmd = nil
+					runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+						switch {
+						case cmd == "df":
+							return []byte("Avail\n4096\n"), nil
+						case cmd == "rsync" && args[0] == "--dry-run":
+							return []byte(">f..t...... etc/os-release\n"), nil
+						}
+						return []byte{}, nil
+					}
+					upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+					Expect(err).NotTo(HaveOccurred())
+					err = upgrade.Run()
+					var elErr *elementalError.ElementalError
+					Expect(errors.As(err, &elErr)).To(BeTrue())
+					Expect(elErr.ExitCode()).To(Equal(elementalError.VerifyImage))
+
+					target := filepath.Join(spec.Partitions.Persistent.MountPoint, constants.FailedUpgradeDir)
+					ok, _ := utils.Exists(fs, filepath.Join(target, "snapshot.img"))
+					Expect(ok).To(BeTrue())
+					ok, _ = utils.Exists(fs, filepath.Join(target, "root"))
+					Expect(ok).To(BeFalse())
+				})
+				It("does not preserve trees failing for other reasons", func() {
+					config.OnVerifyFailure = constants.VerifyQuarantine
+					spec.PreSwapVerifyCmd = nil
+					bootloader.ErrorSetDefaultEntry = true
+					upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(upgrade.Run()).NotTo(Succeed())
+					ok, _ := utils.Exists(fs, filepath.Join(spec.Partitions.Persistent.MountPoint, constants.QuarantineDir))
+					Expect(ok).To(BeFalse())
+				})
+			})
+			It("Sets the boot attempts counter in the OEM partition", Label("boot-attempts"), func() {
+				Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 1)).To(Succeed())
+				spec.BootAttempts = 2
+				Expect(spec.Sanitize()).To(Succeed())
+				upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(upgrade.Run()).To(Succeed())
+
+				grubEnv := filepath.Join(constants.OEMPath, constants.GrubEnv)
+				Expect(bootloader.PersistentVariables[grubEnv]).To(HaveKeyWithValue(constants.GrubBootAttempts, "2"))
+			})
+			It("Does not set the boot attempts counter if disabled or without OEM partition", Label("boot-attempts"), func() {
+				Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 1)).To(Succeed())
+				spec.BootAttempts = 0
+				spec.Partitions.OEM = nil
+				upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(upgrade.Run()).To(Succeed())
+
+				grubEnv := filepath.Join(constants.OEMPath, constants.GrubEnv)
+				Expect(bootloader.PersistentVariables).NotTo(HaveKey(grubEnv))
 			})
 			It("Successfully upgrades from docker image", func() {
 				Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 2)).To(Succeed())
@@ -217,6 +601,18 @@ var _ = Describe("Runtime Actions", func() {
 
 				spec.System = types.NewDockerSrc("alpine")
 				spec.SnapshotLabels = map[string]string{"foo": "bar"}
+
+				// OS versions of the running and the upgraded systems
+				Expect(utils.MkdirAll(fs, "/etc", constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile("/etc/os-release", []byte("VERSION_ID=1.0\n"), constants.FilePerm)).To(Succeed())
+				extractor.SideEffect = func(_, destination, _ string, _, _ bool) (string, error) {
+					Expect(utils.MkdirAll(fs, filepath.Join(destination, "etc"), constants.DirPerm)).To(Succeed())
+					Expect(fs.WriteFile(
+						filepath.Join(destination, "etc", "os-release"), []byte("VERSION_ID=2.0\nGRUB_ENTRY_NAME=TESTOS\n"), constants.FilePerm,
+					)).To(Succeed())
+					return mocks.FakeDigest, nil
+				}
+
 				upgrade, err = action.NewUpgradeAction(config, spec)
 				Expect(err).NotTo(HaveOccurred())
 				err := upgrade.Run()
@@ -254,6 +650,8 @@ var _ = Describe("Runtime Actions", func() {
 					To(BeFalse())
 				Expect(state.Partitions[constants.StatePartName].Snapshots[3].Digest).
 					To(Equal(mocks.FakeDigest))
+				Expect(state.Partitions[constants.StatePartName].Snapshots[3].Version).
+					To(Equal("2.0"))
 				Expect(state.Partitions[constants.StatePartName].Snapshots[3].Source.String()).
 					To(Equal("oci://alpine:latest"))
 				Expect(state.Partitions[constants.StatePartName].Snapshots[2].Source.String()).
@@ -261,6 +659,19 @@ var _ = Describe("Runtime Actions", func() {
 				// Snapshot 1 was deleted
 				Expect(state.Partitions[constants.StatePartName].Snapshots[1]).
 					To(BeNil())
+
+				// The upgrade is recorded in the history
+				history, err := config.LoadUpgradeHistory(
+					filepath.Join(spec.Partitions.OEM.MountPoint, constants.UpgradeHistoryFile),
+				)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(history).To(HaveLen(1))
+				Expect(history[0].From).To(Equal("oci://some/image:v2"))
+				Expect(history[0].FromVersion).To(Equal("1.0"))
+				Expect(history[0].ToVersion).To(Equal("2.0"))
+				Expect(history[0].To).To(Equal(spec.System.String()))
+				Expect(history[0].Digest).To(Equal(mocks.FakeDigest))
+				Expect(history[0].Result).To(Equal(constants.UpgradeSucceeded))
 			})
 			It("Successfully reboots after upgrade from docker image", func() {
 				Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 1)).To(Succeed())
@@ -327,6 +738,458 @@ var _ = Describe("Runtime Actions", func() {
 				_, err = fs.Stat(spec.RecoverySystem.File)
 				Expect(err).To(HaveOccurred())
 			})
+			Describe("Missing recovery partition", Label("missing-recovery"), func() {
+				It("skips the recovery upgrade", func() {
+					spec.Partitions.Recovery = nil
+					spec.RecoveryUpgrade = true
+
+					upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(upgrade.Run()).To(Succeed())
+					Expect(memLog.String()).To(ContainSubstring("Recovery partition not found, skipping the recovery upgrade"))
+					Expect(runner.IncludesCmds([][]string{{"parted"}})).NotTo(Succeed())
+				})
+				It("creates the recovery partition and upgrades the recovery image into it", func() {
+					spec := PrepareTestRecoveryImage(config, constants.RecoveryDir, fs, runner)
+					spec.Partitions.Recovery = nil
+					spec.RecoveryUpgrade = false
+					spec.CreateRecoveryIfMissing = true
+
+					recoverySideEffect := runner.SideEffect
+					partedOut := printOutput + fmt.Sprintf(partTmpl, 1, "2048", "4095")
+					runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+						if cmd == "parted" {
+							if slices.Contains(args, "mkpart") {
+								partedOut += fmt.Sprintf(partTmpl, 2, "4096", "8392703")
+								Expect(utils.MkdirAll(fs, filepath.Dir(spec.Partitions.State.Disk), constants.DirPerm)).To(Succeed())
+								_, err := fs.Create(spec.Partitions.State.Disk + "2")
+								Expect(err).NotTo(HaveOccurred())
+							}
+							return []byte(partedOut), nil
+						}
+						return recoverySideEffect(cmd, args...)
+					}
+
+					upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(upgrade.Run()).To(Succeed())
+
+					Expect(runner.IncludesCmds([][]string{
+						{"mkfs.ext4", "-L", constants.RecoveryLabel, spec.Partitions.State.Disk + "2"},
+					})).To(Succeed())
+					Expect(spec.Partitions.Recovery.MountPoint).To(Equal(constants.RecoveryDir))
+					Expect(spec.RecoveryUpgrade).To(BeTrue())
+					state, err := config.LoadInstallState()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(state.Partitions[constants.RecoveryPartName]).NotTo(BeNil())
+
+					// The partition is only created once the upgraded system is committed
+					log := memLog.String()
+					Expect(strings.Index(log, "Creating the recovery partition")).To(
+						BeNumerically(">", strings.Index(log, "Closing snapshotter transaction")),
+					)
+				})
+				It("removes the created recovery partition if the recovery upgrade fails", func() {
+					spec.Partitions.Recovery = nil
+					spec.CreateRecoveryIfMissing = true
+
+					partedOut := printOutput + fmt.Sprintf(partTmpl, 1, "2048", "4095")
+					runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+						switch cmd {
+						case "parted":
+							if slices.Contains(args, "mkpart") {
+								partedOut += fmt.Sprintf(partTmpl, 2, "4096", "8392703")
+								Expect(utils.MkdirAll(fs, filepath.Dir(spec.Partitions.State.Disk), constants.DirPerm)).To(Succeed())
+								_, err := fs.Create(spec.Partitions.State.Disk + "2")
+								Expect(err).NotTo(HaveOccurred())
+							}
+							return []byte(partedOut), nil
+						case "mksquashfs":
+							return []byte{}, errors.New("mksquashfs failed")
+						}
+						return []byte{}, nil
+					}
+
+					upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(upgrade.Run()).NotTo(Succeed())
+					Expect(runner.IncludesCmds([][]string{
+						{"parted", "--script", "--machine", "--", spec.Partitions.State.Disk, "unit", "s", "rm", "2"},
+					})).To(Succeed())
+					Expect(spec.Partitions.Recovery).To(BeNil())
+				})
+				It("fails if there is no free space for the recovery partition", func() {
+					spec.Partitions.Recovery = nil
+					spec.CreateRecoveryIfMissing = true
+					runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+						if cmd == "parted" {
+							return []byte(printOutput + fmt.Sprintf(partTmpl, 1, "2048", "50591743")), nil
+						}
+						return []byte{}, nil
+					}
+
+					upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(upgrade.Run()).To(MatchError(ContainSubstring("not enough free space")))
+
+					// The upgrade is rejected before deploying anything
+					Expect(runner.IncludesCmds([][]string{{"parted", "--script", "--machine", "--", spec.Partitions.State.Disk, "unit", "s", "mkpart"}})).NotTo(Succeed())
+					Expect(memLog.String()).NotTo(ContainSubstring("Starting snapshotter transaction"))
+				})
+			})
+			Describe("Staged upgrades", Label("verify-only", "resume"), func() {
+				var stagingDir string
+				BeforeEach(func() {
+					spec.Partitions.Persistent = &types.Partition{
+						FilesystemLabel: constants.PersistentLabel,
+						Path:            "/dev/device7",
+						MountPoint:      constants.PersistentDir,
+					}
+					stagingDir = filepath.Join(constants.PersistentDir, constants.UpgradeStagingDir)
+					extractor.SideEffect = func(_, destination, _ string, _, _ bool) (string, error) {
+						for _, dir := range []string{"boot", "lib/modules/6.4"} {
+							Expect(utils.MkdirAll(fs, filepath.Join(destination, dir), constants.DirPerm)).To(Succeed())
+						}
+						for _, file := range []string{"boot/vmlinuz-6.4", "boot/initrd"} {
+							Expect(fs.WriteFile(filepath.Join(destination, file), []byte{}, constants.FilePerm)).To(Succeed())
+						}
+						return mocks.FakeDigest, nil
+					}
+				})
+				It("verifies and stages an upgrade without applying it", func() {
+					Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 1)).To(Succeed())
+					spec.System = types.NewDockerSrc("registry.org/elemental/os:v1.0")
+					spec.VerifyOnly = true
+					config.Reboot = true
+					Expect(spec.Sanitize()).To(Succeed())
+					upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(upgrade.Run()).To(Succeed())
+
+					ok, _ := utils.Exists(fs, filepath.Join(stagingDir, constants.UpgradeStagingFile))
+					Expect(ok).To(BeTrue())
+
+					// The new snapshot is created but not activated and no reboot was triggered
+					activeLink := filepath.Join(constants.RunningStateDir, ".snapshots", constants.ActiveSnapshot)
+					ok, _ = utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/2/snapshot.img"))
+					Expect(ok).To(BeTrue())
+					link, err := fs.Readlink(activeLink)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(link).To(HaveSuffix("1/snapshot.img"))
+					Expect(runner.IncludesCmds([][]string{{"reboot", "-f"}})).NotTo(Succeed())
+
+					// Resume the staged upgrade without any source, it is not deployed again
+					for _, dir := range []string{"boot", "lib/modules/6.4"} {
+						Expect(utils.MkdirAll(fs, filepath.Join(constants.ActivateImageDir, dir), constants.DirPerm)).To(Succeed())
+					}
+					for _, file := range []string{"boot/vmlinuz-6.4", "boot/initrd"} {
+						Expect(fs.WriteFile(filepath.Join(constants.ActivateImageDir, file), []byte{}, constants.FilePerm)).To(Succeed())
+					}
+					extractor.SideEffect = func(_, _, _ string, _, _ bool) (string, error) {
+						return "", errors.New("source deployed again")
+					}
+					spec.System = types.NewEmptySrc()
+					spec.VerifyOnly = false
+					spec.ResumeUpgrade = true
+					config.Reboot = false
+					Expect(spec.Sanitize()).To(Succeed())
+					upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(upgrade.Run()).To(Succeed())
+
+					link, err = fs.Readlink(activeLink)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(link).To(HaveSuffix("2/snapshot.img"))
+					ok, _ = utils.Exists(fs, stagingDir)
+					Expect(ok).To(BeFalse())
+
+					state, err := config.LoadInstallState()
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(state.Partitions[constants.StatePartName].Snapshots[2].Source.String()).
+						To(Equal("oci://registry.org/elemental/os:v1.0"))
+					Expect(state.Partitions[constants.StatePartName].Snapshots[2].Digest).
+						To(Equal(mocks.FakeDigest))
+				})
+				It("fails to stage a non bootable upgrade", func() {
+					extractor.SideEffect = nil
+					spec.System = types.NewDockerSrc("alpine")
+					spec.VerifyOnly = true
+					upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+					Expect(err).NotTo(HaveOccurred())
+					err = upgrade.Run()
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("no Kernel file found"))
+					ok, _ := utils.Exists(fs, stagingDir)
+					Expect(ok).To(BeFalse())
+					ok, _ = utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/2"))
+					Expect(ok).To(BeFalse())
+				})
+				It("fails to stage an upgrade bigger than the configured image size", func() {
+					extractor.SideEffect = func(_, destination, _ string, _, _ bool) (string, error) {
+						for _, dir := range []string{"boot", "lib/modules/6.4"} {
+							Expect(utils.MkdirAll(fs, filepath.Join(destination, dir), constants.DirPerm)).To(Succeed())
+						}
+						Expect(fs.WriteFile(filepath.Join(destination, "boot/initrd"), []byte{}, constants.FilePerm)).To(Succeed())
+						f, err := fs.Create(filepath.Join(destination, "boot/vmlinuz-6.4"))
+						Expect(err).NotTo(HaveOccurred())
+						Expect(f.Truncate(32 * 1024 * 1024)).To(Succeed())
+						Expect(f.Close()).To(Succeed())
+						return mocks.FakeDigest, nil
+					}
+					spec.System = types.NewDockerSrc("alpine")
+					spec.VerifyOnly = true
+					upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+					Expect(err).NotTo(HaveOccurred())
+					err = upgrade.Run()
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("does not fit"))
+				})
+				It("fails to stage an upgrade with kernel modules not matching the kernel", Label("modules"), func() {
+					extractor.SideEffect = func(_, destination, _ string, _, _ bool) (string, error) {
+						for _, dir := range []string{"boot", "lib/modules/6.4", "lib/modules/6.5"} {
+							Expect(utils.MkdirAll(fs, filepath.Join(destination, dir), constants.DirPerm)).To(Succeed())
+						}
+						for _, file := range []string{"boot/vmlinuz-6.4.2", "boot/initrd"} {
+							Expect(fs.WriteFile(filepath.Join(destination, file), []byte{}, constants.FilePerm)).To(Succeed())
+						}
+						return mocks.FakeDigest, nil
+					}
+					spec.System = types.NewDockerSrc("alpine")
+					spec.VerifyOnly = true
+					spec.VerifyModules = true
+					upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+					Expect(err).NotTo(HaveOccurred())
+					err = upgrade.Run()
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("no kernel modules found for kernel version 6.4.2"))
+					ok, _ := utils.Exists(fs, stagingDir)
+					Expect(ok).To(BeFalse())
+				})
+				It("fails to resume if there is no staged upgrade", func() {
+					spec.System = types.NewEmptySrc()
+					spec.ResumeUpgrade = true
+					upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(upgrade.Run()).NotTo(Succeed())
+				})
+				It("fails to sanitize resume with a new upgrade source", func() {
+					spec.System = types.NewDockerSrc("registry.org/elemental/os:v1.0")
+					spec.ResumeUpgrade = true
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+				It("fails to sanitize verify-only and resume at the same time", func() {
+					spec.VerifyOnly = true
+					spec.ResumeUpgrade = true
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+			})
+			Describe("Upgrades from local artifacts", Label("from-file"), func() {
+				var artifact string
+				BeforeEach(func() {
+					Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 1)).To(Succeed())
+					spec.Partitions.Persistent = &types.Partition{
+						FilesystemLabel: constants.PersistentLabel,
+						Path:            "/dev/device7",
+						MountPoint:      constants.PersistentDir,
+					}
+					Expect(utils.MkdirAll(fs, constants.PersistentDir, constants.DirPerm)).To(Succeed())
+					Expect(utils.MkdirAll(fs, "/media/usb", constants.DirPerm)).To(Succeed())
+					artifact = "/media/usb/os.img"
+				})
+				It("upgrades from a squashfs image with a valid checksum", func() {
+					Expect(fs.WriteFile(artifact, []byte("hsqs-image"), constants.FilePerm)).To(Succeed())
+					checksum, err := utils.CalcFileChecksum(fs, artifact)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fs.WriteFile(artifact+".sha256", []byte(checksum+"  os.img\n"), constants.FilePerm)).To(Succeed())
+					config.Reboot = true
+
+					Expect(action.UpgradeFromFile(config, spec, artifact)).To(Succeed())
+					Expect(spec.System.IsFile()).To(BeTrue())
+					Expect(spec.System.Value()).To(Equal(artifact))
+					ok, _ := utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/2/snapshot.img"))
+					Expect(ok).To(BeTrue())
+					Expect(runner.IncludesCmds([][]string{{"reboot", "-f"}})).To(Succeed())
+				})
+				It("upgrades from an image with a sha512 checksum", Label("checksum"), func() {
+					Expect(fs.WriteFile(artifact, []byte("hsqs-image"), constants.FilePerm)).To(Succeed())
+					checksum, err := utils.CalcFileChecksumWithAlgo(fs, artifact, constants.SHA512)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fs.WriteFile(artifact+".sha512", []byte(checksum+"  os.img\n"), constants.FilePerm)).To(Succeed())
+
+					Expect(action.UpgradeFromFile(config, spec, artifact)).To(Succeed())
+					Expect(memLog.String()).To(ContainSubstring("Checksum of /media/usb/os.img verified"))
+				})
+				It("upgrades from a tarball and removes the unpacked tree", func() {
+					header := make([]byte, 512)
+					copy(header[257:], "ustar")
+					Expect(fs.WriteFile(artifact, header, constants.FilePerm)).To(Succeed())
+					spec.SkipChecksum = true
+
+					Expect(action.UpgradeFromFile(config, spec, artifact)).To(Succeed())
+					Expect(spec.System.IsDir()).To(BeTrue())
+					Expect(runner.MatchMilestones([][]string{
+						{"tar", "--numeric-owner", "--xattrs", "--xattrs-include=*", "--acls", "-xpf", artifact, "-C", spec.System.Value()},
+					})).To(Succeed())
+					Expect(spec.System.Value()).To(HavePrefix(constants.PersistentDir))
+					ok, _ := utils.Exists(fs, spec.System.Value())
+					Expect(ok).To(BeFalse())
+				})
+				It("unpacks tarballs within the download directory", Label("download-dir"), func() {
+					header := make([]byte, 512)
+					copy(header[257:], "ustar")
+					Expect(fs.WriteFile(artifact, header, constants.FilePerm)).To(Succeed())
+					spec.SkipChecksum = true
+					config.DownloadDir = "/var/elemental/downloads"
+
+					Expect(action.UpgradeFromFile(config, spec, artifact)).To(Succeed())
+					Expect(spec.System.Value()).To(HavePrefix(config.DownloadDir))
+					Expect(runner.IncludesCmds([][]string{
+						{"df", "--output=avail", "--block-size=1M", config.DownloadDir},
+					})).To(Succeed())
+				})
+				It("upgrades from an image without checksum if the spec has no upgrade source", func() {
+					Expect(fs.WriteFile(artifact, []byte("hsqs-image"), constants.FilePerm)).To(Succeed())
+					spec.SkipChecksum = true
+					spec.System = nil
+
+					Expect(action.UpgradeFromFile(config, spec, artifact)).To(Succeed())
+					Expect(spec.System.IsFile()).To(BeTrue())
+				})
+				It("fails if there is no checksum file", func() {
+					Expect(fs.WriteFile(artifact, []byte("hsqs-image"), constants.FilePerm)).To(Succeed())
+
+					err := action.UpgradeFromFile(config, spec, artifact)
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("can't be verified"))
+					ok, _ := utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/2/snapshot.img"))
+					Expect(ok).To(BeFalse())
+				})
+				It("fails on a checksum mismatch", func() {
+					Expect(fs.WriteFile(artifact, []byte("hsqs-image"), constants.FilePerm)).To(Succeed())
+					Expect(fs.WriteFile(artifact+".sha256", []byte("0123abcd  os.img\n"), constants.FilePerm)).To(Succeed())
+
+					err := action.UpgradeFromFile(config, spec, artifact)
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("checksum mismatch"))
+					ok, _ := utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/2/snapshot.img"))
+					Expect(ok).To(BeFalse())
+				})
+				It("verifies the artifact signature if cosign is enabled", func() {
+					Expect(fs.WriteFile(artifact, []byte("hsqs-image"), constants.FilePerm)).To(Succeed())
+					spec.SkipChecksum = true
+					config.Cosign = true
+					config.CosignPubKey = "/media/usb/cosign.pub"
+					runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+						if cmd == "cosign" {
+							return []byte("invalid signature"), errors.New("cosign failed")
+						}
+						return []byte{}, nil
+					}
+
+					Expect(action.UpgradeFromFile(config, spec, artifact)).NotTo(Succeed())
+					Expect(runner.IncludesCmds([][]string{{
+						"cosign", "verify-blob", "--signature", artifact + ".sig", "--key", "/media/usb/cosign.pub", artifact,
+					}})).To(Succeed())
+				})
+				It("fails on unknown artifact types", func() {
+					Expect(fs.WriteFile(artifact, []byte("not an image"), constants.FilePerm)).To(Succeed())
+					spec.SkipChecksum = true
+					err := action.UpgradeFromFile(config, spec, artifact)
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("unknown artifact type"))
+				})
+			})
+		})
+		Describe("Persistent partition preflight", Label("persistent-space"), func() {
+			var freeSpace []string
+			var cacheDir string
+			BeforeEach(func() {
+				Expect(fs.WriteFile(constants.ActiveMode, []byte("1"), constants.FilePerm)).To(Succeed())
+				Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 1)).To(Succeed())
+
+				var err error
+				spec, err = conf.NewUpgradeSpec(config.Config)
+				Expect(err).ShouldNot(HaveOccurred())
+				spec.System = types.NewDockerSrc("alpine")
+				spec.Partitions.Persistent = &types.Partition{
+					FilesystemLabel: constants.PersistentLabel,
+					Path:            "/dev/device7",
+					MountPoint:      constants.PersistentDir,
+				}
+
+				cacheDir = filepath.Join(constants.PersistentDir, "var/cache")
+				Expect(utils.MkdirAll(fs, cacheDir, constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(filepath.Join(cacheDir, "pkgs.tar"), []byte("cache"), constants.FilePerm)).To(Succeed())
+
+				freeSpace = []string{"10"}
+				runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+					if cmd == "df" {
+						free := freeSpace[0]
+						if len(freeSpace) > 1 {
+							freeSpace = freeSpace[1:]
+						}
+						return []byte("Avail\n" + free + "\n"), nil
+					}
+					return []byte{}, nil
+				}
+			})
+			It("aborts the upgrade early if there is not enough free space", func() {
+				upgrade, err := action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+				Expect(err).NotTo(HaveOccurred())
+				err = upgrade.Run()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("10MiB free"))
+				Expect(runner.IncludesCmds([][]string{{"df", "--output=avail", "--block-size=1M", constants.PersistentDir}})).To(Succeed())
+
+				// Nothing was deployed nor pruned
+				ok, _ := utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/2"))
+				Expect(ok).To(BeFalse())
+				ok, _ = utils.Exists(fs, filepath.Join(cacheDir, "pkgs.tar"))
+				Expect(ok).To(BeTrue())
+
+				// The failed upgrade is recorded in the history
+				history, err := config.LoadUpgradeHistory(
+					filepath.Join(spec.Partitions.OEM.MountPoint, constants.UpgradeHistoryFile),
+				)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(history).To(HaveLen(1))
+				Expect(history[0].Result).To(Equal(constants.UpgradeFailed))
+			})
+			It("requires room for the estimated system size", func() {
+				freeSpace = []string{"100"}
+				loopCfg, ok := config.Snapshotter.Config.(*types.LoopDeviceConfig)
+				Expect(ok).To(BeTrue())
+				loopCfg.Size = 512
+				upgrade, err := action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+				Expect(err).NotTo(HaveOccurred())
+				err = upgrade.Run()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(fmt.Sprintf("100MiB free, %dMiB are required", 512+constants.PersistentUpgradeMinFreeMiB)))
+				ok, _ = utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/2"))
+				Expect(ok).To(BeFalse())
+			})
+			It("prunes the configured cache paths to make room", func() {
+				freeSpace = []string{"10", "1024"}
+				config.PrunePersistentOnUpgrade = true
+				config.PersistentCachePaths = []string{"var/cache", "var/missing"}
+				upgrade, err := action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(upgrade.Run()).To(Succeed())
+
+				ok, _ := utils.Exists(fs, filepath.Join(cacheDir, "pkgs.tar"))
+				Expect(ok).To(BeFalse())
+				ok, _ = utils.Exists(fs, cacheDir)
+				Expect(ok).To(BeTrue())
+			})
+			It("fails if pruning cache paths does not free enough space", func() {
+				config.PrunePersistentOnUpgrade = true
+				config.PersistentCachePaths = []string{"var/cache"}
+				upgrade, err := action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+				Expect(err).NotTo(HaveOccurred())
+				err = upgrade.Run()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("after pruning"))
+			})
 		})
 		Describe(fmt.Sprintf("Booting from %s", constants.RecoveryLabel), Label("recovery_label"), func() {
 			BeforeEach(func() {
@@ -0,0 +1,381 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+
+	efilib "github.com/canonical/go-efilib"
+	"gopkg.in/yaml.v3"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/bootloader"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	eleefi "github.com/rancher/elemental-toolkit/v2/pkg/efi"
+	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/snapshotter"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+// VerifyCheck is the result of a single installation check
+type VerifyCheck struct {
+	Name    string `yaml:"name"`
+	Passed  bool   `yaml:"passed"`
+	Message string `yaml:"message,omitempty"`
+}
+
+// VerifyReport is the result of all the checks of an installation
+type VerifyReport struct {
+	Checks []VerifyCheck `yaml:"checks"`
+}
+
+// Failed returns the checks which did not pass
+func (r VerifyReport) Failed() []VerifyCheck {
+	failed := []VerifyCheck{}
+	for _, check := range r.Checks {
+		if !check.Passed {
+			failed = append(failed, check)
+		}
+	}
+	return failed
+}
+
+func (r *VerifyReport) pass(name, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, VerifyCheck{Name: name, Passed: true, Message: fmt.Sprintf(format, args...)})
+}
+
+func (r *VerifyReport) fail(name, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, VerifyCheck{Name: name, Passed: false, Message: fmt.Sprintf(format, args...)})
+}
+
+var bootEntryRegexp = regexp.MustCompile(`^Boot[0-9a-fA-F]{4}$`)
+
+type VerifyInstallOption func(v *verifyInstall)
+
+// WithVerifyEFIVariables sets the EFI variables store used to check the boot entries
+func WithVerifyEFIVariables(efivars eleefi.Variables) VerifyInstallOption {
+	return func(v *verifyInstall) {
+		v.efivars = efivars
+	}
+}
+
+type verifyInstall struct {
+	cfg     *types.RunConfig
+	report  *VerifyReport
+	efivars eleefi.Variables
+	state   *types.InstallState
+	parts   types.ElementalPartitions
+}
+
+// VerifyInstall checks a completed installation end-to-end: all the partitions listed in the
+// installation state exist with the expected labels and filesystems, the active and recovery
+// images are present and match the checksums recorded at install time, the bootloader is in
+// place and the OEM configuration files are readable. Partitions are only mounted read-only.
+// The report is always returned, an error is also returned if any check did not pass.
+func VerifyInstall(cfg *types.RunConfig, opts ...VerifyInstallOption) (report *VerifyReport, err error) {
+	v := &verifyInstall{
+		cfg:     cfg,
+		report:  &VerifyReport{},
+		efivars: eleefi.RealEFIVariables{},
+	}
+	for _, o := range opts {
+		o(v)
+	}
+
+	cleanup := utils.NewCleanStack()
+	defer func() { err = cleanup.Cleanup(err) }()
+
+	parts, err := utils.GetAllPartitions()
+	if err != nil {
+		cfg.Logger.Errorf("could not read host partitions: %v", err)
+		return v.report, elementalError.NewFromError(err, elementalError.MountPartitions)
+	}
+	v.parts, err = cfg.PartitionSelection.ElementalPartitions(parts, nil)
+	if err != nil {
+		cfg.Logger.Errorf("could not pick the host partitions: %v", err)
+		return v.report, elementalError.NewFromError(err, elementalError.MountPartitions)
+	}
+
+	// The installation state lists the installed partitions and images
+	if v.mount(v.parts.State, constants.StatePartName, cleanup) {
+		v.loadState()
+	} else {
+		v.report.fail(constants.InstallStateFile, "state partition not available")
+	}
+
+	if v.state != nil {
+		v.parts, err = cfg.PartitionSelection.ElementalPartitions(parts, v.state)
+		if err != nil {
+			cfg.Logger.Errorf("could not pick the host partitions: %v", err)
+			return v.report, elementalError.NewFromError(err, elementalError.MountPartitions)
+		}
+		for _, name := range []string{
+			constants.BootPartName, constants.OEMPartName, constants.RecoveryPartName,
+			constants.StatePartName, constants.PersistentPartName,
+		} {
+			v.checkPartition(name)
+		}
+
+		v.checkActiveImage()
+		if v.mount(v.parts.Recovery, constants.RecoveryPartName, cleanup) {
+			v.checkRecoveryImage()
+		}
+		if v.mount(v.parts.Boot, constants.BootPartName, cleanup) {
+			v.checkBootloader()
+		}
+		if v.mount(v.parts.OEM, constants.OEMPartName, cleanup) {
+			v.checkOEMConfigs()
+		}
+	}
+
+	failed := v.report.Failed()
+	for _, check := range failed {
+		cfg.Logger.Errorf("Check '%s' failed: %s", check.Name, check.Message)
+	}
+	if len(failed) > 0 {
+		return v.report, elementalError.New(
+			fmt.Sprintf("%d of %d installation checks failed", len(failed), len(v.report.Checks)),
+			elementalError.VerifyInstall,
+		)
+	}
+	cfg.Logger.Infof("All %d installation checks passed", len(v.report.Checks))
+	return v.report, nil
+}
+
+// verifyMountPoints are the mount points used for each partition during the verification
+var verifyMountPoints = map[string]string{
+	constants.BootPartName:     constants.BootDir,
+	constants.OEMPartName:      constants.OEMDir,
+	constants.RecoveryPartName: constants.RecoveryDir,
+	constants.StatePartName:    constants.StateDir,
+}
+
+// mount mounts the given partition read-only and reports whether it succeeded
+func (v *verifyInstall) mount(part *types.Partition, name string, cleanup *utils.CleanStack) bool {
+	if part == nil {
+		return false
+	}
+	part.MountPoint = verifyMountPoints[name]
+	opts := []string{"ro"}
+	if part.FS == constants.Btrfs {
+		// Mount the top level subvolume, not the default one, to reach all snapshots
+		opts = append(opts, "subvolid=5")
+	}
+	err := elemental.MountPartition(v.cfg.Config, part, opts...)
+	if err != nil {
+		v.report.fail(name, "failed mounting partition %s: %v", part.Path, err)
+		return false
+	}
+	cleanup.Push(func() error { return elemental.UnmountPartition(v.cfg.Config, part) })
+	return true
+}
+
+func (v *verifyInstall) loadState() {
+	stateFile := filepath.Join(v.parts.State.MountPoint, constants.InstallStateFile)
+	data, err := v.cfg.Fs.ReadFile(stateFile)
+	if err != nil {
+		v.report.fail(constants.InstallStateFile, "failed reading state file: %v", err)
+		return
+	}
+	state := &types.InstallState{}
+	err = yaml.Unmarshal(data, state)
+	if err != nil {
+		v.report.fail(constants.InstallStateFile, "failed parsing state file: %v", err)
+		return
+	}
+	v.state = state
+	v.report.pass(constants.InstallStateFile, "state file loaded")
+}
+
+func (v *verifyInstall) checkPartition(name string) {
+	expected := v.state.Partitions[name]
+	if expected == nil {
+		return
+	}
+	part := map[string]*types.Partition{
+		constants.BootPartName:       v.parts.Boot,
+		constants.OEMPartName:        v.parts.OEM,
+		constants.RecoveryPartName:   v.parts.Recovery,
+		constants.StatePartName:      v.parts.State,
+		constants.PersistentPartName: v.parts.Persistent,
+	}[name]
+
+	check := fmt.Sprintf("%s partition", name)
+	switch {
+	case part == nil:
+		v.report.fail(check, "partition not found")
+	case part.FilesystemLabel != expected.FSLabel:
+		v.report.fail(check, "partition %s has label '%s', expected '%s'", part.Path, part.FilesystemLabel, expected.FSLabel)
+	case part.FS == "":
+		v.report.fail(check, "partition %s has no filesystem", part.Path)
+	case name == constants.BootPartName && part.FS != constants.BootFs:
+		v.report.fail(check, "partition %s has a %s filesystem, expected %s", part.Path, part.FS, constants.BootFs)
+	default:
+		v.report.pass(check, "%s with label '%s' and %s filesystem", part.Path, part.FilesystemLabel, part.FS)
+	}
+}
+
+func (v *verifyInstall) checkActiveImage() {
+	const check = "active image"
+
+	statePart := v.state.Partitions[constants.StatePartName]
+	if statePart == nil || v.parts.State.MountPoint == "" {
+		v.report.fail(check, "no state partition data")
+		return
+	}
+	for id, snap := range statePart.Snapshots {
+		if !snap.Active {
+			continue
+		}
+		path, err := snapshotter.SnapshotPath(v.state.Snapshotter, v.parts.State.MountPoint, id)
+		if err != nil {
+			v.report.fail(check, "%v", err)
+			return
+		}
+		v.checkImage(check, path, snap.Checksum)
+		return
+	}
+	v.report.fail(check, "no active snapshot in state file")
+}
+
+func (v *verifyInstall) checkRecoveryImage() {
+	const check = "recovery image"
+
+	recoveryPart := v.state.Partitions[constants.RecoveryPartName]
+	if recoveryPart == nil || recoveryPart.RecoveryImage == nil {
+		v.report.fail(check, "no recovery image in state file")
+		return
+	}
+	path := filepath.Join(v.parts.Recovery.MountPoint, constants.BootPath, constants.RecoveryImgFile)
+	if ok, _ := utils.Exists(v.cfg.Fs, path); !ok {
+		// Legacy location of the recovery image
+		path = filepath.Join(v.parts.Recovery.MountPoint, constants.RecoveryImgFile)
+	}
+	v.checkImage(check, path, recoveryPart.RecoveryImage.Checksum)
+}
+
+// checkImage checks the given image exists and matches the given checksum, if any
+func (v *verifyInstall) checkImage(check, path, checksum string) {
+	if ok, _ := utils.Exists(v.cfg.Fs, path); !ok {
+		v.report.fail(check, "%s not found", path)
+		return
+	}
+	if checksum == "" {
+		v.report.pass(check, "%s found, no checksum recorded", path)
+		return
+	}
+	err := utils.VerifyFileDigest(v.cfg.Fs, path, checksum)
+	if err != nil {
+		v.report.fail(check, "%v", err)
+		return
+	}
+	v.report.pass(check, "%s found, checksum verified", path)
+}
+
+// checkBootloader checks the files written by the configured bootloader are in place
+func (v *verifyInstall) checkBootloader() {
+	const check = "EFI boot entry"
+
+	if v.cfg.Bootloader == constants.BootloaderNone {
+		for _, file := range bootloader.NoneFiles(&v.cfg.Config) {
+			if ok, _ := utils.Exists(v.cfg.Fs, filepath.Join(v.parts.Boot.MountPoint, file)); !ok {
+				v.report.fail("bootloader", "%s not found", file)
+				return
+			}
+		}
+		v.report.pass("bootloader", "kernel, initrd and boot entry found")
+		v.report.pass(check, "owned by the existing bootloader, skipped")
+		return
+	}
+
+	for _, prefix := range bootloader.GrubPrefixes(&v.cfg.Config) {
+		grubCfg := filepath.Join(v.parts.Boot.MountPoint, prefix, constants.GrubCfg)
+		if ok, _ := utils.Exists(v.cfg.Fs, grubCfg); !ok {
+			v.report.fail("bootloader", "%s not found", filepath.Join(prefix, constants.GrubCfg))
+			return
+		}
+	}
+	v.report.pass("bootloader", "grub configuration found")
+
+	if !eleefi.VariablesSupported(v.efivars) {
+		v.report.pass(check, "EFI variables not available, skipped")
+		return
+	}
+	variables, err := v.efivars.ListVariables()
+	if err != nil {
+		v.report.fail(check, "failed listing EFI variables: %v", err)
+		return
+	}
+	for _, desc := range variables {
+		if !bootEntryRegexp.MatchString(desc.Name) {
+			continue
+		}
+		data, _, err := v.efivars.GetVariable(desc.GUID, desc.Name)
+		if err != nil {
+			continue
+		}
+		option, err := efilib.ReadLoadOption(bytes.NewReader(data))
+		if err == nil && option.Description == constants.BootEntryName {
+			v.report.pass(check, "%s entry found as %s", constants.BootEntryName, desc.Name)
+			return
+		}
+	}
+	// Firmwares boot the fallback path if there is no entry
+	fallback, _ := v.cfg.Fs.Glob(filepath.Join(v.parts.Boot.MountPoint, constants.FallbackEFIPath, "*.efi"))
+	if len(fallback) > 0 {
+		v.report.pass(check, "no %s entry found, fallback EFI binaries in place", constants.BootEntryName)
+		return
+	}
+	v.report.fail(check, "no %s entry nor fallback EFI binaries found", constants.BootEntryName)
+}
+
+func (v *verifyInstall) checkOEMConfigs() {
+	const check = "OEM configs"
+
+	files, _ := v.cfg.Fs.Glob(filepath.Join(v.parts.OEM.MountPoint, "*.yaml"))
+	for _, file := range files {
+		data, err := v.cfg.Fs.ReadFile(file)
+		if err != nil {
+			v.report.fail(check, "failed reading %s: %v", filepath.Base(file), err)
+			return
+		}
+		var content interface{}
+		err = yaml.Unmarshal(data, &content)
+		if err != nil {
+			v.report.fail(check, "failed parsing %s: %v", filepath.Base(file), err)
+			return
+		}
+	}
+	v.report.pass(check, "%d configuration files readable", len(files))
+}
+
+// imageChecksum returns the checksum of the given image file, prefixed by the given
+// algorithm, or an empty string if there is no image file, as for btrfs snapshots
+// which are directories
+func imageChecksum(fs types.FS, path string, algo string) (string, error) {
+	if ok, _ := utils.Exists(fs, path); !ok {
+		return "", nil
+	}
+	if dir, _ := utils.IsDir(fs, path); dir {
+		return "", nil
+	}
+	return utils.FileDigest(fs, path, algo)
+}
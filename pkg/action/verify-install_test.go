@@ -0,0 +1,219 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action_test
+
+import (
+	"bytes"
+	"path/filepath"
+
+	efi "github.com/canonical/go-efilib"
+	"github.com/jaypipes/ghw/pkg/block"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v4"
+	"github.com/twpayne/go-vfs/v4/vfst"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/action"
+	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+var _ = Describe("VerifyInstall action", Label("verify-install"), func() {
+	var config *types.RunConfig
+	var runner *mocks.FakeRunner
+	var fs vfs.FS
+	var mounter *mocks.FakeMounter
+	var cleanup func()
+	var ghwTest mocks.GhwMock
+	var efivars *mocks.MockEFIVariables
+	var state *types.InstallState
+	var recoveryImg string
+
+	writeState := func() {
+		Expect(config.WriteInstallState(state, filepath.Join(constants.StateDir, constants.InstallStateFile), "")).To(Succeed())
+	}
+
+	failedChecks := func(report *action.VerifyReport) []string {
+		names := []string{}
+		for _, check := range report.Failed() {
+			names = append(names, check.Name)
+		}
+		return names
+	}
+
+	BeforeEach(func() {
+		runner = mocks.NewFakeRunner()
+		mounter = mocks.NewFakeMounter()
+		logger := types.NewBufferLogger(&bytes.Buffer{})
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).Should(BeNil())
+
+		config = conf.NewRunConfig(
+			conf.WithFs(fs),
+			conf.WithRunner(runner),
+			conf.WithLogger(logger),
+			conf.WithMounter(mounter),
+		)
+
+		mainDisk := block.Disk{
+			Name: "device",
+			Partitions: []*block.Partition{
+				{Name: "device1", FilesystemLabel: constants.BootLabel, Type: "vfat"},
+				{Name: "device2", FilesystemLabel: constants.OEMLabel, Type: "ext4"},
+				{Name: "device3", FilesystemLabel: constants.RecoveryLabel, Type: "ext4"},
+				{Name: "device4", FilesystemLabel: constants.StateLabel, Type: "ext4"},
+				{Name: "device5", FilesystemLabel: constants.PersistentLabel, Type: "ext4"},
+			},
+		}
+		ghwTest = mocks.GhwMock{}
+		ghwTest.AddDisk(mainDisk)
+		ghwTest.CreateDevices()
+
+		// Installed images
+		activeImg := filepath.Join(constants.StateDir, ".snapshots/1/snapshot.img")
+		Expect(utils.MkdirAll(fs, filepath.Dir(activeImg), constants.DirPerm)).To(Succeed())
+		Expect(fs.WriteFile(activeImg, []byte("active"), constants.FilePerm)).To(Succeed())
+		activeSum, err := utils.CalcFileChecksum(fs, activeImg)
+		Expect(err).NotTo(HaveOccurred())
+
+		recoveryImg = filepath.Join(constants.RecoveryDir, constants.BootPath, constants.RecoveryImgFile)
+		Expect(utils.MkdirAll(fs, filepath.Dir(recoveryImg), constants.DirPerm)).To(Succeed())
+		Expect(fs.WriteFile(recoveryImg, []byte("recovery"), constants.FilePerm)).To(Succeed())
+		recoverySum, err := utils.CalcFileChecksum(fs, recoveryImg)
+		Expect(err).NotTo(HaveOccurred())
+
+		// Bootloader and OEM configs
+		for _, prefix := range []string{constants.FallbackEFIPath, constants.EntryEFIPath} {
+			Expect(utils.MkdirAll(fs, filepath.Join(constants.BootDir, prefix), constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile(filepath.Join(constants.BootDir, prefix, constants.GrubCfg), []byte{}, constants.FilePerm)).To(Succeed())
+		}
+		Expect(utils.MkdirAll(fs, constants.OEMDir, constants.DirPerm)).To(Succeed())
+		Expect(fs.WriteFile(filepath.Join(constants.OEMDir, "90_custom.yaml"), []byte("name: custom\n"), constants.FilePerm)).To(Succeed())
+
+		efivars = mocks.NewMockEFIVariables()
+		option := &efi.LoadOption{
+			Attributes:  efi.LoadOptionActive,
+			Description: constants.BootEntryName,
+			FilePath:    efi.DevicePath{efi.NewFilePathDevicePathNode("\\EFI\\ELEMENTAL\\shim.efi")},
+		}
+		data, err := option.Bytes()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(efivars.SetVariable(efi.GlobalVariable, "Boot0001", data, 0)).To(Succeed())
+
+		state = &types.InstallState{
+			Snapshotter: types.NewLoopDevice(),
+			Partitions: map[string]*types.PartitionState{
+				constants.BootPartName:       {FSLabel: constants.BootLabel},
+				constants.OEMPartName:        {FSLabel: constants.OEMLabel},
+				constants.PersistentPartName: {FSLabel: constants.PersistentLabel},
+				constants.StatePartName: {
+					FSLabel: constants.StateLabel,
+					Snapshots: map[int]*types.SystemState{
+						1: {Active: true, Checksum: activeSum},
+					},
+				},
+				constants.RecoveryPartName: {
+					FSLabel:       constants.RecoveryLabel,
+					RecoveryImage: &types.SystemState{Checksum: recoverySum},
+				},
+			},
+		}
+		writeState()
+	})
+	AfterEach(func() {
+		ghwTest.Clean()
+		cleanup()
+	})
+	It("verifies a complete installation", func() {
+		report, err := action.VerifyInstall(config, action.WithVerifyEFIVariables(efivars))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Failed()).To(BeEmpty())
+		Expect(report.Checks).To(ContainElement(action.VerifyCheck{
+			Name: "EFI boot entry", Passed: true, Message: "elemental-shim entry found as Boot0001",
+		}))
+		Expect(report.Checks).To(ContainElement(HaveField("Message", ContainSubstring("checksum verified"))))
+		// Partitions are mounted read-only and released
+		Expect(mounter.List()).To(BeEmpty())
+	})
+	It("accepts images without a recorded checksum", func() {
+		state.Partitions[constants.RecoveryPartName].RecoveryImage.Checksum = ""
+		writeState()
+		Expect(fs.WriteFile(recoveryImg, []byte("upgraded"), constants.FilePerm)).To(Succeed())
+
+		_, err := action.VerifyInstall(config, action.WithVerifyEFIVariables(efivars))
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("accepts the fallback EFI binaries if there is no boot entry", func() {
+		Expect(fs.WriteFile(filepath.Join(constants.BootDir, constants.FallbackEFIPath, "bootx64.efi"), []byte{}, constants.FilePerm)).To(Succeed())
+
+		report, err := action.VerifyInstall(config, action.WithVerifyEFIVariables(mocks.NewMockEFIVariables()))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Checks).To(ContainElement(HaveField("Message", ContainSubstring("fallback EFI binaries in place"))))
+	})
+	It("only checks the vendor EFI path if the removable path is disabled", Label("removable-efi"), func() {
+		config.RemovableEFI = false
+		Expect(fs.Remove(filepath.Join(constants.BootDir, constants.FallbackEFIPath, constants.GrubCfg))).To(Succeed())
+
+		_, err := action.VerifyInstall(config, action.WithVerifyEFIVariables(efivars))
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("checks the kernel and boot entry if there is no bootloader", Label("bootloader-none"), func() {
+		config.Bootloader = constants.BootloaderNone
+		config.KernelInstallPath = "/EFI/Linux/elemental"
+		for _, prefix := range []string{constants.FallbackEFIPath, constants.EntryEFIPath} {
+			Expect(fs.Remove(filepath.Join(constants.BootDir, prefix, constants.GrubCfg))).To(Succeed())
+		}
+		kernelDir := filepath.Join(constants.BootDir, config.KernelInstallPath)
+		Expect(utils.MkdirAll(fs, kernelDir, constants.DirPerm)).To(Succeed())
+		for _, name := range []string{"vmlinuz", "initrd"} {
+			Expect(fs.WriteFile(filepath.Join(kernelDir, name), []byte{}, constants.FilePerm)).To(Succeed())
+		}
+
+		report, err := action.VerifyInstall(config, action.WithVerifyEFIVariables(mocks.NewMockEFIVariables()))
+		Expect(err).To(HaveOccurred())
+		Expect(failedChecks(report)).To(ConsistOf("bootloader"))
+
+		Expect(fs.WriteFile(filepath.Join(kernelDir, "elemental.conf"), []byte{}, constants.FilePerm)).To(Succeed())
+		report, err = action.VerifyInstall(config, action.WithVerifyEFIVariables(mocks.NewMockEFIVariables()))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Checks).To(ContainElement(HaveField("Message", "kernel, initrd and boot entry found")))
+	})
+	It("reports all the failed checks", func() {
+		Expect(fs.WriteFile(recoveryImg, []byte("corrupted"), constants.FilePerm)).To(Succeed())
+		Expect(fs.Remove(filepath.Join(constants.BootDir, constants.EntryEFIPath, constants.GrubCfg))).To(Succeed())
+		Expect(fs.WriteFile(filepath.Join(constants.OEMDir, "91_broken.yaml"), []byte("name: [broken"), constants.FilePerm)).To(Succeed())
+		state.Partitions[constants.PersistentPartName].FSLabel = "MY_PERSISTENT"
+		writeState()
+
+		report, err := action.VerifyInstall(config, action.WithVerifyEFIVariables(efivars))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("4 of"))
+		Expect(failedChecks(report)).To(ConsistOf("persistent partition", "recovery image", "bootloader", "OEM configs"))
+		Expect(mounter.List()).To(BeEmpty())
+	})
+	It("fails if there is no state file", func() {
+		Expect(fs.Remove(filepath.Join(constants.StateDir, constants.InstallStateFile))).To(Succeed())
+
+		report, err := action.VerifyInstall(config, action.WithVerifyEFIVariables(efivars))
+		Expect(err).To(HaveOccurred())
+		Expect(failedChecks(report)).To(ConsistOf(constants.InstallStateFile))
+	})
+})
@@ -0,0 +1,116 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package atomicfile writes files so that after a power loss they are either fully
+// written or left unchanged. It has no dependencies on other elemental packages, so
+// it can be used from any of them.
+package atomicfile
+
+import (
+	"errors"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FS is the subset of the filesystem interface required to write files atomically
+type FS interface {
+	Open(name string) (fs.File, error)
+	OpenFile(name string, flag int, perm fs.FileMode) (*os.File, error)
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+}
+
+// WriteFile writes data to a temporary file next to filename and renames it
+// once synced to disk, so after a power loss filename is either fully written or
+// left unchanged. Each write has its own temporary file, so concurrent writes of
+// the same file never mix, the last one renamed wins.
+func WriteFile(vfs FS, filename string, data []byte, perm fs.FileMode) error {
+	f, tmp, err := createTemp(vfs, filename, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		_ = vfs.Remove(tmp)
+		return err
+	}
+	return SyncAndRename(vfs, tmp, filename)
+}
+
+// createTemp creates a new temporary file next to filename, named as TempName with
+// a random suffix
+func createTemp(vfs FS, filename string, perm fs.FileMode) (*os.File, string, error) {
+	for {
+		suffix := strconv.FormatUint(uint64(rand.Uint32()), 36)
+		tmp := strings.TrimSuffix(TempName(filename), ".tmp") + "." + suffix + ".tmp"
+		f, err := vfs.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		return f, tmp, err
+	}
+}
+
+// SyncAndRename syncs oldpath to disk, renames it to newpath and syncs the parent
+// directory of newpath, so the rename itself survives a power loss. oldpath is
+// removed on failure.
+func SyncAndRename(vfs FS, oldpath, newpath string) (err error) {
+	defer func() {
+		if err != nil {
+			_ = vfs.Remove(oldpath)
+		}
+	}()
+
+	f, err := vfs.OpenFile(oldpath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = vfs.Rename(oldpath, newpath)
+	if err != nil {
+		return err
+	}
+
+	dir, err := vfs.Open(filepath.Dir(newpath))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if d, ok := dir.(interface{ Sync() error }); ok {
+		return d.Sync()
+	}
+	return nil
+}
+
+// TempName returns the name of a temporary file to stage filename before it is renamed
+// into place with SyncAndRename
+func TempName(filename string) string {
+	return filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+}
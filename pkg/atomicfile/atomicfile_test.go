@@ -0,0 +1,73 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package atomicfile_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v4/vfst"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/atomicfile"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+)
+
+var _ = Describe("atomicfile", Label("atomic"), func() {
+	var fs *vfst.TestFS
+	var cleanup func()
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+			"/etc/config.yaml": &vfst.File{Contents: []byte("old"), Perm: constants.FilePerm},
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		cleanup()
+	})
+	It("replaces the file and leaves no temporary file behind", func() {
+		Expect(atomicfile.WriteFile(fs, "/etc/config.yaml", []byte("new"), 0600)).To(Succeed())
+		data, err := fs.ReadFile("/etc/config.yaml")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(data)).To(Equal("new"))
+		Expect(fs.Glob("/etc/.config.yaml*")).To(BeEmpty())
+	})
+	It("keeps the file complete on concurrent writes", func() {
+		done := make(chan error)
+		for _, data := range []string{"first", "second", "third"} {
+			go func(data string) {
+				done <- atomicfile.WriteFile(fs, "/etc/config.yaml", []byte(data), 0600)
+			}(data)
+		}
+		for range 3 {
+			Expect(<-done).To(Succeed())
+		}
+		data, err := fs.ReadFile("/etc/config.yaml")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(data)).To(BeElementOf("first", "second", "third"))
+		Expect(fs.Glob("/etc/.config.yaml*")).To(BeEmpty())
+	})
+	It("fails and keeps no temporary file if the directory does not exist", func() {
+		Expect(atomicfile.WriteFile(fs, "/missing/config.yaml", []byte("new"), 0600)).NotTo(Succeed())
+		Expect(fs.Glob("/missing/.config.yaml*")).To(BeEmpty())
+	})
+	It("fails to rename a non existing file", func() {
+		Expect(atomicfile.SyncAndRename(fs, "/etc/nonexisting", "/etc/config.yaml")).NotTo(Succeed())
+		data, err := fs.ReadFile("/etc/config.yaml")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(data)).To(Equal("old"))
+	})
+})
@@ -19,9 +19,14 @@ package bootloader
 import (
 	"bytes"
 	"fmt"
+	"io/fs"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"strings"
+	"text/template"
 
+	"github.com/rancher/elemental-toolkit/v2/pkg/atomicfile"
 	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
 	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
@@ -40,6 +45,15 @@ var (
 	defaultGrubPrefixes = []string{constants.FallbackEFIPath, constants.EntryEFIPath}
 )
 
+// GrubPrefixes returns the paths within the EFI partition grub is installed to
+func GrubPrefixes(cfg *types.Config) []string {
+	if !cfg.RemovableEFI {
+		// Only the vendor path, booted from the EFI boot entry
+		return []string{constants.EntryEFIPath}
+	}
+	return defaultGrubPrefixes
+}
+
 func getGModulePatterns(module string) []string {
 	var patterns []string
 	for _, pattern := range constants.GetDefaultGrubModulesPatterns() {
@@ -60,17 +74,47 @@ type Grub struct {
 
 	grubPrefixes       []string
 	configFile         string
+	theme              string
+	template           string
+	templateData       GrubTemplateData
 	elementalCfg       string
 	legacyElementalCfg string
 	disableBootEntry   bool
 	clearBootEntry     bool
 	secureBoot         bool
+	stripCmdlineKeys   []string
 }
 
 var _ types.Bootloader = (*Grub)(nil)
 
 type GrubOptions func(g *Grub) error
 
+// GrubTemplateData holds the variables available to custom grub config templates
+type GrubTemplateData struct {
+	// Labels includes all the variables set in the grub OEM environment file, as in
+	// {{ index .Labels "state_label" }}
+	Labels          map[string]string
+	StateLabel      string
+	RecoveryLabel   string
+	OEMLabel        string
+	PersistentLabel string
+	MenuName        string
+	Snapshotter     string
+}
+
+// NewGrubTemplateData returns the template data for the given grub environment labels
+func NewGrubTemplateData(labels map[string]string, menuName, snapshotter string) GrubTemplateData {
+	return GrubTemplateData{
+		Labels:          labels,
+		StateLabel:      labels["state_label"],
+		RecoveryLabel:   labels["recovery_label"],
+		OEMLabel:        labels["oem_label"],
+		PersistentLabel: labels["persistent_label"],
+		MenuName:        menuName,
+		Snapshotter:     snapshotter,
+	}
+}
+
 func NewGrub(cfg *types.Config, opts ...GrubOptions) *Grub {
 	secureBoot := true
 	if cfg.Platform.Arch == constants.ArchRiscV64 {
@@ -83,11 +127,14 @@ func NewGrub(cfg *types.Config, opts ...GrubOptions) *Grub {
 		runner:             cfg.Runner,
 		platform:           cfg.Platform,
 		configFile:         grubCfgFile,
-		grubPrefixes:       defaultGrubPrefixes,
+		grubPrefixes:       GrubPrefixes(cfg),
 		elementalCfg:       filepath.Join(constants.GrubCfgPath, constants.GrubCfg),
 		legacyElementalCfg: filepath.Join(constants.LegacyGrubCfgPath, constants.GrubCfg),
 		clearBootEntry:     true,
 		secureBoot:         secureBoot,
+		theme:              cfg.GrubTheme,
+		template:           cfg.GrubTemplate,
+		stripCmdlineKeys:   cfg.StripCmdlineKeys,
 	}
 
 	for _, o := range opts {
@@ -144,6 +191,14 @@ func WithGrubAutoDisableBootEntry() func(g *Grub) error {
 	}
 }
 
+// WithGrubTemplateData sets the variables to render the configured grub config template with
+func WithGrubTemplateData(data GrubTemplateData) func(g *Grub) error {
+	return func(g *Grub) error {
+		g.templateData = data
+		return nil
+	}
+}
+
 func WithGrubClearBootEntry(clearBootEntry bool) func(g *Grub) error {
 	return func(g *Grub) error {
 		g.clearBootEntry = clearBootEntry
@@ -372,6 +427,9 @@ func (g *Grub) SetPersistentVariables(grubEnvFile string, vars map[string]string
 	}
 
 	for key, value := range vars {
+		if strings.HasSuffix(key, "cmdline") {
+			value = stripCmdline(value, g.stripCmdlineKeys)
+		}
 		g.logger.Debugf("Running %s with params: %s set %s=%s", cmd, grubEnvFile, key, value)
 		out, err := g.runner.Run(cmd, grubEnvFile, "set", fmt.Sprintf("%s=%s", key, value))
 		if err != nil {
@@ -418,6 +476,10 @@ func (g *Grub) Install(rootDir, bootDir string) (err error) {
 		return err
 	}
 
+	if g.disableBootEntry && !slices.Contains(g.grubPrefixes, constants.FallbackEFIPath) {
+		g.logger.Warnf("neither the removable EFI path nor a boot entry are written, the system might not boot")
+	}
+
 	if !g.disableBootEntry {
 		image := g.grubEfiImg
 		if g.secureBoot {
@@ -436,30 +498,198 @@ func (g *Grub) Install(rootDir, bootDir string) (err error) {
 // rootDir is the root of the OS image, bootDir is the folder grub read the
 // configuration from, usually EFI partition mountpoint
 func (g Grub) InstallConfig(rootDir, bootDir string) error {
-	for _, path := range g.grubPrefixes {
-		grubFile := filepath.Join(rootDir, g.elementalCfg)
-		if exists, _ := utils.Exists(g.fs, grubFile); !exists {
-			grubFile = filepath.Join(rootDir, g.legacyElementalCfg)
-			g.logger.Warnf("Grub config not found, using legacy config: %s", grubFile)
+	var rendered []byte
+	if g.template != "" {
+		var err error
+		rendered, err = g.renderTemplate()
+		if err != nil {
+			return err
 		}
+	}
 
+	for _, path := range g.grubPrefixes {
 		dstGrubFile := filepath.Join(bootDir, path, g.configFile)
 
-		g.logger.Infof("Using grub config file %s", grubFile)
-
 		// Create Needed dir under state partition to store the grub.cfg and any needed modules
 		err := utils.MkdirAll(g.fs, filepath.Join(bootDir, path), constants.DirPerm)
 		if err != nil {
 			return fmt.Errorf("error creating grub dir: %s", err)
 		}
 
+		if rendered != nil {
+			g.logger.Infof("Writing grub config file rendered from %s to %s", g.template, dstGrubFile)
+			err = atomicfile.WriteFile(g.fs, dstGrubFile, stripGrubCmdlines(rendered, g.stripCmdlineKeys), constants.FilePerm)
+			if err != nil {
+				g.logger.Errorf("Failed writing grub config file: %s", err)
+				return err
+			}
+			continue
+		}
+
+		grubFile := filepath.Join(rootDir, g.elementalCfg)
+		if exists, _ := utils.Exists(g.fs, grubFile); !exists {
+			grubFile = filepath.Join(rootDir, g.legacyElementalCfg)
+			g.logger.Warnf("Grub config not found, using legacy config: %s", grubFile)
+		}
+
+		g.logger.Infof("Using grub config file %s", grubFile)
+		if len(g.stripCmdlineKeys) > 0 {
+			data, err := g.fs.ReadFile(grubFile)
+			if err != nil {
+				g.logger.Errorf("Failed reading grub config file: %s", err)
+				return err
+			}
+			g.logger.Infof("Writing grub config file from %s to %s stripping cmdline keys %v", grubFile, dstGrubFile, g.stripCmdlineKeys)
+			err = atomicfile.WriteFile(g.fs, dstGrubFile, stripGrubCmdlines(data, g.stripCmdlineKeys), constants.FilePerm)
+			if err != nil {
+				g.logger.Errorf("Failed writing grub config file: %s", err)
+				return err
+			}
+			continue
+		}
 		g.logger.Infof("Copying grub config file from %s to %s", grubFile, dstGrubFile)
-		err = utils.CopyFile(g.fs, grubFile, dstGrubFile)
+		tmpGrubFile := atomicfile.TempName(dstGrubFile)
+		err = utils.CopyFile(g.fs, grubFile, tmpGrubFile)
+		if err != nil {
+			_ = g.fs.Remove(tmpGrubFile)
+		} else {
+			err = atomicfile.SyncAndRename(g.fs, tmpGrubFile, dstGrubFile)
+		}
 		if err != nil {
 			g.logger.Errorf("Failed copying grub config file: %s", err)
 			return err
 		}
 	}
 
-	return nil
+	return g.installTheme(rootDir, bootDir)
+}
+
+// grubSetCmdline matches grub variable assignments, such as set kernelcmd="...", of the kernel cmdline
+var grubSetCmdline = regexp.MustCompile(`^(\s*set\s+\w*cmd\w*=)("?)([^"]*)("?)(.*)$`)
+
+// stripGrubCmdlines removes the given kernel cmdline keys from the linux commands and the
+// cmdline variable assignments of the given grub config
+func stripGrubCmdlines(config []byte, keys []string) []byte {
+	if len(keys) == 0 {
+		return config
+	}
+	lines := strings.Split(string(config), "\n")
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) > 2 && (fields[0] == "linux" || fields[0] == "linuxefi"):
+			indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+			lines[i] = indent + fields[0] + " " + fields[1]
+			if args := stripCmdline(strings.Join(fields[2:], " "), keys); args != "" {
+				lines[i] += " " + args
+			}
+		case grubSetCmdline.MatchString(line):
+			m := grubSetCmdline.FindStringSubmatch(line)
+			lines[i] = m[1] + m[2] + stripCmdline(m[3], keys) + m[4] + m[5]
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// stripCmdline removes the arguments of the given keys, with or without value, from the cmdline
+func stripCmdline(cmdline string, keys []string) string {
+	if len(keys) == 0 {
+		return cmdline
+	}
+	var args []string
+	for _, arg := range strings.Fields(cmdline) {
+		key, _, _ := strings.Cut(arg, "=")
+		if !slices.Contains(keys, key) {
+			args = append(args, arg)
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+// renderTemplate renders the configured grub config template, read from the host, with
+// the template data of the bootloader
+func (g Grub) renderTemplate() ([]byte, error) {
+	data, err := g.fs.ReadFile(g.template)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading grub template %s: %w", g.template, err)
+	}
+	tmpl, err := template.New(filepath.Base(g.template)).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing grub template %s: %w", g.template, err)
+	}
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, g.templateData)
+	if err != nil {
+		return nil, fmt.Errorf("failed rendering grub template %s: %w", g.template, err)
+	}
+	return out.Bytes(), nil
+}
+
+// installTheme copies the configured grub theme or splash image from the OS image into
+// the bootDir and writes the grub config file loading it. A missing theme is not an error.
+func (g Grub) installTheme(rootDir, bootDir string) error {
+	if g.theme == "" {
+		return nil
+	}
+
+	src := filepath.Join(rootDir, g.theme)
+	info, err := g.fs.Stat(src)
+	if err != nil {
+		g.logger.Warnf("Grub theme %s not found in the image, skipping it", g.theme)
+		return nil
+	}
+
+	if ok, _ := utils.Exists(g.fs, filepath.Join(src, constants.GrubThemeFile)); info.IsDir() && !ok {
+		g.logger.Warnf("Grub theme %s does not include a %s file, skipping it", g.theme, constants.GrubThemeFile)
+		return nil
+	}
+
+	name := filepath.Base(src)
+	themeDir := filepath.Join(bootDir, constants.GrubThemesDir, name)
+	// Drop any previous theme, the boot partition is not meant to accumulate them
+	err = g.fs.RemoveAll(filepath.Join(bootDir, constants.GrubThemesDir))
+	if err != nil {
+		return fmt.Errorf("failed removing previous grub themes: %w", err)
+	}
+
+	var cfg strings.Builder
+	cfg.WriteString("insmod png\ninsmod jpeg\ninsmod tga\nset gfxmode=auto\nterminal_output gfxterm\n")
+	if info.IsDir() {
+		var fonts []string
+		err = utils.WalkDirFs(g.fs, src, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(src, path)
+			target := filepath.Join(themeDir, rel)
+			if d.IsDir() {
+				return utils.MkdirAll(g.fs, target, constants.DirPerm)
+			}
+			if filepath.Ext(path) == ".pf2" {
+				fonts = append(fonts, filepath.Join("/", constants.GrubThemesDir, name, rel))
+			}
+			return utils.CopyFile(g.fs, path, target)
+		})
+		if err != nil {
+			return fmt.Errorf("failed copying grub theme: %w", err)
+		}
+		for _, font := range fonts {
+			cfg.WriteString(fmt.Sprintf("loadfont %s\n", font))
+		}
+		cfg.WriteString(fmt.Sprintf("set theme=%s\nexport theme\n", filepath.Join("/", constants.GrubThemesDir, name, constants.GrubThemeFile)))
+	} else {
+		// A single image is used as the splash background of the default menu
+		err = utils.MkdirAll(g.fs, themeDir, constants.DirPerm)
+		if err == nil {
+			err = utils.CopyFile(g.fs, src, themeDir)
+		}
+		if err != nil {
+			return fmt.Errorf("failed copying grub splash: %w", err)
+		}
+		cfg.WriteString(fmt.Sprintf("background_image %s\n", filepath.Join("/", constants.GrubThemesDir, name, name)))
+	}
+
+	themeCfg := filepath.Join(bootDir, constants.GrubThemeCfg)
+	g.logger.Infof("Installing grub theme %s to %s", g.theme, themeDir)
+	return atomicfile.WriteFile(g.fs, themeCfg, []byte(cfg.String()), constants.FilePerm)
 }
@@ -222,6 +222,117 @@ var _ = Describe("Booloader", Label("bootloader", "grub"), func() {
 		Expect(data).To(Equal(grubCfg))
 	})
 
+	It("installs grub.cfg stripping the configured cmdline keys", Label("strip-cmdline"), func() {
+		Expect(fs.WriteFile(filepath.Join(rootDir, constants.GrubCfgPath, constants.GrubCfg), []byte(
+			"set kernelcmd=\"console=tty1 rd.hint=/dev/sda root=LABEL=STATE\"\n"+
+				"menuentry \"os\" {\n  linux /vmlinuz ${kernelcmd} rd.hint rd.neednet=1 quiet\n}\n",
+		), constants.FilePerm)).To(Succeed())
+
+		cfg.StripCmdlineKeys = []string{"rd.hint", "rd.neednet"}
+		grub = bootloader.NewGrub(cfg, bootloader.WithGrubDisableBootEntry(true))
+		Expect(grub.InstallConfig(rootDir, efiDir)).To(Succeed())
+
+		for _, path := range []string{"EFI/BOOT/grub.cfg", "EFI/ELEMENTAL/grub.cfg"} {
+			data, err := fs.ReadFile(filepath.Join(efiDir, path))
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(Equal(
+				"set kernelcmd=\"console=tty1 root=LABEL=STATE\"\n" +
+					"menuentry \"os\" {\n  linux /vmlinuz ${kernelcmd} quiet\n}\n",
+			))
+		}
+	})
+
+	It("strips the configured cmdline keys from cmdline grub variables", Label("strip-cmdline"), func() {
+		cfg.StripCmdlineKeys = []string{"rd.hint"}
+		grub = bootloader.NewGrub(cfg, bootloader.WithGrubDisableBootEntry(true))
+		Expect(grub.SetPersistentVariables(
+			"somefile", map[string]string{"extra_cmdline": "rd.hint=/dev/sda quiet", "label": "rd.hint"},
+		)).To(Succeed())
+		Expect(runner.IncludesCmds([][]string{
+			{"grub2-editenv", "somefile", "set", "extra_cmdline=quiet"},
+			{"grub2-editenv", "somefile", "set", "label=rd.hint"},
+		})).To(Succeed())
+	})
+
+	It("installs grub.cfg rendered from a custom template", Label("template"), func() {
+		Expect(fs.WriteFile("/grub.cfg.tmpl", []byte(
+			"menuentry \"{{ .MenuName }}\" {\n  search --label {{ .StateLabel }}\n}\n# {{ index .Labels \"oem_label\" }}\n",
+		), constants.FilePerm)).To(Succeed())
+
+		cfg.GrubTemplate = "/grub.cfg.tmpl"
+		grub = bootloader.NewGrub(cfg,
+			bootloader.WithGrubDisableBootEntry(true),
+			bootloader.WithGrubTemplateData(bootloader.NewGrubTemplateData(
+				map[string]string{"state_label": "MY_STATE", "oem_label": "MY_OEM"}, "MyOS", constants.LoopDeviceSnapshotterType,
+			)),
+		)
+		Expect(grub.InstallConfig(rootDir, efiDir)).To(Succeed())
+
+		for _, path := range []string{"EFI/BOOT/grub.cfg", "EFI/ELEMENTAL/grub.cfg"} {
+			data, err := fs.ReadFile(filepath.Join(efiDir, path))
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(Equal("menuentry \"MyOS\" {\n  search --label MY_STATE\n}\n# MY_OEM\n"))
+		}
+	})
+
+	It("fails to install grub.cfg from an invalid template", Label("template"), func() {
+		Expect(fs.WriteFile("/grub.cfg.tmpl", []byte("{{ .Unknown }}"), constants.FilePerm)).To(Succeed())
+
+		cfg.GrubTemplate = "/grub.cfg.tmpl"
+		grub = bootloader.NewGrub(cfg, bootloader.WithGrubDisableBootEntry(true))
+		Expect(grub.InstallConfig(rootDir, efiDir)).To(MatchError(ContainSubstring("failed rendering grub template")))
+
+		cfg.GrubTemplate = "/missing.tmpl"
+		grub = bootloader.NewGrub(cfg, bootloader.WithGrubDisableBootEntry(true))
+		Expect(grub.InstallConfig(rootDir, efiDir)).To(MatchError(ContainSubstring("failed reading grub template")))
+	})
+
+	It("installs the grub theme from the image", Label("theme"), func() {
+		themeDir := filepath.Join(rootDir, "/usr/share/grub2/themes/brand")
+		Expect(utils.MkdirAll(fs, filepath.Join(themeDir, "icons"), constants.DirPerm)).To(Succeed())
+		Expect(fs.WriteFile(filepath.Join(themeDir, "theme.txt"), []byte("desktop-image: \"splash.png\""), constants.FilePerm)).To(Succeed())
+		Expect(fs.WriteFile(filepath.Join(themeDir, "splash.png"), []byte("png"), constants.FilePerm)).To(Succeed())
+		Expect(fs.WriteFile(filepath.Join(themeDir, "icons/elemental.png"), []byte("png"), constants.FilePerm)).To(Succeed())
+		Expect(fs.WriteFile(filepath.Join(themeDir, "sans.pf2"), []byte("font"), constants.FilePerm)).To(Succeed())
+
+		cfg.GrubTheme = "/usr/share/grub2/themes/brand"
+		grub = bootloader.NewGrub(cfg, bootloader.WithGrubDisableBootEntry(true))
+		Expect(grub.InstallConfig(rootDir, efiDir)).To(Succeed())
+
+		_, err = fs.Stat(filepath.Join(efiDir, "themes/brand/icons/elemental.png"))
+		Expect(err).To(BeNil())
+		data, err := fs.ReadFile(filepath.Join(efiDir, constants.GrubThemeCfg))
+		Expect(err).To(BeNil())
+		Expect(string(data)).To(ContainSubstring("loadfont /themes/brand/sans.pf2\n"))
+		Expect(string(data)).To(ContainSubstring("set theme=/themes/brand/theme.txt\n"))
+	})
+
+	It("installs a splash image as the grub background", Label("theme"), func() {
+		Expect(fs.WriteFile(filepath.Join(rootDir, "splash.png"), []byte("png"), constants.FilePerm)).To(Succeed())
+
+		cfg.GrubTheme = "/splash.png"
+		grub = bootloader.NewGrub(cfg, bootloader.WithGrubDisableBootEntry(true))
+		Expect(grub.InstallConfig(rootDir, efiDir)).To(Succeed())
+
+		_, err = fs.Stat(filepath.Join(efiDir, "themes/splash.png/splash.png"))
+		Expect(err).To(BeNil())
+		data, err := fs.ReadFile(filepath.Join(efiDir, constants.GrubThemeCfg))
+		Expect(err).To(BeNil())
+		Expect(string(data)).To(ContainSubstring("background_image /themes/splash.png/splash.png\n"))
+	})
+
+	It("warns and carries on if the grub theme is missing", Label("theme"), func() {
+		memLog := &bytes.Buffer{}
+		cfg.Logger = types.NewBufferLogger(memLog)
+		cfg.GrubTheme = "/usr/share/grub2/themes/missing"
+		grub = bootloader.NewGrub(cfg, bootloader.WithGrubDisableBootEntry(true))
+		Expect(grub.InstallConfig(rootDir, efiDir)).To(Succeed())
+
+		ok, _ := utils.Exists(fs, filepath.Join(efiDir, constants.GrubThemeCfg))
+		Expect(ok).To(BeFalse())
+		Expect(memLog.String()).To(ContainSubstring("not found"))
+	})
+
 	It("fails to install grub.cfg without write permissions", func() {
 		cfg.Fs = vfs.NewReadOnlyFS(fs)
 		grub = bootloader.NewGrub(cfg, bootloader.WithGrubDisableBootEntry(true))
@@ -267,6 +378,19 @@ var _ = Describe("Booloader", Label("bootloader", "grub"), func() {
 		Expect(err).To(BeNil())
 	})
 
+	It("installs EFI binaries only at the vendor path if the removable path is disabled", Label("removable-efi"), func() {
+		cfg.RemovableEFI = false
+		grub = bootloader.NewGrub(cfg, bootloader.WithGrubDisableBootEntry(true))
+		Expect(grub.InstallEFI(rootDir, efiDir)).To(Succeed())
+
+		_, err = fs.Stat(filepath.Join(efiDir, "EFI/ELEMENTAL/shim.efi"))
+		Expect(err).To(BeNil())
+		_, err = fs.Stat(filepath.Join(efiDir, "EFI/ELEMENTAL/grub.efi"))
+		Expect(err).To(BeNil())
+		_, err = fs.Stat(filepath.Join(efiDir, "EFI/BOOT"))
+		Expect(err).NotTo(BeNil())
+	})
+
 	It("fails to install EFI binaries if some module is missing", func() {
 		grub = bootloader.NewGrub(cfg, bootloader.WithGrubDisableBootEntry(true))
 		Expect(fs.Remove(filepath.Join(rootDir, "/usr/share/grub2/x86_64-efi/xzio.mod"))).To(Succeed())
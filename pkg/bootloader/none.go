@@ -0,0 +1,393 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bootloader
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/atomicfile"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+const (
+	noneCfgFile    = "elemental.conf"
+	noneEnvFile    = "elemental.env"
+	noneKernelFile = "vmlinuz"
+	noneInitrdFile = "initrd"
+)
+
+// None is the bootloader used when the system is chainloaded from an already existing
+// bootloader. It does not install any bootloader binary nor EFI entry, it only copies
+// the kernel, the initrd and a minimal boot entry to the configured kernel install path.
+type None struct {
+	cfg          *types.Config
+	installPath  string
+	templateData GrubTemplateData
+	// Variables of the boot entry, the equivalent of the grub environment
+	vars     map[string]string
+	bootDir  string
+	bootargs [][]byte
+	// Temporary files, by destination, renamed into place on Commit
+	staging bool
+	staged  map[string]string
+}
+
+var _ types.Bootloader = (*None)(nil)
+
+// NewNone returns a bootloader copying the kernel and initrd to the configured kernel
+// install path, the template data provides the labels of the kernel command line
+func NewNone(cfg *types.Config, data GrubTemplateData) *None {
+	vars := map[string]string{}
+	for k, v := range data.Labels {
+		vars[k] = v
+	}
+	return &None{
+		cfg:          cfg,
+		installPath:  cfg.KernelInstallPath,
+		templateData: data,
+		vars:         vars,
+		staged:       map[string]string{},
+	}
+}
+
+// NoneFiles returns the paths within the boot directory of the files installed by the
+// none bootloader
+func NoneFiles(cfg *types.Config) []string {
+	var files []string
+	for _, name := range []string{noneKernelFile, noneInitrdFile, noneCfgFile} {
+		files = append(files, filepath.Join(cfg.KernelInstallPath, name))
+	}
+	return files
+}
+
+// Install copies the kernel, the initrd and the boot entry into the bootDir
+func (n *None) Install(rootDir, bootDir string) error {
+	return n.InstallConfig(rootDir, bootDir)
+}
+
+// InstallConfig copies the kernel and initrd of the OS image at rootDir to the kernel install
+// path within bootDir, usually the EFI partition mountpoint, and writes a boot loader
+// specification entry next to them for the existing bootloader to pick up
+func (n *None) InstallConfig(rootDir, bootDir string) error {
+	err := n.Stage(rootDir, bootDir)
+	if err != nil {
+		n.Discard()
+		return err
+	}
+	return n.Commit()
+}
+
+// Stage copies the kernel, the initrd and the boot entry of the OS image at rootDir to
+// temporary files within the kernel install path. The running system keeps booting the
+// current kernel until the staged files are renamed into place by Commit. Any later
+// SetPersistentVariables call is also staged.
+func (n *None) Stage(rootDir, bootDir string) error {
+	kernel, initrd, err := elemental.FindKernelInitrd(*n.cfg, rootDir)
+	if err != nil {
+		return fmt.Errorf("failed finding kernel and initrd: %w", err)
+	}
+
+	dstDir := filepath.Join(bootDir, n.installPath)
+	err = utils.MkdirAll(n.cfg.Fs, dstDir, constants.DirPerm)
+	if err != nil {
+		return fmt.Errorf("failed creating kernel install path: %w", err)
+	}
+
+	n.bootDir = bootDir
+	n.staging = true
+	err = n.loadEnv()
+	if err != nil {
+		return err
+	}
+
+	n.bootargs = nil
+	for _, path := range []string{constants.LegacyGrubCfgPath, constants.GrubCfgPath} {
+		data, err := n.cfg.Fs.ReadFile(filepath.Join(rootDir, path, constants.BootargsCfg))
+		if err == nil {
+			n.bootargs = append(n.bootargs, data)
+		}
+	}
+
+	for src, dst := range map[string]string{kernel: noneKernelFile, initrd: noneInitrdFile} {
+		dstFile := filepath.Join(dstDir, dst)
+		n.cfg.Logger.Infof("Copying %s to %s", src, dstFile)
+		tmpFile := atomicfile.TempName(dstFile)
+		err = utils.CopyFile(n.cfg.Fs, src, tmpFile)
+		if err != nil {
+			_ = n.cfg.Fs.Remove(tmpFile)
+			return fmt.Errorf("failed copying %s: %w", src, err)
+		}
+		n.staged[dstFile] = tmpFile
+	}
+
+	return n.writeEntry()
+}
+
+// Commit renames the staged files into place, the kernel and initrd first
+func (n *None) Commit() error {
+	dstDir := filepath.Join(n.bootDir, n.installPath)
+	order := []string{noneKernelFile, noneInitrdFile, noneEnvFile, noneCfgFile}
+	for _, name := range order {
+		dst := filepath.Join(dstDir, name)
+		tmp, ok := n.staged[dst]
+		if !ok {
+			continue
+		}
+		err := atomicfile.SyncAndRename(n.cfg.Fs, tmp, dst)
+		if err != nil {
+			return fmt.Errorf("failed installing %s: %w", dst, err)
+		}
+		delete(n.staged, dst)
+	}
+	n.staging = false
+	return nil
+}
+
+// Discard removes the staged files, the installed kernel, initrd and boot entry are kept
+func (n *None) Discard() {
+	for dst, tmp := range n.staged {
+		_ = n.cfg.Fs.Remove(tmp)
+		delete(n.staged, dst)
+	}
+	n.staging = false
+}
+
+// write atomically writes the given file, while staging it is written to a temporary file
+func (n *None) write(dst string, data []byte) error {
+	if !n.staging {
+		return atomicfile.WriteFile(n.cfg.Fs, dst, data, constants.FilePerm)
+	}
+	tmp := atomicfile.TempName(dst)
+	err := n.cfg.Fs.WriteFile(tmp, data, constants.FilePerm)
+	if err != nil {
+		_ = n.cfg.Fs.Remove(tmp)
+		return err
+	}
+	n.staged[dst] = tmp
+	return nil
+}
+
+// loadEnv reads the variables kept by previous installs, such as the RAID array UUID,
+// the variables already set take precedence
+func (n *None) loadEnv() error {
+	data, err := n.cfg.Fs.ReadFile(filepath.Join(n.bootDir, n.installPath, noneEnvFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed reading boot entry variables: %w", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if _, set := n.vars[key]; ok && !set {
+			n.vars[key] = value
+		}
+	}
+	return nil
+}
+
+// writeEntry writes the boot entry of the active system
+func (n *None) writeEntry() error {
+	cfgFile := filepath.Join(n.bootDir, n.installPath, noneCfgFile)
+	n.cfg.Logger.Infof("Writing boot entry %s", cfgFile)
+	err := n.write(cfgFile, []byte(n.bootEntry()))
+	if err != nil {
+		return fmt.Errorf("failed writing boot entry: %w", err)
+	}
+	return nil
+}
+
+// bootEntry renders the boot entry of the active system. As the elemental grub configuration
+// does for the active entry, the kernel command line is evaluated from the bootargs.cfg of the
+// image with the boot entry variables, followed by the extra cmdline variables.
+func (n None) bootEntry() string {
+	data := n.templateData
+	vars := map[string]string{}
+	for k, v := range n.vars {
+		vars[k] = v
+	}
+	vars["mode"] = "active"
+	vars["snapshotter"] = data.Snapshotter
+	for _, script := range n.bootargs {
+		evalGrubScript(script, vars)
+	}
+
+	kernelcmd := vars["kernelcmd"]
+	if kernelcmd == "" {
+		kernelcmd = defaultKernelCmd(vars)
+	}
+	cmdline := strings.Join(strings.Fields(strings.Join([]string{
+		kernelcmd, vars["extra_cmdline"], vars["extra_active_cmdline"],
+	}, " ")), " ")
+	cmdline = stripCmdline(cmdline, n.cfg.StripCmdlineKeys)
+
+	title := data.MenuName
+	if title == "" {
+		title = "Elemental"
+	}
+	path := filepath.Join("/", n.installPath)
+	return fmt.Sprintf(
+		"title %s\nlinux %s\ninitrd %s\noptions %s\n", title,
+		filepath.Join(path, noneKernelFile), filepath.Join(path, noneInitrdFile), cmdline,
+	)
+}
+
+// defaultKernelCmd returns the active kernel command line of the default bootargs.cfg, used
+// for images not shipping any
+func defaultKernelCmd(vars map[string]string) string {
+	cmdline := []string{"console=tty1", "console=ttyS0", fmt.Sprintf("root=LABEL=%s", vars["state_label"])}
+	if vars["raid_uuid"] != "" {
+		cmdline = append(cmdline, fmt.Sprintf("rd.md.uuid=%s", vars["raid_uuid"]))
+	}
+	if vars["snapshotter"] == constants.BtrfsSnapshotterType {
+		cmdline = append(cmdline, "elemental.snapshotter=btrfs")
+	}
+	return strings.Join(append(
+		cmdline, "elemental.mode=active", fmt.Sprintf("elemental.oemlabel=%s", vars["oem_label"]),
+		"panic=5", "security=selinux", "fsck.mode=force", "fsck.repair=yes",
+	), " ")
+}
+
+var (
+	grubSetVar  = regexp.MustCompile(`^set\s+(\w+)=(?:"([^"]*)"|(\S*))$`)
+	grubVarRef  = regexp.MustCompile(`\$\{(\w+)\}`)
+	grubIfCond  = regexp.MustCompile(`^(?:el)?if\s+\[\s+(.*)\s+\];\s*then$`)
+	grubCondArg = regexp.MustCompile(`"([^"]*)"|(\S+)`)
+)
+
+// evalGrubScript evaluates the variable assignments of a bootargs.cfg like grub script into
+// vars. Only 'set' commands and 'if' blocks with test conditions are supported, any other
+// command is ignored and unsupported conditions are false.
+func evalGrubScript(script []byte, vars map[string]string) {
+	type block struct{ active, taken, parent bool }
+	var blocks []block
+	active := true
+	expand := func(s string) string {
+		return grubVarRef.ReplaceAllStringFunc(s, func(ref string) string {
+			return vars[grubVarRef.FindStringSubmatch(ref)[1]]
+		})
+	}
+
+	for _, line := range strings.Split(string(script), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "if "):
+			cond := active && evalGrubCond(grubIfCond.FindStringSubmatch(line), expand)
+			blocks = append(blocks, block{active: cond, taken: cond, parent: active})
+			active = cond
+		case strings.HasPrefix(line, "elif ") && len(blocks) > 0:
+			b := &blocks[len(blocks)-1]
+			b.active = b.parent && !b.taken && evalGrubCond(grubIfCond.FindStringSubmatch(line), expand)
+			b.taken = b.taken || b.active
+			active = b.active
+		case line == "else" && len(blocks) > 0:
+			b := &blocks[len(blocks)-1]
+			b.active = b.parent && !b.taken
+			b.taken = true
+			active = b.active
+		case line == "fi" && len(blocks) > 0:
+			active = blocks[len(blocks)-1].parent
+			blocks = blocks[:len(blocks)-1]
+		case active && grubSetVar.MatchString(line):
+			m := grubSetVar.FindStringSubmatch(line)
+			vars[m[1]] = expand(m[2] + m[3])
+		}
+	}
+}
+
+// evalGrubCond evaluates the '-n', '-z', '==' and '!=' test conditions
+func evalGrubCond(m []string, expand func(string) string) bool {
+	if m == nil {
+		return false
+	}
+	var args []string
+	for _, arg := range grubCondArg.FindAllStringSubmatch(m[1], -1) {
+		args = append(args, expand(arg[1]+arg[2]))
+	}
+	switch {
+	case len(args) == 2 && args[0] == "-n":
+		return args[1] != ""
+	case len(args) == 2 && args[0] == "-z":
+		return args[1] == ""
+	case len(args) == 3 && (args[1] == "==" || args[1] == "="):
+		return args[0] == args[2]
+	case len(args) == 3 && args[1] == "!=":
+		return args[0] != args[2]
+	}
+	return false
+}
+
+// DoEFIEntries does nothing, the existing bootloader owns the EFI boot entries
+func (n *None) DoEFIEntries(_, _ string) error {
+	return nil
+}
+
+// InstallEFI does nothing, there are no EFI binaries to install
+func (n *None) InstallEFI(_, _ string) error {
+	return nil
+}
+
+// InstallEFIBinaries does nothing, there are no EFI binaries to install
+func (n *None) InstallEFIBinaries(_, _, _ string) error {
+	return nil
+}
+
+// SetPersistentVariables sets the given variables of the boot entry, such as the RAID array
+// UUID or extra cmdline arguments, if the envFile is within the boot directory the kernel was
+// installed to. The variables are kept next to the boot entry for later upgrades.
+func (n *None) SetPersistentVariables(envFile string, vars map[string]string) error {
+	if n.bootDir == "" || filepath.Dir(envFile) != n.bootDir {
+		n.cfg.Logger.Debugf("No bootloader installed, skipping variables of %s", envFile)
+		return nil
+	}
+	err := n.loadEnv()
+	if err != nil {
+		return err
+	}
+	for k, v := range vars {
+		n.vars[k] = v
+	}
+
+	keys := make([]string, 0, len(n.vars))
+	for k := range n.vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var env strings.Builder
+	for _, k := range keys {
+		env.WriteString(fmt.Sprintf("%s=%s\n", k, n.vars[k]))
+	}
+	err = n.write(filepath.Join(n.bootDir, n.installPath, noneEnvFile), []byte(env.String()))
+	if err != nil {
+		return fmt.Errorf("failed writing boot entry variables: %w", err)
+	}
+	return n.writeEntry()
+}
+
+// SetDefaultEntry does nothing, the existing bootloader owns the default entry
+func (n *None) SetDefaultEntry(_, _, _ string) error {
+	return nil
+}
@@ -0,0 +1,177 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bootloader_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/twpayne/go-vfs/v4"
+	"github.com/twpayne/go-vfs/v4/vfst"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/bootloader"
+	"github.com/rancher/elemental-toolkit/v2/pkg/config"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+var _ = Describe("None bootloader", Label("bootloader", "none"), func() {
+	var fs vfs.FS
+	var runner *mocks.FakeRunner
+	var cleanup func()
+	var err error
+	var cfg *types.Config
+	var none *bootloader.None
+	var rootDir, efiDir string
+
+	BeforeEach(func() {
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).Should(BeNil())
+		runner = mocks.NewFakeRunner()
+
+		efiDir = "/some/efi/directory"
+		Expect(utils.MkdirAll(fs, efiDir, constants.DirPerm)).To(Succeed())
+
+		rootDir = "/some/working/directory"
+		Expect(utils.MkdirAll(fs, filepath.Join(rootDir, "boot"), constants.DirPerm)).To(Succeed())
+		Expect(utils.MkdirAll(fs, filepath.Join(rootDir, "lib/modules/6.4.0-1"), constants.DirPerm)).To(Succeed())
+		Expect(fs.WriteFile(filepath.Join(rootDir, "boot/vmlinuz-6.4.0-1"), []byte("kernel"), constants.FilePerm)).To(Succeed())
+		Expect(fs.WriteFile(filepath.Join(rootDir, "boot/initrd-6.4.0-1"), []byte("initrd"), constants.FilePerm)).To(Succeed())
+
+		cfg = config.NewConfig(
+			config.WithFs(fs),
+			config.WithRunner(runner),
+			config.WithLogger(types.NewNullLogger()),
+		)
+		cfg.KernelInstallPath = "/EFI/elemental"
+		none = bootloader.NewNone(cfg, bootloader.NewGrubTemplateData(map[string]string{
+			"state_label": "COS_STATE",
+			"oem_label":   "COS_OEM",
+		}, "My OS", constants.BtrfsSnapshotterType))
+	})
+	AfterEach(func() {
+		cleanup()
+	})
+	It("copies the kernel, the initrd and a boot entry to the kernel install path", func() {
+		Expect(none.Install(rootDir, efiDir)).To(Succeed())
+
+		kernel, err := fs.ReadFile(filepath.Join(efiDir, "EFI/elemental/vmlinuz"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(kernel)).To(Equal("kernel"))
+		initrd, err := fs.ReadFile(filepath.Join(efiDir, "EFI/elemental/initrd"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(initrd)).To(Equal("initrd"))
+
+		entry, err := fs.ReadFile(filepath.Join(efiDir, "EFI/elemental/elemental.conf"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(entry)).To(ContainSubstring("title My OS\n"))
+		Expect(string(entry)).To(ContainSubstring("linux /EFI/elemental/vmlinuz\n"))
+		Expect(string(entry)).To(ContainSubstring("initrd /EFI/elemental/initrd\n"))
+		Expect(string(entry)).To(ContainSubstring("root=LABEL=COS_STATE elemental.snapshotter=btrfs elemental.mode=active elemental.oemlabel=COS_OEM"))
+
+		// No grub, EFI binaries or boot entries are involved
+		Expect(runner.GetCmds()).To(BeEmpty())
+		ok, _ := utils.Exists(fs, filepath.Join(efiDir, constants.FallbackEFIPath))
+		Expect(ok).To(BeFalse())
+	})
+	It("fails if the image has no kernel", func() {
+		Expect(fs.Remove(filepath.Join(rootDir, "boot/vmlinuz-6.4.0-1"))).To(Succeed())
+		Expect(none.Install(rootDir, efiDir)).To(MatchError(ContainSubstring("failed finding kernel and initrd")))
+	})
+	It("evaluates the kernel command line from the image bootargs and entry variables", func() {
+		bootargs, err := os.ReadFile("../features/embedded/grub-default-bootargs/etc/elemental/bootargs.cfg")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(utils.MkdirAll(fs, filepath.Join(rootDir, constants.GrubCfgPath), constants.DirPerm)).To(Succeed())
+		Expect(fs.WriteFile(filepath.Join(rootDir, constants.GrubCfgPath, constants.BootargsCfg), bootargs, constants.FilePerm)).To(Succeed())
+		cfg.StripCmdlineKeys = []string{"console"}
+
+		Expect(none.Install(rootDir, efiDir)).To(Succeed())
+		Expect(none.SetPersistentVariables(filepath.Join(efiDir, constants.GrubOEMEnv), map[string]string{
+			"raid_uuid": "1234", "extra_cmdline": "quiet console=ttyS1",
+		})).To(Succeed())
+
+		entryFile := filepath.Join(efiDir, "EFI/elemental/elemental.conf")
+		entry, err := fs.ReadFile(entryFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(entry)).To(ContainSubstring(
+			"options root=LABEL=COS_STATE rd.md.uuid=1234 elemental.snapshotter=btrfs elemental.mode=active " +
+				"elemental.oemlabel=COS_OEM panic=5 security=selinux fsck.mode=force fsck.repair=yes quiet\n",
+		))
+
+		// Variables are kept for later upgrades
+		Expect(fs.Remove(entryFile)).To(Succeed())
+		upgrade := bootloader.NewNone(cfg, bootloader.NewGrubTemplateData(map[string]string{
+			"state_label": "COS_STATE",
+			"oem_label":   "COS_OEM",
+		}, "My OS", constants.BtrfsSnapshotterType))
+		Expect(upgrade.InstallConfig(rootDir, efiDir)).To(Succeed())
+		entry, err = fs.ReadFile(entryFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(entry)).To(ContainSubstring("rd.md.uuid=1234"))
+		Expect(string(entry)).To(ContainSubstring("quiet"))
+	})
+	It("keeps the installed kernel until the staged files are committed", func() {
+		Expect(none.Install(rootDir, efiDir)).To(Succeed())
+		Expect(fs.WriteFile(filepath.Join(rootDir, "boot/vmlinuz-6.4.0-1"), []byte("new kernel"), constants.FilePerm)).To(Succeed())
+
+		Expect(none.Stage(rootDir, efiDir)).To(Succeed())
+		Expect(none.SetPersistentVariables(filepath.Join(efiDir, constants.GrubOEMEnv), map[string]string{"raid_uuid": "1234"})).To(Succeed())
+		kernel, err := fs.ReadFile(filepath.Join(efiDir, "EFI/elemental/vmlinuz"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(kernel)).To(Equal("kernel"))
+		entry, err := fs.ReadFile(filepath.Join(efiDir, "EFI/elemental/elemental.conf"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(entry)).NotTo(ContainSubstring("rd.md.uuid"))
+
+		Expect(none.Commit()).To(Succeed())
+		kernel, err = fs.ReadFile(filepath.Join(efiDir, "EFI/elemental/vmlinuz"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(kernel)).To(Equal("new kernel"))
+		entry, err = fs.ReadFile(filepath.Join(efiDir, "EFI/elemental/elemental.conf"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(entry)).To(ContainSubstring("rd.md.uuid=1234"))
+	})
+	It("discards the staged files", func() {
+		Expect(none.Install(rootDir, efiDir)).To(Succeed())
+		Expect(fs.WriteFile(filepath.Join(rootDir, "boot/vmlinuz-6.4.0-1"), []byte("new kernel"), constants.FilePerm)).To(Succeed())
+
+		Expect(none.Stage(rootDir, efiDir)).To(Succeed())
+		none.Discard()
+		kernel, err := fs.ReadFile(filepath.Join(efiDir, "EFI/elemental/vmlinuz"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(kernel)).To(Equal("kernel"))
+		files, err := fs.ReadDir(filepath.Join(efiDir, "EFI/elemental"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(HaveLen(3))
+	})
+	It("does not set any bootloader variable outside the kernel boot directory", func() {
+		Expect(none.SetPersistentVariables(filepath.Join(efiDir, constants.GrubOEMEnv), map[string]string{"key": "value"})).To(Succeed())
+		Expect(none.Install(rootDir, efiDir)).To(Succeed())
+		Expect(none.SetPersistentVariables("/some/oem/"+constants.GrubOEMEnv, map[string]string{"key": "value"})).To(Succeed())
+		Expect(none.SetDefaultEntry(efiDir, rootDir, "My OS")).To(Succeed())
+		Expect(runner.GetCmds()).To(BeEmpty())
+		ok, _ := utils.Exists(fs, filepath.Join(efiDir, constants.GrubOEMEnv))
+		Expect(ok).To(BeFalse())
+		ok, _ = utils.Exists(fs, filepath.Join(efiDir, "EFI/elemental/elemental.env"))
+		Expect(ok).To(BeFalse())
+	})
+})
@@ -98,3 +98,9 @@ func (ci *YipCloudInitRunner) CloudInitFileRender(target string, config *schema.
 	}
 	return ci.fs.WriteFile(target, out, constants.FilePerm)
 }
+
+// Validate parses the given cloud-init file as it is parsed on boot, without running any stage
+func (ci YipCloudInitRunner) Validate(path string) error {
+	_, err := schema.Load(path, ci.fs, schema.FromFile, nil)
+	return err
+}
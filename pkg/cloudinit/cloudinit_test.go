@@ -106,6 +106,33 @@ stages:
 			Expect(string(b)).Should(Equal("baz"))
 		})
 	})
+	Describe("validating yaml files", Label("validate"), func() {
+		var fs *vfst.TestFS
+		var cleanup func()
+		var err error
+		var yipRunner *YipCloudInitRunner
+
+		BeforeEach(func() {
+			fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+				"/oem/90_custom.yaml": "stages:\n  boot:\n  - commands:\n    - echo hello\n",
+				"/oem/91_custom.yaml": "name: broken\nstages:\n  boot:\n  - commands: echo: hello\n",
+			})
+			Expect(err).Should(BeNil())
+			yipRunner = NewYipCloudInitRunner(types.NewNullLogger(), &types.RealRunner{}, fs)
+		})
+		AfterEach(func() {
+			cleanup()
+		})
+		It("accepts a well formed file", func() {
+			Expect(yipRunner.Validate("/oem/90_custom.yaml")).To(Succeed())
+		})
+		It("reports the line of a malformed file", func() {
+			Expect(yipRunner.Validate("/oem/91_custom.yaml")).To(MatchError(ContainSubstring("line 4")))
+		})
+		It("fails on a missing file", func() {
+			Expect(yipRunner.Validate("/oem/92_custom.yaml")).NotTo(Succeed())
+		})
+	})
 	Describe("writing yaml files", func() {
 		var fs *vfst.TestFS
 		var logger types.Logger
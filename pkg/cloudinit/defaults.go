@@ -0,0 +1,35 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudinit
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// Cloud-config files dropped in ./defaults before building are embedded in the binary. They are
+// installed to the OEM partition if no other cloud-config is provided, this allows building
+// self-contained installers for single purpose appliances.
+//
+//go:embed all:defaults
+var defaultConfigs embed.FS
+
+// DefaultConfigs returns the filesystem of the embedded default cloud-config files
+func DefaultConfigs() fs.FS {
+	sub, _ := fs.Sub(defaultConfigs, "defaults")
+	return sub
+}
@@ -128,6 +128,10 @@ func NewConfig(opts ...GenericOptions) *types.Config {
 		Platform:                  defaultPlatform,
 		SquashFsCompressionConfig: constants.GetDefaultSquashfsCompressionOptions(),
 		TLSVerify:                 true,
+		RemovableEFI:              true,
+		SparseImages:              true,
+		PartitionSizeTolerance:    constants.PartSizeTolerance,
+		ImageSizePolicy:           types.SizePolicy{Overhead: constants.ImgOverhead, RoundTo: 1},
 	}
 	for _, o := range opts {
 		err := o(c)
@@ -175,6 +179,7 @@ func NewRunConfig(opts ...GenericOptions) *types.RunConfig {
 
 	r := &types.RunConfig{
 		Snapshotter: snapshotter,
+		RebootDelay: constants.RebootDelay,
 		Config:      *config,
 	}
 	return r
@@ -194,17 +199,27 @@ func NewInstallSpec(cfg types.Config) *types.InstallSpec {
 		system = types.NewEmptySrc()
 	}
 
-	recoverySystem.Source = system
+	// Recovery defaults to the system source on sanitize, it can't be the same
+	// pointer, otherwise setting the recovery source overwrites the system source
+	recoverySystem.Source = types.NewEmptySrc()
 	recoverySystem.FS = constants.SquashFs
 	recoverySystem.File = filepath.Join(constants.RecoveryDir, constants.BootPath, constants.RecoveryImgFile)
-	recoverySystem.MountPoint = constants.TransitionDir
+	recoverySystem.MountPoint = constants.TransitionMountPoint(constants.ActionInstall)
 
 	return &types.InstallSpec{
-		Firmware:       types.EFI,
-		PartTable:      types.GPT,
-		Partitions:     NewInstallElementalPartitions(),
-		System:         system,
-		RecoverySystem: recoverySystem,
+		Firmware:         types.EFI,
+		PartTable:        types.GPT,
+		Partitions:       NewInstallElementalPartitions(),
+		System:           system,
+		RecoverySystem:   recoverySystem,
+		TrimAfterInstall: constants.TrimAuto,
+	}
+}
+
+// NewCaptureSpec returns a CaptureSpec struct all based on defaults
+func NewCaptureSpec() *types.CaptureSpec {
+	return &types.CaptureSpec{
+		FS: constants.SquashFs,
 	}
 }
 
@@ -246,11 +261,11 @@ func NewMountSpec(cfg types.Config) *types.MountSpec {
 		Ephemeral: types.EphemeralMounts{
 			Type:  constants.Tmpfs,
 			Size:  "25%",
-			Paths: []string{"/var", "/etc", "/srv"},
+			Paths: constants.GetDefaultEphemeralPaths(),
 		},
 		Persistent: types.PersistentMounts{
 			Mode:  constants.OverlayMode,
-			Paths: []string{"/etc/systemd", "/etc/ssh", "/home", "/opt", "/root", "/var/log"},
+			Paths: constants.GetDefaultPersistentPaths(),
 			Volume: types.VolumeMount{
 				Mountpoint: constants.PersistentDir,
 				Device:     fmt.Sprintf("PARTLABEL=%s", constants.PersistentPartName),
@@ -349,21 +364,26 @@ func NewUpgradeSpec(cfg types.Config) (*types.UpgradeSpec, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not read host partitions")
 	}
-	ep := types.NewElementalPartitionsFromList(parts, installState)
+	ep, err := cfg.PartitionSelection.ElementalPartitions(parts, installState)
+	if err != nil {
+		return nil, err
+	}
 
+	// The recovery image is also set without a recovery partition, it can be created on upgrade
+	recoveryDir := constants.RecoveryDir
 	if ep.Recovery != nil {
 		if ep.Recovery.MountPoint == "" {
 			ep.Recovery.MountPoint = constants.RecoveryDir
 		}
-
-		recovery = types.Image{
-			File:       filepath.Join(ep.Recovery.MountPoint, constants.BootTransitionPath, constants.RecoveryImgFile),
-			Size:       constants.ImgSize,
-			Label:      rState.Label,
-			FS:         rState.FS,
-			MountPoint: constants.TransitionDir,
-			Source:     types.NewEmptySrc(),
-		}
+		recoveryDir = ep.Recovery.MountPoint
+	}
+	recovery = types.Image{
+		File:       filepath.Join(recoveryDir, constants.TransitionPath(constants.ActionUpgradeRecovery), constants.RecoveryImgFile),
+		Size:       constants.ImgSize,
+		Label:      rState.Label,
+		FS:         rState.FS,
+		MountPoint: constants.TransitionMountPoint(constants.ActionUpgradeRecovery),
+		Source:     types.NewEmptySrc(),
 	}
 
 	if ep.State != nil {
@@ -414,7 +434,10 @@ func NewResetSpec(cfg types.Config) (*types.ResetSpec, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not read host partitions")
 	}
-	ep := types.NewElementalPartitionsFromList(parts, installState)
+	ep, err := cfg.PartitionSelection.ElementalPartitions(parts, installState)
+	if err != nil {
+		return nil, err
+	}
 
 	if efiExists {
 		if ep.Boot == nil {
@@ -463,6 +486,23 @@ func NewResetSpec(cfg types.Config) (*types.ResetSpec, error) {
 		cfg.Logger.Warnf("no Persistent partition found")
 	}
 
+	// The separate root partition is formatted and seeded again, the var partition is
+	// only required to set the mount settings and it is not mounted
+	ep.Root, err = systemPartition(parts, installState, constants.RootPartName, target)
+	if err != nil {
+		return nil, err
+	}
+	if ep.Root != nil {
+		ep.Root.MountPoint = constants.RootDir
+	}
+	ep.Var, err = systemPartition(parts, installState, constants.VarPartName, target)
+	if err != nil {
+		return nil, err
+	}
+	if ep.Var != nil {
+		ep.Var.MountPoint = ""
+	}
+
 	recoveryImg := filepath.Join(constants.RunningStateDir, constants.BootPath, constants.RecoveryImgFile)
 	oldRecoveryImg := filepath.Join(constants.RunningStateDir, constants.RecoveryImgFile)
 
@@ -484,6 +524,22 @@ func NewResetSpec(cfg types.Config) (*types.ResetSpec, error) {
 	}, nil
 }
 
+// systemPartition returns the partition of the given disk with the label recorded in the install
+// state for the given partition name. It returns nil if the install state does not include it.
+func systemPartition(parts types.PartitionList, state *types.InstallState, name, disk string) (*types.Partition, error) {
+	if state == nil || state.Partitions[name] == nil {
+		return nil, nil
+	}
+	label := state.Partitions[name].FSLabel
+	for _, part := range parts {
+		if part.FilesystemLabel == label && part.Disk == disk {
+			part.Name = name
+			return part, nil
+		}
+	}
+	return nil, fmt.Errorf("%s partition labeled %s not found in %s", name, label, disk)
+}
+
 func NewDiskElementalPartitions(workdir string) types.ElementalPartitions {
 	partitions := types.ElementalPartitions{}
 
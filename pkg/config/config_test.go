@@ -131,10 +131,15 @@ var _ = Describe("Types", Label("types", "config"), func() {
 				spec := config.NewInstallSpec(*c)
 				Expect(spec.Firmware).To(Equal(types.EFI))
 				Expect(spec.System.Value()).To(Equal(constants.ISOBaseTree))
-				Expect(spec.RecoverySystem.Source.Value()).To(Equal(spec.System.Value()))
+				Expect(spec.RecoverySystem.Source.IsEmpty()).To(BeTrue())
 				Expect(spec.PartTable).To(Equal(types.GPT))
 
 				Expect(spec.Partitions.Boot).NotTo(BeNil())
+
+				// Recovery defaults to the system source
+				spec.Target = "/dev/sda"
+				Expect(spec.Sanitize()).To(Succeed())
+				Expect(spec.RecoverySystem.Source.Value()).To(Equal(spec.System.Value()))
 			})
 			It("sets installation defaults without being on installation media", Label("install"), func() {
 				spec := config.NewInstallSpec(*c)
@@ -31,18 +31,33 @@ const (
 	StateLabel         = "COS_STATE"
 	StatePartName      = "state"
 	InstallStateFile   = "state.yaml"
+	InstallConfigFile  = "install-config.yaml"
+	ProvisionedFile    = "provisioned.yaml"
+	UpgradeHistoryFile = "upgrade-history.json"
 	PersistentLabel    = "COS_PERSISTENT"
 	PersistentPartName = "persistent"
 	OEMLabel           = "COS_OEM"
 	OEMPartName        = "oem"
+	VarLabel           = "COS_VAR"
+	VarPartName        = "var"
+	VarPath            = "/var"
+	RootLabel          = "COS_ROOT"
+	RootPartName       = "root"
+	UsrPath            = "/usr"
 	MountBinary        = "/usr/bin/mount"
 	EfiDevice          = "/sys/firmware/efi"
+	TPMDevice          = "/sys/class/tpm/tpm0"
+	DropCachesFile     = "/proc/sys/vm/drop_caches"
 	LinuxFs            = "ext4"
 	LinuxImgFs         = "ext2"
 	SquashFs           = "squashfs"
+	Tarball            = "tar"
+	RecoveryArtifact   = "recovery"
+	ISOArtifact        = "iso"
 	BootFs             = "vfat"
 	Btrfs              = "btrfs"
 	BiosFs             = ""
+	RaidMemberFs       = "linux_raid_member"
 	MinPartSize        = uint(64)
 	BootSize           = MinPartSize
 	OEMSize            = MinPartSize
@@ -51,23 +66,80 @@ const (
 	PersistentSize     = uint(0)
 	BiosSize           = uint(1)
 	ImgSize            = uint(0)
+	PartSizeTolerance  = uint(1)
+	// The grub counter decrements from a fixed list of digits, grub has no arithmetic
+	MaxBootAttempts    = 9
 	ImgOverhead        = uint(256)
+	ImgInodeOverhead   = uint64(1024)
+	ExtBytesPerInode   = uint64(16384)
 	HTTPTimeout        = 60
+	RebootDelay        = 5
 	GPT                = "gpt"
 	BuildImgName       = "elemental"
 	OEMPath            = "/oem"
 	PersistentPath     = PersistentDir
 	ConfigDir          = "/etc/elemental"
+	ImageDefaultsFile  = "/etc/elemental/defaults.yaml"
 	OverlayMode        = "overlay"
 	BindMode           = "bind"
 	Tmpfs              = "tmpfs"
 	Autofs             = "auto"
 	Block              = "block"
+	PersistentOverlay  = "persistent"
+	ImmutableEtc       = "immutable"
+	TrimAuto           = "auto"
+	TrimAlways         = "always"
+	TrimNever          = "never"
+	Fstrim             = "fstrim"
+	BenchmarkSizeMB    = 64
+	VerifyDelete       = "abort-delete"
+	VerifyKeep         = "abort-keep"
+	VerifyQuarantine   = "quarantine"
+	StageSequential    = "sequential"
+	StageParallel      = "parallel"
+	BootloaderGrub     = "grub"
+	BootloaderNone     = "none"
+	OverlayConfigFile  = "80_overlay.yaml"
+	RecoveryPassConfig = "85_recovery_password.yaml"
+	UsersConfig        = "82_users.yaml"
 	EfivarsMountPath   = "/sys/firmware/efi/efivars"
 
 	// Maxium number of nested symlinks to resolve
 	MaxLinkDepth = 4
 
+	// SBOM formats and files
+	SPDXFormat      = "spdx"
+	CycloneDXFormat = "cyclonedx"
+	SPDXFile        = "sbom.spdx.json"
+	CycloneDXFile   = "sbom.cdx.json"
+	SBOMEmbeddedDir = "/usr/share/sbom"
+
+	// Timezone files of an image
+	ZoneInfoDir   = "/usr/share/zoneinfo"
+	LocalTimeFile = "/etc/localtime"
+
+	// Systemd default target link of an image
+	DefaultTargetLink = "/etc/systemd/system/default.target"
+
+	// Install target value to pick the target disk automatically
+	AutoTarget = "auto"
+
+	// Device classes of disks, read from sysfs
+	SysBlockDir    = "/sys/block"
+	DiskTypeNVDIMM = "nvdimm"
+	DiskTypeOptane = "optane"
+	DiskTypeNVMe   = "nvme"
+	DiskTypeSSD    = "ssd"
+	DiskTypeHDD    = "hdd"
+
+	// Software RAID defaults
+	RaidDevice = "/dev/md0"
+	RaidLevel  = "1"
+	MdadmConf  = "/etc/mdadm.conf"
+
+	// Machine ID file, systemd considers an empty one as a first boot
+	MachineID = "/etc/machine-id"
+
 	// Kernel and initrd paths
 	KernelModulesDir = "/lib/modules"
 	KernelPath       = "/boot/vmlinuz"
@@ -85,11 +157,16 @@ const (
 	BootargsCfg            = "bootargs.cfg"
 	GrubCfgPath            = "/etc/elemental"
 	GrubOEMEnv             = "grub_oem_env"
+	GrubPasswordCfg        = "grub_password.cfg"
+	GrubThemeCfg           = "grub_theme.cfg"
+	GrubThemesDir          = "themes"
+	GrubThemeFile          = "theme.txt"
 	GrubEnv                = "grubenv"
 	GrubDefEntry           = "Elemental"
 	GrubFallback           = "default_fallback"
 	GrubPassiveSnapshots   = "passive_snaps"
 	GrubActiveSnapshot     = "active_snap"
+	GrubBootAttempts       = "boot_assessment_attempts"
 	ElementalBootloaderBin = "/usr/lib/elemental/bootloader"
 
 	// Mountpoints or links to images and partitions
@@ -99,14 +176,34 @@ const (
 	StateDir              = "/run/elemental/state"
 	OEMDir                = "/run/elemental/oem"
 	PersistentDir         = "/run/elemental/persistent"
+	VarDir                = "/run/elemental/var"
+	RootDir               = "/run/elemental/root"
 	TransitionDir         = "/run/elemental/transition"
 	BootDir               = "/run/elemental/efi"
 	ImgSrcDir             = "/run/elemental/imgsrc"
+	DriftImageDir         = "/run/elemental/drift"
+	ActivateImageDir      = "/run/elemental/activate"
 	WorkingImgDir         = "/run/elemental/workingtree"
 	WorkingImgBuildLink   = RunElementalBuildLink + "/workingtree"
 	OverlayDir            = "/run/elemental/overlay"
 	PersistentStateDir    = ".state"
-	RunningStateDir       = "/run/initramfs/elemental-state" // TODO: converge this constant with StateDir/RecoveryDir when moving to elemental-rootfs as default rootfs feature.
+	UpgradeStagingDir     = ".upgrade-staging"
+	UpgradeStagingFile    = "staged.yaml"
+	FailedUpgradeDir      = ".upgrade-failed"
+	QuarantineDir         = ".upgrade-quarantine"
+	QuarantineRecordFile  = "verify-failure.yaml"
+	// Environment variable set to the transition tree for the pre-swap verification command
+	TransitionMountPointEnv = "ELEMENTAL_TRANSITION_MOUNTPOINT"
+	// Environment variable set to the unpacked source tree for the transform command
+	SourceTreeEnv = "ELEMENTAL_SOURCE_TREE"
+	// Build information of the deployed image, written into the image itself
+	ImageVersionFile = "/etc/elemental/version"
+	// Free space kept in the persistent partition for runtime writes during upgrades
+	PersistentUpgradeMinFreeMiB = uint(64)
+	RunningStateDir             = "/run/initramfs/elemental-state" // TODO: converge this constant with StateDir/RecoveryDir when moving to elemental-rootfs as default rootfs feature.
+
+	// Trace of the commands executed by elemental, included in support bundles
+	CommandTraceFile = "/run/elemental/commands.log"
 
 	// Running mode sentinel files
 	ActiveMode   = "/run/elemental/active_mode"
@@ -116,6 +213,7 @@ const (
 	// Live image mountpoints
 	ISOBaseTree = "/run/rootfsbase"
 	LiveDir     = "/run/initramfs/live"
+	IsoScanDir  = "/run/initramfs/isoscan"
 
 	// Image constants
 	ActiveImgName      = "active"
@@ -166,11 +264,24 @@ const (
 	AzureType   = "azure"
 	GCEType     = "gce"
 
+	// Checksum algorithms
+	SHA256 = "sha256"
+	SHA512 = "sha512"
+
+	// Policies for build artifacts already existing in the output directory
+	OverwriteArtifacts = "overwrite"
+	FailOnArtifacts    = "fail"
+	RenameArtifacts    = "rename"
+	// Placeholder of the artifact name replaced by the target architecture
+	ArchPlaceholder = "{arch}"
+
 	// Default directory and file fileModes
 	DirPerm        = os.ModeDir | os.ModePerm
 	FilePerm       = 0666
 	NoWriteDirPerm = 0555 | os.ModeDir
 	TempDirPerm    = os.ModePerm | os.ModeSticky | os.ModeDir
+	SecureFilePerm = 0600
+	SecureDirPerm  = 0700 | os.ModeDir
 
 	// Eject script
 	EjectScript = "#!/bin/sh\n/usr/bin/eject -rmF"
@@ -203,8 +314,67 @@ const (
 	ActionUpgradeRecovery = "upgrade-recovery"
 	ActionReset           = "reset"
 	ActionBuildDisk       = "build-disk"
+
+	// Upgrade history results
+	UpgradeSucceeded = "success"
+	UpgradeFailed    = "failure"
 )
 
+// GetChecksumAlgorithms returns the supported checksum algorithms
+func GetChecksumAlgorithms() []string {
+	return []string{SHA256, SHA512}
+}
+
+// GetSystemdUnitDirs returns the directories of an image holding systemd units, by priority
+func GetSystemdUnitDirs() []string {
+	return []string{"/etc/systemd/system", "/usr/lib/systemd/system", "/lib/systemd/system"}
+}
+
+// GetVerifyFailurePolicies returns the policies applied to the tree of an upgrade failing its verification
+func GetVerifyFailurePolicies() []string {
+	return []string{VerifyDelete, VerifyKeep, VerifyQuarantine}
+}
+
+// GetStageConcurrencyModes returns the modes cloud-init files of a stage can be run with
+func GetStageConcurrencyModes() []string {
+	return []string{StageSequential, StageParallel}
+}
+
+// GetBootloaders returns the bootloaders elemental can install
+func GetBootloaders() []string {
+	return []string{BootloaderGrub, BootloaderNone}
+}
+
+// GetTrimPolicies returns the policies to trim filesystems after installation
+func GetTrimPolicies() []string {
+	return []string{TrimAuto, TrimAlways, TrimNever}
+}
+
+// GetDiskTypes returns the device classes disks can be selected by
+func GetDiskTypes() []string {
+	return []string{DiskTypeNVDIMM, DiskTypeOptane, DiskTypeNVMe, DiskTypeSSD, DiskTypeHDD}
+}
+
+// GetOptaneModelPrefixes returns the model prefixes of Intel Optane devices not
+// including 'Optane' in their model string
+func GetOptaneModelPrefixes() []string {
+	return []string{"INTEL SSDPE21", "INTEL SSDPED1", "INTEL SSDPEL1", "INTEL SSDPF21", "INTEL MEMPEK", "INTEL HBRPEK"}
+}
+
+// GetDeployedFiles returns the files of a system image that might be written at deployment
+// time, thus not matching the image source. Only used for installations not recording them.
+func GetDeployedFiles() []string {
+	return []string{
+		ImageVersionFile,
+		KernelPath,
+		InitrdPath,
+		DefaultTargetLink,
+		LocalTimeFile,
+		MachineID,
+		MdadmConf,
+	}
+}
+
 // GetDefaultSystemExcludes returns a list of paths
 // that are commonly present in an Elemental based running system.
 // Those paths are not needed or wanted in order to replicate the root-tree.
@@ -222,6 +392,19 @@ func GetDefaultSystemExcludes() []string {
 	}
 }
 
+// GetDefaultCaptureExcludes returns the expressions matching the paths of a running system
+// which are volatile or specific to the host. Those are left out of captured images.
+func GetDefaultCaptureExcludes() []string {
+	return []string{
+		"^/(dev|mnt|proc|run|sys|tmp)/",
+		"^/\\.snapshots$",
+		"^/oem/",
+		"^/etc/machine-id$",
+		"^/etc/ssh/ssh_host_",
+		"^/var/log/",
+	}
+}
+
 // GetDefaultSystemExcludes returns a list of transient paths
 // that are commonly present in an Elemental based running system.
 // Paths are rooted to the given rootDir. Those paths are not
@@ -288,6 +471,16 @@ func GetDefaultGrubModulesPatterns() []string {
 	}
 }
 
+// GetDefaultPersistentPaths returns the default paths persisted across reboots
+func GetDefaultPersistentPaths() []string {
+	return []string{"/etc/systemd", "/etc/ssh", "/home", "/opt", "/root", "/var/log"}
+}
+
+// GetDefaultEphemeralPaths returns the default paths overlayed with ephemeral storage
+func GetDefaultEphemeralPaths() []string {
+	return []string{"/var", "/etc", "/srv"}
+}
+
 func GetCloudInitPaths() []string {
 	return []string{"/system/oem", "/oem/", "/usr/local/cloud-config/"}
 }
@@ -300,16 +493,96 @@ func GetDefaultSquashfsCompressionOptions() []string {
 	return []string{"-b", "1024k"}
 }
 
+// GetSquashfsCompressionLevels returns the valid compression level range of each squashfs
+// compressor supporting levels, mksquashfs uses gzip if no compressor is set
+func GetSquashfsCompressionLevels() map[string][2]int {
+	return map[string][2]int{
+		"gzip": {1, 9},
+		"lzo":  {1, 9},
+		"zstd": {1, 22},
+	}
+}
+
+// GetCompressionArtifacts returns the artifact types a compression level can be set for
+func GetCompressionArtifacts() []string {
+	return []string{RecoveryArtifact, ISOArtifact}
+}
+
+// GetPartitionFlags returns the parted flag set for each of the supported partition flag names
+func GetPartitionFlags() map[string]string {
+	return map[string]string{
+		"boot":         "boot",
+		"esp":          "esp",
+		"bios_grub":    "bios_grub",
+		"bios-grub":    "bios_grub",
+		"legacy_boot":  "legacy_boot",
+		"legacy-boot":  "legacy_boot",
+		"hidden":       "hidden",
+		"raid":         "raid",
+		"lvm":          "lvm",
+		"swap":         "swap",
+		"diag":         "diag",
+		"prep":         "prep",
+		"msftdata":     "msftdata",
+		"msftres":      "msftres",
+		"no_automount": "no_automount",
+		"no-automount": "no_automount",
+	}
+}
+
+// GetProbeTools returns the tools whose availability on the host is reported by a probe
+func GetProbeTools() []string {
+	return []string{
+		"rsync", "parted", "sgdisk", "lsblk", "blkid", "mkfs.ext4", "mkfs.xfs", "mkfs.btrfs",
+		"mkfs.vfat", "mksquashfs", "xorriso", "mdadm", "cryptsetup", "efibootmgr", "cosign",
+	}
+}
+
+// GetMkfsReservedFlags returns, for each filesystem supporting custom mkfs arguments,
+// the flags set by the toolkit itself which can't be part of the custom arguments.
+// Entries ending with '=' are suboptions, matched within comma separated option values
+func GetMkfsReservedFlags() map[string][]string {
+	linuxFlags := []string{"-L", "-U"}
+	return map[string][]string{
+		"ext2":   append(linuxFlags, "-d"),
+		"ext3":   append(linuxFlags, "-d"),
+		"ext4":   append(linuxFlags, "-d"),
+		"xfs":    {"-L", "uuid="},
+		Btrfs:    append(linuxFlags, "--label", "--uuid", "-f", "--force"),
+		"fat":    {"-n", "-i"},
+		BootFs:   {"-n", "-i"},
+		SquashFs: {"-e", "-ef", "-wildcards"},
+	}
+}
+
 // GetRunKeyEnvMap returns environment variable bindings to RunConfig data
 func GetRunKeyEnvMap() map[string]string {
 	return map[string]string{
-		"poweroff":              "POWEROFF",
-		"reboot":                "REBOOT",
-		"strict":                "STRICT",
-		"eject-cd":              "EJECT_CD",
-		"snapshotter.type":      "SNAPSHOTTER_TYPE",
-		"snapshotter.max-snaps": "SNAPSHOTTER_MAX_SNAPS",
-		"cloud-init-paths":      "CLOUD_INIT_PATHS",
+		"poweroff":                    "POWEROFF",
+		"reboot":                      "REBOOT",
+		"strict":                      "STRICT",
+		"eject-cd":                    "EJECT_CD",
+		"snapshotter.type":            "SNAPSHOTTER_TYPE",
+		"snapshotter.max-snaps":       "SNAPSHOTTER_MAX_SNAPS",
+		"cloud-init-paths":            "CLOUD_INIT_PATHS",
+		"registry-mirror":             "REGISTRY_MIRROR",
+		"kernel-pattern":              "KERNEL_PATTERN",
+		"initrd-pattern":              "INITRD_PATTERN",
+		"fail-on-unknown-keys":        "FAIL_ON_UNKNOWN_KEYS",
+		"prune-persistent-on-upgrade": "PRUNE_PERSISTENT_ON_UPGRADE",
+		"persistent-cache-paths":      "PERSISTENT_CACHE_PATHS",
+		"max-image-copy-retries":      "MAX_IMAGE_COPY_RETRIES",
+		"reboot-delay":                "REBOOT_DELAY",
+		"download-dir":                "DOWNLOAD_DIR",
+		"removable-efi":               "REMOVABLE_EFI",
+		"reboot-message":              "REBOOT_MESSAGE",
+	}
+}
+
+// GetCaptureKeyEnvMap returns environment variable bindings to CaptureSpec data
+func GetCaptureKeyEnvMap() map[string]string {
+	return map[string]string{
+		"fs": "FS",
 	}
 }
 
@@ -332,17 +605,30 @@ func GetMountKeyEnvMap() map[string]string {
 // GetInstallKeyEnvMap returns environment variable bindings to InstallSpec data
 func GetInstallKeyEnvMap() map[string]string {
 	return map[string]string{
-		"target":              "TARGET",
-		"system":              "SYSTEM",
-		"recovery-system.uri": "RECOVERY_SYSTEM",
-		"cloud-init":          "CLOUD_INIT",
-		"iso":                 "ISO",
-		"firmware":            "FIRMWARE",
-		"part-table":          "PART_TABLE",
-		"no-format":           "NO_FORMAT",
-		"grub-entry-name":     "GRUB_ENTRY_NAME",
-		"disable-boot-entry":  "DISABLE_BOOT_ENTRY",
-		"snapshot-labels":     "SNAPSHOT_LABELS",
+		"target":                   "TARGET",
+		"exclude-device-labels":    "EXCLUDE_DEVICE_LABELS",
+		"exclude-device-paths":     "EXCLUDE_DEVICE_PATHS",
+		"exclude-device-types":     "EXCLUDE_DEVICE_TYPES",
+		"prefer-device-type":       "PREFER_DEVICE_TYPE",
+		"trim-after-install":       "TRIM_AFTER_INSTALL",
+		"system":                   "SYSTEM",
+		"recovery-system.uri":      "RECOVERY_SYSTEM",
+		"cloud-init":               "CLOUD_INIT",
+		"iso":                      "ISO",
+		"firmware":                 "FIRMWARE",
+		"part-table":               "PART_TABLE",
+		"no-format":                "NO_FORMAT",
+		"skip-partitioning":        "SKIP_PARTITIONING",
+		"root-mountpoint":          "ROOT_MOUNTPOINT",
+		"grub-entry-name":          "GRUB_ENTRY_NAME",
+		"disable-boot-entry":       "DISABLE_BOOT_ENTRY",
+		"snapshot-labels":          "SNAPSHOT_LABELS",
+		"overlay.backend":          "OVERLAY_BACKEND",
+		"overlay.size":             "OVERLAY_SIZE",
+		"raid-disks":               "RAID_DISKS",
+		"raid-level":               "RAID_LEVEL",
+		"skip-first-boot-setup":    "SKIP_FIRST_BOOT_SETUP",
+		"boot-assessment-attempts": "BOOT_ASSESSMENT_ATTEMPTS",
 	}
 }
 
@@ -362,20 +648,30 @@ func GetResetKeyEnvMap() map[string]string {
 // GetUpgradeKeyEnvMap returns environment variable bindings to UpgradeSpec data
 func GetUpgradeKeyEnvMap() map[string]string {
 	return map[string]string{
-		"recovery":            "RECOVERY",
-		"system":              "SYSTEM",
-		"recovery-system.uri": "RECOVERY_SYSTEM",
-		"snapshot-labels":     "SNAPSHOT_LABELS",
+		"recovery":                 "RECOVERY",
+		"system":                   "SYSTEM",
+		"recovery-system.uri":      "RECOVERY_SYSTEM",
+		"snapshot-labels":          "SNAPSHOT_LABELS",
+		"verify-only":              "VERIFY_ONLY",
+		"resume":                   "RESUME",
+		"boot-assessment-attempts": "BOOT_ASSESSMENT_ATTEMPTS",
 	}
 }
 
 // GetBuildKeyEnvMap returns environment variable bindings to BuildConfig data
 func GetBuildKeyEnvMap() map[string]string {
 	return map[string]string{
-		"name": "NAME",
+		"name":                 "NAME",
+		"fail-on-unknown-keys": "FAIL_ON_UNKNOWN_KEYS",
+		"sparse-images":        "SPARSE_IMAGES",
 	}
 }
 
+// GetNonSparseFilesystems returns the filesystems which do not support sparse files
+func GetNonSparseFilesystems() []string {
+	return []string{"vfat", "msdos", "exfat"}
+}
+
 // GetISOKeyEnvMap returns environment variable bindings to LiveISO data
 func GetISOKeyEnvMap() map[string]string {
 	// None for the time being
@@ -402,3 +698,14 @@ func ISOKernelPath(arch string) string {
 func ISOInitrdPath(arch string) string {
 	return filepath.Join(ISOLoaderPath(arch), "initrd")
 }
+
+// TransitionPath returns the transition directory of the given operation, relative to the
+// partition holding it, so concurrent operations do not clobber each other transitions
+func TransitionPath(operation string) string {
+	return filepath.Join(BootTransitionPath, operation)
+}
+
+// TransitionMountPoint returns the mount point of the transition image of the given operation
+func TransitionMountPoint(operation string) string {
+	return filepath.Join(TransitionDir, operation)
+}
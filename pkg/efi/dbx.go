@@ -0,0 +1,140 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package efi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	efi "github.com/canonical/go-efilib"
+)
+
+// dbxAttributes are the attributes of the forbidden signatures database variable
+const dbxAttributes = efi.AttributeNonVolatile | efi.AttributeBootserviceAccess |
+	efi.AttributeRuntimeAccess | efi.AttributeTimeBasedAuthenticatedWriteAccess
+
+// DbxUpdate is an authenticated update of the forbidden signatures database (dbx), as
+// distributed in dbxupdate files: signature lists prefixed by a time based authentication
+// header signed with a KEK. The firmware verifies the signature when applying it.
+type DbxUpdate struct {
+	Timestamp  time.Time
+	Signatures efi.SignatureDatabase
+	data       []byte
+}
+
+// ReadDbxUpdate parses the given authenticated dbx update
+func ReadDbxUpdate(data []byte) (*DbxUpdate, error) {
+	r := bytes.NewReader(data)
+	auth, err := efi.ReadTimeBasedVariableAuthentication(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dbx update authentication header: %w", err)
+	}
+	db, err := efi.ReadSignatureDatabase(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dbx update signature lists: %w", err)
+	}
+	if len(db) == 0 {
+		return nil, fmt.Errorf("dbx update does not include any signature")
+	}
+	return &DbxUpdate{Timestamp: auth.TimeStamp, Signatures: db, data: data}, nil
+}
+
+// Len returns the number of signatures of the update
+func (u DbxUpdate) Len() int {
+	count := 0
+	for _, list := range u.Signatures {
+		count += len(list.Signatures)
+	}
+	return count
+}
+
+// ComputeDbxUpdate checks the given update is applicable to the firmware and returns the
+// number of its signatures missing in the current dbx. Zero means it is already applied.
+func ComputeDbxUpdate(efiVars Variables, update *DbxUpdate) (int, error) {
+	if !VariablesSupported(efiVars) {
+		return 0, fmt.Errorf("EFI variables not supported")
+	}
+	current, err := readDbx(efiVars)
+	if err != nil {
+		return 0, err
+	}
+	missing := 0
+	for _, list := range update.Signatures {
+		for _, sig := range list.Signatures {
+			if !dbContains(current, list.Type, sig) {
+				missing++
+			}
+		}
+	}
+	return missing, nil
+}
+
+// ApplyDbxUpdate appends the given update to the dbx if any of its signatures is missing and
+// verifies the firmware accepted it. It returns the number of signatures added.
+func ApplyDbxUpdate(efiVars Variables, update *DbxUpdate) (int, error) {
+	missing, err := ComputeDbxUpdate(efiVars, update)
+	if err != nil || missing == 0 {
+		return 0, err
+	}
+	err = efiVars.SetVariable(efi.DbxVariable.GUID, efi.DbxVariable.Name, update.data, dbxAttributes|efi.AttributeAppendWrite)
+	if err != nil {
+		return 0, fmt.Errorf("failed writing dbx update: %w", err)
+	}
+	left, err := ComputeDbxUpdate(efiVars, update)
+	if err != nil {
+		return 0, err
+	}
+	if left != 0 {
+		return 0, fmt.Errorf("firmware did not apply %d signatures of the dbx update", left)
+	}
+	return missing, nil
+}
+
+// readDbx reads the current dbx, a missing dbx is empty
+func readDbx(efiVars Variables) (efi.SignatureDatabase, error) {
+	data, attrs, err := efiVars.GetVariable(efi.DbxVariable.GUID, efi.DbxVariable.Name)
+	if errors.Is(err, efi.ErrVarNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed reading dbx variable: %w", err)
+	}
+	if attrs&efi.AttributeTimeBasedAuthenticatedWriteAccess == 0 {
+		return nil, fmt.Errorf("dbx variable does not accept time based authenticated updates")
+	}
+	db, err := efi.ReadSignatureDatabase(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid dbx variable: %w", err)
+	}
+	return db, nil
+}
+
+// dbContains checks if the given signature of the given type is included in the database
+func dbContains(db efi.SignatureDatabase, sigType efi.GUID, sig *efi.SignatureData) bool {
+	for _, list := range db {
+		if list.Type != sigType {
+			continue
+		}
+		for _, s := range list.Signatures {
+			if s.Equal(sig) {
+				return true
+			}
+		}
+	}
+	return false
+}
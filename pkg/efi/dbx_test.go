@@ -0,0 +1,102 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package efi_test
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	efilib "github.com/canonical/go-efilib"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/efi"
+	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
+)
+
+var _ = Describe("Forbidden signatures database update", Label("efi", "dbx"), func() {
+	var vars *mocks.MockEFIVariables
+	var update *efi.DbxUpdate
+
+	dbxAttrs := efilib.AttributeNonVolatile | efilib.AttributeBootserviceAccess |
+		efilib.AttributeRuntimeAccess | efilib.AttributeTimeBasedAuthenticatedWriteAccess
+
+	BeforeEach(func() {
+		vars = mocks.NewMockEFIVariables()
+		Expect(vars.SetVariable(efilib.GlobalVariable, "SecureBoot", []byte{1}, efilib.AttributeBootserviceAccess)).To(Succeed())
+
+		var err error
+		update, err = efi.ReadDbxUpdate(mocks.NewDbxUpdate(bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("parses an authenticated update", func() {
+		Expect(update.Len()).To(Equal(2))
+		Expect(update.Timestamp.Year()).To(Equal(2025))
+	})
+
+	It("fails to parse an update without authentication header", func() {
+		_, err := efi.ReadDbxUpdate([]byte("not an update"))
+		Expect(err).To(MatchError(ContainSubstring("invalid dbx update authentication header")))
+	})
+
+	It("appends the missing signatures to the dbx", func() {
+		db := efilib.SignatureDatabase{mocks.NewSHA256SignatureList(bytes.Repeat([]byte{1}, 32))}
+		data, err := db.Bytes()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vars.SetVariable(efilib.DbxVariable.GUID, efilib.DbxVariable.Name, data, dbxAttrs)).To(Succeed())
+
+		missing, err := efi.ComputeDbxUpdate(vars, update)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(missing).To(Equal(1))
+
+		applied, err := efi.ApplyDbxUpdate(vars, update)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(applied).To(Equal(1))
+
+		missing, err = efi.ComputeDbxUpdate(vars, update)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(missing).To(Equal(0))
+	})
+
+	It("creates the dbx if missing", func() {
+		applied, err := efi.ApplyDbxUpdate(vars, update)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(applied).To(Equal(2))
+		_, attrs, err := vars.GetVariable(efilib.DbxVariable.GUID, efilib.DbxVariable.Name)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(attrs).To(Equal(dbxAttrs))
+	})
+
+	It("does not write an already applied update", func() {
+		_, err := efi.ApplyDbxUpdate(vars, update)
+		Expect(err).NotTo(HaveOccurred())
+		before, _, _ := vars.GetVariable(efilib.DbxVariable.GUID, efilib.DbxVariable.Name)
+
+		applied, err := efi.ApplyDbxUpdate(vars, update)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(applied).To(Equal(0))
+		after, _, _ := vars.GetVariable(efilib.DbxVariable.GUID, efilib.DbxVariable.Name)
+		Expect(after).To(Equal(before))
+	})
+
+	It("fails if the dbx does not accept authenticated updates", func() {
+		Expect(vars.SetVariable(efilib.DbxVariable.GUID, efilib.DbxVariable.Name, []byte{0}, efilib.AttributeNonVolatile)).To(Succeed())
+		_, err := efi.ApplyDbxUpdate(vars, update)
+		Expect(err).To(MatchError(ContainSubstring("does not accept time based authenticated updates")))
+	})
+})
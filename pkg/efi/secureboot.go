@@ -0,0 +1,40 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package efi
+
+import (
+	"errors"
+	"fmt"
+
+	efi "github.com/canonical/go-efilib"
+)
+
+// SecureBootEnabled reports whether the firmware enforces secure boot, based on the SecureBoot
+// global variable. A missing variable, as in firmwares without secure boot support, reports
+// it as disabled. It fails if EFI variables can't be accessed, e.g. on non EFI systems.
+func SecureBootEnabled(efiVars Variables) (bool, error) {
+	data, _, err := efiVars.GetVariable(efi.GlobalVariable, "SecureBoot")
+	if errors.Is(err, efi.ErrVarNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed reading SecureBoot variable: %w", err)
+	}
+	if len(data) != 1 {
+		return false, fmt.Errorf("invalid SecureBoot variable size: %d bytes", len(data))
+	}
+	return data[0] == 1, nil
+}
@@ -0,0 +1,61 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package efi_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	efilib "github.com/canonical/go-efilib"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/efi"
+	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
+)
+
+var _ = Describe("Secure boot state", Label("efi", "secureboot"), func() {
+	var vars *mocks.MockEFIVariables
+
+	BeforeEach(func() {
+		vars = mocks.NewMockEFIVariables()
+	})
+
+	It("reports secure boot as enabled", func() {
+		Expect(vars.SetVariable(efilib.GlobalVariable, "SecureBoot", []byte{1}, efilib.AttributeBootserviceAccess)).To(Succeed())
+		enabled, err := efi.SecureBootEnabled(vars)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(enabled).To(BeTrue())
+	})
+
+	It("reports secure boot as disabled", func() {
+		Expect(vars.SetVariable(efilib.GlobalVariable, "SecureBoot", []byte{0}, efilib.AttributeBootserviceAccess)).To(Succeed())
+		enabled, err := efi.SecureBootEnabled(vars)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(enabled).To(BeFalse())
+	})
+
+	It("reports secure boot as disabled if the variable is missing", func() {
+		enabled, err := efi.SecureBootEnabled(vars)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(enabled).To(BeFalse())
+	})
+
+	It("fails on an invalid variable", func() {
+		Expect(vars.SetVariable(efilib.GlobalVariable, "SecureBoot", []byte{1, 0}, efilib.AttributeBootserviceAccess)).To(Succeed())
+		_, err := efi.SecureBootEnabled(vars)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -18,26 +18,95 @@ package elemental
 
 import (
 	"fmt"
+	iofs "io/fs"
 	"math/rand"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/distribution/distribution/reference"
 	"github.com/hashicorp/go-multierror"
+	"github.com/rancher/yip/pkg/schema"
+	"gopkg.in/yaml.v3"
 
+	"github.com/rancher/elemental-toolkit/v2/pkg/atomicfile"
 	cnst "github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
 	"github.com/rancher/elemental-toolkit/v2/pkg/partitioner"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
 )
 
+// CreateRaidArray creates and assembles a software RAID array on the given device
+// including the given member disks. Metadata is stored at the end of the members,
+// so the firmware can read the EFI partition from any of them.
+func CreateRaidArray(c types.Config, device, level string, disks []string) error {
+	c.Logger.Infof("Creating RAID%s array %s over %s", level, device, strings.Join(disks, ", "))
+	args := []string{
+		"--create", device, "--run", "--metadata=1.0",
+		fmt.Sprintf("--level=%s", level), fmt.Sprintf("--raid-devices=%d", len(disks)),
+	}
+	out, err := c.Runner.Run("mdadm", append(args, disks...)...)
+	if err != nil {
+		c.Logger.Errorf("failed creating RAID array: %s", string(out))
+		return err
+	}
+	_, _ = c.Runner.Run("udevadm", "settle")
+	return nil
+}
+
+// ConfigureRaid writes the mdadm configuration of the given array into the
+// given root tree and returns the array UUID.
+func ConfigureRaid(c types.Config, device, root string) (string, error) {
+	out, err := c.Runner.Run("mdadm", "--detail", "--brief", device)
+	if err != nil {
+		c.Logger.Errorf("failed inspecting RAID array %s: %s", device, string(out))
+		return "", err
+	}
+
+	var uuid string
+	for _, field := range strings.Fields(string(out)) {
+		if value, ok := strings.CutPrefix(field, "UUID="); ok {
+			uuid = value
+		}
+	}
+	if uuid == "" {
+		return "", fmt.Errorf("could not find the UUID of RAID array %s", device)
+	}
+
+	mdadmConf := filepath.Join(root, cnst.MdadmConf)
+	err = utils.MkdirAll(c.Fs, filepath.Dir(mdadmConf), cnst.DirPerm)
+	if err != nil {
+		return "", err
+	}
+	err = atomicfile.WriteFile(c.Fs, mdadmConf, out, cnst.FilePerm)
+	if err != nil {
+		return "", err
+	}
+	return uuid, nil
+}
+
 // FormatPartition will format an already existing partition
 func FormatPartition(c types.Config, part *types.Partition, opts ...string) error {
 	c.Logger.Infof("Formatting '%s' partition", part.Name)
-	return partitioner.FormatDevice(c.Runner, part.Path, part.FS, part.FilesystemLabel, opts...)
+	// Stale signatures could be reported along with the new filesystem label
+	err := utils.WipeFilesystemSignatures(c.Runner, part.Path)
+	if err != nil {
+		return err
+	}
+	return partitioner.FormatDevice(c.Runner, part.Path, part.FS, part.FilesystemLabel, part.FSUUID, mkfsArgs(c, part.FS, opts...)...)
+}
+
+// mkfsArgs returns the given mkfs options followed by the custom mkfs arguments configured
+// for the given filesystem
+func mkfsArgs(c types.Config, fs string, opts ...string) []string {
+	args := append([]string{}, opts...)
+	return append(args, c.MkfsArgs[fs]...)
 }
 
 // PartitionAndFormatDevice creates a new empty partition table on target disk
@@ -50,6 +119,7 @@ func PartitionAndFormatDevice(c types.Config, i *types.InstallSpec) error {
 		partitioner.WithFS(c.Fs),
 		partitioner.WithLogger(c.Logger),
 		partitioner.WithMounter(c.Mounter),
+		partitioner.WithSizeTolerance(c.PartitionSizeTolerance),
 	)
 
 	if !disk.Exists() {
@@ -68,9 +138,85 @@ func PartitionAndFormatDevice(c types.Config, i *types.InstallSpec) error {
 	return createPartitions(c, disk, parts)
 }
 
+// CheckPartitionSpace checks there is enough free space at the end of the given disk to add
+// the given partition, the disk is not modified.
+func CheckPartitionSpace(c types.Config, device string, part *types.Partition) error {
+	disk := partitioner.NewDisk(
+		device,
+		partitioner.WithRunner(c.Runner),
+		partitioner.WithFS(c.Fs),
+		partitioner.WithLogger(c.Logger),
+		partitioner.WithMounter(c.Mounter),
+	)
+	if !disk.CheckDiskFreeSpaceMiB(part.Size) {
+		return fmt.Errorf("not enough free space in disk %s for a %dMiB %s partition", device, part.Size, part.Name)
+	}
+	return nil
+}
+
+// AddPartition creates and formats the given partition in the free space at the end of the
+// given disk. It fails if there is not enough free space for the partition size.
+func AddPartition(c types.Config, device string, part *types.Partition) error {
+	disk := partitioner.NewDisk(
+		device,
+		partitioner.WithRunner(c.Runner),
+		partitioner.WithFS(c.Fs),
+		partitioner.WithLogger(c.Logger),
+		partitioner.WithMounter(c.Mounter),
+		partitioner.WithSizeTolerance(c.PartitionSizeTolerance),
+	)
+	if !disk.CheckDiskFreeSpaceMiB(part.Size) {
+		return fmt.Errorf("not enough free space in disk %s for a %dMiB %s partition", device, part.Size, part.Name)
+	}
+	last, err := disk.LastPartitionNumber()
+	if err != nil {
+		return err
+	}
+	err = createAndFormatPartition(c, disk, part)
+	if err != nil {
+		// Do not leave a half created partition behind
+		num, nErr := disk.LastPartitionNumber()
+		if nErr == nil && num > last {
+			c.Logger.Warnf("removing partially created %s partition", part.Name)
+			if rErr := disk.RemovePartition(num); rErr != nil {
+				c.Logger.Errorf("failed removing partition %d of %s: %v", num, device, rErr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// RemovePartition deletes the given partition from the given disk. Only the partition at the end
+// of the disk can be removed, as created by AddPartition.
+func RemovePartition(c types.Config, device string, part *types.Partition) error {
+	disk := partitioner.NewDisk(
+		device,
+		partitioner.WithRunner(c.Runner),
+		partitioner.WithFS(c.Fs),
+		partitioner.WithLogger(c.Logger),
+		partitioner.WithMounter(c.Mounter),
+	)
+	num, err := disk.LastPartitionNumber()
+	if err != nil {
+		return err
+	}
+	if num == 0 {
+		return fmt.Errorf("no partition found in disk %s", device)
+	}
+	partDev, err := disk.FindPartitionDevice(num)
+	if err != nil {
+		return err
+	}
+	if partDev != part.Path {
+		return fmt.Errorf("partition %s is not the last partition of disk %s", part.Path, device)
+	}
+	return disk.RemovePartition(num)
+}
+
 func createAndFormatPartition(c types.Config, disk *partitioner.Disk, part *types.Partition) error {
 	c.Logger.Debugf("Adding partition %s", part.Name)
-	num, err := disk.AddPartition(part.Size, part.FS, part.Name, part.Flags...)
+	num, err := disk.AddTypedPartition(part.Size, part.FS, part.Name, part.TypeGUID, part.Flags...)
 	if err != nil {
 		c.Logger.Errorf("Failed creating %s partition", part.Name)
 		return err
@@ -79,20 +225,21 @@ func createAndFormatPartition(c types.Config, disk *partitioner.Disk, part *type
 	if err != nil {
 		return err
 	}
+	// Partitions from a previous layout might start at the same sector, wipe their
+	// signatures so stale filesystem labels are not reported
+	c.Logger.Debugf("Wipe file system on %s", part.Name)
+	err = disk.WipeFsOnPartition(partDev)
+	if err != nil {
+		c.Logger.Errorf("Failed to wipe filesystem of partition %s", partDev)
+		return err
+	}
 	if part.FS != "" {
 		c.Logger.Debugf("Formatting partition with label %s", part.FilesystemLabel)
-		err = partitioner.FormatDevice(c.Runner, partDev, part.FS, part.FilesystemLabel)
+		err = partitioner.FormatDevice(c.Runner, partDev, part.FS, part.FilesystemLabel, part.FSUUID, mkfsArgs(c, part.FS)...)
 		if err != nil {
 			c.Logger.Errorf("Failed formatting partition %s", part.Name)
 			return err
 		}
-	} else {
-		c.Logger.Debugf("Wipe file system on %s", part.Name)
-		err = disk.WipeFsOnPartition(partDev)
-		if err != nil {
-			c.Logger.Errorf("Failed to wipe filesystem of partition %s", partDev)
-			return err
-		}
 	}
 	part.Path = partDev
 	return nil
@@ -108,12 +255,12 @@ func createPartitions(c types.Config, disk *partitioner.Disk, parts types.Partit
 	return nil
 }
 
-// MountPartitions mounts configured partitions. Partitions with an unset mountpoint are not mounted.
-// Paritions already mounted are not remounted. Note umounts must be handled by caller logic.
-func MountPartitions(c types.Config, parts types.PartitionList, overwriteFlags ...string) error {
+// MountPartitions mounts configured partitions with the given mount options. Partitions with an
+// unset mountpoint are not mounted. Paritions already mounted are not remounted. Note umounts must
+// be handled by caller logic.
+func MountPartitions(c types.Config, parts types.PartitionList, opts ...string) error {
 	c.Logger.Infof("Mounting disk partitions")
 	var err error
-	var flags []string
 
 	for _, part := range parts {
 		if part.MountPoint == "" {
@@ -121,11 +268,8 @@ func MountPartitions(c types.Config, parts types.PartitionList, overwriteFlags .
 			continue
 		}
 		if ok, _ := IsMounted(c, part); !ok {
-			flags = part.Flags
-			if len(overwriteFlags) > 0 {
-				flags = overwriteFlags
-			}
-			err = MountPartition(c, part, flags...)
+			// Partition flags are partition table flags, not mount options
+			err = MountPartition(c, part, opts...)
 			if err != nil {
 				_ = UnmountPartitions(c, parts)
 				return err
@@ -169,13 +313,7 @@ func IsMounted(c types.Config, part *types.Partition) (bool, error) {
 	if part.MountPoint == "" {
 		return false, nil
 	}
-	// Using IsLikelyNotMountPoint seams to be safe as we are not checking
-	// for bind mounts here
-	notMnt, err := c.Mounter.IsLikelyNotMountPoint(part.MountPoint)
-	if err != nil {
-		return false, err
-	}
-	return !notMnt, nil
+	return utils.IsMounted(c.Mounter, part.MountPoint), nil
 }
 
 func IsRWMountPoint(r types.Runner, mountPoint string) (bool, error) {
@@ -215,8 +353,13 @@ func MountRWPartition(c types.Config, part *types.Partition) (umount func() erro
 	return umount, nil
 }
 
-// MountPartition mounts a partition with the given mount options
+// MountPartition mounts a partition with the given mount options or does nothing if it is
+// already mounted, remounts are always applied
 func MountPartition(c types.Config, part *types.Partition, opts ...string) error {
+	if !slices.Contains(opts, "remount") && utils.IsMounted(c.Mounter, part.MountPoint) {
+		c.Logger.Debugf("Not mounting partition, %s is already a mountpoint", part.MountPoint)
+		return nil
+	}
 	c.Logger.Debugf("Mounting partition %s", part.FilesystemLabel)
 	err := utils.MkdirAll(c.Fs, part.MountPoint, cnst.DirPerm)
 	if err != nil {
@@ -250,8 +393,16 @@ func UnmountPartition(c types.Config, part *types.Partition) error {
 	return c.Mounter.Unmount(part.MountPoint)
 }
 
-// MountFileSystemImage mounts an image with the given mount options
+// MountFileSystemImage mounts an image with the given mount options or does nothing if it is
+// already mounted
 func MountFileSystemImage(c types.Config, img *types.Image, opts ...string) error {
+	if utils.IsMounted(c.Mounter, img.MountPoint) {
+		c.Logger.Debugf("Not mounting image, %s is already a mountpoint", img.MountPoint)
+		if img.LoopDevice == "" {
+			img.LoopDevice = mountedDevice(c, img.MountPoint)
+		}
+		return nil
+	}
 	c.Logger.Debugf("Mounting image %s to %s", img.Label, img.MountPoint)
 	err := utils.MkdirAll(c.Fs, img.MountPoint, cnst.DirPerm)
 	if err != nil {
@@ -274,11 +425,20 @@ func MountFileSystemImage(c types.Config, img *types.Image, opts ...string) erro
 	return nil
 }
 
+// mountedDevice returns the device mounted at the given path, if any
+func mountedDevice(c types.Config, path string) string {
+	mnts, _ := c.Mounter.List()
+	for _, mnt := range mnts {
+		if filepath.Clean(mnt.Path) == filepath.Clean(path) {
+			return mnt.Device
+		}
+	}
+	return ""
+}
+
 // UnmountFilesystemImage unmounts the given image or does nothing if not mounted
 func UnmountFileSystemImage(c types.Config, img *types.Image) error {
-	// Using IsLikelyNotMountPoint seams to be safe as we are not checking
-	// for bind mounts here
-	if notMnt, _ := c.Mounter.IsLikelyNotMountPoint(img.MountPoint); notMnt {
+	if !utils.IsMounted(c.Mounter, img.MountPoint) {
 		c.Logger.Debugf("Not unmounting image, %s doesn't look like mountpoint", img.MountPoint)
 		return nil
 	}
@@ -293,6 +453,48 @@ func UnmountFileSystemImage(c types.Config, img *types.Image) error {
 	return err
 }
 
+// CreateImageFile creates an image backing file of the given size in MiB, either sparse or
+// fully allocated as set in the configuration. It fails if the filesystem holding the file
+// does not support the configured allocation.
+func CreateImageFile(c types.Config, filename string, size uint) error {
+	if c.SparseImages {
+		dir := filepath.Dir(filename)
+		out, err := c.Runner.Run("findmnt", "-nfo", "FSTYPE", "-T", dir)
+		fsType := strings.TrimSpace(string(out))
+		if err == nil && slices.Contains(cnst.GetNonSparseFilesystems(), fsType) {
+			return fmt.Errorf("the %s filesystem of %s does not support sparse files, set sparse-images to false", fsType, dir)
+		}
+		return utils.CreateRAWFile(c.Fs, filename, size)
+	}
+
+	err := utils.CreateRAWFile(c.Fs, filename, size)
+	if err != nil {
+		return err
+	}
+	err = AllocateFile(c, filename)
+	if err != nil {
+		_ = c.Fs.RemoveAll(filename)
+		return err
+	}
+	return nil
+}
+
+// AllocateFile allocates all the blocks of the given file, so none of it is sparse
+func AllocateFile(c types.Config, filename string) error {
+	info, err := c.Fs.Stat(filename)
+	if err != nil {
+		return err
+	}
+	out, err := c.Runner.Run("fallocate", "-l", strconv.FormatInt(info.Size(), 10), filename)
+	if err != nil {
+		return fmt.Errorf(
+			"the filesystem of %s does not support fully allocated files, set sparse-images to true: %s",
+			filepath.Dir(filename), strings.TrimSpace(string(out)),
+		)
+	}
+	return nil
+}
+
 // CreateFileSystemImage creates the image file for the given image. An root tree path
 // can be used to determine the image size and the preload flag can be used to create an image
 // including the root tree data.
@@ -305,15 +507,15 @@ func CreateFileSystemImage(c types.Config, img *types.Image, rootDir string, pre
 	}
 
 	if img.Size == 0 && rootDir != "" {
-		size, err := utils.DirSizeMB(c.Fs, rootDir, excludes...)
+		size, err := utils.DirSize(c.Fs, rootDir, excludes...)
 		if err != nil {
 			return err
 		}
-		img.Size = size + cnst.ImgOverhead
+		img.Size = uint(utils.ComputeImageSize(size, c.ImageSizePolicy) / (1024 * 1024))
 		c.Logger.Debugf("Image size %dM", img.Size)
 	}
 
-	err = utils.CreateRAWFile(c.Fs, img.File, img.Size)
+	err = CreateImageFile(c, img.File, img.Size)
 	if err != nil {
 		c.Logger.Errorf("failed creating raw file %s", img.File)
 		return err
@@ -325,11 +527,18 @@ func CreateFileSystemImage(c types.Config, img *types.Image, rootDir string, pre
 	if preload && match {
 		extraOpts = []string{"-d", rootDir}
 	}
+	if rootDir != "" && match {
+		inodeOpts, err := inodeArgs(c, img, rootDir, excludes...)
+		if err != nil {
+			return err
+		}
+		extraOpts = append(extraOpts, inodeOpts...)
+	}
 	if preload && !match {
 		c.Logger.Errorf("Preloaded filesystem images are only supported for ext2-4 filesystems")
 		return fmt.Errorf("unexpected filesystem: %s", img.FS)
 	}
-	mkfs := partitioner.NewMkfsCall(img.File, img.FS, img.Label, c.Runner, extraOpts...)
+	mkfs := partitioner.NewMkfsCall(img.File, img.FS, img.Label, c.Runner, mkfsArgs(c, img.FS, extraOpts...)...)
 	_, err = mkfs.Apply()
 	if err != nil {
 		c.Logger.Errorf("failed formatting file %s with %s", img.File, img.FS)
@@ -339,10 +548,55 @@ func CreateFileSystemImage(c types.Config, img *types.Image, rootDir string, pre
 	return nil
 }
 
+// inodeArgs returns the mkfs options to create the given ext image with enough inodes for the
+// given root tree, if the default inode ratio falls short, as with trees of many small files.
+// Nothing is set if the inode count or ratio are already set in the custom mkfs arguments.
+func inodeArgs(c types.Config, img *types.Image, rootDir string, excludes ...string) ([]string, error) {
+	for _, arg := range c.MkfsArgs[img.FS] {
+		if arg == "-N" || arg == "-i" {
+			return nil, nil
+		}
+	}
+	count, err := utils.CountInodes(c.Fs, rootDir, excludes...)
+	if err != nil {
+		return nil, err
+	}
+	inodes := utils.ComputeImageInodes(count, c.ImageSizePolicy)
+	if inodes <= uint64(img.Size)*1024*1024/cnst.ExtBytesPerInode {
+		return nil, nil
+	}
+	c.Logger.Debugf("Image %s requires %d inodes", img.File, inodes)
+	return []string{"-N", strconv.FormatUint(inodes, 10)}, nil
+}
+
+// escapeWildcards escapes wildcard characters from the given paths so they are
+// matched literally as squashfs and rsync exclude patterns.
+func escapeWildcards(paths []string) []string {
+	escaper := strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`)
+	escaped := make([]string, len(paths))
+	for i, path := range paths {
+		escaped[i] = escaper.Replace(path)
+	}
+	return escaped
+}
+
 // CreateImageFromTree creates the given image including the given root tree. If preload flag is true
 // it attempts to preload the root tree at filesystem format time. This allows creating images with the
 // given root tree without the need of mounting them.
 func CreateImageFromTree(c types.Config, img *types.Image, rootDir string, preload bool, cleaners ...func() error) (err error) {
+	return createImageFromTree(c, img, rootDir, preload, nil, cleaners...)
+}
+
+// CreateImageFromTreeExcluding creates the given image including the given root tree except the given
+// paths, relative to the root tree with a leading '/'. Paths are matched literally, not as patterns.
+func CreateImageFromTreeExcluding(c types.Config, img *types.Image, rootDir string, paths []string, cleaners ...func() error) error {
+	return createImageFromTree(c, img, rootDir, false, paths, cleaners...)
+}
+
+// createImageFromTree creates the given image including the given root tree except the default
+// system excludes and the given paths, relative to the root tree with a leading '/'. Paths are
+// matched literally, not as patterns.
+func createImageFromTree(c types.Config, img *types.Image, rootDir string, preload bool, paths []string, cleaners ...func() error) (err error) {
 	defer func() {
 		for _, cleaner := range cleaners {
 			if cleaner == nil {
@@ -355,6 +609,69 @@ func CreateImageFromTree(c types.Config, img *types.Image, rootDir string, prelo
 		}
 	}()
 
+	for attempt := 1; ; attempt++ {
+		err = writeImageFromTree(c, img, rootDir, preload, paths)
+		if err != nil || c.MaxImageCopyRetries == 0 {
+			return err
+		}
+		err = verifyImage(c, img.File, rootDir, paths)
+		if err == nil {
+			return nil
+		}
+		if attempt > c.MaxImageCopyRetries {
+			c.Logger.Errorf("image %s verification failed, no retries left", img.File)
+			return err
+		}
+		c.Logger.Warnf("image %s verification failed, creating it again (retry %d of %d): %v", img.File, attempt, c.MaxImageCopyRetries, err)
+		if err = c.Fs.RemoveAll(img.File); err != nil {
+			return err
+		}
+	}
+}
+
+// verifyImage checks the data of the given image file matches the root tree it was created from,
+// except the default system excludes and the given paths, relative to the root tree with a leading '/'
+func verifyImage(c types.Config, file string, rootDir string, paths []string) (err error) {
+	mountPoint, err := utils.TempDir(c.Fs, "", "elemental-verify")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = c.Fs.RemoveAll(mountPoint)
+	}()
+
+	img := &types.Image{File: file, MountPoint: mountPoint}
+	err = MountFileSystemImage(c, img, "ro")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		uErr := UnmountFileSystemImage(c, img)
+		if err == nil && uErr != nil {
+			err = uErr
+		}
+	}()
+
+	var excludes []string
+	for _, path := range cnst.GetDefaultSystemExcludes() {
+		excludes = append(excludes, "/"+path)
+	}
+	diff, err := utils.DiffData(c.Logger, c.Runner, c.Fs, rootDir, mountPoint, append(excludes, escapeWildcards(paths)...)...)
+	if err != nil {
+		return err
+	}
+	if len(diff) > 0 {
+		return elementalError.New(
+			fmt.Sprintf("%d paths of image %s do not match %s, first one is '%s'", len(diff), file, rootDir, diff[0]),
+			elementalError.VerifyImage,
+		)
+	}
+	return nil
+}
+
+// writeImageFromTree writes the given image including the given root tree except the default
+// system excludes and the given paths
+func writeImageFromTree(c types.Config, img *types.Image, rootDir string, preload bool, paths []string) (err error) {
 	if img.FS == cnst.SquashFs {
 		c.Logger.Infof("Creating squashfs image for file %s", img.File)
 
@@ -370,14 +687,21 @@ func CreateImageFromTree(c types.Config, img *types.Image, rootDir string, prelo
 		}
 
 		excludes := cnst.GetDefaultSystemExcludes()
-		err = utils.CreateSquashFS(c.Runner, c.Logger, rootDir, img.File, c.SquashFsCompressionConfig, excludes...)
+		for _, path := range escapeWildcards(paths) {
+			excludes = append(excludes, strings.TrimPrefix(path, "/"))
+		}
+		opts := mkfsArgs(c, cnst.SquashFs, c.SquashFsCompressionConfig...)
+		err = utils.CreateSquashFS(c.Runner, c.Logger, rootDir, img.File, opts, excludes...)
 		if err != nil {
 			c.Logger.Errorf("failed creating squashfs image for %s: %v", img.File, err)
 			return err
 		}
 	} else {
+		if preload && len(paths) > 0 {
+			return fmt.Errorf("excluding paths is not supported for preloaded images")
+		}
 		excludes := cnst.GetDefaultSystemRootedExcludes(rootDir)
-		err = CreateFileSystemImage(c, img, rootDir, preload, excludes...)
+		err = CreateFileSystemImage(c, img, rootDir, preload, append(excludes, utils.PreAppendRoot(rootDir, paths...)...)...)
 		if err != nil {
 			c.Logger.Errorf("failed creating filesystem image: %v", err)
 			return err
@@ -396,7 +720,8 @@ func CreateImageFromTree(c types.Config, img *types.Image, rootDir string, prelo
 			}()
 
 			c.Logger.Infof("Sync %s to %s", rootDir, img.MountPoint)
-			err = utils.SyncData(c.Logger, c.Runner, c.Fs, rootDir, img.MountPoint, excludes...)
+			// A leading '/' anchors rsync excludes to the root of the transfer
+			err = utils.SyncData(c.Logger, c.Runner, c.Fs, rootDir, img.MountPoint, append(excludes, escapeWildcards(paths)...)...)
 			if err != nil {
 				c.Logger.Errorf("failed syncing data to the target loop image: %v", err)
 				return err
@@ -444,8 +769,9 @@ func CopyFileImg(c types.Config, img *types.Image) error {
 // extracts kernel+initrd to the same directory.
 // This can be used for both ISO (all artifacts in same output dir) and raw
 // disks (kernel and initrd in ESP, rootfs squashfs image in recovery
-// partition.
-func DeployRecoverySystem(cfg types.Config, img *types.Image) error {
+// partition. Optional excludes are paths, relative to the source tree with
+// a leading '/', that are not included in the recovery image.
+func DeployRecoverySystem(cfg types.Config, img *types.Image, excludes ...string) error {
 	var err error
 	var cleaner func() error
 
@@ -476,16 +802,21 @@ func DeployRecoverySystem(cfg types.Config, img *types.Image) error {
 			}
 			return cfg.Fs.RemoveAll(transientTree)
 		}
-	} else if img.Source.IsImage() {
+	} else if img.Source.IsImage() || img.Source.IsCustom() {
 		err = MirrorRoot(cfg, transientTree, img.Source)
 		if err != nil {
 			cfg.Logger.Errorf("failed dumping image tree: %v", err)
 			return err
 		}
 		cleaner = func() error { return cfg.Fs.RemoveAll(transientTree) }
+		err = LinkKernelInitrd(cfg, transientTree)
+		if err != nil {
+			cfg.Logger.Errorf("failed linking kernel and initrd: %v", err)
+			return err
+		}
 	}
 
-	kernel, initrd, err := utils.FindKernelInitrd(cfg.Fs, transientTree)
+	kernel, initrd, err := FindKernelInitrd(cfg, transientTree)
 	if err != nil {
 		cfg.Logger.Errorf("Could not find kernel and/or initrd: %s", err.Error())
 		return err
@@ -535,7 +866,7 @@ func DeployRecoverySystem(cfg types.Config, img *types.Image) error {
 		}
 	}
 
-	err = CreateImageFromTree(cfg, img, transientTree, false, cleaner)
+	err = createImageFromTree(cfg, img, transientTree, false, excludes, cleaner)
 	if err != nil {
 		cfg.Logger.Errorf("Failed creating image from image tree: %s", err.Error())
 		return err
@@ -546,104 +877,500 @@ func DeployRecoverySystem(cfg types.Config, img *types.Image) error {
 
 // DumpSource dumps the imgSrc data to target. SyncFunc argument is the function used to synchronize file or directory
 // sources (unused for contaier images), defaults to utils.SyncData if nil provided.
-func DumpSource(
-	c types.Config, target string, imgSrc *types.ImageSource,
-	syncFunc func(
-		l types.Logger, r types.Runner, f types.FS, src string, dst string, excl ...string,
-	) error,
-) error { // nolint:gocyclo
-	var err error
-	var digest string
-
+func DumpSource(c types.Config, target string, imgSrc *types.ImageSource, syncFunc types.SyncFunc) error {
 	if syncFunc == nil {
 		syncFunc = utils.SyncData
 	}
 
 	c.Logger.Infof("Copying %s source...", imgSrc.Value())
 
-	err = utils.MkdirAll(c.Fs, target, cnst.DirPerm)
+	err := utils.MkdirAll(c.Fs, target, cnst.DirPerm)
 	if err != nil {
 		c.Logger.Errorf("failed to create target directory %s", target)
 		return err
 	}
 
-	if imgSrc.IsImage() {
+	handler := types.GetSourceHandler(imgSrc.Scheme())
+	if handler == nil {
+		return fmt.Errorf("unknown image source type")
+	}
+	digest, err := handler(c, imgSrc, target, syncFunc)
+	if err != nil {
+		return err
+	}
+	if digest != "" {
+		imgSrc.SetDigest(digest)
+	}
+
+	c.Logger.Infof("Finished copying %s into %s", imgSrc.Value(), target)
+	return nil
+}
+
+func init() {
+	for scheme, handler := range map[string]types.SourceHandler{
+		types.OCIScheme:  dumpImageSource,
+		types.DirScheme:  dumpDirSource,
+		types.FileScheme: dumpFileSource,
+	} {
+		if err := types.RegisterSourceHandler(scheme, handler); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// dumpImageSource is the source handler of container images, the image signature is
+// verified first if cosign is enabled
+func dumpImageSource(c types.Config, imgSrc *types.ImageSource, target string, _ types.SyncFunc) (string, error) {
+	if c.Cosign {
+		c.Logger.Infof("Running cosing verification for %s", imgSrc.Value())
+		out, err := utils.CosignVerify(
+			c.Fs, c.Runner, imgSrc.Value(),
+			c.CosignPubKey, types.IsDebugLevel(c.Logger), imgSrc.GetAuth(),
+		)
+		if err != nil {
+			c.Logger.Errorf("Cosign verification failed: %s", out)
+			return "", elementalError.NewFromError(fmt.Errorf("cosign verification of %s failed: %w", imgSrc.Value(), err), elementalError.CosignVerify)
+		}
+	}
+	return extractImage(c, imgSrc.Value(), target, imgSrc.GetAuth())
+}
+
+// dumpDirSource is the source handler of directories
+func dumpDirSource(c types.Config, imgSrc *types.ImageSource, target string, syncFunc types.SyncFunc) (string, error) {
+	excludes := cnst.GetDefaultSystemRootedExcludes(imgSrc.Value())
+	return "", syncFunc(c.Logger, c.Runner, c.Fs, imgSrc.Value(), target, excludes...)
+}
+
+// dumpFileSource is the source handler of filesystem image files
+func dumpFileSource(c types.Config, imgSrc *types.ImageSource, target string, syncFunc types.SyncFunc) (string, error) {
+	err := utils.MkdirAll(c.Fs, cnst.ImgSrcDir, cnst.DirPerm)
+	if err != nil {
+		return "", err
+	}
+	img := &types.Image{File: imgSrc.Value(), MountPoint: cnst.ImgSrcDir}
+	err = MountFileSystemImage(c, img, "auto", "ro")
+	if err != nil {
+		return "", err
+	}
+	defer UnmountFileSystemImage(c, img) // nolint:errcheck
+	return "", syncFunc(c.Logger, c.Runner, c.Fs, cnst.ImgSrcDir, target)
+}
+
+// extractImage extracts the given image reference to target. If a registry mirror is configured
+// the image is pulled from the mirror first, falling back to the upstream registry on failure.
+// The given credentials are only used for the upstream registry. The mirror is not used with
+// cosign verification, as the verified signature applies to the upstream reference only.
+func extractImage(c types.Config, imgRef, target string, auth *types.RegistryAuth) (string, error) {
+	if c.RegistryMirror != "" && !c.LocalImage {
+		mirrorRef, err := mirrorImageRef(imgRef, c.RegistryMirror)
 		if c.Cosign {
-			c.Logger.Infof("Running cosing verification for %s", imgSrc.Value())
-			out, err := utils.CosignVerify(
-				c.Fs, c.Runner, imgSrc.Value(),
-				c.CosignPubKey, types.IsDebugLevel(c.Logger),
-			)
+			c.Logger.Infof("Cosign verification enabled, not using registry mirror for %s", imgRef)
+		} else if err != nil {
+			c.Logger.Warnf("could not compute mirrored reference for %s: %v", imgRef, err)
+		} else {
+			c.Logger.Infof("Pulling %s from registry mirror", mirrorRef)
+			digest, err := c.ImageExtractor.ExtractImage(mirrorRef, target, c.Platform.String(), false, c.Verify, nil)
+			if err == nil {
+				return digest, nil
+			}
+			c.Logger.Warnf("failed pulling %s from mirror, falling back to upstream: %v", mirrorRef, err)
+			// Do not mix partially extracted layers with the upstream ones
+			err = clearDir(c.Fs, target)
 			if err != nil {
-				c.Logger.Errorf("Cosign verification failed: %s", out)
-				return err
+				c.Logger.Errorf("failed cleaning %s: %v", target, err)
+				return "", err
 			}
 		}
+	}
+	if auth != nil {
+		c.Logger.Debugf("Pulling %s with credentials %s", imgRef, auth)
+	}
+	return c.ImageExtractor.ExtractImage(imgRef, target, c.Platform.String(), c.LocalImage, c.Verify, auth)
+}
 
-		digest, err = c.ImageExtractor.ExtractImage(imgSrc.Value(), target, c.Platform.String(), c.LocalImage, c.Verify)
+// clearDir removes the contents of the given directory, keeping the directory itself
+func clearDir(vfs types.FS, dir string) error {
+	entries, err := vfs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err = vfs.RemoveAll(filepath.Join(dir, entry.Name()))
 		if err != nil {
 			return err
 		}
-		imgSrc.SetDigest(digest)
-	} else if imgSrc.IsDir() {
-		excludes := cnst.GetDefaultSystemRootedExcludes(imgSrc.Value())
-		err = syncFunc(c.Logger, c.Runner, c.Fs, imgSrc.Value(), target, excludes...)
-		if err != nil {
+	}
+	return nil
+}
+
+// mirrorImageRef returns the given image reference with its registry domain replaced by
+// the given mirror. The mirror can include a path prefix, e.g. 'mirror.local:5000/cache'.
+func mirrorImageRef(imgRef, mirror string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(imgRef)
+	if err != nil {
+		return "", err
+	}
+	mirrored := fmt.Sprintf("%s/%s", strings.TrimSuffix(mirror, "/"), reference.Path(named))
+	if tagged, ok := named.(reference.Tagged); ok {
+		mirrored = fmt.Sprintf("%s:%s", mirrored, tagged.Tag())
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		mirrored = fmt.Sprintf("%s@%s", mirrored, digested.Digest())
+	}
+	return mirrored, nil
+}
+
+// MirrorRoot mirrors image source contents to target. Any preexisting data in target is going to be overwritten or
+// deleted to perfectly match image source contents.
+func MirrorRoot(c types.Config, target string, imgSrc *types.ImageSource) error {
+	err := DumpSource(c, target, imgSrc, utils.MirrorData)
+	if err != nil {
+		return err
+	}
+	return utils.CreateDirStructure(c.Fs, target)
+}
+
+// CopyCloudConfig will check if there is a cloud init in the config and store it on the target
+func CopyCloudConfig(c types.Config, path string, cloudInit []string) (err error) {
+	if path == "" {
+		c.Logger.Warnf("empty path. Will not copy cloud config files.")
+		return nil
+	}
+	if len(cloudInit) > 0 {
+		if err = secureConfigDir(c, path); err != nil {
 			return err
 		}
-	} else if imgSrc.IsFile() {
-		err = utils.MkdirAll(c.Fs, cnst.ImgSrcDir, cnst.DirPerm)
+	}
+	for i, ci := range cloudInit {
+		customConfig := filepath.Join(path, fmt.Sprintf("9%d_custom.yaml", i))
+		tmpConfig := atomicfile.TempName(customConfig)
+		err = utils.GetSource(c, ci, tmpConfig)
 		if err != nil {
+			_ = c.Fs.Remove(tmpConfig)
+			return err
+		}
+		if err = c.Fs.Chmod(tmpConfig, c.ConfigFilePerm()); err != nil {
+			_ = c.Fs.Remove(tmpConfig)
+			return err
+		}
+		if err = atomicfile.SyncAndRename(c.Fs, tmpConfig, customConfig); err != nil {
 			return err
 		}
-		img := &types.Image{File: imgSrc.Value(), MountPoint: cnst.ImgSrcDir}
-		err = MountFileSystemImage(c, img, "auto", "ro")
+		c.Logger.Infof("Finished copying cloud config file %s to %s", cloudInit, customConfig)
+	}
+	return nil
+}
+
+// WriteDefaultCloudConfig writes the yaml files of the given default cloud-config filesystem
+// in the given path, file names are kept.
+func WriteDefaultCloudConfig(c types.Config, path string, configs iofs.FS) error {
+	if path == "" {
+		c.Logger.Warnf("empty path. Will not write default cloud config files.")
+		return nil
+	}
+	files, err := iofs.Glob(configs, "*.yaml")
+	if err != nil {
+		return err
+	}
+	if err = secureConfigDir(c, path); err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := iofs.ReadFile(configs, file)
 		if err != nil {
 			return err
 		}
-		defer UnmountFileSystemImage(c, img) // nolint:errcheck
-		err = syncFunc(c.Logger, c.Runner, c.Fs, cnst.ImgSrcDir, target)
+		err = atomicfile.WriteFile(c.Fs, filepath.Join(path, file), data, c.ConfigFilePerm())
 		if err != nil {
 			return err
 		}
-	} else {
-		return fmt.Errorf("unknown image source type")
+		c.Logger.Infof("Written default cloud config file %s", filepath.Join(path, file))
 	}
+	return nil
+}
 
-	c.Logger.Infof("Finished copying %s into %s", imgSrc.Value(), target)
+// ValidateCloudConfig parses all the cloud-init files in the given path as they are parsed on
+// boot, so malformed files are reported before booting the system
+func ValidateCloudConfig(c types.Config, path string) error {
+	if path == "" {
+		return nil
+	}
+	var files []string
+	for _, pattern := range []string{"*.yaml", "*.yml"} {
+		matches, err := c.Fs.Glob(filepath.Join(path, pattern))
+		if err != nil {
+			return err
+		}
+		files = append(files, matches...)
+	}
+	for _, file := range files {
+		if err := c.CloudInitRunner.Validate(file); err != nil {
+			return fmt.Errorf("invalid cloud-init file %s: %w", file, err)
+		}
+		c.Logger.Debugf("Validated cloud-init file %s", file)
+	}
 	return nil
 }
 
-// MirrorRoot mirrors image source contents to target. Any preexisting data in target is going to be overwritten or
-// deleted to perfectly match image source contents.
-func MirrorRoot(c types.Config, target string, imgSrc *types.ImageSource) error {
-	err := DumpSource(c, target, imgSrc, utils.MirrorData)
+const overlayConfigTmpl = `name: "Overlay Settings"
+stages:
+  rootfs:
+    - if: '[ ! -f "%s" ]'
+      name: "Overlay configuration"
+      files:
+        - path: /run/elemental/config.d/overlay.yaml
+          content: |
+            mount:
+%s
+`
+
+// SeedRootPartition copies the given deployed root tree but /usr to the separate root
+// partition. The contents of /var are left to the var partition, if any.
+func SeedRootPartition(c types.Config, tree string, parts types.ElementalPartitions) error {
+	excludes := append(cnst.GetDefaultSystemExcludes(), cnst.UsrPath)
+	if parts.Var != nil {
+		excludes = append(excludes, cnst.VarPath+"/*")
+	}
+	c.Logger.Infof("Seeding the root partition from %s", tree)
+	return utils.SyncData(c.Logger, c.Runner, c.Fs, tree, parts.Root.MountPoint, excludes...)
+}
+
+// WriteOverlayConfig writes a cloud-config file in the given path setting the
+// backend of the /etc overlay and mounting the given separate /var and root partitions.
+// It is a no-op for an empty backend and nil var and root partitions.
+func WriteOverlayConfig(c types.Config, path string, overlay types.OverlaySpec, varPart, rootPart *types.Partition) error {
+	if overlay.Backend == "" && varPart == nil && rootPart == nil {
+		return nil
+	}
+	if path == "" {
+		c.Logger.Warnf("empty path. Will not write the overlay config file.")
+		return nil
+	}
+
+	// Paths within the var or root partitions are neither ephemeral nor persistent overlays,
+	// only /usr is provided by the system image if there is a root partition
+	inPartition := func(p string) bool {
+		if rootPart != nil && p != cnst.UsrPath && !strings.HasPrefix(p, cnst.UsrPath+"/") {
+			return true
+		}
+		return varPart != nil && (p == cnst.VarPath || strings.HasPrefix(p, cnst.VarPath+"/"))
+	}
+	quote := func(paths []string) string {
+		if len(paths) == 0 {
+			return "[]"
+		}
+		return fmt.Sprintf("['%s']", strings.Join(paths, "', '"))
+	}
+
+	var mount []string
+	if varPart != nil {
+		// Lists are not merged with the default mount settings, thus default volumes are included
+		mount = append(mount, "extra-volumes:",
+			fmt.Sprintf("  - mountpoint: %s", cnst.OEMPath),
+			fmt.Sprintf("    device: PARTLABEL=%s", cnst.OEMPartName),
+			"    options: ['rw', 'defaults']",
+			fmt.Sprintf("  - mountpoint: %s", cnst.BootDir),
+			fmt.Sprintf("    device: PARTLABEL=%s", cnst.BootPartName),
+			"    options: ['ro', 'defaults']",
+			fmt.Sprintf("  - mountpoint: %s", cnst.VarPath),
+			fmt.Sprintf("    device: LABEL=%s", varPart.FilesystemLabel),
+			fmt.Sprintf("    fs: %s", varPart.FS),
+			"    options: ['rw', 'defaults']",
+		)
+	}
+	if rootPart != nil {
+		mount = append(mount, "split-root:",
+			"  volume:",
+			fmt.Sprintf("    mountpoint: %s", cnst.RootDir),
+			fmt.Sprintf("    device: LABEL=%s", rootPart.FilesystemLabel),
+			fmt.Sprintf("    fs: %s", rootPart.FS),
+			"    options: ['rw', 'defaults']",
+		)
+	}
+
+	var ephemeral []string
+	if overlay.Backend == cnst.ImmutableEtc || varPart != nil || rootPart != nil {
+		var paths []string
+		for _, p := range cnst.GetDefaultEphemeralPaths() {
+			if inPartition(p) || (overlay.Backend == cnst.ImmutableEtc && p == "/etc") {
+				continue
+			}
+			paths = append(paths, p)
+		}
+		ephemeral = append(ephemeral, fmt.Sprintf("  paths: %s", quote(paths)))
+	}
+	if overlay.Size != "" {
+		// The size is checked against the RAM at boot, the installer host RAM is irrelevant
+		ephemeral = append(ephemeral, fmt.Sprintf("  size: %s", overlay.Size))
+	}
+	if len(ephemeral) > 0 {
+		mount = append(append(mount, "ephemeral:"), ephemeral...)
+	}
+
+	var persistent []string
+	if overlay.Backend == cnst.PersistentOverlay {
+		persistent = append(persistent, "/etc")
+	}
+	for _, p := range cnst.GetDefaultPersistentPaths() {
+		// Paths within /etc are kept by /etc itself if persistent and discarded with it if in RAM
+		if (overlay.Backend == cnst.PersistentOverlay || overlay.Backend == cnst.Tmpfs) && strings.HasPrefix(p, "/etc/") {
+			continue
+		}
+		if !inPartition(p) {
+			persistent = append(persistent, p)
+		}
+	}
+	mount = append(mount, "persistent:", fmt.Sprintf("  paths: %s", quote(persistent)))
+
+	const indent = "              "
+	overlayConfig := filepath.Join(path, cnst.OverlayConfigFile)
+	data := fmt.Sprintf(overlayConfigTmpl, cnst.RecoveryMode, indent+strings.Join(mount, "\n"+indent))
+	err := secureConfigDir(c, path)
 	if err != nil {
 		return err
 	}
-	return utils.CreateDirStructure(c.Fs, target)
+	err = atomicfile.WriteFile(c.Fs, overlayConfig, []byte(data), c.ConfigFilePerm())
+	if err != nil {
+		return err
+	}
+	c.Logger.Infof("Finished writing overlay config to %s", overlayConfig)
+	return nil
 }
 
-// CopyCloudConfig will check if there is a cloud init in the config and store it on the target
-func CopyCloudConfig(c types.Config, path string, cloudInit []string) (err error) {
+const recoveryPassConfigTmpl = `name: "Recovery password"
+stages:
+  initramfs:
+    - if: '[ -f "%s" ]'
+      name: "Set the recovery root password"
+      commands:
+        - usermod -p '%s' root
+`
+
+// WriteRecoveryPassConfig writes a cloud-config file in the given path setting the root
+// password hash of the recovery system. It is a no-op for an empty hash.
+func WriteRecoveryPassConfig(c types.Config, path string, hash string) error {
+	if hash == "" {
+		return nil
+	}
 	if path == "" {
-		c.Logger.Warnf("empty path. Will not copy cloud config files.")
+		c.Logger.Warnf("empty path. Will not write the recovery password config file.")
 		return nil
 	}
-	for i, ci := range cloudInit {
-		customConfig := filepath.Join(path, fmt.Sprintf("9%d_custom.yaml", i))
-		err = utils.GetSource(c, ci, customConfig)
+	passConfig := filepath.Join(path, cnst.RecoveryPassConfig)
+	data := fmt.Sprintf(recoveryPassConfigTmpl, cnst.RecoveryMode, hash)
+	err := secureConfigDir(c, path)
+	if err != nil {
+		return err
+	}
+	err = atomicfile.WriteFile(c.Fs, passConfig, []byte(data), cnst.SecureFilePerm)
+	if err != nil {
+		return err
+	}
+	c.Logger.Infof("Finished writing recovery password config to %s", passConfig)
+	return nil
+}
+
+// WriteGrubPassword writes the grub password file in the given boot directory, so editing
+// menu entries or using the grub shell requires the root user password. The hash is
+// expected in 'grub.pbkdf2' format. It is a no-op for an empty hash.
+func WriteGrubPassword(c types.Config, bootDir string, hash string) error {
+	if hash == "" {
+		return nil
+	}
+	passFile := filepath.Join(bootDir, cnst.GrubPasswordCfg)
+	data := fmt.Sprintf("set superusers=\"root\"\nexport superusers\npassword_pbkdf2 root %s\n", hash)
+	err := atomicfile.WriteFile(c.Fs, passFile, []byte(data), 0600)
+	if err != nil {
+		return err
+	}
+	c.Logger.Infof("Finished writing grub password to %s", passFile)
+	return nil
+}
+
+// secureConfigDir restricts the permissions of the given configuration directory if
+// secure configuration permissions are set, other directories are left untouched
+func secureConfigDir(c types.Config, path string) error {
+	if !c.SecureConfigPerms {
+		return nil
+	}
+	err := utils.MkdirAll(c.Fs, path, c.ConfigDirPerm())
+	if err != nil {
+		return err
+	}
+	return c.Fs.Chmod(path, c.ConfigDirPerm())
+}
+
+// FindKernelInitrd finds the kernel and initrd files of the given root tree. If the
+// kernel or initrd patterns are configured they are used instead of the default ones and
+// they must match a single file.
+func FindKernelInitrd(c types.Config, root string) (kernel string, initrd string, err error) {
+	if c.KernelPattern == "" && c.InitrdPattern == "" {
+		return utils.FindKernelInitrd(c.Fs, root)
+	}
+	if c.KernelPattern != "" {
+		kernel, err = utils.FindUniqueFile(c.Fs, root, c.KernelPattern)
+	} else {
+		kernel, _, err = utils.FindKernel(c.Fs, root)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed finding kernel: %w", err)
+	}
+	if c.InitrdPattern != "" {
+		initrd, err = utils.FindUniqueFile(c.Fs, root, c.InitrdPattern)
+	} else {
+		initrd, err = utils.FindInitrd(c.Fs, root)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed finding initrd: %w", err)
+	}
+	return kernel, initrd, nil
+}
+
+// LinkKernelInitrd links the kernel and initrd files matching the configured patterns
+// to the default paths the bootloader loads them from. It does nothing if
+// no pattern is configured.
+func LinkKernelInitrd(c types.Config, root string) error {
+	if c.KernelPattern == "" && c.InitrdPattern == "" {
+		return nil
+	}
+	kernel, initrd, err := FindKernelInitrd(c, root)
+	if err != nil {
+		return err
+	}
+	for link, target := range map[string]string{
+		cnst.KernelPath: kernel,
+		cnst.InitrdPath: initrd,
+	} {
+		link = filepath.Join(root, link)
+		if link == target {
+			continue
+		}
+		relTarget, err := filepath.Rel(filepath.Dir(link), target)
 		if err != nil {
 			return err
 		}
-		if err = c.Fs.Chmod(customConfig, cnst.FilePerm); err != nil {
+		c.Logger.Debugf("Creating boot symlink from %s to %s", link, relTarget)
+		_ = c.Fs.Remove(link)
+		err = c.Fs.Symlink(relTarget, link)
+		if err != nil {
 			return err
 		}
-		c.Logger.Infof("Finished copying cloud config file %s to %s", cloudInit, customConfig)
 	}
 	return nil
 }
 
+// ResetMachineID empties the machine ID of the given root tree, so systemd runs its
+// first boot setup and generates a new ID on the first boot of the system
+func ResetMachineID(c types.Config, root string) error {
+	machineID := filepath.Join(root, cnst.MachineID)
+	if ok, _ := utils.Exists(c.Fs, machineID); !ok {
+		c.Logger.Debugf("no machine ID found in %s", root)
+		return nil
+	}
+	c.Logger.Infof("Resetting machine ID")
+	return atomicfile.WriteFile(c.Fs, machineID, []byte{}, cnst.FilePerm)
+}
+
 // SelinuxRelabel will relabel the system if it finds the binary and the context
 func SelinuxRelabel(c types.Config, rootDir string, extraPaths ...string) error {
 	contextFile := filepath.Join(rootDir, cnst.SELinuxTargetedContextFile)
@@ -729,12 +1456,63 @@ func IsRecoveryMode(cfg types.Config) bool {
 	return ok
 }
 
+// StagingDir creates a temporary directory, named after the given prefix, to stage downloaded or
+// unpacked sources. It is created within the configured download directory, if any, or within the
+// given base directory, which defaults to the system temporary directory. It fails if the filesystem
+// has less than the required free space, in bytes. The check is skipped if the required space is 0.
+func StagingDir(c types.Config, base, prefix string, required uint64) (string, error) {
+	if c.DownloadDir != "" {
+		base = c.DownloadDir
+		err := utils.MkdirAll(c.Fs, base, cnst.DirPerm)
+		if err != nil {
+			return "", fmt.Errorf("failed creating download directory %s: %w", base, err)
+		}
+	}
+
+	if required > 0 {
+		requiredMiB := uint((required + 1024*1024 - 1) / (1024 * 1024))
+		dir := base
+		if dir == "" {
+			dir = os.TempDir()
+		}
+		free, err := utils.FreeSpaceMB(c.Runner, dir)
+		if err != nil {
+			c.Logger.Warnf("skipping the free space check of %s: %v", dir, err)
+		} else if free < requiredMiB {
+			return "", fmt.Errorf(
+				"%s has %dMiB free, %dMiB are required to stage the sources. Set download-dir to a larger filesystem",
+				dir, free, requiredMiB,
+			)
+		}
+	}
+	return utils.TempDir(c.Fs, base, prefix)
+}
+
+// localSize returns the size of the given local file URI. It returns 0 for remote URIs
+// or if the size can't be read.
+func localSize(c types.Config, uri string) uint64 {
+	if local, _ := utils.IsLocalURI(uri); !local {
+		return 0
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return 0
+	}
+	info, err := c.Fs.Stat(u.Path)
+	if err != nil {
+		return 0
+	}
+	return uint64(info.Size())
+}
+
 // SourceISO downloads an ISO in a temporary folder, mounts it and returns the image source to be used
 // Returns a source and cleaner method to unmount and remove the temporary folder afterwards.
-func SourceFormISO(c types.Config, iso string) (*types.ImageSource, func() error, error) {
+// If a checksum is given, either a sha256 digest or the URL of a checksum file, the downloaded
+// ISO is verified against it before being mounted.
+func SourceFormISO(c types.Config, iso, checksum string) (*types.ImageSource, func() error, error) {
 	nilErr := func() error { return nil }
 
-	tmpDir, err := utils.TempDir(c.Fs, "", "elemental")
+	tmpDir, err := StagingDir(c, "", "elemental", localSize(c, iso))
 	if err != nil {
 		return nil, nilErr, err
 	}
@@ -747,6 +1525,13 @@ func SourceFormISO(c types.Config, iso string) (*types.ImageSource, func() error
 		return nil, cleanTmpDir, err
 	}
 
+	if checksum != "" {
+		err = verifyISOChecksum(c, iso, tmpFile, checksum)
+		if err != nil {
+			return nil, cleanTmpDir, err
+		}
+	}
+
 	isoMnt := filepath.Join(tmpDir, "iso")
 	err = utils.MkdirAll(c.Fs, isoMnt, cnst.DirPerm)
 	if err != nil {
@@ -776,6 +1561,49 @@ func SourceFormISO(c types.Config, iso string) (*types.ImageSource, func() error
 	return types.NewFileSrc(squashfsImg), cleanAll, nil
 }
 
+// verifyISOChecksum compares the checksum of the downloaded ISO file with the expected one.
+// The checksum is either a digest, as in 'sha512:<checksum>', a plain sha256 or sha512
+// checksum or the URL of a checksum file in sha256sum or sha512sum format.
+func verifyISOChecksum(c types.Config, iso, file, checksum string) error {
+	expected := checksum
+	if _, _, err := utils.ParseDigest(checksum); err != nil {
+		expected = ""
+		sumFile := file + ".checksum"
+		err := utils.GetSource(c, checksum, sumFile)
+		if err != nil {
+			return fmt.Errorf("failed fetching ISO checksum file %s: %w", checksum, err)
+		}
+		data, err := c.Fs.ReadFile(sumFile)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			// Take the first digest unless there is one for this specific ISO
+			if expected == "" {
+				expected = fields[0]
+			}
+			if len(fields) > 1 && strings.TrimPrefix(fields[1], "*") == filepath.Base(iso) {
+				expected = fields[0]
+				break
+			}
+		}
+		if _, _, err := utils.ParseDigest(expected); err != nil {
+			return fmt.Errorf("no sha256 or sha512 checksum found in %s", checksum)
+		}
+	}
+
+	c.Logger.Infof("Verifying checksum of ISO %s", iso)
+	err := utils.VerifyFileDigest(c.Fs, file, expected)
+	if err != nil {
+		return fmt.Errorf("failed verifying ISO %s: %w", iso, err)
+	}
+	return nil
+}
+
 // DeactivateDevice deactivates unmounted the block devices present within the system.
 // Useful to deactivate LVM volumes, if any, related to the target device.
 func DeactivateDevices(c types.Config) error {
@@ -816,7 +1644,11 @@ func GetTempDir(c types.Config, suffix string) string {
 	}
 	// Check persistent and if its mounted
 	state, _ := c.LoadInstallState()
-	ep := types.NewElementalPartitionsFromList(parts, state)
+	ep, err := c.PartitionSelection.ElementalPartitions(parts, state)
+	if err != nil {
+		c.Logger.Debugf("Could not pick the persistent partition, defaulting to /tmp: %v", err)
+		return filepath.Join("/", "tmp", elementalTmpDir)
+	}
 	persistent := ep.Persistent
 	if persistent != nil {
 		if mnt, _ := IsMounted(c, persistent); mnt {
@@ -827,3 +1659,162 @@ func GetTempDir(c types.Config, suffix string) string {
 	c.Logger.Debug("Could not get any valid tmpdir, defaulting to /tmp")
 	return filepath.Join("/", "tmp", elementalTmpDir)
 }
+
+// VerifyKernelModules checks the kernel modules directory of the given root tree matches
+// the version of the kernel of the same tree. The kernel version is taken from the kernel
+// file name (e.g. 'vmlinuz-<version>'), if it can't be determined the check is skipped.
+func VerifyKernelModules(c types.Config, root string) error {
+	kernel, _, err := FindKernelInitrd(c, root)
+	if err != nil {
+		return err
+	}
+	kernel, err = utils.ResolveLink(c.Fs, kernel, root, cnst.MaxLinkDepth)
+	if err != nil {
+		return err
+	}
+	_, version, found := strings.Cut(filepath.Base(kernel), "-")
+	if !found || version == "" {
+		c.Logger.Warnf("could not determine the version of kernel %s, not checking kernel modules", kernel)
+		return nil
+	}
+	modules := filepath.Join(root, cnst.KernelModulesDir, version)
+	if ok, _ := utils.Exists(c.Fs, modules); !ok {
+		return fmt.Errorf("no kernel modules found for kernel version %s, %s does not exist", version, filepath.Join(cnst.KernelModulesDir, version))
+	}
+	c.Logger.Debugf("kernel modules match kernel version %s", version)
+	return nil
+}
+
+// WriteUsersConfig writes a cloud-config file in the given path creating the given users
+// and their authorized SSH keys on boot. Users are kept out of the system image, so they
+// survive upgrades and resets and their homes live in the persistent /home. It is a no-op
+// for an empty list of users.
+func WriteUsersConfig(c types.Config, path string, users []types.User) error {
+	if len(users) == 0 {
+		return nil
+	}
+	if path == "" {
+		c.Logger.Warnf("empty path. Will not write the users config file.")
+		return nil
+	}
+
+	stage := schema.Stage{Name: "Create users", Users: map[string]schema.User{}}
+	for _, user := range users {
+		// Users without password hash can only log in with SSH keys, the password of
+		// existing users is only changed if a hash is given
+		stage.Users[user.Name] = schema.User{
+			Name:              user.Name,
+			PasswordHash:      user.PasswordHash,
+			LockPasswd:        user.PasswordHash == "",
+			Groups:            user.Groups,
+			SSHAuthorizedKeys: user.SSHKeys,
+			Shell:             "/bin/bash",
+		}
+	}
+	conf := schema.YipConfig{
+		Name:   "Users",
+		Stages: map[string][]schema.Stage{"initramfs": {stage}},
+	}
+	data, err := yaml.Marshal(conf)
+	if err != nil {
+		return err
+	}
+
+	usersConfig := filepath.Join(path, cnst.UsersConfig)
+	err = secureConfigDir(c, path)
+	if err != nil {
+		return err
+	}
+	err = atomicfile.WriteFile(c.Fs, usersConfig, data, cnst.SecureFilePerm)
+	if err != nil {
+		return err
+	}
+	c.Logger.Infof("Finished writing users config to %s", usersConfig)
+	return nil
+}
+
+// SyncTime sets the system clock from the configured NTP server or timestamp and saves
+// it into the hardware clock. It does nothing if neither of them is configured.
+func SyncTime(c types.Config, spec types.TimeSyncSpec) error {
+	var out []byte
+	var err error
+
+	switch {
+	case spec.NTPServer != "":
+		c.Logger.Infof("Setting system time from NTP server %s", spec.NTPServer)
+		if c.Runner.CommandExists("chronyd") {
+			out, err = c.Runner.Run("chronyd", "-q", "-t", "30", fmt.Sprintf("server %s iburst", spec.NTPServer))
+		} else if c.Runner.CommandExists("ntpdate") {
+			out, err = c.Runner.Run("ntpdate", "-u", spec.NTPServer)
+		} else {
+			return fmt.Errorf("neither chronyd nor ntpdate are available to sync the time")
+		}
+	case spec.Timestamp != "":
+		c.Logger.Infof("Setting system time to %s", spec.Timestamp)
+		var ts time.Time
+		ts, err = time.Parse(time.RFC3339, spec.Timestamp)
+		if err != nil {
+			return err
+		}
+		out, err = c.Runner.Run("date", "-u", "-s", fmt.Sprintf("@%d", ts.Unix()))
+	default:
+		return nil
+	}
+	if err != nil {
+		c.Logger.Errorf("failed setting system time: %s", string(out))
+		return err
+	}
+
+	// Not all platforms have a hardware clock
+	out, err = c.Runner.Run("hwclock", "--systohc", "--utc")
+	if err != nil {
+		c.Logger.Warnf("failed setting the hardware clock: %s", string(out))
+	}
+	return nil
+}
+
+// SetDefaultBootTarget links the default systemd target of the given root tree to the given
+// target unit, which must be available in the same tree.
+func SetDefaultBootTarget(c types.Config, root string, target string) error {
+	if target == "" {
+		return nil
+	}
+	var unit string
+	for _, dir := range cnst.GetSystemdUnitDirs() {
+		path := filepath.Join(dir, target)
+		if path == cnst.DefaultTargetLink {
+			continue
+		}
+		if ok, _ := utils.Exists(c.Fs, filepath.Join(root, path)); ok {
+			unit = path
+			break
+		}
+	}
+	if unit == "" {
+		return fmt.Errorf("boot target %s not found in the image", target)
+	}
+	c.Logger.Infof("Setting default boot target to %s", target)
+	link := filepath.Join(root, cnst.DefaultTargetLink)
+	err := utils.MkdirAll(c.Fs, filepath.Dir(link), cnst.DirPerm)
+	if err != nil {
+		return err
+	}
+	_ = c.Fs.Remove(link)
+	return c.Fs.Symlink(unit, link)
+}
+
+// SetTimezone links the localtime file of the given root tree to the given timezone
+// which must be available in the zoneinfo database of the same tree.
+func SetTimezone(c types.Config, root string, timezone string) error {
+	if timezone == "" {
+		return nil
+	}
+	zone := filepath.Join(cnst.ZoneInfoDir, timezone)
+	if ok, _ := utils.Exists(c.Fs, filepath.Join(root, zone)); !ok {
+		return fmt.Errorf("timezone %s not found in %s", timezone, cnst.ZoneInfoDir)
+	}
+	c.Logger.Infof("Setting timezone to %s", timezone)
+	localtime := filepath.Join(root, cnst.LocalTimeFile)
+	_ = c.Fs.Remove(localtime)
+	return c.Fs.Symlink(filepath.Join("..", zone), localtime)
+}
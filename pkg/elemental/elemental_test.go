@@ -17,17 +17,24 @@
 package elemental_test
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	iofs "io/fs"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/rancher/yip/pkg/schema"
 	"github.com/twpayne/go-vfs/v4"
 	"github.com/twpayne/go-vfs/v4/vfst"
+	"gopkg.in/yaml.v3"
 
 	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
 	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
@@ -118,6 +125,12 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			Expect(len(lst)).To(Equal(3))
 			Expect(lst[2].Opts).To(Equal([]string{"remount", "ro"}))
 		})
+		It("Does not mount an already mounted partition again", func() {
+			Expect(elemental.MountPartition(*config, parts.OEM)).To(Succeed())
+			Expect(elemental.MountPartition(*config, parts.OEM)).To(Succeed())
+			lst, _ := mounter.List()
+			Expect(len(lst)).To(Equal(1))
+		})
 		It("Fails to mount a partition", func() {
 			mounter.ErrorOnMount = true
 			_, err := elemental.MountRWPartition(*config, parts.OEM)
@@ -302,6 +315,18 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			Expect(img.LoopDevice).To(Equal("/dev/loop"))
 		})
 
+		It("Does not mount an already mounted image again", func() {
+			runner.ReturnValue = []byte("/dev/loop")
+			Expect(elemental.MountFileSystemImage(*config, img)).To(Succeed())
+
+			again := &types.Image{MountPoint: "/some/mountpoint"}
+			Expect(elemental.MountFileSystemImage(*config, again)).To(Succeed())
+			Expect(again.LoopDevice).To(Equal("/dev/loop"))
+			lst, _ := mounter.List()
+			Expect(len(lst)).To(Equal(1))
+			Expect(runner.GetCmds()).To(HaveLen(1))
+		})
+
 		It("Fails to set a loop device", Label("loop"), func() {
 			runner.ReturnError = errors.New("failed to set a loop device")
 			Expect(elemental.MountFileSystemImage(*config, img)).NotTo(BeNil())
@@ -374,6 +399,41 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			_, err = fs.Stat(img.File)
 			Expect(err).NotTo(BeNil())
 		})
+
+		It("Creates a fully allocated image file", Label("sparse-images"), func() {
+			config.SparseImages = false
+			Expect(elemental.CreateFileSystemImage(*config, img, "", false)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{
+				{"fallocate", "-l", strconv.Itoa(32 * 1024 * 1024), img.File},
+			})).To(Succeed())
+		})
+
+		It("Fails if the filesystem can't fully allocate the image file", Label("sparse-images"), func() {
+			config.SparseImages = false
+			runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+				if cmd == "fallocate" {
+					return []byte("fallocate failed: Operation not supported"), errors.New("exit status 1")
+				}
+				return []byte{}, nil
+			}
+			err := elemental.CreateFileSystemImage(*config, img, "", false)
+			Expect(err).To(MatchError(ContainSubstring("does not support fully allocated files")))
+			Expect(err).To(MatchError(ContainSubstring("Operation not supported")))
+			_, err = fs.Stat(img.File)
+			Expect(err).NotTo(BeNil())
+		})
+
+		It("Fails to create a sparse image file on a filesystem without sparse files", Label("sparse-images"), func() {
+			runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+				if cmd == "findmnt" {
+					return []byte("vfat\n"), nil
+				}
+				return []byte{}, nil
+			}
+			err := elemental.CreateFileSystemImage(*config, img, "", false)
+			Expect(err).To(MatchError(ContainSubstring("the vfat filesystem of " + constants.StateDir + " does not support sparse files")))
+			Expect(runner.IncludesCmds([][]string{{"fallocate"}})).NotTo(Succeed())
+		})
 	})
 
 	Describe("FormatPartition", Label("FormatPartition", "partition", "format"), func() {
@@ -385,6 +445,18 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			}
 			Expect(elemental.FormatPartition(*config, part)).To(BeNil())
 		})
+		It("Appends the custom mkfs arguments of the filesystem", Label("mkfs-args"), func() {
+			config.MkfsArgs = map[string][]string{"ext4": {"-i", "8192"}, "xfs": {"-d", "agcount=4"}}
+			part := &types.Partition{
+				Path:            "/dev/device1",
+				FS:              "ext4",
+				FilesystemLabel: "MY_LABEL",
+			}
+			Expect(elemental.FormatPartition(*config, part)).To(BeNil())
+			Expect(runner.IncludesCmds([][]string{
+				{"mkfs.ext4", "-L", "MY_LABEL", "-i", "8192", "/dev/device1"},
+			})).To(Succeed())
+		})
 
 	})
 	Describe("PartitionAndFormatDevice", Label("PartitionAndFormatDevice", "partition", "format"), func() {
@@ -420,7 +492,7 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 					}, {
 						"parted", "--script", "--machine", "--", "/some/device", "unit", "s",
 						"mkpart", "efi", "fat32", "2048", "133119", "set", "1", "esp", "on",
-					}, {"mkfs.vfat", "-n", "COS_GRUB", "/some/device1"},
+					}, {"wipefs", "--all", "/some/device1"}, {"mkfs.vfat", "-n", "COS_GRUB", "/some/device1"},
 				}
 				biosPartCmds = [][]string{
 					{
@@ -436,16 +508,16 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 					{
 						"parted", "--script", "--machine", "--", "/some/device", "unit", "s",
 						"mkpart", "oem", "ext4", "133120", "264191",
-					}, {"mkfs.ext4", "-L", "COS_OEM", "/some/device2"}, {
+					}, {"wipefs", "--all", "/some/device2"}, {"mkfs.ext4", "-L", "COS_OEM", "/some/device2"}, {
 						"parted", "--script", "--machine", "--", "/some/device", "unit", "s",
 						"mkpart", "recovery", "ext4", "264192", "8652799",
-					}, {"mkfs.ext4", "-L", "COS_RECOVERY", "/some/device3"}, {
+					}, {"wipefs", "--all", "/some/device3"}, {"mkfs.ext4", "-L", "COS_RECOVERY", "/some/device3"}, {
 						"parted", "--script", "--machine", "--", "/some/device", "unit", "s",
 						"mkpart", "state", "ext4", "8652800", "25430015",
-					}, {"mkfs.ext4", "-L", "COS_STATE", "/some/device4"}, {
+					}, {"wipefs", "--all", "/some/device4"}, {"mkfs.ext4", "-L", "COS_STATE", "/some/device4"}, {
 						"parted", "--script", "--machine", "--", "/some/device", "unit", "s",
 						"mkpart", "persistent", "ext4", "25430016", "100%",
-					}, {"mkfs.ext4", "-L", "COS_PERSISTENT", "/some/device5"},
+					}, {"wipefs", "--all", "/some/device5"}, {"mkfs.ext4", "-L", "COS_PERSISTENT", "/some/device5"},
 				}
 
 				runFunc = func(cmd string, args ...string) ([]byte, error) {
@@ -479,6 +551,18 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 				Expect(runner.MatchMilestones(append(efiPartCmds, partCmds...))).To(BeNil())
 			})
 
+			It("Successfully creates partitions with the declared flags", Label("flags"), func() {
+				install.PartTable = types.GPT
+				install.Firmware = types.EFI
+				install.Partitions.SetFirmwarePartitions(types.EFI, types.GPT)
+				install.Partitions.State.Flags = []string{"legacy_boot", "hidden"}
+				Expect(elemental.PartitionAndFormatDevice(*config, install)).To(BeNil())
+				Expect(runner.IncludesCmds([][]string{{
+					"parted", "--script", "--machine", "--", "/some/device", "unit", "s",
+					"mkpart", "state", "ext4", "8652800", "25430015", "set", "4", "legacy_boot", "on", "set", "4", "hidden", "on",
+				}})).To(Succeed())
+			})
+
 			It("Successfully creates partitions and formats them, BIOS boot", func() {
 				install.PartTable = types.GPT
 				install.Firmware = types.BIOS
@@ -613,6 +697,116 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			err := elemental.DumpSource(*config, destDir, types.NewDockerSrc("docker/image:latest"), nil)
 			Expect(err).To(Equal(unpackErr))
 		})
+		It("Unpacks a docker image from the configured registry mirror", Label("docker", "mirror"), func() {
+			var pulled []string
+			extractor.SideEffect = func(ref, _, _ string, _, _ bool) (string, error) {
+				pulled = append(pulled, ref)
+				return "mirrorDigest", nil
+			}
+			config.RegistryMirror = "mirror.local:5000/cache/"
+			dockerSrc := types.NewDockerSrc("registry.org/elemental/image:v1")
+			Expect(elemental.DumpSource(*config, destDir, dockerSrc, nil)).To(Succeed())
+			Expect(pulled).To(Equal([]string{"mirror.local:5000/cache/elemental/image:v1"}))
+			Expect(dockerSrc.GetDigest()).To(Equal("mirrorDigest"))
+			// Source is not modified by the mirror
+			Expect(dockerSrc.Value()).To(Equal("registry.org/elemental/image:v1"))
+		})
+		It("Pulls images pinned by digest, also from the registry mirror", Label("docker", "mirror", "digest"), func() {
+			digest := "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+			var pulled []string
+			extractor.SideEffect = func(ref, _, _ string, _, _ bool) (string, error) {
+				pulled = append(pulled, ref)
+				return digest, nil
+			}
+			config.RegistryMirror = "mirror.local"
+			dockerSrc, err := types.NewSrcFromURI("docker://registry.org/elemental/image@" + digest)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(elemental.DumpSource(*config, destDir, dockerSrc, nil)).To(Succeed())
+			Expect(pulled).To(Equal([]string{"mirror.local/elemental/image@" + digest}))
+			Expect(dockerSrc.GetDigest()).To(Equal(digest))
+		})
+		It("Falls back to upstream registry if the mirror fails", Label("docker", "mirror"), func() {
+			var pulled []string
+			extractor.SideEffect = func(ref, dest, _ string, _, _ bool) (string, error) {
+				pulled = append(pulled, ref)
+				if strings.HasPrefix(ref, "mirror.local") {
+					// Partially extracted image
+					Expect(fs.WriteFile(filepath.Join(dest, "partial"), []byte{}, constants.FilePerm)).To(Succeed())
+					return "", errors.New("connection reset")
+				}
+				ok, _ := utils.Exists(fs, filepath.Join(dest, "partial"))
+				Expect(ok).To(BeFalse())
+				return "upstreamDigest", nil
+			}
+			config.RegistryMirror = "mirror.local"
+			dockerSrc := types.NewDockerSrc("alpine:3.20")
+			Expect(elemental.DumpSource(*config, destDir, dockerSrc, nil)).To(Succeed())
+			Expect(pulled).To(Equal([]string{"mirror.local/library/alpine:3.20", "alpine:3.20"}))
+			Expect(dockerSrc.GetDigest()).To(Equal("upstreamDigest"))
+		})
+		It("Does not use the registry mirror with cosign verification", Label("docker", "mirror", "cosign"), func() {
+			var pulled []string
+			extractor.SideEffect = func(ref, _, _ string, _, _ bool) (string, error) {
+				pulled = append(pulled, ref)
+				return "upstreamDigest", nil
+			}
+			config.Cosign = true
+			config.RegistryMirror = "mirror.local"
+			Expect(elemental.DumpSource(*config, destDir, types.NewDockerSrc("alpine:3.20"), nil)).To(Succeed())
+			Expect(pulled).To(Equal([]string{"alpine:3.20"}))
+		})
+		It("Pulls a docker image with the source credentials", Label("docker", "auth"), func() {
+			memLog := &bytes.Buffer{}
+			config.Logger = types.NewBufferLogger(memLog)
+			config.Logger.SetLevel(types.DebugLevel())
+			auth := &types.RegistryAuth{Username: "user", Password: "secret"}
+			config.RegistryMirror = "mirror.local"
+			dockerSrc := types.NewDockerSrc("registry.org/private/image:v1")
+			dockerSrc.SetAuth(auth)
+			extractor.SideEffect = func(ref, _, _ string, _, _ bool) (string, error) {
+				if strings.HasPrefix(ref, "mirror.local") {
+					return "", errors.New("not found")
+				}
+				return "upstreamDigest", nil
+			}
+			Expect(elemental.DumpSource(*config, destDir, dockerSrc, nil)).To(Succeed())
+			// Credentials are not sent to the mirror
+			Expect(extractor.Auths["mirror.local/private/image:v1"]).To(BeNil())
+			Expect(extractor.Auths["registry.org/private/image:v1"]).To(Equal(auth))
+			Expect(memLog.String()).To(ContainSubstring("username: user"))
+			Expect(memLog.String()).NotTo(ContainSubstring("secret"))
+		})
+		It("Dumps a source with a custom scheme using its registered handler", func() {
+			var gotSrc, gotTarget string
+			Expect(types.RegisterSourceHandler("store", func(_ types.Config, src *types.ImageSource, target string, _ types.SyncFunc) (string, error) {
+				gotSrc = src.Value()
+				gotTarget = target
+				return "storeDigest", nil
+			})).To(Succeed())
+			DeferCleanup(types.UnregisterSourceHandler, "store")
+			customSrc, err := types.NewSrcFromURI("store://artifacts.local/os/v1")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(elemental.DumpSource(*config, destDir, customSrc, syncFunc)).To(Succeed())
+			Expect(gotSrc).To(Equal("artifacts.local/os/v1"))
+			Expect(gotTarget).To(Equal(destDir))
+			Expect(customSrc.GetDigest()).To(Equal("storeDigest"))
+			// SyncFunc is not used
+			Expect(src).To(BeEmpty())
+		})
+		It("Dumps built-in sources with the registered handlers, which can't be overwritten", func() {
+			handler := func(_ types.Config, _ *types.ImageSource, _ string, _ types.SyncFunc) (string, error) {
+				return "", errors.New("overwritten")
+			}
+			for _, scheme := range []string{types.OCIScheme, types.DirScheme, types.FileScheme} {
+				Expect(types.GetSourceHandler(scheme)).NotTo(BeNil())
+				Expect(types.RegisterSourceHandler(scheme, handler)).NotTo(Succeed())
+				types.UnregisterSourceHandler(scheme)
+				Expect(types.GetSourceHandler(scheme)).NotTo(BeNil())
+			}
+			Expect(elemental.DumpSource(*config, destDir, types.NewDirSrc("/source"), syncFunc)).To(Succeed())
+			Expect(src).To(Equal("/source"))
+		})
 		It("Copies image file to target", func() {
 			sourceImg := "/source.img"
 			destFile := filepath.Join(destDir, "active.img")
@@ -660,9 +854,17 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			}
 			err := elemental.CreateImageFromTree(*config, img, root, false, cleaner)
 			Expect(err).ShouldNot(HaveOccurred())
-			Expect(img.Size).To(Equal(32 + constants.ImgOverhead + 1))
+			Expect(img.Size).To(Equal(32 + constants.ImgOverhead))
 			Expect(cleaned).To(BeTrue())
 		})
+		It("Sizes the image from the exact size of the root tree", Label("size-policy"), func() {
+			sf, err := fs.OpenFile(filepath.Join(root, "somefile"), os.O_WRONLY, constants.FilePerm)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(sf.Truncate(32*1024*1024 + 1)).To(Succeed())
+			Expect(sf.Close()).To(Succeed())
+			Expect(elemental.CreateImageFromTree(*config, img, root, false)).To(Succeed())
+			Expect(img.Size).To(Equal(33 + constants.ImgOverhead))
+		})
 		It("Creates an squashfs image", func() {
 			img.FS = constants.SquashFs
 			err := elemental.CreateImageFromTree(*config, img, root, false)
@@ -670,6 +872,54 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			Expect(img.Size).To(Equal(uint(0)))
 			Expect(runner.IncludesCmds([][]string{{"mksquashfs"}}))
 		})
+		It("Creates an squashfs image with custom mksquashfs arguments", Label("mkfs-args"), func() {
+			img.FS = constants.SquashFs
+			config.MkfsArgs = map[string][]string{constants.SquashFs: {"-Xbcj", "x86"}}
+			err := elemental.CreateImageFromTree(*config, img, root, false)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(runner.IncludesCmds([][]string{
+				{"mksquashfs", root, imgFile, "-b", "1024k", "-Xbcj", "x86"},
+			})).To(Succeed())
+		})
+		It("Creates an image sized according to the configured size policy", Label("size-policy"), func() {
+			config.ImageSizePolicy = types.SizePolicy{Headroom: 20, RoundTo: 64, MinSize: 128}
+			Expect(elemental.CreateImageFromTree(*config, img, root, false)).To(Succeed())
+			Expect(img.Size).To(Equal(uint(128)))
+
+			// The image is created within the test root tree
+			Expect(fs.Remove(imgFile)).To(Succeed())
+			img.Size = 0
+			config.ImageSizePolicy.MinSize = 0
+			Expect(elemental.CreateImageFromTree(*config, img, root, false)).To(Succeed())
+			Expect(img.Size).To(Equal(uint(64)))
+		})
+		It("Raises the inodes of small images holding many files", Label("inodes"), func() {
+			for i := 0; i < 2048; i++ {
+				Expect(fs.WriteFile(filepath.Join(root, fmt.Sprintf("file%d", i)), []byte{}, constants.FilePerm)).To(Succeed())
+			}
+			img.Size = 32
+			Expect(elemental.CreateImageFromTree(*config, img, root, false)).To(Succeed())
+			// The default ratio gives 2048 inodes to a 32MiB image
+			Expect(runner.IncludesCmds([][]string{{"mkfs.ext2", "-N"}})).To(Succeed())
+		})
+		It("Does not change the inodes of images with enough of them", Label("inodes"), func() {
+			img.Size = 1024
+			Expect(elemental.CreateImageFromTree(*config, img, root, false)).To(Succeed())
+			for _, cmd := range runner.GetCmds() {
+				Expect(cmd).NotTo(ContainElement("-N"))
+			}
+		})
+		It("Keeps the inode ratio of the custom mkfs arguments", Label("inodes", "mkfs-args"), func() {
+			for i := 0; i < 2048; i++ {
+				Expect(fs.WriteFile(filepath.Join(root, fmt.Sprintf("file%d", i)), []byte{}, constants.FilePerm)).To(Succeed())
+			}
+			img.Size = 32
+			config.MkfsArgs = map[string][]string{constants.LinuxImgFs: {"-i", "4096"}}
+			Expect(elemental.CreateImageFromTree(*config, img, root, false)).To(Succeed())
+			for _, cmd := range runner.GetCmds() {
+				Expect(cmd).NotTo(ContainElement("-N"))
+			}
+		})
 		It("Creates an image of an specific size including including the root tree contents", func() {
 			img.Size = 64
 			err := elemental.CreateImageFromTree(*config, img, root, false)
@@ -677,11 +927,41 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			Expect(img.Size).To(Equal(uint(64)))
 			Expect(runner.IncludesCmds([][]string{{"rsync"}}))
 		})
+		It("Creates the image again if it does not match the root tree", Label("verify"), func() {
+			config.MaxImageCopyRetries = 2
+			verifications := 0
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "rsync" && args[0] == "--dry-run" {
+					verifications++
+					if verifications == 1 {
+						return []byte(">fc.T...... somefile\n.d..t...... ./\n"), nil
+					}
+				}
+				return []byte{}, nil
+			}
+			Expect(elemental.CreateImageFromTree(*config, img, root, false)).To(Succeed())
+			Expect(verifications).To(Equal(2))
+			Expect(runner.MatchMilestones([][]string{
+				{"mkfs.ext2"}, {"rsync", "--dry-run"}, {"mkfs.ext2"}, {"rsync", "--dry-run"},
+			})).To(Succeed())
+		})
+		It("Fails if the image does not match the root tree after all retries", Label("verify"), func() {
+			config.MaxImageCopyRetries = 1
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "rsync" && args[0] == "--dry-run" {
+					return []byte(">fc.T...... somefile\n"), nil
+				}
+				return []byte{}, nil
+			}
+			err := elemental.CreateImageFromTree(*config, img, root, false)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("first one is 'somefile'"))
+		})
 		It("Fails to mount created filesystem image", func() {
 			mounter.ErrorOnUnmount = true
 			err := elemental.CreateImageFromTree(*config, img, root, false)
 			Expect(err).Should(HaveOccurred())
-			Expect(img.Size).To(Equal(32 + constants.ImgOverhead + 1))
+			Expect(img.Size).To(Equal(32 + constants.ImgOverhead))
 			Expect(cleaned).To(BeFalse())
 			Expect(runner.IncludesCmds([][]string{{"rsync"}}))
 		})
@@ -847,6 +1127,48 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			Expect(runner.CmdsMatch([][]string{relabelCmd})).To(BeNil())
 		})
 	})
+	Describe("StagingDir", Label("download-dir"), func() {
+		BeforeEach(func() {
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "df" {
+					return []byte("Avail\n100\n"), nil
+				}
+				return []byte{}, nil
+			}
+		})
+		It("creates the staging directory within the download directory", func() {
+			config.DownloadDir = "/var/elemental/downloads"
+			dir, err := elemental.StagingDir(*config, "/some/base", "elemental", 50*1024*1024)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dir).To(HavePrefix(config.DownloadDir))
+			Expect(runner.IncludesCmds([][]string{{"df", "--output=avail", "--block-size=1M", config.DownloadDir}})).To(Succeed())
+		})
+		It("creates the staging directory within the given base by default", func() {
+			Expect(utils.MkdirAll(fs, "/some/base", constants.DirPerm)).To(Succeed())
+			dir, err := elemental.StagingDir(*config, "/some/base", "elemental", 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dir).To(HavePrefix("/some/base"))
+			Expect(runner.IncludesCmds([][]string{{"df"}})).NotTo(Succeed())
+		})
+		It("fails if there is not enough free space", func() {
+			config.DownloadDir = "/var/elemental/downloads"
+			_, err := elemental.StagingDir(*config, "", "elemental", 101*1024*1024)
+			Expect(err).To(MatchError(ContainSubstring("100MiB free, 101MiB are required")))
+		})
+		It("checks the free space of the downloaded ISO", Label("iso"), func() {
+			config.DownloadDir = "/var/elemental/downloads"
+			iso := "/media/fake.iso"
+			Expect(utils.MkdirAll(fs, "/media", constants.DirPerm)).To(Succeed())
+			f, err := fs.Create(iso)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(f.Truncate(200 * 1024 * 1024)).To(Succeed())
+			Expect(f.Close()).To(Succeed())
+
+			_, isoClean, err := elemental.SourceFormISO(*config, iso, "")
+			Expect(err).To(MatchError(ContainSubstring("100MiB free, 200MiB are required")))
+			Expect(isoClean()).To(Succeed())
+		})
+	})
 	Describe("GetIso", Label("GetIso", "iso"), func() {
 		It("Gets the iso, mounts it and updates image source", func() {
 			tmpDir, err := utils.TempDir(fs, "", "elemental-test")
@@ -860,14 +1182,51 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			Expect(utils.MkdirAll(fs, filepath.Dir(rootfsImg), constants.DirPerm)).To(Succeed())
 			Expect(fs.WriteFile(rootfsImg, []byte{}, constants.FilePerm)).To(Succeed())
 
-			source, isoClean, err := elemental.SourceFormISO(*config, iso)
+			source, isoClean, err := elemental.SourceFormISO(*config, iso, "")
 			Expect(err).To(BeNil())
 			Expect(source.IsFile()).To(BeTrue())
 			Expect(isoClean()).To(Succeed())
 		})
+		It("Verifies the iso checksum before mounting it", func() {
+			tmpDir, err := utils.TempDir(fs, "", "elemental-test")
+			Expect(err).To(BeNil())
+			iso := filepath.Join(tmpDir, "fake.iso")
+			Expect(fs.WriteFile(iso, []byte("Hi"), constants.FilePerm)).To(Succeed())
+			rootfsImg := filepath.Join(os.TempDir(), "/elemental/iso", constants.ISORootFile)
+			Expect(utils.MkdirAll(fs, filepath.Dir(rootfsImg), constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile(rootfsImg, []byte{}, constants.FilePerm)).To(Succeed())
+
+			// sha256 of 'Hi'
+			sum := "3639efcd08abb273b1619e82e78c29a7df02c1051b1820e99fc395dcaa3326b8"
+			source, isoClean, err := elemental.SourceFormISO(*config, iso, "sha256:"+sum)
+			Expect(err).To(BeNil())
+			Expect(source.IsFile()).To(BeTrue())
+			Expect(isoClean()).To(Succeed())
+
+			// From a checksum file listing several ISOs
+			sumFile := filepath.Join(tmpDir, "SHA256SUMS")
+			content := fmt.Sprintf("%064d  other.iso\n%s *fake.iso\n", 0, sum)
+			Expect(fs.WriteFile(sumFile, []byte(content), constants.FilePerm)).To(Succeed())
+			Expect(utils.MkdirAll(fs, filepath.Dir(rootfsImg), constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile(rootfsImg, []byte{}, constants.FilePerm)).To(Succeed())
+			_, isoClean, err = elemental.SourceFormISO(*config, iso, sumFile)
+			Expect(err).To(BeNil())
+			Expect(isoClean()).To(Succeed())
+		})
+		It("Fails if the iso checksum does not match", func() {
+			tmpDir, err := utils.TempDir(fs, "", "elemental-test")
+			Expect(err).To(BeNil())
+			iso := filepath.Join(tmpDir, "fake.iso")
+			Expect(fs.WriteFile(iso, []byte("Hi"), constants.FilePerm)).To(Succeed())
+
+			_, isoClean, err := elemental.SourceFormISO(*config, iso, fmt.Sprintf("%064d", 0))
+			Expect(err).To(MatchError(ContainSubstring("checksum mismatch")))
+			Expect(mounter.List()).To(BeEmpty())
+			Expect(isoClean()).To(Succeed())
+		})
 		It("Fails if it cant find the iso", func() {
 			iso := "whatever"
-			_, isoClean, err := elemental.SourceFormISO(*config, iso)
+			_, isoClean, err := elemental.SourceFormISO(*config, iso, "")
 			Expect(err).ToNot(BeNil())
 			Expect(isoClean()).To(Succeed())
 		})
@@ -879,7 +1238,7 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			iso := fmt.Sprintf("%s/fake.iso", tmpDir)
 			config.Fs = vfs.NewReadOnlyFS(fs)
 
-			_, isoClean, err := elemental.SourceFormISO(*config, iso)
+			_, isoClean, err := elemental.SourceFormISO(*config, iso, "")
 			Expect(err).ToNot(BeNil())
 			Expect(isoClean()).To(Succeed())
 		})
@@ -890,7 +1249,7 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			err = fs.WriteFile(fmt.Sprintf("%s/fake.iso", tmpDir), []byte("Hi"), constants.FilePerm)
 			Expect(err).To(BeNil())
 			iso := fmt.Sprintf("%s/fake.iso", tmpDir)
-			_, isoClean, err := elemental.SourceFormISO(*config, iso)
+			_, isoClean, err := elemental.SourceFormISO(*config, iso, "")
 			Expect(err).ToNot(BeNil())
 			Expect(err.Error()).To(ContainSubstring("mount error"))
 			Expect(isoClean()).To(Succeed())
@@ -914,6 +1273,19 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			Expect(err).To(BeNil())
 			Expect(copiedFile).To(ContainSubstring(testString))
 		})
+		It("Restricts the permissions of the copied cloud config files", Label("secure-perms"), func() {
+			Expect(fs.WriteFile("/config.yaml", []byte("token: secret"), constants.FilePerm)).To(Succeed())
+			Expect(utils.MkdirAll(fs, constants.OEMDir, constants.DirPerm)).To(Succeed())
+
+			config.SecureConfigPerms = true
+			Expect(elemental.CopyCloudConfig(*config, parts.GetConfigStorage(), []string{"/config.yaml"})).To(Succeed())
+			info, err := fs.Stat(filepath.Join(constants.OEMDir, "90_custom.yaml"))
+			Expect(err).To(BeNil())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+			info, err = fs.Stat(constants.OEMDir)
+			Expect(err).To(BeNil())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0700)))
+		})
 		It("Doesnt do anything if the config file is not set", func() {
 			err := elemental.CopyCloudConfig(*config, parts.GetConfigStorage(), []string{})
 			Expect(err).To(BeNil())
@@ -923,6 +1295,109 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			err := elemental.CopyCloudConfig(*config, parts.GetConfigStorage(), []string{})
 			Expect(err).To(BeNil())
 		})
+		It("Validates the cloud config files", Label("validate"), func() {
+			cInit := &mocks.FakeCloudInitRunner{}
+			config.CloudInitRunner = cInit
+			Expect(utils.MkdirAll(fs, constants.OEMDir, constants.DirPerm)).To(Succeed())
+			for _, f := range []string{"90_custom.yaml", "91_custom.yml", "notes.txt"} {
+				Expect(fs.WriteFile(filepath.Join(constants.OEMDir, f), []byte{}, constants.FilePerm)).To(Succeed())
+			}
+			Expect(elemental.ValidateCloudConfig(*config, parts.GetConfigStorage())).To(Succeed())
+			Expect(cInit.Validated).To(ConsistOf(
+				filepath.Join(constants.OEMDir, "90_custom.yaml"), filepath.Join(constants.OEMDir, "91_custom.yml"),
+			))
+
+			cInit.ValidateErr = true
+			err := elemental.ValidateCloudConfig(*config, parts.GetConfigStorage())
+			Expect(err).To(MatchError(ContainSubstring("invalid cloud-init file " + filepath.Join(constants.OEMDir, "90_custom.yaml"))))
+			Expect(err).To(MatchError(ContainSubstring("line 1")))
+		})
+		It("Writes a tmpfs overlay config", Label("overlay"), func() {
+			Expect(utils.MkdirAll(fs, constants.OEMDir, constants.DirPerm)).To(Succeed())
+			overlay := types.OverlaySpec{Backend: constants.Tmpfs, Size: "4G"}
+			Expect(elemental.WriteOverlayConfig(*config, parts.GetConfigStorage(), overlay, nil, nil)).To(Succeed())
+			data, err := fs.ReadFile(filepath.Join(constants.OEMDir, constants.OverlayConfigFile))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring("size: 4G"))
+			Expect(string(data)).To(ContainSubstring("paths: ['/home', '/opt', '/root', '/var/log']"))
+		})
+		It("Writes a persistent overlay config", Label("overlay"), func() {
+			Expect(utils.MkdirAll(fs, constants.OEMDir, constants.DirPerm)).To(Succeed())
+			overlay := types.OverlaySpec{Backend: constants.PersistentOverlay}
+			Expect(elemental.WriteOverlayConfig(*config, parts.GetConfigStorage(), overlay, nil, nil)).To(Succeed())
+			data, err := fs.ReadFile(filepath.Join(constants.OEMDir, constants.OverlayConfigFile))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).NotTo(ContainSubstring("ephemeral"))
+			Expect(string(data)).To(ContainSubstring("paths: ['/etc', '/home', '/opt', '/root', '/var/log']"))
+		})
+		It("Writes an immutable /etc config", Label("overlay"), func() {
+			Expect(utils.MkdirAll(fs, constants.OEMDir, constants.DirPerm)).To(Succeed())
+			overlay := types.OverlaySpec{Backend: constants.ImmutableEtc}
+			Expect(elemental.WriteOverlayConfig(*config, parts.GetConfigStorage(), overlay, nil, nil)).To(Succeed())
+			data, err := fs.ReadFile(filepath.Join(constants.OEMDir, constants.OverlayConfigFile))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring("paths: ['/var', '/srv']"))
+			Expect(string(data)).To(ContainSubstring("paths: ['/etc/systemd', '/etc/ssh', '/home', '/opt', '/root', '/var/log']"))
+		})
+		It("Writes the mount config of a var partition", Label("overlay", "var"), func() {
+			Expect(utils.MkdirAll(fs, constants.OEMDir, constants.DirPerm)).To(Succeed())
+			varPart := &types.Partition{FilesystemLabel: constants.VarLabel, FS: "xfs"}
+			overlay := types.OverlaySpec{Backend: constants.Tmpfs, Size: "512M"}
+			Expect(elemental.WriteOverlayConfig(*config, parts.GetConfigStorage(), overlay, varPart, nil)).To(Succeed())
+			data, err := fs.ReadFile(filepath.Join(constants.OEMDir, constants.OverlayConfigFile))
+			Expect(err).NotTo(HaveOccurred())
+
+			cloudConfig := struct {
+				Stages map[string][]struct {
+					Files []struct {
+						Content string `yaml:"content"`
+					} `yaml:"files"`
+				} `yaml:"stages"`
+			}{}
+			Expect(yaml.Unmarshal(data, &cloudConfig)).To(Succeed())
+			mountConfig := struct {
+				Mount types.MountSpec `yaml:"mount"`
+			}{}
+			Expect(yaml.Unmarshal([]byte(cloudConfig.Stages["rootfs"][0].Files[0].Content), &mountConfig)).To(Succeed())
+			Expect(mountConfig.Mount.Volumes).To(HaveLen(3))
+			Expect(*mountConfig.Mount.Volumes[2]).To(Equal(types.VolumeMount{
+				Mountpoint: "/var", Device: "LABEL=COS_VAR", FSType: "xfs", Options: []string{"rw", "defaults"},
+			}))
+			Expect(mountConfig.Mount.Ephemeral.Paths).To(Equal([]string{"/etc", "/srv"}))
+			Expect(mountConfig.Mount.Ephemeral.Size).To(Equal("512M"))
+			Expect(mountConfig.Mount.Persistent.Paths).To(Equal([]string{"/home", "/opt", "/root"}))
+		})
+		It("Writes the mount config of a root partition", Label("overlay", "root"), func() {
+			Expect(utils.MkdirAll(fs, constants.OEMDir, constants.DirPerm)).To(Succeed())
+			rootPart := &types.Partition{FilesystemLabel: constants.RootLabel, FS: constants.LinuxFs}
+			Expect(elemental.WriteOverlayConfig(*config, parts.GetConfigStorage(), types.OverlaySpec{}, nil, rootPart)).To(Succeed())
+			data, err := fs.ReadFile(filepath.Join(constants.OEMDir, constants.OverlayConfigFile))
+			Expect(err).NotTo(HaveOccurred())
+
+			cloudConfig := struct {
+				Stages map[string][]struct {
+					Files []struct {
+						Content string `yaml:"content"`
+					} `yaml:"files"`
+				} `yaml:"stages"`
+			}{}
+			Expect(yaml.Unmarshal(data, &cloudConfig)).To(Succeed())
+			mountConfig := struct {
+				Mount types.MountSpec `yaml:"mount"`
+			}{}
+			Expect(yaml.Unmarshal([]byte(cloudConfig.Stages["rootfs"][0].Files[0].Content), &mountConfig)).To(Succeed())
+			Expect(mountConfig.Mount.SplitRoot.Volume).To(Equal(types.VolumeMount{
+				Mountpoint: constants.RootDir, Device: "LABEL=COS_ROOT", FSType: "ext4", Options: []string{"rw", "defaults"},
+			}))
+			Expect(mountConfig.Mount.Volumes).To(BeEmpty())
+			Expect(mountConfig.Mount.Ephemeral.Paths).To(BeEmpty())
+			Expect(mountConfig.Mount.Persistent.Paths).To(BeEmpty())
+		})
+		It("Doesnt do anything if no overlay backend is set", Label("overlay"), func() {
+			Expect(elemental.WriteOverlayConfig(*config, parts.GetConfigStorage(), types.OverlaySpec{}, nil, nil)).To(Succeed())
+			ok, _ := utils.Exists(fs, filepath.Join(constants.OEMDir, constants.OverlayConfigFile))
+			Expect(ok).To(BeFalse())
+		})
 	})
 	Describe("DeactivateDevices", Label("blkdeactivate"), func() {
 		It("calls blkdeactivat", func() {
@@ -934,6 +1409,356 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			}})).To(BeNil())
 		})
 	})
+	Describe("ResetMachineID", Label("pristine"), func() {
+		It("empties the machine ID of the given root", func() {
+			Expect(utils.MkdirAll(fs, "/some/root/etc", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/some/root/etc/machine-id", []byte("d2f0b5c1a3e4"), constants.FilePerm)).To(Succeed())
+			Expect(elemental.ResetMachineID(*config, "/some/root")).To(Succeed())
+			data, err := fs.ReadFile("/some/root/etc/machine-id")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data).To(BeEmpty())
+		})
+		It("does nothing if there is no machine ID", func() {
+			Expect(elemental.ResetMachineID(*config, "/some/root")).To(Succeed())
+			ok, _ := utils.Exists(fs, "/some/root/etc/machine-id")
+			Expect(ok).To(BeFalse())
+		})
+	})
+	Describe("LinkKernelInitrd", Label("kernel", "initrd"), func() {
+		BeforeEach(func() {
+			Expect(utils.MkdirAll(fs, "/some/root/boot", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/some/root/boot/kernel-6.4.0-1", []byte("kernel"), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile("/some/root/boot/initramfs-6.4.0-1.img", []byte("initrd"), constants.FilePerm)).To(Succeed())
+		})
+		It("links the files matching the configured patterns", func() {
+			config.KernelPattern = "/boot/kernel-*"
+			config.InitrdPattern = "/boot/initramfs-*.img"
+			Expect(elemental.LinkKernelInitrd(*config, "/some/root")).To(Succeed())
+			link, err := fs.Readlink("/some/root/boot/vmlinuz")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link).To(Equal("kernel-6.4.0-1"))
+			link, err = fs.Readlink("/some/root/boot/initrd")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link).To(Equal("initramfs-6.4.0-1.img"))
+		})
+		It("does nothing without patterns", func() {
+			Expect(elemental.LinkKernelInitrd(*config, "/some/root")).To(Succeed())
+			ok, _ := utils.Exists(fs, "/some/root/boot/vmlinuz", true)
+			Expect(ok).To(BeFalse())
+		})
+		It("fails if a pattern matches multiple files", func() {
+			Expect(fs.WriteFile("/some/root/boot/kernel-6.5.0-1", []byte("kernel"), constants.FilePerm)).To(Succeed())
+			config.KernelPattern = "/boot/kernel-*"
+			config.InitrdPattern = "/boot/initramfs-*.img"
+			Expect(elemental.LinkKernelInitrd(*config, "/some/root")).NotTo(Succeed())
+		})
+	})
+	Describe("VerifyKernelModules", Label("kernel", "modules"), func() {
+		BeforeEach(func() {
+			Expect(utils.MkdirAll(fs, "/some/root/boot", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/some/root/boot/vmlinuz-6.4.0-1", []byte("kernel"), constants.FilePerm)).To(Succeed())
+			Expect(fs.Symlink("vmlinuz-6.4.0-1", "/some/root/boot/vmlinuz")).To(Succeed())
+			Expect(fs.WriteFile("/some/root/boot/initrd", []byte("initrd"), constants.FilePerm)).To(Succeed())
+		})
+		It("succeeds if the modules match the kernel version", func() {
+			Expect(utils.MkdirAll(fs, "/some/root/lib/modules/6.4.0-1", constants.DirPerm)).To(Succeed())
+			Expect(elemental.VerifyKernelModules(*config, "/some/root")).To(Succeed())
+		})
+		It("fails if the modules do not match the kernel version", func() {
+			Expect(utils.MkdirAll(fs, "/some/root/lib/modules/6.4.0", constants.DirPerm)).To(Succeed())
+			err := elemental.VerifyKernelModules(*config, "/some/root")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("no kernel modules found for kernel version 6.4.0-1"))
+		})
+		It("skips the check if the kernel version is unknown", func() {
+			Expect(fs.WriteFile("/some/root/boot/kernel", []byte("kernel"), constants.FilePerm)).To(Succeed())
+			config.KernelPattern = "/boot/kernel"
+			Expect(elemental.VerifyKernelModules(*config, "/some/root")).To(Succeed())
+		})
+	})
+	Describe("CheckBootCompatibility", Label("kernel", "boot-compat"), func() {
+		// kernelImage returns a kernel image header of the given architecture, as a PE
+		// executable of the given machine type if set
+		kernelImage := func(arch string, peMachine uint16) []byte {
+			img := make([]byte, 4096)
+			switch arch {
+			case constants.Archx86:
+				copy(img[0x202:], "HdrS")
+			case constants.ArchArm64:
+				copy(img[0x38:], "ARM\x64")
+			}
+			if peMachine != 0 {
+				copy(img, "MZ")
+				binary.LittleEndian.PutUint32(img[0x3c:], 0x40)
+				copy(img[0x40:], "PE\x00\x00")
+				binary.LittleEndian.PutUint16(img[0x44:], peMachine)
+			}
+			return img
+		}
+		BeforeEach(func() {
+			var err error
+			config.Platform, err = types.NewPlatformFromArch(constants.Archx86)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(utils.MkdirAll(fs, "/some/root/boot", constants.DirPerm)).To(Succeed())
+			Expect(utils.MkdirAll(fs, "/some/root/lib/modules/6.4.0-1", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/some/root/boot/initrd-6.4.0-1", []byte("initrd"), constants.FilePerm)).To(Succeed())
+		})
+		It("accepts an EFI stub kernel of the target architecture", func() {
+			Expect(fs.WriteFile("/some/root/boot/vmlinuz-6.4.0-1", kernelImage(constants.Archx86, 0x8664), constants.FilePerm)).To(Succeed())
+			Expect(elemental.CheckBootCompatibility(*config, "/some/root", types.EFI)).To(Succeed())
+		})
+		It("fails on kernels without EFI stub for EFI firmware", func() {
+			Expect(fs.WriteFile("/some/root/boot/vmlinuz-6.4.0-1", kernelImage(constants.Archx86, 0), constants.FilePerm)).To(Succeed())
+			Expect(elemental.CheckBootCompatibility(*config, "/some/root", types.BIOS)).To(Succeed())
+			err := elemental.CheckBootCompatibility(*config, "/some/root", types.EFI)
+			Expect(err).To(MatchError(ContainSubstring("has no EFI stub")))
+		})
+		It("fails on kernels without EFI stub for the none bootloader", func() {
+			Expect(fs.WriteFile("/some/root/boot/vmlinuz-6.4.0-1", kernelImage(constants.Archx86, 0), constants.FilePerm)).To(Succeed())
+			config.Bootloader = constants.BootloaderNone
+			Expect(elemental.CheckBootCompatibility(*config, "/some/root", types.BIOS)).NotTo(Succeed())
+		})
+		It("fails on kernels of another architecture", func() {
+			Expect(fs.WriteFile("/some/root/boot/vmlinuz-6.4.0-1", kernelImage(constants.ArchArm64, 0xaa64), constants.FilePerm)).To(Succeed())
+			err := elemental.CheckBootCompatibility(*config, "/some/root", types.EFI)
+			Expect(err).To(MatchError(ContainSubstring("is built for arm64, but the target platform is x86_64")))
+		})
+		It("only checks the presence of kernels of unknown format", func() {
+			Expect(fs.WriteFile("/some/root/boot/vmlinuz-6.4.0-1", []byte("kernel"), constants.FilePerm)).To(Succeed())
+			Expect(elemental.CheckBootCompatibility(*config, "/some/root", types.EFI)).To(Succeed())
+			Expect(fs.Remove("/some/root/boot/initrd-6.4.0-1")).To(Succeed())
+			Expect(elemental.CheckBootCompatibility(*config, "/some/root", types.EFI)).NotTo(Succeed())
+		})
+	})
+	Describe("WriteUsersConfig", Label("users"), func() {
+		BeforeEach(func() {
+			Expect(utils.MkdirAll(fs, "/oem", constants.DirPerm)).To(Succeed())
+		})
+		It("writes a cloud-config file creating users with groups, ssh keys and password hash", func() {
+			users := []types.User{
+				{
+					Name:         "admin",
+					Groups:       []string{"wheel", "users"},
+					SSHKeys:      []string{"ssh-ed25519 AAAA admin@host"},
+					PasswordHash: "$6$salt$hash",
+				},
+				{Name: "guest"},
+			}
+			Expect(elemental.WriteUsersConfig(*config, "/oem", users)).To(Succeed())
+
+			usersConfig := filepath.Join("/oem", constants.UsersConfig)
+			info, err := fs.Stat(usersConfig)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(constants.SecureFilePerm)))
+
+			data, err := fs.ReadFile(usersConfig)
+			Expect(err).NotTo(HaveOccurred())
+			yipConf := schema.YipConfig{}
+			Expect(yaml.Unmarshal(data, &yipConf)).To(Succeed())
+			Expect(yipConf.Stages["initramfs"]).To(HaveLen(1))
+			created := yipConf.Stages["initramfs"][0].Users
+			Expect(created["admin"].PasswordHash).To(Equal("$6$salt$hash"))
+			Expect(created["admin"].LockPasswd).To(BeFalse())
+			Expect(created["admin"].Groups).To(Equal([]string{"wheel", "users"}))
+			Expect(created["admin"].SSHAuthorizedKeys).To(Equal([]string{"ssh-ed25519 AAAA admin@host"}))
+			Expect(created["guest"].LockPasswd).To(BeTrue())
+
+			// Nothing is written into the image
+			ok, _ := utils.Exists(fs, "/etc/passwd")
+			Expect(ok).To(BeFalse())
+		})
+		It("does nothing without users", func() {
+			Expect(elemental.WriteUsersConfig(*config, "/oem", nil)).To(Succeed())
+			ok, _ := utils.Exists(fs, filepath.Join("/oem", constants.UsersConfig))
+			Expect(ok).To(BeFalse())
+		})
+	})
+	Describe("WriteSBOM", Label("sbom"), func() {
+		var src *types.ImageSource
+		BeforeEach(func() {
+			Expect(utils.MkdirAll(fs, "/some/root", constants.DirPerm)).To(Succeed())
+			Expect(utils.MkdirAll(fs, "/oem", constants.DirPerm)).To(Succeed())
+			src = types.NewDockerSrc("registry.org/elemental/os:v1.0")
+			src.SetDigest("sha256:abcd")
+			runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+				if cmd == "rpm" {
+					return []byte("bash|5.2-1.1|x86_64|GPL-3.0-or-later\nkernel-default|6.4.0-1.1|x86_64|GPL-2.0-only\n"), nil
+				}
+				return []byte{}, nil
+			}
+		})
+		It("generates an SPDX document from the installed packages", func() {
+			name, err := elemental.WriteSBOM(*config, "/some/root", "/oem", constants.SPDXFormat, src)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(name).To(Equal(constants.SPDXFile))
+			Expect(runner.IncludesCmds([][]string{{"rpm", "--root", "/some/root", "-qa"}})).To(Succeed())
+			data, err := fs.ReadFile(filepath.Join("/oem", constants.SPDXFile))
+			Expect(err).NotTo(HaveOccurred())
+			doc := map[string]interface{}{}
+			Expect(json.Unmarshal(data, &doc)).To(Succeed())
+			Expect(doc["spdxVersion"]).To(Equal("SPDX-2.3"))
+			Expect(doc["name"]).To(Equal("oci://registry.org/elemental/os:v1.0"))
+			Expect(doc["packages"]).To(HaveLen(2))
+			Expect(string(data)).To(ContainSubstring("pkg:rpm/bash@5.2-1.1?arch=x86_64"))
+		})
+		It("generates a CycloneDX document from the installed packages", func() {
+			name, err := elemental.WriteSBOM(*config, "/some/root", "/oem", constants.CycloneDXFormat, src)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(name).To(Equal(constants.CycloneDXFile))
+			data, err := fs.ReadFile(filepath.Join("/oem", constants.CycloneDXFile))
+			Expect(err).NotTo(HaveOccurred())
+			doc := map[string]interface{}{}
+			Expect(json.Unmarshal(data, &doc)).To(Succeed())
+			Expect(doc["bomFormat"]).To(Equal("CycloneDX"))
+			Expect(doc["components"]).To(HaveLen(2))
+			Expect(string(data)).To(ContainSubstring("sha256:abcd"))
+			Expect(string(data)).To(ContainSubstring("GPL-2.0-only"))
+		})
+		It("copies the SBOM shipped by the image", func() {
+			Expect(utils.MkdirAll(fs, "/some/root/usr/share/sbom", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/some/root/usr/share/sbom/os.spdx.json", []byte(`{"spdxVersion": "SPDX-2.3"}`), constants.FilePerm)).To(Succeed())
+			_, err := elemental.WriteSBOM(*config, "/some/root", "/oem", constants.SPDXFormat, src)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.GetCmds()).To(BeEmpty())
+			data, err := fs.ReadFile(filepath.Join("/oem", constants.SPDXFile))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(Equal(`{"spdxVersion": "SPDX-2.3"}`))
+		})
+		It("fails without rpm", func() {
+			runner.CmdNotFound = "rpm"
+			_, err := elemental.WriteSBOM(*config, "/some/root", "/oem", constants.SPDXFormat, src)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("Passwords", Label("password"), func() {
+		It("writes the grub password file", func() {
+			Expect(utils.MkdirAll(fs, "/boot/efi", constants.DirPerm)).To(Succeed())
+			Expect(elemental.WriteGrubPassword(*config, "/boot/efi", "grub.pbkdf2.sha512.10000.AB12.CD34")).To(Succeed())
+			data, err := fs.ReadFile(filepath.Join("/boot/efi", constants.GrubPasswordCfg))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring("set superusers=\"root\""))
+			Expect(string(data)).To(ContainSubstring("password_pbkdf2 root grub.pbkdf2.sha512.10000.AB12.CD34"))
+			info, err := fs.Stat(filepath.Join("/boot/efi", constants.GrubPasswordCfg))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		})
+		It("writes the recovery password config", func() {
+			Expect(utils.MkdirAll(fs, "/oem", constants.DirPerm)).To(Succeed())
+			Expect(elemental.WriteRecoveryPassConfig(*config, "/oem", "$6$salt$hash")).To(Succeed())
+			data, err := fs.ReadFile(filepath.Join("/oem", constants.RecoveryPassConfig))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring(constants.RecoveryMode))
+			Expect(string(data)).To(ContainSubstring("usermod -p '$6$salt$hash' root"))
+		})
+		It("does nothing without hashes", func() {
+			Expect(elemental.WriteGrubPassword(*config, "/boot/efi", "")).To(Succeed())
+			Expect(elemental.WriteRecoveryPassConfig(*config, "/oem", "")).To(Succeed())
+			ok, _ := utils.Exists(fs, filepath.Join("/boot/efi", constants.GrubPasswordCfg))
+			Expect(ok).To(BeFalse())
+		})
+	})
+	Describe("Time sync", Label("time"), func() {
+		It("syncs the time from an NTP server", func() {
+			spec := types.TimeSyncSpec{NTPServer: "pool.ntp.org"}
+			Expect(elemental.SyncTime(*config, spec)).To(Succeed())
+			Expect(runner.CmdsMatch([][]string{
+				{"chronyd", "-q", "-t", "30", "server pool.ntp.org iburst"},
+				{"hwclock", "--systohc", "--utc"},
+			})).To(Succeed())
+		})
+		It("falls back to ntpdate", func() {
+			runner.CmdNotFound = "chronyd"
+			spec := types.TimeSyncSpec{NTPServer: "pool.ntp.org"}
+			Expect(elemental.SyncTime(*config, spec)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"ntpdate", "-u", "pool.ntp.org"}})).To(Succeed())
+		})
+		It("sets the time from a timestamp ignoring hardware clock errors", func() {
+			runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+				if cmd == "hwclock" {
+					return []byte{}, errors.New("no hardware clock")
+				}
+				return []byte{}, nil
+			}
+			spec := types.TimeSyncSpec{Timestamp: "2025-01-01T00:00:00Z"}
+			Expect(elemental.SyncTime(*config, spec)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"date", "-u", "-s", "@1735689600"}})).To(Succeed())
+		})
+		It("does nothing if not configured", func() {
+			Expect(elemental.SyncTime(*config, types.TimeSyncSpec{})).To(Succeed())
+			Expect(runner.GetCmds()).To(BeEmpty())
+		})
+		It("sets the timezone of the given root", func() {
+			Expect(utils.MkdirAll(fs, "/some/root/usr/share/zoneinfo/Europe", constants.DirPerm)).To(Succeed())
+			Expect(utils.MkdirAll(fs, "/some/root/etc", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/some/root/usr/share/zoneinfo/Europe/Berlin", []byte{}, constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile("/some/root/etc/localtime", []byte{}, constants.FilePerm)).To(Succeed())
+			Expect(elemental.SetTimezone(*config, "/some/root", "Europe/Berlin")).To(Succeed())
+			link, err := fs.Readlink("/some/root/etc/localtime")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link).To(Equal("../usr/share/zoneinfo/Europe/Berlin"))
+			Expect(elemental.SetTimezone(*config, "/some/root", "Mars/Olympus")).NotTo(Succeed())
+		})
+	})
+	Describe("SetDefaultBootTarget", Label("boot-target"), func() {
+		BeforeEach(func() {
+			Expect(utils.MkdirAll(fs, "/some/root/usr/lib/systemd/system", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/some/root/usr/lib/systemd/system/rescue.target", []byte{}, constants.FilePerm)).To(Succeed())
+		})
+		It("links the default target to the given target of the root", func() {
+			Expect(utils.MkdirAll(fs, "/some/root/etc/systemd/system", constants.DirPerm)).To(Succeed())
+			Expect(fs.Symlink("/usr/lib/systemd/system/graphical.target", "/some/root/etc/systemd/system/default.target")).To(Succeed())
+			Expect(elemental.SetDefaultBootTarget(*config, "/some/root", "rescue.target")).To(Succeed())
+			link, err := fs.Readlink("/some/root/etc/systemd/system/default.target")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link).To(HaveSuffix("/usr/lib/systemd/system/rescue.target"))
+		})
+		It("does nothing if not configured", func() {
+			Expect(elemental.SetDefaultBootTarget(*config, "/some/root", "")).To(Succeed())
+			ok, _ := utils.Exists(fs, "/some/root/etc/systemd/system/default.target")
+			Expect(ok).To(BeFalse())
+		})
+		It("fails if the target is not in the root", func() {
+			err := elemental.SetDefaultBootTarget(*config, "/some/root", "maintenance.target")
+			Expect(err).To(MatchError(ContainSubstring("not found in the image")))
+		})
+	})
+	Describe("RAID", Label("raid", "mdadm"), func() {
+		It("creates a RAID array", func() {
+			err := elemental.CreateRaidArray(*config, "/dev/md0", "1", []string{"/dev/sda", "/dev/sdb"})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(runner.CmdsMatch([][]string{
+				{
+					"mdadm", "--create", "/dev/md0", "--run", "--metadata=1.0",
+					"--level=1", "--raid-devices=2", "/dev/sda", "/dev/sdb",
+				},
+				{"udevadm", "settle"},
+			})).To(Succeed())
+		})
+		It("fails to create a RAID array", func() {
+			runner.ReturnError = fmt.Errorf("mdadm failed")
+			err := elemental.CreateRaidArray(*config, "/dev/md0", "1", []string{"/dev/sda", "/dev/sdb"})
+			Expect(err).Should(HaveOccurred())
+		})
+		It("writes the mdadm config and returns the array UUID", func() {
+			detail := "ARRAY /dev/md0 metadata=1.0 name=host:0 UUID=6c6a6e0d:2b2d4a0c:8f1a7e54:d0e3b2a1\n"
+			runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+				if cmd == "mdadm" {
+					return []byte(detail), nil
+				}
+				return []byte{}, nil
+			}
+			uuid, err := elemental.ConfigureRaid(*config, "/dev/md0", "/some/root")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(uuid).To(Equal("6c6a6e0d:2b2d4a0c:8f1a7e54:d0e3b2a1"))
+			data, err := fs.ReadFile(filepath.Join("/some/root", constants.MdadmConf))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(data)).To(Equal(detail))
+		})
+		It("fails if the array UUID is not found", func() {
+			_, err := elemental.ConfigureRaid(*config, "/dev/md0", "/some/root")
+			Expect(err).Should(HaveOccurred())
+		})
+	})
 	Describe("DeployRecoverySystem", Label("recovery"), func() {
 		BeforeEach(func() {
 			extractor.SideEffect = func(_, destination, platform string, _, _ bool) (string, error) {
@@ -974,6 +1799,60 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			Expect(err).ShouldNot(HaveOccurred())
 			Expect(info.Mode() & iofs.ModeSymlink).To(BeZero())
 		})
+		It("deploys a recovery system with non standard kernel and initrd names", Label("kernel", "initrd"), func() {
+			extractor.SideEffect = func(_, destination, platform string, _, _ bool) (string, error) {
+				bootDir := filepath.Join(destination, "boot")
+				Expect(utils.MkdirAll(fs, bootDir, constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(filepath.Join(bootDir, "kernel-6.4"), []byte("kernel"), constants.FilePerm)).To(Succeed())
+				Expect(fs.WriteFile(filepath.Join(bootDir, "initramfs-6.4.img"), []byte("initrd"), constants.FilePerm)).To(Succeed())
+				return mocks.FakeDigest, nil
+			}
+			var linked bool
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "mksquashfs" {
+					// The image tree includes the links to the boot files
+					ok, _ := utils.Exists(fs, filepath.Join(args[0], constants.KernelPath))
+					linked = ok
+				}
+				return []byte{}, nil
+			}
+			config.KernelPattern = "/boot/kernel-*"
+			config.InitrdPattern = "/boot/initramfs-*.img"
+			Expect(utils.MkdirAll(fs, "/recovery/boot", constants.DirPerm)).To(Succeed())
+
+			img := &types.Image{
+				File:   filepath.Join("/recovery", constants.BootPath, constants.RecoveryImgFile),
+				Source: types.NewDockerSrc("elemental:latest"),
+				FS:     constants.SquashFs,
+			}
+			Expect(elemental.DeployRecoverySystem(*config, img)).To(Succeed())
+			Expect(linked).To(BeTrue())
+
+			data, err := fs.ReadFile("/recovery/boot/vmlinuz")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(data)).To(Equal("kernel"))
+			data, err = fs.ReadFile("/recovery/boot/initrd")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(data)).To(Equal("initrd"))
+		})
+		It("deploys a recovery system excluding the given paths", func() {
+			Expect(utils.MkdirAll(fs, "/recovery/boot", constants.DirPerm)).To(Succeed())
+
+			img := &types.Image{
+				File:   filepath.Join("/recovery", constants.BootPath, constants.RecoveryImgFile),
+				Source: types.NewDockerSrc("elemental:latest"),
+				FS:     constants.SquashFs,
+			}
+			Expect(elemental.DeployRecoverySystem(*config, img, "/usr/share/doc", "/opt/file[1]")).To(Succeed())
+
+			var squashCmd []string
+			for _, cmd := range runner.GetCmds() {
+				if cmd[0] == "mksquashfs" {
+					squashCmd = cmd
+				}
+			}
+			Expect(squashCmd).To(ContainElements("usr/share/doc", `opt/file\[1]`))
+		})
 	})
 })
 
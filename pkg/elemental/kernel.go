@@ -0,0 +1,116 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package elemental
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	cnst "github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+// kernelHeaderSize is the amount of bytes read to identify a kernel image
+const kernelHeaderSize = 4096
+
+// peMachines maps the PE machine types of EFI stub kernels to architectures
+var peMachines = map[uint16]string{
+	0x8664: cnst.Archx86,
+	0xaa64: cnst.ArchArm64,
+	0x5064: cnst.ArchRiscV64,
+}
+
+// kernelImage describes the boot format of a kernel image
+type kernelImage struct {
+	arch    string
+	efiStub bool
+}
+
+// readKernelImage identifies the architecture of the given kernel image and whether it
+// includes an EFI stub. It returns nil for unknown formats, such as compressed images.
+func readKernelImage(vfs types.FS, path string) (*kernelImage, error) {
+	f, err := vfs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header := make([]byte, kernelHeaderSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	header = header[:n]
+	has := func(offset int, magic string) bool {
+		return offset >= 0 && len(header) >= offset+len(magic) && string(header[offset:offset+len(magic)]) == magic
+	}
+
+	img := &kernelImage{}
+	switch {
+	case has(0x202, "HdrS"):
+		img.arch = cnst.Archx86
+	case has(0x38, "ARM\x64"):
+		img.arch = cnst.ArchArm64
+	case has(0x30, "RSC\x05"):
+		img.arch = cnst.ArchRiscV64
+	}
+
+	// EFI stub kernels are PE executables, the PE header offset is stored at 0x3c
+	if has(0, "MZ") && len(header) >= 0x40 {
+		pe := int(binary.LittleEndian.Uint32(header[0x3c:]))
+		if has(pe, "PE\x00\x00") && len(header) >= pe+6 {
+			if arch, ok := peMachines[binary.LittleEndian.Uint16(header[pe+4:])]; ok {
+				img.arch = arch
+				img.efiStub = true
+			}
+		}
+	}
+
+	if img.arch == "" {
+		return nil, nil
+	}
+	return img, nil
+}
+
+// CheckBootCompatibility checks the tree at root includes a kernel and an initrd and that
+// the kernel can be booted on the given firmware with the configured bootloader and platform.
+// EFI firmware and the none bootloader, which chainloads from an EFI boot manager, require
+// an EFI stub kernel. Kernels of an unknown format are only checked for presence.
+func CheckBootCompatibility(c types.Config, root, firmware string) error {
+	kernel, _, err := FindKernelInitrd(c, root)
+	if err != nil {
+		return err
+	}
+	img, err := readKernelImage(c.Fs, kernel)
+	if err != nil {
+		return fmt.Errorf("failed reading kernel %s: %w", kernel, err)
+	}
+	if img == nil {
+		c.Logger.Warnf("unknown format of kernel %s, skipping the firmware and architecture checks", kernel)
+		return nil
+	}
+
+	if c.Platform != nil && img.arch != c.Platform.Arch {
+		return fmt.Errorf("kernel %s is built for %s, but the target platform is %s", kernel, img.arch, c.Platform.Arch)
+	}
+	if (firmware == types.EFI || c.Bootloader == cnst.BootloaderNone) && !img.efiStub {
+		return fmt.Errorf("kernel %s has no EFI stub, it can't be booted from EFI firmware", kernel)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package elemental
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/atomicfile"
+	cnst "github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+// sbomPackage is a package installed in an image
+type sbomPackage struct {
+	name    string
+	version string
+	arch    string
+	license string
+}
+
+func (p sbomPackage) purl() string {
+	return fmt.Sprintf("pkg:rpm/%s@%s?arch=%s", url.PathEscape(p.name), url.PathEscape(p.version), p.arch)
+}
+
+// WriteSBOM writes the software bill of materials of the given root tree into the given
+// directory in the given format and returns the written file name. If the image ships
+// an SBOM of the same format in /usr/share/sbom it is used, otherwise it is generated
+// from the RPM database of the tree.
+func WriteSBOM(c types.Config, root, dir, format string, src *types.ImageSource) (string, error) {
+	name := cnst.SPDXFile
+	suffix := ".spdx.json"
+	if format == cnst.CycloneDXFormat {
+		name = cnst.CycloneDXFile
+		suffix = ".cdx.json"
+	}
+	dest := filepath.Join(dir, name)
+
+	embedded, _ := c.Fs.Glob(filepath.Join(root, cnst.SBOMEmbeddedDir, "*"+suffix))
+	if len(embedded) > 0 {
+		c.Logger.Infof("Copying embedded SBOM %s", strings.TrimPrefix(embedded[0], root))
+		err := utils.CopyFile(c.Fs, embedded[0], dest)
+		if err != nil {
+			return "", err
+		}
+		return name, nil
+	}
+
+	c.Logger.Infof("Generating %s SBOM from the installed packages", format)
+	pkgs, err := listPackages(c, root)
+	if err != nil {
+		return "", err
+	}
+
+	var doc interface{}
+	if format == cnst.CycloneDXFormat {
+		doc = cycloneDXDocument(src, pkgs)
+	} else {
+		doc = spdxDocument(src, pkgs)
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	err = atomicfile.WriteFile(c.Fs, dest, data, cnst.FilePerm)
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// listPackages lists the RPM packages installed in the given root tree
+func listPackages(c types.Config, root string) ([]sbomPackage, error) {
+	if !c.Runner.CommandExists("rpm") {
+		return nil, fmt.Errorf("rpm is required to generate an SBOM of the installed packages")
+	}
+	out, err := c.Runner.Run(
+		"rpm", "--root", root, "-qa", "--queryformat", "%{NAME}|%{VERSION}-%{RELEASE}|%{ARCH}|%{LICENSE}\\n",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing installed packages: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	pkgs := []sbomPackage{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.SplitN(line, "|", 4)
+		if len(fields) < 4 {
+			continue
+		}
+		pkgs = append(pkgs, sbomPackage{name: fields[0], version: fields[1], arch: fields[2], license: fields[3]})
+	}
+	return pkgs, nil
+}
+
+func spdxDocument(src *types.ImageSource, pkgs []sbomPackage) map[string]interface{} {
+	packages := []map[string]interface{}{}
+	for i, p := range pkgs {
+		packages = append(packages, map[string]interface{}{
+			"name":             p.name,
+			"SPDXID":           fmt.Sprintf("SPDXRef-Package-%d", i),
+			"versionInfo":      p.version,
+			"downloadLocation": "NOASSERTION",
+			"licenseConcluded": "NOASSERTION",
+			"licenseDeclared":  "NOASSERTION",
+			"comment":          fmt.Sprintf("License: %s", p.license),
+			"externalRefs": []map[string]string{{
+				"referenceCategory": "PACKAGE-MANAGER",
+				"referenceType":     "purl",
+				"referenceLocator":  p.purl(),
+			}},
+		})
+	}
+	now := time.Now().UTC()
+	return map[string]interface{}{
+		"spdxVersion":       "SPDX-2.3",
+		"dataLicense":       "CC0-1.0",
+		"SPDXID":            "SPDXRef-DOCUMENT",
+		"name":              src.String(),
+		"documentNamespace": fmt.Sprintf("https://rancher.github.io/elemental-toolkit/spdx/%s-%d", url.PathEscape(src.Value()), now.UnixNano()),
+		"creationInfo": map[string]interface{}{
+			"created":  now.Format(time.RFC3339),
+			"creators": []string{"Tool: elemental"},
+		},
+		"packages": packages,
+	}
+}
+
+func cycloneDXDocument(src *types.ImageSource, pkgs []sbomPackage) map[string]interface{} {
+	components := []map[string]interface{}{}
+	for _, p := range pkgs {
+		components = append(components, map[string]interface{}{
+			"type":     "library",
+			"name":     p.name,
+			"version":  p.version,
+			"purl":     p.purl(),
+			"licenses": []map[string]interface{}{{"license": map[string]string{"name": p.license}}},
+		})
+	}
+	return map[string]interface{}{
+		"bomFormat":   "CycloneDX",
+		"specVersion": "1.5",
+		"version":     1,
+		"metadata": map[string]interface{}{
+			"timestamp": time.Now().UTC().Format(time.RFC3339),
+			"tools":     []map[string]string{{"name": "elemental"}},
+			"component": map[string]string{
+				"type":    "operating-system",
+				"name":    src.String(),
+				"version": src.GetDigest(),
+			},
+		},
+		"components": components,
+	}
+}
@@ -265,5 +265,80 @@ const UpgradeRecovery = 88
 // Error displaying installation state
 const DisplayingInstallationState = 89
 
+// Invalid boot entry
+const InvalidBootEntry = 90
+
+// Error expanding a partition
+const ExpandPartition = 91
+
+// Error verifying the upgrade source
+const VerifyUpgrade = 92
+
+// Error resuming a staged upgrade
+const ResumeUpgrade = 93
+
+// Error setting up a software RAID array
+const SetupRaid = 94
+
+// Error finding the kernel or initrd of an image
+const FindKernelInitrd = 95
+
+// Error creating the configured users
+const CreateUsers = 96
+
+// Error setting the system time
+const SyncTime = 97
+
+// Error installing some of several target devices
+const InstallMany = 98
+
+// Error verifying a completed installation
+const VerifyInstall = 99
+
+// Not enough free space in the persistent partition to upgrade
+const PersistentSpace = 100
+
+// Refusing to upgrade to a version not newer than the active one
+const Downgrade = 101
+
+// Error running the source transform command
+const TransformSource = 102
+
+// The active image drifted from its source
+const DetectDrift = 103
+
+// Error creating the missing recovery partition
+const CreateRecoveryPartition = 104
+
+// Error setting the default boot target
+const BootTarget = 105
+
+// Error activating a snapshot
+const ActivateSnapshot = 106
+
+// The system kernel can't be booted on the target
+const BootCompatibility = 107
+
+// Not enough free inodes to deploy the system
+const NotEnoughInodes = 108
+
+// Error capturing the running system
+const CaptureSystem = 109
+
+// Invalid cloud-init configuration
+const InvalidCloudConfig = 110
+
+// Error pruning unused artifacts
+const PruneSlots = 111
+
+// Error applying a forbidden signatures database update
+const DbxUpdate = 112
+
+// Error verifying the signature of an image
+const CosignVerify = 113
+
+// Error verifying a created image matches its source tree
+const VerifyImage = 114
+
 // Unknown error
 const Unknown int = 255
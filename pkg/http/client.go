@@ -17,6 +17,9 @@ limitations under the License.
 package http
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -26,14 +29,39 @@ import (
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 )
 
+// maxRedirects matches the default redirects limit of the net/http client
+const maxRedirects = 10
+
 type Client struct {
-	client *grab.Client
+	client  *grab.Client
+	headers types.HTTPHeaderScopes
 }
 
 func NewClient() *Client {
 	client := grab.NewClient()
-	client.HTTPClient = &http.Client{Timeout: time.Second * constants.HTTPTimeout}
-	return &Client{client: client}
+	c := &Client{client: client}
+	client.HTTPClient = &http.Client{Timeout: time.Second * constants.HTTPTimeout, CheckRedirect: c.scopeRedirect}
+	return c
+}
+
+// SetHeaders sets extra headers sent on downloads of the URLs of each scope
+func (c *Client) SetHeaders(headers types.HTTPHeaderScopes) {
+	c.headers = headers
+}
+
+// scopeRedirect replaces the extra headers copied from the previous request by the ones
+// scoped to the redirect URL, so they are never forwarded to another host
+func (c *Client) scopeRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	for _, name := range c.headers.Names() {
+		req.Header.Del(name)
+	}
+	for name, value := range c.headers.For(req.URL.String()) {
+		req.Header.Set(name, value)
+	}
+	return nil
 }
 
 // GetURL attempts to download the contents of the given URL to the given destination
@@ -43,6 +71,9 @@ func (c Client) GetURL(log types.Logger, url string, destination string) error {
 		log.Errorf("Failed creating a request to '%s'", url)
 		return err
 	}
+	for name, value := range c.headers.For(url) {
+		req.HTTPRequest.Header.Set(name, value)
+	}
 
 	// start download
 	log.Infof("Downloading %v...\n", req.URL())
@@ -76,3 +107,31 @@ Loop:
 	log.Debugf("Download saved to ./%v \n", resp.Filename)
 	return nil
 }
+
+// PostJSON posts the given data encoded as JSON to the given URL
+func (c Client) PostJSON(log types.Logger, url string, data interface{}) error { // nolint:revive
+	body, err := json.Marshal(data)
+	if err != nil {
+		log.Errorf("Failed encoding data for '%s'", url)
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		log.Errorf("Failed creating a request to '%s'", url)
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	log.Debugf("Posting to %s: %s", url, body)
+	resp, err := c.client.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response from '%s': %s", url, resp.Status)
+	}
+	return nil
+}
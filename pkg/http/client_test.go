@@ -17,6 +17,8 @@ limitations under the License.
 package http_test
 
 import (
+	gohttp "net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 
@@ -57,6 +59,38 @@ var _ = Describe("HTTPClient", Label("http"), func() {
 		_, err = os.Stat(filepath.Join(destDir, "testfile"))
 		Expect(err).To(BeNil())
 	})
+	It("Sends the configured headers on downloads of their scope only", Label("http-headers"), func() {
+		var auth string
+		server := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+			auth = r.Header.Get("Authorization")
+			_, _ = w.Write([]byte("data"))
+		}))
+		defer server.Close()
+
+		client.SetHeaders(types.HTTPHeaderScopes{{
+			URL: server.URL + "/private", Headers: types.HTTPHeaders{"authorization": "Bearer s3cr3t"},
+		}})
+		Expect(client.GetURL(log, server.URL+"/private/file", filepath.Join(destDir, "file"))).To(Succeed())
+		Expect(auth).To(Equal("Bearer s3cr3t"))
+		Expect(client.GetURL(log, server.URL+"/public/file", filepath.Join(destDir, "other"))).To(Succeed())
+		Expect(auth).To(BeEmpty())
+	})
+	It("Does not forward the configured headers on redirects to other hosts", Label("http-headers"), func() {
+		var apiKey string
+		other := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+			apiKey = r.Header.Get("X-Api-Key")
+			_, _ = w.Write([]byte("data"))
+		}))
+		defer other.Close()
+		server := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+			gohttp.Redirect(w, r, other.URL+"/file", gohttp.StatusFound)
+		}))
+		defer server.Close()
+
+		client.SetHeaders(types.HTTPHeaderScopes{{URL: server.URL, Headers: types.HTTPHeaders{"X-Api-Key": "k3y"}}})
+		Expect(client.GetURL(log, server.URL+"/file", filepath.Join(destDir, "file"))).To(Succeed())
+		Expect(apiKey).To(BeEmpty())
+	})
 	It("Fails to download a non existing url", func() {
 		source := "http://nonexisting.stuff"
 		Expect(client.GetURL(log, source, destDir)).NotTo(BeNil())
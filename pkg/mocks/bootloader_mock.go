@@ -32,6 +32,8 @@ type FakeBootloader struct {
 	ErrorInstallEFIBinaries     bool
 	ErrorSetPersistentVariables bool
 	ErrorSetDefaultEntry        bool
+	// Variables set by SetPersistentVariables indexed by env file
+	PersistentVariables map[string]map[string]string
 }
 
 func (f *FakeBootloader) Install(_, _ string) error {
@@ -69,10 +71,19 @@ func (f *FakeBootloader) DoEFIEntries(_, _ string) error {
 	return nil
 }
 
-func (f *FakeBootloader) SetPersistentVariables(_ string, _ map[string]string) error {
+func (f *FakeBootloader) SetPersistentVariables(envFile string, vars map[string]string) error {
 	if f.ErrorSetPersistentVariables {
 		return fmt.Errorf("error setting persistent variables")
 	}
+	if f.PersistentVariables == nil {
+		f.PersistentVariables = map[string]map[string]string{}
+	}
+	if f.PersistentVariables[envFile] == nil {
+		f.PersistentVariables[envFile] = map[string]string{}
+	}
+	for key, value := range vars {
+		f.PersistentVariables[envFile][key] = value
+	}
 	return nil
 }
 
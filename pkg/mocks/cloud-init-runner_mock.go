@@ -19,15 +19,19 @@ package mocks
 import (
 	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/rancher/yip/pkg/schema"
 )
 
 type FakeCloudInitRunner struct {
-	ExecStages []string
-	Error      bool
-	RenderErr  bool
-	stageArgs  map[string][]string
+	ExecStages  []string
+	Error       bool
+	RenderErr   bool
+	ValidateErr bool
+	Validated   []string
+	stageArgs   map[string][]string
+	mu          sync.Mutex
 }
 
 func appendIfMissing(slice []string, item string) []string {
@@ -40,6 +44,9 @@ func appendIfMissing(slice []string, item string) []string {
 }
 
 func (ci *FakeCloudInitRunner) Run(stage string, args ...string) error {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
 	if ci.stageArgs == nil {
 		ci.stageArgs = map[string][]string{}
 	}
@@ -69,3 +76,11 @@ func (ci *FakeCloudInitRunner) CloudInitFileRender(_ string, _ *schema.YipConfig
 	}
 	return nil
 }
+
+func (ci *FakeCloudInitRunner) Validate(path string) error {
+	ci.Validated = append(ci.Validated, path)
+	if ci.ValidateErr {
+		return fmt.Errorf("yaml: line 1: invalid cloud-init file")
+	}
+	return nil
+}
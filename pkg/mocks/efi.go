@@ -17,6 +17,7 @@ limitations under the License.
 package mocks
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
@@ -71,12 +72,25 @@ func (m MockEFIVariables) GetVariable(guid efi.GUID, name string) (data []byte,
 	return out.data, out.attrs, nil
 }
 
-// SetVariable implements EFIVariables
+// SetVariable implements EFIVariables. Authenticated appends are not verified, the
+// authentication header is dropped and the payload appended, as firmware does.
 func (m MockEFIVariables) SetVariable(guid efi.GUID, name string, data []byte, attrs efi.VariableAttributes) error {
+	desc := efi.VariableDescriptor{Name: name, GUID: guid}
+	if attrs&efi.AttributeAppendWrite != 0 {
+		attrs &^= efi.AttributeAppendWrite
+		if attrs&efi.AttributeTimeBasedAuthenticatedWriteAccess != 0 {
+			r := bytes.NewReader(data)
+			if _, err := efi.ReadTimeBasedVariableAuthentication(r); err != nil {
+				return err
+			}
+			data = data[len(data)-r.Len():]
+		}
+		data = append(append([]byte{}, m.store[desc].data...), data...)
+	}
 	if len(data) == 0 {
-		delete(m.store, efi.VariableDescriptor{Name: name, GUID: guid})
+		delete(m.store, desc)
 	} else {
-		m.store[efi.VariableDescriptor{Name: name, GUID: guid}] = mockEFIVariable{data, attrs}
+		m.store[desc] = mockEFIVariable{data, attrs}
 	}
 	return nil
 }
@@ -121,3 +135,36 @@ func (m MockEFIVariables) NewFileDevicePath(fpath string, _ efi_linux.FilePathTo
 		efi.NewFilePathDevicePathNode(fpath),
 	}, nil
 }
+
+// NewSHA256SignatureList returns a signature list of the given SHA256 hashes
+func NewSHA256SignatureList(hashes ...[]byte) *efi.SignatureList {
+	list := &efi.SignatureList{Type: efi.CertSHA256Guid}
+	for _, hash := range hashes {
+		list.Signatures = append(list.Signatures, &efi.SignatureData{Owner: efi.GlobalVariable, Data: hash})
+	}
+	return list
+}
+
+// NewDbxUpdate returns an authenticated dbx update of the given SHA256 hashes. The
+// authentication header includes a placeholder signature, it is not verified by the mocks.
+func NewDbxUpdate(hashes ...[]byte) []byte {
+	buf := new(bytes.Buffer)
+	// EFI_TIME of 2025-01-01
+	_ = binary.Write(buf, binary.LittleEndian, struct {
+		Year                               uint16
+		Month, Day, Hour, Minute, Sec, Pad uint8
+		Nanosecond                         uint32
+		TimeZone                           int16
+		Daylight, Pad2                     uint8
+	}{Year: 2025, Month: 1, Day: 1})
+	// WIN_CERTIFICATE_UEFI_GUID with an unknown certificate type
+	signature := []byte("signature")
+	_ = binary.Write(buf, binary.LittleEndian, uint32(24+len(signature)))
+	_ = binary.Write(buf, binary.LittleEndian, uint16(0x0200))
+	_ = binary.Write(buf, binary.LittleEndian, uint16(0x0EF1))
+	certType := efi.MakeGUID(0x12345678, 0x1234, 0x1234, 0x1234, [6]uint8{1, 2, 3, 4, 5, 6})
+	buf.Write(certType[:])
+	buf.Write(signature)
+	_ = NewSHA256SignatureList(hashes...).Write(buf)
+	return buf.Bytes()
+}
@@ -23,6 +23,8 @@ const FakeDigest = "fakeDigest"
 type FakeImageExtractor struct {
 	Logger     types.Logger
 	SideEffect func(imageRef, destination, platformRef string, local bool, verify bool) (string, error)
+	// Auths records the credentials used for each extracted image reference
+	Auths map[string]*types.RegistryAuth
 }
 
 var _ types.ImageExtractor = FakeImageExtractor{}
@@ -30,11 +32,15 @@ var _ types.ImageExtractor = FakeImageExtractor{}
 func NewFakeImageExtractor(logger types.Logger) *FakeImageExtractor {
 	return &FakeImageExtractor{
 		Logger: logger,
+		Auths:  map[string]*types.RegistryAuth{},
 	}
 }
 
-func (f FakeImageExtractor) ExtractImage(imageRef, destination, platformRef string, local bool, verify bool) (string, error) {
+func (f FakeImageExtractor) ExtractImage(imageRef, destination, platformRef string, local bool, verify bool, auth *types.RegistryAuth) (string, error) {
 	f.Logger.Debugf("extracting %s to %s in platform %s", imageRef, destination, platformRef)
+	if f.Auths != nil {
+		f.Auths[imageRef] = auth
+	}
 	if f.SideEffect != nil {
 		f.Logger.Debugf("running sideeffect")
 		return f.SideEffect(imageRef, destination, platformRef, local, verify)
@@ -17,11 +17,14 @@ limitations under the License.
 package mocks
 
 import (
+	"bytes"
 	"fmt"
+	"hash/crc32"
 	"os"
 	"path/filepath"
 	"strings"
 
+	efi "github.com/canonical/go-efilib"
 	"github.com/jaypipes/ghw/pkg/block"
 	"github.com/jaypipes/ghw/pkg/context"
 	"github.com/jaypipes/ghw/pkg/linuxpath"
@@ -85,11 +88,16 @@ func (g *GhwMock) CreateDevices() {
 			_ = os.Mkdir(filepath.Join(diskPath, partition.Name), 0755)
 			// Create the /sys/block/DISK_NAME/PARTITION_NAME/dev file which contains the major:minor of the partition
 			_ = os.WriteFile(filepath.Join(diskPath, partition.Name, "dev"), []byte(fmt.Sprintf("%d:6%d\n", indexDisk, indexPart)), 0644)
+			// Create the /sys/block/DISK_NAME/PARTITION_NAME/partition file which contains the partition number
+			_ = os.WriteFile(filepath.Join(diskPath, partition.Name, "partition"), []byte(fmt.Sprintf("%d\n", indexPart+1)), 0644)
 			// Create the /run/udev/data/bMAJOR:MINOR file with the data inside to mimic the udev database
 			data := []string{fmt.Sprintf("E:ID_FS_LABEL=%s\n", partition.FilesystemLabel)}
 			if partition.Type != "" {
 				data = append(data, fmt.Sprintf("E:ID_FS_TYPE=%s\n", partition.Type))
 			}
+			if partition.UUID != "" {
+				data = append(data, fmt.Sprintf("E:ID_PART_ENTRY_UUID=%s\n", partition.UUID))
+			}
 			_ = os.WriteFile(filepath.Join(g.paths.RunUdevData, fmt.Sprintf("b%d:6%d", indexDisk, indexPart)), []byte(strings.Join(data, "")), 0644)
 			// If we got a mountpoint, add it to our fake /proc/self/mounts
 			if partition.MountPoint != "" {
@@ -108,6 +116,12 @@ func (g *GhwMock) CreateDevices() {
 	_ = os.WriteFile(g.paths.ProcMounts, []byte(strings.Join(g.mounts, "")), 0644)
 }
 
+// AddHolder sets the given holder device of the given disk, e.g. the RAID array the disk is a member of.
+// It makes no effort checking if the disk exists
+func (g *GhwMock) AddHolder(diskName string, holder string) {
+	_ = os.MkdirAll(filepath.Join(g.paths.SysBlock, diskName, "holders", holder), 0755)
+}
+
 // RemoveDisk will remove the files for a disk. It makes no effort to check if the disk exists or not
 func (g *GhwMock) RemoveDisk(disk string) {
 	// This could be simpler I think, just removing the /sys/block/DEVICE should make ghw not find anything and not search
@@ -171,3 +185,44 @@ func (g *GhwMock) Clean() {
 	_ = os.Unsetenv("GHW_CHROOT")
 	_ = os.RemoveAll(g.chroot)
 }
+
+// NewGPTImage returns a 64 sectors disk image with a GPT partition table including a partition
+// for each of the given partition GUIDs. Empty GUIDs are unused partition table entries.
+func NewGPTImage(guids ...string) []byte {
+	const sector = 512
+	img := make([]byte, 64*sector)
+
+	// Protective MBR
+	img[446+4] = 0xee
+	img[510], img[511] = 0x55, 0xaa
+
+	entries := new(bytes.Buffer)
+	linuxType := efi.MakeGUID(0x0fc63daf, 0x8483, 0x4772, 0x8e79, [6]uint8{0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4})
+	for i, guid := range guids {
+		entry := &efi.PartitionEntry{}
+		if guid != "" {
+			entry.PartitionTypeGUID = linuxType
+			entry.UniquePartitionGUID, _ = efi.DecodeGUIDString(guid)
+			entry.StartingLBA = efi.LBA(34 + 2*i)
+			entry.EndingLBA = efi.LBA(35 + 2*i)
+		}
+		_ = entry.Write(entries)
+	}
+	copy(img[2*sector:], entries.Bytes())
+
+	hdr := &efi.PartitionTableHeader{
+		HeaderSize:               92,
+		MyLBA:                    1,
+		AlternateLBA:             63,
+		FirstUsableLBA:           34,
+		LastUsableLBA:            62,
+		PartitionEntryLBA:        2,
+		NumberOfPartitionEntries: uint32(len(guids)),
+		SizeOfPartitionEntry:     128,
+		PartitionEntryArrayCRC32: crc32.ChecksumIEEE(entries.Bytes()),
+	}
+	buf := new(bytes.Buffer)
+	_ = hdr.Write(buf)
+	copy(img[sector:], buf.Bytes())
+	return img
+}
@@ -24,18 +24,43 @@ import (
 
 // FakeHTTPClient is an implementation of HTTPClient interface used for testing
 // It stores Get calls into ClientCalls for easy checking of what was called
+// If Fs is set the url is written to the destination file as its content.
 type FakeHTTPClient struct {
 	ClientCalls []string
+	PostData    map[string][]interface{}
+	Headers     types.HTTPHeaderScopes
 	Error       bool
+	Fs          types.FS
+}
+
+// SetHeaders stores the given headers into Headers
+func (m *FakeHTTPClient) SetHeaders(headers types.HTTPHeaderScopes) {
+	m.Headers = headers
 }
 
 // GetURL will return a FakeHttpBody and store the url call into ClientCalls
-func (m *FakeHTTPClient) GetURL(_ types.Logger, url string, _ string) error {
+func (m *FakeHTTPClient) GetURL(_ types.Logger, url string, destination string) error {
 	// Store calls to the mock client, so we can verify that we didnt mangled them or anything
 	m.ClientCalls = append(m.ClientCalls, url)
 	if m.Error {
 		return errors.New("fake http error")
 	}
+	if m.Fs != nil {
+		return m.Fs.WriteFile(destination, []byte(url), 0644)
+	}
+	return nil
+}
+
+// PostJSON stores the url call into ClientCalls and the posted data into PostData
+func (m *FakeHTTPClient) PostJSON(_ types.Logger, url string, data interface{}) error {
+	m.ClientCalls = append(m.ClientCalls, url)
+	if m.Error {
+		return errors.New("fake http error")
+	}
+	if m.PostData == nil {
+		m.PostData = map[string][]interface{}{}
+	}
+	m.PostData[url] = append(m.PostData[url], data)
 	return nil
 }
 
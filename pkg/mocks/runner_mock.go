@@ -20,10 +20,14 @@ import (
 	"fmt"
 	"os/exec"
 	"strings"
+	"sync"
 
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 )
 
+// runLock serializes fake commands run concurrently, so each side effect gets its own command
+var runLock sync.Mutex
+
 type FakeRunner struct {
 	cmds        [][]string
 	ReturnValue []byte
@@ -31,6 +35,8 @@ type FakeRunner struct {
 	ReturnError error
 	Logger      types.Logger
 	CmdNotFound string
+	// Env is the environment of the last command run with RunCmd
+	Env []string
 }
 
 func NewFakeRunner() *FakeRunner {
@@ -42,6 +48,8 @@ func (r *FakeRunner) CommandExists(command string) bool {
 }
 
 func (r *FakeRunner) Run(command string, args ...string) ([]byte, error) {
+	runLock.Lock()
+	defer runLock.Unlock()
 	r.debug(fmt.Sprintf("Running cmd: '%s %s'", command, strings.Join(args, " ")))
 	r.InitCmd(command, args...)
 	out, err := r.RunCmd(nil)
@@ -51,7 +59,10 @@ func (r *FakeRunner) Run(command string, args ...string) ([]byte, error) {
 	return out, err
 }
 
-func (r *FakeRunner) RunCmd(_ *exec.Cmd) ([]byte, error) {
+func (r *FakeRunner) RunCmd(cmd *exec.Cmd) ([]byte, error) {
+	if cmd != nil {
+		r.Env = cmd.Env
+	}
 	if r.SideEffect != nil {
 		if len(r.cmds) > 0 {
 			lastCmd := len(r.cmds) - 1
@@ -63,7 +74,7 @@ func (r *FakeRunner) RunCmd(_ *exec.Cmd) ([]byte, error) {
 
 func (r *FakeRunner) InitCmd(command string, args ...string) *exec.Cmd {
 	r.cmds = append(r.cmds, append([]string{command}, args...))
-	return nil
+	return exec.Command(command, args...)
 }
 
 func (r *FakeRunner) ClearCmds() {
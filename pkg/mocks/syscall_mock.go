@@ -16,18 +16,27 @@ limitations under the License.
 
 package mocks
 
-import "errors"
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
 
 // FakeSyscall is a test helper method to track calls to syscall
 // It can also fail on Chroot command
 type FakeSyscall struct {
-	chrootHistory []string // Track calls to chroot
-	ErrorOnChroot bool
+	chrootHistory  []string // Track calls to chroot
+	ErrorOnChroot  bool
+	ErrorOnUnshare bool
+	unshareCalls   atomic.Int32
+	mu             sync.Mutex
 }
 
 // Chroot will store the chroot call
 // It can return a failure if ErrorOnChroot is true
 func (f *FakeSyscall) Chroot(path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.chrootHistory = append(f.chrootHistory, path)
 	if f.ErrorOnChroot {
 		return errors.New("chroot error")
@@ -39,8 +48,24 @@ func (f *FakeSyscall) Chdir(_ string) error {
 	return nil
 }
 
+// UnshareMountNS counts the calls, it can return a failure if ErrorOnUnshare is true
+func (f *FakeSyscall) UnshareMountNS() error {
+	f.unshareCalls.Add(1)
+	if f.ErrorOnUnshare {
+		return errors.New("unshare error")
+	}
+	return nil
+}
+
+// UnshareCalls returns the number of calls to UnshareMountNS
+func (f *FakeSyscall) UnshareCalls() int {
+	return int(f.unshareCalls.Load())
+}
+
 // WasChrootCalledWith is a helper method to check if Chroot was called with the given path
 func (f *FakeSyscall) WasChrootCalledWith(path string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	for _, c := range f.chrootHistory {
 		if c == path {
 			return true
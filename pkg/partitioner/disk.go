@@ -27,6 +27,7 @@ import (
 
 	"github.com/twpayne/go-vfs/v4"
 
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
 )
@@ -51,6 +52,8 @@ type Disk struct {
 	logger      types.Logger
 	mounter     types.Mounter
 	partBackend string
+	// MiB a created partition can be smaller than requested
+	sizeTolerance uint
 }
 
 func MiBToSectors(size uint, sectorSize uint) uint {
@@ -58,7 +61,7 @@ func MiBToSectors(size uint, sectorSize uint) uint {
 }
 
 func NewDisk(device string, opts ...DiskOptions) *Disk {
-	dev := &Disk{device: device, partBackend: Parted}
+	dev := &Disk{device: device, partBackend: Parted, sizeTolerance: constants.PartSizeTolerance}
 
 	for _, opt := range opts {
 		if err := opt(dev); err != nil {
@@ -87,8 +90,8 @@ func NewDisk(device string, opts ...DiskOptions) *Disk {
 }
 
 // FormatDevice formats a block device with the given parameters
-func FormatDevice(runner types.Runner, device string, fileSystem string, label string, opts ...string) error {
-	mkfs := MkfsCall{fileSystem: fileSystem, label: label, customOpts: opts, dev: device, runner: runner}
+func FormatDevice(runner types.Runner, device string, fileSystem string, label string, uuid string, opts ...string) error {
+	mkfs := MkfsCall{fileSystem: fileSystem, label: label, uuid: uuid, customOpts: opts, dev: device, runner: runner}
 	_, err := mkfs.Apply()
 	return err
 }
@@ -239,6 +242,12 @@ func (dev *Disk) NewPartitionTable(label string) (string, error) {
 // AddPartition adds a partition. Size is expressed in MiB here
 // Size is expressed in MiB here
 func (dev *Disk) AddPartition(size uint, fileSystem string, pLabel string, flags ...string) (int, error) {
+	return dev.AddTypedPartition(size, fileSystem, pLabel, "", flags...)
+}
+
+// AddTypedPartition adds a partition as AddPartition does, additionally setting the given
+// GPT partition type GUID. An empty type GUID keeps the partitioner default type.
+func (dev *Disk) AddTypedPartition(size uint, fileSystem string, pLabel string, typeGUID string, flags ...string) (int, error) {
 	pc := NewPartitioner(dev.String(), dev.runner, dev.partBackend)
 
 	//Check we have loaded partition table data
@@ -254,6 +263,9 @@ func (dev *Disk) AddPartition(size uint, fileSystem string, pLabel string, flags
 	if err != nil {
 		return 0, err
 	}
+	if typeGUID != "" && dev.label != constants.GPT {
+		return 0, fmt.Errorf("partition type GUIDs require a GPT partition table, found '%s'", dev.label)
+	}
 
 	var partNum int
 	var startS uint
@@ -279,6 +291,7 @@ func (dev *Disk) AddPartition(size uint, fileSystem string, pLabel string, flags
 		SizeS:      size,
 		PLabel:     pLabel,
 		FileSystem: fileSystem,
+		TypeGUID:   typeGUID,
 	}
 
 	pc.CreatePartition(&part)
@@ -299,9 +312,80 @@ func (dev *Disk) AddPartition(size uint, fileSystem string, pLabel string, flags
 		dev.logger.Errorf("Failed analyzing disk: %v\n", err)
 		return 0, err
 	}
+
+	// Partitions filling the free space have no requested size
+	if size > 0 {
+		err = dev.checkPartitionSize(partNum, size)
+		if err != nil {
+			dev.logger.Errorf("Unexpected partition size: %v", err)
+			return 0, err
+		}
+	}
 	return partNum, nil
 }
 
+// RemovePartition deletes the partition of the given number from the partition table
+func (dev *Disk) RemovePartition(num int) error {
+	pc := NewPartitioner(dev.String(), dev.runner, dev.partBackend)
+
+	//Check we have loaded partition table data
+	if dev.sectorS == 0 {
+		err := dev.Reload()
+		if err != nil {
+			dev.logger.Errorf("Failed analyzing disk: %v\n", err)
+			return err
+		}
+	}
+
+	err := pc.SetPartitionTableLabel(dev.label)
+	if err != nil {
+		return err
+	}
+
+	pc.DeletePartition(num)
+	out, err := pc.WriteChanges()
+	dev.logger.Debugf("partitioner output: %s", out)
+	if err != nil {
+		dev.logger.Errorf("Failed removing partition: %v", err)
+		return err
+	}
+	return dev.Reload()
+}
+
+// LastPartitionNumber returns the number of the partition at the end of the disk, zero if
+// there is none
+func (dev *Disk) LastPartitionNumber() (int, error) {
+	if dev.sectorS == 0 {
+		err := dev.Reload()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(dev.parts) == 0 {
+		return 0, nil
+	}
+	return dev.parts[len(dev.parts)-1].Number, nil
+}
+
+// checkPartitionSize checks the given partition, as read from the partition table, is not
+// smaller than the given size in sectors beyond the size tolerance. The partitioner might
+// round sizes to align partitions.
+func (dev Disk) checkPartitionSize(partNum int, size uint) error {
+	for _, part := range dev.parts {
+		if part.Number != partNum {
+			continue
+		}
+		if part.SizeS+MiBToSectors(dev.sizeTolerance, dev.sectorS) < size {
+			return fmt.Errorf(
+				"partition %d was created with %d sectors (%dMiB), %d sectors (%dMiB) were requested",
+				partNum, part.SizeS, part.SizeS*dev.sectorS/1048576, size, size*dev.sectorS/1048576,
+			)
+		}
+		return nil
+	}
+	return fmt.Errorf("partition %d not found in the partition table of %s", partNum, dev.device)
+}
+
 func (dev Disk) FormatPartition(partNum int, fileSystem string, label string) (string, error) {
 	pDev, err := dev.FindPartitionDevice(partNum)
 	if err != nil {
@@ -313,8 +397,7 @@ func (dev Disk) FormatPartition(partNum int, fileSystem string, label string) (s
 }
 
 func (dev Disk) WipeFsOnPartition(device string) error {
-	_, err := dev.runner.Run("wipefs", "--all", device)
-	return err
+	return utils.WipeFilesystemSignatures(dev.runner, device)
 }
 
 func (dev Disk) FindPartitionDevice(partNum int) (string, error) {
@@ -19,6 +19,7 @@ package partitioner
 import (
 	"fmt"
 	"regexp"
+	"strings"
 
 	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
@@ -27,6 +28,7 @@ import (
 type MkfsCall struct {
 	fileSystem string
 	label      string
+	uuid       string
 	customOpts []string
 	dev        string
 	runner     types.Runner
@@ -48,6 +50,11 @@ func (mkfs MkfsCall) buildOptions() ([]string, error) {
 			opts = append(opts, "-L")
 			opts = append(opts, mkfs.label)
 		}
+		if mkfs.uuid != "" && mkfs.fileSystem == "xfs" {
+			opts = append(opts, "-m", fmt.Sprintf("uuid=%s", mkfs.uuid))
+		} else if mkfs.uuid != "" {
+			opts = append(opts, "-U", mkfs.uuid)
+		}
 		if len(mkfs.customOpts) > 0 {
 			opts = append(opts, mkfs.customOpts...)
 		}
@@ -60,6 +67,10 @@ func (mkfs MkfsCall) buildOptions() ([]string, error) {
 			opts = append(opts, "-n")
 			opts = append(opts, mkfs.label)
 		}
+		if mkfs.uuid != "" {
+			// FAT volume IDs are shown as 'ABCD-1234' but set as '-i ABCD1234'
+			opts = append(opts, "-i", strings.ReplaceAll(mkfs.uuid, "-", ""))
+		}
 		if len(mkfs.customOpts) > 0 {
 			opts = append(opts, mkfs.customOpts...)
 		}
@@ -50,6 +50,14 @@ func WithGdisk() func(d *Disk) error {
 	}
 }
 
+// WithSizeTolerance sets the MiB a created partition can be smaller than requested
+func WithSizeTolerance(mib uint) func(d *Disk) error {
+	return func(d *Disk) error {
+		d.sizeTolerance = mib
+		return nil
+	}
+}
+
 func WithMounter(mounter types.Mounter) func(d *Disk) error {
 	return func(d *Disk) error {
 		d.mounter = mounter
@@ -26,6 +26,7 @@ import (
 
 	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
 )
 
 type partedCall struct {
@@ -92,6 +93,11 @@ func (pc partedCall) optionsBuilder() []string {
 		} else {
 			opts = append(opts, fmt.Sprintf("%d", part.StartS), fmt.Sprintf("%d", part.StartS+part.SizeS-1))
 		}
+
+		// GPT partition type GUIDs require parted >= 3.5
+		if label == constants.GPT && part.TypeGUID != "" {
+			opts = append(opts, "type", fmt.Sprintf("%d", part.Number), part.TypeGUID)
+		}
 	}
 
 	for _, flag := range pc.flags {
@@ -194,36 +200,22 @@ func (pc partedCall) GetPartitionTableLabel(printOut string) (string, error) {
 	return pc.parseHeaderFields(printOut, 6)
 }
 
-// Parses the output of a GdiskCall.Print call
-func (pc partedCall) GetPartitions(printOut string) []Partition { //nolint:dupl
-	re := regexp.MustCompile(`^(\d+):(\d+)s:(\d+)s:(\d+)s:(.*):(.*):(.*);$`)
-	var start uint
-	var end uint
-	var size uint
-	var pLabel string
-	var partNum int
+// Parses the output of a partedCall.Print call
+func (pc partedCall) GetPartitions(printOut string) []Partition {
 	var partitions []Partition
 
-	scanner := bufio.NewScanner(strings.NewReader(strings.TrimSpace(printOut)))
-	for scanner.Scan() {
-		match := re.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
-		if match != nil {
-			partNum, _ = strconv.Atoi(match[1])
-			parsed, _ := strconv.ParseUint(match[2], 10, 0)
-			start = uint(parsed)
-			parsed, _ = strconv.ParseUint(match[3], 10, 0)
-			end = uint(parsed)
-			size = end - start + 1
-			pLabel = match[6]
-
-			partitions = append(partitions, Partition{
-				Number:     partNum,
-				StartS:     start,
-				SizeS:      size,
-				PLabel:     pLabel,
-				FileSystem: "",
-			})
-		}
+	parsed, err := utils.ParsePartedOutput([]byte(printOut))
+	if err != nil {
+		return partitions
+	}
+	for _, p := range parsed {
+		partitions = append(partitions, Partition{
+			Number:     p.Number,
+			StartS:     uint(p.Start),
+			SizeS:      uint(p.End - p.Start + 1),
+			PLabel:     p.Name,
+			FileSystem: "",
+		})
 	}
 
 	return partitions
@@ -45,6 +45,7 @@ type Partition struct {
 	SizeS      uint
 	PLabel     string
 	FileSystem string
+	TypeGUID   string
 }
 
 func NewPartitioner(dev string, runner types.Runner, backend string) Partitioner {
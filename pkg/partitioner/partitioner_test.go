@@ -18,6 +18,7 @@ package partitioner_test
 
 import (
 	"errors"
+	"slices"
 	"testing"
 
 	"github.com/jaypipes/ghw/pkg/block"
@@ -137,6 +138,19 @@ var _ = Describe("Partitioner", Label("disk", "partition", "partitioner"), func(
 			Expect(err).To(BeNil())
 			Expect(runner.MatchMilestones(cmds)).To(BeNil())
 		})
+		It("Creates a new partition of the given type", Label("type-guid"), func() {
+			cmds := [][]string{
+				{"sgdisk", "-n=1:2048:+204800", "-c=1:efi", "-t=1:C12A7328-F81F-11D2-BA4B-00A0C93EC93B", "/dev/device"},
+			}
+			partition := part.Partition{
+				Number: 1, StartS: 2048, SizeS: 204800, PLabel: "efi",
+				FileSystem: "vfat", TypeGUID: "C12A7328-F81F-11D2-BA4B-00A0C93EC93B",
+			}
+			gc.CreatePartition(&partition)
+			_, err := gc.WriteChanges()
+			Expect(err).To(BeNil())
+			Expect(runner.MatchMilestones(cmds)).To(BeNil())
+		})
 		It("Deletes a partition", func() {
 			cmds := [][]string{
 				{"sgdisk", "-P", "-d=1", "-d=2", "/dev/device"},
@@ -262,6 +276,23 @@ var _ = Describe("Partitioner", Label("disk", "partition", "partitioner"), func(
 			Expect(err).To(BeNil())
 			Expect(runner.CmdsMatch(cmds)).To(BeNil())
 		})
+		It("Creates a new partition of the given type", Label("type-guid"), func() {
+			cmds := [][]string{{
+				"parted", "--script", "--machine", "--", "/dev/device",
+				"unit", "s", "mkpart", "p.root", "ext4", "2048", "206847",
+				"type", "1", "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709",
+			}, {
+				"partx", "-u", "/dev/device",
+			}}
+			partition := part.Partition{
+				Number: 1, StartS: 2048, SizeS: 204800, PLabel: "p.root",
+				FileSystem: "ext4", TypeGUID: "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709",
+			}
+			pc.CreatePartition(&partition)
+			_, err := pc.WriteChanges()
+			Expect(err).To(BeNil())
+			Expect(runner.CmdsMatch(cmds)).To(BeNil())
+		})
 		It("Deletes a partition", func() {
 			cmds := [][]string{{
 				"parted", "--script", "--machine", "--", "/dev/device",
@@ -348,6 +379,19 @@ var _ = Describe("Partitioner", Label("disk", "partition", "partitioner"), func(
 			cmds := [][]string{{"mkfs.vfat", "-n", "EFI", "/dev/device"}}
 			Expect(runner.CmdsMatch(cmds)).To(BeNil())
 		})
+		It("Successfully formats partitions with a given UUID", Label("fs-uuid"), func() {
+			uuid := "3f4d7ab2-0c1e-4b4e-9a51-6c7d8e9f0a1b"
+			Expect(part.FormatDevice(runner, "/dev/device1", "ext4", "OEM", uuid)).To(Succeed())
+			Expect(part.FormatDevice(runner, "/dev/device2", "xfs", "STATE", uuid)).To(Succeed())
+			Expect(part.FormatDevice(runner, "/dev/device3", "btrfs", "DATA", uuid)).To(Succeed())
+			Expect(part.FormatDevice(runner, "/dev/device4", "vfat", "EFI", "ABCD-1234")).To(Succeed())
+			Expect(runner.CmdsMatch([][]string{
+				{"mkfs.ext4", "-L", "OEM", "-U", uuid, "/dev/device1"},
+				{"mkfs.xfs", "-L", "STATE", "-m", "uuid=" + uuid, "/dev/device2"},
+				{"mkfs.btrfs", "-L", "DATA", "-U", uuid, "-f", "/dev/device3"},
+				{"mkfs.vfat", "-n", "EFI", "-i", "ABCD1234", "/dev/device4"},
+			})).To(Succeed())
+		})
 		It("Fails for unsupported filesystem", func() {
 			mkfs := part.NewMkfsCall("/dev/device", "zfs", "OEM", runner)
 			_, err := mkfs.Apply()
@@ -430,7 +474,7 @@ var _ = Describe("Partitioner", Label("disk", "partition", "partitioner"), func(
 		})
 		Describe("Modify disk", func() {
 			It("Format an already existing partition", func() {
-				err := part.FormatDevice(runner, "/dev/device1", "ext4", "MY_LABEL")
+				err := part.FormatDevice(runner, "/dev/device1", "ext4", "MY_LABEL", "")
 				Expect(err).To(BeNil())
 				Expect(runner.CmdsMatch([][]string{
 					{"mkfs.ext4", "-L", "MY_LABEL", "/dev/device1"},
@@ -467,6 +511,55 @@ var _ = Describe("Partitioner", Label("disk", "partition", "partitioner"), func(
 				Expect(num).To(Equal(5))
 				Expect(runner.CmdsMatch(cmds)).To(BeNil())
 			})
+			Describe("Verifying created partition sizes", Label("size-tolerance"), func() {
+				var created string
+				BeforeEach(func() {
+					created = ""
+					runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+						if cmd == "parted" && slices.Contains(args, "mkpart") {
+							// 64MiB partition rounded by the given sectors
+							created = "\n5:50331648s:50462719s:131072s:ext4::type=83;"
+						}
+						return []byte(partedPrint + created), nil
+					}
+				})
+				It("Adds a new partition with the requested size", func() {
+					num, err := dev.AddPartition(64, "ext4", "ignored")
+					Expect(err).To(BeNil())
+					Expect(num).To(Equal(5))
+				})
+				It("Adds a new partition within the size tolerance", func() {
+					num, err := dev.AddPartition(65, "ext4", "ignored")
+					Expect(err).To(BeNil())
+					Expect(num).To(Equal(5))
+				})
+				It("Fails to add a new partition smaller than requested", func() {
+					_, err := dev.AddPartition(66, "ext4", "ignored")
+					Expect(err).To(MatchError(ContainSubstring("partition 5 was created with 131072 sectors (64MiB)")))
+				})
+				It("Fails to add a new partition smaller than requested without tolerance", func() {
+					dev = part.NewDisk(
+						"/dev/device", part.WithRunner(runner), part.WithFS(fs),
+						part.WithMounter(mounter), part.WithSizeTolerance(0),
+					)
+					_, err := dev.AddPartition(65, "ext4", "ignored")
+					Expect(err).NotTo(BeNil())
+				})
+				It("Fails if the new partition is not found", func() {
+					runner.SideEffect = func(_ string, _ ...string) ([]byte, error) {
+						return []byte(partedPrint), nil
+					}
+					_, err := dev.AddPartition(64, "ext4", "ignored")
+					Expect(err).To(MatchError(ContainSubstring("partition 5 not found")))
+				})
+			})
+			It("Fails to add a typed partition on a non GPT partition table", Label("type-guid"), func() {
+				cmds = [][]string{printCmd}
+				runner.ReturnValue = []byte(partedPrint)
+				_, err := dev.AddTypedPartition(0, "ext4", "ignored", "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709")
+				Expect(err).NotTo(BeNil())
+				Expect(runner.CmdsMatch(cmds)).To(BeNil())
+			})
 			It("Fails to a new partition if there is not enough space available", func() {
 				cmds = [][]string{printCmd}
 				runner.ReturnValue = []byte(partedPrint)
@@ -79,8 +79,10 @@ func (gd gdiskCall) buildOptions() []string {
 			opts = append(opts, fmt.Sprintf("-c=%d:%s", part.Number, part.PLabel))
 		}
 
-		// Assumes any fat partition is for EFI
-		if isFat.MatchString(part.FileSystem) {
+		// Without an explicit type assumes any fat partition is for EFI
+		if part.TypeGUID != "" {
+			opts = append(opts, fmt.Sprintf("-t=%d:%s", part.Number, part.TypeGUID))
+		} else if isFat.MatchString(part.FileSystem) {
 			opts = append(opts, fmt.Sprintf("-t=%d:%s", part.Number, efiType))
 		} else if part.FileSystem != "" {
 			opts = append(opts, fmt.Sprintf("-t=%d:%s", part.Number, linuxType))
@@ -189,7 +189,7 @@ func (b *Btrfs) StartTransaction() (*types.Snapshot, error) {
 // CloseTransactionOnError is a destructor method to clean the given initated snapshot. Useful in case of an error once
 // the transaction has already started.
 func (b *Btrfs) CloseTransactionOnError(snapshot *types.Snapshot) (err error) {
-	if snapshot.InProgress {
+	if snapshot.InProgress && utils.IsMounted(b.cfg.Mounter, snapshot.MountPoint) {
 		err = b.cfg.Mounter.Unmount(snapshot.MountPoint)
 	}
 	defer func() {
@@ -227,11 +227,13 @@ func (b *Btrfs) CloseTransaction(snapshot *types.Snapshot) (err error) {
 		return err
 	}
 
-	b.cfg.Logger.Debugf("Unmount %s", snapshot.MountPoint)
-	err = b.cfg.Mounter.Unmount(snapshot.MountPoint)
-	if err != nil {
-		b.cfg.Logger.Errorf("failed umounting snapshot %d workdir bind mount", snapshot.ID)
-		return err
+	if utils.IsMounted(b.cfg.Mounter, snapshot.MountPoint) {
+		b.cfg.Logger.Debugf("Unmount %s", snapshot.MountPoint)
+		err = b.cfg.Mounter.Unmount(snapshot.MountPoint)
+		if err != nil {
+			b.cfg.Logger.Errorf("failed umounting snapshot %d workdir bind mount", snapshot.ID)
+			return err
+		}
 	}
 
 	if snapshot.ID > 1 {
@@ -298,7 +300,7 @@ func (b *Btrfs) GetSnapshots() (snapshots []int, err error) {
 	if b.activeSnapshotID > 0 {
 		// Check if snapshots subvolume is mounted
 		snapshotsSubolume := filepath.Join(b.rootDir, fmt.Sprintf(snapshotPathTmpl, b.activeSnapshotID), snapshotsPath)
-		if notMnt, _ := b.cfg.Mounter.IsLikelyNotMountPoint(snapshotsSubolume); notMnt {
+		if !utils.IsMounted(b.cfg.Mounter, snapshotsSubolume) {
 			err = b.snapshotsMount()
 			if err != nil {
 				return nil, err
@@ -322,6 +324,12 @@ func (b *Btrfs) GetSnapshots() (snapshots []int, err error) {
 	return []int{}, err
 }
 
+// ActivateSnapshot is not supported by the btrfs snapshotter, the active snapshot is only
+// set by committing a new snapshot
+func (b *Btrfs) ActivateSnapshot(id int) error {
+	return fmt.Errorf("activating snapshot %d: not supported by the %s snapshotter", id, constants.BtrfsSnapshotterType)
+}
+
 // SnapshotImageToSource converts the given snapshot into an ImageSource. This is useful to deploy a system
 // from a given snapshot, for instance setting the recovery image from a snapshot.
 func (b *Btrfs) SnapshotToImageSource(snap *types.Snapshot) (*types.ImageSource, error) {
@@ -18,6 +18,8 @@ package snapshotter
 
 import (
 	"fmt"
+	"path/filepath"
+	"strconv"
 
 	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
@@ -35,6 +37,19 @@ func NewSnapshotter(cfg types.Config, snapCfg types.SnapshotterConfig, bootloade
 	return nil, fmt.Errorf("unsupported snapshotter type: %s", snapCfg.Type)
 }
 
+// SnapshotPath returns the path of the given snapshot within the root of the state partition,
+// an image file for loop device snapshots and a subvolume for btrfs snapshots.
+func SnapshotPath(snapCfg types.SnapshotterConfig, rootDir string, id int) (string, error) {
+	switch snapCfg.Type {
+	case constants.LoopDeviceSnapshotterType:
+		return filepath.Join(rootDir, loopDeviceSnapsPath, strconv.Itoa(id), loopDeviceImgName), nil
+	case constants.BtrfsSnapshotterType:
+		return filepath.Join(rootDir, rootSubvol, fmt.Sprintf(snapshotPathTmpl, id)), nil
+	default:
+		return "", fmt.Errorf("unsupported snapshotter type: %s", snapCfg.Type)
+	}
+}
+
 func init() {
 	snapshotterFactories[constants.LoopDeviceSnapshotterType] = newLoopDeviceSnapshotter
 	snapshotterFactories[constants.BtrfsSnapshotterType] = newBtrfsSnapshotter
@@ -18,9 +18,11 @@ package snapshotter
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -29,6 +31,7 @@ import (
 
 	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
 	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
 
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
@@ -53,6 +56,8 @@ type LoopDevice struct {
 	activeSnapshotID  int
 	bootloader        types.Bootloader
 	legacyClean       bool
+	// Image of the snapshot in progress if it is deployed straight into it
+	workImg *types.Image
 }
 
 // newLoopDeviceSnapshotter creates a new loop device snapshotter vased on the given configuration and the given bootloader
@@ -156,37 +161,77 @@ func (l *LoopDevice) StartTransaction() (*types.Snapshot, error) {
 		return nil, err
 	}
 
-	workDir := filepath.Join(snapPath, loopDeviceWorkDir)
-	err = utils.MkdirAll(l.cfg.Fs, workDir, constants.DirPerm)
+	snapshot := &types.Snapshot{
+		ID:         nextID,
+		Path:       filepath.Join(snapPath, loopDeviceImgName),
+		WorkDir:    filepath.Join(snapPath, loopDeviceWorkDir),
+		MountPoint: constants.WorkingImgDir,
+		Label:      fmt.Sprintf(loopDeviceLabelPattern, nextID),
+		InProgress: true,
+	}
+
+	if l.loopDevCfg.Size > 0 {
+		err = l.startImageTransaction(snapshot)
+	} else {
+		err = l.startTreeTransaction(snapshot)
+	}
 	if err != nil {
 		_ = l.cfg.Fs.RemoveAll(snapPath)
 		return nil, err
 	}
 
-	err = utils.MkdirAll(l.cfg.Fs, constants.WorkingImgDir, constants.DirPerm)
+	l.cfg.Logger.Infof("Transaction for snapshot %d successfully started", nextID)
+	return snapshot, nil
+}
+
+// startTreeTransaction sets a work directory, bind mounted at the snapshot mountpoint, to
+// deploy the system into. The snapshot image is created from it on transaction close, so
+// its size can be computed from the deployed tree.
+func (l *LoopDevice) startTreeTransaction(snapshot *types.Snapshot) error {
+	err := utils.MkdirAll(l.cfg.Fs, snapshot.WorkDir, constants.DirPerm)
 	if err != nil {
-		_ = l.cfg.Fs.RemoveAll(snapPath)
-		return nil, err
+		return err
 	}
 
-	err = l.cfg.Mounter.Mount(workDir, constants.WorkingImgDir, "bind", []string{"bind"})
+	err = utils.MkdirAll(l.cfg.Fs, snapshot.MountPoint, constants.DirPerm)
 	if err != nil {
-		_ = l.cfg.Fs.RemoveAll(snapPath)
-		_ = l.cfg.Fs.RemoveAll(constants.WorkingImgDir)
-		return nil, err
+		return err
 	}
 
-	snapshot := &types.Snapshot{
-		ID:         nextID,
-		Path:       filepath.Join(snapPath, loopDeviceImgName),
-		WorkDir:    workDir,
-		MountPoint: constants.WorkingImgDir,
-		Label:      fmt.Sprintf(loopDeviceLabelPattern, nextID),
-		InProgress: true,
+	err = l.cfg.Mounter.Mount(snapshot.WorkDir, snapshot.MountPoint, "bind", []string{"bind"})
+	if err != nil {
+		_ = l.cfg.Fs.RemoveAll(snapshot.MountPoint)
+		return err
 	}
+	return nil
+}
 
-	l.cfg.Logger.Infof("Transaction for snapshot %d successfully started", nextID)
-	return snapshot, nil
+// startImageTransaction creates the snapshot image upfront, as its size is fixed, and mounts it
+// at the snapshot mountpoint, so the system is deployed straight into it without copying
+// it from an intermediate tree.
+func (l *LoopDevice) startImageTransaction(snapshot *types.Snapshot) error {
+	snapshot.WorkDir = snapshot.MountPoint
+	img := l.snapshotToImage(snapshot)
+
+	l.cfg.Logger.Debugf("Deploying snapshot %d straight into a %dMiB image", snapshot.ID, img.Size)
+	err := elemental.CreateFileSystemImage(l.cfg, img, "", false)
+	if err != nil {
+		l.cfg.Logger.Errorf("failed creating image for snapshot %d: %v", snapshot.ID, err)
+		return err
+	}
+
+	err = elemental.MountFileSystemImage(l.cfg, img, "rw")
+	if err != nil {
+		l.cfg.Logger.Errorf("failed mounting image for snapshot %d: %v", snapshot.ID, err)
+		return err
+	}
+	l.workImg = img
+	return nil
+}
+
+// isImageTransaction checks if the given snapshot is deployed straight into its image
+func (l *LoopDevice) isImageTransaction(snapshot *types.Snapshot) bool {
+	return l.workImg != nil && l.workImg.File == snapshot.Path
 }
 
 // CloseTransactionOnError is a destructor method to clean the given initated snapshot. Useful in case of an error once
@@ -199,7 +244,12 @@ func (l *LoopDevice) CloseTransactionOnError(snapshot *types.Snapshot) error {
 	}
 
 	if snapshot.InProgress {
-		err = l.cfg.Mounter.Unmount(snapshot.MountPoint)
+		if l.isImageTransaction(snapshot) {
+			err = elemental.UnmountFileSystemImage(l.cfg, l.workImg)
+			l.workImg = nil
+		} else if utils.IsMounted(l.cfg.Mounter, snapshot.MountPoint) {
+			err = l.cfg.Mounter.Unmount(snapshot.MountPoint)
+		}
 	}
 
 	rErr := l.cfg.Fs.RemoveAll(filepath.Dir(snapshot.Path))
@@ -222,32 +272,9 @@ func (l *LoopDevice) CloseTransactionOnError(snapshot *types.Snapshot) error {
 func (l *LoopDevice) CloseTransaction(snapshot *types.Snapshot) (err error) {
 	var linkDst, activeSnap string
 
-	defer func() {
-		if err != nil {
-			_ = l.CloseTransactionOnError(snapshot)
-		}
-	}()
-
-	if !snapshot.InProgress {
-		l.cfg.Logger.Debugf("No transaction to close for snapshot %d workdir", snapshot.ID)
-		return fmt.Errorf("given snapshot is not in progress")
-	}
-
-	l.cfg.Logger.Infof("Closing transaction for snapshot %d workdir", snapshot.ID)
-	l.cfg.Logger.Debugf("Unmount %s", snapshot.MountPoint)
-	err = l.cfg.Mounter.Unmount(snapshot.MountPoint)
-	if err != nil {
-		l.cfg.Logger.Errorf("failed umounting snapshot %d workdir bind mount", snapshot.ID)
-		return err
-	}
-
-	err = elemental.CreateImageFromTree(l.cfg, l.snapshotToImage(snapshot), snapshot.WorkDir, false)
-	if err != nil {
-		l.cfg.Logger.Errorf("failed creating image for snapshot %d: %v", snapshot.ID, err)
-		return err
-	}
+	defer func() { l.discardOnError(snapshot, err) }()
 
-	err = l.cfg.Fs.RemoveAll(snapshot.WorkDir)
+	err = l.closeTransaction(snapshot)
 	if err != nil {
 		return err
 	}
@@ -276,6 +303,92 @@ func (l *LoopDevice) CloseTransaction(snapshot *types.Snapshot) (err error) {
 	return err
 }
 
+// StageTransaction closes the transaction of the given snapshot without activating it, the
+// snapshot is only booted once it is activated with ActivateSnapshot
+func (l *LoopDevice) StageTransaction(snapshot *types.Snapshot) (err error) {
+	defer func() { l.discardOnError(snapshot, err) }()
+
+	err = l.closeTransaction(snapshot)
+	if err != nil {
+		return err
+	}
+	l.cfg.Logger.Infof("Snapshot %d staged, it is not active until activated", snapshot.ID)
+
+	snapshot.InProgress = false
+	return nil
+}
+
+// discardOnError drops the given snapshot if closing its transaction failed. An image failing
+// its verification is left for the caller to inspect, it is discarded once the caller closes
+// the transaction with CloseTransactionOnError
+func (l *LoopDevice) discardOnError(snapshot *types.Snapshot, err error) {
+	var elErr *elementalError.ElementalError
+	if err != nil && (!errors.As(err, &elErr) || elErr.ExitCode() != elementalError.VerifyImage) {
+		_ = l.CloseTransactionOnError(snapshot)
+	}
+}
+
+// closeTransaction creates the image of the given in progress snapshot
+func (l *LoopDevice) closeTransaction(snapshot *types.Snapshot) error {
+	if !snapshot.InProgress {
+		l.cfg.Logger.Debugf("No transaction to close for snapshot %d workdir", snapshot.ID)
+		return fmt.Errorf("given snapshot is not in progress")
+	}
+
+	if l.isImageTransaction(snapshot) {
+		return l.closeImageTransaction(snapshot)
+	}
+	return l.closeTreeTransaction(snapshot)
+}
+
+// closeTreeTransaction creates the snapshot image from the work directory of the given snapshot
+func (l *LoopDevice) closeTreeTransaction(snapshot *types.Snapshot) error {
+	var err error
+
+	l.cfg.Logger.Infof("Closing transaction for snapshot %d workdir", snapshot.ID)
+	if utils.IsMounted(l.cfg.Mounter, snapshot.MountPoint) {
+		l.cfg.Logger.Debugf("Unmount %s", snapshot.MountPoint)
+		err = l.cfg.Mounter.Unmount(snapshot.MountPoint)
+		if err != nil {
+			l.cfg.Logger.Errorf("failed umounting snapshot %d workdir bind mount", snapshot.ID)
+			return err
+		}
+	}
+
+	err = elemental.CreateImageFromTree(l.cfg, l.snapshotToImage(snapshot), snapshot.WorkDir, false)
+	if err != nil {
+		l.cfg.Logger.Errorf("failed creating image for snapshot %d: %v", snapshot.ID, err)
+		return err
+	}
+
+	return l.cfg.Fs.RemoveAll(snapshot.WorkDir)
+}
+
+// closeImageTransaction completes and unmounts the image the given snapshot was deployed into
+func (l *LoopDevice) closeImageTransaction(snapshot *types.Snapshot) error {
+	l.cfg.Logger.Infof("Closing transaction for snapshot %d image", snapshot.ID)
+	err := utils.CreateDirStructure(l.cfg.Fs, snapshot.MountPoint)
+	if err != nil {
+		l.cfg.Logger.Errorf("failed creating dir structure: %v", err)
+		return err
+	}
+
+	err = elemental.ApplySELinuxLabels(l.cfg, snapshot.MountPoint, nil)
+	if err != nil {
+		l.cfg.Logger.Errorf("failed SELinux labelling at %s: %v", snapshot.MountPoint, err)
+		return err
+	}
+
+	l.cfg.Logger.Debugf("Unmount %s", snapshot.MountPoint)
+	err = elemental.UnmountFileSystemImage(l.cfg, l.workImg)
+	if err != nil {
+		l.cfg.Logger.Errorf("failed umounting snapshot %d image", snapshot.ID)
+		return err
+	}
+	l.workImg = nil
+	return nil
+}
+
 // DeleteSnapshot deletes the snapshot of the given ID. It cannot delete an snapshot that is actually booted.
 func (l *LoopDevice) DeleteSnapshot(id int) error {
 	var err error
@@ -355,6 +468,37 @@ func (l *LoopDevice) GetSnapshots() ([]int, error) {
 	return ids, fmt.Errorf("cannot determine snapshots, initate snapshotter first")
 }
 
+// ActivateSnapshot sets the given existing snapshot as the active one, so it is booted by default,
+// and updates the bootloader with the resulting passive snapshots
+func (l *LoopDevice) ActivateSnapshot(id int) error {
+	ids, err := l.GetSnapshots()
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(ids, id) {
+		return fmt.Errorf("snapshot %d not found", id)
+	}
+
+	// Replace the active link atomically, the system is never left without an active snapshot
+	activeSnap := filepath.Join(l.rootDir, loopDeviceSnapsPath, constants.ActiveSnapshot)
+	tmpLink := activeSnap + ".new"
+	linkDst := fmt.Sprintf("%d/%s", id, loopDeviceImgName)
+	l.cfg.Logger.Infof("Activating snapshot %d", id)
+	_ = l.cfg.Fs.Remove(tmpLink)
+	err = l.cfg.Fs.Symlink(linkDst, tmpLink)
+	if err == nil {
+		err = l.cfg.Fs.Rename(tmpLink, activeSnap)
+	}
+	if err != nil {
+		_ = l.cfg.Fs.Remove(tmpLink)
+		l.cfg.Logger.Errorf("failed setting snapshot %d as active: %v", id, err)
+		return err
+	}
+	l.activeSnapshotID = id
+
+	return l.setBootloader()
+}
+
 // SnapshotImageToSource converts the given snapshot into an ImageSource. This is useful to deploy a system
 // from a given snapshot, for instance setting the recovery image from a snapshot.
 func (l *LoopDevice) SnapshotToImageSource(snap *types.Snapshot) (*types.ImageSource, error) {
@@ -262,6 +262,24 @@ var _ = Describe("LoopDevice", Label("snapshotter", "loopdevice"), func() {
 			Expect(lp.DeleteSnapshot(5)).NotTo(Succeed())
 		})
 
+		It("activates a passive snapshot", Label("activate"), func() {
+			Expect(lp.ActivateSnapshot(3)).To(Succeed())
+			link, err := fs.Readlink(filepath.Join(rootDir, ".snapshots", constants.ActiveSnapshot))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link).To(HaveSuffix("3/snapshot.img"))
+			Expect(bootloader.PersistentVariables).To(HaveKeyWithValue(
+				filepath.Join(efiDir, constants.GrubOEMEnv),
+				HaveKeyWithValue(constants.GrubPassiveSnapshots, "5 4 2 1"),
+			))
+		})
+
+		It("fails to activate a non existing snapshot", Label("activate"), func() {
+			Expect(lp.ActivateSnapshot(99)).To(MatchError(ContainSubstring("snapshot 99 not found")))
+			link, err := fs.Readlink(filepath.Join(rootDir, ".snapshots", constants.ActiveSnapshot))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link).To(HaveSuffix("5/snapshot.img"))
+		})
+
 		It("deletes nothing for non existing snapshots", func() {
 			Expect(lp.DeleteSnapshot(99)).To(Succeed())
 			Expect(memLog.String()).To(ContainSubstring("nothing to delete"))
@@ -277,6 +295,23 @@ var _ = Describe("LoopDevice", Label("snapshotter", "loopdevice"), func() {
 			Expect(lp.GetSnapshots()).To(Equal([]int{5, 6}))
 		})
 
+		It("stages a started transaction without activating it", func() {
+			snap, err := lp.StartTransaction()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lp.(*snapshotter.LoopDevice).StageTransaction(snap)).To(Succeed())
+			Expect(snap.InProgress).To(BeFalse())
+			Expect(lp.GetSnapshots()).To(Equal([]int{1, 2, 3, 4, 5, 6}))
+			link, err := fs.Readlink(filepath.Join(rootDir, ".snapshots", constants.ActiveSnapshot))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link).To(HaveSuffix("5/snapshot.img"))
+			Expect(bootloader.PersistentVariables).To(BeEmpty())
+
+			Expect(lp.ActivateSnapshot(6)).To(Succeed())
+			link, err = fs.Readlink(filepath.Join(rootDir, ".snapshots", constants.ActiveSnapshot))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link).To(HaveSuffix("6/snapshot.img"))
+		})
+
 		It("closes a started transaction and cleans old snapshots up to current active", func() {
 			// Snapshot 2 is the current one
 			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
@@ -322,6 +357,43 @@ var _ = Describe("LoopDevice", Label("snapshotter", "loopdevice"), func() {
 			Expect(lp.GetSnapshots()).To(Equal([]int{1, 2, 3, 4, 5}))
 		})
 
+		It("deploys a snapshot straight into a fixed size image", Label("direct-image"), func() {
+			snapCfg.Config = &types.LoopDeviceConfig{Size: 64, FS: constants.LinuxImgFs}
+			lp, err = snapshotter.NewSnapshotter(cfg, snapCfg, bootloader)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lp.InitSnapshotter(statePart, efiDir)).To(Succeed())
+
+			snap, err := lp.StartTransaction()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(snap.ID).To(Equal(6))
+			Expect(snap.WorkDir).To(Equal(constants.WorkingImgDir))
+			Expect(utils.Exists(fs, snap.Path)).To(BeTrue())
+			Expect(utils.Exists(fs, filepath.Join(rootDir, ".snapshots/6/snapshot.workDir"))).To(BeFalse())
+			Expect(runner.MatchMilestones([][]string{
+				{"mkfs.ext2", "-L", "EL_SNAP6", snap.Path},
+				{"losetup", "--show", "-f", snap.Path},
+			})).To(Succeed())
+
+			runner.ClearCmds()
+			Expect(lp.CloseTransaction(snap)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"rsync"}})).NotTo(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"losetup", "-d"}})).To(Succeed())
+			Expect(lp.GetSnapshots()).To(Equal([]int{5, 6}))
+		})
+
+		It("drops a snapshot deployed into a fixed size image on error", Label("direct-image"), func() {
+			snapCfg.Config = &types.LoopDeviceConfig{Size: 64, FS: constants.LinuxImgFs}
+			lp, err = snapshotter.NewSnapshotter(cfg, snapCfg, bootloader)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lp.InitSnapshotter(statePart, efiDir)).To(Succeed())
+
+			snap, err := lp.StartTransaction()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lp.CloseTransactionOnError(snap)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"losetup", "-d"}})).To(Succeed())
+			Expect(utils.Exists(fs, snap.Path)).To(BeFalse())
+		})
+
 		It("fails closing a transaction, can't create image from tree", func() {
 			Expect(lp.GetSnapshots()).To(Equal([]int{1, 2, 3, 4, 5}))
 			snap, err := lp.StartTransaction()
@@ -334,5 +406,31 @@ var _ = Describe("LoopDevice", Label("snapshotter", "loopdevice"), func() {
 			Expect(lp.CloseTransaction(snap)).NotTo(Succeed())
 			Expect(lp.GetSnapshots()).To(Equal([]int{1, 2, 3, 4, 5}))
 		})
+
+		It("keeps the image failing its verification until the transaction is closed on error", func() {
+			cfg.MaxImageCopyRetries = 1
+			snapCfg.Config.(*types.LoopDeviceConfig).Size = 0
+			lp, err = snapshotter.NewSnapshotter(cfg, snapCfg, bootloader)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lp.InitSnapshotter(statePart, efiDir)).To(Succeed())
+
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				switch {
+				case cmd == "losetup":
+					return []byte(".snapshots/5/snapshot.img"), nil
+				case cmd == "rsync" && args[0] == "--dry-run":
+					return []byte(">f..t...... etc/os-release\n"), nil
+				}
+				return []byte(""), nil
+			}
+			snap, err := lp.StartTransaction()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(lp.CloseTransaction(snap)).To(MatchError(ContainSubstring("do not match")))
+			Expect(utils.Exists(fs, snap.Path)).To(BeTrue())
+			Expect(lp.CloseTransactionOnError(snap)).To(Succeed())
+			Expect(utils.Exists(fs, snap.Path)).To(BeFalse())
+			Expect(lp.GetSnapshots()).To(Equal([]int{1, 2, 3, 4, 5}))
+		})
 	})
 })
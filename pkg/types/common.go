@@ -20,7 +20,10 @@ import (
 	"fmt"
 	"net/url"
 	"path/filepath"
+	"strings"
+	"sync"
 
+	"github.com/mitchellh/mapstructure"
 	"gopkg.in/yaml.v3"
 
 	"github.com/distribution/distribution/reference"
@@ -33,11 +36,95 @@ const (
 	dir    = "dir"
 )
 
+// URI schemes of the built-in image source handlers
+const (
+	OCIScheme  = oci
+	DirScheme  = dir
+	FileScheme = file
+)
+
+// SyncFunc copies the src tree into dst, except the given excludes
+type SyncFunc func(l Logger, r Runner, fs FS, src string, dst string, excl ...string) error
+
+// SourceHandler dumps the given image source into the target directory, trees are copied
+// with the given sync function. All image sources are dumped by the handler registered for
+// their scheme, the returned digest is optional.
+type SourceHandler func(c Config, src *ImageSource, target string, sync SyncFunc) (digest string, err error)
+
+var (
+	sourceHandlers   = map[string]SourceHandler{}
+	sourceHandlersMu sync.RWMutex
+)
+
+// isBuiltinScheme returns true for the schemes handled by the toolkit itself
+func isBuiltinScheme(scheme string) bool {
+	switch scheme {
+	case oci, dir, file:
+		return true
+	}
+	return false
+}
+
+// RegisterSourceHandler registers a handler for image sources using the given URI scheme.
+// Handlers of built-in schemes are registered by the elemental package and can't be
+// overwritten.
+func RegisterSourceHandler(scheme string, handler SourceHandler) error {
+	if scheme == "" || scheme == docker {
+		return fmt.Errorf("can't register a source handler for the reserved scheme '%s'", scheme)
+	}
+	if handler == nil {
+		return fmt.Errorf("undefined source handler for scheme '%s'", scheme)
+	}
+
+	sourceHandlersMu.Lock()
+	defer sourceHandlersMu.Unlock()
+	if _, ok := sourceHandlers[scheme]; ok && isBuiltinScheme(scheme) {
+		return fmt.Errorf("can't overwrite the source handler of the built-in scheme '%s'", scheme)
+	}
+	sourceHandlers[scheme] = handler
+	return nil
+}
+
+// UnregisterSourceHandler removes the source handler registered for the given scheme, if any.
+// Handlers of built-in schemes are never removed.
+func UnregisterSourceHandler(scheme string) {
+	if isBuiltinScheme(scheme) {
+		return
+	}
+	sourceHandlersMu.Lock()
+	defer sourceHandlersMu.Unlock()
+	delete(sourceHandlers, scheme)
+}
+
+// GetSourceHandler returns the source handler registered for the given scheme, nil if none
+func GetSourceHandler(scheme string) SourceHandler {
+	sourceHandlersMu.RLock()
+	defer sourceHandlersMu.RUnlock()
+	return sourceHandlers[scheme]
+}
+
 // ImageSource represents the source from where an image is created for easy identification
 type ImageSource struct {
 	source  string
 	srcType string
 	digest  string
+	auth    *RegistryAuth
+}
+
+// imageSourceSpec is the map form of an ImageSource, including registry credentials
+type imageSourceSpec struct {
+	URI  string        `yaml:"uri" mapstructure:"uri"`
+	Auth *RegistryAuth `yaml:"auth,omitempty" mapstructure:"auth"`
+}
+
+// SetAuth sets the credentials to pull the image source from its registry
+func (i *ImageSource) SetAuth(auth *RegistryAuth) {
+	i.auth = auth
+}
+
+// GetAuth returns the credentials to pull the image source, nil if none
+func (i ImageSource) GetAuth() *RegistryAuth {
+	return i.auth
 }
 
 func (i *ImageSource) SetDigest(digest string) {
@@ -64,6 +151,20 @@ func (i ImageSource) IsFile() bool {
 	return i.srcType == file
 }
 
+// IsCustom returns true if the source type is handled by a registered SourceHandler other
+// than the built-in ones
+func (i ImageSource) IsCustom() bool {
+	if i.srcType == "" || isBuiltinScheme(i.srcType) {
+		return false
+	}
+	return GetSourceHandler(i.srcType) != nil
+}
+
+// Scheme returns the URI scheme of the source type
+func (i ImageSource) Scheme() string {
+	return i.srcType
+}
+
 func (i ImageSource) IsEmpty() bool {
 	if i.srcType == "" {
 		return true
@@ -86,21 +187,55 @@ func (i ImageSource) MarshalYAML() (interface{}, error) {
 }
 
 func (i *ImageSource) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.MappingNode {
+		spec := imageSourceSpec{}
+		if err := value.Decode(&spec); err != nil {
+			return err
+		}
+		if spec.Auth != nil {
+			if err := spec.Auth.Sanitize(); err != nil {
+				return err
+			}
+		}
+		i.auth = spec.Auth
+		return i.updateFromURI(spec.URI)
+	}
 	return i.updateFromURI(value.Value)
 }
 
+// CustomUnmarshal sets the ImageSource from an URI string or from a map including
+// the 'uri' and the registry credentials under 'auth' keys.
 func (i *ImageSource) CustomUnmarshal(data interface{}) (bool, error) {
-	src, ok := data.(string)
-	if !ok {
-		return false, fmt.Errorf("can't unmarshal %+v to an ImageSource type", data)
+	if src, ok := data.(string); ok {
+		return false, i.updateFromURI(src)
 	}
-	err := i.updateFromURI(src)
-	return false, err
+	if _, ok := data.(map[string]interface{}); ok {
+		spec := imageSourceSpec{}
+		if err := mapstructure.Decode(data, &spec); err != nil {
+			return false, err
+		}
+		if spec.Auth != nil {
+			if err := spec.Auth.Sanitize(); err != nil {
+				return false, err
+			}
+		}
+		i.auth = spec.Auth
+		return false, i.updateFromURI(spec.URI)
+	}
+	return false, fmt.Errorf("can't unmarshal %+v to an ImageSource type", data)
 }
 
 func (i *ImageSource) updateFromURI(uri string) error {
+	// Image references are not parsed as URLs, digests would be taken as ports
+	if scheme, value, ok := strings.Cut(uri, ":"); ok && (scheme == oci || scheme == docker) {
+		return i.parseImageReference(strings.TrimPrefix(value, "//"))
+	}
 	u, err := url.Parse(uri)
 	if err != nil {
+		// Plain image references pinned by digest, such as 'image@sha256:...', are not valid URLs
+		if refErr := i.parseImageReference(uri); refErr == nil {
+			return nil
+		}
 		return err
 	}
 	scheme := u.Scheme
@@ -109,8 +244,6 @@ func (i *ImageSource) updateFromURI(uri string) error {
 		value = filepath.Join(u.Host, u.Path)
 	}
 	switch scheme {
-	case oci, docker:
-		return i.parseImageReference(value)
 	case dir:
 		i.srcType = dir
 		i.source = value
@@ -118,6 +251,11 @@ func (i *ImageSource) updateFromURI(uri string) error {
 		i.srcType = file
 		i.source = value
 	default:
+		if GetSourceHandler(scheme) != nil {
+			i.srcType = scheme
+			i.source = value
+			return nil
+		}
 		return i.parseImageReference(uri)
 	}
 	return nil
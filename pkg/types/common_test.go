@@ -19,6 +19,8 @@ package types_test
 import (
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v4/vfst"
+	"gopkg.in/yaml.v3"
 
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 )
@@ -79,6 +81,29 @@ var _ = Describe("Types", Label("types", "common"), func() {
 			Expect(o.IsImage()).To(BeTrue())
 			Expect(o.Value()).To(Equal("registry.company.org/my/image:tag"))
 		})
+		It("unmarshals image references pinned by digest", Label("digest"), func() {
+			digest := "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+			for uri, value := range map[string]string{
+				"docker://alpine@" + digest:                    "alpine@" + digest,
+				"docker:alpine@" + digest:                      "alpine@" + digest,
+				"alpine@" + digest:                             "alpine@" + digest,
+				"oci://registry.company.org/image@" + digest:   "registry.company.org/image@" + digest,
+				"registry.company.org:5000/image:v1@" + digest: "registry.company.org:5000/image:v1@" + digest,
+			} {
+				o, err := types.NewSrcFromURI(uri)
+				Expect(err).ShouldNot(HaveOccurred(), uri)
+				Expect(o.IsImage()).To(BeTrue())
+				Expect(o.Value()).To(Equal(value))
+
+				// The URI recorded in the state file is parsed back to the same source
+				parsed, err := types.NewSrcFromURI(o.String())
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(parsed.Value()).To(Equal(value))
+			}
+
+			_, err := types.NewSrcFromURI("alpine@sha256:tooshort")
+			Expect(err).Should(HaveOccurred())
+		})
 		It("convertion to string URI works are expected", func() {
 			o := types.NewDirSrc("/some/dir")
 			Expect(o.IsDir()).To(BeTrue())
@@ -102,6 +127,69 @@ var _ = Describe("Types", Label("types", "common"), func() {
 			_, err := o.CustomUnmarshal(map[string]string{})
 			Expect(err).Should(HaveOccurred())
 		})
+		It("unmarshals image sources including registry credentials", Label("auth"), func() {
+			o := types.NewEmptySrc()
+			_, err := o.CustomUnmarshal(map[string]interface{}{
+				"uri":  "oci:registry.company.org/private/image:v1",
+				"auth": map[string]interface{}{"username": "user", "password": "secret"},
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(o.Value()).To(Equal("registry.company.org/private/image:v1"))
+			Expect(o.GetAuth()).To(Equal(&types.RegistryAuth{Username: "user", Password: "secret"}))
+
+			o = types.NewEmptySrc()
+			data := "uri: oci:registry.company.org/private/image:v1\nauth:\n  token: secret\n"
+			Expect(yaml.Unmarshal([]byte(data), o)).To(Succeed())
+			Expect(o.GetAuth().Token).To(Equal("secret"))
+		})
+		It("fails on redacted registry credentials", Label("auth"), func() {
+			o := types.NewEmptySrc()
+			_, err := o.CustomUnmarshal(map[string]interface{}{
+				"uri":  "oci:registry.company.org/private/image:v1",
+				"auth": map[string]interface{}{"username": "user", "password": "<redacted>"},
+			})
+			Expect(err).To(MatchError(ContainSubstring("registry credentials of user 'user' are redacted")))
+
+			data := "uri: oci:registry.company.org/private/image:v1\nauth:\n  token: <redacted>\n"
+			Expect(yaml.Unmarshal([]byte(data), o)).To(MatchError(ContainSubstring("are redacted")))
+		})
+		It("renders registry credentials as a docker config", Label("auth"), func() {
+			fs, cleanup, err := vfst.NewTestFS(map[string]interface{}{"/root/.docker/config.json": `{"auths":{}}`})
+			Expect(err).ShouldNot(HaveOccurred())
+			defer cleanup()
+
+			auth := types.RegistryAuth{Username: "user", Password: "secret"}
+			data, err := auth.DockerConfigJSON(fs, "registry.company.org/private/image:v1")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(data)).To(Equal(`{"auths":{"registry.company.org":{"auth":"dXNlcjpzZWNyZXQ="}}}`))
+
+			auth = types.RegistryAuth{Token: "token"}
+			data, err = auth.DockerConfigJSON(fs, "alpine:3.20")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(data)).To(Equal(`{"auths":{"https://index.docker.io/v1/":{"registrytoken":"token"}}}`))
+
+			// Docker config files are read from the given filesystem
+			auth = types.RegistryAuth{DockerConfig: "/root/.docker/config.json"}
+			data, err = auth.DockerConfigJSON(fs, "alpine:3.20")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(data)).To(Equal(`{"auths":{}}`))
+		})
+		It("redacts registry credentials", Label("auth"), func() {
+			auth := types.RegistryAuth{Username: "user", Password: "secret", Token: "token"}
+			Expect(auth.String()).NotTo(ContainSubstring("secret"))
+			Expect(auth.String()).To(ContainSubstring("user"))
+			data, err := yaml.Marshal(auth)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(data)).NotTo(ContainSubstring("secret"))
+			Expect(string(data)).NotTo(ContainSubstring("token: token"))
+			Expect(auth.Password).To(Equal("secret"))
+
+			o := types.NewDockerSrc("registry.company.org/private/image:v1")
+			o.SetAuth(&auth)
+			data, err = yaml.Marshal(o)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(data)).To(Equal("oci://registry.company.org/private/image:v1\n"))
+		})
 		It("fails to unmarshal unknown scheme and invalid image reference", func() {
 			o := types.NewEmptySrc()
 			_, err := o.CustomUnmarshal("scheme://some.uri.org")
@@ -112,6 +200,34 @@ var _ = Describe("Types", Label("types", "common"), func() {
 			_, err := o.CustomUnmarshal("jp#afs://insanity")
 			Expect(err).Should(HaveOccurred())
 		})
+		It("unmarshals sources with a registered custom scheme", func() {
+			handler := func(_ types.Config, _ *types.ImageSource, _ string, _ types.SyncFunc) (string, error) { return "", nil }
+			Expect(types.RegisterSourceHandler("artifacts", handler)).To(Succeed())
+			DeferCleanup(types.UnregisterSourceHandler, "artifacts")
+			o := types.NewEmptySrc()
+			_, err := o.CustomUnmarshal("artifacts://store.local/some/artifact")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(o.IsCustom()).To(BeTrue())
+			Expect(o.IsImage()).To(BeFalse())
+			Expect(o.Scheme()).To(Equal("artifacts"))
+			Expect(o.Value()).To(Equal("store.local/some/artifact"))
+			Expect(o.String()).To(Equal("artifacts://store.local/some/artifact"))
+		})
+		It("fails to register a source handler for reserved schemes", func() {
+			handler := func(_ types.Config, _ *types.ImageSource, _ string, _ types.SyncFunc) (string, error) { return "", nil }
+			Expect(types.RegisterSourceHandler("docker", handler)).NotTo(Succeed())
+			Expect(types.RegisterSourceHandler("", handler)).NotTo(Succeed())
+			Expect(types.RegisterSourceHandler("someother", nil)).NotTo(Succeed())
+		})
+		It("unregisters a source handler", func() {
+			handler := func(_ types.Config, _ *types.ImageSource, _ string, _ types.SyncFunc) (string, error) { return "", nil }
+			Expect(types.RegisterSourceHandler("artifacts", handler)).To(Succeed())
+			Expect(types.GetSourceHandler("artifacts")).NotTo(BeNil())
+			types.UnregisterSourceHandler("artifacts")
+			Expect(types.GetSourceHandler("artifacts")).To(BeNil())
+			_, err := types.NewSrcFromURI("artifacts://store.local/some/artifact")
+			Expect(err).Should(HaveOccurred())
+		})
 	})
 
 })
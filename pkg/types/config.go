@@ -17,19 +17,38 @@ limitations under the License.
 package types
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
 	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	efi "github.com/canonical/go-efilib"
+	"github.com/docker/go-units"
+	"github.com/hashicorp/go-multierror"
 	"gopkg.in/yaml.v3"
 
+	"github.com/rancher/elemental-toolkit/v2/pkg/atomicfile"
 	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
 )
 
+var (
+	userNameRegexp  = regexp.MustCompile(`^[a-z_][a-z0-9_-]*\$?$`)
+	cryptHashRegexp = regexp.MustCompile(`^\$[0-9a-z]+\$[./0-9A-Za-z$=,]+$`)
+	grubHashRegexp  = regexp.MustCompile(`^grub\.pbkdf2\.sha512\.[0-9]+\.[0-9A-F]+\.[0-9A-F]+$`)
+	fsUUIDRegexp    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	fatVolIDRegexp  = regexp.MustCompile(`^[0-9a-fA-F]{4}-[0-9a-fA-F]{4}$`)
+)
+
 const (
 	GPT   = "gpt"
 	BIOS  = "bios"
@@ -43,25 +62,90 @@ const (
 // Config is the struct that includes basic and generic configuration of elemental binary runtime.
 // It mostly includes the interfaces used around many methods in elemental code
 type Config struct {
-	Logger                    Logger
-	Fs                        FS
-	Mounter                   Mounter
-	Runner                    Runner
-	Syscall                   SyscallInterface
-	CloudInitRunner           CloudInitRunner
-	ImageExtractor            ImageExtractor
-	Client                    HTTPClient
-	Platform                  *Platform `yaml:"platform,omitempty" mapstructure:"platform"`
-	Cosign                    bool      `yaml:"cosign,omitempty" mapstructure:"cosign"`
-	Verify                    bool      `yaml:"verify,omitempty" mapstructure:"verify"`
-	TLSVerify                 bool      `yaml:"tls-verify,omitempty" mapstructure:"tls-verify"`
-	CosignPubKey              string    `yaml:"cosign-key,omitempty" mapstructure:"cosign-key"`
-	LocalImage                bool      `yaml:"local,omitempty" mapstructure:"local"`
-	Arch                      string    `yaml:"arch,omitempty" mapstructure:"arch"`
-	SquashFsCompressionConfig []string  `yaml:"squash-compression,omitempty" mapstructure:"squash-compression"`
-	SquashFsNoCompression     bool      `yaml:"squash-no-compression,omitempty" mapstructure:"squash-no-compression"`
-	CloudInitPaths            []string  `yaml:"cloud-init-paths,omitempty" mapstructure:"cloud-init-paths"`
-	Strict                    bool      `yaml:"strict,omitempty" mapstructure:"strict"`
+	Logger                    Logger              `yaml:"-"`
+	Fs                        FS                  `yaml:"-"`
+	Mounter                   Mounter             `yaml:"-"`
+	Runner                    Runner              `yaml:"-"`
+	Syscall                   SyscallInterface    `yaml:"-"`
+	CloudInitRunner           CloudInitRunner     `yaml:"-"`
+	ImageExtractor            ImageExtractor      `yaml:"-"`
+	Client                    HTTPClient          `yaml:"-"`
+	Platform                  *Platform           `yaml:"platform,omitempty" mapstructure:"platform"`
+	Cosign                    bool                `yaml:"cosign,omitempty" mapstructure:"cosign"`
+	Verify                    bool                `yaml:"verify,omitempty" mapstructure:"verify"`
+	TLSVerify                 bool                `yaml:"tls-verify,omitempty" mapstructure:"tls-verify"`
+	CosignPubKey              string              `yaml:"cosign-key,omitempty" mapstructure:"cosign-key"`
+	LocalImage                bool                `yaml:"local,omitempty" mapstructure:"local"`
+	Arch                      string              `yaml:"arch,omitempty" mapstructure:"arch"`
+	SquashFsCompressionConfig []string            `yaml:"squash-compression,omitempty" mapstructure:"squash-compression"`
+	SquashFsNoCompression     bool                `yaml:"squash-no-compression,omitempty" mapstructure:"squash-no-compression"`
+	CloudInitPaths            []string            `yaml:"cloud-init-paths,omitempty" mapstructure:"cloud-init-paths"`
+	Strict                    bool                `yaml:"strict,omitempty" mapstructure:"strict"`
+	StageConcurrency          map[string]string   `yaml:"stage-concurrency,omitempty" mapstructure:"stage-concurrency"`
+	RegistryMirror            string              `yaml:"registry-mirror,omitempty" mapstructure:"registry-mirror"`
+	KernelPattern             string              `yaml:"kernel-pattern,omitempty" mapstructure:"kernel-pattern"`
+	InitrdPattern             string              `yaml:"initrd-pattern,omitempty" mapstructure:"initrd-pattern"`
+	FailOnUnknownKeys         bool                `yaml:"fail-on-unknown-keys,omitempty" mapstructure:"fail-on-unknown-keys"`
+	MkfsArgs                  map[string][]string `yaml:"mkfs-args,omitempty" mapstructure:"mkfs-args"`
+	ImageSizePolicy           SizePolicy          `yaml:"image-size-policy,omitempty" mapstructure:"image-size-policy"`
+	MaxImageCopyRetries       int                 `yaml:"max-image-copy-retries,omitempty" mapstructure:"max-image-copy-retries"`
+	CompressionLevel          map[string]int      `yaml:"compression-level,omitempty" mapstructure:"compression-level"`
+	GrubTheme                 string              `yaml:"grub-theme,omitempty" mapstructure:"grub-theme"`
+	GrubTemplate              string              `yaml:"grub-template,omitempty" mapstructure:"grub-template"`
+	StripCmdlineKeys          []string            `yaml:"strip-cmdline-keys,omitempty" mapstructure:"strip-cmdline-keys"`
+	ChecksumAlgo              string              `yaml:"checksum-algorithm,omitempty" mapstructure:"checksum-algorithm"`
+	SecureConfigPerms         bool                `yaml:"secure-config-perms,omitempty" mapstructure:"secure-config-perms"`
+	OnVerifyFailure           string              `yaml:"on-verify-failure,omitempty" mapstructure:"on-verify-failure"`
+	DefaultBootTarget         string              `yaml:"default-boot-target,omitempty" mapstructure:"default-boot-target"`
+	Bootloader                string              `yaml:"bootloader,omitempty" mapstructure:"bootloader"`
+	KernelInstallPath         string              `yaml:"kernel-install-path,omitempty" mapstructure:"kernel-install-path"`
+	HTTPHeaders               HTTPHeaderScopes    `yaml:"http-headers,omitempty" mapstructure:"http-headers"`
+	RemovableEFI              bool                `yaml:"removable-efi,omitempty" mapstructure:"removable-efi"`
+	SparseImages              bool                `yaml:"sparse-images,omitempty" mapstructure:"sparse-images"`
+	PartitionSizeTolerance    uint                `yaml:"partition-size-tolerance,omitempty" mapstructure:"partition-size-tolerance"`
+	PartitionSelection        PartitionSelection  `yaml:"partition-selection,omitempty" mapstructure:"partition-selection"`
+	DownloadDir               string              `yaml:"download-dir,omitempty" mapstructure:"download-dir"`
+}
+
+// ConfigFilePerm returns the permissions of written configuration files, which might include
+// secrets, such as cloud-config files. They are only readable by the owner with SecureConfigPerms.
+func (c Config) ConfigFilePerm() os.FileMode {
+	if c.SecureConfigPerms {
+		return constants.SecureFilePerm
+	}
+	return constants.FilePerm
+}
+
+// ConfigDirPerm returns the permissions of the directories including configuration files
+func (c Config) ConfigDirPerm() os.FileMode {
+	if c.SecureConfigPerms {
+		return constants.SecureDirPerm
+	}
+	return constants.DirPerm
+}
+
+// squashFsCompressor returns the squashfs compressor set in the compression options
+func (c Config) squashFsCompressor() string {
+	// Options may be given together in the same string, i.e. "-comp xz"
+	opts := strings.Fields(strings.Join(c.SquashFsCompressionConfig, " "))
+	for i, opt := range opts {
+		if opt == "-comp" && i+1 < len(opts) {
+			return opts[i+1]
+		}
+	}
+	return "gzip"
+}
+
+// ForArtifact returns a copy of the configuration to create the given artifact type, its
+// squashfs compression options include the compression level configured for it, if any
+func (c Config) ForArtifact(artifact string) Config {
+	level, ok := c.CompressionLevel[artifact]
+	if !ok || c.SquashFsNoCompression {
+		return c
+	}
+	opts := append([]string{}, c.SquashFsCompressionConfig...)
+	c.SquashFsCompressionConfig = append(opts, "-Xcompression-level", strconv.Itoa(level))
+	return c
 }
 
 // WriteInstallState writes the state.yaml file to the given state and recovery paths
@@ -75,7 +159,7 @@ func (c Config) WriteInstallState(i *InstallState, statePath, recoveryPath strin
 	data = append([]byte("# Autogenerated file by elemental client, do not edit\n\n"), data...)
 
 	if statePath != "" {
-		err = c.Fs.WriteFile(statePath, data, constants.FilePerm)
+		err = atomicfile.WriteFile(c.Fs, statePath, data, constants.FilePerm)
 		if err != nil {
 			c.Logger.Errorf("failed state file in state partition: %v", err)
 			return err
@@ -83,7 +167,7 @@ func (c Config) WriteInstallState(i *InstallState, statePath, recoveryPath strin
 	}
 
 	if recoveryPath != "" {
-		err = c.Fs.WriteFile(recoveryPath, data, constants.FilePerm)
+		err = atomicfile.WriteFile(c.Fs, recoveryPath, data, constants.FilePerm)
 		if err != nil {
 			c.Logger.Errorf("failed state file in recovery partition: %v", err)
 			return err
@@ -93,6 +177,37 @@ func (c Config) WriteInstallState(i *InstallState, statePath, recoveryPath strin
 	return nil
 }
 
+// AppendUpgradeHistory appends the given record to the JSON upgrade history file,
+// the file is created if it does not exist
+func (c Config) AppendUpgradeHistory(path string, record UpgradeRecord) error {
+	history, err := c.LoadUpgradeHistory(path)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(append(history, record), "", "  ")
+	if err != nil {
+		c.Logger.Errorf("failed marshalling upgrade history: %v", err)
+		return err
+	}
+	return atomicfile.WriteFile(c.Fs, path, data, constants.FilePerm)
+}
+
+// LoadUpgradeHistory loads the JSON upgrade history file. A missing file is an empty history.
+func (c Config) LoadUpgradeHistory(path string) ([]UpgradeRecord, error) {
+	history := []UpgradeRecord{}
+	data, err := c.Fs.ReadFile(path)
+	if os.IsNotExist(err) {
+		return history, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &history)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing upgrade history %s: %w", path, err)
+	}
+	return history, nil
+}
+
 // LoadInstallState loads the state.yaml file and unmarshals it to an InstallState object
 func (c Config) LoadInstallState() (*InstallState, error) {
 	installState := &InstallState{
@@ -167,14 +282,155 @@ func (c *Config) Sanitize() error {
 		c.Platform = p
 	}
 
+	for _, pattern := range []string{c.KernelPattern, c.InitrdPattern} {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid kernel or initrd pattern '%s': %w", pattern, err)
+		}
+	}
+
+	if err := c.HTTPHeaders.Sanitize(); err != nil {
+		return err
+	}
+	if err := c.PartitionSelection.Sanitize(); err != nil {
+		return err
+	}
+	if c.DownloadDir != "" && !filepath.IsAbs(c.DownloadDir) {
+		return fmt.Errorf("download-dir must be an absolute path, got '%s'", c.DownloadDir)
+	}
+	if c.Client != nil {
+		c.Client.SetHeaders(c.HTTPHeaders)
+	}
+
+	if c.ImageSizePolicy.RoundTo == 0 {
+		c.ImageSizePolicy.RoundTo = 1
+	}
+
+	if c.MaxImageCopyRetries < 0 {
+		return fmt.Errorf("max-image-copy-retries can't be negative")
+	}
+
+	if c.ChecksumAlgo == "" {
+		c.ChecksumAlgo = constants.SHA256
+	}
+	if !slices.Contains(constants.GetChecksumAlgorithms(), c.ChecksumAlgo) {
+		return fmt.Errorf(
+			"unsupported checksum algorithm '%s', supported algorithms are %s",
+			c.ChecksumAlgo, strings.Join(constants.GetChecksumAlgorithms(), ", "),
+		)
+	}
+
+	if c.OnVerifyFailure == "" {
+		c.OnVerifyFailure = constants.VerifyDelete
+	}
+	if !slices.Contains(constants.GetVerifyFailurePolicies(), c.OnVerifyFailure) {
+		return fmt.Errorf(
+			"unknown verification failure policy '%s', supported policies are %s",
+			c.OnVerifyFailure, strings.Join(constants.GetVerifyFailurePolicies(), ", "),
+		)
+	}
+
+	if c.DefaultBootTarget != "" &&
+		(!strings.HasSuffix(c.DefaultBootTarget, ".target") || strings.Contains(c.DefaultBootTarget, "/")) {
+		return fmt.Errorf("invalid default boot target '%s', it must be a systemd target unit name", c.DefaultBootTarget)
+	}
+
+	for stage, mode := range c.StageConcurrency {
+		if !slices.Contains(constants.GetStageConcurrencyModes(), mode) {
+			return fmt.Errorf(
+				"unknown concurrency mode '%s' for stage '%s', supported modes are %s",
+				mode, stage, strings.Join(constants.GetStageConcurrencyModes(), ", "),
+			)
+		}
+	}
+
+	if c.Bootloader == "" {
+		c.Bootloader = constants.BootloaderGrub
+	}
+	if !slices.Contains(constants.GetBootloaders(), c.Bootloader) {
+		return fmt.Errorf(
+			"unknown bootloader '%s', supported bootloaders are %s",
+			c.Bootloader, strings.Join(constants.GetBootloaders(), ", "),
+		)
+	}
+	if c.Bootloader == constants.BootloaderNone && c.KernelInstallPath == "" {
+		return fmt.Errorf("kernel-install-path is required when the bootloader is '%s'", constants.BootloaderNone)
+	}
+
+	if len(c.CompressionLevel) > 0 && !c.SquashFsNoCompression {
+		comp := c.squashFsCompressor()
+		levels, ok := constants.GetSquashfsCompressionLevels()[comp]
+		if !ok {
+			return fmt.Errorf("squashfs compressor '%s' does not support compression levels", comp)
+		}
+		for artifact, level := range c.CompressionLevel {
+			if !slices.Contains(constants.GetCompressionArtifacts(), artifact) {
+				return fmt.Errorf("compression level for unknown artifact '%s'", artifact)
+			}
+			if level < levels[0] || level > levels[1] {
+				return fmt.Errorf("compression level %d for %s is out of the %s range %d-%d", level, artifact, comp, levels[0], levels[1])
+			}
+		}
+	}
+
+	reserved := constants.GetMkfsReservedFlags()
+	for fs, args := range c.MkfsArgs {
+		flags, ok := reserved[fs]
+		if !ok {
+			return fmt.Errorf("mkfs arguments for unsupported filesystem '%s'", fs)
+		}
+		for _, arg := range args {
+			for _, flag := range flags {
+				if isReservedMkfsArg(arg, flag) {
+					return fmt.Errorf("mkfs argument '%s' for %s is reserved by the toolkit", arg, fs)
+				}
+			}
+		}
+	}
+
 	return nil
 }
 
+// isReservedMkfsArg checks if the given mkfs argument sets the given reserved flag. Flags
+// ending with '=' are suboptions, such as xfs '-m uuid=<uuid>', which are looked up within
+// the comma separated list of the argument
+func isReservedMkfsArg(arg, flag string) bool {
+	if strings.HasSuffix(flag, "=") {
+		for _, opt := range strings.Split(arg, ",") {
+			if strings.HasPrefix(opt, flag) {
+				return true
+			}
+		}
+		return false
+	}
+	return arg == flag || strings.HasPrefix(arg, flag+"=")
+}
+
+// SizePolicy defines how images are sized from the size of their source tree. The source size
+// is increased by the headroom percentage and the overhead, rounded up to a multiple of RoundTo
+// and raised to MinSize if below it. All sizes are in MiB.
+type SizePolicy struct {
+	Headroom uint `yaml:"headroom,omitempty" mapstructure:"headroom"`
+	Overhead uint `yaml:"overhead,omitempty" mapstructure:"overhead"`
+	RoundTo  uint `yaml:"round-to,omitempty" mapstructure:"round-to"`
+	MinSize  uint `yaml:"min-size,omitempty" mapstructure:"min-size"`
+}
+
 type RunConfig struct {
 	Reboot      bool              `yaml:"reboot,omitempty" mapstructure:"reboot"`
 	PowerOff    bool              `yaml:"poweroff,omitempty" mapstructure:"poweroff"`
 	EjectCD     bool              `yaml:"eject-cd,omitempty" mapstructure:"eject-cd"`
 	Snapshotter SnapshotterConfig `yaml:"snapshotter,omitempty" mapstructure:"snapshotter"`
+	// Seconds to wait before the final reboot or power off and message broadcasted before it
+	RebootDelay   int    `yaml:"reboot-delay,omitempty" mapstructure:"reboot-delay"`
+	RebootMessage string `yaml:"reboot-message,omitempty" mapstructure:"reboot-message"`
+	// Cache paths, relative to the persistent partition, pruned on upgrades if there is not
+	// enough free space in the persistent partition
+	PrunePersistentOnUpgrade bool     `yaml:"prune-persistent-on-upgrade,omitempty" mapstructure:"prune-persistent-on-upgrade"`
+	PersistentCachePaths     []string `yaml:"persistent-cache-paths,omitempty" mapstructure:"persistent-cache-paths"`
+	// Endpoint receiving a JSON event on completion of install, upgrade and reset actions
+	WebhookURL string `yaml:"webhook-url,omitempty" mapstructure:"webhook-url"`
+	// Prometheus textfile updated with the outcome of install, upgrade and reset actions
+	MetricsFile string `yaml:"metrics-file,omitempty" mapstructure:"metrics-file"`
 
 	// 'inline' and 'squash' labels ensure config fields
 	// are embedded from a yaml and map PoV
@@ -186,6 +442,29 @@ type RunConfig struct {
 func (r *RunConfig) Sanitize() error {
 	// Always include default cloud-init paths
 	r.CloudInitPaths = append(constants.GetCloudInitPaths(), r.CloudInitPaths...)
+
+	if r.PrunePersistentOnUpgrade && len(r.PersistentCachePaths) == 0 {
+		return fmt.Errorf("prune-persistent-on-upgrade requires some persistent-cache-paths")
+	}
+	for i, path := range r.PersistentCachePaths {
+		path = filepath.Clean(strings.TrimPrefix(path, "/"))
+		if path == "." || path == ".." || strings.HasPrefix(path, "../") {
+			return fmt.Errorf("invalid persistent cache path '%s'", r.PersistentCachePaths[i])
+		}
+		r.PersistentCachePaths[i] = path
+	}
+	if r.RebootDelay < 0 {
+		return fmt.Errorf("reboot-delay can't be negative")
+	}
+	if r.WebhookURL != "" {
+		u, err := url.Parse(r.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook URL '%s', an http or https URL is required", r.WebhookURL)
+		}
+	}
+	if r.MetricsFile != "" && !filepath.IsAbs(r.MetricsFile) {
+		return fmt.Errorf("invalid metrics file '%s', an absolute path is required", r.MetricsFile)
+	}
 	return r.Config.Sanitize()
 }
 
@@ -213,22 +492,252 @@ func KeyValuePairFromData(data interface{}) (KeyValuePair, error) {
 	return result, nil
 }
 
+// ParseSizeMiB parses a size with a binary unit suffix (e.g. '512M', '8GiB') and returns
+// it in MiB. Bare numbers are already taken as MiB. Sizes must be a whole number of MiB.
+func ParseSizeMiB(size string) (uint, error) {
+	size = strings.TrimSpace(size)
+	if mib, err := strconv.ParseUint(size, 10, 0); err == nil {
+		return uint(mib), nil
+	}
+	bytes, err := units.RAMInBytes(size)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size '%s': %w", size, err)
+	}
+	if bytes%units.MiB != 0 {
+		return 0, fmt.Errorf("invalid size '%s': not a whole number of MiB", size)
+	}
+	return uint(bytes / units.MiB), nil
+}
+
+// SizeHookFromData is a mapstructure decode hook parsing strings with units decoded into
+// unsigned integers, which in configuration are sizes in MiB
+func SizeHookFromData(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if from.Kind() != reflect.String || to.Kind() != reflect.Uint {
+		return data, nil
+	}
+	return ParseSizeMiB(data.(string))
+}
+
 // InstallSpec struct represents all the installation action details
 type InstallSpec struct {
-	Target           string `yaml:"target,omitempty" mapstructure:"target"`
-	Firmware         string
-	PartTable        string
-	Partitions       ElementalPartitions `yaml:"partitions,omitempty" mapstructure:"partitions"`
-	ExtraPartitions  PartitionList       `yaml:"extra-partitions,omitempty" mapstructure:"extra-partitions"`
-	NoFormat         bool                `yaml:"no-format,omitempty" mapstructure:"no-format"`
-	Force            bool                `yaml:"force,omitempty" mapstructure:"force"`
-	CloudInit        []string            `yaml:"cloud-init,omitempty" mapstructure:"cloud-init"`
-	Iso              string              `yaml:"iso,omitempty" mapstructure:"iso"`
-	GrubDefEntry     string              `yaml:"grub-entry-name,omitempty" mapstructure:"grub-entry-name"`
-	System           *ImageSource        `yaml:"system,omitempty" mapstructure:"system"`
-	RecoverySystem   Image               `yaml:"recovery-system,omitempty" mapstructure:"recovery-system"`
-	DisableBootEntry bool                `yaml:"disable-boot-entry,omitempty" mapstructure:"disable-boot-entry"`
-	SnapshotLabels   KeyValuePair        `yaml:"snapshot-labels,omitempty" mapstructure:"snapshot-labels"`
+	Target              string   `yaml:"target,omitempty" mapstructure:"target"`
+	AllowRemovable      bool     `yaml:"auto-target-allow-removable,omitempty" mapstructure:"auto-target-allow-removable"`
+	ExcludeDeviceLabels []string `yaml:"exclude-device-labels,omitempty" mapstructure:"exclude-device-labels"`
+	ExcludeDevicePaths  []string `yaml:"exclude-device-paths,omitempty" mapstructure:"exclude-device-paths"`
+	ExcludeDeviceTypes  []string `yaml:"exclude-device-types,omitempty" mapstructure:"exclude-device-types"`
+	PreferDeviceType    string   `yaml:"prefer-device-type,omitempty" mapstructure:"prefer-device-type"`
+	Firmware            string
+	PartTable           string
+	Partitions          ElementalPartitions `yaml:"partitions,omitempty" mapstructure:"partitions"`
+	ExtraPartitions     PartitionList       `yaml:"extra-partitions,omitempty" mapstructure:"extra-partitions"`
+	NoFormat            bool                `yaml:"no-format,omitempty" mapstructure:"no-format"`
+	SkipPartitioning    bool                `yaml:"skip-partitioning,omitempty" mapstructure:"skip-partitioning"`
+	RootMountPoint      string              `yaml:"root-mountpoint,omitempty" mapstructure:"root-mountpoint"`
+	Force               bool                `yaml:"force,omitempty" mapstructure:"force"`
+	CloudInit           []string            `yaml:"cloud-init,omitempty" mapstructure:"cloud-init"`
+	OEMSources          []*ImageSource      `yaml:"oem-sources,omitempty" mapstructure:"oem-sources"`
+	Iso                 string              `yaml:"iso,omitempty" mapstructure:"iso"`
+	IsoChecksum         string              `yaml:"iso-checksum,omitempty" mapstructure:"iso-checksum"`
+	GrubDefEntry        string              `yaml:"grub-entry-name,omitempty" mapstructure:"grub-entry-name"`
+	System              *ImageSource        `yaml:"system,omitempty" mapstructure:"system"`
+	RecoverySystem      Image               `yaml:"recovery-system,omitempty" mapstructure:"recovery-system"`
+	DisableBootEntry    bool                `yaml:"disable-boot-entry,omitempty" mapstructure:"disable-boot-entry"`
+	SnapshotLabels      KeyValuePair        `yaml:"snapshot-labels,omitempty" mapstructure:"snapshot-labels"`
+	Overlay             OverlaySpec         `yaml:"overlay,omitempty" mapstructure:"overlay"`
+	RaidDisks           []string            `yaml:"raid-disks,omitempty" mapstructure:"raid-disks"`
+	RaidLevel           string              `yaml:"raid-level,omitempty" mapstructure:"raid-level"`
+	SkipFirstBootSetup  bool                `yaml:"skip-first-boot-setup,omitempty" mapstructure:"skip-first-boot-setup"`
+	Users               []User              `yaml:"users,omitempty" mapstructure:"users"`
+	TimeSync            TimeSyncSpec        `yaml:"time-sync,omitempty" mapstructure:"time-sync"`
+	GrubPasswordHash    string              `yaml:"grub-password-hash,omitempty" mapstructure:"grub-password-hash"`
+	RecoveryPassHash    string              `yaml:"recovery-password-hash,omitempty" mapstructure:"recovery-password-hash"`
+	SBOM                string              `yaml:"sbom,omitempty" mapstructure:"sbom"`
+	BootAttempts        int                 `yaml:"boot-assessment-attempts,omitempty" mapstructure:"boot-assessment-attempts"`
+	RecordChecksums     bool                `yaml:"record-checksums,omitempty" mapstructure:"record-checksums"`
+	LayoutPolicy        LayoutPolicy        `yaml:"layout-policy,omitempty" mapstructure:"layout-policy"`
+	RecoveryFromActive  bool                `yaml:"recovery-from-active,omitempty" mapstructure:"recovery-from-active"`
+	RecoveryIncludes    []string            `yaml:"recovery-includes,omitempty" mapstructure:"recovery-includes"`
+	RecoveryExcludes    []string            `yaml:"recovery-excludes,omitempty" mapstructure:"recovery-excludes"`
+	EtcMode             string              `yaml:"etc-mode,omitempty" mapstructure:"etc-mode"`
+	AnswerFile          bool                `yaml:"answer-file,omitempty" mapstructure:"answer-file"`
+	TransformCmd        []string            `yaml:"transform-command,omitempty" mapstructure:"transform-command"`
+	TrimAfterInstall    string              `yaml:"trim-after-install,omitempty" mapstructure:"trim-after-install"`
+	DbxUpdate           string              `yaml:"dbx-update,omitempty" mapstructure:"dbx-update"`
+}
+
+// RecoveryFilters returns the compiled include and exclude expressions used to filter
+// the active system tree when deriving the recovery image from it
+func (i InstallSpec) RecoveryFilters() (includes, excludes []*regexp.Regexp, err error) {
+	return compileFilters("recovery", i.RecoveryIncludes, i.RecoveryExcludes)
+}
+
+// compileFilters compiles the given include and exclude expressions, kind names the
+// filters in error messages
+func compileFilters(kind string, includeExprs, excludeExprs []string) (includes, excludes []*regexp.Regexp, err error) {
+	compile := func(exprs []string) ([]*regexp.Regexp, error) {
+		var compiled []*regexp.Regexp
+		for _, expr := range exprs {
+			r, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s filter expression '%s': %w", kind, expr, err)
+			}
+			compiled = append(compiled, r)
+		}
+		return compiled, nil
+	}
+
+	if includes, err = compile(includeExprs); err != nil {
+		return nil, nil, err
+	}
+	if excludes, err = compile(excludeExprs); err != nil {
+		return nil, nil, err
+	}
+	return includes, excludes, nil
+}
+
+// sanitizeEtcMode translates the /etc mode into the matching overlay backend. Any
+// overlay backend already set must be consistent with it.
+func (i *InstallSpec) sanitizeEtcMode() error {
+	switch i.EtcMode {
+	case "":
+		return nil
+	case constants.OverlayMode:
+		if i.Overlay.Backend != "" && i.Overlay.Backend != constants.Tmpfs {
+			return fmt.Errorf("etc-mode '%s' is inconsistent with the '%s' overlay backend", i.EtcMode, i.Overlay.Backend)
+		}
+		return nil
+	case constants.ImmutableEtc, constants.PersistentOverlay:
+		if i.Overlay.Backend != "" && i.Overlay.Backend != i.EtcMode {
+			return fmt.Errorf("etc-mode '%s' is inconsistent with the '%s' overlay backend", i.EtcMode, i.Overlay.Backend)
+		}
+	default:
+		return fmt.Errorf("unknown etc-mode '%s', valid modes are: %s, %s, %s",
+			i.EtcMode, constants.ImmutableEtc, constants.OverlayMode, constants.PersistentOverlay)
+	}
+
+	if i.EtcMode == constants.PersistentOverlay {
+		persistent := i.Partitions.Persistent
+		if persistent == nil {
+			return fmt.Errorf("etc-mode '%s' requires a persistent partition", i.EtcMode)
+		}
+		// Overlay upper dirs are not supported on FAT filesystems
+		switch persistent.FS {
+		case constants.LinuxFs, constants.LinuxImgFs, "ext3", "xfs", constants.Btrfs:
+		default:
+			return fmt.Errorf("etc-mode '%s' is not supported on a '%s' persistent partition", i.EtcMode, persistent.FS)
+		}
+	}
+	i.Overlay.Backend = i.EtcMode
+	return nil
+}
+
+// sanitizeVarPartition sets the defaults of the separate /var partition, if any. It
+// requires a fixed size, as the persistent partition usually takes the rest of the disk.
+func (i *InstallSpec) sanitizeVarPartition() error {
+	return i.sanitizeSystemPartition(i.Partitions.Var, constants.VarPartName, constants.VarLabel, constants.VarDir)
+}
+
+// sanitizeRootPartition sets the defaults of the separate writable root partition, if
+// any. The system image only provides /usr when it is set, the rest of the root tree is
+// seeded into this partition.
+func (i *InstallSpec) sanitizeRootPartition() error {
+	return i.sanitizeSystemPartition(i.Partitions.Root, constants.RootPartName, constants.RootLabel, constants.RootDir)
+}
+
+// sanitizeSystemPartition sets the defaults of a partition holding part of the system
+// tree, its mount settings are stored in the OEM partition
+func (i *InstallSpec) sanitizeSystemPartition(part *Partition, name, label, mountPoint string) error {
+	if part == nil {
+		return nil
+	}
+	if part.Size == 0 {
+		return fmt.Errorf("the %s partition requires a size", name)
+	}
+	if i.Partitions.OEM == nil {
+		return fmt.Errorf("the %s partition requires an OEM partition to store its mount settings", name)
+	}
+	part.Name = name
+	if part.FilesystemLabel == "" {
+		part.FilesystemLabel = label
+	}
+	if part.FS == "" {
+		part.FS = constants.LinuxFs
+	}
+	if part.MountPoint == "" {
+		part.MountPoint = mountPoint
+	}
+	switch part.FS {
+	case constants.LinuxFs, "ext3", "xfs", constants.Btrfs:
+	default:
+		return fmt.Errorf("filesystem '%s' is not supported for the %s partition", part.FS, name)
+	}
+	return nil
+}
+
+// IsRaid returns true if the installation target is a software RAID array
+func (i InstallSpec) IsRaid() bool {
+	return len(i.RaidDisks) > 0 || strings.HasPrefix(i.Target, "/dev/md")
+}
+
+// OverlaySpec defines the backend of the /etc overlay of the installed system.
+// The persistent backend keeps the whole /etc in the persistent partition, the
+// tmpfs backend keeps it in RAM, up to the given size, and discards it on reboot.
+// The immutable backend does not overlay /etc at all, so it is kept read-only.
+// An empty backend keeps the default layout.
+type OverlaySpec struct {
+	Backend string `yaml:"backend,omitempty" mapstructure:"backend"`
+	Size    string `yaml:"size,omitempty" mapstructure:"size"`
+}
+
+// Sanitize checks the consistency of the struct, returns error
+// if unsolvable inconsistencies are found
+func (o OverlaySpec) Sanitize() error {
+	switch o.Backend {
+	case "", constants.PersistentOverlay, constants.Tmpfs, constants.ImmutableEtc:
+	default:
+		return fmt.Errorf("unknown overlay backend: '%s'", o.Backend)
+	}
+	if o.Size == "" {
+		return nil
+	}
+	if o.Backend != constants.Tmpfs {
+		return fmt.Errorf("overlay size can only be set for the '%s' backend", constants.Tmpfs)
+	}
+	_, _, err := ParseTmpfsSize(o.Size)
+	return err
+}
+
+// ParseTmpfsSize parses a tmpfs size option value. It returns the size in bytes
+// or the percentage of RAM if the size is expressed as a percentage.
+func ParseTmpfsSize(size string) (uint64, bool, error) {
+	if num, ok := strings.CutSuffix(size, "%"); ok {
+		value, err := strconv.ParseUint(num, 10, 64)
+		if err != nil || value == 0 || value > 100 {
+			return 0, true, fmt.Errorf("invalid tmpfs size '%s', percentages must be within 1%% and 100%%", size)
+		}
+		return value, true, nil
+	}
+
+	var mult uint64 = 1
+	num := size
+	if len(size) > 0 {
+		switch strings.ToLower(size[len(size)-1:]) {
+		case "k":
+			mult = 1 << 10
+		case "m":
+			mult = 1 << 20
+		case "g":
+			mult = 1 << 30
+		}
+		if mult > 1 {
+			num = size[:len(size)-1]
+		}
+	}
+	value, err := strconv.ParseUint(num, 10, 64)
+	if err != nil || value == 0 {
+		return 0, false, fmt.Errorf("invalid tmpfs size '%s'", size)
+	}
+	return value * mult, false, nil
 }
 
 // Sanitize checks the consistency of the struct, returns error
@@ -237,15 +746,55 @@ func (i *InstallSpec) Sanitize() error {
 	if i.System.IsEmpty() && i.Iso == "" {
 		return fmt.Errorf("undefined system source to install")
 	}
+	if i.IsoChecksum != "" && i.Iso == "" {
+		return fmt.Errorf("an ISO checksum requires installing from an ISO")
+	}
 	if i.Partitions.State == nil || i.Partitions.State.MountPoint == "" {
 		return fmt.Errorf("undefined state partition")
 	}
 
+	for _, t := range append([]string{i.PreferDeviceType}, i.ExcludeDeviceTypes...) {
+		if t != "" && !slices.Contains(constants.GetDiskTypes(), t) {
+			return fmt.Errorf(
+				"unknown device type '%s', supported types are %s", t, strings.Join(constants.GetDiskTypes(), ", "),
+			)
+		}
+	}
+	if slices.Contains(i.ExcludeDeviceTypes, i.PreferDeviceType) {
+		return fmt.Errorf("device type '%s' can't be preferred and excluded at once", i.PreferDeviceType)
+	}
+
+	if err := i.sanitizeVarPartition(); err != nil {
+		return err
+	}
+	if err := i.sanitizeRootPartition(); err != nil {
+		return err
+	}
+
+	if i.SkipPartitioning {
+		if err := i.setRootMountPoint(); err != nil {
+			return err
+		}
+	} else if i.RootMountPoint != "" {
+		return fmt.Errorf("root-mountpoint requires skip-partitioning")
+	}
+
 	// If not special recovery is defined use main system source
 	if i.RecoverySystem.Source.IsEmpty() {
 		i.RecoverySystem.Source = i.System
 	}
 
+	if i.RecoveryFromActive {
+		if i.RecoverySystem.Source.String() != i.System.String() {
+			return fmt.Errorf("recovery-from-active can't be combined with a recovery-system source")
+		}
+		if _, _, err := i.RecoveryFilters(); err != nil {
+			return err
+		}
+	} else if len(i.RecoveryIncludes) > 0 || len(i.RecoveryExcludes) > 0 {
+		return fmt.Errorf("recovery-includes and recovery-excludes require recovery-from-active")
+	}
+
 	// Set default label for non squashfs images
 	if i.RecoverySystem.FS != constants.SquashFs && i.RecoverySystem.Label == "" {
 		i.RecoverySystem.Label = constants.SystemLabel
@@ -268,7 +817,197 @@ func (i *InstallSpec) Sanitize() error {
 	if extraPartsSizeCheck == 1 && i.Partitions.Persistent.Size == 0 {
 		return fmt.Errorf("both persistent partition and extra partitions have size set to 0. Only one partition can have its size set to 0 which means that it will take all the available disk space in the device")
 	}
-	return i.Partitions.SetFirmwarePartitions(i.Firmware, i.PartTable)
+	if err := i.sanitizeEtcMode(); err != nil {
+		return err
+	}
+	if i.TrimAfterInstall == "" {
+		i.TrimAfterInstall = constants.TrimAuto
+	}
+	if !slices.Contains(constants.GetTrimPolicies(), i.TrimAfterInstall) {
+		return fmt.Errorf("unknown trim-after-install policy '%s', valid policies are: %s",
+			i.TrimAfterInstall, strings.Join(constants.GetTrimPolicies(), ", "))
+	}
+	if err := i.Overlay.Sanitize(); err != nil {
+		return err
+	}
+	for _, u := range i.Users {
+		if err := u.Sanitize(); err != nil {
+			return err
+		}
+	}
+	if err := i.TimeSync.Sanitize(); err != nil {
+		return err
+	}
+	if i.GrubPasswordHash != "" && !grubHashRegexp.MatchString(i.GrubPasswordHash) {
+		return fmt.Errorf("grub password is not a 'grub.pbkdf2' hash, use grub2-mkpasswd-pbkdf2 to create it")
+	}
+	if i.RecoveryPassHash != "" && !cryptHashRegexp.MatchString(i.RecoveryPassHash) {
+		return fmt.Errorf("recovery password is not a crypt hash, plain text passwords are not accepted")
+	}
+	switch i.SBOM {
+	case "", constants.SPDXFormat, constants.CycloneDXFormat:
+	default:
+		return fmt.Errorf("unknown SBOM format '%s', valid formats are: %s, %s", i.SBOM, constants.SPDXFormat, constants.CycloneDXFormat)
+	}
+	if i.SBOM != "" && i.Partitions.GetConfigStorage() == "" {
+		return fmt.Errorf("an OEM partition is required to store the SBOM")
+	}
+	if len(i.Users) > 0 && i.Partitions.GetConfigStorage() == "" {
+		return fmt.Errorf("an OEM partition is required to store the users config")
+	}
+	if len(i.OEMSources) > 0 && i.Partitions.GetConfigStorage() == "" {
+		return fmt.Errorf("an OEM partition is required to populate it from oem-sources")
+	}
+	for _, src := range i.OEMSources {
+		if src == nil || src.IsEmpty() {
+			return fmt.Errorf("empty source in oem-sources")
+		}
+	}
+	if err := sanitizeBootAttempts(i.BootAttempts, i.Partitions); err != nil {
+		return err
+	}
+	if err := sanitizeFSUUIDs(i.Partitions.PartitionsByInstallOrder(i.ExtraPartitions)); err != nil {
+		return err
+	}
+	if err := sanitizeTypeGUIDs(i.PartTable, i.Partitions.PartitionsByInstallOrder(i.ExtraPartitions)); err != nil {
+		return err
+	}
+	if err := sanitizePartitionFlags(i.Partitions.PartitionsByInstallOrder(i.ExtraPartitions)); err != nil {
+		return err
+	}
+	if len(i.RaidDisks) > 0 {
+		if len(i.RaidDisks) < 2 {
+			return fmt.Errorf("at least two disks are required to create a RAID array")
+		}
+		if i.RaidLevel == "" {
+			i.RaidLevel = constants.RaidLevel
+		}
+		if i.Target == "" {
+			i.Target = constants.RaidDevice
+		}
+	}
+	if err := i.Partitions.SetFirmwarePartitions(i.Firmware, i.PartTable); err != nil {
+		return err
+	}
+	// The layout is only computed by the installer if it partitions the device
+	if i.NoFormat || i.SkipPartitioning {
+		return nil
+	}
+	return i.LayoutPolicy.Validate(i.PartTable, i.Partitions.PartitionsByInstallOrder(i.ExtraPartitions))
+}
+
+// setRootMountPoint sets the mountpoints of the partitions, already partitioned and mounted by
+// the caller, under the root mountpoint. Each partition is expected at the folder named
+// as its default mountpoint, e.g. '<root>/efi' or '<root>/state'.
+func (i *InstallSpec) setRootMountPoint() error {
+	if !filepath.IsAbs(i.RootMountPoint) {
+		return fmt.Errorf("skip-partitioning requires an absolute root-mountpoint")
+	}
+	if len(i.RaidDisks) > 0 {
+		return fmt.Errorf("skip-partitioning can't be combined with raid-disks")
+	}
+	for _, part := range i.Partitions.PartitionsByInstallOrder(PartitionList{}) {
+		if part.MountPoint != "" {
+			part.MountPoint = filepath.Join(i.RootMountPoint, filepath.Base(part.MountPoint))
+		}
+	}
+	if strings.HasPrefix(i.RecoverySystem.File, constants.RecoveryDir+"/") && i.Partitions.Recovery != nil {
+		i.RecoverySystem.File = filepath.Join(i.Partitions.Recovery.MountPoint, strings.TrimPrefix(i.RecoverySystem.File, constants.RecoveryDir))
+	}
+	return nil
+}
+
+// LayoutPolicy is a set of rules the partition layout computed for an installation must
+// comply with, so layout standards can be enforced across installations. Sizes are in MiB.
+// Partitions are referred by name, partitions with size 0 take the rest of the disk and
+// are not checked against their minimum size.
+type LayoutPolicy struct {
+	PartTables         []string        `yaml:"part-tables,omitempty" mapstructure:"part-tables"`
+	RequiredPartitions []string        `yaml:"required-partitions,omitempty" mapstructure:"required-partitions"`
+	MinSizes           map[string]uint `yaml:"min-sizes,omitempty" mapstructure:"min-sizes"`
+}
+
+// Validate checks the given partition table type and partitions comply with the policy,
+// the returned error names the violated rule
+func (l LayoutPolicy) Validate(partTable string, parts PartitionList) error {
+	if len(l.PartTables) > 0 && !slices.Contains(l.PartTables, partTable) {
+		return fmt.Errorf("layout policy rule 'part-tables' violated: '%s' partition table is not one of %v", partTable, l.PartTables)
+	}
+	for _, name := range l.RequiredPartitions {
+		if parts.GetByName(name) == nil {
+			return fmt.Errorf("layout policy rule 'required-partitions' violated: partition '%s' is missing", name)
+		}
+	}
+	names := make([]string, 0, len(l.MinSizes))
+	for name := range l.MinSizes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		size := l.MinSizes[name]
+		part := parts.GetByName(name)
+		if part == nil {
+			return fmt.Errorf("layout policy rule 'min-sizes' violated: partition '%s' is missing", name)
+		}
+		if part.Size != 0 && part.Size < size {
+			return fmt.Errorf("layout policy rule 'min-sizes' violated: partition '%s' is %dMiB, at least %dMiB are required", name, part.Size, size)
+		}
+	}
+	return nil
+}
+
+// TimeSyncSpec defines how the system clock is set before any download happens, either
+// from an NTP server or from a given RFC3339 timestamp, and the timezone of the installed
+// system (e.g. 'Europe/Berlin').
+type TimeSyncSpec struct {
+	NTPServer string `yaml:"ntp-server,omitempty" mapstructure:"ntp-server"`
+	Timestamp string `yaml:"timestamp,omitempty" mapstructure:"timestamp"`
+	Timezone  string `yaml:"timezone,omitempty" mapstructure:"timezone"`
+}
+
+// Sanitize checks the consistency of the struct, returns error
+// if unsolvable inconsistencies are found
+func (t TimeSyncSpec) Sanitize() error {
+	if t.NTPServer != "" && t.Timestamp != "" {
+		return fmt.Errorf("ntp-server and timestamp time sync options are mutually exclusive")
+	}
+	if t.Timestamp != "" {
+		if _, err := time.Parse(time.RFC3339, t.Timestamp); err != nil {
+			return fmt.Errorf("invalid time sync timestamp '%s', RFC3339 format is expected: %w", t.Timestamp, err)
+		}
+	}
+	if t.Timezone != "" && (filepath.IsAbs(t.Timezone) || filepath.Clean(t.Timezone) != t.Timezone || strings.HasPrefix(t.Timezone, "..")) {
+		return fmt.Errorf("invalid timezone '%s'", t.Timezone)
+	}
+	return nil
+}
+
+// User defines a user to be created in the installed system. Passwords are only
+// accepted as crypt hashes (e.g. 'openssl passwd -6'), users without a password
+// hash get a locked password and can only log in with their SSH keys.
+type User struct {
+	Name         string   `yaml:"name,omitempty" mapstructure:"name"`
+	Groups       []string `yaml:"groups,omitempty" mapstructure:"groups"`
+	SSHKeys      []string `yaml:"ssh-authorized-keys,omitempty" mapstructure:"ssh-authorized-keys"`
+	PasswordHash string   `yaml:"password-hash,omitempty" mapstructure:"password-hash"`
+}
+
+// Sanitize checks the consistency of the struct, returns error
+// if unsolvable inconsistencies are found
+func (u User) Sanitize() error {
+	if !userNameRegexp.MatchString(u.Name) {
+		return fmt.Errorf("invalid user name '%s'", u.Name)
+	}
+	// Never include the password in the error, it could be plain text
+	if u.PasswordHash != "" && !cryptHashRegexp.MatchString(u.PasswordHash) {
+		return fmt.Errorf("password of user '%s' is not a crypt hash, plain text passwords are not accepted", u.Name)
+	}
+	return nil
+}
+
+// LitterDump prints the user without its password hash so it is never logged
+func (u User) LitterDump(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "types.User{Name: %q, Groups: %q, SSHKeys: %d keys, PasswordHash: <redacted>}", u.Name, u.Groups, len(u.SSHKeys))
 }
 
 // InitSpec struct represents all the init action details
@@ -279,6 +1018,31 @@ type InitSpec struct {
 	Features []string `yaml:"features,omitempty" mapstructure:"features"`
 }
 
+// CaptureSpec struct represents all the capture action details
+type CaptureSpec struct {
+	FS       string   `yaml:"fs,omitempty" mapstructure:"fs"`
+	Includes []string `yaml:"includes,omitempty" mapstructure:"includes"`
+	Excludes []string `yaml:"excludes,omitempty" mapstructure:"excludes"`
+}
+
+// Filters returns the compiled include and exclude expressions used to filter the
+// running system tree on capture
+func (c CaptureSpec) Filters() (includes, excludes []*regexp.Regexp, err error) {
+	return compileFilters("capture", c.Includes, c.Excludes)
+}
+
+// Sanitize checks the consistency of the struct, returns error
+// if unsolvable inconsistencies are found
+func (c *CaptureSpec) Sanitize() error {
+	switch c.FS {
+	case constants.SquashFs, constants.LinuxImgFs, "ext3", constants.LinuxFs, constants.Tarball:
+	default:
+		return fmt.Errorf("unsupported capture filesystem '%s'", c.FS)
+	}
+	_, _, err := c.Filters()
+	return err
+}
+
 // MountSpec struct represents all the mount action details
 type MountSpec struct {
 	WriteFstab     bool             `yaml:"write-fstab,omitempty" mapstructure:"write-fstab"`
@@ -289,6 +1053,13 @@ type MountSpec struct {
 	Volumes        []*VolumeMount   `yaml:"extra-volumes,omitempty" mapstructure:"extra-volumes"`
 	Ephemeral      EphemeralMounts  `yaml:"ephemeral,omitempty" mapstructure:"ephemeral"`
 	Persistent     PersistentMounts `yaml:"persistent,omitempty" mapstructure:"persistent"`
+	SplitRoot      SplitRootMounts  `yaml:"split-root,omitempty" mapstructure:"split-root"`
+}
+
+// SplitRootMounts sets a separate writable root volume. Every top level directory of the
+// volume but /usr is bind mounted over the read-only system image, which only provides /usr.
+type SplitRootMounts struct {
+	Volume VolumeMount `yaml:"volume,omitempty" mapstructure:"volume"`
 }
 
 type VolumeMount struct {
@@ -359,6 +1130,13 @@ func (spec *MountSpec) Sanitize() error {
 	return nil
 }
 
+// HasSplitRoot returns true if a separate writable root volume is set, it is not used
+// when booting the recovery system
+func (spec *MountSpec) HasSplitRoot() bool {
+	return spec.Mode != constants.RecoveryImgName &&
+		spec.SplitRoot.Volume.Device != "" && spec.SplitRoot.Volume.Mountpoint != ""
+}
+
 func (spec *MountSpec) HasPersistent() bool {
 	return spec.Mode != constants.RecoveryImgName &&
 		spec.Persistent.Volume.Device != "" && spec.Persistent.Volume.Mountpoint != ""
@@ -390,18 +1168,27 @@ func (r *ResetSpec) Sanitize() error {
 		return fmt.Errorf("undefined state partition")
 	}
 
-	return nil
+	return sanitizeFSUUIDs(r.Partitions.PartitionsByInstallOrder(PartitionList{}))
 }
 
 type UpgradeSpec struct {
-	RecoveryUpgrade   bool         `yaml:"recovery,omitempty" mapstructure:"recovery"`
-	System            *ImageSource `yaml:"system,omitempty" mapstructure:"system"`
-	RecoverySystem    Image        `yaml:"recovery-system,omitempty" mapstructure:"recovery-system"`
-	GrubDefEntry      string       `yaml:"grub-entry-name,omitempty" mapstructure:"grub-entry-name"`
-	BootloaderUpgrade bool         `yaml:"bootloader,omitempty" mapstructure:"bootloader"`
-	SnapshotLabels    KeyValuePair `yaml:"snapshot-labels,omitempty" mapstructure:"snapshot-labels"`
-	Partitions        ElementalPartitions
-	State             *InstallState
+	RecoveryUpgrade         bool         `yaml:"recovery,omitempty" mapstructure:"recovery"`
+	System                  *ImageSource `yaml:"system,omitempty" mapstructure:"system"`
+	RecoverySystem          Image        `yaml:"recovery-system,omitempty" mapstructure:"recovery-system"`
+	GrubDefEntry            string       `yaml:"grub-entry-name,omitempty" mapstructure:"grub-entry-name"`
+	BootloaderUpgrade       bool         `yaml:"bootloader,omitempty" mapstructure:"bootloader"`
+	SnapshotLabels          KeyValuePair `yaml:"snapshot-labels,omitempty" mapstructure:"snapshot-labels"`
+	VerifyOnly              bool         `yaml:"verify-only,omitempty" mapstructure:"verify-only"`
+	ResumeUpgrade           bool         `yaml:"resume,omitempty" mapstructure:"resume"`
+	VerifyModules           bool         `yaml:"verify-kernel-modules,omitempty" mapstructure:"verify-kernel-modules"`
+	BootAttempts            int          `yaml:"boot-assessment-attempts,omitempty" mapstructure:"boot-assessment-attempts"`
+	SkipChecksum            bool         `yaml:"skip-checksum,omitempty" mapstructure:"skip-checksum"`
+	PreSwapVerifyCmd        []string     `yaml:"pre-swap-verify-command,omitempty" mapstructure:"pre-swap-verify-command"`
+	OnlyIfNewer             bool         `yaml:"only-upgrade-if-newer,omitempty" mapstructure:"only-upgrade-if-newer"`
+	AllowDowngrade          bool         `yaml:"allow-downgrade,omitempty" mapstructure:"allow-downgrade"`
+	CreateRecoveryIfMissing bool         `yaml:"create-recovery-if-missing,omitempty" mapstructure:"create-recovery-if-missing"`
+	Partitions              ElementalPartitions
+	State                   *InstallState
 }
 
 // Sanitize checks the consistency of the struct, returns error
@@ -410,15 +1197,29 @@ func (u *UpgradeSpec) Sanitize() error {
 	if u.Partitions.State == nil || u.Partitions.State.MountPoint == "" {
 		return fmt.Errorf("undefined state partition")
 	}
-	if u.System.IsEmpty() {
+	if u.VerifyOnly && u.ResumeUpgrade {
+		return fmt.Errorf("verify-only and resume options are mutually exclusive")
+	}
+	if u.VerifyOnly || u.ResumeUpgrade {
+		// Upgrades are staged in the persistent partition
+		if u.Partitions.Persistent == nil || u.Partitions.Persistent.MountPoint == "" {
+			return fmt.Errorf("undefined persistent partition, required to stage upgrades")
+		}
+	}
+	// A resumed upgrade uses the previously staged source
+	if u.ResumeUpgrade && !u.System.IsEmpty() {
+		return fmt.Errorf("resume option applies the staged upgrade source, it can't be combined with a new source")
+	}
+	if u.System.IsEmpty() && !u.ResumeUpgrade {
 		return fmt.Errorf("undefined upgrade source")
 	}
 
-	if u.RecoveryUpgrade {
-		if u.Partitions.Recovery == nil || u.Partitions.Recovery.MountPoint == "" {
-			return fmt.Errorf("undefined recovery partition")
-		}
-		if u.RecoverySystem.Source.IsEmpty() {
+	// A missing recovery partition is either created or skipped by the upgrade action
+	if u.Partitions.Recovery != nil && u.Partitions.Recovery.MountPoint == "" {
+		return fmt.Errorf("undefined recovery partition")
+	}
+	if u.RecoveryUpgrade || u.CreateRecoveryIfMissing {
+		if u.RecoverySystem.Source == nil || u.RecoverySystem.Source.IsEmpty() {
 			u.RecoverySystem.Source = u.System
 		}
 	}
@@ -429,6 +1230,10 @@ func (u *UpgradeSpec) Sanitize() error {
 		}
 	}
 
+	if err := sanitizeBootAttempts(u.BootAttempts, u.Partitions); err != nil {
+		return err
+	}
+
 	// Set default label for non squashfs images
 	if u.RecoverySystem.FS != constants.SquashFs && u.RecoverySystem.Label == "" {
 		u.RecoverySystem.Label = constants.SystemLabel
@@ -462,16 +1267,32 @@ func (u *UpgradeSpec) SanitizeForRecoveryOnly() error {
 	return nil
 }
 
+// PartedPartition represents a partition entry of the parted machine readable output.
+// Start, End and Size are given in sectors if Unit is "s", otherwise in bytes
+type PartedPartition struct {
+	Number     int
+	Start      uint64
+	End        uint64
+	Size       uint64
+	Unit       string
+	FileSystem string
+	Name       string
+	Flags      []string
+}
+
 // Partition struct represents a partition with its commonly configurable values, size in MiB
 type Partition struct {
 	Name            string
 	FilesystemLabel string   `yaml:"label,omitempty" mapstructure:"label"`
 	Size            uint     `yaml:"size,omitempty" mapstructure:"size"`
 	FS              string   `yaml:"fs,omitempty" mapstructure:"fs"`
+	FSUUID          string   `yaml:"uuid,omitempty" mapstructure:"uuid"`
 	Flags           []string `yaml:"flags,omitempty" mapstructure:"flags"`
+	TypeGUID        string   `yaml:"type-guid,omitempty" mapstructure:"type-guid"`
 	MountPoint      string
 	Path            string
 	Disk            string
+	GUID            string
 }
 
 type PartitionList []*Partition
@@ -535,6 +1356,86 @@ type ElementalPartitions struct {
 	Recovery   *Partition `yaml:"recovery,omitempty" mapstructure:"recovery"`
 	State      *Partition `yaml:"state,omitempty" mapstructure:"state"`
 	Persistent *Partition `yaml:"persistent,omitempty" mapstructure:"persistent"`
+	Var        *Partition `yaml:"var,omitempty" mapstructure:"var"`
+	Root       *Partition `yaml:"root,omitempty" mapstructure:"root"`
+}
+
+// sanitizeBootAttempts checks the boot attempts counter is in range, the counter is
+// stored in the grubenv file of the OEM partition
+func sanitizeBootAttempts(attempts int, ep ElementalPartitions) error {
+	if attempts < 0 || attempts > constants.MaxBootAttempts {
+		return fmt.Errorf("boot assessment attempts must be between 0 and %d", constants.MaxBootAttempts)
+	}
+	if attempts > 0 && ep.OEM == nil {
+		return fmt.Errorf("an OEM partition is required to count boot assessment attempts")
+	}
+	return nil
+}
+
+// sanitizeFSUUIDs checks the filesystem UUIDs to set at format time are well formed for the
+// partition filesystem and unique. FAT filesystems take a volume ID such as 'ABCD-1234'.
+func sanitizeFSUUIDs(parts PartitionList) error {
+	uuids := map[string]bool{}
+	for _, part := range parts {
+		if part.FSUUID == "" {
+			continue
+		}
+		switch part.FS {
+		case constants.LinuxFs, constants.LinuxImgFs, "ext3", "xfs", constants.Btrfs:
+			if !fsUUIDRegexp.MatchString(part.FSUUID) {
+				return fmt.Errorf("invalid filesystem UUID '%s' for partition '%s'", part.FSUUID, part.Name)
+			}
+		case constants.BootFs, "fat":
+			if !fatVolIDRegexp.MatchString(part.FSUUID) {
+				return fmt.Errorf("invalid FAT volume ID '%s' for partition '%s', expected format is 'ABCD-1234'", part.FSUUID, part.Name)
+			}
+		default:
+			return fmt.Errorf("setting a UUID is not supported for filesystem '%s' of partition '%s'", part.FS, part.Name)
+		}
+		uuid := strings.ToLower(part.FSUUID)
+		if uuids[uuid] {
+			return fmt.Errorf("filesystem UUID '%s' is set for more than one partition", part.FSUUID)
+		}
+		uuids[uuid] = true
+	}
+	return nil
+}
+
+// sanitizeTypeGUIDs checks the partition type GUIDs are well formed and only set for GPT
+// partition tables
+func sanitizeTypeGUIDs(partTable string, parts PartitionList) error {
+	for _, part := range parts {
+		if part.TypeGUID == "" {
+			continue
+		}
+		if partTable != GPT {
+			return fmt.Errorf("partition type GUID of partition '%s' requires a GPT partition table", part.Name)
+		}
+		if _, err := efi.DecodeGUIDString(part.TypeGUID); err != nil {
+			return fmt.Errorf("invalid type GUID '%s' for partition '%s': %w", part.TypeGUID, part.Name, err)
+		}
+	}
+	return nil
+}
+
+// sanitizePartitionFlags maps the partition flags to the flag names of parted, failing on
+// unknown flags
+func sanitizePartitionFlags(parts PartitionList) error {
+	supported := constants.GetPartitionFlags()
+	for _, part := range parts {
+		flags := []string{}
+		for _, flag := range part.Flags {
+			pFlag, ok := supported[strings.ToLower(flag)]
+			if !ok {
+				return fmt.Errorf("unknown flag '%s' for partition '%s'", flag, part.Name)
+			}
+			if !slices.Contains(flags, pFlag) {
+				flags = append(flags, pFlag)
+			}
+		}
+		part.Flags = flags
+	}
+	return nil
 }
 
 // GetConfigStorage returns the path, usually a mountpoint, of the configuration partition
@@ -578,7 +1479,21 @@ func (ep *ElementalPartitions) SetFirmwarePartitions(firmware string, partTable
 // it tries to match partitions by filesystem label
 func NewElementalPartitionsFromList(pl PartitionList, state *InstallState) ElementalPartitions {
 	ep := ElementalPartitions{}
+	lm := elementalLabels(state)
 
+	ep.BIOS = pl.GetByName(constants.BiosPartName)
+	ep.Boot = pl.GetByNameOrLabel(constants.BootPartName, lm[constants.BootPartName])
+	ep.OEM = pl.GetByNameOrLabel(constants.OEMPartName, lm[constants.OEMPartName])
+	ep.Recovery = pl.GetByNameOrLabel(constants.RecoveryPartName, lm[constants.RecoveryPartName])
+	ep.State = pl.GetByNameOrLabel(constants.StatePartName, lm[constants.StatePartName])
+	ep.Persistent = pl.GetByNameOrLabel(constants.PersistentPartName, lm[constants.PersistentPartName])
+
+	return ep
+}
+
+// elementalLabels returns the filesystem labels of the elemental partitions by partition name,
+// the labels recorded in the installation state take precedence over the default ones
+func elementalLabels(state *InstallState) map[string]string {
 	lm := map[string]string{
 		constants.BootPartName:       constants.BootLabel,
 		constants.OEMPartName:        constants.OEMLabel,
@@ -593,15 +1508,122 @@ func NewElementalPartitionsFromList(pl PartitionList, state *InstallState) Eleme
 			}
 		}
 	}
+	return lm
+}
 
-	ep.BIOS = pl.GetByName(constants.BiosPartName)
-	ep.Boot = pl.GetByNameOrLabel(constants.BootPartName, lm[constants.BootPartName])
-	ep.OEM = pl.GetByNameOrLabel(constants.OEMPartName, lm[constants.OEMPartName])
-	ep.Recovery = pl.GetByNameOrLabel(constants.RecoveryPartName, lm[constants.RecoveryPartName])
-	ep.State = pl.GetByNameOrLabel(constants.StatePartName, lm[constants.StatePartName])
-	ep.Persistent = pl.GetByNameOrLabel(constants.PersistentPartName, lm[constants.PersistentPartName])
+// PartitionSelection disambiguates the host partitions used by the runtime actions when several
+// partitions share the name or label of an elemental partition, as after a botched reinstall.
+// Paths pins partitions by device path and partition name, GUIDs pins them by GPT partition
+// GUID and partition name, Disk only considers the partitions of the given disk.
+type PartitionSelection struct {
+	Disk  string            `yaml:"disk,omitempty" mapstructure:"disk"`
+	Paths map[string]string `yaml:"paths,omitempty" mapstructure:"paths"`
+	GUIDs map[string]string `yaml:"guids,omitempty" mapstructure:"guids"`
+}
 
-	return ep
+// Sanitize checks the consistency of the struct, returns error
+// if unsolvable inconsistencies are found
+func (s PartitionSelection) Sanitize() error {
+	names := elementalLabels(nil)
+	for name := range s.Paths {
+		if _, ok := names[name]; !ok && name != constants.BiosPartName {
+			return fmt.Errorf("unknown partition '%s' in partition-selection paths", name)
+		}
+	}
+	for name, guid := range s.GUIDs {
+		if _, ok := names[name]; !ok && name != constants.BiosPartName {
+			return fmt.Errorf("unknown partition '%s' in partition-selection guids", name)
+		}
+		if _, ok := s.Paths[name]; ok {
+			return fmt.Errorf("partition '%s' is selected both by path and by GUID", name)
+		}
+		if _, err := efi.DecodeGUIDString(guid); err != nil {
+			return fmt.Errorf("invalid GUID '%s' for partition '%s' in partition-selection guids", guid, name)
+		}
+	}
+	return nil
+}
+
+// Pinned returns the partition of the given name pinned by path or by GUID among the given host
+// partitions. It returns false if the partition is not pinned and fails if it is not found.
+func (s PartitionSelection) Pinned(name string, pl PartitionList) (*Partition, bool, error) {
+	if path := s.Paths[name]; path != "" {
+		for _, part := range pl {
+			if part.Path == path {
+				return part, true, nil
+			}
+		}
+		return nil, true, fmt.Errorf("%s partition %s not found", name, path)
+	}
+	if guid := s.GUIDs[name]; guid != "" {
+		for _, part := range pl {
+			if strings.EqualFold(part.GUID, guid) {
+				return part, true, nil
+			}
+		}
+		return nil, true, fmt.Errorf("%s partition with GUID %s not found", name, guid)
+	}
+	return nil, false, nil
+}
+
+// ElementalPartitions returns the elemental partitions of the given host partitions list as
+// NewElementalPartitionsFromList does. It fails listing the candidates of any elemental partition
+// found more than once, unless the selection picks one of them.
+func (s PartitionSelection) ElementalPartitions(pl PartitionList, state *InstallState) (ElementalPartitions, error) {
+	var errs error
+	ep := ElementalPartitions{}
+	lm := elementalLabels(state)
+
+	pick := func(name, label string) *Partition {
+		if part, pinned, err := s.Pinned(name, pl); pinned {
+			if err != nil {
+				errs = multierror.Append(errs, err)
+			}
+			return part
+		}
+
+		var byName, byLabel PartitionList
+		for _, part := range pl {
+			// RAID members might share the label of the array filesystem
+			if part.FS == constants.RaidMemberFs || (s.Disk != "" && part.Disk != s.Disk) {
+				continue
+			}
+			if part.Name == name {
+				byName = append(byName, part)
+			} else if label != "" && part.FilesystemLabel == label {
+				byLabel = append(byLabel, part)
+			}
+		}
+		candidates := byName
+		if len(candidates) == 0 {
+			candidates = byLabel
+		}
+		switch len(candidates) {
+		case 0:
+			return nil
+		case 1:
+			return candidates[0]
+		}
+
+		var listing []string
+		for _, part := range candidates {
+			listing = append(listing, fmt.Sprintf("%s (disk %s, %dMiB)", part.Path, part.Disk, part.Size))
+		}
+		errs = multierror.Append(errs, fmt.Errorf(
+			"found %d %s partitions: %s. Set partition-selection to pick one of them",
+			len(candidates), name, strings.Join(listing, ", "),
+		))
+		return nil
+	}
+
+	ep.BIOS = pick(constants.BiosPartName, "")
+	ep.Boot = pick(constants.BootPartName, lm[constants.BootPartName])
+	ep.OEM = pick(constants.OEMPartName, lm[constants.OEMPartName])
+	ep.Recovery = pick(constants.RecoveryPartName, lm[constants.RecoveryPartName])
+	ep.State = pick(constants.StatePartName, lm[constants.StatePartName])
+	ep.Persistent = pick(constants.PersistentPartName, lm[constants.PersistentPartName])
+
+	return ep, errs
 }
 
 // PartitionsByInstallOrder sorts partitions according to the default layout
@@ -635,6 +1657,12 @@ func (ep ElementalPartitions) PartitionsByInstallOrder(extraPartitions Partition
 	if ep.State != nil && !inExcludes(ep.State, excludes...) {
 		partitions = append(partitions, ep.State)
 	}
+	if ep.Root != nil && !inExcludes(ep.Root, excludes...) {
+		partitions = append(partitions, ep.Root)
+	}
+	if ep.Var != nil && !inExcludes(ep.Var, excludes...) {
+		partitions = append(partitions, ep.Var)
+	}
 	if ep.Persistent != nil && !inExcludes(ep.Persistent, excludes...) {
 		// Check if we have to set this partition the latest due size == 0
 		if ep.Persistent.Size == 0 {
@@ -752,6 +1780,7 @@ type BuildConfig struct {
 	Date        bool              `yaml:"date,omitempty" mapstructure:"date"`
 	Name        string            `yaml:"name,omitempty" mapstructure:"name"`
 	OutDir      string            `yaml:"output,omitempty" mapstructure:"output"`
+	Overwrite   string            `yaml:"overwrite-policy,omitempty" mapstructure:"overwrite-policy"`
 	Snapshotter SnapshotterConfig `yaml:"snapshotter,omitempty" mapstructure:"snapshotter"`
 
 	// 'inline' and 'squash' labels ensure config fields
@@ -764,6 +1793,14 @@ type BuildConfig struct {
 func (b *BuildConfig) Sanitize() error {
 	// Always include default cloud-init paths
 	b.CloudInitPaths = append(constants.GetCloudInitPaths(), b.CloudInitPaths...)
+	switch b.Overwrite {
+	case "", constants.OverwriteArtifacts, constants.FailOnArtifacts, constants.RenameArtifacts:
+	default:
+		return fmt.Errorf(
+			"invalid overwrite policy '%s', valid policies are %s, %s and %s", b.Overwrite,
+			constants.OverwriteArtifacts, constants.FailOnArtifacts, constants.RenameArtifacts,
+		)
+	}
 	return b.Config.Sanitize()
 }
 
@@ -792,6 +1829,13 @@ func (d *DiskSpec) Sanitize() error {
 		d.RecoverySystem.Source = d.System
 	}
 
+	if d.Partitions.Var != nil {
+		return fmt.Errorf("a separate var partition is not supported for disk images")
+	}
+	if d.Partitions.Root != nil {
+		return fmt.Errorf("a separate root partition is not supported for disk images")
+	}
+
 	if d.RecoverySystem.FS == constants.SquashFs {
 		d.RecoverySystem.Label = ""
 	} else if d.RecoverySystem.Label == "" {
@@ -804,7 +1848,16 @@ func (d *DiskSpec) Sanitize() error {
 		return fmt.Errorf("Requested disk size (%dMB) is not enough, it should be, at least, of %d", d.Size, minSize)
 	}
 
-	return nil
+	// Disk images are always partitioned with sgdisk, thus GPT. Partition flags are not
+	// supported, the EFI partition type is set from its filesystem.
+	for _, part := range d.Partitions.PartitionsByInstallOrder(PartitionList{}) {
+		for _, flag := range part.Flags {
+			if flag != ESP {
+				return fmt.Errorf("partition flag '%s' is not supported for disk images, set a type GUID for partition '%s' instead", flag, part.Name)
+			}
+		}
+	}
+	return sanitizeTypeGUIDs(GPT, d.Partitions.PartitionsByInstallOrder(PartitionList{}))
 }
 
 // minDiskSize counts the minimum size (MB) required for the disk given the partitions setup
@@ -829,6 +1882,43 @@ type InstallState struct {
 	Date        string                     `yaml:"date,omitempty"`
 	Partitions  map[string]*PartitionState `yaml:",omitempty,inline"`
 	Snapshotter SnapshotterConfig          `yaml:"snapshotter,omitempty"`
+	Timings     []PhaseTiming              `yaml:"timings,omitempty"`
+	DbxUpdate   *DbxUpdateState            `yaml:"dbx-update,omitempty"`
+}
+
+// DbxUpdateState records the forbidden signatures database update applied on install
+type DbxUpdateState struct {
+	Source     string `yaml:"source,omitempty"`
+	Digest     string `yaml:"digest,omitempty"`
+	Timestamp  string `yaml:"timestamp,omitempty"`
+	Signatures int    `yaml:"signatures"`
+	Applied    int    `yaml:"applied"`
+}
+
+// UpgradeRecord is an entry of the upgrade history kept in the OEM partition
+type UpgradeRecord struct {
+	Date        string `json:"date"`
+	From        string `json:"from,omitempty"`
+	FromVersion string `json:"from-version,omitempty"`
+	To          string `json:"to"`
+	ToVersion   string `json:"to-version,omitempty"`
+	Digest      string `json:"digest,omitempty"`
+	Result      string `json:"result"`
+}
+
+// ImageVersion is the build information written into each deployed image, it includes
+// the same deployment data tracked in the installation state
+type ImageVersion struct {
+	Toolkit     string `yaml:"toolkit"`
+	GitCommit   string `yaml:"gitCommit,omitempty"`
+	Snapshotter string `yaml:"snapshotter,omitempty"`
+	SystemState `yaml:",inline"`
+}
+
+// PhaseTiming is the duration of a phase of the last action applied to the system
+type PhaseTiming struct {
+	Phase    string `yaml:"phase"`
+	Duration string `yaml:"duration"`
 }
 
 // PartState tracks installation data of a partition
@@ -842,10 +1932,14 @@ type PartitionState struct {
 type SystemState struct {
 	Source     *ImageSource      `yaml:"source,omitempty"`
 	Digest     string            `yaml:"digest,omitempty"`
+	Version    string            `yaml:"version,omitempty"` // OS version of the image, as set in its os-release file
 	Active     bool              `yaml:"active,omitempty"`
 	Label      string            `yaml:"label,omitempty"` // Only meaningful for the recovery image
 	FS         string            `yaml:"fs,omitempty"`    // Only meaningful for the recovery image
 	Labels     map[string]string `yaml:"labels,omitempty"`
 	Date       string            `yaml:"date,omitempty"`
 	FromAction string            `yaml:"fromAction,omitempty"`
+	SBOM       string            `yaml:"sbom,omitempty"`     // SBOM file in the OEM partition
+	Checksum   string            `yaml:"checksum,omitempty"` // '<algorithm>:<checksum>' of the image file, if any
+	Deployed   []string          `yaml:"deployed,omitempty"` // Files of the image written at deployment time
 }
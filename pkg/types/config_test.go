@@ -17,12 +17,15 @@ limitations under the License.
 package types_test
 
 import (
+	"bytes"
+	"os"
 	"path/filepath"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/twpayne/go-vfs/v4"
 	"github.com/twpayne/go-vfs/v4/vfst"
+	"gopkg.in/yaml.v3"
 
 	"github.com/rancher/elemental-toolkit/v2/pkg/config"
 	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
@@ -228,6 +231,77 @@ var _ = Describe("Types", Label("types", "config"), func() {
 			Expect(ep.State == nil).To(BeTrue())
 			Expect(ep.Recovery != nil).To(BeTrue())
 		})
+		Describe("picks the host partitions", Label("partition-selection"), func() {
+			var host types.PartitionList
+			BeforeEach(func() {
+				host = types.PartitionList{
+					{Name: "", FilesystemLabel: constants.StateLabel, Path: "/dev/sda4", Disk: "/dev/sda", Size: 8192},
+					{Name: "", FilesystemLabel: constants.StateLabel, Path: "/dev/sdb4", Disk: "/dev/sdb", Size: 4096, GUID: "3f2504e0-4f89-41d3-9a0c-0305e82c3301"},
+					{Name: "", FilesystemLabel: constants.OEMLabel, Path: "/dev/sda2", Disk: "/dev/sda"},
+					{Name: "", FilesystemLabel: constants.RecoveryLabel, Path: "/dev/sdc1", Disk: "/dev/sdc", FS: constants.RaidMemberFs},
+					{Name: "", FilesystemLabel: constants.RecoveryLabel, Path: "/dev/sdd1", Disk: "/dev/sdd", FS: constants.RaidMemberFs},
+				}
+			})
+			It("fails listing the candidates of duplicated partitions", func() {
+				_, err := types.PartitionSelection{}.ElementalPartitions(host, nil)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("found 2 state partitions"))
+				Expect(err.Error()).To(ContainSubstring("/dev/sda4 (disk /dev/sda, 8192MiB), /dev/sdb4 (disk /dev/sdb, 4096MiB)"))
+			})
+			It("picks the partitions of the selected disk", func() {
+				ep, err := types.PartitionSelection{Disk: "/dev/sdb"}.ElementalPartitions(host, nil)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ep.State.Path).To(Equal("/dev/sdb4"))
+				Expect(ep.OEM).To(BeNil())
+			})
+			It("picks the partitions by path", func() {
+				ep, err := types.PartitionSelection{
+					Paths: map[string]string{constants.StatePartName: "/dev/sda4"},
+				}.ElementalPartitions(host, nil)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ep.State.Path).To(Equal("/dev/sda4"))
+				Expect(ep.OEM.Path).To(Equal("/dev/sda2"))
+				// RAID members are not candidates
+				Expect(ep.Recovery).To(BeNil())
+			})
+			It("fails if the selected path is not found", func() {
+				_, err := types.PartitionSelection{
+					Paths: map[string]string{constants.StatePartName: "/dev/sde4"},
+				}.ElementalPartitions(host, nil)
+				Expect(err).To(MatchError(ContainSubstring("state partition /dev/sde4 not found")))
+			})
+			It("fails on unknown partition names", func() {
+				selection := types.PartitionSelection{Paths: map[string]string{"data": "/dev/sda5"}}
+				Expect(selection.Sanitize()).To(MatchError(ContainSubstring("unknown partition 'data'")))
+			})
+			It("picks the partitions by GUID", Label("guid"), func() {
+				selection := types.PartitionSelection{
+					GUIDs: map[string]string{constants.StatePartName: "3F2504E0-4F89-41D3-9A0C-0305E82C3301"},
+				}
+				Expect(selection.Sanitize()).To(Succeed())
+				ep, err := selection.ElementalPartitions(host, nil)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ep.State.Path).To(Equal("/dev/sdb4"))
+				Expect(ep.OEM.Path).To(Equal("/dev/sda2"))
+			})
+			It("fails if the selected GUID is not found", Label("guid"), func() {
+				_, err := types.PartitionSelection{
+					GUIDs: map[string]string{constants.OEMPartName: "8c5b2f0e-7e2a-4a5b-9d1e-2f4a6b8c0d1e"},
+				}.ElementalPartitions(host, nil)
+				Expect(err).To(MatchError(ContainSubstring("oem partition with GUID 8c5b2f0e-7e2a-4a5b-9d1e-2f4a6b8c0d1e not found")))
+			})
+			It("fails on invalid GUID selections", Label("guid"), func() {
+				selection := types.PartitionSelection{GUIDs: map[string]string{constants.StatePartName: "sdb4"}}
+				Expect(selection.Sanitize()).To(MatchError(ContainSubstring("invalid GUID 'sdb4'")))
+
+				selection.GUIDs = map[string]string{"data": "3f2504e0-4f89-41d3-9a0c-0305e82c3301"}
+				Expect(selection.Sanitize()).To(MatchError(ContainSubstring("unknown partition 'data'")))
+
+				selection.GUIDs = map[string]string{constants.StatePartName: "3f2504e0-4f89-41d3-9a0c-0305e82c3301"}
+				selection.Paths = map[string]string{constants.StatePartName: "/dev/sdb4"}
+				Expect(selection.Sanitize()).To(MatchError(ContainSubstring("selected both by path and by GUID")))
+			})
+		})
 		Describe("returns a partition list by install order", func() {
 			It("with no extra parts", func() {
 				ep := types.NewElementalPartitionsFromList(p, nil)
@@ -364,6 +438,264 @@ var _ = Describe("Types", Label("types", "config"), func() {
 			Expect(p.GetByName("nonexistent")).To(BeNil())
 		})
 	})
+	Describe("RunConfig", func() {
+		var cfg *types.RunConfig
+		BeforeEach(func() {
+			cfg = config.NewRunConfig(config.WithMounter(v1mocks.NewFakeMounter()))
+		})
+		Describe("sanitize", Label("persistent-space"), func() {
+			It("cleans persistent cache paths", func() {
+				cfg.PrunePersistentOnUpgrade = true
+				cfg.PersistentCachePaths = []string{"/var/cache/", "var/lib/containerd/./tmp"}
+				Expect(cfg.Sanitize()).To(Succeed())
+				Expect(cfg.PersistentCachePaths).To(Equal([]string{"var/cache", "var/lib/containerd/tmp"}))
+			})
+			It("fails on pruning without cache paths", func() {
+				cfg.PrunePersistentOnUpgrade = true
+				Expect(cfg.Sanitize()).NotTo(Succeed())
+			})
+			It("fails on cache paths out of the persistent partition", func() {
+				for _, path := range []string{"/", "../etc", "var/../.."} {
+					cfg.PersistentCachePaths = []string{path}
+					Expect(cfg.Sanitize()).NotTo(Succeed(), path)
+				}
+			})
+		})
+		Describe("sanitize", Label("webhook"), func() {
+			It("accepts an http webhook URL", func() {
+				cfg.WebhookURL = "https://dashboard.example.org/events"
+				Expect(cfg.Sanitize()).To(Succeed())
+			})
+			It("fails on non http webhook URLs", func() {
+				for _, u := range []string{"dashboard.example.org", "ftp://dashboard.example.org", "http://"} {
+					cfg.WebhookURL = u
+					Expect(cfg.Sanitize()).NotTo(Succeed(), u)
+				}
+			})
+			It("fails on a negative reboot delay", Label("reboot"), func() {
+				cfg.RebootDelay = -1
+				Expect(cfg.Sanitize()).NotTo(Succeed())
+			})
+		})
+	})
+	Describe("Config", func() {
+		var cfg *types.Config
+
+		BeforeEach(func() {
+			cfg = config.NewConfig(config.WithMounter(v1mocks.NewFakeMounter()))
+		})
+		Describe("sanitize", Label("concurrency"), func() {
+			It("accepts the stage concurrency modes", func() {
+				cfg.StageConcurrency = map[string]string{
+					"network":         constants.StageSequential,
+					"initramfs.after": constants.StageParallel,
+				}
+				Expect(cfg.Sanitize()).To(Succeed())
+			})
+			It("fails on unknown stage concurrency modes", func() {
+				cfg.StageConcurrency = map[string]string{"network": "random"}
+				Expect(cfg.Sanitize()).To(MatchError(ContainSubstring("unknown concurrency mode 'random' for stage 'network'")))
+			})
+		})
+		Describe("sanitize", Label("mkfs-args"), func() {
+			It("accepts custom mkfs arguments", func() {
+				cfg.MkfsArgs = map[string][]string{
+					"ext4":             {"-i", "8192"},
+					"xfs":              {"-d", "agcount=4", "-m", "crc=1"},
+					constants.SquashFs: {"-Xbcj", "x86"},
+				}
+				Expect(cfg.Sanitize()).To(Succeed())
+			})
+			It("fails on reserved mkfs arguments", func() {
+				cfg.MkfsArgs = map[string][]string{"ext4": {"-i", "8192", "-L", "MYLABEL"}}
+				Expect(cfg.Sanitize()).NotTo(Succeed())
+
+				cfg.MkfsArgs = map[string][]string{constants.Btrfs: {"--label=MYLABEL"}}
+				Expect(cfg.Sanitize()).NotTo(Succeed())
+
+				cfg.MkfsArgs = map[string][]string{constants.SquashFs: {"-e", "/tmp"}}
+				Expect(cfg.Sanitize()).NotTo(Succeed())
+			})
+			It("fails on mkfs arguments setting the filesystem UUID", Label("fs-uuid"), func() {
+				cfg.MkfsArgs = map[string][]string{"ext4": {"-U", "random"}}
+				Expect(cfg.Sanitize()).NotTo(Succeed())
+
+				cfg.MkfsArgs = map[string][]string{"xfs": {"-m", "crc=1,uuid=3f4d7ab2-0c1e-4b4e-9a51-6c7d8e9f0a1b"}}
+				Expect(cfg.Sanitize()).NotTo(Succeed())
+
+				cfg.MkfsArgs = map[string][]string{constants.BootFs: {"-i", "ABCD1234"}}
+				Expect(cfg.Sanitize()).NotTo(Succeed())
+			})
+			It("fails on mkfs arguments for unsupported filesystems", func() {
+				cfg.MkfsArgs = map[string][]string{"zfs": {"-o", "ashift=12"}}
+				Expect(cfg.Sanitize()).NotTo(Succeed())
+			})
+		})
+		Describe("config permissions", Label("secure-perms"), func() {
+			It("uses the default permissions unless secure ones are set", func() {
+				Expect(cfg.ConfigFilePerm()).To(Equal(os.FileMode(constants.FilePerm)))
+				Expect(cfg.ConfigDirPerm()).To(Equal(constants.DirPerm))
+				cfg.SecureConfigPerms = true
+				Expect(cfg.ConfigFilePerm().Perm()).To(Equal(os.FileMode(0600)))
+				Expect(cfg.ConfigDirPerm().Perm()).To(Equal(os.FileMode(0700)))
+				Expect(cfg.ConfigDirPerm().IsDir()).To(BeTrue())
+			})
+		})
+		Describe("sanitize", Label("checksum"), func() {
+			It("defaults to sha256", func() {
+				cfg.ChecksumAlgo = ""
+				Expect(cfg.Sanitize()).To(Succeed())
+				Expect(cfg.ChecksumAlgo).To(Equal(constants.SHA256))
+			})
+			It("accepts sha512", func() {
+				cfg.ChecksumAlgo = constants.SHA512
+				Expect(cfg.Sanitize()).To(Succeed())
+				Expect(cfg.ChecksumAlgo).To(Equal(constants.SHA512))
+			})
+			It("fails on unsupported checksum algorithms", func() {
+				cfg.ChecksumAlgo = "blake3"
+				Expect(cfg.Sanitize()).To(MatchError(ContainSubstring("unsupported checksum algorithm")))
+			})
+		})
+		Describe("default boot target", Label("boot-target"), func() {
+			It("accepts systemd target units", func() {
+				cfg.DefaultBootTarget = "multi-user.target"
+				Expect(cfg.Sanitize()).To(Succeed())
+			})
+			It("fails on other unit names", func() {
+				for _, target := range []string{"sshd.service", "../../tmp/x.target"} {
+					cfg.DefaultBootTarget = target
+					Expect(cfg.Sanitize()).To(MatchError(ContainSubstring("invalid default boot target")))
+				}
+			})
+		})
+		It("fails on a relative download directory", Label("download-dir"), func() {
+			cfg.DownloadDir = "downloads"
+			Expect(cfg.Sanitize()).To(MatchError(ContainSubstring("download-dir must be an absolute path")))
+			cfg.DownloadDir = "/var/elemental/downloads"
+			Expect(cfg.Sanitize()).To(Succeed())
+		})
+		Describe("HTTP headers", Label("http-headers"), func() {
+			It("sets the headers of the HTTP client", func() {
+				client := &v1mocks.FakeHTTPClient{}
+				cfg.Client = client
+				cfg.HTTPHeaders = types.HTTPHeaderScopes{{
+					URL:     "https://artifacts.example.com",
+					Headers: types.HTTPHeaders{"Authorization": "Bearer s3cr3t", "X-Api-Key": "k3y"},
+				}}
+				Expect(cfg.Sanitize()).To(Succeed())
+				Expect(client.Headers).To(Equal(cfg.HTTPHeaders))
+			})
+			It("fails on invalid header names or values", func() {
+				scope := func(headers types.HTTPHeaders) types.HTTPHeaderScopes {
+					return types.HTTPHeaderScopes{{URL: "https://artifacts.example.com", Headers: headers}}
+				}
+				cfg.HTTPHeaders = scope(types.HTTPHeaders{"Bad Header": "value"})
+				Expect(cfg.Sanitize()).To(MatchError(ContainSubstring("invalid HTTP header name")))
+				cfg.HTTPHeaders = scope(types.HTTPHeaders{"X-Api-Key": "k3y\r\nHost: evil"})
+				Expect(cfg.Sanitize()).To(MatchError(ContainSubstring("invalid value of HTTP header")))
+				cfg.HTTPHeaders = scope(types.HTTPHeaders{"X-Api-Key": "<redacted>"})
+				Expect(cfg.Sanitize()).To(MatchError(ContainSubstring("value of HTTP header 'X-Api-Key' is redacted")))
+			})
+			It("fails on scopes which are not http URLs", func() {
+				for _, url := range []string{"", "artifacts.example.com", "ftp://artifacts.example.com", "https://artifacts.example.com/?a=b"} {
+					cfg.HTTPHeaders = types.HTTPHeaderScopes{{URL: url, Headers: types.HTTPHeaders{"X-Api-Key": "k3y"}}}
+					Expect(cfg.Sanitize()).To(MatchError(ContainSubstring("invalid HTTP headers URL")), url)
+				}
+			})
+			It("returns the headers of the scopes including a URL", func() {
+				scopes := types.HTTPHeaderScopes{
+					{URL: "https://artifacts.example.com", Headers: types.HTTPHeaders{"Authorization": "Bearer all", "X-Api-Key": "k3y"}},
+					{URL: "https://ARTIFACTS.example.com/private/", Headers: types.HTTPHeaders{"Authorization": "Bearer private"}},
+				}
+				Expect(scopes.For("https://artifacts.example.com/iso/os.iso")).To(Equal(types.HTTPHeaders{
+					"Authorization": "Bearer all", "X-Api-Key": "k3y",
+				}))
+				Expect(scopes.For("https://artifacts.example.com/private/os.iso")).To(Equal(types.HTTPHeaders{
+					"Authorization": "Bearer private", "X-Api-Key": "k3y",
+				}))
+				Expect(scopes.For("https://artifacts.example.com/private")).To(HaveKeyWithValue("Authorization", "Bearer private"))
+				Expect(scopes.For("https://artifacts.example.com/privateer")).To(HaveKeyWithValue("Authorization", "Bearer all"))
+				Expect(scopes.For("http://artifacts.example.com/iso/os.iso")).To(BeEmpty())
+				Expect(scopes.For("https://artifacts.example.com:8443/iso/os.iso")).To(BeEmpty())
+				Expect(scopes.For("https://artifacts.example.com.evil.org/iso/os.iso")).To(BeEmpty())
+			})
+			It("does not dump or marshal the header values", func() {
+				headers := types.HTTPHeaders{"Authorization": "Bearer s3cr3t"}
+				buf := &bytes.Buffer{}
+				headers.LitterDump(buf)
+				Expect(buf.String()).To(ContainSubstring("Authorization"))
+				Expect(buf.String()).NotTo(ContainSubstring("s3cr3t"))
+				data, err := yaml.Marshal(types.Config{HTTPHeaders: types.HTTPHeaderScopes{{URL: "https://artifacts.example.com", Headers: headers}}})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).To(ContainSubstring("Authorization"))
+				Expect(string(data)).NotTo(ContainSubstring("s3cr3t"))
+			})
+		})
+		Describe("bootloader", Label("bootloader"), func() {
+			It("defaults to grub", func() {
+				Expect(cfg.Sanitize()).To(Succeed())
+				Expect(cfg.Bootloader).To(Equal(constants.BootloaderGrub))
+			})
+			It("accepts none with a kernel install path", func() {
+				cfg.Bootloader = constants.BootloaderNone
+				cfg.KernelInstallPath = "/EFI/elemental"
+				Expect(cfg.Sanitize()).To(Succeed())
+			})
+			It("fails on none without a kernel install path", func() {
+				cfg.Bootloader = constants.BootloaderNone
+				Expect(cfg.Sanitize()).To(MatchError(ContainSubstring("kernel-install-path is required")))
+			})
+			It("fails on unknown bootloaders", func() {
+				cfg.Bootloader = "syslinux"
+				Expect(cfg.Sanitize()).To(MatchError(ContainSubstring("unknown bootloader")))
+			})
+		})
+		Describe("verification failure policy", Label("verify-failure"), func() {
+			It("defaults to abort-delete", func() {
+				Expect(cfg.Sanitize()).To(Succeed())
+				Expect(cfg.OnVerifyFailure).To(Equal(constants.VerifyDelete))
+			})
+			It("accepts quarantine", func() {
+				cfg.OnVerifyFailure = constants.VerifyQuarantine
+				Expect(cfg.Sanitize()).To(Succeed())
+			})
+			It("fails on unknown policies", func() {
+				cfg.OnVerifyFailure = "ignore"
+				Expect(cfg.Sanitize()).To(MatchError(ContainSubstring("unknown verification failure policy")))
+			})
+		})
+		Describe("compression level", Label("compression-level"), func() {
+			It("accepts levels within the compressor range", func() {
+				cfg.CompressionLevel = map[string]int{constants.RecoveryArtifact: 9}
+				Expect(cfg.Sanitize()).To(Succeed())
+
+				cfg.SquashFsCompressionConfig = []string{"-comp zstd"}
+				cfg.CompressionLevel = map[string]int{constants.RecoveryArtifact: 3, constants.ISOArtifact: 22}
+				Expect(cfg.Sanitize()).To(Succeed())
+			})
+			It("fails on levels out of the compressor range", func() {
+				cfg.CompressionLevel = map[string]int{constants.ISOArtifact: 10}
+				Expect(cfg.Sanitize()).To(MatchError(ContainSubstring("out of the gzip range")))
+			})
+			It("fails on compressors without levels and unknown artifacts", func() {
+				cfg.SquashFsCompressionConfig = []string{"-comp", "xz"}
+				cfg.CompressionLevel = map[string]int{constants.ISOArtifact: 1}
+				Expect(cfg.Sanitize()).NotTo(Succeed())
+
+				cfg.SquashFsCompressionConfig = []string{}
+				cfg.CompressionLevel = map[string]int{"snapshot": 1}
+				Expect(cfg.Sanitize()).NotTo(Succeed())
+			})
+			It("sets the level of the given artifact only", func() {
+				cfg.CompressionLevel = map[string]int{constants.ISOArtifact: 1}
+				Expect(cfg.ForArtifact(constants.ISOArtifact).SquashFsCompressionConfig).To(Equal([]string{
+					"-b", "1024k", "-Xcompression-level", "1",
+				}))
+				Expect(cfg.ForArtifact(constants.RecoveryArtifact).SquashFsCompressionConfig).To(Equal([]string{"-b", "1024k"}))
+			})
+		})
+	})
 	Describe("InstallSpec", func() {
 		var spec *types.InstallSpec
 
@@ -372,6 +704,29 @@ var _ = Describe("Types", Label("types", "config"), func() {
 			spec = config.NewInstallSpec(*cfg)
 		})
 		Describe("sanitize", func() {
+			It("sets the partition mountpoints under the root mountpoint", Label("skip-partitioning"), func() {
+				spec.System = types.NewDirSrc("/dir")
+				spec.SkipPartitioning = true
+				spec.RootMountPoint = "/mnt/target"
+				Expect(spec.Sanitize()).To(Succeed())
+				Expect(spec.Partitions.Boot.MountPoint).To(Equal("/mnt/target/efi"))
+				Expect(spec.Partitions.State.MountPoint).To(Equal("/mnt/target/state"))
+				Expect(spec.Partitions.OEM.MountPoint).To(Equal("/mnt/target/oem"))
+				Expect(spec.RecoverySystem.File).To(Equal("/mnt/target/recovery/boot/recovery.img"))
+
+				// Sanitize can be called more than once
+				Expect(spec.Sanitize()).To(Succeed())
+				Expect(spec.Partitions.State.MountPoint).To(Equal("/mnt/target/state"))
+			})
+			It("fails on invalid root mountpoints", Label("skip-partitioning"), func() {
+				spec.System = types.NewDirSrc("/dir")
+				spec.RootMountPoint = "/mnt/target"
+				Expect(spec.Sanitize()).NotTo(Succeed())
+
+				spec.SkipPartitioning = true
+				spec.RootMountPoint = "mnt/target"
+				Expect(spec.Sanitize()).NotTo(Succeed())
+			})
 			It("runs method", func() {
 				Expect(spec.Partitions.Boot).ToNot(BeNil())
 				Expect(spec.System.IsEmpty()).To(BeTrue())
@@ -425,6 +780,397 @@ var _ = Describe("Types", Label("types", "config"), func() {
 					Expect(err).ToNot(HaveOccurred())
 				})
 			})
+			Describe("with RAID disks", Label("raid"), func() {
+				BeforeEach(func() {
+					spec.System = types.NewDirSrc("/dir")
+				})
+				It("sets the default RAID device and level", func() {
+					spec.RaidDisks = []string{"/dev/sda", "/dev/sdb"}
+					Expect(spec.Sanitize()).To(Succeed())
+					Expect(spec.Target).To(Equal(constants.RaidDevice))
+					Expect(spec.RaidLevel).To(Equal(constants.RaidLevel))
+					Expect(spec.IsRaid()).To(BeTrue())
+				})
+				It("fails with a single RAID disk", func() {
+					spec.RaidDisks = []string{"/dev/sda"}
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+			})
+			Describe("with filesystem UUIDs", Label("fs-uuid"), func() {
+				BeforeEach(func() {
+					spec.System = types.NewDirSrc("/dir")
+				})
+				It("accepts well formed UUIDs and FAT volume IDs", func() {
+					spec.Partitions.State.FSUUID = "3f4d7ab2-0c1e-4b4e-9a51-6c7d8e9f0a1b"
+					spec.Partitions.Boot.FSUUID = "ABCD-1234"
+					Expect(spec.Sanitize()).To(Succeed())
+				})
+				It("fails on malformed UUIDs", func() {
+					spec.Partitions.State.FSUUID = "not-a-uuid"
+					Expect(spec.Sanitize()).NotTo(Succeed())
+
+					spec.Partitions.State.FSUUID = ""
+					spec.Partitions.Boot.FSUUID = "3f4d7ab2-0c1e-4b4e-9a51-6c7d8e9f0a1b"
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+				It("fails on duplicated UUIDs", func() {
+					spec.Partitions.State.FSUUID = "3f4d7ab2-0c1e-4b4e-9a51-6c7d8e9f0a1b"
+					spec.Partitions.OEM.FSUUID = "3F4D7AB2-0C1E-4B4E-9A51-6C7D8E9F0A1B"
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+				It("fails on filesystems not supporting UUIDs", func() {
+					spec.ExtraPartitions = types.PartitionList{
+						{Name: "extra", Size: 10, FSUUID: "3f4d7ab2-0c1e-4b4e-9a51-6c7d8e9f0a1b"},
+					}
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+			})
+			Describe("with an overlay backend", Label("overlay"), func() {
+				BeforeEach(func() {
+					spec.System = types.NewDirSrc("/dir")
+				})
+				It("accepts a sized tmpfs overlay", func() {
+					spec.Overlay = types.OverlaySpec{Backend: constants.Tmpfs, Size: "512M"}
+					Expect(spec.Sanitize()).To(Succeed())
+					spec.Overlay.Size = "30%"
+					Expect(spec.Sanitize()).To(Succeed())
+				})
+				It("fails on unknown backends", func() {
+					spec.Overlay = types.OverlaySpec{Backend: "nfs"}
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+				It("fails to set a size for a persistent overlay", func() {
+					spec.Overlay = types.OverlaySpec{Backend: constants.PersistentOverlay, Size: "1G"}
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+				It("fails on invalid sizes", func() {
+					spec.Overlay = types.OverlaySpec{Backend: constants.Tmpfs, Size: "120%"}
+					Expect(spec.Sanitize()).NotTo(Succeed())
+					spec.Overlay.Size = "1T"
+					Expect(spec.Sanitize()).NotTo(Succeed())
+					spec.Overlay.Size = "0"
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+			})
+			Describe("with time sync", Label("time"), func() {
+				BeforeEach(func() {
+					spec.System = types.NewDirSrc("/dir")
+				})
+				It("accepts an NTP server and a timezone", func() {
+					spec.TimeSync = types.TimeSyncSpec{NTPServer: "pool.ntp.org", Timezone: "Europe/Berlin"}
+					Expect(spec.Sanitize()).To(Succeed())
+				})
+				It("fails with both NTP server and timestamp", func() {
+					spec.TimeSync = types.TimeSyncSpec{NTPServer: "pool.ntp.org", Timestamp: "2025-01-01T00:00:00Z"}
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+				It("fails on invalid timestamps and timezones", func() {
+					spec.TimeSync = types.TimeSyncSpec{Timestamp: "yesterday"}
+					Expect(spec.Sanitize()).NotTo(Succeed())
+					spec.TimeSync = types.TimeSyncSpec{Timezone: "../../etc/shadow"}
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+			})
+			Describe("with a layout policy", Label("layout-policy"), func() {
+				BeforeEach(func() {
+					spec.System = types.NewDirSrc("/dir")
+					spec.PartTable = types.GPT
+					spec.Partitions.State.Size = 8192
+				})
+				It("accepts a compliant layout", func() {
+					spec.LayoutPolicy = types.LayoutPolicy{
+						PartTables:         []string{types.GPT},
+						RequiredPartitions: []string{constants.OEMPartName, constants.PersistentPartName},
+						MinSizes:           map[string]uint{constants.StatePartName: 8192, constants.PersistentPartName: 4096},
+					}
+					Expect(spec.Sanitize()).To(Succeed())
+				})
+				It("fails on a not allowed partition table", func() {
+					spec.LayoutPolicy.PartTables = []string{types.GPT}
+					spec.PartTable = types.MSDOS
+					err := spec.Sanitize()
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("'part-tables'"))
+				})
+				It("fails on missing required partitions", func() {
+					spec.LayoutPolicy.RequiredPartitions = []string{constants.OEMPartName}
+					spec.Partitions.OEM = nil
+					err := spec.Sanitize()
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("'required-partitions'"))
+				})
+				It("fails on undersized partitions", func() {
+					spec.LayoutPolicy.MinSizes = map[string]uint{constants.StatePartName: 10240}
+					err := spec.Sanitize()
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("'min-sizes'"))
+				})
+				It("is not applied if partitioning is skipped", func() {
+					spec.LayoutPolicy.PartTables = []string{types.MSDOS}
+					spec.NoFormat = true
+					Expect(spec.Sanitize()).To(Succeed())
+				})
+			})
+			Describe("with a trim policy", Label("trim"), func() {
+				BeforeEach(func() {
+					spec.System = types.NewDirSrc("/dir")
+				})
+				It("defaults to trim non-rotational disks only", func() {
+					spec.TrimAfterInstall = ""
+					Expect(spec.Sanitize()).To(Succeed())
+					Expect(spec.TrimAfterInstall).To(Equal(constants.TrimAuto))
+				})
+				It("fails on unknown policies", func() {
+					spec.TrimAfterInstall = "sometimes"
+					Expect(spec.Sanitize()).To(MatchError(ContainSubstring("unknown trim-after-install policy")))
+				})
+			})
+			Describe("with an /etc mode", Label("etc-mode"), func() {
+				BeforeEach(func() {
+					spec.System = types.NewDirSrc("/dir")
+				})
+				It("sets the matching overlay backend", func() {
+					spec.EtcMode = constants.ImmutableEtc
+					Expect(spec.Sanitize()).To(Succeed())
+					Expect(spec.Overlay.Backend).To(Equal(constants.ImmutableEtc))
+
+					spec.EtcMode = constants.PersistentOverlay
+					spec.Overlay.Backend = ""
+					Expect(spec.Sanitize()).To(Succeed())
+					Expect(spec.Overlay.Backend).To(Equal(constants.PersistentOverlay))
+				})
+				It("keeps the default layout for the overlay mode", func() {
+					spec.EtcMode = constants.OverlayMode
+					Expect(spec.Sanitize()).To(Succeed())
+					Expect(spec.Overlay.Backend).To(BeEmpty())
+				})
+				It("fails on an unknown mode", func() {
+					spec.EtcMode = "readonly"
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+				It("fails on an inconsistent overlay backend", func() {
+					spec.EtcMode = constants.PersistentOverlay
+					spec.Overlay.Backend = constants.Tmpfs
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+				It("fails to persist /etc without a suitable persistent partition", func() {
+					spec.EtcMode = constants.PersistentOverlay
+					spec.Partitions.Persistent.FS = "vfat"
+					Expect(spec.Sanitize()).NotTo(Succeed())
+					spec.Partitions.Persistent = nil
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+			})
+			Describe("with device types", Label("device-type"), func() {
+				BeforeEach(func() {
+					spec.System = types.NewDirSrc("/dir")
+				})
+				It("accepts known device types", func() {
+					spec.PreferDeviceType = constants.DiskTypeSSD
+					spec.ExcludeDeviceTypes = []string{constants.DiskTypeOptane, constants.DiskTypeNVDIMM}
+					Expect(spec.Sanitize()).To(Succeed())
+				})
+				It("fails on unknown device types", func() {
+					spec.PreferDeviceType = "floppy"
+					Expect(spec.Sanitize()).To(MatchError(ContainSubstring("unknown device type")))
+					spec.PreferDeviceType = ""
+					spec.ExcludeDeviceTypes = []string{"tape"}
+					Expect(spec.Sanitize()).To(MatchError(ContainSubstring("unknown device type")))
+				})
+				It("fails if the preferred device type is excluded", func() {
+					spec.PreferDeviceType = constants.DiskTypeHDD
+					spec.ExcludeDeviceTypes = []string{constants.DiskTypeHDD}
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+			})
+			Describe("with a var partition", Label("var"), func() {
+				BeforeEach(func() {
+					spec.System = types.NewDirSrc("/dir")
+				})
+				It("sets the var partition defaults", func() {
+					spec.Partitions.Var = &types.Partition{Size: 2048}
+					Expect(spec.Sanitize()).To(Succeed())
+					Expect(spec.Partitions.Var.Name).To(Equal(constants.VarPartName))
+					Expect(spec.Partitions.Var.FilesystemLabel).To(Equal(constants.VarLabel))
+					Expect(spec.Partitions.Var.FS).To(Equal(constants.LinuxFs))
+					Expect(spec.Partitions.Var.MountPoint).To(Equal(constants.VarDir))
+					Expect(spec.Partitions.PartitionsByInstallOrder(types.PartitionList{})).To(ContainElement(spec.Partitions.Var))
+				})
+				It("fails without a var partition size", func() {
+					spec.Partitions.Var = &types.Partition{}
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+				It("fails on an unsupported filesystem", func() {
+					spec.Partitions.Var = &types.Partition{Size: 2048, FS: "vfat"}
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+				It("fails without an OEM partition", func() {
+					spec.Partitions.Var = &types.Partition{Size: 2048}
+					spec.Partitions.OEM = nil
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+			})
+			Describe("with a root partition", Label("root"), func() {
+				BeforeEach(func() {
+					spec.System = types.NewDirSrc("/dir")
+				})
+				It("sets the root partition defaults", func() {
+					spec.Partitions.Root = &types.Partition{Size: 4096}
+					Expect(spec.Sanitize()).To(Succeed())
+					Expect(spec.Partitions.Root.Name).To(Equal(constants.RootPartName))
+					Expect(spec.Partitions.Root.FilesystemLabel).To(Equal(constants.RootLabel))
+					Expect(spec.Partitions.Root.FS).To(Equal(constants.LinuxFs))
+					Expect(spec.Partitions.Root.MountPoint).To(Equal(constants.RootDir))
+					Expect(spec.Partitions.PartitionsByInstallOrder(types.PartitionList{})).To(ContainElement(spec.Partitions.Root))
+				})
+				It("fails without a root partition size", func() {
+					spec.Partitions.Root = &types.Partition{}
+					Expect(spec.Sanitize()).To(MatchError(ContainSubstring("root partition requires a size")))
+				})
+				It("fails without an OEM partition", func() {
+					spec.Partitions.Root = &types.Partition{Size: 4096}
+					spec.Partitions.OEM = nil
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+			})
+			Describe("with partition type GUIDs", Label("type-guid"), func() {
+				BeforeEach(func() {
+					spec.System = types.NewDirSrc("/dir")
+				})
+				It("accepts valid type GUIDs on GPT", func() {
+					spec.PartTable = types.GPT
+					spec.Partitions.State.TypeGUID = "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709"
+					Expect(spec.Sanitize()).To(Succeed())
+				})
+				It("fails on malformed type GUIDs", func() {
+					spec.PartTable = types.GPT
+					spec.Partitions.State.TypeGUID = "not-a-guid"
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+				It("fails on type GUIDs for msdos partition tables", func() {
+					spec.PartTable = types.MSDOS
+					spec.Partitions.State.TypeGUID = "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709"
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+			})
+			Describe("with partition flags", Label("flags"), func() {
+				BeforeEach(func() {
+					spec.System = types.NewDirSrc("/dir")
+				})
+				It("maps flag names to parted flags", func() {
+					spec.Partitions.State.Flags = []string{"legacy-boot", "HIDDEN", "legacy_boot"}
+					spec.ExtraPartitions = types.PartitionList{{Name: "swap", Size: 1024, Flags: []string{"swap"}}}
+					Expect(spec.Sanitize()).To(Succeed())
+					Expect(spec.Partitions.State.Flags).To(Equal([]string{"legacy_boot", "hidden"}))
+					Expect(spec.ExtraPartitions[0].Flags).To(Equal([]string{"swap"}))
+					Expect(spec.Partitions.Boot.Flags).To(Equal([]string{types.ESP}))
+				})
+				It("fails on unknown flags", func() {
+					spec.Partitions.OEM.Flags = []string{"bootable"}
+					Expect(spec.Sanitize()).To(MatchError(ContainSubstring("unknown flag 'bootable'")))
+				})
+			})
+			Describe("with recovery derived from the active system", Label("recovery"), func() {
+				BeforeEach(func() {
+					spec.System = types.NewDirSrc("/dir")
+					spec.RecoveryFromActive = true
+				})
+				It("accepts valid filter expressions", func() {
+					spec.RecoveryExcludes = []string{"^/usr/share/doc"}
+					spec.RecoveryIncludes = []string{"^/usr/share/doc/keep"}
+					Expect(spec.Sanitize()).To(Succeed())
+					includes, excludes, err := spec.RecoveryFilters()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(includes).To(HaveLen(1))
+					Expect(excludes).To(HaveLen(1))
+				})
+				It("fails on an invalid filter expression", func() {
+					spec.RecoveryExcludes = []string{"^/usr/(share"}
+					err := spec.Sanitize()
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("invalid recovery filter expression"))
+				})
+				It("fails if a different recovery source is set", func() {
+					spec.RecoverySystem.Source = types.NewDockerSrc("some/image:latest")
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+				It("fails on filter expressions without recovery-from-active", func() {
+					spec.RecoveryFromActive = false
+					spec.RecoveryExcludes = []string{"^/usr/share/doc"}
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+			})
+			Describe("with an SBOM format", Label("sbom"), func() {
+				It("fails on unknown SBOM formats", func() {
+					spec.System = types.NewDirSrc("/dir")
+					spec.SBOM = constants.CycloneDXFormat
+					Expect(spec.Sanitize()).To(Succeed())
+					spec.SBOM = "swid"
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+			})
+			Describe("with OEM sources", Label("oem-sources"), func() {
+				BeforeEach(func() {
+					spec.System = types.NewDirSrc("/dir")
+				})
+				It("accepts a list of OEM sources", func() {
+					spec.OEMSources = []*types.ImageSource{types.NewDockerSrc("my/oem:base"), types.NewDirSrc("/oem-extra")}
+					Expect(spec.Sanitize()).To(Succeed())
+				})
+				It("fails on empty sources", func() {
+					spec.OEMSources = []*types.ImageSource{types.NewEmptySrc()}
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+				It("fails without an OEM partition", func() {
+					spec.OEMSources = []*types.ImageSource{types.NewDockerSrc("my/oem:base")}
+					spec.Partitions.OEM = nil
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+			})
+			Describe("with users", Label("users"), func() {
+				BeforeEach(func() {
+					spec.System = types.NewDirSrc("/dir")
+				})
+				It("accepts users with a password hash", func() {
+					spec.Users = []types.User{{Name: "admin", PasswordHash: "$6$salt$c2VjcmV0aGFzaA"}}
+					Expect(spec.Sanitize()).To(Succeed())
+				})
+				It("fails on plain text passwords without printing them", func() {
+					spec.Users = []types.User{{Name: "admin", PasswordHash: "s3cr3t"}}
+					err := spec.Sanitize()
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).NotTo(ContainSubstring("s3cr3t"))
+				})
+				It("fails on invalid user names", func() {
+					spec.Users = []types.User{{Name: "Admin:0"}}
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+				It("fails without an OEM partition", func() {
+					spec.Users = []types.User{{Name: "admin"}}
+					spec.Partitions.OEM = nil
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+				It("accepts grub and recovery password hashes", Label("password"), func() {
+					spec.GrubPasswordHash = "grub.pbkdf2.sha512.10000.AB12.CD34"
+					spec.RecoveryPassHash = "$6$rounds=4096$salt$hash"
+					Expect(spec.Sanitize()).To(Succeed())
+				})
+				It("fails on plain text grub and recovery passwords", Label("password"), func() {
+					spec.GrubPasswordHash = "s3cr3t"
+					Expect(spec.Sanitize()).NotTo(Succeed())
+					spec.GrubPasswordHash = ""
+					spec.RecoveryPassHash = "s3cr3t"
+					Expect(spec.Sanitize()).NotTo(Succeed())
+					spec.RecoveryPassHash = "$6$salt$hash' root; rm -rf /"
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+				It("does not dump the password hash", func() {
+					buf := &bytes.Buffer{}
+					types.User{Name: "admin", PasswordHash: "$6$salt$c2VjcmV0aGFzaA"}.LitterDump(buf)
+					Expect(buf.String()).To(ContainSubstring("admin"))
+					Expect(buf.String()).NotTo(ContainSubstring("c2VjcmV0aGFzaA"))
+				})
+			})
 		})
 	})
 	Describe("ResetSpec", func() {
@@ -452,6 +1198,23 @@ var _ = Describe("Types", Label("types", "config"), func() {
 		})
 	})
 	Describe("UpgradeSpec", func() {
+		It("checks the boot attempts counter", Label("boot-attempts"), func() {
+			spec := &types.UpgradeSpec{
+				System: types.NewDirSrc("/dir"),
+				Partitions: types.ElementalPartitions{
+					State: &types.Partition{MountPoint: "mountpoint"},
+				},
+				BootAttempts: 3,
+			}
+			// Requires an OEM partition
+			Expect(spec.Sanitize()).NotTo(Succeed())
+
+			spec.Partitions.OEM = &types.Partition{FilesystemLabel: constants.OEMLabel}
+			Expect(spec.Sanitize()).To(Succeed())
+
+			spec.BootAttempts = constants.MaxBootAttempts + 1
+			Expect(spec.Sanitize()).NotTo(Succeed())
+		})
 		It("runs sanitize method", func() {
 			spec := &types.UpgradeSpec{
 				System: types.NewDirSrc("/dir"),
@@ -495,9 +1258,15 @@ var _ = Describe("Types", Label("types", "config"), func() {
 			err = spec.Sanitize()
 			Expect(err).Should(HaveOccurred())
 
-			//Fails on missing recovery partition for recovery upgrade
+			//Missing recovery partition for recovery upgrade is handled by the upgrade action
+			spec.Partitions.State = &types.Partition{MountPoint: "mountpoint"}
 			spec.Partitions.Recovery = nil
 			err = spec.Sanitize()
+			Expect(err).ShouldNot(HaveOccurred())
+
+			//Fails on recovery partition without mountpoint
+			spec.Partitions.Recovery = &types.Partition{}
+			err = spec.Sanitize()
 			Expect(err).Should(HaveOccurred())
 		})
 	})
@@ -531,6 +1300,28 @@ var _ = Describe("Types", Label("types", "config"), func() {
 			Expect(spec.Sanitize()).Should(HaveOccurred())
 		})
 	})
+	Describe("CaptureSpec", Label("capture"), func() {
+		It("compiles the include and exclude filters", func() {
+			spec := types.CaptureSpec{
+				FS:       constants.SquashFs,
+				Includes: []string{"^/var/log/audit$"},
+				Excludes: []string{"^/root/\\.cache$"},
+			}
+			Expect(spec.Sanitize()).To(Succeed())
+			includes, excludes, err := spec.Filters()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(includes).To(HaveLen(1))
+			Expect(excludes).To(HaveLen(1))
+		})
+		It("fails on an invalid filter expression", func() {
+			spec := types.CaptureSpec{FS: constants.SquashFs, Excludes: []string{"^/root/(cache"}}
+			Expect(spec.Sanitize()).To(MatchError(ContainSubstring("invalid capture filter expression")))
+		})
+		It("fails on an unsupported filesystem", func() {
+			spec := types.CaptureSpec{FS: "btrfs"}
+			Expect(spec.Sanitize()).To(MatchError(ContainSubstring("unsupported capture filesystem")))
+		})
+	})
 	Describe("MountSpec", func() {
 		It("sanitizes empty paths", func() {
 			spec := types.MountSpec{
@@ -550,6 +1341,32 @@ var _ = Describe("Types", Label("types", "config"), func() {
 			Expect(spec.Persistent.Paths).To(Equal([]string{"/root", "/etc/rancher"}))
 		})
 	})
+	Describe("DiskSpec", Label("disk"), func() {
+		var disk *types.DiskSpec
+
+		BeforeEach(func() {
+			cfg := config.NewBuildConfig(config.WithMounter(v1mocks.NewFakeMounter()))
+			disk = config.NewDisk(cfg)
+			disk.System = types.NewDockerSrc("some/image:tag")
+		})
+		It("accepts the default EFI partition flags", Label("flags"), func() {
+			Expect(disk.Sanitize()).To(Succeed())
+		})
+		It("fails on partition flags other than esp", Label("flags"), func() {
+			disk.Partitions.State.Flags = []string{"legacy_boot"}
+			Expect(disk.Sanitize()).To(MatchError(ContainSubstring("not supported for disk images")))
+		})
+	})
+	Describe("BuildConfig", Label("build"), func() {
+		It("validates the overwrite policy", Label("output"), func() {
+			cfg := config.NewBuildConfig(config.WithMounter(v1mocks.NewFakeMounter()))
+			cfg.Overwrite = constants.RenameArtifacts
+			Expect(cfg.Sanitize()).To(Succeed())
+
+			cfg.Overwrite = "keep"
+			Expect(cfg.Sanitize()).To(MatchError(ContainSubstring("invalid overwrite policy")))
+		})
+	})
 	Describe("KeyValuePair", func() {
 		It("should decode from comma separated string", func() {
 			input := "myFirstLabel=foo,mySecondLabel=bar"
@@ -557,4 +1374,23 @@ var _ = Describe("Types", Label("types", "config"), func() {
 			Expect(types.KeyValuePairFromData(input)).Should(Equal(wantLabels))
 		})
 	})
+	Describe("ParseSizeMiB", Label("size"), func() {
+		It("parses sizes with binary units into MiB", func() {
+			Expect(types.ParseSizeMiB("8GiB")).To(Equal(uint(8192)))
+			Expect(types.ParseSizeMiB("8G")).To(Equal(uint(8192)))
+			Expect(types.ParseSizeMiB("512M")).To(Equal(uint(512)))
+			Expect(types.ParseSizeMiB("2048KiB")).To(Equal(uint(2)))
+		})
+		It("takes bare numbers as MiB", func() {
+			Expect(types.ParseSizeMiB("1024")).To(Equal(uint(1024)))
+		})
+		It("fails on invalid units and partial MiB", func() {
+			_, err := types.ParseSizeMiB("8GB2")
+			Expect(err).To(HaveOccurred())
+			_, err = types.ParseSizeMiB("8 gallons")
+			Expect(err).To(HaveOccurred())
+			_, err = types.ParseSizeMiB("1500K")
+			Expect(err).To(MatchError(ContainSubstring("not a whole number of MiB")))
+		})
+	})
 })
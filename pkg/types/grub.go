@@ -36,9 +36,15 @@ func (i InstallSpec) GetGrubLabels() map[string]string {
 
 func (u UpgradeSpec) GetGrubLabels() map[string]string {
 	grubVars := map[string]string{
-		"state_label":    u.Partitions.State.FilesystemLabel,
-		"recovery_label": u.Partitions.Recovery.FilesystemLabel,
-		"oem_label":      u.Partitions.OEM.FilesystemLabel,
+		"state_label": u.Partitions.State.FilesystemLabel,
+	}
+
+	if u.Partitions.Recovery != nil {
+		grubVars["recovery_label"] = u.Partitions.Recovery.FilesystemLabel
+	}
+
+	if u.Partitions.OEM != nil {
+		grubVars["oem_label"] = u.Partitions.OEM.FilesystemLabel
 	}
 
 	if u.Partitions.Persistent != nil {
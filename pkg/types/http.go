@@ -16,6 +16,128 @@ limitations under the License.
 
 package types
 
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
 type HTTPClient interface {
 	GetURL(log Logger, url string, destination string) error
+	PostJSON(log Logger, url string, data interface{}) error
+	SetHeaders(headers HTTPHeaderScopes)
+}
+
+// headerNameRegexp matches valid HTTP header names, as defined by RFC 9110
+var headerNameRegexp = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// HTTPHeaders are extra headers sent on downloads, values might include secrets such
+// as bearer tokens or API keys, so they are redacted in logs and written configs
+type HTTPHeaders map[string]string
+
+// Sanitize checks the header names and values can be sent in a request
+func (h HTTPHeaders) Sanitize() error {
+	for name, value := range h {
+		if !headerNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid HTTP header name '%s'", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid value of HTTP header '%s'", name)
+		}
+		if value == redacted {
+			return fmt.Errorf("value of HTTP header '%s' is redacted, set the actual value", name)
+		}
+	}
+	return nil
+}
+
+// Redacted returns a copy of the headers with the values replaced
+func (h HTTPHeaders) Redacted() HTTPHeaders {
+	r := HTTPHeaders{}
+	for name := range h {
+		r[name] = redacted
+	}
+	return r
+}
+
+// LitterDump prints the header names only so values are never logged
+func (h HTTPHeaders) LitterDump(w io.Writer) {
+	var fields []string
+	for _, name := range slices.Sorted(maps.Keys(h)) {
+		fields = append(fields, fmt.Sprintf("%q: %q", name, redacted))
+	}
+	_, _ = fmt.Fprintf(w, "types.HTTPHeaders{%s}", strings.Join(fields, ", "))
+}
+
+// MarshalYAML redacts the values, so secrets are never written to disk
+func (h HTTPHeaders) MarshalYAML() (interface{}, error) {
+	return map[string]string(h.Redacted()), nil
+}
+
+// HTTPHeaderScope are the extra headers sent on downloads of the URLs under the given URL,
+// that is with the same scheme and host and a path within the URL path
+type HTTPHeaderScope struct {
+	URL     string      `yaml:"url" mapstructure:"url"`
+	Headers HTTPHeaders `yaml:"headers" mapstructure:"headers"`
+}
+
+// HTTPHeaderScopes are the extra headers of each download URL scope. The headers are only
+// set by the elemental HTTP client, cloud-init files fetched at boot by yip are fetched
+// without them.
+type HTTPHeaderScopes []HTTPHeaderScope
+
+// Sanitize checks each scope is an absolute http or https URL with valid headers
+func (s HTTPHeaderScopes) Sanitize() error {
+	for _, scope := range s {
+		u, err := url.Parse(scope.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid HTTP headers URL '%s', an http or https URL is required", scope.URL)
+		}
+		if u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("invalid HTTP headers URL '%s', query and fragment are not supported", scope.URL)
+		}
+		if err := scope.Headers.Sanitize(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// For returns the headers of all the scopes including the given URL, later scopes
+// take precedence
+func (s HTTPHeaderScopes) For(rawURL string) HTTPHeaders {
+	headers := HTTPHeaders{}
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return headers
+	}
+	for _, scope := range s {
+		u, err := url.Parse(scope.URL)
+		if err != nil || !strings.EqualFold(u.Scheme, target.Scheme) || !strings.EqualFold(u.Host, target.Host) {
+			continue
+		}
+		prefix := strings.TrimSuffix(u.Path, "/")
+		if prefix != "" && target.Path != prefix && !strings.HasPrefix(target.Path, prefix+"/") {
+			continue
+		}
+		for name, value := range scope.Headers {
+			headers[name] = value
+		}
+	}
+	return headers
+}
+
+// Names returns the header names of all the scopes
+func (s HTTPHeaderScopes) Names() []string {
+	var names []string
+	for _, scope := range s {
+		for name := range scope.Headers {
+			names = append(names, name)
+		}
+	}
+	return names
 }
@@ -18,11 +18,17 @@ package types
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"os"
 	"time"
 
 	backoff "github.com/cenkalti/backoff/v4"
 	"github.com/containerd/containerd/archive"
+	"github.com/docker/cli/cli/config"
+	clitypes "github.com/docker/cli/cli/config/types"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	containerregistry "github.com/google/go-containerregistry/pkg/v1"
@@ -32,14 +38,115 @@ import (
 )
 
 type ImageExtractor interface {
-	ExtractImage(imageRef, destination, platformRef string, local bool, verify bool) (string, error)
+	ExtractImage(imageRef, destination, platformRef string, local bool, verify bool, auth *RegistryAuth) (string, error)
 }
 
+// RegistryAuth holds the credentials to pull an image from a registry. Either
+// a username and password, a registry token or a docker config file can be set.
+type RegistryAuth struct {
+	Username     string `yaml:"username,omitempty" mapstructure:"username"`
+	Password     string `yaml:"password,omitempty" mapstructure:"password"`
+	Token        string `yaml:"token,omitempty" mapstructure:"token"`
+	DockerConfig string `yaml:"docker-config,omitempty" mapstructure:"docker-config"`
+}
+
+// Redacted returns a copy of the credentials with the secrets replaced
+func (a RegistryAuth) Redacted() RegistryAuth {
+	if a.Password != "" {
+		a.Password = redacted
+	}
+	if a.Token != "" {
+		a.Token = redacted
+	}
+	return a
+}
+
+// Sanitize checks the secrets are not the placeholders of redacted credentials
+func (a RegistryAuth) Sanitize() error {
+	if a.Password == redacted || a.Token == redacted {
+		return fmt.Errorf("registry credentials of user '%s' are redacted, set the actual password or token", a.Username)
+	}
+	return nil
+}
+
+// String returns the credentials with the secrets redacted, so they are safe to log
+func (a RegistryAuth) String() string {
+	r := a.Redacted()
+	return fmt.Sprintf("{username: %s, password: %s, token: %s, docker-config: %s}", r.Username, r.Password, r.Token, r.DockerConfig)
+}
+
+// MarshalYAML redacts the secrets, so credentials are never written to disk
+func (a RegistryAuth) MarshalYAML() (interface{}, error) {
+	type plainAuth RegistryAuth
+	return plainAuth(a.Redacted()), nil
+}
+
+// DockerConfigJSON returns a docker config.json file content granting these credentials
+// to the registry of the given image reference, so external tools like cosign can use them
+func (a RegistryAuth) DockerConfigJSON(fs FS, imageRef string) ([]byte, error) {
+	if a.DockerConfig != "" {
+		return fs.ReadFile(a.DockerConfig)
+	}
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		return nil, err
+	}
+	registry := ref.Context().RegistryStr()
+	if registry == name.DefaultRegistry {
+		registry = authn.DefaultAuthKey
+	}
+	auth := clitypes.AuthConfig{RegistryToken: a.Token}
+	if a.Username != "" {
+		auth.Auth = base64.StdEncoding.EncodeToString([]byte(a.Username + ":" + a.Password))
+	}
+	return json.Marshal(map[string]map[string]clitypes.AuthConfig{"auths": {registry: auth}})
+}
+
+// authenticator returns the authenticator for the given registry
+func (a RegistryAuth) authenticator(registry string) (authn.Authenticator, error) {
+	switch {
+	case a.DockerConfig != "":
+		f, err := os.Open(a.DockerConfig)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		cf, err := config.LoadFromReader(f)
+		if err != nil {
+			return nil, err
+		}
+		if registry == name.DefaultRegistry {
+			registry = authn.DefaultAuthKey
+		}
+		cfg, err := cf.GetAuthConfig(registry)
+		if err != nil {
+			return nil, err
+		}
+		return authn.FromConfig(authn.AuthConfig{
+			Username:      cfg.Username,
+			Password:      cfg.Password,
+			Auth:          cfg.Auth,
+			IdentityToken: cfg.IdentityToken,
+			RegistryToken: cfg.RegistryToken,
+		}), nil
+	case a.Token != "":
+		return authn.FromConfig(authn.AuthConfig{RegistryToken: a.Token}), nil
+	case a.Username != "":
+		return &authn.Basic{Username: a.Username, Password: a.Password}, nil
+	}
+	return authn.Anonymous, nil
+}
+
+const redacted = "<redacted>"
+
 type OCIImageExtractor struct{}
 
 var _ ImageExtractor = OCIImageExtractor{}
 
-func (e OCIImageExtractor) ExtractImage(imageRef, destination, platformRef string, local bool, verify bool) (string, error) {
+// ExtractImage pulls and unpacks the given image reference into destination and returns the
+// digest of the pulled image. References pinned by digest are checked by the registry client,
+// the pull fails if the fetched manifest does not match the pinned digest.
+func (e OCIImageExtractor) ExtractImage(imageRef, destination, platformRef string, local bool, verify bool, auth *RegistryAuth) (string, error) {
 	platform, err := containerregistry.ParsePlatform(platformRef)
 	if err != nil {
 		return "", err
@@ -57,8 +164,17 @@ func (e OCIImageExtractor) ExtractImage(imageRef, destination, platformRef strin
 
 	var img containerregistry.Image
 
+	authOpt := remote.WithAuthFromKeychain(authn.DefaultKeychain)
+	if auth != nil {
+		authenticator, err := auth.authenticator(ref.Context().RegistryStr())
+		if err != nil {
+			return "", err
+		}
+		authOpt = remote.WithAuth(authenticator)
+	}
+
 	err = backoff.Retry(func() error {
-		img, err = image(ref, *platform, local)
+		img, err = image(ref, *platform, local, authOpt)
 		return err
 	}, backoff.WithMaxRetries(backoff.NewConstantBackOff(3*time.Second), 3))
 	if err != nil {
@@ -76,7 +192,7 @@ func (e OCIImageExtractor) ExtractImage(imageRef, destination, platformRef strin
 	return digest.String(), err
 }
 
-func image(ref name.Reference, platform containerregistry.Platform, local bool) (containerregistry.Image, error) {
+func image(ref name.Reference, platform containerregistry.Platform, local bool, authOpt remote.Option) (containerregistry.Image, error) {
 	if local {
 		return daemon.Image(ref)
 	}
@@ -84,6 +200,6 @@ func image(ref name.Reference, platform containerregistry.Platform, local bool)
 	return remote.Image(ref,
 		remote.WithTransport(http.DefaultTransport),
 		remote.WithPlatform(platform),
-		remote.WithAuthFromKeychain(authn.DefaultKeychain),
+		authOpt,
 	)
 }
@@ -113,7 +113,9 @@ func (w *logrusWrapper) Success(r ...interface{}) {
 	w.Info(r...)
 }
 
-var emojiStrip = regexp.MustCompile(`[:][\w]+[:]`)
+// Matches a :WORD: and any extra space after that and the next word to remove emojis
+// which are like ":house: realMessageStartsHere"
+var emojiStrip = regexp.MustCompile(`[:][\w]+[:]\s`)
 
 func (w *logrusWrapper) Debug(args ...interface{}) {
 	converted := convert(args)
@@ -143,9 +145,6 @@ func (w *logrusWrapper) Fatal(args ...interface{}) {
 // convert changes a list of interfaces into a proper joined string ready to log
 func convert(args []interface{}) string {
 	var together []string
-	// Matches a :WORD: and any extra space after that and the next word to remove emojis
-	// which are like ":house: realMessageStartsHere"
-	emojiStrip = regexp.MustCompile(`[:][\w]+[:]\s`)
 	for _, a := range args {
 		toClean := fmt.Sprintf("%v", a)                     // coerce into string
 		cleaned := emojiStrip.ReplaceAllString(toClean, "") // remove any emoji
@@ -25,6 +25,7 @@ type Mounter interface {
 	Mount(source string, target string, fstype string, options []string) error
 	Unmount(target string) error
 	IsLikelyNotMountPoint(file string) (bool, error)
+	List() ([]mount.MountPoint, error)
 }
 
 func NewMounter(binary string) Mounter {
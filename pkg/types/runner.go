@@ -18,8 +18,11 @@ package types
 
 import (
 	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 type Runner interface {
@@ -33,6 +36,8 @@ type Runner interface {
 
 type RealRunner struct {
 	Logger Logger
+	// File each executed command is appended to, no trace is kept if empty
+	TraceFile string
 }
 
 func (r RealRunner) CommandExists(command string) bool {
@@ -45,7 +50,10 @@ func (r RealRunner) InitCmd(command string, args ...string) *exec.Cmd {
 }
 
 func (r RealRunner) RunCmd(cmd *exec.Cmd) ([]byte, error) {
-	return cmd.CombinedOutput()
+	start := time.Now()
+	out, err := cmd.CombinedOutput()
+	r.trace(cmd, start, err)
+	return out, err
 }
 
 func (r RealRunner) Run(command string, args ...string) ([]byte, error) {
@@ -72,3 +80,34 @@ func (r RealRunner) debug(msg string) {
 		r.Logger.Debug(msg)
 	}
 }
+
+// trace appends the command, its start time, duration and result to the trace file
+func (r RealRunner) trace(cmd *exec.Cmd, start time.Time, cmdErr error) {
+	if r.TraceFile == "" {
+		return
+	}
+	result := "ok"
+	if cmdErr != nil {
+		result = cmdErr.Error()
+	}
+	line := fmt.Sprintf(
+		"%s %s (%s): %s\n", start.Format(time.RFC3339), cmd.String(),
+		time.Since(start).Round(time.Millisecond), result,
+	)
+
+	err := os.MkdirAll(filepath.Dir(r.TraceFile), 0755)
+	if err != nil {
+		r.debug(fmt.Sprintf("failed creating command trace directory: %s", err.Error()))
+		return
+	}
+	f, err := os.OpenFile(r.TraceFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		r.debug(fmt.Sprintf("failed opening command trace file: %s", err.Error()))
+		return
+	}
+	defer f.Close()
+	_, err = f.WriteString(line)
+	if err != nil {
+		r.debug(fmt.Sprintf("failed writing command trace: %s", err.Error()))
+	}
+}
@@ -18,6 +18,9 @@ package types_test
 
 import (
 	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -70,6 +73,22 @@ var _ = Describe("Runner", Label("types", "runner"), func() {
 		Expect(err).NotTo(BeNil())
 		Expect(memLog.String()).To(ContainSubstring("not found"))
 	})
+	It("appends the executed commands to the trace file", func() {
+		trace := filepath.Join(GinkgoT().TempDir(), "trace", "commands.log")
+		r := types.RealRunner{TraceFile: trace}
+		_, err := r.Run("echo", "-n", "Some message")
+		Expect(err).To(BeNil())
+		_, err = r.Run("false")
+		Expect(err).NotTo(BeNil())
+		data, err := os.ReadFile(trace)
+		Expect(err).To(BeNil())
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		Expect(lines).To(HaveLen(2))
+		Expect(lines[0]).To(ContainSubstring("echo -n Some message"))
+		Expect(lines[0]).To(HaveSuffix(": ok"))
+		Expect(lines[1]).To(ContainSubstring("false"))
+		Expect(lines[1]).To(HaveSuffix(": exit status 1"))
+	})
 	It("returns false if command does not exists", func() {
 		r := types.RealRunner{}
 		exists := r.CommandExists("THISCOMMANDSHOULDNOTBETHERECOMEON")
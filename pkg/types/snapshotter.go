@@ -33,6 +33,7 @@ type Snapshotter interface {
 	DeleteSnapshot(id int) error
 	GetSnapshots() ([]int, error)
 	SnapshotToImageSource(snap *Snapshot) (*ImageSource, error)
+	ActivateSnapshot(id int) error
 }
 
 type SnapshotterConfig struct {
@@ -121,7 +122,8 @@ func innerConfigDecoder[T any](defaultConf T, data interface{}) (T, error) {
 	}
 
 	cfg := &mapstructure.DecoderConfig{
-		Result: &defaultConf,
+		Result:     &defaultConf,
+		DecodeHook: SizeHookFromData,
 	}
 	dec, err := mapstructure.NewDecoder(cfg)
 	if err != nil {
@@ -23,6 +23,7 @@ import (
 type SyscallInterface interface {
 	Chroot(string) error
 	Chdir(string) error
+	UnshareMountNS() error
 }
 
 type RealSyscall struct{}
@@ -34,3 +35,15 @@ func (r *RealSyscall) Chroot(path string) error {
 func (r *RealSyscall) Chdir(path string) error {
 	return syscall.Chdir(path)
 }
+
+// UnshareMountNS moves the calling thread into a new private mount namespace, so mounts
+// done from it, or from the commands it runs, are not visible to the rest of the host.
+// The caller must be locked to its OS thread and never unlock it, so the thread is
+// terminated when the goroutine exits instead of being reused.
+func (r *RealSyscall) UnshareMountNS() error {
+	err := syscall.Unshare(syscall.CLONE_NEWNS)
+	if err != nil {
+		return err
+	}
+	return syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+}
@@ -0,0 +1,113 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+// newChecksumHash returns a new hash of the given checksum algorithm, defaults to sha256
+func newChecksumHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case "", constants.SHA256:
+		return sha256.New(), nil
+	case constants.SHA512:
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm '%s'", algo)
+	}
+}
+
+// CalcFileChecksumWithAlgo opens the given file and returns its checksum computed
+// with the given algorithm
+func CalcFileChecksumWithAlgo(fs types.FS, fileName string, algo string) (string, error) {
+	h, err := newChecksumHash(algo)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := fs.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// FileDigest returns the checksum of the given file prefixed by the algorithm used
+// to compute it, as in 'sha512:<checksum>'
+func FileDigest(fs types.FS, fileName string, algo string) (string, error) {
+	if algo == "" {
+		algo = constants.SHA256
+	}
+	checksum, err := CalcFileChecksumWithAlgo(fs, fileName, algo)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%s", algo, checksum), nil
+}
+
+// ParseDigest returns the algorithm and the checksum of the given digest. Digests without
+// an algorithm prefix are plain checksums, their algorithm is guessed from their length.
+func ParseDigest(digest string) (algo string, checksum string, err error) {
+	algo, checksum, found := strings.Cut(digest, ":")
+	if !found {
+		checksum = digest
+		switch len(checksum) {
+		case sha256.Size * 2:
+			algo = constants.SHA256
+		case sha512.Size * 2:
+			algo = constants.SHA512
+		default:
+			return "", "", fmt.Errorf("unknown checksum format '%s'", digest)
+		}
+	}
+	if _, err := newChecksumHash(algo); err != nil {
+		return "", "", err
+	}
+	return algo, strings.ToLower(checksum), nil
+}
+
+// VerifyFileDigest checks the given file matches the given digest, the algorithm
+// used to compute the file checksum is taken from the digest
+func VerifyFileDigest(fs types.FS, fileName string, digest string) error {
+	algo, expected, err := ParseDigest(digest)
+	if err != nil {
+		return err
+	}
+	actual, err := CalcFileChecksumWithAlgo(fs, fileName, algo)
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return fmt.Errorf("%s checksum mismatch for %s: expected %s, got %s", algo, fileName, expected, actual)
+	}
+	return nil
+}
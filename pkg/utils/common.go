@@ -17,14 +17,20 @@ limitations under the License.
 package utils
 
 import (
-	"crypto/sha256"
+	"bufio"
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -175,6 +181,45 @@ func MirrorData(log types.Logger, runner types.Runner, fs types.FS, source strin
 	return rsyncWrapper(log, runner, fs, source, target, flags)
 }
 
+// DiffData compares the source folder contents with the target folder contents by checksum and returns
+// the source paths missing or differing in target. Attributes, such as permissions or times, are not
+// compared and extra files in target are ignored.
+func DiffData(log types.Logger, runner types.Runner, fs types.FS, source string, target string, excludes ...string) ([]string, error) {
+	if fs != nil {
+		if s, err := fs.RawPath(source); err == nil {
+			source = s
+		}
+		if t, err := fs.RawPath(target); err == nil {
+			target = t
+		}
+	}
+
+	flags := []string{"--dry-run", "--checksum", "--itemize-changes", "--archive"}
+	for _, e := range excludes {
+		flags = append(flags, fmt.Sprintf("--exclude=%s", e))
+	}
+	args := append(flags, strings.TrimSuffix(source, "/")+"/", strings.TrimSuffix(target, "/")+"/")
+
+	log.Debugf("Comparing %s with %s", source, target)
+	out, err := runner.Run(constants.Rsync, args...)
+	if err != nil {
+		log.Errorf("rsync finished with errors: %s", err.Error())
+		return nil, err
+	}
+
+	// Itemized changes are '<changes> <path>', only transfers or creations are data differences
+	var diff []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		changes, path, ok := strings.Cut(scanner.Text(), " ")
+		if !ok || len(changes) == 0 || (changes[0] != '>' && changes[0] != 'c') {
+			continue
+		}
+		diff = append(diff, path)
+	}
+	return diff, nil
+}
+
 func rsyncWrapper(log types.Logger, runner types.Runner, fs types.FS, source string, target string, flags []string) error {
 	if fs != nil {
 		if s, err := fs.RawPath(source); err == nil {
@@ -231,6 +276,21 @@ func displayProgress(log types.Logger, tick time.Duration, message string) chan
 	return done
 }
 
+// SyncAndDropCaches flushes all pending writes to disk and drops the page cache, dentries
+// and inodes, so data is known to be on disk before a forced reboot or power off, which
+// skips the regular shutdown sequence.
+func SyncAndDropCaches(fs types.FS, runner types.Runner) error {
+	out, err := runner.Run("sync")
+	if err != nil {
+		return fmt.Errorf("failed syncing filesystems: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	err = fs.WriteFile(constants.DropCachesFile, []byte("3"), constants.FilePerm)
+	if err != nil {
+		return fmt.Errorf("failed dropping caches: %w", err)
+	}
+	return nil
+}
+
 // Reboot reboots the system after the given delay (in seconds) time passed.
 func Reboot(runner types.Runner, delay time.Duration) error {
 	time.Sleep(delay * time.Second)
@@ -238,6 +298,16 @@ func Reboot(runner types.Runner, delay time.Duration) error {
 	return err
 }
 
+// WipeFilesystemSignatures removes all filesystem, RAID and partition table signatures of
+// the given device, so stale labels of a previous layout are not reported anymore
+func WipeFilesystemSignatures(runner types.Runner, device string) error {
+	out, err := runner.Run("wipefs", "--all", device)
+	if err != nil {
+		return fmt.Errorf("failed wiping signatures of %s: %s: %w", device, strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
 // Shutdown halts the system after the given delay (in seconds) time passed.
 func Shutdown(runner types.Runner, delay time.Duration) error {
 	time.Sleep(delay * time.Second)
@@ -247,8 +317,10 @@ func Shutdown(runner types.Runner, delay time.Duration) error {
 
 // CosignVerify runs a cosign validation for the give image and given public key. If no
 // key is provided then it attempts a keyless validation (experimental feature).
-func CosignVerify(fs types.FS, runner types.Runner, image string, publicKey string, debug bool) (string, error) {
+func CosignVerify(fs types.FS, runner types.Runner, image string, publicKey string, debug bool, auth *types.RegistryAuth) (string, error) {
 	args := []string{}
+	// Settings are only passed to the cosign command, concurrent installations share the process environment
+	env := []string{}
 
 	if debug {
 		args = append(args, "-d=true")
@@ -256,8 +328,7 @@ func CosignVerify(fs types.FS, runner types.Runner, image string, publicKey stri
 	if publicKey != "" {
 		args = append(args, "-key", publicKey)
 	} else {
-		os.Setenv("COSIGN_EXPERIMENTAL", "1")
-		defer os.Unsetenv("COSIGN_EXPERIMENTAL")
+		env = append(env, "COSIGN_EXPERIMENTAL=1")
 	}
 	args = append(args, image)
 
@@ -266,15 +337,32 @@ func CosignVerify(fs types.FS, runner types.Runner, image string, publicKey stri
 	if err != nil {
 		return "", err
 	}
-	_ = os.Setenv("TUF_ROOT", tmpDir)
+	env = append(env, fmt.Sprintf("TUF_ROOT=%s", tmpDir))
 	defer func(fs types.FS, path string) {
 		_ = fs.RemoveAll(path)
 	}(fs, tmpDir)
-	defer func() {
-		_ = os.Unsetenv("TUF_ROOT")
-	}()
 
-	out, err := runner.Run("cosign", args...)
+	// Make the source credentials available to cosign to fetch the signatures
+	if auth != nil {
+		data, err := auth.DockerConfigJSON(fs, image)
+		if err != nil {
+			return "", err
+		}
+		dockerDir := filepath.Join(tmpDir, "docker")
+		err = MkdirAll(fs, dockerDir, constants.DirPerm)
+		if err != nil {
+			return "", err
+		}
+		err = fs.WriteFile(filepath.Join(dockerDir, "config.json"), data, 0600)
+		if err != nil {
+			return "", err
+		}
+		env = append(env, fmt.Sprintf("DOCKER_CONFIG=%s", dockerDir))
+	}
+
+	cmd := runner.InitCmd("cosign", args...)
+	cmd.Env = append(os.Environ(), env...)
+	out, err := runner.RunCmd(cmd)
 	return string(out), err
 }
 
@@ -467,6 +555,24 @@ func FindFiles(vfs types.FS, rootDir string, pattern string) ([]string, error) {
 	return findFiles(vfs, rootDir, pattern, false)
 }
 
+// FindUniqueFile finds the single file matching the given pattern on top of a root path.
+// It fails if no file or more than one file matches.
+func FindUniqueFile(vfs types.FS, rootDir string, pattern string) (string, error) {
+	files, err := findFiles(vfs, rootDir, pattern, false)
+	if err != nil {
+		return "", err
+	}
+	files = slices.Compact(slices.Sorted(slices.Values(files)))
+	switch len(files) {
+	case 0:
+		return "", fmt.Errorf("no file matching %s found in %s", pattern, rootDir)
+	case 1:
+		return files[0], nil
+	default:
+		return "", fmt.Errorf("pattern %s is ambiguous, it matches %s", pattern, strings.Join(files, ", "))
+	}
+}
+
 func findFiles(vfs types.FS, rootDir, pattern string, fristMatchReturn bool) ([]string, error) {
 	foundFiles := []string{}
 
@@ -621,18 +727,7 @@ func ResolveLink(vfs types.FS, path string, rootDir string, depth int) (string,
 
 // CalcFileChecksum opens the given file and returns the sha256 checksum of it.
 func CalcFileChecksum(fs types.FS, fileName string) (string, error) {
-	f, err := fs.Open(fileName)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
-
-	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return "", err
-	}
-
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
+	return CalcFileChecksumWithAlgo(fs, fileName, constants.SHA256)
 }
 
 // CreateRAWFile creates raw file of the given size in MB
@@ -663,3 +758,256 @@ func PreAppendRoot(root string, paths ...string) []string {
 	}
 	return newPaths
 }
+
+var (
+	trailingDigitRegexp = regexp.MustCompile(`\d$`)
+	lsblkPairRegexp     = regexp.MustCompile(`([A-Z:-]+)="([^"]*)"`)
+)
+
+// GrowPartition expands the partition number partNum of the given disk up to the end of the
+// available space and grows its filesystem afterwards. It uses growpart if available and falls
+// back to parted otherwise. Mounted filesystems are grown online, note xfs and btrfs can only
+// be grown if mounted. Running it over an already expanded partition is a no-op.
+func GrowPartition(runner types.Runner, disk string, partNum int) error {
+	num := strconv.Itoa(partNum)
+	if runner.CommandExists("growpart") {
+		out, err := runner.Run("growpart", disk, num)
+		// growpart exits with 1 and reports NOCHANGE if there is nothing to grow
+		if err != nil && !strings.Contains(string(out), "NOCHANGE") {
+			return fmt.Errorf("failed growing partition %d of %s: %s", partNum, disk, string(out))
+		}
+	} else {
+		out, err := runner.Run("parted", "--script", "--fix", disk, "--", "resizepart", num, "100%")
+		if err != nil {
+			return fmt.Errorf("failed growing partition %d of %s: %s", partNum, disk, string(out))
+		}
+	}
+	_, _ = runner.Run("udevadm", "settle")
+
+	device := fmt.Sprintf("%s%d", disk, partNum)
+	if trailingDigitRegexp.MatchString(disk) {
+		device = fmt.Sprintf("%sp%d", disk, partNum)
+	}
+
+	out, err := runner.Run("lsblk", "-nPo", "FSTYPE,MOUNTPOINT", device)
+	if err != nil {
+		return fmt.Errorf("failed inspecting %s: %s", device, string(out))
+	}
+	var fsType, mountPoint string
+	for _, match := range lsblkPairRegexp.FindAllStringSubmatch(string(out), -1) {
+		switch match[1] {
+		case "FSTYPE":
+			fsType = match[2]
+		case "MOUNTPOINT":
+			mountPoint = match[2]
+		}
+	}
+	if fsType == "" {
+		return fmt.Errorf("could not find filesystem for %s", device)
+	}
+
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		if mountPoint == "" {
+			out, err = runner.Run("e2fsck", "-fy", device)
+			// e2fsck exits with 1 when it corrected filesystem errors, only higher codes are failures
+			var exitErr *exec.ExitError
+			if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+				return fmt.Errorf("failed checking filesystem of %s: %s", device, string(out))
+			}
+		}
+		out, err = runner.Run("resize2fs", device)
+	case "xfs":
+		if mountPoint == "" {
+			return fmt.Errorf("xfs filesystem of %s must be mounted to be grown", device)
+		}
+		out, err = runner.Run("xfs_growfs", mountPoint)
+	case "btrfs":
+		if mountPoint == "" {
+			return fmt.Errorf("btrfs filesystem of %s must be mounted to be grown", device)
+		}
+		out, err = runner.Run("btrfs", "filesystem", "resize", "max", mountPoint)
+	default:
+		return fmt.Errorf("unsupported filesystem '%s' for %s", fsType, device)
+	}
+	if err != nil {
+		return fmt.Errorf("failed growing filesystem of %s: %s", device, string(out))
+	}
+	return nil
+}
+
+// FindAutoTarget returns the largest writable disk of the host, excluding the
+// installer media the system is booted from, the disks listed in excludePaths and
+// the disks holding a filesystem labeled as any of excludeLabels. Removable disks
+// are only considered if allowRemovable is set. It fails if there is no candidate
+// or if there are several candidates of the largest size, unless force is set, in
+// that case the first of them is returned.
+func FindAutoTarget(runner types.Runner, allowRemovable, force bool, excludeLabels, excludePaths []string) (string, error) {
+	excluded := map[string]bool{}
+	for _, path := range excludePaths {
+		excluded[path] = true
+	}
+	for _, bootPath := range []string{constants.LiveDir, constants.IsoScanDir} {
+		if disk := mountSourceDisk(runner, bootPath); disk != "" {
+			excluded[disk] = true
+		}
+	}
+	if len(excludeLabels) > 0 {
+		disks, err := labeledDisks(runner, excludeLabels)
+		if err != nil {
+			return "", err
+		}
+		for _, disk := range disks {
+			excluded[disk] = true
+		}
+	}
+
+	out, err := runner.Run("lsblk", "-dbnpro", "NAME,SIZE,TYPE,RM,RO")
+	if err != nil {
+		return "", fmt.Errorf("failed listing disks: %s", string(out))
+	}
+
+	var target, removableTarget string
+	var size, removableSize uint64
+	var ambiguous, removableAmbiguous bool
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 5 || fields[2] != "disk" || fields[4] != "0" || excluded[fields[0]] {
+			continue
+		}
+		dSize, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil || dSize == 0 {
+			continue
+		}
+		if fields[3] == "1" {
+			if dSize == removableSize {
+				removableAmbiguous = true
+			} else if dSize > removableSize {
+				removableTarget, removableSize, removableAmbiguous = fields[0], dSize, false
+			}
+			continue
+		}
+		if dSize == size {
+			ambiguous = true
+		} else if dSize > size {
+			target, size, ambiguous = fields[0], dSize, false
+		}
+	}
+
+	if target == "" {
+		if removableTarget == "" {
+			return "", fmt.Errorf("no suitable target disk found")
+		}
+		if !allowRemovable {
+			return "", fmt.Errorf("only removable disks found, refusing to pick '%s' as target", removableTarget)
+		}
+		target, size, ambiguous = removableTarget, removableSize, removableAmbiguous
+	}
+	if ambiguous && !force {
+		return "", fmt.Errorf("several disks of %d bytes found, can't pick a target disk unambiguously", size)
+	}
+	return target, nil
+}
+
+// DiskType returns the device class of the given disk, as read from sysfs: NVDIMM
+// namespaces, Optane devices, other NVMe devices, SSDs or rotational disks. Returns
+// an empty string if the class is unknown.
+func DiskType(fs types.FS, disk string) string {
+	name := filepath.Base(disk)
+	sysDir := filepath.Join(constants.SysBlockDir, name)
+	if strings.HasPrefix(name, "pmem") {
+		return constants.DiskTypeNVDIMM
+	}
+
+	model, _ := fs.ReadFile(filepath.Join(sysDir, "device", "model"))
+	modelStr := strings.ToUpper(strings.TrimSpace(string(model)))
+	if strings.Contains(modelStr, "OPTANE") {
+		return constants.DiskTypeOptane
+	}
+	for _, prefix := range constants.GetOptaneModelPrefixes() {
+		if strings.HasPrefix(modelStr, prefix) {
+			return constants.DiskTypeOptane
+		}
+	}
+	if strings.HasPrefix(name, "nvme") {
+		return constants.DiskTypeNVMe
+	}
+
+	rotational, err := fs.ReadFile(filepath.Join(sysDir, "queue", "rotational"))
+	if err != nil {
+		return ""
+	}
+	switch strings.TrimSpace(string(rotational)) {
+	case "0":
+		return constants.DiskTypeSSD
+	case "1":
+		return constants.DiskTypeHDD
+	}
+	return ""
+}
+
+// DiskTypes returns the device class of every disk of the host, indexed by path
+func DiskTypes(fs types.FS, runner types.Runner) (map[string]string, error) {
+	out, err := runner.Run("lsblk", "-dbnpro", "NAME,SIZE,TYPE,RM,RO")
+	if err != nil {
+		return nil, fmt.Errorf("failed listing disks: %s", string(out))
+	}
+	diskTypes := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 5 || fields[2] != "disk" {
+			continue
+		}
+		diskTypes[fields[0]] = DiskType(fs, fields[0])
+	}
+	return diskTypes, nil
+}
+
+// mountSourceDisk returns the disk backing the filesystem mounted at the given path,
+// or the mount source itself if it has no parent device. Returns an empty string
+// if nothing is mounted there.
+func mountSourceDisk(runner types.Runner, path string) string {
+	out, err := runner.Run("findmnt", "-nvo", "SOURCE", path)
+	src := strings.TrimSpace(string(out))
+	if err != nil || src == "" {
+		return ""
+	}
+	out, err = runner.Run("lsblk", "-npdro", "PKNAME", src)
+	if parent := strings.TrimSpace(string(out)); err == nil && parent != "" {
+		return parent
+	}
+	return src
+}
+
+// labeledDisks returns the disks including any block device labeled as any of the
+// given labels, either the disk itself or any of its partitions.
+func labeledDisks(runner types.Runner, labels []string) ([]string, error) {
+	out, err := runner.Run("lsblk", "-Jlnpo", "NAME,PKNAME,LABEL")
+	if err != nil {
+		return nil, fmt.Errorf("failed listing block device labels: %s", string(out))
+	}
+
+	var devices struct {
+		BlockDevices []struct {
+			Name   string `json:"name"`
+			PkName string `json:"pkname"`
+			Label  string `json:"label"`
+		} `json:"blockdevices"`
+	}
+	if err = json.Unmarshal(out, &devices); err != nil {
+		return nil, fmt.Errorf("failed parsing block device labels: %w", err)
+	}
+
+	var disks []string
+	for _, dev := range devices.BlockDevices {
+		if dev.Label == "" || !slices.Contains(labels, dev.Label) {
+			continue
+		}
+		if dev.PkName != "" {
+			disks = append(disks, dev.PkName)
+		} else {
+			disks = append(disks, dev.Name)
+		}
+	}
+	return disks, nil
+}
@@ -22,8 +22,10 @@ package utils
 import (
 	"fmt"
 	"io/fs"
+	"math"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -34,6 +36,7 @@ import (
 	"github.com/twpayne/go-vfs/v4"
 	"github.com/twpayne/go-vfs/v4/vfst"
 
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 )
 
@@ -59,6 +62,129 @@ func DirSize(fs types.FS, path string, excludes ...string) (int64, error) {
 	return size, err
 }
 
+// FilterTreePaths walks the given root tree and returns the paths, relative to root with a
+// leading '/', matching any of the exclude expressions and none of the include expressions.
+// Matching directories are returned without walking into them.
+func FilterTreePaths(fs types.FS, root string, includes, excludes []*regexp.Regexp) ([]string, error) {
+	var paths []string
+
+	matchAny := func(path string, exprs []*regexp.Regexp) bool {
+		for _, expr := range exprs {
+			if expr.MatchString(path) {
+				return true
+			}
+		}
+		return false
+	}
+
+	err := vfs.Walk(fs, root, func(loopPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, loopPath)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = "/" + rel
+		if matchAny(rel, excludes) && !matchAny(rel, includes) {
+			paths = append(paths, rel)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// FreeSpaceMB returns the available space of the filesystem including the given path. Result in Megabytes
+func FreeSpaceMB(runner types.Runner, path string) (uint, error) {
+	out, err := runner.Run("df", "--output=avail", "--block-size=1M", path)
+	if err != nil {
+		return 0, fmt.Errorf("failed checking free space of '%s': %w", path, err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	free, err := strconv.ParseUint(strings.TrimSpace(lines[len(lines)-1]), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed parsing free space of '%s': %w", path, err)
+	}
+	return uint(free), nil
+}
+
+// FreeInodes returns the available inodes of the filesystem holding the given path. Filesystems
+// allocating inodes dynamically, which report no inodes at all, return math.MaxUint64.
+func FreeInodes(runner types.Runner, path string) (uint64, error) {
+	out, err := runner.Run("df", "--output=itotal,iavail", path)
+	if err != nil {
+		return 0, fmt.Errorf("failed checking free inodes of '%s': %w", path, err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) != 2 {
+		return 0, fmt.Errorf("failed parsing free inodes of '%s': unexpected output '%s'", path, lines[len(lines)-1])
+	}
+	total, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed parsing free inodes of '%s': %w", path, err)
+	}
+	free, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed parsing free inodes of '%s': %w", path, err)
+	}
+	if total == 0 {
+		return math.MaxUint64, nil
+	}
+	return free, nil
+}
+
+// CountInodes returns the number of inodes required to hold the given tree, that is the number
+// of files, directories and links in it. Hard links are counted once per link.
+func CountInodes(fs types.FS, path string, excludes ...string) (uint64, error) {
+	var count uint64
+	err := vfs.Walk(fs, path, func(loopPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			for _, exclude := range excludes {
+				if strings.HasPrefix(loopPath, exclude) {
+					return filepath.SkipDir
+				}
+			}
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// ComputeImageInodes returns the number of inodes of an image holding the given number of
+// inodes according to the headroom of the given size policy
+func ComputeImageInodes(sourceInodes uint64, policy types.SizePolicy) uint64 {
+	return sourceInodes + sourceInodes*uint64(policy.Headroom)/100 + constants.ImgInodeOverhead
+}
+
+// ComputeImageSize returns the size in bytes of an image holding sourceBytes of data according
+// to the given size policy. The result is always a multiple of a MiB.
+func ComputeImageSize(sourceBytes int64, policy types.SizePolicy) int64 {
+	const MiB = int64(1024 * 1024)
+
+	size := sourceBytes + sourceBytes*int64(policy.Headroom)/100 + int64(policy.Overhead)*MiB
+
+	roundTo := int64(policy.RoundTo) * MiB
+	if roundTo == 0 {
+		roundTo = MiB
+	}
+	if rem := size % roundTo; rem != 0 {
+		size += roundTo - rem
+	}
+
+	if minSize := int64(policy.MinSize) * MiB; size < minSize {
+		size = minSize
+	}
+	return size
+}
+
 // DirSizeMB returns the accumulated size of all files in folder. Result in Megabytes
 func DirSizeMB(fs types.FS, path string, excludes ...string) (uint, error) {
 	size, err := DirSize(fs, path, excludes...)
@@ -103,6 +229,44 @@ func RemoveAll(fs types.FS, path string) error {
 	return nil
 }
 
+// SafeRemoveAll removes the specified path as RemoveAll does, but refuses to remove empty
+// paths, the current directory or its parents, the root, its direct subdirectories and mount
+// points or paths including mount points. It is meant for computed paths, so a bug computing
+// them can't wipe the host.
+func SafeRemoveAll(log types.Logger, mounter types.Mounter, fs types.FS, path string) error {
+	if path == "" {
+		return refuseRemove(log, path, "empty path")
+	}
+	rel := filepath.Clean(path)
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return refuseRemove(log, path, "the current directory or one of its parents")
+	}
+	clean, err := filepath.Abs(rel)
+	if err != nil {
+		return refuseRemove(log, path, err.Error())
+	}
+	switch {
+	case clean == "/" || filepath.Dir(clean) == "/":
+		return refuseRemove(log, path, "root or a top level directory")
+	case IsMounted(mounter, clean):
+		return refuseRemove(log, path, "a mount point")
+	}
+	if mnts, err := mounter.List(); err == nil {
+		for _, mnt := range mnts {
+			if strings.HasPrefix(filepath.Clean(mnt.Path), clean+"/") {
+				return refuseRemove(log, path, fmt.Sprintf("including the mount point %s", mnt.Path))
+			}
+		}
+	}
+	return RemoveAll(fs, rel)
+}
+
+// refuseRemove logs and returns the error of a refused removal of the given path
+func refuseRemove(log types.Logger, path, reason string) error {
+	log.Errorf("Refusing to remove '%s': %s", path, reason)
+	return fmt.Errorf("refusing to remove '%s': %s", path, reason)
+}
+
 // IsDir check if the path is a dir
 func IsDir(fs types.FS, path string) (bool, error) {
 	fi, err := fs.Stat(path)
@@ -295,3 +459,18 @@ func readDir(vfs types.FS, dirname string) ([]fs.DirEntry, error) {
 	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Name() < dirs[j].Name() })
 	return dirs, nil
 }
+
+// IsMounted checks if the given path is a mountpoint. It checks the mount list, so bind
+// mounts are also detected, and falls back to compare the device of the path and its parent.
+func IsMounted(mounter types.Mounter, path string) bool {
+	path = filepath.Clean(path)
+	if mnts, err := mounter.List(); err == nil {
+		for _, mnt := range mnts {
+			if filepath.Clean(mnt.Path) == path {
+				return true
+			}
+		}
+	}
+	notMnt, err := mounter.IsLikelyNotMountPoint(path)
+	return err == nil && !notMnt
+}
@@ -18,11 +18,17 @@ package utils
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
+	efi "github.com/canonical/go-efilib"
 	"github.com/jaypipes/ghw"
 	"github.com/jaypipes/ghw/pkg/block"
+	"github.com/jaypipes/ghw/pkg/context"
+	"github.com/jaypipes/ghw/pkg/linuxpath"
 	ghwUtil "github.com/jaypipes/ghw/pkg/util"
 
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
@@ -30,6 +36,10 @@ import (
 
 // ghwPartitionToInternalPartition transforms a block.Partition from ghw lib to our types.Partition type
 func ghwPartitionToInternalPartition(partition *block.Partition) *types.Partition {
+	guid := strings.ToLower(partition.UUID)
+	if partition.UUID == ghwUtil.UNKNOWN {
+		guid = ""
+	}
 	return &types.Partition{
 		FilesystemLabel: partition.FilesystemLabel,
 		Size:            uint(partition.SizeBytes / (1024 * 1024)), // Converts B to MB
@@ -39,6 +49,7 @@ func ghwPartitionToInternalPartition(partition *block.Partition) *types.Partitio
 		MountPoint:      partition.MountPoint,
 		Path:            filepath.Join("/dev", partition.Name),
 		Disk:            filepath.Join("/dev", partition.Disk.Name),
+		GUID:            guid,
 	}
 }
 
@@ -49,15 +60,91 @@ func GetAllPartitions() (types.PartitionList, error) {
 	if err != nil {
 		return nil, err
 	}
+	sysBlock := linuxpath.New(context.New()).SysBlock
 	for _, d := range blockDevices.Disks {
+		// The partitions of whole disk RAID members are the partitions of the array seen
+		// through a single member, they carry the same labels on every member disk
+		if isRaidMember(sysBlock, d.Name) {
+			continue
+		}
+		// The partition table is the reference for partition GUIDs, the udev database
+		// is only used if it can't be read
+		guids, _ := diskPartitionGUIDs(sysBlock, d.Name)
 		for _, part := range d.Partitions {
-			parts = append(parts, ghwPartitionToInternalPartition(part))
+			p := ghwPartitionToInternalPartition(part)
+			if guid := guids[partitionNumber(sysBlock, d.Name, part.Name)]; guid != "" {
+				p.GUID = guid
+			}
+			parts = append(parts, p)
 		}
 	}
 
 	return parts, nil
 }
 
+// ReadPartitionGUIDs reads the GPT partition table of the given device of the given size and
+// logical block size. It returns the unique GUIDs of the partitions indexed by partition number.
+func ReadPartitionGUIDs(r io.ReaderAt, size, blockSize int64) (map[int]string, error) {
+	table, err := efi.ReadPartitionTable(r, size, blockSize, efi.PrimaryPartitionTable, true)
+	if err != nil {
+		return nil, err
+	}
+	guids := map[int]string{}
+	for i, entry := range table.Entries {
+		if entry.PartitionTypeGUID == (efi.GUID{}) {
+			continue
+		}
+		guids[i+1] = strings.ToLower(entry.UniquePartitionGUID.String())
+	}
+	return guids, nil
+}
+
+// diskPartitionGUIDs reads the partition GUIDs of the given disk from its partition table
+func diskPartitionGUIDs(sysBlock, disk string) (map[int]string, error) {
+	f, err := os.Open(filepath.Join("/dev", disk))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	blockSize := int64(512)
+	data, err := os.ReadFile(filepath.Join(sysBlock, disk, "queue", "logical_block_size"))
+	if err == nil {
+		if bs, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err == nil && bs > 0 {
+			blockSize = bs
+		}
+	}
+	return ReadPartitionGUIDs(f, size, blockSize)
+}
+
+// partitionNumber returns the number of the given partition of the given disk, zero if unknown
+func partitionNumber(sysBlock, disk, part string) int {
+	data, err := os.ReadFile(filepath.Join(sysBlock, disk, part, "partition"))
+	if err != nil {
+		return 0
+	}
+	num, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return num
+}
+
+// isRaidMember checks if the given disk is held by a software RAID array
+func isRaidMember(sysBlock, disk string) bool {
+	holders, err := os.ReadDir(filepath.Join(sysBlock, disk, "holders"))
+	if err != nil {
+		return false
+	}
+	for _, holder := range holders {
+		if strings.HasPrefix(holder.Name(), "md") {
+			return true
+		}
+	}
+	return false
+}
+
 // GetPartitionFS gets the FS of a partition given
 func GetPartitionFS(partition string) (string, error) {
 	// We want to have the device always prefixed with a /dev
@@ -0,0 +1,123 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+// partedUnits maps the unit suffixes of parted to their size in bytes
+var partedUnits = map[string]float64{
+	"B":   1,
+	"kB":  1e3,
+	"MB":  1e6,
+	"GB":  1e9,
+	"TB":  1e12,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+	"TiB": 1 << 40,
+}
+
+// ParsePartedOutput parses the partitions of a 'parted --machine print' output. Only the
+// 'BYT;' format is supported. Positions in sectors are kept in sectors, any other unit
+// is converted to bytes. A device without partitions returns an empty list.
+func ParsePartedOutput(out []byte) ([]types.PartedPartition, error) {
+	var partitions []types.PartedPartition
+	var format string
+
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimSpace(out)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if format == "" {
+			format = strings.TrimSuffix(line, ";")
+			if format != "BYT" {
+				return nil, fmt.Errorf("unsupported parted output format '%s'", format)
+			}
+			continue
+		}
+		if !strings.HasSuffix(line, ";") {
+			return nil, fmt.Errorf("invalid parted output line '%s'", line)
+		}
+		fields := strings.Split(strings.TrimSuffix(line, ";"), ":")
+		num, err := strconv.Atoi(fields[0])
+		if err != nil {
+			// Device header line, i.e. '/dev/sda:500118192s:scsi:512:4096:gpt:ATA disk:;'
+			if len(fields) < 6 {
+				return nil, fmt.Errorf("invalid parted device line '%s'", line)
+			}
+			continue
+		}
+		if len(fields) < 7 {
+			return nil, fmt.Errorf("invalid parted partition line '%s'", line)
+		}
+		part := types.PartedPartition{Number: num, FileSystem: fields[4], Name: fields[5]}
+		var units [3]string
+		for i, val := range []*uint64{&part.Start, &part.End, &part.Size} {
+			*val, units[i], err = parsePartedValue(fields[i+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid parted partition line '%s': %w", line, err)
+			}
+		}
+		if units[0] != units[1] || units[0] != units[2] {
+			return nil, fmt.Errorf("mixed units in parted partition line '%s'", line)
+		}
+		part.Unit = units[0]
+		for _, flag := range strings.Split(fields[6], ",") {
+			if flag = strings.TrimSpace(flag); flag != "" {
+				part.Flags = append(part.Flags, flag)
+			}
+		}
+		partitions = append(partitions, part)
+	}
+	if format == "" {
+		return nil, fmt.Errorf("empty parted output")
+	}
+
+	return partitions, nil
+}
+
+// parsePartedValue parses a parted position or size and returns it together with its
+// unit, which is either "s" for sectors or "B" for bytes
+func parsePartedValue(value string) (uint64, string, error) {
+	if num, ok := strings.CutSuffix(value, "s"); ok {
+		parsed, err := strconv.ParseUint(num, 10, 64)
+		return parsed, "s", err
+	}
+	for i := len(value); i > 0; i-- {
+		if _, err := strconv.ParseFloat(value[:i], 64); err != nil {
+			continue
+		}
+		mult, ok := partedUnits[value[i:]]
+		if !ok {
+			return 0, "", fmt.Errorf("unknown unit in '%s'", value)
+		}
+		num, _ := strconv.ParseFloat(value[:i], 64)
+		return uint64(math.Round(num * mult)), "B", nil
+	}
+	return 0, "", fmt.Errorf("invalid value '%s'", value)
+}
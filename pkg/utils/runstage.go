@@ -18,12 +18,16 @@ package utils
 
 import (
 	"fmt"
+	"io/fs"
+	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/rancher/yip/pkg/schema"
 	"gopkg.in/yaml.v3"
 
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 )
 
@@ -85,7 +89,7 @@ func RunStage(cfg *types.Config, stage string, strict bool, cloudInitPaths ...st
 	// Run all stages for each of the default cloud config paths + extra cloud config paths
 	if len(cloudInitPaths) > 0 {
 		for _, s := range []string{stageBefore, stage, stageAfter} {
-			err = cfg.CloudInitRunner.Run(s, filterNonExistingLocalURIs(cfg, cloudInitPaths...)...)
+			err = runStageSources(cfg, s, stageConcurrency(cfg, s), filterNonExistingLocalURIs(cfg, cloudInitPaths...))
 			if err != nil {
 				allErrors = multierror.Append(allErrors, err)
 			}
@@ -116,6 +120,82 @@ func RunStage(cfg *types.Config, stage string, strict bool, cloudInitPaths ...st
 	return allErrors
 }
 
+// stageConcurrency returns the configured concurrency mode of the given stage, the '.before'
+// and '.after' stages default to the mode of their stage. Empty means the default mode.
+func stageConcurrency(cfg *types.Config, stage string) string {
+	if mode, ok := cfg.StageConcurrency[stage]; ok {
+		return mode
+	}
+	base := strings.TrimSuffix(strings.TrimSuffix(stage, ".before"), ".after")
+	return cfg.StageConcurrency[base]
+}
+
+// runStageSources runs the given stage of the cloud-init sources with the given concurrency
+// mode. On sequential and parallel modes each cloud-init file is run on its own, local
+// directories are expanded to their files.
+func runStageSources(cfg *types.Config, stage, mode string, sources []string) error {
+	if mode == "" {
+		return cfg.CloudInitRunner.Run(stage, sources...)
+	}
+
+	var files []string
+	for _, src := range sources {
+		files = append(files, cloudInitFiles(cfg, src)...)
+	}
+	cfg.Logger.Debugf("Running stage %s %s from files %v", stage, mode, files)
+
+	var allErrors error
+	if mode == constants.StageSequential {
+		for _, file := range files {
+			err := cfg.CloudInitRunner.Run(stage, file)
+			if err != nil {
+				allErrors = multierror.Append(allErrors, err)
+			}
+		}
+		return allErrors
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, file := range files {
+		wg.Add(1)
+		go func(file string) {
+			defer wg.Done()
+			err := cfg.CloudInitRunner.Run(stage, file)
+			if err != nil {
+				mu.Lock()
+				allErrors = multierror.Append(allErrors, err)
+				mu.Unlock()
+			}
+		}(file)
+	}
+	wg.Wait()
+	return allErrors
+}
+
+// cloudInitFiles returns the yaml files of the given local directory in walking order, as
+// sorted by name on each directory level the same way yip does. Any other source is returned as is.
+func cloudInitFiles(cfg *types.Config, src string) []string {
+	if local, _ := IsLocalURI(src); !local {
+		return []string{src}
+	}
+	if ok, _ := IsDir(cfg.Fs, src); !ok {
+		return []string{src}
+	}
+	var files []string
+	_ = WalkDirFs(cfg.Fs, src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := filepath.Ext(path)
+		if !d.IsDir() && (ext == ".yaml" || ext == ".yml") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files
+}
+
 // filterNonExistingLocalURIs attempts to remove non existing local paths from the given URI slice.
 // Returns the filtered slice.
 func filterNonExistingLocalURIs(cfg *types.Config, uris ...string) []string {
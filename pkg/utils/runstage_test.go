@@ -171,4 +171,50 @@ var _ = Describe("run stage", Label("RunStage"), func() {
 		Expect(ci.GetStageArgs("stage")).NotTo(ContainElement("/nonexisting"))
 		Expect(ci.GetStageArgs("stage")).NotTo(ContainElement("/wrongpath"))
 	})
+
+	Describe("stage concurrency", Label("concurrency"), func() {
+		var ci *mocks.FakeCloudInitRunner
+
+		BeforeEach(func() {
+			ci = &mocks.FakeCloudInitRunner{}
+			config.CloudInitRunner = ci
+			Expect(utils.MkdirAll(fs, "/dir/sub", constants.DirPerm)).To(Succeed())
+			for _, file := range []string{"/dir/b.yaml", "/dir/a.yml", "/dir/sub/c.yaml", "/dir/notes.txt"} {
+				Expect(fs.WriteFile(file, []byte(testingStages), constants.FilePerm)).To(Succeed())
+			}
+			// The cmdline is always run last
+			Expect(writeCmdline("quiet", fs)).To(Succeed())
+		})
+		It("runs the whole directory at once by default", func() {
+			Expect(utils.RunStage(config, "stage", strict, "/dir")).To(Succeed())
+			Expect(ci.GetStageArgs("stage")).To(Equal([]string{"/dir", "quiet"}))
+		})
+		It("runs each file on its own sorted by name", func() {
+			config.StageConcurrency = map[string]string{"stage": constants.StageSequential}
+			Expect(utils.RunStage(config, "stage", strict, "/dir", "https://my.domain.org/cloud-file")).To(Succeed())
+			files := []string{"/dir/a.yml", "/dir/b.yaml", "/dir/sub/c.yaml", "https://my.domain.org/cloud-file", "quiet"}
+			Expect(ci.GetStageArgs("stage")).To(Equal(files))
+
+			// before and after stages inherit the stage mode
+			Expect(ci.GetStageArgs("stage.before")).To(Equal(files))
+			Expect(ci.GetStageArgs("stage.after")).To(Equal(files))
+		})
+		It("applies the mode of the before and after stages", func() {
+			config.StageConcurrency = map[string]string{"stage.before": constants.StageSequential}
+			Expect(utils.RunStage(config, "stage", strict, "/dir")).To(Succeed())
+			Expect(ci.GetStageArgs("stage.before")).To(HaveLen(4))
+			Expect(ci.GetStageArgs("stage")).To(Equal([]string{"/dir", "quiet"}))
+		})
+		It("runs each file concurrently", func() {
+			config.StageConcurrency = map[string]string{"stage": constants.StageParallel}
+			Expect(utils.RunStage(config, "stage", strict, "/dir")).To(Succeed())
+			Expect(ci.GetStageArgs("stage")).To(ConsistOf("/dir/a.yml", "/dir/b.yaml", "/dir/sub/c.yaml", "quiet"))
+		})
+		It("reports the errors of all files in strict mode", func() {
+			ci.Error = true
+			config.StageConcurrency = map[string]string{"stage": constants.StageParallel}
+			Expect(utils.RunStage(config, "stage", true, "/dir")).NotTo(Succeed())
+			Expect(ci.ExecStages).To(HaveLen(12))
+		})
+	})
 })
@@ -0,0 +1,60 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"time"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+// PhaseTimer records the duration of each phase of an action
+type PhaseTimer struct {
+	logger  types.Logger
+	start   time.Time
+	timings []types.PhaseTiming
+}
+
+// NewPhaseTimer returns a new timer, the total duration is measured from now on
+func NewPhaseTimer(logger types.Logger) *PhaseTimer {
+	return &PhaseTimer{logger: logger, start: time.Now()}
+}
+
+// Track starts measuring the given phase, the returned function stops
+// the measurement and records it.
+func (t *PhaseTimer) Track(phase string) func() {
+	start := time.Now()
+	return func() {
+		elapsed := time.Since(start).Round(time.Millisecond)
+		t.logger.Debugf("Phase %s took %s", phase, elapsed)
+		t.timings = append(t.timings, types.PhaseTiming{Phase: phase, Duration: elapsed.String()})
+	}
+}
+
+// Timings returns the recorded phases in the order they were completed
+func (t *PhaseTimer) Timings() []types.PhaseTiming {
+	return t.timings
+}
+
+// Summary logs the duration of each recorded phase and the total duration
+func (t *PhaseTimer) Summary() {
+	t.logger.Info("Phase timings:")
+	for _, timing := range t.timings {
+		t.logger.Infof("  %s: %s", timing.Phase, timing.Duration)
+	}
+	t.logger.Infof("  total: %s", time.Since(t.start).Round(time.Millisecond))
+}
@@ -23,8 +23,11 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
+	"math"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
@@ -241,6 +244,7 @@ var _ = Describe("Utils", Label("utils"), func() {
 				Partitions: []*block.Partition{
 					{
 						Name: "sdb1Test",
+						UUID: "3F2504E0-4F89-41D3-9A0C-0305E82C3301",
 					},
 				},
 			}
@@ -262,6 +266,66 @@ var _ = Describe("Utils", Label("utils"), func() {
 			Expect(devices).To(ContainElement(ContainSubstring("sda2Test")))
 			Expect(devices).To(ContainElement(ContainSubstring("sdb1Test")))
 		})
+		It("returns the partition GUIDs of the udev database", Label("guid"), func() {
+			parts, err := utils.GetAllPartitions()
+			Expect(err).To(BeNil())
+			guids := map[string]string{}
+			for _, p := range parts {
+				guids[p.Path] = p.GUID
+			}
+			Expect(guids).To(HaveKeyWithValue("/dev/sdb1Test", "3f2504e0-4f89-41d3-9a0c-0305e82c3301"))
+			Expect(guids).To(HaveKeyWithValue("/dev/sda1Test", ""))
+		})
+		It("skips the partitions of whole disk RAID members", Label("raid"), func() {
+			ghwTest.Clean()
+			ghwTest = mocks.GhwMock{}
+			for _, disk := range []string{"sda", "sdb", "md127"} {
+				name := disk + "1"
+				if disk == "md127" {
+					name = disk + "p1"
+				}
+				ghwTest.AddDisk(block.Disk{
+					Name:       disk,
+					Partitions: []*block.Partition{{Name: name, Label: constants.StatePartName, FilesystemLabel: constants.StateLabel}},
+				})
+			}
+			ghwTest.CreateDevices()
+			ghwTest.AddHolder("sda", "md127")
+			ghwTest.AddHolder("sdb", "md127")
+
+			parts, err := utils.GetAllPartitions()
+			Expect(err).To(BeNil())
+			Expect(parts).To(HaveLen(1))
+			Expect(parts[0].Path).To(Equal("/dev/md127p1"))
+
+			ep, err := types.PartitionSelection{}.ElementalPartitions(parts, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ep.State.Path).To(Equal("/dev/md127p1"))
+		})
+	})
+	Describe("ReadPartitionGUIDs", Label("partitions", "guid"), func() {
+		It("reads the partition GUIDs of the partition table", func() {
+			img := mocks.NewGPTImage(
+				"3F2504E0-4F89-41D3-9A0C-0305E82C3301", "", "8c5b2f0e-7e2a-4a5b-9d1e-2f4a6b8c0d1e",
+			)
+			guids, err := utils.ReadPartitionGUIDs(bytes.NewReader(img), int64(len(img)), 512)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(guids).To(Equal(map[int]string{
+				1: "3f2504e0-4f89-41d3-9a0c-0305e82c3301",
+				3: "8c5b2f0e-7e2a-4a5b-9d1e-2f4a6b8c0d1e",
+			}))
+		})
+		It("fails on disks without a valid GPT partition table", func() {
+			img := make([]byte, 64*512)
+			_, err := utils.ReadPartitionGUIDs(bytes.NewReader(img), int64(len(img)), 512)
+			Expect(err).To(HaveOccurred())
+
+			img = mocks.NewGPTImage("3F2504E0-4F89-41D3-9A0C-0305E82C3301")
+			// Corrupt the header
+			img[512+40] = 0xff
+			_, err = utils.ReadPartitionGUIDs(bytes.NewReader(img), int64(len(img)), 512)
+			Expect(err).To(HaveOccurred())
+		})
 	})
 	Describe("GetPartitionFS", Label("lsblk", "partitions"), func() {
 		var ghwTest mocks.GhwMock
@@ -297,21 +361,278 @@ var _ = Describe("Utils", Label("utils"), func() {
 			Expect(err).NotTo(BeNil())
 		})
 	})
+	Describe("GrowPartition", Label("GrowPartition", "partitions"), func() {
+		var lsblkOut string
+		var growErr bool
+		var fsckExitCode int
+		BeforeEach(func() {
+			lsblkOut = `FSTYPE="ext4" MOUNTPOINT="/run/elemental/persistent"`
+			growErr = false
+			fsckExitCode = 0
+			runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+				switch cmd {
+				case "lsblk":
+					return []byte(lsblkOut), nil
+				case "e2fsck":
+					if fsckExitCode != 0 {
+						return []byte{}, exec.Command("sh", "-c", fmt.Sprintf("exit %d", fsckExitCode)).Run()
+					}
+				case "growpart":
+					if growErr {
+						return []byte("NOCHANGE: partition 5 is size 2048. it cannot be grown"), fmt.Errorf("exit status 1")
+					}
+				}
+				return []byte{}, nil
+			}
+		})
+		It("grows a mounted ext4 partition online", func() {
+			Expect(utils.GrowPartition(runner, "/dev/sda", 5)).To(Succeed())
+			Expect(runner.CmdsMatch([][]string{
+				{"growpart", "/dev/sda", "5"},
+				{"udevadm", "settle"},
+				{"lsblk", "-nPo", "FSTYPE,MOUNTPOINT", "/dev/sda5"},
+				{"resize2fs", "/dev/sda5"},
+			})).To(Succeed())
+		})
+		It("checks an unmounted ext4 filesystem before resizing it", func() {
+			lsblkOut = `FSTYPE="ext4" MOUNTPOINT=""`
+			Expect(utils.GrowPartition(runner, "/dev/nvme0n1", 5)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{
+				{"e2fsck", "-fy", "/dev/nvme0n1p5"},
+				{"resize2fs", "/dev/nvme0n1p5"},
+			})).To(Succeed())
+		})
+		It("grows an ext4 filesystem once e2fsck corrected its errors", func() {
+			lsblkOut = `FSTYPE="ext4" MOUNTPOINT=""`
+			fsckExitCode = 1
+			Expect(utils.GrowPartition(runner, "/dev/sda", 5)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"resize2fs", "/dev/sda5"}})).To(Succeed())
+		})
+		It("fails if e2fsck could not correct filesystem errors", func() {
+			lsblkOut = `FSTYPE="ext4" MOUNTPOINT=""`
+			fsckExitCode = 4
+			Expect(utils.GrowPartition(runner, "/dev/sda", 5)).NotTo(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"resize2fs", "/dev/sda5"}})).NotTo(Succeed())
+		})
+		It("grows xfs and btrfs filesystems at their mount point", func() {
+			lsblkOut = `FSTYPE="xfs" MOUNTPOINT="/data"`
+			Expect(utils.GrowPartition(runner, "/dev/sda", 5)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"xfs_growfs", "/data"}})).To(Succeed())
+			lsblkOut = `FSTYPE="btrfs" MOUNTPOINT="/data"`
+			Expect(utils.GrowPartition(runner, "/dev/sda", 5)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"btrfs", "filesystem", "resize", "max", "/data"}})).To(Succeed())
+		})
+		It("fails to grow an unmounted xfs filesystem", func() {
+			lsblkOut = `FSTYPE="xfs" MOUNTPOINT=""`
+			Expect(utils.GrowPartition(runner, "/dev/sda", 5)).NotTo(Succeed())
+		})
+		It("is a no-op for the partition table if it is already expanded", func() {
+			growErr = true
+			Expect(utils.GrowPartition(runner, "/dev/sda", 5)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"resize2fs", "/dev/sda5"}})).To(Succeed())
+		})
+		It("uses parted if growpart is not available", func() {
+			runner.CmdNotFound = "growpart"
+			Expect(utils.GrowPartition(runner, "/dev/sda", 5)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{
+				{"parted", "--script", "--fix", "/dev/sda", "--", "resizepart", "5", "100%"},
+			})).To(Succeed())
+		})
+		It("fails if the partition has no filesystem", func() {
+			lsblkOut = `FSTYPE="" MOUNTPOINT="/mnt"`
+			err := utils.GrowPartition(runner, "/dev/sda", 5)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("could not find filesystem"))
+		})
+		It("fails on unsupported filesystems", func() {
+			lsblkOut = `FSTYPE="vfat" MOUNTPOINT="/boot"`
+			err := utils.GrowPartition(runner, "/dev/sda", 1)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("unsupported filesystem"))
+		})
+	})
+	Describe("FindAutoTarget", Label("FindAutoTarget", "lsblk"), func() {
+		var disks, liveSrc, isoScanSrc, labels string
+		BeforeEach(func() {
+			liveSrc = "/dev/sdb1"
+			isoScanSrc = ""
+			labels = `{"blockdevices": [
+				{"name": "/dev/sda", "pkname": null, "label": null},
+				{"name": "/dev/sda1", "pkname": "/dev/sda", "label": "DATA"},
+				{"name": "/dev/nvme0n1", "pkname": null, "label": "BACKUP"}
+			]}`
+			disks = "/dev/sda 21474836480 disk 0 0\n" +
+				"/dev/sdb 8589934592 disk 0 0\n" +
+				"/dev/nvme0n1 107374182400 disk 0 0\n" +
+				"/dev/sr0 1073741824 rom 1 0\n" +
+				"/dev/loop0 536870912 loop 0 0\n"
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				switch {
+				case cmd == "findmnt" && args[len(args)-1] == constants.IsoScanDir:
+					return []byte(isoScanSrc), nil
+				case cmd == "findmnt":
+					return []byte(liveSrc), nil
+				case cmd == "lsblk" && args[0] == "-Jlnpo":
+					return []byte(labels), nil
+				case cmd == "lsblk" && args[len(args)-2] == "PKNAME":
+					return []byte("/dev/sdb\n"), nil
+				case cmd == "lsblk":
+					return []byte(disks), nil
+				}
+				return []byte{}, nil
+			}
+		})
+		It("picks the largest non-removable disk", func() {
+			target, err := utils.FindAutoTarget(runner, false, false, nil, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(target).To(Equal("/dev/nvme0n1"))
+		})
+		It("excludes the installer media", func() {
+			disks = "/dev/sda 21474836480 disk 0 0\n/dev/sdb 107374182400 disk 0 0\n"
+			target, err := utils.FindAutoTarget(runner, false, false, nil, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(target).To(Equal("/dev/sda"))
+		})
+		It("fails if the choice is ambiguous unless forced", func() {
+			disks = "/dev/sda 21474836480 disk 0 0\n/dev/sdc 21474836480 disk 0 0\n"
+			_, err := utils.FindAutoTarget(runner, false, false, nil, nil)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("unambiguously"))
+			target, err := utils.FindAutoTarget(runner, false, true, nil, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(target).To(Equal("/dev/sda"))
+		})
+		It("fails if there are only removable disks unless they are allowed", func() {
+			liveSrc = ""
+			disks = "/dev/sda 21474836480 disk 1 0\n/dev/sdc 8589934592 disk 0 1\n"
+			_, err := utils.FindAutoTarget(runner, false, false, nil, nil)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("only removable disks"))
+			target, err := utils.FindAutoTarget(runner, true, false, nil, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(target).To(Equal("/dev/sda"))
+		})
+		It("excludes the disk holding the installer ISO file", func() {
+			liveSrc = "/dev/loop0"
+			isoScanSrc = "/dev/nvme0n1p1"
+			disks = "/dev/sda 21474836480 disk 0 0\n/dev/nvme0n1 107374182400 disk 0 0\n"
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				switch {
+				case cmd == "findmnt" && args[len(args)-1] == constants.IsoScanDir:
+					return []byte(isoScanSrc), nil
+				case cmd == "findmnt":
+					return []byte(liveSrc), nil
+				case cmd == "lsblk" && args[len(args)-1] == isoScanSrc:
+					return []byte("/dev/nvme0n1\n"), nil
+				case cmd == "lsblk" && args[len(args)-2] == "PKNAME":
+					return []byte{}, nil
+				case cmd == "lsblk":
+					return []byte(disks), nil
+				}
+				return []byte{}, nil
+			}
+			target, err := utils.FindAutoTarget(runner, false, false, nil, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(target).To(Equal("/dev/sda"))
+		})
+		It("excludes the given device paths", func() {
+			target, err := utils.FindAutoTarget(runner, false, false, nil, []string{"/dev/nvme0n1"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(target).To(Equal("/dev/sda"))
+		})
+		It("excludes disks including any of the given labels", func() {
+			disks = "/dev/sda 21474836480 disk 0 0\n/dev/sdc 8589934592 disk 0 0\n" +
+				"/dev/nvme0n1 107374182400 disk 0 0\n"
+			target, err := utils.FindAutoTarget(runner, false, false, []string{"DATA"}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(target).To(Equal("/dev/nvme0n1"))
+			target, err = utils.FindAutoTarget(runner, false, false, []string{"DATA", "BACKUP"}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(target).To(Equal("/dev/sdc"))
+		})
+		It("fails if labels can't be listed", func() {
+			labels = "wrong"
+			_, err := utils.FindAutoTarget(runner, false, false, []string{"DATA"}, nil)
+			Expect(err).To(HaveOccurred())
+		})
+		It("fails if there is no disk available", func() {
+			disks = "/dev/sdb 8589934592 disk 0 0\n"
+			_, err := utils.FindAutoTarget(runner, true, true, nil, nil)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("DiskType", Label("device-type"), func() {
+		BeforeEach(func() {
+			for disk, model := range map[string]string{
+				"sda": "ST4000NM0035", "sdb": "Samsung SSD 870", "nvme0n1": "INTEL SSDPED1D280GA",
+				"nvme1n1": "Samsung SSD 980 PRO", "nvme2n1": "Intel Optane SSD 905P",
+			} {
+				Expect(utils.MkdirAll(fs, filepath.Join("/sys/block", disk, "device"), constants.DirPerm)).To(Succeed())
+				Expect(utils.MkdirAll(fs, filepath.Join("/sys/block", disk, "queue"), constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(filepath.Join("/sys/block", disk, "device/model"), []byte(model+"\n"), constants.FilePerm)).To(Succeed())
+				Expect(fs.WriteFile(filepath.Join("/sys/block", disk, "queue/rotational"), []byte("0\n"), constants.FilePerm)).To(Succeed())
+			}
+			Expect(fs.WriteFile("/sys/block/sda/queue/rotational", []byte("1\n"), constants.FilePerm)).To(Succeed())
+		})
+		It("detects the device class of disks", func() {
+			Expect(utils.DiskType(fs, "/dev/sda")).To(Equal(constants.DiskTypeHDD))
+			Expect(utils.DiskType(fs, "/dev/sdb")).To(Equal(constants.DiskTypeSSD))
+			Expect(utils.DiskType(fs, "/dev/nvme0n1")).To(Equal(constants.DiskTypeOptane))
+			Expect(utils.DiskType(fs, "/dev/nvme1n1")).To(Equal(constants.DiskTypeNVMe))
+			Expect(utils.DiskType(fs, "/dev/nvme2n1")).To(Equal(constants.DiskTypeOptane))
+			Expect(utils.DiskType(fs, "/dev/pmem0")).To(Equal(constants.DiskTypeNVDIMM))
+			Expect(utils.DiskType(fs, "/dev/vda")).To(BeEmpty())
+		})
+		It("lists the device class of the disks of the host", func() {
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				return []byte("/dev/sda 21474836480 disk 0 0\n/dev/pmem0 8589934592 disk 0 0\n/dev/sr0 1073741824 rom 1 0\n"), nil
+			}
+			diskTypes, err := utils.DiskTypes(fs, runner)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(diskTypes).To(Equal(map[string]string{"/dev/sda": constants.DiskTypeHDD, "/dev/pmem0": constants.DiskTypeNVDIMM}))
+		})
+	})
 	Describe("CosignVerify", Label("cosign"), func() {
 		It("runs a keyless verification", func() {
-			_, err := utils.CosignVerify(fs, runner, "some/image:latest", "", true)
+			_, err := utils.CosignVerify(fs, runner, "some/image:latest", "", true, nil)
 			Expect(err).To(BeNil())
 			Expect(runner.CmdsMatch([][]string{{"cosign", "-d=true", "some/image:latest"}})).To(BeNil())
+			Expect(runner.Env).To(ContainElement("COSIGN_EXPERIMENTAL=1"))
+			Expect(os.Getenv("COSIGN_EXPERIMENTAL")).To(BeEmpty())
 		})
 		It("runs a verification using a public key", func() {
-			_, err := utils.CosignVerify(fs, runner, "some/image:latest", "https://mykey.pub", false)
+			_, err := utils.CosignVerify(fs, runner, "some/image:latest", "https://mykey.pub", false, nil)
 			Expect(err).To(BeNil())
 			Expect(runner.CmdsMatch(
 				[][]string{{"cosign", "-key", "https://mykey.pub", "some/image:latest"}},
 			)).To(BeNil())
 		})
+		It("runs a verification with the source credentials", Label("auth"), func() {
+			var dockerConfig []byte
+			runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+				if cmd == "cosign" {
+					var dockerDir string
+					for _, v := range runner.Env {
+						if strings.HasPrefix(v, "DOCKER_CONFIG=") {
+							dockerDir = strings.TrimPrefix(v, "DOCKER_CONFIG=")
+						}
+					}
+					var err error
+					dockerConfig, err = fs.ReadFile(filepath.Join(dockerDir, "config.json"))
+					Expect(err).NotTo(HaveOccurred())
+				}
+				return []byte{}, nil
+			}
+			auth := &types.RegistryAuth{Username: "user", Password: "secret"}
+			_, err := utils.CosignVerify(fs, runner, "registry.org/some/image:latest", "", false, auth)
+			Expect(err).To(BeNil())
+			Expect(string(dockerConfig)).To(ContainSubstring("registry.org"))
+			// The process environment is left untouched
+			Expect(os.Getenv("DOCKER_CONFIG")).To(BeEmpty())
+			Expect(os.Getenv("TUF_ROOT")).To(BeEmpty())
+		})
 		It("Fails to to create temporary directories", func() {
-			_, err := utils.CosignVerify(vfs.NewReadOnlyFS(fs), runner, "some/image:latest", "", true)
+			_, err := utils.CosignVerify(vfs.NewReadOnlyFS(fs), runner, "some/image:latest", "", true, nil)
 			Expect(err).NotTo(BeNil())
 		})
 	})
@@ -331,6 +652,36 @@ var _ = Describe("Utils", Label("utils"), func() {
 			Expect(duration.Seconds() >= 3).To(BeTrue())
 		})
 	})
+	Describe("SyncAndDropCaches", Label("sync"), func() {
+		It("syncs and drops caches", func() {
+			Expect(utils.MkdirAll(fs, filepath.Dir(constants.DropCachesFile), constants.DirPerm)).To(Succeed())
+			Expect(utils.SyncAndDropCaches(fs, runner)).To(Succeed())
+			Expect(runner.CmdsMatch([][]string{{"sync"}})).To(Succeed())
+			data, err := fs.ReadFile(constants.DropCachesFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(Equal("3"))
+		})
+		It("fails if sync fails", func() {
+			runner.ReturnError = errors.New("sync error")
+			Expect(utils.SyncAndDropCaches(fs, runner)).To(MatchError(ContainSubstring("sync error")))
+		})
+		It("fails if caches can't be dropped", func() {
+			Expect(utils.SyncAndDropCaches(fs, runner)).To(MatchError(ContainSubstring("dropping caches")))
+		})
+	})
+	Describe("WipeFilesystemSignatures", Label("wipefs", "partitions"), func() {
+		It("wipes all signatures of the device", func() {
+			Expect(utils.WipeFilesystemSignatures(runner, "/dev/sda1")).To(Succeed())
+			Expect(runner.CmdsMatch([][]string{{"wipefs", "--all", "/dev/sda1"}})).To(Succeed())
+		})
+		It("fails including the wipefs output", func() {
+			runner.ReturnValue = []byte("wipefs: error: /dev/sda1: probing initialization failed")
+			runner.ReturnError = errors.New("exit status 1")
+			err := utils.WipeFilesystemSignatures(runner, "/dev/sda1")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("probing initialization failed"))
+		})
+	})
 	Describe("GetFullDeviceByLabel", Label("lsblk", "partitions"), func() {
 		var cmds [][]string
 		BeforeEach(func() {
@@ -592,6 +943,18 @@ var _ = Describe("Utils", Label("utils"), func() {
 			fs.RemoveAll(sourceDir)
 			Expect(utils.SyncData(logger, realRunner, nil, "/welp", destDir)).NotTo(BeNil())
 		})
+		It("lists the source paths differing in target", Label("diff"), func() {
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				return []byte(".d..t...... ./\n>fc.T...... etc/os-release\ncd+++++++++ usr/lib/\n.f...p..... usr/bin/ls\n"), nil
+			}
+			diff, err := utils.DiffData(logger, runner, nil, sourceDir, destDir, "/proc/*")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(diff).To(Equal([]string{"etc/os-release", "usr/lib/"}))
+			Expect(runner.CmdsMatch([][]string{{
+				"rsync", "--dry-run", "--checksum", "--itemize-changes", "--archive",
+				"--exclude=/proc/*", sourceDir + "/", destDir + "/",
+			}})).To(Succeed())
+		})
 	})
 	Describe("IsLocalURI", Label("uri"), func() {
 		It("Detects a local url", func() {
@@ -728,6 +1091,187 @@ var _ = Describe("Utils", Label("utils"), func() {
 			Expect(err).Should(HaveOccurred())
 		})
 	})
+	Describe("CountInodes", Label("fs", "inodes"), func() {
+		BeforeEach(func() {
+			Expect(utils.MkdirAll(fs, "/folder/subfolder", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/folder/file", []byte{}, constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile("/folder/subfolder/file", []byte{}, constants.FilePerm)).To(Succeed())
+			Expect(fs.Symlink("file", "/folder/link")).To(Succeed())
+		})
+		It("counts files, directories and links", func() {
+			count, err := utils.CountInodes(fs, "/folder")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(count).To(Equal(uint64(5)))
+		})
+		It("skips excluded subdirectories", func() {
+			count, err := utils.CountInodes(fs, "/folder", "/folder/subfolder")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(count).To(Equal(uint64(3)))
+		})
+		It("adds the headroom and overhead to the image inodes", Label("size-policy"), func() {
+			Expect(utils.ComputeImageInodes(1000, types.SizePolicy{Headroom: 20})).To(Equal(1200 + constants.ImgInodeOverhead))
+		})
+	})
+	Describe("FilterTreePaths", Label("fs"), func() {
+		BeforeEach(func() {
+			for _, dir := range []string{"/root/usr/share/doc/pkg", "/root/usr/share/doc/keep", "/root/usr/bin"} {
+				Expect(utils.MkdirAll(fs, dir, constants.DirPerm)).To(Succeed())
+			}
+			for _, file := range []string{"/root/usr/share/doc/pkg/README", "/root/usr/share/doc/keep/README", "/root/usr/bin/tool.debug"} {
+				_, err := fs.Create(file)
+				Expect(err).ShouldNot(HaveOccurred())
+			}
+		})
+		It("returns excluded paths without walking into excluded directories", func() {
+			excludes := []*regexp.Regexp{regexp.MustCompile(`^/usr/share/doc/`), regexp.MustCompile(`\.debug$`)}
+			paths, err := utils.FilterTreePaths(fs, "/root", nil, excludes)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(paths).To(Equal([]string{"/usr/bin/tool.debug", "/usr/share/doc/keep", "/usr/share/doc/pkg"}))
+		})
+		It("keeps excluded paths matching an include expression", func() {
+			includes := []*regexp.Regexp{regexp.MustCompile(`^/usr/share/doc/keep`)}
+			excludes := []*regexp.Regexp{regexp.MustCompile(`^/usr/share/doc/`)}
+			paths, err := utils.FilterTreePaths(fs, "/root", includes, excludes)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(paths).To(Equal([]string{"/usr/share/doc/pkg"}))
+		})
+		It("returns no paths without exclude expressions", func() {
+			paths, err := utils.FilterTreePaths(fs, "/root", nil, nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(paths).To(BeEmpty())
+		})
+	})
+	Describe("ComputeImageSize", Label("size-policy"), func() {
+		const MiB = int64(1024 * 1024)
+		It("adds the overhead and rounds up to a MiB by default", func() {
+			policy := types.SizePolicy{Overhead: 256}
+			Expect(utils.ComputeImageSize(100*MiB, policy)).To(Equal(356 * MiB))
+			Expect(utils.ComputeImageSize(100*MiB+1, policy)).To(Equal(357 * MiB))
+		})
+		It("adds the headroom and rounds up to the given multiple", func() {
+			policy := types.SizePolicy{Headroom: 20, RoundTo: 64}
+			// 1000MiB + 20% = 1200MiB, rounded up to 1216MiB
+			Expect(utils.ComputeImageSize(1000*MiB, policy)).To(Equal(1216 * MiB))
+			Expect(utils.ComputeImageSize(1280*MiB*10/12, policy)).To(Equal(1280 * MiB))
+		})
+		It("applies the minimum size", func() {
+			policy := types.SizePolicy{Headroom: 20, RoundTo: 64, MinSize: 512}
+			Expect(utils.ComputeImageSize(10*MiB, policy)).To(Equal(512 * MiB))
+			Expect(utils.ComputeImageSize(0, types.SizePolicy{})).To(Equal(int64(0)))
+		})
+	})
+	Describe("FreeSpaceMB", Label("fs"), func() {
+		It("returns the available space of the given path", func() {
+			runner.SideEffect = func(_ string, _ ...string) ([]byte, error) {
+				return []byte("Avail\n  2048\n"), nil
+			}
+			free, err := utils.FreeSpaceMB(runner, "/data")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(free).To(Equal(uint(2048)))
+			Expect(runner.CmdsMatch([][]string{{"df", "--output=avail", "--block-size=1M", "/data"}})).To(Succeed())
+		})
+		It("fails on unexpected df output", func() {
+			_, err := utils.FreeSpaceMB(runner, "/data")
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+	Describe("FreeInodes", Label("fs", "inodes"), func() {
+		It("returns the available inodes of the given path", func() {
+			runner.SideEffect = func(_ string, _ ...string) ([]byte, error) {
+				return []byte(" Inodes  IFree\n 65536   1024\n"), nil
+			}
+			free, err := utils.FreeInodes(runner, "/data")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(free).To(Equal(uint64(1024)))
+			Expect(runner.CmdsMatch([][]string{{"df", "--output=itotal,iavail", "/data"}})).To(Succeed())
+		})
+		It("returns no limit for filesystems without fixed inodes", func() {
+			runner.SideEffect = func(_ string, _ ...string) ([]byte, error) {
+				return []byte(" Inodes  IFree\n 0   0\n"), nil
+			}
+			free, err := utils.FreeInodes(runner, "/data")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(free).To(Equal(uint64(math.MaxUint64)))
+		})
+		It("fails on unexpected df output", func() {
+			_, err := utils.FreeInodes(runner, "/data")
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+	Describe("ParsePartedOutput", Label("parted", "partitions"), func() {
+		It("parses a gpt table in sectors", func() {
+			parts, err := utils.ParsePartedOutput([]byte(`BYT;
+/dev/sda:500118192s:scsi:512:4096:gpt:ATA disk:;
+1:2048s:133119s:131072s:fat16:efi:boot, esp;
+2:133120s:264191s:131072s:ext4:oem:;
+`))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(parts).To(Equal([]types.PartedPartition{
+				{Number: 1, Start: 2048, End: 133119, Size: 131072, Unit: "s", FileSystem: "fat16", Name: "efi", Flags: []string{"boot", "esp"}},
+				{Number: 2, Start: 133120, End: 264191, Size: 131072, Unit: "s", FileSystem: "ext4", Name: "oem"},
+			}))
+		})
+		It("parses a msdos table with unit suffixes", func() {
+			parts, err := utils.ParsePartedOutput([]byte(`BYT;
+/dev/loop0:25.9GB:loopback:512:512:msdos:Loopback device:;
+1:1049kB:50.3MB:49.3MB:ext4::type=83;
+2:512B:1024B:512B:::boot, type=83;`))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(parts).To(HaveLen(2))
+			Expect(parts[0]).To(Equal(types.PartedPartition{
+				Number: 1, Start: 1049000, End: 50300000, Size: 49300000, Unit: "B", FileSystem: "ext4", Flags: []string{"type=83"},
+			}))
+			Expect(parts[1].Flags).To(Equal([]string{"boot", "type=83"}))
+		})
+		It("returns no partitions for an empty table", func() {
+			parts, err := utils.ParsePartedOutput([]byte("BYT;\n/dev/sda:500118192s:scsi:512:4096:gpt:ATA disk:;\n"))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(parts).To(BeEmpty())
+		})
+		It("fails on unsupported or malformed output", func() {
+			_, err := utils.ParsePartedOutput([]byte(""))
+			Expect(err).Should(HaveOccurred())
+			_, err = utils.ParsePartedOutput([]byte("CHS;\n/dev/sda:1024,255,63:scsi:512:4096:gpt:ATA disk:;"))
+			Expect(err).Should(HaveOccurred())
+			_, err = utils.ParsePartedOutput([]byte("BYT;\n1:2048s:133119s:131072s:fat16:efi;"))
+			Expect(err).Should(HaveOccurred())
+			_, err = utils.ParsePartedOutput([]byte("BYT;\n1:2048s:133119s:131072s:fat16:efi:boot"))
+			Expect(err).Should(HaveOccurred())
+			_, err = utils.ParsePartedOutput([]byte("BYT;\n1:2048s:64MB:131072s:fat16:efi:;"))
+			Expect(err).Should(HaveOccurred())
+			_, err = utils.ParsePartedOutput([]byte("BYT;\n1:2048s:10XB:131072s:fat16:efi:;"))
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+	Describe("CompareVersions", Label("version"), func() {
+		It("compares semantic versions", func() {
+			for _, c := range []struct {
+				a, b string
+				res  int
+			}{
+				{"1.2.3", "1.2.3", 0},
+				{"v1.2.3", "1.2.3+build.5", 0},
+				{"1.2", "1.2.0", 0},
+				{"1.10.0", "1.9.0", 1},
+				{"2", "1.99.99", 1},
+				{"1.2.3-rc1", "1.2.3", -1},
+				{"1.2.3-alpha", "1.2.3-alpha.1", -1},
+				{"1.2.3-alpha.1", "1.2.3-alpha.beta", -1},
+				{"1.2.3-beta.11", "1.2.3-beta.2", 1},
+				{"1.2.3-rc.1", "1.2.3-beta", 1},
+			} {
+				res, err := utils.CompareVersions(c.a, c.b)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(res).To(Equal(c.res), "comparing %s and %s", c.a, c.b)
+			}
+		})
+		It("fails on invalid versions", func() {
+			_, err := utils.CompareVersions("", "1.0")
+			Expect(err).Should(HaveOccurred())
+			_, err = utils.CompareVersions("1.0", "latest")
+			Expect(err).Should(HaveOccurred())
+		})
+	})
 	Describe("ResolveLink", func() {
 		var rootDir, file, relSymlink, absSymlink, nestSymlink, brokenSymlink string
 
@@ -936,6 +1480,63 @@ var _ = Describe("Utils", Label("utils"), func() {
 			Expect(err).Should(HaveOccurred())
 		})
 	})
+	Describe("FindUniqueFile", Label("find"), func() {
+		BeforeEach(func() {
+			Expect(utils.MkdirAll(fs, "/path/boot", constants.DirPerm)).To(Succeed())
+			_, err := fs.Create("/path/boot/kernel-5.3-31-def")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(fs.Symlink("kernel-5.3-31-def", "/path/boot/kernel")).To(Succeed())
+		})
+		It("finds the single file matching the pattern", func() {
+			f, err := utils.FindUniqueFile(fs, "/path", "/boot/kernel*")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(f).To(Equal("/path/boot/kernel-5.3-31-def"))
+		})
+		It("fails if no file matches", func() {
+			_, err := utils.FindUniqueFile(fs, "/path", "/boot/vmlinuz*")
+			Expect(err).Should(HaveOccurred())
+		})
+		It("fails if the pattern is ambiguous", func() {
+			_, err := fs.Create("/path/boot/kernel-5.4-1-def")
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = utils.FindUniqueFile(fs, "/path", "/boot/kernel-*")
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("ambiguous"))
+		})
+	})
+	Describe("IsMounted", Label("mount"), func() {
+		It("checks the given path is in the mount list", func() {
+			mounter := mocks.NewFakeMounter()
+			Expect(utils.IsMounted(mounter, "/some/mountpoint")).To(BeFalse())
+			Expect(mounter.Mount("/some/dir", "/some/mountpoint", "bind", []string{"bind"})).To(Succeed())
+			Expect(utils.IsMounted(mounter, "/some/mountpoint/")).To(BeTrue())
+			Expect(utils.IsMounted(mounter, "/some")).To(BeFalse())
+		})
+	})
+	Describe("SafeRemoveAll", Label("fs", "remove"), func() {
+		BeforeEach(func() {
+			Expect(utils.MkdirAll(fs, "/some/dir/subdir", constants.DirPerm)).To(Succeed())
+		})
+		It("removes the given path", func() {
+			Expect(utils.SafeRemoveAll(logger, mounter, fs, "/some/dir")).To(Succeed())
+			Expect(utils.Exists(fs, "/some/dir")).To(BeFalse())
+			Expect(utils.SafeRemoveAll(logger, mounter, fs, "/some/missing")).To(Succeed())
+		})
+		It("refuses to remove empty, relative root and top level paths", func() {
+			for _, path := range []string{"", ".", "./", "..", "../some", "/", "//", "/some", "/some/dir/.."} {
+				Expect(utils.SafeRemoveAll(logger, mounter, fs, path)).To(MatchError(ContainSubstring("refusing to remove")), path)
+			}
+			Expect(utils.Exists(fs, "/some/dir")).To(BeTrue())
+		})
+		It("refuses to remove mount points or paths including them", func() {
+			Expect(mounter.Mount("/dev/device", "/some/dir/subdir", "ext4", []string{})).To(Succeed())
+			err := utils.SafeRemoveAll(logger, mounter, fs, "/some/dir/subdir")
+			Expect(err).To(MatchError(ContainSubstring("a mount point")))
+			err = utils.SafeRemoveAll(logger, mounter, fs, "/some/dir")
+			Expect(err).To(MatchError(ContainSubstring("including the mount point /some/dir/subdir")))
+			Expect(utils.Exists(fs, "/some/dir/subdir")).To(BeTrue())
+		})
+	})
 	Describe("CalcFileChecksum", Label("checksum"), func() {
 		It("compute correct sha256 checksum", func() {
 			testData := strings.Repeat("abcdefghilmnopqrstuvz\n", 20)
@@ -950,6 +1551,25 @@ var _ = Describe("Utils", Label("utils"), func() {
 			Expect(err).ShouldNot(HaveOccurred())
 			Expect(checksum).To(Equal(testDataSHA256))
 		})
+		It("computes and verifies digests of the given algorithm", func() {
+			Expect(fs.WriteFile("/test.img", []byte("Hi"), 0644)).To(Succeed())
+
+			digest, err := utils.FileDigest(fs, "/test.img", constants.SHA512)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(digest).To(MatchRegexp("^sha512:[0-9a-f]{128}$"))
+			Expect(utils.VerifyFileDigest(fs, "/test.img", digest)).To(Succeed())
+
+			// Plain checksums are identified by their length
+			algo, checksum, err := utils.ParseDigest(strings.TrimPrefix(digest, "sha512:"))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(algo).To(Equal(constants.SHA512))
+			Expect(utils.VerifyFileDigest(fs, "/test.img", checksum)).To(Succeed())
+			Expect(utils.VerifyFileDigest(fs, "/test.img", "3639efcd08abb273b1619e82e78c29a7df02c1051b1820e99fc395dcaa3326b8")).To(Succeed())
+
+			Expect(utils.VerifyFileDigest(fs, "/test.img", fmt.Sprintf("sha256:%064d", 0))).To(MatchError(ContainSubstring("checksum mismatch")))
+			_, _, err = utils.ParseDigest("blake3:" + checksum)
+			Expect(err).To(MatchError(ContainSubstring("unsupported checksum algorithm")))
+		})
 	})
 	Describe("CreateSquashFS", Label("CreateSquashFS"), func() {
 		It("runs with no options if none given", func() {
@@ -1161,6 +1781,19 @@ var _ = Describe("Utils", Label("utils"), func() {
 			Expect(onErrorCallback).To(BeTrue())
 		})
 	})
+	Describe("PhaseTimer", Label("PhaseTimer"), func() {
+		It("records phases in completion order", func() {
+			timer := utils.NewPhaseTimer(logger)
+			doneOuter := timer.Track("outer")
+			timer.Track("inner")()
+			doneOuter()
+			timings := timer.Timings()
+			Expect(len(timings)).To(Equal(2))
+			Expect(timings[0].Phase).To(Equal("inner"))
+			Expect(timings[1].Phase).To(Equal("outer"))
+			Expect(timings[1].Duration).NotTo(BeEmpty())
+		})
+	})
 	Describe("VHD utils", Label("vhd"), func() {
 		It("creates a valid header", func() {
 			tmpDir, _ := utils.TempDir(fs, "", "")
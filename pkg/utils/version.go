@@ -0,0 +1,90 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var semverRegexp = regexp.MustCompile(`^v?(\d+)(?:\.(\d+))?(?:\.(\d+))?(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+
+// CompareVersions compares two semantic versions and returns -1, 0 or 1 if a is lower,
+// equal or greater than b. Missing minor or patch numbers are taken as 0, pre-releases
+// precede their release and build metadata is ignored, as in semver 2.0.
+func CompareVersions(a, b string) (int, error) {
+	va := semverRegexp.FindStringSubmatch(strings.TrimSpace(a))
+	if va == nil {
+		return 0, fmt.Errorf("invalid semantic version '%s'", a)
+	}
+	vb := semverRegexp.FindStringSubmatch(strings.TrimSpace(b))
+	if vb == nil {
+		return 0, fmt.Errorf("invalid semantic version '%s'", b)
+	}
+
+	for i := 1; i <= 3; i++ {
+		if c := compareNumeric(va[i], vb[i]); c != 0 {
+			return c, nil
+		}
+	}
+
+	switch {
+	case va[4] == vb[4]:
+		return 0, nil
+	case va[4] == "":
+		return 1, nil
+	case vb[4] == "":
+		return -1, nil
+	}
+
+	pa, pb := strings.Split(va[4], "."), strings.Split(vb[4], ".")
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		_, errA := strconv.ParseUint(pa[i], 10, 64)
+		_, errB := strconv.ParseUint(pb[i], 10, 64)
+		var c int
+		switch {
+		case errA == nil && errB == nil:
+			c = compareNumeric(pa[i], pb[i])
+		case errA == nil:
+			// Numeric identifiers have lower precedence than alphanumeric ones
+			c = -1
+		case errB == nil:
+			c = 1
+		default:
+			c = strings.Compare(pa[i], pb[i])
+		}
+		if c != 0 {
+			return c, nil
+		}
+	}
+	return cmp.Compare(len(pa), len(pb)), nil
+}
+
+// compareNumeric compares two unsigned integers given as strings, empty strings are 0
+func compareNumeric(a, b string) int {
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}